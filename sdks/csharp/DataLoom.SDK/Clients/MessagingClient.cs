@@ -35,6 +35,12 @@ namespace DataLoom.SDK.Clients
         /// </summary>
         private ConcurrentDictionary<string, TaskCompletionSource<WebSocketResponse>> _pendingResponses = new();
 
+        /// <summary>
+        /// Dictionary of the message ID mapped to the chunks received so far for a chunked response,
+        /// which are put back together once the final chunk is received. Only used by the receive loop.
+        /// </summary>
+        private Dictionary<string, List<WebSocketResponse>> _pendingChunks = new();
+
         /// <summary>
         /// Subscription Managaer that will handle subscribing, unsubscribing and sending messages to all subscribers.
         /// </summary>
@@ -128,6 +134,7 @@ namespace DataLoom.SDK.Clients
         private async Task ReceiveLoopAsync(CancellationTokenSource cts)
         {
             var buffer = new byte[8192];
+            using var frame = new MemoryStream();
 
             try
             {
@@ -136,10 +143,21 @@ namespace DataLoom.SDK.Clients
                     var result = await _webSocket.ReceiveAsync(buffer, CancellationToken.None);
                     if (result.MessageType == WebSocketMessageType.Close) { break; }
 
-                    var json = Encoding.UTF8.GetString(buffer, 0, result.Count);
+                    // a message bigger than the buffer comes in several reads
+                    frame.Write(buffer, 0, result.Count);
+                    if (!result.EndOfMessage) { continue; }
+
+                    var json = Encoding.UTF8.GetString(frame.GetBuffer(), 0, (int)frame.Length);
+                    frame.SetLength(0);
 
                     if (TryDeserialize<WebSocketResponse>(json, out var response) && response != null && response.Type == "response")
                     {
+                        if (response.Chunk != null && !TryReassembleChunks(ref response))
+                        {
+                            // wait for the rest of the chunks
+                            continue;
+                        }
+
                         if (response != null && !string.IsNullOrWhiteSpace(response.Id) &&
                             _pendingResponses.TryRemove(response.Id, out var tcs))
                         {
@@ -290,17 +308,19 @@ namespace DataLoom.SDK.Clients
         /// </summary>
         /// <typeparam name="T">The type of the value to be retrieved.</typeparam>
         /// <param name="topicName">The name of the topic to get the value for.</param>
+        /// <param name="chunked">If the server should send a large value in chunks, which are put back together before returning.</param>
         /// <returns>Task that contains a nullable instance of the value of the topic.</returns>
         /// <exception cref="ServerException">Thrown if server responds with null response or 
         /// a non-success response code. </exception>
-        public async Task<T?> GetAsync<T>(string topicName)
+        public async Task<T?> GetAsync<T>(string topicName, bool chunked = false)
         {
             var response = await SendAndWaitForAckAsync(new WebSocketMessage<T>
             {
                 MessageId = Guid.NewGuid().ToString(),
                 Action = GET,
                 Topic = topicName,
-                RequireAck = true
+                RequireAck = true,
+                Options = chunked ? new MessageOptions { Chunked = true } : null
             }, true) ?? throw new ServerException(-1, "Recieved null response from server from get request for topic: " + topicName);
 
             ValidateResponse(response, "get request for topic: " + topicName);
@@ -486,6 +506,49 @@ namespace DataLoom.SDK.Clients
             return _webSocket.SendAsync(new ArraySegment<byte>(bytes), WebSocketMessageType.Text, true, CancellationToken.None);
         }
 
+        /// <summary>
+        /// Will hold on to a chunk of a chunked response until the final chunk is received, then
+        /// join the data of all the chunks in order into the data of the whole response.
+        /// </summary>
+        /// <param name="response">The chunk that was received. Set to the whole response once the final chunk is received.</param>
+        /// <returns>Boolean if the whole response was put back together.</returns>
+        private bool TryReassembleChunks(ref WebSocketResponse response)
+        {
+            if (!_pendingChunks.TryGetValue(response.Id, out var chunks))
+            {
+                chunks = new List<WebSocketResponse>();
+                _pendingChunks[response.Id] = chunks;
+            }
+            chunks.Add(response);
+
+            if (!response.Chunk!.Final)
+            {
+                return false;
+            }
+            _pendingChunks.Remove(response.Id);
+
+            response.Chunk = null;
+            try
+            {
+                var json = new StringBuilder();
+                foreach (var chunk in chunks.OrderBy(c => c.Chunk!.Index))
+                {
+                    json.Append(chunk.Data?.GetString());
+                }
+
+                using var document = JsonDocument.Parse(json.ToString());
+                response.Data = document.RootElement.Clone();
+            }
+            catch (Exception ex) when (ex is JsonException || ex is InvalidOperationException)
+            {
+                // a chunk was missing or wasn't a string, so fail the request instead of the receive loop
+                response.Code = -1;
+                response.Message = "Couldn't put chunked response back together: " + ex.Message;
+                response.Data = null;
+            }
+            return true;
+        }
+
         /// <summary>
         /// Will attempt to deserialize a message.
         /// </summary>
@@ -90,10 +90,11 @@ namespace DataLoom.SDK.Interfaces
         /// </summary>
         /// <typeparam name="T">The type of the value to retrieve.</typeparam>
         /// <param name="topicName">The name of the topic.</param>
+        /// <param name="chunked">If the server should send a large value in chunks, which are put back together before returning.</param>
         /// <returns>A task that completes with the value, or null if no value exists.</returns>
         /// <exception cref="ArgumentException">Thrown if the topic name is invalid.</exception>
         /// <exception cref="ServerException">Thrown if the server cannot process the get request.</exception>
-        Task<T?> GetAsync<T>(string topicName);
+        Task<T?> GetAsync<T>(string topicName, bool chunked = false);
 
         /// <summary>
         /// Registers a new topic with the specified name and schema type.
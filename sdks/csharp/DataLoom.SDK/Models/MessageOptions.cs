@@ -0,0 +1,18 @@
+using System.Text.Json.Serialization;
+
+namespace DataLoom.SDK.Models
+{
+	/// <summary>
+	/// Options that change how the server handles a particular message.
+	/// </summary>
+	public class MessageOptions
+	{
+		/// <summary>
+		/// Boolean if a large response to a get should be split into chunks
+		/// by the server. The chunks are put back together by the SDK.
+		/// </summary>
+		[JsonPropertyName("chunked")]
+		[JsonIgnore(Condition = JsonIgnoreCondition.WhenWritingDefault)]
+		public bool Chunked { get; set; }
+	}
+}
@@ -0,0 +1,16 @@
+using System.Text.Json.Serialization;
+
+namespace DataLoom.SDK.Models
+{
+    /// <summary>
+    /// Says which piece of a chunked response from the server a response is.
+    /// </summary>
+    public class ResponseChunk
+    {
+        [JsonPropertyName("index")]
+        public int Index { get; set; }
+
+        [JsonPropertyName("final")]
+        public bool Final { get; set; }
+    }
+}
@@ -43,5 +43,12 @@ namespace DataLoom.SDK.Models
 		/// </summary>
 		[JsonPropertyName("requireAck")]
 		public bool RequireAck { get; set; }
+
+		/// <summary>
+		/// Options for how the server should handle the message (if any).
+		/// </summary>
+		[JsonPropertyName("options")]
+		[JsonIgnore(Condition = JsonIgnoreCondition.WhenWritingNull)]
+		public MessageOptions? Options { get; set; }
 	}
 }
\ No newline at end of file
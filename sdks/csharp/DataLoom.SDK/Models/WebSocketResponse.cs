@@ -23,6 +23,9 @@ namespace DataLoom.SDK.Models
         [JsonPropertyName("type")]
         public string Type { get; set; } = string.Empty;
 
+        [JsonPropertyName("chunk")]
+        public ResponseChunk? Chunk { get; set; }
+
         public override string ToString()
         {
             string dataString = Data.HasValue ? Data.Value.GetRawText() : "null";
@@ -10,7 +10,8 @@ import (
 	"time"
 
 	"github.com/atyalexyoung/data-loom/server/internal/config"
-	_ "github.com/atyalexyoung/data-loom/server/internal/logging"
+	"github.com/atyalexyoung/data-loom/server/internal/logging"
+	"github.com/atyalexyoung/data-loom/server/internal/metrics"
 	"github.com/atyalexyoung/data-loom/server/internal/storage"
 	"github.com/atyalexyoung/data-loom/server/internal/topic"
 	log "github.com/sirupsen/logrus"
@@ -23,6 +24,7 @@ func main() {
 	log.Info("Entering main...")
 
 	cfg := config.Load()
+	logging.RedactFields(cfg.LogRedactFields)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -42,14 +44,56 @@ func main() {
 		return
 	}
 	defer db.Close()
+	if cfg.OtlpEndpoint != "" && cfg.OtlpTraces {
+		db = storage.NewTracedStorage(db)
+	}
+
+	ids, err := network.NewIdGenerator(cfg.IdFormat)
+	if err != nil {
+		log.Fatal("Error when setting up id generator with error: ", err)
+		return
+	}
 
 	clientHub := network.NewClientHub()
-	topicManager := topic.NewTopicManager(db)
-	wsServer := server.NewWebSocketServer(clientHub, topicManager, cfg)
+	managerOptions := []topic.ManagerOption{topic.WithIdGenerator(ids)}
+	if cfg.DefaultSchemaFile != "" {
+		defaultSchemas, err := topic.LoadDefaultSchemas(cfg.DefaultSchemaFile)
+		if err != nil {
+			log.Fatal("Error when loading default schemas with error: ", err)
+			return
+		}
+		managerOptions = append(managerOptions, topic.WithDefaultSchemas(defaultSchemas))
+	}
+	if cfg.TransformsFile != "" {
+		transforms, err := topic.LoadTransforms(cfg.TransformsFile)
+		if err != nil {
+			log.Fatal("Error when loading transforms with error: ", err)
+			return
+		}
+		managerOptions = append(managerOptions, transforms...)
+	}
+	topicManager := topic.NewTopicManager(db, cfg, managerOptions...)
+	if cfg.SeedFile != "" {
+		if _, err := topic.SeedFromFile(topicManager, cfg.SeedFile); err != nil {
+			log.Fatal("Error when seeding topics with error: ", err)
+			return
+		}
+	}
+	topicManager.StartIdleExpiry(ctx)
+	wsServer := server.NewWebSocketServer(clientHub, topicManager, cfg, server.WithIdGenerator(ids))
+	go wsServer.ListenForClientFailuresFromTopicManager()
+	wsServer.StartClientCleanupCrew(ctx)
+	if cfg.OtlpEndpoint != "" {
+		if err := metrics.StartOtlp(ctx, wsServer.Metrics(), cfg.OtlpEndpoint, cfg.OtlpExportInterval, cfg.OtlpTraces); err != nil {
+			log.Fatal("Error when setting up OpenTelemetry export with error: ", err)
+			return
+		}
+	}
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.PortNumber),
-		Handler: wsServer.Handler(),
+		Addr:              fmt.Sprintf(":%d", cfg.PortNumber),
+		Handler:           wsServer.Handler(),
+		ReadHeaderTimeout: cfg.HandshakeTimeout,
 	}
 
 	go func() {
@@ -61,9 +105,30 @@ func main() {
 
 	<-ctx.Done()
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, shutdownCancel := shutdownContext(cfg)
 	defer shutdownCancel()
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Error("Server forced to shutdown: ", err)
 	}
+
+	// end of run diagnostics
+	summary := wsServer.Metrics().Summary(time.Now())
+	log.WithFields(log.Fields{
+		"uptime":         summary.Uptime.String(),
+		"total_messages": summary.TotalMessages,
+		"actions":        summary.Actions,
+	}).Info("shutdown summary")
+
+	if err := wsServer.Metrics().Flush(shutdownCtx); err != nil {
+		log.Error("Error when flushing metrics on shutdown: ", err)
+	}
+	if err := wsServer.Close(); err != nil {
+		log.Error("Error when closing server resources on shutdown: ", err)
+	}
+	logging.Flush()
+}
+
+// shutdownContext will return the context that shutting down has to finish within.
+func shutdownContext(cfg *config.Config) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 }
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+)
+
+func TestShutdownContext_UsesConfiguredTimeout(t *testing.T) {
+	before := time.Now()
+	ctx, cancel := shutdownContext(&config.Config{ShutdownTimeout: 250 * time.Millisecond})
+	defer cancel()
+	after := time.Now()
+
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	assert.False(t, deadline.Before(before.Add(250*time.Millisecond)))
+	assert.False(t, deadline.After(after.Add(250*time.Millisecond)))
+}
@@ -1,17 +1,79 @@
 package config
 
 import (
+	"fmt"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	APIKey      string
-	StorageType string
-	StoragePath string
-	PortNumber  int
+	APIKey         string
+	AdminAPIKey    string
+	APIKeyPrefixes map[string]string // more api keys, each confined to the topics starting with its prefix
+	StorageType    string
+	StoragePath    string
+	PortNumber     int
+
+	HandshakeTimeout  time.Duration
+	ShutdownTimeout   time.Duration
+	AccessLogPath     string
+	LogRedactFields   []string // names of fields whose values are replaced in logs, empty redacts nothing
+	SeedFile          string
+	DefaultSchemaFile string // json file of the schemas topics registered on their own get, empty infers them from the first value
+	TransformsFile    string // json file of the transforms values published to matching topics go through, empty transforms nothing
+
+	ReadBufferSize  int  // bytes of the buffer each connection reads frames into
+	WriteBufferSize int  // bytes of the buffer each connection writes frames from
+	WriteBufferPool bool // share write buffers between connections instead of each keeping its own
+	Compression     bool // negotiate permessage-deflate compression with clients that offer it
+	HandlerWorkers  int  // goroutines shared by all connections to run handlers on, 0 runs them on each connection's read loop
+
+	FailedClientsBuffer int           // how many failed sends to clients can be queued for the server to count
+	FailedClientsWait   time.Duration // how long a failed send waits for room in a full queue before it's dropped, 0 drops it right away
+	FailedClientsGrace  time.Duration // how long a client's failures have to go on before it's evicted, 0 evicts it once it passes the threshold
+
+	MaxSubscriptionsPerClient int
+	OverflowPolicy            string
+	MaxNestingDepth           int
+	MaxPatternResults         int
+	ChunkSize                 int // bytes of data in each response of a chunked get or getRecent
+	MaxPayloadSize            int // most bytes a published value can be for topics that don't set their own, 0 is unlimited
+	MaxSchemaVersions         int
+	MaxTopics                 int // most topics that can be registered at once, 0 is unlimited
+	MaxConcurrentSends        int // most sends to subscribers that can run at once across all topics, 0 is unlimited
+	DisabledActions           []string
+	RequireRegisteredTopic    bool          // false lets publish and subscribe create missing topics with no schema
+	AllowedTopicPatterns      []string      // glob patterns topic names must match to be registered, empty allows any name
+	WebhookAllowedHosts       []string      // hosts topics can post their webhooks to, empty doesn't allow webhooks
+	TopicIdleExpiry           time.Duration // unregister topics with no subscribers and no activity for this long, 0 never does
+	TopicIdleExpiryPurge      bool          // delete the stored value of topics unregistered for being idle
+	PresenceEvents            bool          // tell subscribers when other clients subscribe to or unsubscribe from a topic
+	ReadOnly                  bool          // start in read only mode, rejecting actions that change topics or stored values
+	SubscriptionRestoreWindow time.Duration // how long a disconnected client's subscriptions are kept to restore when it reconnects with the same id, 0 doesn't keep them
+	ReconnectTokenTTL         time.Duration // how long a disconnected client's reconnect token is accepted, 0 doesn't issue tokens
+	IdFormat                  string        // format of the client and message ids the server makes, "uuid" or "sortable"
+
+	SqliteJournalMode string
+	SqliteSynchronous string
+	SqliteBusyTimeout time.Duration
+
+	StorageWriteRetries int
+	StorageRetryBackoff time.Duration
+	GetReadThrough      bool
+
+	StorageDegradedQueueDepth int           // queued writes at which storage is reported degraded, 0 never is for depth
+	StorageDegradedLatency    time.Duration // write latency at which storage is reported degraded, 0 never is for latency
+
+	OtlpEndpoint       string        // base url of an OpenTelemetry collector to export metrics to over OTLP/HTTP, empty doesn't export
+	OtlpTraces         bool          // export spans for each handled message to the collector too
+	OtlpExportInterval time.Duration // how often metrics are exported to the collector
 }
 
 func Load() *Config {
@@ -27,13 +89,41 @@ func Load() *Config {
 		cfg.APIKey = ""
 	}
 
+	// ADMIN API KEY
+	if adminKey := os.Getenv("ADMIN_API_KEY"); adminKey != "" {
+		log.Debug("Successfully read admin api key from config")
+		cfg.AdminAPIKey = adminKey
+	} else {
+		log.Debug("Couldn't read admin api key from config. Admin endpoints are disabled")
+		cfg.AdminAPIKey = ""
+	}
+
+	// API KEY PREFIXES
+	if keyPrefixes := os.Getenv("API_KEY_PREFIXES"); keyPrefixes != "" {
+		prefixes, err := parseAPIKeyPrefixes(keyPrefixes, cfg.APIKey)
+		if err != nil {
+			log.Fatalf("Invalid API_KEY_PREFIXES: %v", err)
+		}
+		log.Debugf("Successfully read %d api keys with topic prefixes from config", len(prefixes))
+		cfg.APIKeyPrefixes = prefixes
+	} else {
+		log.Debug("API_KEY_PREFIXES not set. No api keys are confined to a topic prefix")
+		cfg.APIKeyPrefixes = nil
+	}
+
 	// STORAGE TYPE
 	if sType := os.Getenv("STORAGE_TYPE"); sType != "" {
+		sType = strings.ToLower(strings.TrimSpace(sType))
+		switch sType {
+		case "badger", "sqlite", "none":
+		default:
+			log.Fatalf("Invalid STORAGE_TYPE: %s. Must be badger, sqlite, or none.", sType)
+		}
 		log.Debugf("Successfully read storage type as: %s", sType)
 		cfg.StorageType = sType
 	} else {
-		log.Debugf("Couldn't read storage type. Setting as default of blank string for no-persistence.")
-		cfg.StorageType = ""
+		log.Debugf("Couldn't read storage type. Setting as default of none for no-persistence.")
+		cfg.StorageType = "none"
 	}
 
 	// STORAGE PATH
@@ -58,5 +148,633 @@ func Load() *Config {
 		cfg.PortNumber = 8080
 	}
 
+	// HANDSHAKE TIMEOUT
+	if handshakeTimeout := os.Getenv("HANDSHAKE_TIMEOUT"); handshakeTimeout != "" {
+		d, err := time.ParseDuration(handshakeTimeout)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid HANDSHAKE_TIMEOUT: %s. Must be a positive duration such as 10s.", handshakeTimeout)
+		}
+		log.Debugf("Successfully read HANDSHAKE_TIMEOUT from config as: %s", handshakeTimeout)
+		cfg.HandshakeTimeout = d
+	} else {
+		log.Debug("HANDSHAKE_TIMEOUT not set. Using default of 10s")
+		cfg.HandshakeTimeout = 10 * time.Second
+	}
+
+	// SHUTDOWN TIMEOUT
+	if shutdownTimeout := os.Getenv("SHUTDOWN_TIMEOUT"); shutdownTimeout != "" {
+		d, err := time.ParseDuration(shutdownTimeout)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid SHUTDOWN_TIMEOUT: %s. Must be a positive duration such as 5s.", shutdownTimeout)
+		}
+		log.Debugf("Successfully read SHUTDOWN_TIMEOUT from config as: %s", shutdownTimeout)
+		cfg.ShutdownTimeout = d
+	} else {
+		log.Debug("SHUTDOWN_TIMEOUT not set. Using default of 5s")
+		cfg.ShutdownTimeout = 5 * time.Second
+	}
+
+	// READ BUFFER SIZE
+	if readBuffer := os.Getenv("READ_BUFFER_SIZE"); readBuffer != "" {
+		r, err := strconv.Atoi(readBuffer)
+		if err != nil || r < 1 {
+			log.Fatalf("Invalid READ_BUFFER_SIZE: %s. Must be 1 or greater.", readBuffer)
+		}
+		log.Debugf("Successfully read READ_BUFFER_SIZE from config as: %s", readBuffer)
+		cfg.ReadBufferSize = r
+	} else {
+		log.Debug("READ_BUFFER_SIZE not set. Using default of 4096")
+		cfg.ReadBufferSize = 4096
+	}
+
+	// WRITE BUFFER SIZE
+	if writeBuffer := os.Getenv("WRITE_BUFFER_SIZE"); writeBuffer != "" {
+		w, err := strconv.Atoi(writeBuffer)
+		if err != nil || w < 1 {
+			log.Fatalf("Invalid WRITE_BUFFER_SIZE: %s. Must be 1 or greater.", writeBuffer)
+		}
+		log.Debugf("Successfully read WRITE_BUFFER_SIZE from config as: %s", writeBuffer)
+		cfg.WriteBufferSize = w
+	} else {
+		log.Debug("WRITE_BUFFER_SIZE not set. Using default of 4096")
+		cfg.WriteBufferSize = 4096
+	}
+
+	// WRITE BUFFER POOL
+	if writePool := os.Getenv("WRITE_BUFFER_POOL"); writePool != "" {
+		b, err := strconv.ParseBool(writePool)
+		if err != nil {
+			log.Fatalf("Invalid WRITE_BUFFER_POOL: %s. Must be true or false.", writePool)
+		}
+		log.Debugf("Successfully read WRITE_BUFFER_POOL from config as: %s", writePool)
+		cfg.WriteBufferPool = b
+	} else {
+		log.Debug("WRITE_BUFFER_POOL not set. Using default of false")
+		cfg.WriteBufferPool = false
+	}
+
+	// WEBSOCKET COMPRESSION
+	if compression := os.Getenv("WEBSOCKET_COMPRESSION"); compression != "" {
+		b, err := strconv.ParseBool(compression)
+		if err != nil {
+			log.Fatalf("Invalid WEBSOCKET_COMPRESSION: %s. Must be true or false.", compression)
+		}
+		log.Debugf("Successfully read WEBSOCKET_COMPRESSION from config as: %s", compression)
+		cfg.Compression = b
+	} else {
+		log.Debug("WEBSOCKET_COMPRESSION not set. Using default of false")
+		cfg.Compression = false
+	}
+
+	// ACCESS LOG PATH
+	if accessLogPath := os.Getenv("ACCESS_LOG_PATH"); accessLogPath != "" {
+		log.Debugf("Successfully read ACCESS_LOG_PATH from config as: %s", accessLogPath)
+		cfg.AccessLogPath = accessLogPath
+	} else {
+		log.Debug("ACCESS_LOG_PATH not set. Access logging is disabled")
+		cfg.AccessLogPath = ""
+	}
+
+	// LOG REDACT FIELDS
+	if redact := os.Getenv("LOG_REDACT_FIELDS"); redact != "" {
+		for _, field := range strings.Split(redact, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				cfg.LogRedactFields = append(cfg.LogRedactFields, field)
+			}
+		}
+		log.Debugf("Successfully read LOG_REDACT_FIELDS from config as: %v", cfg.LogRedactFields)
+	} else {
+		log.Debug("LOG_REDACT_FIELDS not set. Nothing is redacted from logs")
+		cfg.LogRedactFields = nil
+	}
+
+	// SEED FILE
+	if seedFile := os.Getenv("SEED_FILE"); seedFile != "" {
+		log.Debugf("Successfully read SEED_FILE from config as: %s", seedFile)
+		cfg.SeedFile = seedFile
+	} else {
+		log.Debug("SEED_FILE not set. No topics will be seeded at startup")
+		cfg.SeedFile = ""
+	}
+
+	// DEFAULT SCHEMA FILE
+	if defaultSchemaFile := os.Getenv("DEFAULT_SCHEMA_FILE"); defaultSchemaFile != "" {
+		log.Debugf("Successfully read DEFAULT_SCHEMA_FILE from config as: %s", defaultSchemaFile)
+		cfg.DefaultSchemaFile = defaultSchemaFile
+	} else {
+		log.Debug("DEFAULT_SCHEMA_FILE not set. Auto registered topics will get their schema from the first value")
+		cfg.DefaultSchemaFile = ""
+	}
+
+	// TRANSFORMS FILE
+	if transformsFile := os.Getenv("TRANSFORMS_FILE"); transformsFile != "" {
+		log.Debugf("Successfully read TRANSFORMS_FILE from config as: %s", transformsFile)
+		cfg.TransformsFile = transformsFile
+	} else {
+		log.Debug("TRANSFORMS_FILE not set. Published values won't be transformed")
+		cfg.TransformsFile = ""
+	}
+
+	// MAX SUBSCRIPTIONS PER CLIENT
+	if maxSubs := os.Getenv("MAX_SUBSCRIPTIONS_PER_CLIENT"); maxSubs != "" {
+		m, err := strconv.Atoi(maxSubs)
+		if err != nil || m < 0 {
+			log.Fatalf("Invalid MAX_SUBSCRIPTIONS_PER_CLIENT: %s. Must be 0 or greater.", maxSubs)
+		}
+		log.Debugf("Successfully read MAX_SUBSCRIPTIONS_PER_CLIENT from config as: %s", maxSubs)
+		cfg.MaxSubscriptionsPerClient = m
+	} else {
+		log.Debug("MAX_SUBSCRIPTIONS_PER_CLIENT not set. Using default of 0 for unlimited")
+		cfg.MaxSubscriptionsPerClient = 0
+	}
+
+	// OVERFLOW POLICY
+	if policy := os.Getenv("OVERFLOW_POLICY"); policy != "" {
+		policy = strings.TrimSpace(policy)
+		switch policy {
+		case "dropOldest", "dropNewest", "disconnect":
+		default:
+			log.Fatalf("Invalid OVERFLOW_POLICY: %s. Must be dropOldest, dropNewest, or disconnect.", policy)
+		}
+		log.Debugf("Successfully read OVERFLOW_POLICY from config as: %s", policy)
+		cfg.OverflowPolicy = policy
+	} else {
+		log.Debug("OVERFLOW_POLICY not set. Using default of disconnect")
+		cfg.OverflowPolicy = "disconnect"
+	}
+
+	// MAX NESTING DEPTH
+	if maxDepth := os.Getenv("MAX_NESTING_DEPTH"); maxDepth != "" {
+		d, err := strconv.Atoi(maxDepth)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid MAX_NESTING_DEPTH: %s. Must be 0 or greater.", maxDepth)
+		}
+		log.Debugf("Successfully read MAX_NESTING_DEPTH from config as: %s", maxDepth)
+		cfg.MaxNestingDepth = d
+	} else {
+		log.Debug("MAX_NESTING_DEPTH not set. Using default of 32")
+		cfg.MaxNestingDepth = 32
+	}
+
+	// MAX PATTERN RESULTS
+	if maxResults := os.Getenv("MAX_PATTERN_RESULTS"); maxResults != "" {
+		m, err := strconv.Atoi(maxResults)
+		if err != nil || m < 0 {
+			log.Fatalf("Invalid MAX_PATTERN_RESULTS: %s. Must be 0 or greater.", maxResults)
+		}
+		log.Debugf("Successfully read MAX_PATTERN_RESULTS from config as: %s", maxResults)
+		cfg.MaxPatternResults = m
+	} else {
+		log.Debug("MAX_PATTERN_RESULTS not set. Using default of 1000")
+		cfg.MaxPatternResults = 1000
+	}
+
+	// CHUNK SIZE
+	if chunkSize := os.Getenv("CHUNK_SIZE"); chunkSize != "" {
+		c, err := strconv.Atoi(chunkSize)
+		if err != nil || c < utf8.UTFMax { // a chunk has to fit any character, since they aren't split
+			log.Fatalf("Invalid CHUNK_SIZE: %s. Must be %d or greater.", chunkSize, utf8.UTFMax)
+		}
+		log.Debugf("Successfully read CHUNK_SIZE from config as: %s", chunkSize)
+		cfg.ChunkSize = c
+	} else {
+		log.Debug("CHUNK_SIZE not set. Using default of 65536")
+		cfg.ChunkSize = 65536
+	}
+
+	// MAX PAYLOAD SIZE
+	if maxPayload := os.Getenv("MAX_PAYLOAD_SIZE"); maxPayload != "" {
+		m, err := strconv.Atoi(maxPayload)
+		if err != nil || m < 0 {
+			log.Fatalf("Invalid MAX_PAYLOAD_SIZE: %s. Must be 0 or greater.", maxPayload)
+		}
+		log.Debugf("Successfully read MAX_PAYLOAD_SIZE from config as: %s", maxPayload)
+		cfg.MaxPayloadSize = m
+	} else {
+		log.Debug("MAX_PAYLOAD_SIZE not set. Using default of 0 for unlimited")
+		cfg.MaxPayloadSize = 0
+	}
+
+	// MAX SCHEMA VERSIONS
+	if maxVersions := os.Getenv("MAX_SCHEMA_VERSIONS"); maxVersions != "" {
+		m, err := strconv.Atoi(maxVersions)
+		if err != nil || m < 0 {
+			log.Fatalf("Invalid MAX_SCHEMA_VERSIONS: %s. Must be 0 or greater.", maxVersions)
+		}
+		log.Debugf("Successfully read MAX_SCHEMA_VERSIONS from config as: %s", maxVersions)
+		cfg.MaxSchemaVersions = m
+	} else {
+		log.Debug("MAX_SCHEMA_VERSIONS not set. Using default of 0 for unlimited")
+		cfg.MaxSchemaVersions = 0
+	}
+
+	// MAX TOPICS
+	if maxTopics := os.Getenv("MAX_TOPICS"); maxTopics != "" {
+		m, err := strconv.Atoi(maxTopics)
+		if err != nil || m < 0 {
+			log.Fatalf("Invalid MAX_TOPICS: %s. Must be 0 or greater.", maxTopics)
+		}
+		log.Debugf("Successfully read MAX_TOPICS from config as: %s", maxTopics)
+		cfg.MaxTopics = m
+	} else {
+		log.Debug("MAX_TOPICS not set. Using default of 0 for unlimited")
+		cfg.MaxTopics = 0
+	}
+
+	// MAX CONCURRENT SENDS
+	if maxSends := os.Getenv("MAX_CONCURRENT_SENDS"); maxSends != "" {
+		m, err := strconv.Atoi(maxSends)
+		if err != nil || m < 0 {
+			log.Fatalf("Invalid MAX_CONCURRENT_SENDS: %s. Must be 0 or greater.", maxSends)
+		}
+		log.Debugf("Successfully read MAX_CONCURRENT_SENDS from config as: %s", maxSends)
+		cfg.MaxConcurrentSends = m
+	} else {
+		log.Debug("MAX_CONCURRENT_SENDS not set. Using default of 0 for unlimited")
+		cfg.MaxConcurrentSends = 0
+	}
+
+	// DISABLED ACTIONS
+	if disabled := os.Getenv("DISABLED_ACTIONS"); disabled != "" {
+		for _, action := range strings.Split(disabled, ",") {
+			if action = strings.TrimSpace(action); action != "" {
+				cfg.DisabledActions = append(cfg.DisabledActions, action)
+			}
+		}
+		log.Debugf("Successfully read DISABLED_ACTIONS from config as: %v", cfg.DisabledActions)
+	} else {
+		log.Debug("DISABLED_ACTIONS not set. All actions are enabled")
+		cfg.DisabledActions = nil
+	}
+
+	// ALLOWED TOPIC PATTERNS
+	if allowed := os.Getenv("ALLOWED_TOPIC_PATTERNS"); allowed != "" {
+		for _, pattern := range strings.Split(allowed, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Fatalf("Invalid ALLOWED_TOPIC_PATTERNS: %q is not a valid pattern: %v", pattern, err)
+			}
+			cfg.AllowedTopicPatterns = append(cfg.AllowedTopicPatterns, pattern)
+		}
+		log.Debugf("Successfully read ALLOWED_TOPIC_PATTERNS from config as: %v", cfg.AllowedTopicPatterns)
+	} else {
+		log.Debug("ALLOWED_TOPIC_PATTERNS not set. Any topic name can be registered")
+		cfg.AllowedTopicPatterns = nil
+	}
+
+	// WEBHOOK ALLOWED HOSTS
+	if hosts := os.Getenv("WEBHOOK_ALLOWED_HOSTS"); hosts != "" {
+		for _, host := range strings.Split(hosts, ",") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host == "" {
+				continue
+			}
+			if strings.ContainsAny(host, "/?#@") {
+				log.Fatalf("Invalid WEBHOOK_ALLOWED_HOSTS: %q must be a host or host:port, not a url", host)
+			}
+			cfg.WebhookAllowedHosts = append(cfg.WebhookAllowedHosts, host)
+		}
+		log.Debugf("Successfully read WEBHOOK_ALLOWED_HOSTS from config as: %v", cfg.WebhookAllowedHosts)
+	} else {
+		log.Debug("WEBHOOK_ALLOWED_HOSTS not set. Topics can't be registered with webhooks")
+		cfg.WebhookAllowedHosts = nil
+	}
+
+	// SQLITE JOURNAL MODE
+	if journalMode := os.Getenv("SQLITE_JOURNAL_MODE"); journalMode != "" {
+		journalMode = strings.ToUpper(journalMode)
+		switch journalMode {
+		case "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+		default:
+			log.Fatalf("Invalid SQLITE_JOURNAL_MODE: %s. Must be DELETE, TRUNCATE, PERSIST, MEMORY, WAL, or OFF.", journalMode)
+		}
+		log.Debugf("Successfully read SQLITE_JOURNAL_MODE from config as: %s", journalMode)
+		cfg.SqliteJournalMode = journalMode
+	} else {
+		log.Debug("SQLITE_JOURNAL_MODE not set. Using default of DELETE")
+		cfg.SqliteJournalMode = "DELETE"
+	}
+
+	// SQLITE SYNCHRONOUS
+	if synchronous := os.Getenv("SQLITE_SYNCHRONOUS"); synchronous != "" {
+		synchronous = strings.ToUpper(synchronous)
+		switch synchronous {
+		case "OFF", "NORMAL", "FULL", "EXTRA":
+		default:
+			log.Fatalf("Invalid SQLITE_SYNCHRONOUS: %s. Must be OFF, NORMAL, FULL, or EXTRA.", synchronous)
+		}
+		log.Debugf("Successfully read SQLITE_SYNCHRONOUS from config as: %s", synchronous)
+		cfg.SqliteSynchronous = synchronous
+	} else {
+		log.Debug("SQLITE_SYNCHRONOUS not set. Using default of FULL")
+		cfg.SqliteSynchronous = "FULL"
+	}
+
+	// SQLITE BUSY TIMEOUT
+	if busyTimeout := os.Getenv("SQLITE_BUSY_TIMEOUT"); busyTimeout != "" {
+		d, err := time.ParseDuration(busyTimeout)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid SQLITE_BUSY_TIMEOUT: %s. Must be a duration such as 5s.", busyTimeout)
+		}
+		log.Debugf("Successfully read SQLITE_BUSY_TIMEOUT from config as: %s", busyTimeout)
+		cfg.SqliteBusyTimeout = d
+	} else {
+		log.Debug("SQLITE_BUSY_TIMEOUT not set. Using default of 5s")
+		cfg.SqliteBusyTimeout = 5 * time.Second
+	}
+
+	// STORAGE WRITE RETRIES
+	if retries := os.Getenv("STORAGE_WRITE_RETRIES"); retries != "" {
+		r, err := strconv.Atoi(retries)
+		if err != nil || r < 0 {
+			log.Fatalf("Invalid STORAGE_WRITE_RETRIES: %s. Must be 0 or greater.", retries)
+		}
+		log.Debugf("Successfully read STORAGE_WRITE_RETRIES from config as: %s", retries)
+		cfg.StorageWriteRetries = r
+	} else {
+		log.Debug("STORAGE_WRITE_RETRIES not set. Using default of 3")
+		cfg.StorageWriteRetries = 3
+	}
+
+	// STORAGE RETRY BACKOFF
+	if backoff := os.Getenv("STORAGE_RETRY_BACKOFF"); backoff != "" {
+		d, err := time.ParseDuration(backoff)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid STORAGE_RETRY_BACKOFF: %s. Must be a duration such as 50ms.", backoff)
+		}
+		log.Debugf("Successfully read STORAGE_RETRY_BACKOFF from config as: %s", backoff)
+		cfg.StorageRetryBackoff = d
+	} else {
+		log.Debug("STORAGE_RETRY_BACKOFF not set. Using default of 50ms")
+		cfg.StorageRetryBackoff = 50 * time.Millisecond
+	}
+
+	// STORAGE DEGRADED QUEUE DEPTH
+	if depth := os.Getenv("STORAGE_DEGRADED_QUEUE_DEPTH"); depth != "" {
+		d, err := strconv.Atoi(depth)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid STORAGE_DEGRADED_QUEUE_DEPTH: %s. Must be 0 or greater.", depth)
+		}
+		log.Debugf("Successfully read STORAGE_DEGRADED_QUEUE_DEPTH from config as: %s", depth)
+		cfg.StorageDegradedQueueDepth = d
+	} else {
+		log.Debug("STORAGE_DEGRADED_QUEUE_DEPTH not set. Using default of 1000")
+		cfg.StorageDegradedQueueDepth = 1000
+	}
+
+	// STORAGE DEGRADED LATENCY
+	if latency := os.Getenv("STORAGE_DEGRADED_LATENCY"); latency != "" {
+		d, err := time.ParseDuration(latency)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid STORAGE_DEGRADED_LATENCY: %s. Must be a duration such as 2s.", latency)
+		}
+		log.Debugf("Successfully read STORAGE_DEGRADED_LATENCY from config as: %s", latency)
+		cfg.StorageDegradedLatency = d
+	} else {
+		log.Debug("STORAGE_DEGRADED_LATENCY not set. Using default of 2s")
+		cfg.StorageDegradedLatency = 2 * time.Second
+	}
+
+	// GET READ THROUGH
+	if readThrough := os.Getenv("GET_READ_THROUGH"); readThrough != "" {
+		b, err := strconv.ParseBool(readThrough)
+		if err != nil {
+			log.Fatalf("Invalid GET_READ_THROUGH: %s. Must be true or false.", readThrough)
+		}
+		log.Debugf("Successfully read GET_READ_THROUGH from config as: %s", readThrough)
+		cfg.GetReadThrough = b
+	} else {
+		log.Debug("GET_READ_THROUGH not set. Using default of false")
+		cfg.GetReadThrough = false
+	}
+
+	// REQUIRE REGISTERED TOPIC
+	if requireRegistered := os.Getenv("REQUIRE_REGISTERED_TOPIC"); requireRegistered != "" {
+		b, err := strconv.ParseBool(requireRegistered)
+		if err != nil {
+			log.Fatalf("Invalid REQUIRE_REGISTERED_TOPIC: %s. Must be true or false.", requireRegistered)
+		}
+		log.Debugf("Successfully read REQUIRE_REGISTERED_TOPIC from config as: %s", requireRegistered)
+		cfg.RequireRegisteredTopic = b
+	} else {
+		log.Debug("REQUIRE_REGISTERED_TOPIC not set. Using default of true")
+		cfg.RequireRegisteredTopic = true
+	}
+
+	// TOPIC IDLE EXPIRY
+	if idleExpiry := os.Getenv("TOPIC_IDLE_EXPIRY"); idleExpiry != "" {
+		d, err := time.ParseDuration(idleExpiry)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid TOPIC_IDLE_EXPIRY: %s. Must be a duration such as 24h, or 0 to never expire topics.", idleExpiry)
+		}
+		log.Debugf("Successfully read TOPIC_IDLE_EXPIRY from config as: %s", idleExpiry)
+		cfg.TopicIdleExpiry = d
+	} else {
+		log.Debug("TOPIC_IDLE_EXPIRY not set. Idle topics never expire")
+		cfg.TopicIdleExpiry = 0
+	}
+
+	// TOPIC IDLE EXPIRY PURGE
+	if purge := os.Getenv("TOPIC_IDLE_EXPIRY_PURGE"); purge != "" {
+		b, err := strconv.ParseBool(purge)
+		if err != nil {
+			log.Fatalf("Invalid TOPIC_IDLE_EXPIRY_PURGE: %s. Must be true or false.", purge)
+		}
+		log.Debugf("Successfully read TOPIC_IDLE_EXPIRY_PURGE from config as: %s", purge)
+		cfg.TopicIdleExpiryPurge = b
+	} else {
+		log.Debug("TOPIC_IDLE_EXPIRY_PURGE not set. Using default of false")
+		cfg.TopicIdleExpiryPurge = false
+	}
+
+	// PRESENCE EVENTS
+	if presence := os.Getenv("PRESENCE_EVENTS"); presence != "" {
+		b, err := strconv.ParseBool(presence)
+		if err != nil {
+			log.Fatalf("Invalid PRESENCE_EVENTS: %s. Must be true or false.", presence)
+		}
+		log.Debugf("Successfully read PRESENCE_EVENTS from config as: %s", presence)
+		cfg.PresenceEvents = b
+	} else {
+		log.Debug("PRESENCE_EVENTS not set. Using default of false")
+		cfg.PresenceEvents = false
+	}
+
+	// HANDLER WORKERS
+	if handlerWorkers := os.Getenv("HANDLER_WORKERS"); handlerWorkers != "" {
+		w, err := strconv.Atoi(handlerWorkers)
+		if err != nil || w < 0 {
+			log.Fatalf("Invalid HANDLER_WORKERS: %s. Must be 0 or greater.", handlerWorkers)
+		}
+		log.Debugf("Successfully read HANDLER_WORKERS from config as: %s", handlerWorkers)
+		cfg.HandlerWorkers = w
+	} else {
+		log.Debug("HANDLER_WORKERS not set. Using default of 0 to run handlers on each connection's read loop")
+		cfg.HandlerWorkers = 0
+	}
+
+	// FAILED CLIENTS BUFFER
+	if buffer := os.Getenv("FAILED_CLIENTS_BUFFER"); buffer != "" {
+		b, err := strconv.Atoi(buffer)
+		if err != nil || b < 1 {
+			log.Fatalf("Invalid FAILED_CLIENTS_BUFFER: %s. Must be 1 or greater.", buffer)
+		}
+		log.Debugf("Successfully read FAILED_CLIENTS_BUFFER from config as: %s", buffer)
+		cfg.FailedClientsBuffer = b
+	} else {
+		log.Debug("FAILED_CLIENTS_BUFFER not set. Using default of 100")
+		cfg.FailedClientsBuffer = 100
+	}
+
+	// FAILED CLIENTS WAIT
+	if wait := os.Getenv("FAILED_CLIENTS_WAIT"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid FAILED_CLIENTS_WAIT: %s. Must be a duration such as 50ms, or 0 to not wait.", wait)
+		}
+		log.Debugf("Successfully read FAILED_CLIENTS_WAIT from config as: %s", wait)
+		cfg.FailedClientsWait = d
+	} else {
+		log.Debug("FAILED_CLIENTS_WAIT not set. Using default of 50ms")
+		cfg.FailedClientsWait = 50 * time.Millisecond
+	}
+
+	// FAILED CLIENTS GRACE
+	if grace := os.Getenv("FAILED_CLIENTS_GRACE"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid FAILED_CLIENTS_GRACE: %s. Must be a duration such as 1m, or 0 for no grace period.", grace)
+		}
+		log.Debugf("Successfully read FAILED_CLIENTS_GRACE from config as: %s", grace)
+		cfg.FailedClientsGrace = d
+	} else {
+		log.Debug("FAILED_CLIENTS_GRACE not set. Using default of 0")
+		cfg.FailedClientsGrace = 0
+	}
+
+	// SUBSCRIPTION RESTORE WINDOW
+	if restoreWindow := os.Getenv("SUBSCRIPTION_RESTORE_WINDOW"); restoreWindow != "" {
+		d, err := time.ParseDuration(restoreWindow)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid SUBSCRIPTION_RESTORE_WINDOW: %s. Must be a duration such as 30s, or 0 to not restore subscriptions.", restoreWindow)
+		}
+		log.Debugf("Successfully read SUBSCRIPTION_RESTORE_WINDOW from config as: %s", restoreWindow)
+		cfg.SubscriptionRestoreWindow = d
+	} else {
+		log.Debug("SUBSCRIPTION_RESTORE_WINDOW not set. Subscriptions aren't restored on reconnect")
+		cfg.SubscriptionRestoreWindow = 0
+	}
+
+	// RECONNECT TOKEN TTL
+	if tokenTTL := os.Getenv("RECONNECT_TOKEN_TTL"); tokenTTL != "" {
+		d, err := time.ParseDuration(tokenTTL)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid RECONNECT_TOKEN_TTL: %s. Must be a duration such as 1m, or 0 to not issue reconnect tokens.", tokenTTL)
+		}
+		log.Debugf("Successfully read RECONNECT_TOKEN_TTL from config as: %s", tokenTTL)
+		cfg.ReconnectTokenTTL = d
+	} else {
+		log.Debug("RECONNECT_TOKEN_TTL not set. Reconnect tokens aren't issued")
+		cfg.ReconnectTokenTTL = 0
+	}
+
+	// ID FORMAT
+	if idFormat := os.Getenv("ID_FORMAT"); idFormat != "" {
+		idFormat = strings.TrimSpace(idFormat)
+		switch idFormat {
+		case "uuid", "sortable":
+		default:
+			log.Fatalf("Invalid ID_FORMAT: %s. Must be uuid or sortable.", idFormat)
+		}
+		log.Debugf("Successfully read ID_FORMAT from config as: %s", idFormat)
+		cfg.IdFormat = idFormat
+	} else {
+		log.Debug("ID_FORMAT not set. Using default of uuid")
+		cfg.IdFormat = "uuid"
+	}
+
+	// READ ONLY
+	if readOnly := os.Getenv("READ_ONLY"); readOnly != "" {
+		b, err := strconv.ParseBool(readOnly)
+		if err != nil {
+			log.Fatalf("Invalid READ_ONLY: %s. Must be true or false.", readOnly)
+		}
+		log.Debugf("Successfully read READ_ONLY from config as: %s", readOnly)
+		cfg.ReadOnly = b
+	} else {
+		log.Debug("READ_ONLY not set. Using default of false")
+		cfg.ReadOnly = false
+	}
+
+	// OTLP ENDPOINT
+	if endpoint := os.Getenv("OTLP_ENDPOINT"); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid OTLP_ENDPOINT: %s. Must be an http or https url such as http://localhost:4318.", endpoint)
+		}
+		log.Debugf("Successfully read OTLP_ENDPOINT from config as: %s", endpoint)
+		cfg.OtlpEndpoint = endpoint
+	} else {
+		log.Debug("OTLP_ENDPOINT not set. Metrics aren't exported to an OpenTelemetry collector")
+		cfg.OtlpEndpoint = ""
+	}
+
+	// OTLP TRACES
+	if traces := os.Getenv("OTLP_TRACES"); traces != "" {
+		b, err := strconv.ParseBool(traces)
+		if err != nil {
+			log.Fatalf("Invalid OTLP_TRACES: %s. Must be true or false.", traces)
+		}
+		log.Debugf("Successfully read OTLP_TRACES from config as: %s", traces)
+		cfg.OtlpTraces = b
+	} else {
+		log.Debug("OTLP_TRACES not set. Using default of false")
+		cfg.OtlpTraces = false
+	}
+
+	// OTLP EXPORT INTERVAL
+	if interval := os.Getenv("OTLP_EXPORT_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid OTLP_EXPORT_INTERVAL: %s. Must be a duration greater than 0 such as 30s.", interval)
+		}
+		log.Debugf("Successfully read OTLP_EXPORT_INTERVAL from config as: %s", interval)
+		cfg.OtlpExportInterval = d
+	} else {
+		log.Debug("OTLP_EXPORT_INTERVAL not set. Using default of 60s")
+		cfg.OtlpExportInterval = 60 * time.Second
+	}
+
 	return cfg
 }
+
+// parseAPIKeyPrefixes will parse the key=prefix entries of API_KEY_PREFIXES. Each prefix has to end
+// in "/" and can't start another, so every key's topics are kept apart from the others. Returns
+// error if an entry is malformed, a key is used twice or is the main key, or prefixes overlap.
+func parseAPIKeyPrefixes(value string, mainKey string) (map[string]string, error) {
+	prefixes := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, prefix, ok := strings.Cut(entry, "=")
+		key, prefix = strings.TrimSpace(key), strings.TrimSpace(prefix)
+		if !ok || key == "" || prefix == "" || strings.ContainsAny(prefix, `*?[\`) {
+			return nil, fmt.Errorf("each entry must be key=prefix, and prefixes can't have *, ?, [, or \\")
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			return nil, fmt.Errorf("prefix %q must end in / so it can't start another tenant's topic names", prefix)
+		}
+		if _, exists := prefixes[key]; exists || key == mainKey {
+			return nil, fmt.Errorf("every api key must be different")
+		}
+		for _, other := range prefixes {
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				return nil, fmt.Errorf("prefixes %q and %q overlap, so their topics wouldn't be kept apart", other, prefix)
+			}
+		}
+		prefixes[key] = prefix
+	}
+	return prefixes, nil
+}
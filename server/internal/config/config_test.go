@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -10,22 +11,235 @@ func TestLoad_Defaults(t *testing.T) {
 	t.Setenv("MY_SERVER_KEY", "")
 	t.Setenv("STORAGE_TYPE", "")
 	t.Setenv("STORAGE_PATH", "")
+	t.Setenv("HANDSHAKE_TIMEOUT", "")
+	t.Setenv("SHUTDOWN_TIMEOUT", "")
+	t.Setenv("READ_BUFFER_SIZE", "")
+	t.Setenv("WRITE_BUFFER_SIZE", "")
+	t.Setenv("WRITE_BUFFER_POOL", "")
+	t.Setenv("WEBSOCKET_COMPRESSION", "")
+	t.Setenv("ACCESS_LOG_PATH", "")
+	t.Setenv("LOG_REDACT_FIELDS", "")
+	t.Setenv("MAX_SUBSCRIPTIONS_PER_CLIENT", "")
+	t.Setenv("MAX_NESTING_DEPTH", "")
+	t.Setenv("MAX_PATTERN_RESULTS", "")
+	t.Setenv("CHUNK_SIZE", "")
+	t.Setenv("MAX_PAYLOAD_SIZE", "")
+	t.Setenv("MAX_SCHEMA_VERSIONS", "")
+	t.Setenv("MAX_TOPICS", "")
+	t.Setenv("DISABLED_ACTIONS", "")
+	t.Setenv("ALLOWED_TOPIC_PATTERNS", "")
+	t.Setenv("WEBHOOK_ALLOWED_HOSTS", "")
+	t.Setenv("ADMIN_API_KEY", "")
+	t.Setenv("SEED_FILE", "")
+	t.Setenv("DEFAULT_SCHEMA_FILE", "")
+	t.Setenv("TRANSFORMS_FILE", "")
+	t.Setenv("OVERFLOW_POLICY", "")
+	t.Setenv("STORAGE_WRITE_RETRIES", "")
+	t.Setenv("STORAGE_RETRY_BACKOFF", "")
+	t.Setenv("STORAGE_DEGRADED_QUEUE_DEPTH", "")
+	t.Setenv("STORAGE_DEGRADED_LATENCY", "")
+	t.Setenv("GET_READ_THROUGH", "")
+	t.Setenv("REQUIRE_REGISTERED_TOPIC", "")
+	t.Setenv("TOPIC_IDLE_EXPIRY", "")
+	t.Setenv("TOPIC_IDLE_EXPIRY_PURGE", "")
+	t.Setenv("PRESENCE_EVENTS", "")
+	t.Setenv("READ_ONLY", "")
+	t.Setenv("FAILED_CLIENTS_BUFFER", "")
+	t.Setenv("FAILED_CLIENTS_WAIT", "")
+	t.Setenv("FAILED_CLIENTS_GRACE", "")
+	t.Setenv("OTLP_ENDPOINT", "")
+	t.Setenv("OTLP_TRACES", "")
+	t.Setenv("OTLP_EXPORT_INTERVAL", "")
+	t.Setenv("SUBSCRIPTION_RESTORE_WINDOW", "")
+	t.Setenv("RECONNECT_TOKEN_TTL", "")
+	t.Setenv("ID_FORMAT", "")
+	t.Setenv("MAX_CONCURRENT_SENDS", "")
+	t.Setenv("HANDLER_WORKERS", "")
+	t.Setenv("API_KEY_PREFIXES", "")
+	t.Setenv("SQLITE_JOURNAL_MODE", "")
+	t.Setenv("SQLITE_SYNCHRONOUS", "")
+	t.Setenv("SQLITE_BUSY_TIMEOUT", "")
 
 	cfg := Load()
 
 	assert.Equal(t, "", cfg.APIKey)
-	assert.Equal(t, "", cfg.StorageType)
+	assert.Equal(t, "none", cfg.StorageType)
 	assert.Equal(t, "./tmp/data", cfg.StoragePath)
+	assert.Equal(t, 10*time.Second, cfg.HandshakeTimeout)
+	assert.Equal(t, 5*time.Second, cfg.ShutdownTimeout)
+	assert.Equal(t, 4096, cfg.ReadBufferSize)
+	assert.Equal(t, 4096, cfg.WriteBufferSize)
+	assert.False(t, cfg.WriteBufferPool)
+	assert.False(t, cfg.Compression)
+	assert.Equal(t, "", cfg.AccessLogPath)
+	assert.Empty(t, cfg.LogRedactFields)
+	assert.Equal(t, 0, cfg.MaxSubscriptionsPerClient)
+	assert.Equal(t, 32, cfg.MaxNestingDepth)
+	assert.Equal(t, 1000, cfg.MaxPatternResults)
+	assert.Equal(t, 65536, cfg.ChunkSize)
+	assert.Equal(t, 0, cfg.MaxPayloadSize)
+	assert.Equal(t, 0, cfg.MaxSchemaVersions)
+	assert.Equal(t, 0, cfg.MaxTopics)
+	assert.Empty(t, cfg.DisabledActions)
+	assert.Empty(t, cfg.AllowedTopicPatterns)
+	assert.Empty(t, cfg.WebhookAllowedHosts)
+	assert.Equal(t, "", cfg.AdminAPIKey)
+	assert.Equal(t, "", cfg.SeedFile)
+	assert.Equal(t, "", cfg.DefaultSchemaFile)
+	assert.Equal(t, "", cfg.TransformsFile)
+	assert.Equal(t, "disconnect", cfg.OverflowPolicy)
+	assert.Equal(t, 3, cfg.StorageWriteRetries)
+	assert.Equal(t, 50*time.Millisecond, cfg.StorageRetryBackoff)
+	assert.Equal(t, 1000, cfg.StorageDegradedQueueDepth)
+	assert.Equal(t, 2*time.Second, cfg.StorageDegradedLatency)
+	assert.False(t, cfg.GetReadThrough)
+	assert.True(t, cfg.RequireRegisteredTopic)
+	assert.Equal(t, time.Duration(0), cfg.TopicIdleExpiry)
+	assert.False(t, cfg.TopicIdleExpiryPurge)
+	assert.False(t, cfg.PresenceEvents)
+	assert.False(t, cfg.ReadOnly)
+	assert.Equal(t, 100, cfg.FailedClientsBuffer)
+	assert.Equal(t, 50*time.Millisecond, cfg.FailedClientsWait)
+	assert.Equal(t, time.Duration(0), cfg.FailedClientsGrace)
+	assert.Equal(t, "", cfg.OtlpEndpoint)
+	assert.False(t, cfg.OtlpTraces)
+	assert.Equal(t, 60*time.Second, cfg.OtlpExportInterval)
+	assert.Equal(t, time.Duration(0), cfg.SubscriptionRestoreWindow)
+	assert.Equal(t, time.Duration(0), cfg.ReconnectTokenTTL)
+	assert.Equal(t, "uuid", cfg.IdFormat)
+	assert.Equal(t, 0, cfg.MaxConcurrentSends)
+	assert.Equal(t, 0, cfg.HandlerWorkers)
+	assert.Nil(t, cfg.APIKeyPrefixes)
+	assert.Equal(t, "DELETE", cfg.SqliteJournalMode)
+	assert.Equal(t, "FULL", cfg.SqliteSynchronous)
+	assert.Equal(t, 5*time.Second, cfg.SqliteBusyTimeout)
 }
 
 func TestLoad_WithEnvVars(t *testing.T) {
 	t.Setenv("MY_SERVER_KEY", "test-key")
 	t.Setenv("STORAGE_TYPE", "sqlite")
 	t.Setenv("STORAGE_PATH", "/var/data")
+	t.Setenv("HANDSHAKE_TIMEOUT", "2s")
+	t.Setenv("SHUTDOWN_TIMEOUT", "30s")
+	t.Setenv("READ_BUFFER_SIZE", "65536")
+	t.Setenv("WRITE_BUFFER_SIZE", "32768")
+	t.Setenv("WRITE_BUFFER_POOL", "true")
+	t.Setenv("WEBSOCKET_COMPRESSION", "true")
+	t.Setenv("ACCESS_LOG_PATH", "/var/log/access.log")
+	t.Setenv("LOG_REDACT_FIELDS", "password, ssn,,")
+	t.Setenv("MAX_SUBSCRIPTIONS_PER_CLIENT", "100")
+	t.Setenv("MAX_NESTING_DEPTH", "8")
+	t.Setenv("MAX_PATTERN_RESULTS", "50")
+	t.Setenv("CHUNK_SIZE", "1024")
+	t.Setenv("MAX_PAYLOAD_SIZE", "4096")
+	t.Setenv("MAX_SCHEMA_VERSIONS", "5")
+	t.Setenv("MAX_TOPICS", "1000")
+	t.Setenv("DISABLED_ACTIONS", "unregisterTopic, updateSchema,,")
+	t.Setenv("ALLOWED_TOPIC_PATTERNS", "app1/*, shared,")
+	t.Setenv("WEBHOOK_ALLOWED_HOSTS", "hooks.example.com, Sink:8080,")
+	t.Setenv("ADMIN_API_KEY", "admin-secret")
+	t.Setenv("SEED_FILE", "/etc/data-loom/seed.json")
+	t.Setenv("DEFAULT_SCHEMA_FILE", "/etc/data-loom/default-schemas.json")
+	t.Setenv("TRANSFORMS_FILE", "/etc/data-loom/transforms.json")
+	t.Setenv("OVERFLOW_POLICY", "dropOldest")
+	t.Setenv("STORAGE_WRITE_RETRIES", "0")
+	t.Setenv("STORAGE_RETRY_BACKOFF", "200ms")
+	t.Setenv("STORAGE_DEGRADED_QUEUE_DEPTH", "0")
+	t.Setenv("STORAGE_DEGRADED_LATENCY", "500ms")
+	t.Setenv("GET_READ_THROUGH", "true")
+	t.Setenv("REQUIRE_REGISTERED_TOPIC", "false")
+	t.Setenv("TOPIC_IDLE_EXPIRY", "24h")
+	t.Setenv("TOPIC_IDLE_EXPIRY_PURGE", "true")
+	t.Setenv("PRESENCE_EVENTS", "true")
+	t.Setenv("READ_ONLY", "true")
+	t.Setenv("FAILED_CLIENTS_BUFFER", "500")
+	t.Setenv("FAILED_CLIENTS_WAIT", "0")
+	t.Setenv("FAILED_CLIENTS_GRACE", "2m")
+	t.Setenv("OTLP_ENDPOINT", "http://collector:4318")
+	t.Setenv("OTLP_TRACES", "true")
+	t.Setenv("OTLP_EXPORT_INTERVAL", "15s")
+	t.Setenv("SUBSCRIPTION_RESTORE_WINDOW", "30s")
+	t.Setenv("RECONNECT_TOKEN_TTL", "1m")
+	t.Setenv("ID_FORMAT", "sortable")
+	t.Setenv("MAX_CONCURRENT_SENDS", "64")
+	t.Setenv("HANDLER_WORKERS", "8")
+	t.Setenv("API_KEY_PREFIXES", "tenant-a-key=tenant-a/, tenant-b-key = tenant-b/,")
+	t.Setenv("SQLITE_JOURNAL_MODE", "wal")
+	t.Setenv("SQLITE_SYNCHRONOUS", "normal")
+	t.Setenv("SQLITE_BUSY_TIMEOUT", "250ms")
 
 	cfg := Load()
 
 	assert.Equal(t, "test-key", cfg.APIKey)
 	assert.Equal(t, "sqlite", cfg.StorageType)
 	assert.Equal(t, "/var/data", cfg.StoragePath)
+	assert.Equal(t, 2*time.Second, cfg.HandshakeTimeout)
+	assert.Equal(t, 30*time.Second, cfg.ShutdownTimeout)
+	assert.Equal(t, 65536, cfg.ReadBufferSize)
+	assert.Equal(t, 32768, cfg.WriteBufferSize)
+	assert.True(t, cfg.WriteBufferPool)
+	assert.True(t, cfg.Compression)
+	assert.Equal(t, "/var/log/access.log", cfg.AccessLogPath)
+	assert.Equal(t, []string{"password", "ssn"}, cfg.LogRedactFields)
+	assert.Equal(t, 100, cfg.MaxSubscriptionsPerClient)
+	assert.Equal(t, 8, cfg.MaxNestingDepth)
+	assert.Equal(t, 50, cfg.MaxPatternResults)
+	assert.Equal(t, 1024, cfg.ChunkSize)
+	assert.Equal(t, 4096, cfg.MaxPayloadSize)
+	assert.Equal(t, 5, cfg.MaxSchemaVersions)
+	assert.Equal(t, 1000, cfg.MaxTopics)
+	assert.Equal(t, []string{"unregisterTopic", "updateSchema"}, cfg.DisabledActions)
+	assert.Equal(t, []string{"app1/*", "shared"}, cfg.AllowedTopicPatterns)
+	assert.Equal(t, []string{"hooks.example.com", "sink:8080"}, cfg.WebhookAllowedHosts)
+	assert.Equal(t, "admin-secret", cfg.AdminAPIKey)
+	assert.Equal(t, "/etc/data-loom/seed.json", cfg.SeedFile)
+	assert.Equal(t, "/etc/data-loom/default-schemas.json", cfg.DefaultSchemaFile)
+	assert.Equal(t, "/etc/data-loom/transforms.json", cfg.TransformsFile)
+	assert.Equal(t, "dropOldest", cfg.OverflowPolicy)
+	assert.Equal(t, 0, cfg.StorageWriteRetries)
+	assert.Equal(t, 200*time.Millisecond, cfg.StorageRetryBackoff)
+	assert.Equal(t, 0, cfg.StorageDegradedQueueDepth)
+	assert.Equal(t, 500*time.Millisecond, cfg.StorageDegradedLatency)
+	assert.True(t, cfg.GetReadThrough)
+	assert.False(t, cfg.RequireRegisteredTopic)
+	assert.Equal(t, 24*time.Hour, cfg.TopicIdleExpiry)
+	assert.True(t, cfg.TopicIdleExpiryPurge)
+	assert.True(t, cfg.PresenceEvents)
+	assert.True(t, cfg.ReadOnly)
+	assert.Equal(t, 500, cfg.FailedClientsBuffer)
+	assert.Equal(t, time.Duration(0), cfg.FailedClientsWait)
+	assert.Equal(t, 2*time.Minute, cfg.FailedClientsGrace)
+	assert.Equal(t, "http://collector:4318", cfg.OtlpEndpoint)
+	assert.True(t, cfg.OtlpTraces)
+	assert.Equal(t, 15*time.Second, cfg.OtlpExportInterval)
+	assert.Equal(t, 30*time.Second, cfg.SubscriptionRestoreWindow)
+	assert.Equal(t, time.Minute, cfg.ReconnectTokenTTL)
+	assert.Equal(t, "sortable", cfg.IdFormat)
+	assert.Equal(t, 64, cfg.MaxConcurrentSends)
+	assert.Equal(t, 8, cfg.HandlerWorkers)
+	assert.Equal(t, map[string]string{"tenant-a-key": "tenant-a/", "tenant-b-key": "tenant-b/"}, cfg.APIKeyPrefixes)
+	assert.Equal(t, "WAL", cfg.SqliteJournalMode)
+	assert.Equal(t, "NORMAL", cfg.SqliteSynchronous)
+	assert.Equal(t, 250*time.Millisecond, cfg.SqliteBusyTimeout)
+}
+
+func TestParseAPIKeyPrefixes(t *testing.T) {
+	prefixes, err := parseAPIKeyPrefixes("acme-key=acme/, acme2-key=acme2/", "main-key")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"acme-key": "acme/", "acme2-key": "acme2/"}, prefixes)
+
+	tests := map[string]string{
+		"no trailing slash":    "acme-key=acme, acme2-key=acme2/",
+		"overlapping prefixes": "acme-key=acme/, orders-key=acme/orders/",
+		"overlapping reversed": "orders-key=acme/orders/, acme-key=acme/",
+		"same prefix":          "acme-key=acme/, other-key=acme/",
+		"empty prefix":         "acme-key=",
+		"glob in prefix":       "acme-key=acme*/",
+		"main key":             "main-key=acme/",
+		"duplicate key":        "acme-key=acme/, acme-key=other/",
+	}
+	for name, value := range tests {
+		_, err := parseAPIKeyPrefixes(value, "main-key")
+		assert.Error(t, err, name)
+	}
 }
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessLogger writes one line per handled request to its own output, separate
+// from the application logs, so it can be routed to its own file or sink.
+type AccessLogger struct {
+	logger *log.Logger
+	closer io.Closer
+}
+
+// AccessLogEntry is everything that is written to the access log for a request.
+type AccessLogEntry struct {
+	Time      time.Time
+	ClientId  string
+	Action    string
+	Topic     string
+	MessageId string
+	Code      int
+	Duration  time.Duration
+}
+
+// NewAccessLogger will create an access logger that writes to the writer passed in.
+func NewAccessLogger(w io.Writer) *AccessLogger {
+	logger := log.New()
+	logger.SetOutput(w)
+	logger.SetLevel(log.InfoLevel)
+	logger.SetFormatter(&log.JSONFormatter{
+		TimestampFormat: time.RFC3339Nano,
+		PrettyPrint:     false, // always one line per request
+	})
+	return &AccessLogger{logger: logger}
+}
+
+// OpenAccessLog will create an access logger from the configured destination. "stdout" and
+// "stderr" write to those streams, anything else is a file path that is appended to.
+// A blank destination disables access logging and returns nil.
+func OpenAccessLog(destination string) (*AccessLogger, error) {
+	switch destination {
+	case "":
+		return nil, nil
+	case "stdout":
+		return NewAccessLogger(os.Stdout), nil
+	case "stderr":
+		return NewAccessLogger(os.Stderr), nil
+	default:
+		f, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open access log file %s: %w", destination, err)
+		}
+		accessLogger := NewAccessLogger(f)
+		accessLogger.closer = f
+		return accessLogger, nil
+	}
+}
+
+// Log will write an entry to the access log. Does nothing if the access logger is nil.
+func (a *AccessLogger) Log(entry AccessLogEntry) {
+	if a == nil {
+		return
+	}
+	a.logger.WithTime(entry.Time).WithFields(log.Fields{
+		"client_id":   entry.ClientId,
+		"action":      entry.Action,
+		"topic":       entry.Topic,
+		"msg_id":      entry.MessageId,
+		"code":        entry.Code,
+		"duration_ms": float64(entry.Duration.Microseconds()) / 1000,
+	}).Info("access")
+}
+
+// Close will close the access log file if there is one.
+func (a *AccessLogger) Close() error {
+	if a == nil || a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
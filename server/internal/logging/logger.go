@@ -24,6 +24,13 @@ func init() {
 	// log.AddHook(NewSentryHook()) // add Sentry, Datadog, etc. if desired
 }
 
+// Flush will make sure any buffered log output is written out. Used on shutdown.
+func Flush() {
+	if f, ok := log.StandardLogger().Out.(*os.File); ok {
+		_ = f.Sync()
+	}
+}
+
 // Logs an error in a handler
 func HandlerError(clientId string, action string, topic string, messageId string, err error) {
 	log.WithFields(log.Fields{
@@ -44,6 +51,17 @@ func HandlerSuccess(clientId string, action string, topic string, messageId stri
 	}).Info("Action completed successfully")
 }
 
+// Logs that an action completed but with warnings
+func HandlerWarnings(clientId string, action string, topic string, messageId string, warnings []string) {
+	log.WithFields(log.Fields{
+		"client_id": clientId,
+		"action":    action,
+		"topic":     topic,
+		"msg_id":    messageId,
+		"warnings":  warnings,
+	}).Warn("Action completed with warnings")
+}
+
 // Logs that an acknowledgment was sent
 func HandlerAck(clientId string, action string, topic string, messageId string) {
 	log.WithFields(log.Fields{
@@ -0,0 +1,187 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// REDACTED is what the value of a sensitive field is replaced with in logs.
+const REDACTED = "[REDACTED]"
+
+// RedactionHook replaces the values of sensitive fields before an entry is logged. Fields are
+// matched by name without case, both for the fields of the entry and the fields of objects logged
+// in them, such as a published value or the headers of a message. Objects logged as json, such as
+// the data of a message, are redacted too.
+type RedactionHook struct {
+	fields map[string]bool
+}
+
+// NewRedactionHook will create a hook that redacts the fields with the names.
+func NewRedactionHook(fields []string) *RedactionHook {
+	hook := &RedactionHook{fields: make(map[string]bool, len(fields))}
+	for _, field := range fields {
+		if field = strings.TrimSpace(field); field != "" {
+			hook.fields[strings.ToLower(field)] = true
+		}
+	}
+	return hook
+}
+
+// RedactFields will redact the fields with the names from everything logged by the standard
+// logger. Nothing is redacted if there are no names.
+func RedactFields(fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+	log.AddHook(NewRedactionHook(fields))
+}
+
+// Levels will return every level, so nothing is logged without being redacted.
+func (h *RedactionHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire will redact the fields of the entry. The values logged can be shared with the code that
+// logged them, so they're copied instead of changed.
+func (h *RedactionHook) Fire(entry *log.Entry) error {
+	for key, value := range entry.Data {
+		if h.sensitive(key) {
+			entry.Data[key] = REDACTED
+		} else {
+			entry.Data[key] = h.redact(value)
+		}
+	}
+	return nil
+}
+
+// sensitive will return true if the field's value shouldn't be logged.
+func (h *RedactionHook) sensitive(field string) bool {
+	return h.fields[strings.ToLower(field)]
+}
+
+// redact will return the value with its sensitive fields redacted, or the value itself if it
+// doesn't have any.
+func (h *RedactionHook) redact(value any) any {
+	switch v := value.(type) {
+	case nil, error:
+		return value
+	case map[string]any:
+		return h.redactDecoded(v)
+	case []any:
+		return h.redactDecoded(v)
+	case map[string]string:
+		var redacted map[string]string
+		for key := range v {
+			if h.sensitive(key) {
+				redacted = make(map[string]string, len(v))
+				break
+			}
+		}
+		if redacted == nil {
+			return value
+		}
+		for key, field := range v {
+			if h.sensitive(key) {
+				field = REDACTED
+			}
+			redacted[key] = field
+		}
+		return redacted
+	case json.RawMessage:
+		if redacted, ok := h.redactJSON(v); ok {
+			return json.RawMessage(redacted)
+		}
+		return value
+	case []byte:
+		if redacted, ok := h.redactJSON(v); ok {
+			return redacted
+		}
+		return value
+	case string:
+		if redacted, ok := h.redactJSON([]byte(v)); ok {
+			return string(redacted)
+		}
+		return value
+	}
+
+	// other objects, such as the data of a response, are redacted as the json they'd be sent as
+	switch reflect.Indirect(reflect.ValueOf(value)).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return value
+		}
+		if redacted, ok := h.redactJSON(raw); ok {
+			return json.RawMessage(redacted)
+		}
+	}
+	return value
+}
+
+// redactJSON will redact the sensitive fields of an object or array encoded as json. Returns false
+// if it isn't one or doesn't have any sensitive fields.
+func (h *RedactionHook) redactJSON(raw []byte) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+	var decoded any
+	if err := json.Unmarshal(trimmed, &decoded); err != nil {
+		return nil, false
+	}
+	if !h.hasSensitive(decoded) {
+		return nil, false
+	}
+	redacted, err := json.Marshal(h.redactDecoded(decoded))
+	if err != nil {
+		return nil, false
+	}
+	return redacted, true
+}
+
+// hasSensitive will return true if the value decoded from json has a sensitive field at any depth.
+func (h *RedactionHook) hasSensitive(value any) bool {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if h.sensitive(key) || h.hasSensitive(field) {
+				return true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if h.hasSensitive(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactDecoded will copy a value decoded from json with its sensitive fields redacted.
+func (h *RedactionHook) redactDecoded(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		redacted := make(map[string]any, len(v))
+		for key, field := range v {
+			if h.sensitive(key) {
+				redacted[key] = REDACTED
+			} else {
+				redacted[key] = h.redactDecoded(field)
+			}
+		}
+		return redacted
+	case []any:
+		redacted := make([]any, len(v))
+		for i, item := range v {
+			redacted[i] = h.redactDecoded(item)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCapturedLogger will create a logger that redacts the fields and writes to the buffer it returns.
+func newCapturedLogger(fields ...string) (*log.Logger, *bytes.Buffer) {
+	var out bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(NewRedactionHook(fields))
+	return logger, &out
+}
+
+func TestRedactionHook_RedactsSensitiveFields(t *testing.T) {
+	logger, out := newCapturedLogger("password", "SSN", "Authorization")
+
+	shared := map[string]any{"user": "ana", "password": "hunter2"}
+	logger.WithFields(log.Fields{
+		"value":      `{"user":"ana","profile":{"ssn":"123-45-6789"}}`,
+		"Data":       json.RawMessage(`[{"Password":"swordfish"}]`),
+		"ParsedData": shared,
+		"Headers":    map[string]string{"authorization": "Bearer abc", "trace": "t-1"},
+		"Response":   struct{ Value map[string]any }{Value: map[string]any{"password": "letmein"}},
+		"password":   "top-level",
+	}).Info("calling async put on database")
+
+	logged := out.String()
+	for _, secret := range []string{"hunter2", "123-45-6789", "swordfish", "Bearer abc", "letmein", "top-level"} {
+		assert.NotContains(t, logged, secret)
+	}
+	for _, kept := range []string{"ana", "t-1", REDACTED} {
+		assert.Contains(t, logged, kept)
+	}
+	assert.Equal(t, "hunter2", shared["password"], "the logged value shouldn't be changed")
+}
+
+func TestRedactionHook_LeavesOtherValuesAlone(t *testing.T) {
+	logger, out := newCapturedLogger("password")
+
+	logger.WithFields(log.Fields{
+		"value":  `{"temp":21.5}`,
+		"binary": []byte{0x01, 0x02},
+		"count":  3,
+		"text":   "not json {",
+	}).Warn("published")
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, `{"temp":21.5}`, entry["value"])
+	assert.Equal(t, 3.0, entry["count"])
+	assert.Equal(t, "not json {", entry["text"])
+	assert.Equal(t, "AQI=", entry["binary"])
+}
+
+func TestRedactFields_NothingByDefault(t *testing.T) {
+	hooks := log.StandardLogger().Hooks
+	RedactFields(nil)
+	assert.Equal(t, hooks, log.StandardLogger().Hooks)
+}
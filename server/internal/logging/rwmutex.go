@@ -1,21 +1,105 @@
 package logging
 
 import (
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// DebugRWMutex wraps sync.RWMutex with logging
+// DebugRWMutex wraps sync.RWMutex with logging, and counts how often each method takes the lock
+// and how long it waits for it.
 type DebugRWMutex struct {
 	mu        sync.RWMutex
 	component string
+	counters  *lockCounters
+}
+
+// LockStats is how many times a method took a lock, and how long it waited for it in total and at
+// most. Mode is "RLock" or "Lock".
+type LockStats struct {
+	Component    string
+	Method       string
+	Mode         string
+	Acquisitions int64
+	TotalWait    time.Duration
+	MaxWait      time.Duration
+}
+
+// lockKey is the method and mode a lock was taken with.
+type lockKey struct {
+	method string
+	mode   string
+}
+
+// lockCounter is the counts for a single method and mode. They are updated without a lock so
+// counting doesn't add contention of its own.
+type lockCounter struct {
+	acquisitions atomic.Int64
+	totalWait    atomic.Int64 // nanoseconds
+	maxWait      atomic.Int64 // nanoseconds
+}
+
+// lockCounters is the counts of a mutex by method and mode. The map only grows, since methods
+// are a fixed set.
+type lockCounters struct {
+	byKey sync.Map // lockKey to *lockCounter
 }
 
 // NewDebugRWMutex creates a new instance with a component name for logs
 func NewDebugRWMutex(component string) *DebugRWMutex {
-	return &DebugRWMutex{component: component}
+	return &DebugRWMutex{component: component, counters: &lockCounters{}}
+}
+
+// record will count that the method took the lock after waiting for it.
+func (d *DebugRWMutex) record(method string, mode string, wait time.Duration) {
+	if d.counters == nil {
+		return
+	}
+	key := lockKey{method: method, mode: mode}
+	value, ok := d.counters.byKey.Load(key)
+	if !ok {
+		value, _ = d.counters.byKey.LoadOrStore(key, &lockCounter{})
+	}
+	counter := value.(*lockCounter)
+	counter.acquisitions.Add(1)
+	counter.totalWait.Add(int64(wait))
+	for {
+		current := counter.maxWait.Load()
+		if int64(wait) <= current || counter.maxWait.CompareAndSwap(current, int64(wait)) {
+			return
+		}
+	}
+}
+
+// Stats will return the counts for each method and mode the lock was taken with, sorted by
+// method then mode.
+func (d *DebugRWMutex) Stats() []LockStats {
+	var stats []LockStats
+	if d.counters == nil {
+		return stats
+	}
+	d.counters.byKey.Range(func(k, v any) bool {
+		key, counter := k.(lockKey), v.(*lockCounter)
+		stats = append(stats, LockStats{
+			Component:    d.component,
+			Method:       key.method,
+			Mode:         key.mode,
+			Acquisitions: counter.acquisitions.Load(),
+			TotalWait:    time.Duration(counter.totalWait.Load()),
+			MaxWait:      time.Duration(counter.maxWait.Load()),
+		})
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Method != stats[j].Method {
+			return stats[i].Method < stats[j].Method
+		}
+		return stats[i].Mode < stats[j].Mode
+	})
+	return stats
 }
 
 func (d *DebugRWMutex) RLock(method string) {
@@ -27,12 +111,14 @@ func (d *DebugRWMutex) RLock(method string) {
 	}).Trace("Acquiring read lock")
 
 	d.mu.RLock()
+	wait := time.Since(start)
+	d.record(method, "RLock", wait)
 
 	log.WithFields(log.Fields{
 		"component": d.component,
 		"method":    method,
 		"lock_mode": "RLock",
-		"wait_ms":   time.Since(start).Milliseconds(),
+		"wait_ms":   wait.Milliseconds(),
 	}).Trace("Acquired read lock")
 }
 
@@ -54,12 +140,14 @@ func (d *DebugRWMutex) Lock(method string) {
 	}).Trace("Acquiring write lock")
 
 	d.mu.Lock()
+	wait := time.Since(start)
+	d.record(method, "Lock", wait)
 
 	log.WithFields(log.Fields{
 		"component": d.component,
 		"method":    method,
 		"lock_mode": "Lock",
-		"wait_ms":   time.Since(start).Milliseconds(),
+		"wait_ms":   wait.Milliseconds(),
 	}).Trace("Acquired write lock")
 }
 
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugRWMutex_CountsConcurrentAcquisitions(t *testing.T) {
+	mu := NewDebugRWMutex("Test")
+
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				mu.Lock("Write")
+				time.Sleep(10 * time.Microsecond) // hold it so the others wait
+				mu.Unlock("Write")
+				mu.RLock("Read")
+				mu.RUnlock("Read")
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := mu.Stats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, LockStats{Component: "Test", Method: "Read", Mode: "RLock", Acquisitions: workers * rounds, TotalWait: stats[0].TotalWait, MaxWait: stats[0].MaxWait}, stats[0])
+
+	write := stats[1]
+	assert.Equal(t, "Write", write.Method)
+	assert.Equal(t, "Lock", write.Mode)
+	assert.Equal(t, int64(workers*rounds), write.Acquisitions)
+	assert.Positive(t, write.TotalWait, "expected the writers to have waited on each other")
+	assert.LessOrEqual(t, write.MaxWait, write.TotalWait)
+}
+
+func TestDebugRWMutex_MaxWait(t *testing.T) {
+	mu := NewDebugRWMutex("Test")
+	mu.Lock("Holder")
+
+	acquired := make(chan struct{})
+	go func() {
+		mu.Lock("Waiter")
+		mu.Unlock("Waiter")
+		close(acquired)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	mu.Unlock("Holder")
+	<-acquired
+
+	for _, stat := range mu.Stats() {
+		if stat.Method == "Waiter" {
+			assert.GreaterOrEqual(t, stat.MaxWait, 20*time.Millisecond)
+			assert.Equal(t, stat.MaxWait, stat.TotalWait)
+			return
+		}
+	}
+	t.Fatal("expected stats for the waiter")
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Exporter is anything that buffers metrics and needs to be flushed before the process exits.
+type Exporter interface {
+	Flush(ctx context.Context) error
+}
+
+// Metrics keeps running counts of the actions handled by the server since it started.
+type Metrics struct {
+	mu        sync.Mutex
+	startTime time.Time
+	actions   map[string]*actionStats
+	exporters []Exporter
+}
+
+// actionStats is the running totals for a single action.
+type actionStats struct {
+	count         int64
+	totalDuration time.Duration
+}
+
+// ActionSummary is the totals for a single action at the time of the summary.
+type ActionSummary struct {
+	Action          string        `json:"action"`
+	Count           int64         `json:"count"`
+	AverageDuration time.Duration `json:"averageDuration"`
+}
+
+// Summary is a snapshot of the metrics, used for end of run diagnostics.
+type Summary struct {
+	Uptime        time.Duration   `json:"uptime"`
+	TotalMessages int64           `json:"totalMessages"`
+	Actions       []ActionSummary `json:"actions"`
+}
+
+// NewMetrics will create a ready to use Metrics struct with the start time of now.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		startTime: time.Now(),
+		actions:   make(map[string]*actionStats),
+	}
+}
+
+// RecordAction will add a handled action and how long it took to the totals.
+func (m *Metrics) RecordAction(action string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.actions[action]
+	if !ok {
+		stats = &actionStats{}
+		m.actions[action] = stats
+	}
+	stats.count++
+	stats.totalDuration += duration
+}
+
+// AddExporter will add an exporter to be flushed when Flush is called.
+func (m *Metrics) AddExporter(exporter Exporter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exporters = append(m.exporters, exporter)
+}
+
+// Summary will return a snapshot of the metrics as of the time passed in. The actions
+// are sorted by name so the same metrics always give the same summary.
+func (m *Metrics) Summary(now time.Time) Summary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	summary := Summary{
+		Uptime:  now.Sub(m.startTime),
+		Actions: make([]ActionSummary, 0, len(m.actions)),
+	}
+
+	for action, stats := range m.actions {
+		var average time.Duration
+		if stats.count > 0 {
+			average = stats.totalDuration / time.Duration(stats.count)
+		}
+		summary.TotalMessages += stats.count
+		summary.Actions = append(summary.Actions, ActionSummary{
+			Action:          action,
+			Count:           stats.count,
+			AverageDuration: average,
+		})
+	}
+
+	sort.Slice(summary.Actions, func(i, j int) bool {
+		return summary.Actions[i].Action < summary.Actions[j].Action
+	})
+	return summary
+}
+
+// Flush will flush all the exporters, returning the first error if any failed. Every
+// exporter is flushed even if an earlier one fails.
+func (m *Metrics) Flush(ctx context.Context) error {
+	m.mu.Lock()
+	exporters := make([]Exporter, len(m.exporters))
+	copy(exporters, m.exporters)
+	m.mu.Unlock()
+
+	var firstErr error
+	for _, exporter := range exporters {
+		if err := exporter.Flush(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockExporter struct {
+	flushed bool
+	err     error
+}
+
+func (e *mockExporter) Flush(ctx context.Context) error {
+	e.flushed = true
+	return e.err
+}
+
+func TestSummary_IsDeterministic(t *testing.T) {
+	m := NewMetrics()
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.startTime = start
+
+	m.RecordAction("publish", 2*time.Millisecond)
+	m.RecordAction("publish", 4*time.Millisecond)
+	m.RecordAction("get", 1*time.Millisecond)
+
+	summary := m.Summary(start.Add(time.Minute))
+
+	assert.Equal(t, Summary{
+		Uptime:        time.Minute,
+		TotalMessages: 3,
+		Actions: []ActionSummary{
+			{Action: "get", Count: 1, AverageDuration: 1 * time.Millisecond},
+			{Action: "publish", Count: 2, AverageDuration: 3 * time.Millisecond},
+		},
+	}, summary)
+}
+
+func TestSummary_Empty(t *testing.T) {
+	m := NewMetrics()
+	summary := m.Summary(m.startTime)
+
+	assert.Equal(t, int64(0), summary.TotalMessages)
+	assert.Empty(t, summary.Actions)
+}
+
+func TestFlush_FlushesAllExporters(t *testing.T) {
+	m := NewMetrics()
+	failing := &mockExporter{err: fmt.Errorf("flush failed")}
+	ok := &mockExporter{}
+	m.AddExporter(failing)
+	m.AddExporter(ok)
+
+	err := m.Flush(context.Background())
+
+	assert.Error(t, err)
+	assert.True(t, failing.flushed)
+	assert.True(t, ok.flushed)
+}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// INSTRUMENTATION_NAME is the name of the meter and tracers the server records with.
+const INSTRUMENTATION_NAME = "github.com/atyalexyoung/data-loom/server"
+
+// OtelExporter exports the action metrics through an OpenTelemetry meter provider. The points are
+// the same ones served by the /metrics endpoint, read from the metrics each time the provider
+// collects them.
+type OtelExporter struct {
+	provider *sdkmetric.MeterProvider
+}
+
+// NewOtelExporter will register the action metrics with the meter provider.
+func NewOtelExporter(m *Metrics, provider *sdkmetric.MeterProvider) (*OtelExporter, error) {
+	meter := provider.Meter(INSTRUMENTATION_NAME)
+
+	messages, err := meter.Int64ObservableCounter("dataloom.messages",
+		metric.WithDescription("Messages handled since the server started, by action."),
+		metric.WithUnit("{message}"))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := meter.Float64ObservableCounter("dataloom.message.duration",
+		metric.WithDescription("Total time spent handling messages since the server started, by action."),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	uptime, err := meter.Float64ObservableGauge("dataloom.uptime",
+		metric.WithDescription("Time since the server started."),
+		metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		now := time.Now()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for action, stats := range m.actions {
+			attrs := metric.WithAttributes(attribute.String("action", action))
+			o.ObserveInt64(messages, stats.count, attrs)
+			o.ObserveFloat64(duration, stats.totalDuration.Seconds(), attrs)
+		}
+		o.ObserveFloat64(uptime, now.Sub(m.startTime).Seconds())
+		return nil
+	}, messages, duration, uptime)
+	if err != nil {
+		return nil, err
+	}
+	return &OtelExporter{provider: provider}, nil
+}
+
+// Flush will export the current metrics.
+func (e *OtelExporter) Flush(ctx context.Context) error {
+	return e.provider.ForceFlush(ctx)
+}
+
+// tracerExporter flushes the spans of a tracer provider with the metrics.
+type tracerExporter struct {
+	provider *sdktrace.TracerProvider
+}
+
+// Flush will export the spans that are waiting to be sent.
+func (e *tracerExporter) Flush(ctx context.Context) error {
+	return e.provider.ForceFlush(ctx)
+}
+
+// StartOtlp will export the metrics to an OpenTelemetry collector at the endpoint over OTLP/HTTP
+// every interval, and the handler, topic manager, and storage spans too if traces is true. The
+// endpoint is the collector's base url, such as http://localhost:4318. The exporters are flushed
+// when the metrics are.
+func StartOtlp(ctx context.Context, m *Metrics, endpoint string, interval time.Duration, traces bool) error {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	metricExporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(endpoint+"/v1/metrics"))
+	if err != nil {
+		return fmt.Errorf("couldn't create otlp metric exporter: %w", err)
+	}
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(
+		sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(interval))))
+	exporter, err := NewOtelExporter(m, meterProvider)
+	if err != nil {
+		return fmt.Errorf("couldn't register otlp metrics: %w", err)
+	}
+	m.AddExporter(exporter)
+
+	if !traces {
+		return nil
+	}
+	traceExporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint+"/v1/traces"))
+	if err != nil {
+		return fmt.Errorf("couldn't create otlp trace exporter: %w", err)
+	}
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter))
+	otel.SetTracerProvider(tracerProvider) // spans are recorded with the global tracer, which does nothing until this is set
+	m.AddExporter(&tracerExporter{provider: tracerProvider})
+	return nil
+}
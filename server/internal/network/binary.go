@@ -0,0 +1,41 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidBinaryFrame is returned when a binary frame doesn't start with a json message header.
+var ErrInvalidBinaryFrame = errors.New("invalid binary frame")
+
+// EncodeBinaryFrame will encode a message as a binary frame, which is the json of the message
+// followed directly by the raw payload. The message's data is left out since the payload is the data.
+func EncodeBinaryFrame(msg *WebSocketMessage, payload []byte) ([]byte, error) {
+	header := *msg
+	header.Data = nil
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 0, len(encoded)+len(payload))
+	frame = append(frame, encoded...)
+	return append(frame, payload...), nil
+}
+
+// ParseBinaryFrame will split a binary frame into the json message at the start of it and the
+// raw payload after it, which is set as the message's Binary. Returns error if the frame doesn't
+// start with a json object, or the message also has json data.
+func ParseBinaryFrame(frame []byte) (WebSocketMessage, error) {
+	var msg WebSocketMessage
+	decoder := json.NewDecoder(bytes.NewReader(frame))
+	if err := decoder.Decode(&msg); err != nil {
+		return msg, fmt.Errorf("%w: %w", ErrInvalidBinaryFrame, err)
+	}
+	if len(msg.Data) > 0 {
+		return msg, fmt.Errorf("%w: header can't have data, the payload goes after the header", ErrInvalidBinaryFrame)
+	}
+	msg.Binary = frame[decoder.InputOffset():]
+	return msg, nil
+}
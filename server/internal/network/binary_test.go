@@ -0,0 +1,46 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryFrame_RoundTrip(t *testing.T) {
+	payload := []byte{0x89, 'P', 'N', 'G', 0x00, '{', '}', 0xff}
+	msg := &WebSocketMessage{MessageId: "thumb-1", Action: "publish", Topic: "thumbnails", Data: []byte(`"left out"`)}
+
+	frame, err := EncodeBinaryFrame(msg, payload)
+	require.NoError(t, err)
+
+	parsed, err := ParseBinaryFrame(frame)
+	require.NoError(t, err)
+	assert.Equal(t, "thumb-1", parsed.MessageId)
+	assert.Equal(t, "publish", parsed.Action)
+	assert.Equal(t, "thumbnails", parsed.Topic)
+	assert.Empty(t, parsed.Data)
+	assert.Equal(t, payload, parsed.Binary)
+	assert.Equal(t, `"left out"`, string(msg.Data), "the message itself shouldn't be changed")
+}
+
+func TestParseBinaryFrame_EmptyPayload(t *testing.T) {
+	parsed, err := ParseBinaryFrame([]byte(`{"id":"1","action":"publish","topic":"blobs"}`))
+	require.NoError(t, err)
+	assert.NotNil(t, parsed.Binary)
+	assert.Empty(t, parsed.Binary)
+}
+
+func TestParseBinaryFrame_Invalid(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"empty":         {},
+		"no header":     {0x00, 0x01, 0x02},
+		"header data":   []byte(`{"id":"1","action":"publish","data":{"a":1}}raw`),
+		"unclosed json": []byte(`{"id":"1"`),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseBinaryFrame(frame)
+			assert.ErrorIs(t, err, ErrInvalidBinaryFrame)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+)
+
+// Chunk says which piece of a chunked response the response is. The data of each chunk is a
+// string with part of the json of the full data, and joining them in order gives back the json.
+type Chunk struct {
+	Index int  `json:"index"`
+	Final bool `json:"final,omitempty"` // true on the last chunk of the response
+}
+
+// SplitChunks will create the responses for a successful request with the json of data split into
+// chunks of at most size bytes. Chunks are only split between characters, so one can be a few bytes
+// short of the size. Data that fits in one chunk is still sent as a single, final chunk.
+func SplitChunks(msg WebSocketMessage, data any, size int) ([]Response, error) {
+	if size < utf8.UTFMax {
+		return nil, fmt.Errorf("chunk size must be at least %d, got %d", utf8.UTFMax, size)
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []Response
+	for index := 0; ; index++ {
+		end := min(size, len(encoded))
+		for end < len(encoded) && !utf8.RuneStart(encoded[end]) {
+			end--
+		}
+		response := NewResponse(msg, http.StatusOK, "", string(encoded[:end]))
+		response.Chunk = &Chunk{Index: index, Final: end == len(encoded)}
+		responses = append(responses, response)
+
+		encoded = encoded[end:]
+		if len(encoded) == 0 {
+			return responses, nil
+		}
+	}
+}
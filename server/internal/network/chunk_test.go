@@ -0,0 +1,21 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitChunks_SmallValueIsOneChunk(t *testing.T) {
+	chunks, err := SplitChunks(WebSocketMessage{MessageId: "1"}, 42, 100)
+	require.NoError(t, err)
+	require.Len(t, chunks, 1)
+	assert.Equal(t, &Chunk{Index: 0, Final: true}, chunks[0].Chunk)
+	assert.Equal(t, "42", chunks[0].Data)
+}
+
+func TestSplitChunks_SizeTooSmall(t *testing.T) {
+	_, err := SplitChunks(WebSocketMessage{MessageId: "1"}, "value", 1)
+	assert.Error(t, err)
+}
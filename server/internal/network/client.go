@@ -1,24 +1,511 @@
 package network
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	DEFAULT_SEND_QUEUE_SIZE = 256
+	MAX_CLOSE_REASON_SIZE   = 123 // bytes of text that fit in a close frame after the code
+)
+
+// ErrSendQueueFull is returned when a message can't be sent to a client because its outbound
+// queue is full and the overflow policy for the message is to disconnect the client.
+var ErrSendQueueFull = errors.New("send queue is full")
+
+// ErrMessageDropped is returned when a message isn't queued because the client's outbound queue
+// is full and the overflow policy for the message is to drop the newest.
+var ErrMessageDropped = errors.New("message dropped from a full send queue")
+
+// ErrMessageConflated is returned when a conflated message replaced the one for its topic that was
+// still waiting to be written. The message is queued, but the one it replaced is never written.
+var ErrMessageConflated = errors.New("message replaced one that wasn't written yet")
+
+// OverflowPolicy is what happens to a message sent to a client whose outbound queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest will make room by dropping the oldest queued message that can be dropped.
+	// If every queued message must not be dropped, the new message is dropped instead.
+	OverflowDropOldest OverflowPolicy = "dropOldest"
+	// OverflowDropNewest will drop the new message.
+	OverflowDropNewest OverflowPolicy = "dropNewest"
+	// OverflowDisconnect will disconnect the client. Messages with this policy are never dropped.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+// ParseOverflowPolicy will convert a string into an overflow policy. A blank string is
+// OverflowDisconnect. Returns error if the policy isn't known.
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch OverflowPolicy(policy) {
+	case "":
+		return OverflowDisconnect, nil
+	case OverflowDropOldest, OverflowDropNewest, OverflowDisconnect:
+		return OverflowPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("invalid overflow policy: %s. Must be dropOldest, dropNewest, or disconnect", policy)
+	}
+}
+
+// Priority is how urgently a message should be written to a client. Queued messages are written
+// highest priority first, and in the order they were sent within a priority.
+type Priority int
+
+const (
+	// PriorityNormal is the priority of every message that isn't sent with one.
+	PriorityNormal Priority = 0
+	// PriorityHigh messages are written before any queued normal priority messages.
+	PriorityHigh Priority = 1
+)
+
+// ParsePriority will convert a string into a priority. A blank string is PriorityNormal.
+// Returns error if the priority isn't known.
+func ParsePriority(priority string) (Priority, error) {
+	switch priority {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf("invalid priority: %s. Must be normal or high", priority)
+	}
+}
+
 type ClientInterface interface {
 	SendJSON(message any) error
 }
 
+// Client is a connected websocket client. Messages sent to the client are put on an
+// outbound queue and written by a single writer goroutine once Start is called, so a
+// slow client doesn't block whoever is sending to it. If the writer hasn't been
+// started, messages are written directly to the connection.
 type Client struct {
-	Conn *websocket.Conn
-	Id   string
-	mu   sync.Mutex
+	Conn             *websocket.Conn
+	Id               string
+	CompactResponses bool   // successful acks are sent as a CompactResponse instead of the full Response
+	LegacyResponses  bool   // responses are sent as a LegacyResponse, for clients that connected with PROTOCOL_V0
+	TopicPrefix      string // topics the client names are under this prefix, and it's stripped from topics sent to the client
+	Compression      string // compression negotiated for the connection, COMPRESSION_NONE if it isn't compressed
+	Codec            string // subprotocol negotiated for the connection, which is the shape responses are sent in
+	mu               sync.Mutex
+	queue            *outboundQueue
+	write            func(message any) error
+}
+
+// ScopeTopic will return the full name of a topic the client named, with the client's prefix.
+func (c *Client) ScopeTopic(name string) string {
+	return c.TopicPrefix + name
+}
+
+// UnscopeTopic will return the name the client knows a topic by, without the client's prefix.
+func (c *Client) UnscopeTopic(name string) string {
+	return strings.TrimPrefix(name, c.TopicPrefix)
+}
+
+// InScope returns true if the topic is under the client's prefix, so the client can use it.
+func (c *Client) InScope(name string) bool {
+	return strings.HasPrefix(name, c.TopicPrefix)
+}
+
+// Unscoped will return the message with the topic named the way the client knows it. The message
+// is copied if the topic has to change, so the same message can be sent to other clients.
+func (c *Client) Unscoped(msg *WebSocketMessage) *WebSocketMessage {
+	if c.TopicPrefix == "" || !c.InScope(msg.Topic) {
+		return msg
+	}
+	unscoped := *msg
+	unscoped.Topic = c.UnscopeTopic(msg.Topic)
+	return &unscoped
+}
+
+// outboundEntry is a single message waiting to be written to a client. The key is
+// the topic for conflated messages and blank for everything else.
+type outboundEntry struct {
+	key      string
+	message  any
+	policy   OverflowPolicy
+	expires  time.Time // zero if the message doesn't expire
+	priority Priority
+}
+
+// expired returns true if the message expired before now and shouldn't be written.
+func (e *outboundEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// outboundQueue holds the messages waiting to be written to a client, ordered by priority and
+// then by when they were sent. Conflated messages get a topic-keyed slot so a newer value can
+// replace an undelivered one.
+type outboundQueue struct {
+	mu      sync.Mutex
+	entries []*outboundEntry
+	slots   map[string]*outboundEntry
+	notify  chan struct{}
+	done    chan struct{}
+	maxSize int
+	policy  OverflowPolicy // used for messages sent without a policy of their own
+	dropped int
+	expired int  // messages that were dropped because they expired before they were written
+	overrun bool // a message that can't be dropped overflowed the queue, so the client is disconnected
+	started bool
+	closed  bool
+	err     error
+}
+
+// NewClient will create a client for a connection that is ready to be started.
+func NewClient(conn *websocket.Conn, id string) *Client {
+	c := &Client{
+		Conn: conn,
+		Id:   id,
+		queue: &outboundQueue{
+			slots:   make(map[string]*outboundEntry),
+			notify:  make(chan struct{}, 1),
+			done:    make(chan struct{}),
+			maxSize: DEFAULT_SEND_QUEUE_SIZE,
+			policy:  OverflowDisconnect,
+		},
+	}
+	c.write = c.writeMessage
+	return c
+}
+
+// Start will start the writer goroutine that drains the outbound queue to the connection.
+func (c *Client) Start() {
+	if c.queue == nil {
+		return
+	}
+	c.queue.mu.Lock()
+	if c.queue.started || c.queue.closed {
+		c.queue.mu.Unlock()
+		return
+	}
+	c.queue.started = true
+	c.queue.mu.Unlock()
+
+	go c.writeLoop()
+}
+
+// Close will stop the writer goroutine. Anything still in the outbound queue is dropped.
+func (c *Client) Close() {
+	if c.queue == nil {
+		return
+	}
+	c.queue.mu.Lock()
+	defer c.queue.mu.Unlock()
+	if c.queue.closed {
+		return
+	}
+	c.queue.closed = true
+	c.queue.entries = nil
+	c.queue.slots = make(map[string]*outboundEntry)
+	close(c.queue.done)
+}
+
+// SetOverflowPolicy will set what happens to messages that are sent without a policy of their
+// own when the outbound queue is full. Defaults to OverflowDisconnect.
+func (c *Client) SetOverflowPolicy(policy OverflowPolicy) {
+	if c.queue == nil || policy == "" {
+		return
+	}
+	c.queue.mu.Lock()
+	defer c.queue.mu.Unlock()
+	c.queue.policy = policy
 }
 
+// Dropped returns the number of messages that were dropped because the outbound queue was full.
+func (c *Client) Dropped() int {
+	if c.queue == nil {
+		return 0
+	}
+	c.queue.mu.Lock()
+	defer c.queue.mu.Unlock()
+	return c.queue.dropped
+}
+
+// Expired returns the number of queued messages that were dropped because they expired before they were written.
+func (c *Client) Expired() int {
+	if c.queue == nil {
+		return 0
+	}
+	c.queue.mu.Lock()
+	defer c.queue.mu.Unlock()
+	return c.queue.expired
+}
+
+// SendJSON will queue a message to be written to the client. Returns error if the
+// client is closed, the queue overflowed, or a previous write to the client failed. Returns
+// ErrMessageDropped if the queue is full and the message was dropped instead.
 func (c *Client) SendJSON(message any) error {
+	return c.enqueue("", message, "", time.Time{}, PriorityNormal)
+}
+
+// SendPrepared will queue a message that has already been encoded to be written to the client.
+// This is used when the same message goes to many clients so it is only encoded once. The
+// policy is what happens if the outbound queue is full, or blank for the client's policy. If
+// expires isn't zero, the message is dropped instead of written once it's past that time. The
+// message is written before any queued messages with a lower priority. Returns
+// ErrMessageDropped if the queue is full and the message was dropped instead.
+func (c *Client) SendPrepared(message *websocket.PreparedMessage, policy OverflowPolicy, expires time.Time, priority Priority) error {
+	return c.enqueue("", message, policy, expires, priority)
+}
+
+// SendConflated will queue a message for a topic to be written to the client. If a message
+// for the same topic is still waiting to be written, it is replaced by this one so a slow
+// client only gets the latest value. The message can be a *websocket.PreparedMessage. The
+// policy is what happens if the outbound queue is full, or blank for the client's policy. If
+// expires isn't zero, the message is dropped instead of written once it's past that time. The
+// message is written before any queued messages with a lower priority. Returns
+// ErrMessageConflated if it replaced a message, and ErrMessageDropped if it was dropped.
+func (c *Client) SendConflated(topic string, message any, policy OverflowPolicy, expires time.Time, priority Priority) error {
+	return c.enqueue(topic, message, policy, expires, priority)
+}
+
+// QueueLength returns the number of messages waiting to be written to the client.
+func (c *Client) QueueLength() int {
+	if c.queue == nil {
+		return 0
+	}
+	c.queue.mu.Lock()
+	defer c.queue.mu.Unlock()
+	return len(c.queue.entries)
+}
+
+// enqueue will add a message to the outbound queue behind the queued messages with the same
+// or a higher priority, replacing the message in the slot for the key if there is one. Writes
+// directly if the writer isn't started. If the queue is full, expired messages are dropped
+// first and then the overflow policy decides what is dropped. Returns ErrMessageConflated if the
+// message replaced the one in its slot, and ErrMessageDropped if the message itself was dropped.
+func (c *Client) enqueue(key string, message any, policy OverflowPolicy, expires time.Time, priority Priority) error {
+	if c.queue == nil {
+		return c.writeMessage(message)
+	}
+
+	q := c.queue
+	q.mu.Lock()
+	if !q.started && !q.closed {
+		q.mu.Unlock()
+		return c.write(message)
+	}
+	if q.err != nil {
+		err := q.err
+		q.mu.Unlock()
+		return err
+	}
+	if q.closed {
+		q.mu.Unlock()
+		return fmt.Errorf("client %s is closed", c.Id)
+	}
+
+	if key != "" {
+		if entry, ok := q.slots[key]; ok { // undelivered value for the topic, replace it
+			entry.message = message
+			entry.expires = expires
+			if priority > entry.priority { // the new value is more urgent, so it moves up the queue
+				q.remove(entry)
+				entry.priority = priority
+				q.insert(entry)
+			}
+			q.mu.Unlock()
+			return ErrMessageConflated
+		}
+	}
+
+	if policy == "" {
+		policy = q.policy
+	}
+	if len(q.entries) >= q.maxSize {
+		q.dropExpired(time.Now())
+	}
+	if len(q.entries) >= q.maxSize && !q.makeRoom(policy) {
+		if policy != OverflowDisconnect {
+			q.dropped++
+			q.mu.Unlock()
+			return ErrMessageDropped
+		}
+
+		// nothing else is sent to the client. It's disconnected on its own goroutine since the
+		// writer can be stuck writing to a connection that isn't being read from.
+		q.overrun = true
+		q.err = fmt.Errorf("%w for client %s", ErrSendQueueFull, c.Id)
+		q.entries = nil
+		q.slots = make(map[string]*outboundEntry)
+		err := q.err
+		q.mu.Unlock()
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+		go c.Disconnect(DisconnectSendQueueOverflow, "send queue overflowed")
+		return err
+	}
+
+	entry := &outboundEntry{key: key, message: message, policy: policy, expires: expires, priority: priority}
+	q.insert(entry)
+	if key != "" {
+		q.slots[key] = entry
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default: // writer already has a pending notification
+	}
+	return nil
+}
+
+// insert will add the entry behind every queued entry with the same or a higher priority. Must
+// hold the lock.
+func (q *outboundQueue) insert(entry *outboundEntry) {
+	i := len(q.entries)
+	for i > 0 && q.entries[i-1].priority < entry.priority {
+		i--
+	}
+	q.entries = slices.Insert(q.entries, i, entry)
+}
+
+// remove will take the entry out of the queue without touching its slot. Must hold the lock.
+func (q *outboundQueue) remove(entry *outboundEntry) {
+	if i := slices.Index(q.entries, entry); i >= 0 {
+		q.entries = slices.Delete(q.entries, i, i+1)
+	}
+}
+
+// makeRoom will drop the oldest queued message with the lowest priority that can be dropped if
+// the policy is to drop the oldest. Returns true if there is room for another message. Must hold
+// the lock.
+func (q *outboundQueue) makeRoom(policy OverflowPolicy) bool {
+	if policy != OverflowDropOldest {
+		return false
+	}
+	var oldest *outboundEntry
+	for _, entry := range q.entries {
+		if entry.policy == OverflowDisconnect {
+			continue
+		}
+		if oldest == nil || entry.priority < oldest.priority {
+			oldest = entry
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	if oldest.key != "" && q.slots[oldest.key] == oldest {
+		delete(q.slots, oldest.key)
+	}
+	q.remove(oldest)
+	q.dropped++
+	return true
+}
+
+// dropExpired will remove every queued message that has expired. Must hold the lock.
+func (q *outboundQueue) dropExpired(now time.Time) {
+	kept := q.entries[:0]
+	for _, entry := range q.entries {
+		if !entry.expired(now) {
+			kept = append(kept, entry)
+			continue
+		}
+		if entry.key != "" && q.slots[entry.key] == entry {
+			delete(q.slots, entry.key)
+		}
+		q.expired++
+	}
+	clear(q.entries[len(kept):])
+	q.entries = kept
+}
+
+// writeLoop will write messages from the outbound queue to the connection until the
+// client is closed or a write fails. The error from a failed write is kept and returned
+// from the following sends so the failure can be handled by the sender.
+func (c *Client) writeLoop() {
+	q := c.queue
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.notify:
+		}
+
+		q.mu.Lock()
+		overrun := q.overrun
+		q.mu.Unlock()
+		if overrun { // the client is being disconnected
+			return
+		}
+
+		for {
+			q.mu.Lock()
+			if q.closed || len(q.entries) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			entry := q.entries[0]
+			q.entries[0] = nil
+			q.entries = q.entries[1:]
+			if entry.key != "" && q.slots[entry.key] == entry {
+				delete(q.slots, entry.key)
+			}
+			if entry.expired(time.Now()) { // went stale while it was waiting, don't deliver it
+				q.expired++
+				q.mu.Unlock()
+				continue
+			}
+			message := entry.message
+			q.mu.Unlock()
+
+			if err := c.write(message); err != nil {
+				q.mu.Lock()
+				q.err = err
+				q.entries = nil
+				q.slots = make(map[string]*outboundEntry)
+				q.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// Overflowed returns true if the client's send queue overflowed and it is being disconnected.
+func (c *Client) Overflowed() bool {
+	if c.queue == nil {
+		return false
+	}
+	c.queue.mu.Lock()
+	defer c.queue.mu.Unlock()
+	return c.queue.overrun
+}
+
+// Disconnect will tell the client why it's being disconnected with the reason's close code and
+// the text, and close the connection, which ends the read loop for the client so it's cleaned up.
+// The text is cut short if it doesn't fit in a close frame.
+func (c *Client) Disconnect(reason DisconnectReason, text string) {
+	if c.Conn == nil {
+		return
+	}
+	for len(text) > MAX_CLOSE_REASON_SIZE || !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+	closeMessage := websocket.FormatCloseMessage(reason.CloseCode(), text)
+	_ = c.Conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	_ = c.Conn.Close()
+}
+
+// writeMessage will write a message directly to the connection. Prepared messages are
+// written as is, and anything else is encoded as json.
+func (c *Client) writeMessage(message any) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if prepared, ok := message.(*websocket.PreparedMessage); ok {
+		return c.Conn.WritePreparedMessage(prepared)
+	}
 	return c.Conn.WriteJSON(message)
 }
@@ -0,0 +1,354 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowWriter records messages written to a client and blocks each write until released.
+type slowWriter struct {
+	mu      sync.Mutex
+	written []any
+	release chan struct{}
+	started chan struct{}
+}
+
+func newSlowWriter() *slowWriter {
+	return &slowWriter{
+		release: make(chan struct{}),
+		started: make(chan struct{}, 100),
+	}
+}
+
+func (w *slowWriter) write(message any) error {
+	w.started <- struct{}{}
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.written = append(w.written, message)
+	return nil
+}
+
+func (w *slowWriter) messages() []any {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]any(nil), w.written...)
+}
+
+func newTestClient(w *slowWriter) *Client {
+	c := NewClient(nil, "slow-client")
+	c.write = w.write
+	c.Start()
+	return c
+}
+
+func TestSendConflated_SlowClientOnlyGetsLatest(t *testing.T) {
+	w := newSlowWriter()
+	c := newTestClient(w)
+	defer c.Close()
+
+	// first value gets picked up by the writer, which is now blocked writing it
+	require.NoError(t, c.SendConflated("topic", 0, "", time.Time{}, PriorityNormal))
+	<-w.started
+
+	// burst while the client is slow
+	require.NoError(t, c.SendConflated("topic", 1, "", time.Time{}, PriorityNormal))
+	for i := 2; i <= 100; i++ {
+		require.ErrorIs(t, c.SendConflated("topic", i, "", time.Time{}, PriorityNormal), ErrMessageConflated)
+	}
+	assert.Equal(t, 1, c.QueueLength())
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{0, 100}, w.messages())
+}
+
+func TestSendConflated_KeepsTopicsSeparate(t *testing.T) {
+	w := newSlowWriter()
+	c := newTestClient(w)
+	defer c.Close()
+
+	require.NoError(t, c.SendJSON("blocker"))
+	<-w.started
+
+	require.NoError(t, c.SendConflated("a", "a1", "", time.Time{}, PriorityNormal))
+	require.NoError(t, c.SendConflated("b", "b1", "", time.Time{}, PriorityNormal))
+	require.ErrorIs(t, c.SendConflated("a", "a2", "", time.Time{}, PriorityNormal), ErrMessageConflated)
+	require.NoError(t, c.SendJSON("response"))
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 4 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "a2", "b1", "response"}, w.messages())
+}
+
+func TestSendJSON_SlowClientGetsEveryMessage(t *testing.T) {
+	w := newSlowWriter()
+	c := newTestClient(w)
+	defer c.Close()
+
+	require.NoError(t, c.SendJSON(0))
+	<-w.started
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, c.SendJSON(i))
+	}
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 11 }, time.Second, 10*time.Millisecond)
+}
+
+func TestSendJSON_ReturnsWriteError(t *testing.T) {
+	c := NewClient(nil, "failing-client")
+	c.write = func(message any) error { return fmt.Errorf("write failed") }
+	c.Start()
+	defer c.Close()
+
+	require.NoError(t, c.SendJSON("first"))
+	assert.Eventually(t, func() bool { return c.SendJSON("next") != nil }, time.Second, 10*time.Millisecond)
+}
+
+func TestSendJSON_ClosedClient(t *testing.T) {
+	w := newSlowWriter()
+	c := newTestClient(w)
+	c.Close()
+
+	assert.Error(t, c.SendJSON("after close"))
+}
+
+// newBackedUpClient will create a client with room for size messages whose writer is blocked
+// writing the "blocker" message, so everything sent to it after is queued.
+func newBackedUpClient(t *testing.T, w *slowWriter, size int) *Client {
+	c := newTestClient(w)
+	c.queue.maxSize = size
+	require.NoError(t, c.SendJSON("blocker"))
+	<-w.started
+	return c
+}
+
+func TestOverflow_DropNewest(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, 2)
+	defer c.Close()
+
+	require.NoError(t, c.SendConflated("a", "a", OverflowDropNewest, time.Time{}, PriorityNormal))
+	require.NoError(t, c.SendConflated("b", "b", OverflowDropNewest, time.Time{}, PriorityNormal))
+	require.ErrorIs(t, c.SendConflated("c", "c", OverflowDropNewest, time.Time{}, PriorityNormal), ErrMessageDropped)
+	assert.Equal(t, 2, c.QueueLength())
+	assert.Equal(t, 1, c.Dropped())
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "a", "b"}, w.messages())
+}
+
+func TestOverflow_DropOldest(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, 2)
+	defer c.Close()
+
+	require.NoError(t, c.SendConflated("a", "a", OverflowDropOldest, time.Time{}, PriorityNormal))
+	require.NoError(t, c.SendConflated("b", "b", OverflowDropOldest, time.Time{}, PriorityNormal))
+	require.NoError(t, c.SendConflated("c", "c", OverflowDropOldest, time.Time{}, PriorityNormal))
+	assert.Equal(t, 2, c.QueueLength())
+	assert.Equal(t, 1, c.Dropped())
+
+	// the slot for the dropped topic is gone too, so a new value for it is queued again
+	require.NoError(t, c.SendConflated("a", "a2", OverflowDropOldest, time.Time{}, PriorityNormal))
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "c", "a2"}, w.messages())
+}
+
+func TestOverflow_DropOldestKeepsMessagesThatMustNotDrop(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, 2)
+	defer c.Close()
+
+	require.NoError(t, c.SendJSON("command")) // the client policy defaults to disconnect
+	require.NoError(t, c.SendConflated("a", "a", OverflowDropOldest, time.Time{}, PriorityNormal))
+	require.NoError(t, c.SendConflated("b", "b", OverflowDropOldest, time.Time{}, PriorityNormal))
+	assert.Equal(t, 1, c.Dropped())
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "command", "b"}, w.messages())
+}
+
+func TestOverflow_DropOldestWithNothingToDropDropsNewest(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, 2)
+	defer c.Close()
+
+	require.NoError(t, c.SendJSON("command1"))
+	require.NoError(t, c.SendJSON("command2"))
+	require.ErrorIs(t, c.SendConflated("a", "a", OverflowDropOldest, time.Time{}, PriorityNormal), ErrMessageDropped)
+	assert.Equal(t, 1, c.Dropped())
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "command1", "command2"}, w.messages())
+}
+
+func TestOverflow_Disconnect(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, 2)
+	defer c.Close()
+
+	require.NoError(t, c.SendJSON("a"))
+	require.NoError(t, c.SendJSON("b"))
+	assert.False(t, c.Overflowed())
+	assert.ErrorIs(t, c.SendJSON("c"), ErrSendQueueFull)
+	assert.True(t, c.Overflowed())
+	assert.ErrorIs(t, c.SendJSON("after"), ErrSendQueueFull)
+	assert.Equal(t, 0, c.QueueLength())
+
+	// nothing queued is written once the client is being disconnected
+	close(w.release)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []any{"blocker"}, w.messages())
+}
+
+func TestOverflow_ClientPolicyIsDefault(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, 1)
+	defer c.Close()
+	c.SetOverflowPolicy(OverflowDropNewest)
+
+	require.NoError(t, c.SendJSON("a"))
+	require.ErrorIs(t, c.SendJSON("b"), ErrMessageDropped)
+	assert.Equal(t, 1, c.Dropped())
+
+	// a message's own policy wins over the client's
+	assert.ErrorIs(t, c.SendConflated("c", "c", OverflowDisconnect, time.Time{}, PriorityNormal), ErrSendQueueFull)
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for input, expected := range map[string]OverflowPolicy{
+		"":           OverflowDisconnect,
+		"dropOldest": OverflowDropOldest,
+		"dropNewest": OverflowDropNewest,
+		"disconnect": OverflowDisconnect,
+	} {
+		policy, err := ParseOverflowPolicy(input)
+		require.NoError(t, err)
+		assert.Equal(t, expected, policy)
+	}
+	_, err := ParseOverflowPolicy("dropAll")
+	assert.Error(t, err)
+}
+
+func TestSend_ExpiredMessagesNotWritten(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, DEFAULT_SEND_QUEUE_SIZE)
+	defer c.Close()
+
+	// expired while it was waiting behind the blocker
+	require.NoError(t, c.SendConflated("a", "stale", "", time.Now().Add(-time.Millisecond), PriorityNormal))
+	require.NoError(t, c.SendConflated("b", "fresh", "", time.Now().Add(time.Hour), PriorityNormal))
+	require.NoError(t, c.SendJSON("response"))
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "fresh", "response"}, w.messages())
+	assert.Equal(t, 1, c.Expired())
+}
+
+func TestSend_FullQueueDropsExpiredFirst(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, 2)
+	defer c.Close()
+
+	require.NoError(t, c.SendConflated("a", "stale", OverflowDisconnect, time.Now().Add(-time.Millisecond), PriorityNormal))
+	require.NoError(t, c.SendConflated("b", "fresh", OverflowDisconnect, time.Time{}, PriorityNormal))
+
+	// the queue is full, but the expired message makes room so the client isn't disconnected
+	require.NoError(t, c.SendConflated("c", "c", OverflowDisconnect, time.Time{}, PriorityNormal))
+	assert.Equal(t, 1, c.Expired())
+	assert.Equal(t, 0, c.Dropped())
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "fresh", "c"}, w.messages())
+}
+
+func TestSend_HighPriorityJumpsQueue(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, DEFAULT_SEND_QUEUE_SIZE)
+	defer c.Close()
+
+	require.NoError(t, c.SendConflated("telemetry", "t1", "", time.Time{}, PriorityNormal))
+	require.NoError(t, c.SendJSON("response"))
+	require.NoError(t, c.SendConflated("control", "stop", "", time.Time{}, PriorityHigh))
+	require.NoError(t, c.SendConflated("other", "t2", "", time.Time{}, PriorityNormal))
+	require.NoError(t, c.SendConflated("alarm", "alarm", "", time.Time{}, PriorityHigh))
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 6 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "stop", "alarm", "t1", "response", "t2"}, w.messages())
+}
+
+func TestSendConflated_HighPriorityValueMovesUp(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, DEFAULT_SEND_QUEUE_SIZE)
+	defer c.Close()
+
+	require.NoError(t, c.SendJSON("response"))
+	require.NoError(t, c.SendConflated("a", "a1", "", time.Time{}, PriorityNormal))
+	require.ErrorIs(t, c.SendConflated("a", "a2", "", time.Time{}, PriorityHigh), ErrMessageConflated)
+	// a later normal value keeps the slot where it is
+	require.ErrorIs(t, c.SendConflated("a", "a3", "", time.Time{}, PriorityNormal), ErrMessageConflated)
+	assert.Equal(t, 2, c.QueueLength())
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "a3", "response"}, w.messages())
+}
+
+func TestOverflow_DropOldestDropsLowPriorityFirst(t *testing.T) {
+	w := newSlowWriter()
+	c := newBackedUpClient(t, w, 2)
+	defer c.Close()
+
+	require.NoError(t, c.SendConflated("control", "stop", OverflowDropOldest, time.Time{}, PriorityHigh))
+	require.NoError(t, c.SendConflated("a", "a", OverflowDropOldest, time.Time{}, PriorityNormal))
+	require.NoError(t, c.SendConflated("b", "b", OverflowDropOldest, time.Time{}, PriorityNormal))
+	assert.Equal(t, 1, c.Dropped())
+
+	close(w.release)
+	assert.Eventually(t, func() bool { return len(w.messages()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{"blocker", "stop", "b"}, w.messages())
+}
+
+func TestParsePriority(t *testing.T) {
+	for input, expected := range map[string]Priority{"": PriorityNormal, "normal": PriorityNormal, "high": PriorityHigh} {
+		priority, err := ParsePriority(input)
+		require.NoError(t, err)
+		assert.Equal(t, expected, priority)
+	}
+	_, err := ParsePriority("urgent")
+	assert.Error(t, err)
+}
+
+func TestTopicPrefix_ScopeAndUnscope(t *testing.T) {
+	c := NewClient(nil, "tenant")
+	c.TopicPrefix = "tenant-a/"
+
+	assert.Equal(t, "tenant-a/sensors", c.ScopeTopic("sensors"))
+	assert.Equal(t, "sensors", c.UnscopeTopic("tenant-a/sensors"))
+	assert.True(t, c.InScope("tenant-a/sensors"))
+	assert.False(t, c.InScope("tenant-b/sensors"))
+	assert.False(t, c.InScope("tenant-a2/sensors"), "a prefix ending in / doesn't reach a tenant whose prefix it starts")
+
+	msg := &WebSocketMessage{MessageId: "1", Topic: "tenant-a/sensors"}
+	unscoped := c.Unscoped(msg)
+	assert.Equal(t, "sensors", unscoped.Topic)
+	assert.Equal(t, "tenant-a/sensors", msg.Topic, "the message can still be sent to other clients")
+
+	// clients without a prefix get the message as is
+	assert.Same(t, msg, NewClient(nil, "server").Unscoped(msg))
+}
@@ -1,33 +1,166 @@
 package network
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/metrics"
 )
 
 // WebSocketMessage contains a message that is sent from the client to the server.
 // Contains the action to preform, the topic to preform the action on (if applicable),
 // and any accompanying data (if applicable)
 type WebSocketMessage struct {
-	MessageId  string          `json:"id"`
-	SenderId   string          `json:"senderId,omitempty"`
-	Action     string          `json:"action"`
-	Topic      string          `json:"topic,omitempty"`
-	Data       json.RawMessage `json:"data,omitempty"`
-	RequireAck bool            `json:"requireAck,omitempty"`
-	ParsedData map[string]any  `json:"-"`
+	MessageId     string            `json:"id"`
+	SenderId      string            `json:"senderId,omitempty"`
+	Action        string            `json:"action"`
+	Topic         string            `json:"topic,omitempty"`
+	Data          json.RawMessage   `json:"data,omitempty"`
+	RequireAck    bool              `json:"requireAck,omitempty"`
+	Options       *MessageOptions   `json:"options,omitempty"`
+	Timestamp     *time.Time        `json:"timestamp,omitempty"`     // set by the server on messages sent to subscribers
+	SchemaVersion *int              `json:"schemaVersion,omitempty"` // set by the server on messages sent to subscribers
+	ExpiresAt     *time.Time        `json:"expiresAt,omitempty"`     // set by the server on messages sent to subscribers with a ttl
+	Encoding      string            `json:"encoding,omitempty"`      // set by the server to "gzip" on messages sent to subscribers of a compressed topic
+	Format        string            `json:"format,omitempty"`        // set by the server to "raw" or "msgpack" on messages sent to subscribers of a binary topic
+	Sequence      uint64            `json:"seq,omitempty"`           // set by the server on messages sent to subscribers with an ack window
+	TopicSequence uint64            `json:"topicSeq,omitempty"`      // set by the server on messages sent to subscribers of a topic with a replay history
+	Headers       map[string]string `json:"headers,omitempty"`       // metadata about the data, such as a content type or trace id, that isn't validated against the schema
+	ParsedData    any               `json:"-"`
+	Result        *RequestResult    `json:"-"`
+	Priority      Priority          `json:"-"` // how urgently the message is written to subscribers
+	Binary        []byte            `json:"-"` // the raw payload of a message sent as a binary frame, instead of data
+	ctx           context.Context   // the context of handling the message, such as its trace span
+}
+
+// Context will return the context of handling the message, or the background context if it
+// doesn't have one.
+func (msg WebSocketMessage) Context() context.Context {
+	if msg.ctx == nil {
+		return context.Background()
+	}
+	return msg.ctx
+}
+
+// WithContext will return a copy of the message with the context of handling it.
+func (msg WebSocketMessage) WithContext(ctx context.Context) WebSocketMessage {
+	msg.ctx = ctx
+	return msg
+}
+
+// RequestResult records the outcome of handling a message so that decorators wrapping
+// a handler can see what was responded with. Safe to use on a nil RequestResult.
+type RequestResult struct {
+	code     atomic.Int64
+	mu       sync.Mutex
+	delivery DeliveryStats
+}
+
+// SetCode will record the status code that was responded with.
+func (r *RequestResult) SetCode(code int) {
+	if r != nil {
+		r.code.Store(int64(code))
+	}
+}
+
+// Code will return the status code that was responded with, or 0 if nothing was recorded.
+func (r *RequestResult) Code() int {
+	if r == nil {
+		return 0
+	}
+	return int(r.code.Load())
+}
+
+// AddDelivery will add the counts of a value sent to subscribers, so a message that publishes to
+// several topics records the total across all of them.
+func (r *RequestResult) AddDelivery(stats DeliveryStats) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delivery.Targeted += stats.Targeted
+	r.delivery.Delivered += stats.Delivered
+	r.delivery.Conflated += stats.Conflated
+	r.delivery.Failed += stats.Failed
+}
+
+// Delivery will return the counts of subscribers that values were sent to for the message.
+func (r *RequestResult) Delivery() DeliveryStats {
+	if r == nil {
+		return DeliveryStats{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.delivery
+}
+
+// DeliveryStats are how many subscribers a published value was meant for, how many it was
+// queued to be written to, how many it replaced an unwritten value for, and how many it couldn't
+// be sent to.
+type DeliveryStats struct {
+	Targeted  int `json:"targeted"`
+	Delivered int `json:"delivered"`
+	Conflated int `json:"conflated"`
+	Failed    int `json:"failed"`
+}
+
+// MessageOptions contains the optional settings a client can supply to change how an action is handled.
+type MessageOptions struct {
+	ValidationMode     string   `json:"validationMode,omitempty"`     // registerTopic: "strict" (default), "warn", or "off"
+	Conflate           bool     `json:"conflate,omitempty"`           // subscribe: only deliver the latest value if the client falls behind
+	PersistInterval    string   `json:"persistInterval,omitempty"`    // registerTopic: only persist the latest value once per interval, e.g. "500ms"
+	EchoToSender       *bool    `json:"echoToSender,omitempty"`       // subscribe: deliver the client's own publishes back to it (default true)
+	Webhook            string   `json:"webhook,omitempty"`            // registerTopic: http(s) url that every published value is posted to
+	At                 string   `json:"at,omitempty"`                 // get: RFC 3339 time to get the value the topic had at, instead of the latest
+	Compact            bool     `json:"compact,omitempty"`            // any: send a successful ack as a CompactResponse
+	OverflowPolicy     string   `json:"overflowPolicy,omitempty"`     // registerTopic: "dropOldest", "dropNewest", or "disconnect" when a subscriber falls behind
+	FillDefaults       bool     `json:"fillDefaults,omitempty"`       // registerTopic: fill fields missing from published values with their value in the schema
+	TickInterval       string   `json:"tickInterval,omitempty"`       // registerTopic: send subscribers a "tick" when nothing was published for the interval, e.g. "5s"
+	TtlMs              int64    `json:"ttlMs,omitempty"`              // publish, sendWithoutSave: milliseconds until the value is stale and isn't delivered anymore
+	Count              *int     `json:"count,omitempty"`              // getRecent: how many of the most recent values to get (default 10)
+	Priority           string   `json:"priority,omitempty"`           // publish, sendWithoutSave: "normal" (default) or "high" to be written to subscribers ahead of queued normal messages
+	AutoRegister       bool     `json:"autoRegister,omitempty"`       // publish: register the topic with the published value as its schema if it doesn't exist
+	Binary             bool     `json:"binary,omitempty"`             // registerTopic: the topic takes raw binary payloads sent as binary frames instead of json
+	Format             string   `json:"format,omitempty"`             // registerTopic: "json" (default), "raw", or "msgpack" for how published values are encoded
+	Compressed         bool     `json:"compressed,omitempty"`         // registerTopic: gzip published values when they're stored and sent to subscribers
+	DeliveryReport     bool     `json:"deliveryReport,omitempty"`     // publish, sendWithoutSave, publishTransaction: ack with how many subscribers the value was delivered to
+	KeepLatest         bool     `json:"keepLatest,omitempty"`         // pause: deliver the latest value published while paused when the subscription resumes
+	Chunked            bool     `json:"chunked,omitempty"`            // get, getRecent: split data bigger than the chunk size into several responses
+	DryRun             bool     `json:"dryRun,omitempty"`             // unregisterTopic: respond with what would be deleted without deleting anything
+	MaxPayloadSize     int      `json:"maxPayloadSize,omitempty"`     // registerTopic: most bytes a published value can be, instead of the server's max
+	Meta               bool     `json:"meta,omitempty"`               // get: respond with the value in an envelope with when and how it was stored
+	Aggregate          []string `json:"aggregate,omitempty"`          // registerTopic: numeric fields to keep running aggregates of, which get returns instead of the latest value
+	AckWindow          int      `json:"ackWindow,omitempty"`          // subscribe: how many sequenced values can be sent without being acked before delivery waits for an ack
+	MinPublishInterval string   `json:"minPublishInterval,omitempty"` // registerTopic: least time between values published to the topic, e.g. "100ms"
+	CooldownPolicy     string   `json:"cooldownPolicy,omitempty"`     // registerTopic: "reject" (default) or "coalesce" for values published sooner than minPublishInterval
+	RedeliveryAttempts int      `json:"redeliveryAttempts,omitempty"` // registerTopic: how many more times a value is sent to a subscriber it couldn't be sent to
+	RedeliveryDelay    string   `json:"redeliveryDelay,omitempty"`    // registerTopic: how long to wait before each redelivery, e.g. "200ms" (default 100ms)
+	ReplayHistory      int      `json:"replayHistory,omitempty"`      // registerTopic: how many of the last values to keep to replay to subscribers that resume
+	ResumeFrom         *uint64  `json:"resumeFrom,omitempty"`         // subscribe: replay the values after this topicSeq before values published after
 }
 
 func (msg *WebSocketMessage) GetLogFields() log.Fields {
 	return log.Fields{
-		"MessageId":  msg.MessageId,
-		"SenderId":   msg.SenderId,
-		"Action":     msg.Action,
-		"Topic":      msg.Topic,
-		"Data":       msg.Data,
-		"RequireAck": msg.RequireAck,
-		"ParsedData": msg.ParsedData,
+		"MessageId":     msg.MessageId,
+		"SenderId":      msg.SenderId,
+		"Action":        msg.Action,
+		"Topic":         msg.Topic,
+		"Data":          msg.Data,
+		"RequireAck":    msg.RequireAck,
+		"Options":       msg.Options,
+		"Timestamp":     msg.Timestamp,
+		"SchemaVersion": msg.SchemaVersion,
+		"ExpiresAt":     msg.ExpiresAt,
+		"Encoding":      msg.Encoding,
+		"Headers":       msg.Headers,
+		"ParsedData":    msg.ParsedData,
+		"BinarySize":    len(msg.Binary),
 	}
 }
 
@@ -35,12 +168,15 @@ func (msg *WebSocketMessage) GetLogFields() log.Fields {
 // it will contain the type of response, the status code as http code,
 // any accompanying message about the status if applicable, and the data if applicable
 type Response struct {
-	MessageId string `json:"id"`
-	Action    string `json:"action"`
-	Code      int    `json:"code"`              // 200, 400, etc.
-	Message   string `json:"message,omitempty"` // "OK" or error message
-	Data      any    `json:"data,omitempty"`    // optional payload (topic info, schema, etc.)
-	Type      string `json:"type,omitempty"`    // "response" for clients to tell if something is response or request.
+	MessageId string   `json:"id"`
+	Action    string   `json:"action"`
+	Code      int      `json:"code"`                // 200, 400, etc.
+	Message   string   `json:"message,omitempty"`   // "OK" or error message
+	ErrorCode string   `json:"errorCode,omitempty"` // machine readable code for some errors, such as "TOPIC_HAS_NO_SCHEMA"
+	Data      any      `json:"data,omitempty"`      // optional payload (topic info, schema, etc.)
+	Type      string   `json:"type,omitempty"`      // "response" for clients to tell if something is response or request.
+	Warnings  []string `json:"warnings,omitempty"`  // non-fatal issues with the request, such as schema mismatches.
+	Chunk     *Chunk   `json:"chunk,omitempty"`     // set when the data is one piece of a chunked response.
 }
 
 func (response *Response) GetLogFields() log.Fields {
@@ -49,8 +185,11 @@ func (response *Response) GetLogFields() log.Fields {
 		"Action":    response.Action,
 		"Code":      response.Code,
 		"Message":   response.Message,
+		"ErrorCode": response.ErrorCode,
 		"Data":      response.Data,
 		"Type":      response.Type,
+		"Warnings":  response.Warnings,
+		"Chunk":     response.Chunk,
 	}
 }
 
@@ -65,16 +204,320 @@ func NewResponse(msg WebSocketMessage, code int, message string, data any) Respo
 	}
 }
 
+// CompactResponse is a successful response without the rest of the envelope, for clients that
+// only want the data back. Only the message id and any non-empty fields are sent.
+type CompactResponse struct {
+	MessageId string   `json:"id"`
+	Data      any      `json:"data,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
 // TopicSchemaResponse will contain information a client would want to
 // know about a topic schema
 type TopicSchemaResponse struct {
-	Version int            `json:"version"`
-	Schema  map[string]any `json:"schema"`
+	Version int    `json:"version"`
+	Schema  any    `json:"schema"`
+	Hash    string `json:"hash"` // SHA-256 of the canonical json schema, for detecting drift
+}
+
+// TopicDefinitionResponse is a topic's full schema history, used to export topic definitions
+// from one server and import them into another.
+type TopicDefinitionResponse struct {
+	Name           string                `json:"name"`
+	ValidationMode string                `json:"validationMode,omitempty"`
+	Schemas        []TopicSchemaResponse `json:"schemas"`
+}
+
+// SchemaRegistry is the definitions of all of the topics on a server.
+type SchemaRegistry struct {
+	Topics []TopicDefinitionResponse `json:"topics"`
+}
+
+// PublishTransactionRequest is the data of a publishTransaction message, the values to publish
+// to each topic in a single transaction.
+type PublishTransactionRequest struct {
+	Values []TransactionValue `json:"values"`
+}
+
+// TransactionValue is the value to publish to a single topic in a transaction.
+type TransactionValue struct {
+	Topic string `json:"topic"`
+	Data  any    `json:"data"`
+}
+
+// PublishIfRequest is the data of a publishIf message, the value to publish and what the topic's
+// current value has to be for it to be published. Expected is left as json so an expected null,
+// for a topic with no value, can be told apart from no expected value.
+type PublishIfRequest struct {
+	Value             any             `json:"value"`
+	Expected          json.RawMessage `json:"expected,omitempty"`
+	ExpectedTimestamp string          `json:"expectedTimestamp,omitempty"` // when the current value was stored, as returned by a get with the meta option
+}
+
+// AckRequest is the data of an ack message, which acks every value sent to the subscription with
+// a sequence number up to seq.
+type AckRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+// ResumeResponse is the data of the response to a subscribe that resumed from a sequence number.
+// The values replayed are sent after it.
+type ResumeResponse struct {
+	Replayed  int    `json:"replayed"`
+	Gap       bool   `json:"gap"` // values after resumeFrom aren't kept anymore, so the client missed some
+	OldestSeq uint64 `json:"oldestSeq,omitempty"`
+	LatestSeq uint64 `json:"latestSeq"`
+}
+
+// ValidateSchemaRequest is the data of a validateSchema message, a candidate schema for a topic
+// and an optional sample payload to check against it.
+type ValidateSchemaRequest struct {
+	Schema any `json:"schema"`
+	Sample any `json:"sample,omitempty"`
+}
+
+// ValidateSchemaResponse is whether a candidate schema is compatible with the current schema of
+// a topic and whether the sample payload matches it.
+type ValidateSchemaResponse struct {
+	Compatible   bool     `json:"compatible"`
+	Differences  []string `json:"differences,omitempty"`
+	SampleValid  *bool    `json:"sampleValid,omitempty"` // only set when a sample was supplied
+	SampleErrors []string `json:"sampleErrors,omitempty"`
+}
+
+// MigrateSchemaRequest is the data of a migrateSchema message, the new schema for a topic and how
+// to transform its stored value to match it.
+type MigrateSchemaRequest struct {
+	Schema    any             `json:"schema"`
+	Transform SchemaTransform `json:"transform"`
+}
+
+// SchemaTransform is how a stored value is changed to match a new schema. Fields are renamed, then
+// dropped, then set. Nested fields are named by their path with dots, like "location.lat".
+type SchemaTransform struct {
+	Rename map[string]string `json:"rename,omitempty"` // old field name to new field name
+	Drop   []string          `json:"drop,omitempty"`   // fields to remove
+	Set    map[string]any    `json:"set,omitempty"`    // fields to set to a value
+}
+
+// MigrateSchemaResponse is the schema version a topic was migrated to and its migrated value.
+type MigrateSchemaResponse struct {
+	SchemaVersion int  `json:"schemaVersion"`
+	Migrated      bool `json:"migrated"`        // false if the topic had no stored value to migrate
+	Value         any  `json:"value,omitempty"` // the stored value after it was migrated
+}
+
+// UpdateSchemaManyRequest is the data of an updateSchemaMany message, the new schema for each of
+// the topics to update.
+type UpdateSchemaManyRequest struct {
+	Schemas []TopicSchemaUpdate `json:"schemas"`
+}
+
+// TopicSchemaUpdate is the new schema for a single topic in an updateSchemaMany message.
+type TopicSchemaUpdate struct {
+	Topic  string `json:"topic"`
+	Schema any    `json:"schema"`
+}
+
+// UpdateSchemaManyResponse is the result of updating the schema of each topic, in the order they
+// were requested, and how many of them couldn't be updated.
+type UpdateSchemaManyResponse struct {
+	Results []SchemaUpdateResult `json:"results"`
+	Failed  int                  `json:"failed"`
+}
+
+// SchemaUpdateResult is the result of updating the schema of a single topic, with the topic's new
+// schema version if it was updated, or why it couldn't be.
+type SchemaUpdateResult struct {
+	Topic         string `json:"topic"`
+	Updated       bool   `json:"updated"`
+	SchemaVersion int    `json:"schemaVersion,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// ImportSchemasResponse is how many topics and schema versions were added by an import.
+type ImportSchemasResponse struct {
+	TopicsCreated int `json:"topicsCreated"`
+	VersionsAdded int `json:"versionsAdded"`
 }
 
 // TopicResponse is the struct that will contain the information a client
 // would want to know about a topic
 type TopicResponse struct {
-	Name   string              `json:"name"`
-	Schema TopicSchemaResponse `json:"schema"`
+	Name           string              `json:"name"`
+	Schema         TopicSchemaResponse `json:"schema"`
+	ValidationMode string              `json:"validationMode"`
+	HasValue       bool                `json:"hasValue"`
+	LastUpdated    *time.Time          `json:"lastUpdated,omitempty"`
+	Binary         bool                `json:"binary,omitempty"`
+	Format         string              `json:"format"`
+	Compressed     bool                `json:"compressed,omitempty"`
+	MaxPayloadSize int                 `json:"maxPayloadSize,omitempty"`
+	Aggregate      []string            `json:"aggregate,omitempty"`
+}
+
+// TopicStatsResponse is the admin view of the state of a topic.
+type TopicStatsResponse struct {
+	Name            string     `json:"name"`
+	SchemaVersion   int        `json:"schemaVersion"`
+	ValidationMode  string     `json:"validationMode"`
+	SubscriberCount int        `json:"subscriberCount"`
+	HasValue        bool       `json:"hasValue"`
+	LastUpdated     *time.Time `json:"lastUpdated,omitempty"`
+	LastPublished   *time.Time `json:"lastPublished,omitempty"`
+}
+
+// AdminTopicsResponse is the admin view of all of the topics on the server.
+type AdminTopicsResponse struct {
+	Topics []TopicStatsResponse `json:"topics"`
+}
+
+// DisconnectResponse is the admin view of a client that was disconnected.
+type DisconnectResponse struct {
+	ClientId  string    `json:"clientId"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// AdminDisconnectsResponse is the admin view of the clients that were recently disconnected.
+type AdminDisconnectsResponse struct {
+	Disconnects []DisconnectResponse `json:"disconnects"`
+}
+
+// ClientSubscriptionResponse is a topic a client is subscribed to and the options it subscribed with.
+type ClientSubscriptionResponse struct {
+	Topic     string `json:"topic"`
+	Conflate  bool   `json:"conflate,omitempty"`
+	NoEcho    bool   `json:"noEcho,omitempty"`
+	AckWindow int    `json:"ackWindow,omitempty"`
+}
+
+// AdminClientSubscriptionsResponse is the admin view of the topics a client is subscribed to.
+type AdminClientSubscriptionsResponse struct {
+	ClientId      string                       `json:"clientId"`
+	Subscriptions []ClientSubscriptionResponse `json:"subscriptions"`
+}
+
+// AdminClientResponse is the admin view of a connected client and what its connection negotiated.
+type AdminClientResponse struct {
+	ClientId    string `json:"clientId"`
+	Compression string `json:"compression"` // "permessage-deflate" or "none"
+	Codec       string `json:"codec"`       // the subprotocol responses are sent in
+}
+
+// LockStatsResponse is how many times a method took a lock and how long it waited for it, in
+// nanoseconds like the action metrics. Component is "TopicManager" or "Topic: " and the topic name.
+type LockStatsResponse struct {
+	Component    string        `json:"component"`
+	Method       string        `json:"method"`
+	Mode         string        `json:"mode"` // "RLock" or "Lock"
+	Acquisitions int64         `json:"acquisitions"`
+	TotalWait    time.Duration `json:"totalWait"`
+	MaxWait      time.Duration `json:"maxWait"`
+}
+
+// LocksResponse is the lock stats of the topic manager and every topic.
+type LocksResponse struct {
+	Locks []LockStatsResponse `json:"locks"`
+}
+
+// ServerStatsResponse is a snapshot of how many clients, topics, and subscriptions are on the server.
+type ServerStatsResponse struct {
+	Clients              int   `json:"clients"`
+	Topics               int   `json:"topics"`
+	Subscriptions        int   `json:"subscriptions"`
+	DroppedFailedClients int64 `json:"droppedFailedClients"` // failed sends to clients that weren't counted because the queue was full
+}
+
+// TopicExistsResponse is if a topic is registered, with its latest schema version if it is.
+type TopicExistsResponse struct {
+	Exists        bool `json:"exists"`
+	SchemaVersion *int `json:"schemaVersion,omitempty"`
+}
+
+// StorageStatsResponse is the approximate size on disk and number of keys in the server's storage.
+type StorageStatsResponse struct {
+	SizeBytes int64 `json:"sizeBytes"`
+	Keys      int64 `json:"keys"`
+}
+
+// ValueWithMeta is the response to a get with the meta option, the value of a topic with what is
+// known about when and how it was stored.
+type ValueWithMeta struct {
+	Topic         string            `json:"topic"`
+	Value         any               `json:"value"`
+	Timestamp     *time.Time        `json:"timestamp,omitempty"`     // when the value was stored, left out if it isn't known
+	SchemaVersion *int              `json:"schemaVersion,omitempty"` // the topic's schema version when the value was stored, left out if it isn't known
+	Latest        bool              `json:"latest"`                  // no newer value has been stored for the topic
+	Headers       map[string]string `json:"headers,omitempty"`       // the headers the value was published with, left out if it had none or they aren't known
+}
+
+// SubscriptionsRestored is the data of the message a client is sent when it reconnects with the
+// same id and the subscriptions it had when it disconnected are restored.
+type SubscriptionsRestored struct {
+	Topics []string `json:"topics"`
+}
+
+// ReadOnlyResponse is whether the server is in read only mode, and the body to turn it on or off.
+type ReadOnlyResponse struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// DryRunResponse is what a destructive action would have deleted if it wasn't a dry run.
+type DryRunResponse struct {
+	Topics []DryRunTopic `json:"topics"`
+}
+
+// DryRunTopic is a topic that a dry run would have deleted, whether it has a stored value that
+// would be deleted with it, and how many clients would lose their subscription to it.
+type DryRunTopic struct {
+	Name        string `json:"name"`
+	HasData     bool   `json:"hasData"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// StorageQueueResponse is how backed up the writes to the server's storage are, and whether that
+// has it reporting storage as degraded.
+type StorageQueueResponse struct {
+	Depth          int   `json:"depth"`          // writes waiting in the queue
+	Capacity       int   `json:"capacity"`       // writes the queue holds before rejecting them
+	WriteLatencyMs int64 `json:"writeLatencyMs"` // how long writes are taking from being queued to being written
+	Degraded       bool  `json:"degraded"`
+}
+
+// MetricsResponse is the action metrics collected since the server started, how many failed sends
+// to clients were dropped, the size of its storage and its write queue, and how contended its locks
+// are. Storage is left out if its stats couldn't be read.
+type MetricsResponse struct {
+	metrics.Summary
+	DroppedFailedClients int64                 `json:"droppedFailedClients"`
+	Storage              *StorageStatsResponse `json:"storage,omitempty"`
+	StorageQueue         StorageQueueResponse  `json:"storageQueue"`
+	Locks                []LockStatsResponse   `json:"locks"`
+}
+
+// ReadinessResponse is whether the server is ready to take traffic, and if it isn't, why not.
+type ReadinessResponse struct {
+	Status  string   `json:"status"` // "ready" or "degraded"
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// CapabilitiesResponse describes what the server supports, so clients and tools can adapt to the
+// version of the server they're connected to.
+type CapabilitiesResponse struct {
+	Actions         []string           `json:"actions"`                   // every action the server has a handler for, sorted
+	DisabledActions []string           `json:"disabledActions,omitempty"` // actions that are turned off by config
+	Codecs          []string           `json:"codecs"`                    // how message payloads can be encoded
+	Compression     bool               `json:"compression"`               // whether per message compression can be negotiated
+	Features        CapabilityFeatures `json:"features"`
+}
+
+// CapabilityFeatures are the features of the server that depend on how it's configured.
+type CapabilityFeatures struct {
+	History                bool   `json:"history"`  // whether older values are stored for getRecent and getting at a time
+	AuthMode               string `json:"authMode"` // "none" or "apiKey"
+	Admin                  bool   `json:"admin"`    // whether the admin endpoints are available
+	RequireRegisteredTopic bool   `json:"requireRegisteredTopic"`
+	ReadOnly               bool   `json:"readOnly"` // whether actions that change topics or stored values are rejected
 }
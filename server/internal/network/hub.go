@@ -1,10 +1,73 @@
 package network
 
-import "sync"
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	RECENT_DISCONNECTS_SIZE = 100 // how many disconnects the hub remembers
+)
+
+// DisconnectReason is why a client was removed from the hub.
+type DisconnectReason string
+
+const (
+	// DisconnectClosed is a client that closed its connection.
+	DisconnectClosed DisconnectReason = "closed"
+	// DisconnectReadError is a client whose connection failed while reading from it.
+	DisconnectReadError DisconnectReason = "readError"
+	// DisconnectFailureThreshold is a client that had too many messages fail to send to it.
+	DisconnectFailureThreshold DisconnectReason = "failureThreshold"
+	// DisconnectSendQueueOverflow is a client that fell so far behind that its send queue overflowed.
+	DisconnectSendQueueOverflow DisconnectReason = "sendQueueOverflow"
+	// DisconnectTakenOver is a client whose id was taken over by a new connection with its reconnect token.
+	DisconnectTakenOver DisconnectReason = "takenOver"
+	// DisconnectShutdown is a client that was connected when the server shut down.
+	DisconnectShutdown DisconnectReason = "shutdown"
+)
+
+// Close codes the server sends to clients it disconnects for reasons the websocket protocol
+// doesn't have a code for. Codes from 4000 are left for applications to define.
+const (
+	CLOSE_FAILURE_THRESHOLD   = 4000 // too many messages failed to send to the client
+	CLOSE_SEND_QUEUE_OVERFLOW = 4001 // the client fell so far behind that its send queue overflowed
+	CLOSE_TAKEN_OVER          = 4002 // the client's id was taken over by a new connection
+)
+
+// CloseCode will return the websocket close code the server sends to a client it disconnects for
+// the reason, so clients can tell why they were disconnected.
+func (r DisconnectReason) CloseCode() int {
+	switch r {
+	case DisconnectFailureThreshold:
+		return CLOSE_FAILURE_THRESHOLD
+	case DisconnectSendQueueOverflow:
+		return CLOSE_SEND_QUEUE_OVERFLOW
+	case DisconnectTakenOver:
+		return CLOSE_TAKEN_OVER
+	case DisconnectReadError:
+		return websocket.CloseProtocolError
+	case DisconnectShutdown:
+		return websocket.CloseGoingAway
+	default:
+		return websocket.CloseNormalClosure
+	}
+}
+
+// DisconnectRecord is a client that was removed from the hub, why, and when.
+type DisconnectRecord struct {
+	ClientId  string
+	Reason    DisconnectReason
+	Detail    string // more about the reason, such as the close code, if there is any
+	Timestamp time.Time
+}
 
 type ClientHub struct {
-	mu      sync.RWMutex
-	clients map[string]*Client
+	mu          sync.RWMutex
+	clients     map[string]*Client
+	disconnects []DisconnectRecord // oldest first, at most RECENT_DISCONNECTS_SIZE
 }
 
 func NewClientHub() *ClientHub {
@@ -21,12 +84,39 @@ func (c *ClientHub) AddClient(client *Client) {
 	c.clients[client.Id] = client
 }
 
-// RemoveClient removes a client from the list for a given key.
-func (c *ClientHub) RemoveClient(client *Client) {
+// RemoveClient removes a client from the list for a given key and records why it was removed.
+// Returns false if the client was already removed, in which case nothing is recorded.
+func (c *ClientHub) RemoveClient(client *Client, reason DisconnectReason, detail string) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.clients[client.Id] != client {
+		return false
+	}
 	delete(c.clients, client.Id)
+
+	if len(c.disconnects) >= RECENT_DISCONNECTS_SIZE {
+		c.disconnects = append(c.disconnects[:0], c.disconnects[1:]...)
+	}
+	c.disconnects = append(c.disconnects, DisconnectRecord{
+		ClientId:  client.Id,
+		Reason:    reason,
+		Detail:    detail,
+		Timestamp: time.Now().UTC(),
+	})
+	return true
+}
+
+// RecentDisconnects returns the most recent clients that were removed, newest first.
+func (c *ClientHub) RecentDisconnects() []DisconnectRecord {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	records := make([]DisconnectRecord, 0, len(c.disconnects))
+	for i := len(c.disconnects) - 1; i >= 0; i-- {
+		records = append(records, c.disconnects[i])
+	}
+	return records
 }
 
 func (c *ClientHub) GetClient(id string) *Client {
@@ -34,3 +124,22 @@ func (c *ClientHub) GetClient(id string) *Client {
 	defer c.mu.RUnlock()
 	return c.clients[id]
 }
+
+// Clients returns every connected client.
+func (c *ClientHub) Clients() []*Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(c.clients))
+	for _, client := range c.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// ClientCount returns the number of connected clients.
+func (c *ClientHub) ClientCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.clients)
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveClient_RecordsReason(t *testing.T) {
+	hub := NewClientHub()
+	client := NewClient(nil, "leaving")
+	hub.AddClient(client)
+
+	require.True(t, hub.RemoveClient(client, DisconnectClosed, "close code 1000"))
+	assert.Nil(t, hub.GetClient("leaving"))
+
+	// removing again, such as when the read loop ends after the cleanup crew removed it, isn't recorded twice
+	assert.False(t, hub.RemoveClient(client, DisconnectReadError, "use of closed network connection"))
+
+	disconnects := hub.RecentDisconnects()
+	require.Len(t, disconnects, 1)
+	assert.Equal(t, "leaving", disconnects[0].ClientId)
+	assert.Equal(t, DisconnectClosed, disconnects[0].Reason)
+	assert.Equal(t, "close code 1000", disconnects[0].Detail)
+	assert.False(t, disconnects[0].Timestamp.IsZero())
+}
+
+func TestRemoveClient_OnlyRemovesSameClient(t *testing.T) {
+	hub := NewClientHub()
+	hub.AddClient(NewClient(nil, "shared-id"))
+
+	assert.False(t, hub.RemoveClient(NewClient(nil, "shared-id"), DisconnectClosed, ""))
+	assert.NotNil(t, hub.GetClient("shared-id"))
+	assert.Empty(t, hub.RecentDisconnects())
+}
+
+func TestRecentDisconnects_NewestFirstAndBounded(t *testing.T) {
+	hub := NewClientHub()
+	for i := 0; i < RECENT_DISCONNECTS_SIZE+5; i++ {
+		client := NewClient(nil, fmt.Sprintf("client-%d", i))
+		hub.AddClient(client)
+		hub.RemoveClient(client, DisconnectFailureThreshold, "")
+	}
+
+	disconnects := hub.RecentDisconnects()
+	require.Len(t, disconnects, RECENT_DISCONNECTS_SIZE)
+	assert.Equal(t, fmt.Sprintf("client-%d", RECENT_DISCONNECTS_SIZE+4), disconnects[0].ClientId)
+	assert.Equal(t, "client-5", disconnects[RECENT_DISCONNECTS_SIZE-1].ClientId)
+}
+
+func TestDisconnectReason_CloseCode(t *testing.T) {
+	codes := map[DisconnectReason]int{
+		DisconnectFailureThreshold:  CLOSE_FAILURE_THRESHOLD,
+		DisconnectSendQueueOverflow: CLOSE_SEND_QUEUE_OVERFLOW,
+		DisconnectTakenOver:         CLOSE_TAKEN_OVER,
+		DisconnectReadError:         websocket.CloseProtocolError,
+		DisconnectShutdown:          websocket.CloseGoingAway,
+		DisconnectClosed:            websocket.CloseNormalClosure,
+	}
+	seen := make(map[int]DisconnectReason)
+	for reason, want := range codes {
+		assert.Equal(t, want, reason.CloseCode(), reason)
+		assert.NotContains(t, seen, want, "%s has the same close code as %s", reason, seen[want])
+		seen[want] = reason
+	}
+}
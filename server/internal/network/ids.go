@@ -0,0 +1,53 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// IdGenerator makes the ids the server hands out, so they can follow a format other than bare
+// uuids. It must be safe to call from many goroutines at once.
+type IdGenerator interface {
+	// ClientId will return an id for a client that connected without one.
+	ClientId() string
+
+	// MessageId will return an id for a message the server sends on its own, such as a tick or a
+	// presence event, rather than in response to a client.
+	MessageId() string
+}
+
+// UUIDGenerator makes random uuids for every id. It's the default.
+type UUIDGenerator struct{}
+
+func (UUIDGenerator) ClientId() string  { return uuid.NewString() }
+func (UUIDGenerator) MessageId() string { return uuid.NewString() }
+
+// SortableIdGenerator makes version 7 uuids for every id, which start with the time they were made
+// so they sort in the order they were made.
+type SortableIdGenerator struct{}
+
+func (SortableIdGenerator) ClientId() string  { return newSortableId() }
+func (SortableIdGenerator) MessageId() string { return newSortableId() }
+
+// newSortableId will return a version 7 uuid, or a random one if the clock can't be read.
+func newSortableId() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return uuid.NewString()
+	}
+	return id.String()
+}
+
+// NewIdGenerator will return the generator for the id format, either "uuid" or "sortable". A blank
+// format is "uuid". Returns error if the format is unknown.
+func NewIdGenerator(format string) (IdGenerator, error) {
+	switch format {
+	case "", "uuid":
+		return UUIDGenerator{}, nil
+	case "sortable":
+		return SortableIdGenerator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown id format: %s", format)
+	}
+}
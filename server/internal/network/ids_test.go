@@ -0,0 +1,36 @@
+package network
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIdGenerator(t *testing.T) {
+	ids, err := NewIdGenerator("")
+	require.NoError(t, err)
+	assert.Equal(t, UUIDGenerator{}, ids)
+
+	ids, err = NewIdGenerator("sortable")
+	require.NoError(t, err)
+	assert.Equal(t, SortableIdGenerator{}, ids)
+
+	_, err = NewIdGenerator("ulid")
+	assert.Error(t, err)
+}
+
+func TestSortableIdGenerator_SortsInOrderMade(t *testing.T) {
+	var ids SortableIdGenerator
+	made := make([]string, 100)
+	for i := range made {
+		made[i] = ids.MessageId()
+	}
+	assert.True(t, slices.IsSorted(made), "expected ids to sort in the order they were made")
+
+	id, err := uuid.Parse(ids.ClientId())
+	require.NoError(t, err)
+	assert.Equal(t, uuid.Version(7), id.Version())
+}
@@ -0,0 +1,39 @@
+package network
+
+// PROTOCOL_V1 is the websocket subprotocol for the current shape of responses. Clients that don't
+// ask for a subprotocol get this shape too.
+const PROTOCOL_V1 = "data-loom.v1"
+
+// PROTOCOL_V0 is the websocket subprotocol for the shape responses had before their fields were
+// renamed, so clients written against it keep working while they're migrated.
+const PROTOCOL_V0 = "data-loom.v0"
+
+// Protocols are the websocket subprotocols the server supports, in order of preference.
+var Protocols = []string{PROTOCOL_V1, PROTOCOL_V0}
+
+// LegacyResponse is a response in the shape of PROTOCOL_V0. The message
+// id is "messageId" instead of "id", and "type" is the action instead of "response".
+type LegacyResponse struct {
+	MessageId string   `json:"messageId"`
+	Type      string   `json:"type"`
+	Code      int      `json:"code"`
+	Message   string   `json:"message,omitempty"`
+	ErrorCode string   `json:"errorCode,omitempty"`
+	Data      any      `json:"data,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+	Chunk     *Chunk   `json:"chunk,omitempty"`
+}
+
+// NewLegacyResponse will convert a response into the shape of PROTOCOL_V0.
+func NewLegacyResponse(response Response) LegacyResponse {
+	return LegacyResponse{
+		MessageId: response.MessageId,
+		Type:      response.Action,
+		Code:      response.Code,
+		Message:   response.Message,
+		ErrorCode: response.ErrorCode,
+		Data:      response.Data,
+		Warnings:  response.Warnings,
+		Chunk:     response.Chunk,
+	}
+}
@@ -0,0 +1,18 @@
+package network
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLegacyResponse(t *testing.T) {
+	response := NewResponse(WebSocketMessage{MessageId: "get-1", Action: "get"}, 200, "", map[string]any{"a": 1})
+	response.Warnings = []string{"stale"}
+
+	raw, err := json.Marshal(NewLegacyResponse(response))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"messageId":"get-1","type":"get","code":200,"data":{"a":1},"warnings":["stale"]}`, string(raw))
+}
@@ -0,0 +1,46 @@
+package network
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// COMPRESSION_NONE is a connection whose frames aren't compressed.
+	COMPRESSION_NONE = "none"
+	// COMPRESSION_DEFLATE is a connection whose frames are compressed with permessage-deflate.
+	COMPRESSION_DEFLATE = "permessage-deflate"
+)
+
+// NegotiatedCompression will return the compression a websocket upgrade request ends up with, which
+// is permessage-deflate if the server has it enabled and the client offers it.
+func NegotiatedCompression(r *http.Request, enabled bool) string {
+	if !enabled {
+		return COMPRESSION_NONE
+	}
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == COMPRESSION_DEFLATE {
+				return COMPRESSION_DEFLATE
+			}
+		}
+	}
+	return COMPRESSION_NONE
+}
+
+// NegotiatedProtocol will return the subprotocol a websocket upgrade request ends up with, which is
+// the first of Protocols the client asks for, or PROTOCOL_V1 if it doesn't ask for any of them.
+func NegotiatedProtocol(r *http.Request) string {
+	requested := websocket.Subprotocols(r)
+	for _, protocol := range Protocols {
+		for _, asked := range requested {
+			if asked == protocol {
+				return protocol
+			}
+		}
+	}
+	return PROTOCOL_V1
+}
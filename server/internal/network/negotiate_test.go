@@ -0,0 +1,53 @@
+package network
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiatedCompression(t *testing.T) {
+	tests := map[string]struct {
+		extensions string
+		enabled    bool
+		want       string
+	}{
+		"offered and enabled":   {extensions: "permessage-deflate; client_max_window_bits", enabled: true, want: COMPRESSION_DEFLATE},
+		"offered after another": {extensions: "x-webkit-deflate-frame, permessage-deflate", enabled: true, want: COMPRESSION_DEFLATE},
+		"offered but disabled":  {extensions: "permessage-deflate", enabled: false, want: COMPRESSION_NONE},
+		"not offered":           {extensions: "", enabled: true, want: COMPRESSION_NONE},
+		"other extension":       {extensions: "x-webkit-deflate-frame", enabled: true, want: COMPRESSION_NONE},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := &http.Request{Header: http.Header{}}
+			if tt.extensions != "" {
+				r.Header.Set("Sec-WebSocket-Extensions", tt.extensions)
+			}
+			assert.Equal(t, tt.want, NegotiatedCompression(r, tt.enabled))
+		})
+	}
+}
+
+func TestNegotiatedProtocol(t *testing.T) {
+	tests := map[string]struct {
+		protocols string
+		want      string
+	}{
+		"none asked":         {protocols: "", want: PROTOCOL_V1},
+		"v0":                 {protocols: PROTOCOL_V0, want: PROTOCOL_V0},
+		"server preference":  {protocols: PROTOCOL_V0 + ", " + PROTOCOL_V1, want: PROTOCOL_V1},
+		"unknown then known": {protocols: "mqtt, " + PROTOCOL_V0, want: PROTOCOL_V0},
+		"only unknown":       {protocols: "mqtt", want: PROTOCOL_V1},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := &http.Request{Header: http.Header{}}
+			if tt.protocols != "" {
+				r.Header.Set("Sec-WebSocket-Protocol", tt.protocols)
+			}
+			assert.Equal(t, tt.want, NegotiatedProtocol(r))
+		})
+	}
+}
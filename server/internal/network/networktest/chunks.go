@@ -0,0 +1,45 @@
+package networktest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// ErrInvalidChunks is returned when chunked responses can't be put back together.
+var ErrInvalidChunks = errors.New("invalid chunks")
+
+// ReassembleChunks will join the data of chunked responses, which can be in any order, back into
+// the json of the full data. Returns error if a response isn't a chunk, or a chunk is missing.
+func ReassembleChunks(responses []network.Response) (json.RawMessage, error) {
+	pieces := make([]string, len(responses))
+	final := -1
+	for _, response := range responses {
+		if response.Chunk == nil {
+			return nil, fmt.Errorf("%w: response %s is not a chunk", ErrInvalidChunks, response.MessageId)
+		}
+		index := response.Chunk.Index
+		if index < 0 || index >= len(pieces) || pieces[index] != "" {
+			return nil, fmt.Errorf("%w: unexpected chunk index %d", ErrInvalidChunks, index)
+		}
+		piece, ok := response.Data.(string)
+		if !ok || piece == "" {
+			return nil, fmt.Errorf("%w: chunk %d has no data", ErrInvalidChunks, index)
+		}
+		pieces[index] = piece
+		if response.Chunk.Final {
+			final = index
+		}
+	}
+	if final != len(pieces)-1 {
+		return nil, fmt.Errorf("%w: missing the final chunk", ErrInvalidChunks)
+	}
+
+	var joined []byte
+	for _, piece := range pieces {
+		joined = append(joined, piece...)
+	}
+	return json.RawMessage(joined), nil
+}
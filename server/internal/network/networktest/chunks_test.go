@@ -0,0 +1,63 @@
+package networktest
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitChunks_RoundTrip(t *testing.T) {
+	value := map[string]any{"name": "large", "text": strings.Repeat("日本語 and ascii ", 500)}
+	msg := network.WebSocketMessage{MessageId: "get-1", Action: "get", Topic: "docs"}
+
+	chunks, err := network.SplitChunks(msg, value, 100)
+	require.NoError(t, err)
+	require.Greater(t, len(chunks), 1)
+
+	for i, chunk := range chunks {
+		require.NotNil(t, chunk.Chunk)
+		assert.Equal(t, i, chunk.Chunk.Index)
+		assert.Equal(t, i == len(chunks)-1, chunk.Chunk.Final)
+		assert.Equal(t, "get-1", chunk.MessageId)
+		assert.Equal(t, "response", chunk.Type)
+
+		piece := chunk.Data.(string)
+		assert.LessOrEqual(t, len(piece), 100)
+		assert.True(t, utf8.ValidString(piece), "chunk %d split a character", i)
+	}
+
+	// chunks survive being sent as json and can come back in any order
+	var received []network.Response
+	for i := len(chunks) - 1; i >= 0; i-- {
+		encoded, err := json.Marshal(chunks[i])
+		require.NoError(t, err)
+		var response network.Response
+		require.NoError(t, json.Unmarshal(encoded, &response))
+		received = append(received, response)
+	}
+
+	joined, err := ReassembleChunks(received)
+	require.NoError(t, err)
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(joined, &got))
+	assert.Equal(t, value, got)
+}
+
+func TestReassembleChunks_MissingChunk(t *testing.T) {
+	chunks, err := network.SplitChunks(network.WebSocketMessage{MessageId: "1"}, strings.Repeat("a", 50), 10)
+	require.NoError(t, err)
+
+	_, err = ReassembleChunks(chunks[:len(chunks)-1])
+	assert.ErrorIs(t, err, ErrInvalidChunks, "missing the final chunk")
+
+	_, err = ReassembleChunks(append(chunks[:1:1], chunks[2:]...))
+	assert.ErrorIs(t, err, ErrInvalidChunks, "missing a middle chunk")
+
+	_, err = ReassembleChunks(append(chunks, network.Response{MessageId: "1"}))
+	assert.ErrorIs(t, err, ErrInvalidChunks, "response that isn't a chunk")
+}
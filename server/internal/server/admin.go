@@ -0,0 +1,251 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// requireAdmin will wrap an admin http handler so it's only served when the request has the
+// admin api key in the Authorization header. Admin endpoints are not found when no admin
+// api key is configured.
+func (s *WebSocketServer) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config == nil || s.config.AdminAPIKey == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		apiKey := strings.TrimSpace(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare([]byte(apiKey), []byte(s.config.AdminAPIKey)) != 1 {
+			log.WithFields(log.Fields{"path": r.URL.Path, "remote_addr": r.RemoteAddr}).Warn("rejected admin request with bad api key")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// adminTopicsHandler will respond with the state of every topic on the server, sorted by name.
+// Each topic is only locked long enough to take a snapshot of it.
+func (s *WebSocketServer) adminTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	topics, err := s.topicManager.ListTopics()
+	if err != nil {
+		log.Errorf("Error when listing topics for admin view: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := network.AdminTopicsResponse{Topics: make([]network.TopicStatsResponse, 0, len(topics))}
+	for _, t := range topics {
+		stats := t.Stats()
+		response.Topics = append(response.Topics, network.TopicStatsResponse{
+			Name:            stats.Name,
+			SchemaVersion:   stats.SchemaVersion,
+			ValidationMode:  string(stats.ValidationMode),
+			SubscriberCount: stats.SubscriberCount,
+			HasValue:        stats.HasValue,
+			LastUpdated:     stats.LastUpdated,
+			LastPublished:   stats.LastPublished,
+		})
+	}
+	sort.Slice(response.Topics, func(i, j int) bool {
+		return response.Topics[i].Name < response.Topics[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error when writing admin topics response: %v", err)
+	}
+}
+
+// adminStatsHandler will respond with how many clients, topics, and subscriptions are on the server.
+func (s *WebSocketServer) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.serverStats()); err != nil {
+		log.Errorf("Error when writing admin stats response: %v", err)
+	}
+}
+
+// adminStorageHandler will respond with the same approximate size on disk and number of keys
+// as the storageStats action.
+func (s *WebSocketServer) adminStorageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := s.storageStats(r.Context())
+	if err != nil {
+		log.Errorf("Error when getting storage stats for admin view: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Errorf("Error when writing admin storage response: %v", err)
+	}
+}
+
+// adminLocksHandler will respond with the same lock stats as the lockStats action, for every topic.
+func (s *WebSocketServer) adminLocksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.lockStats("")); err != nil {
+		log.Errorf("Error when writing admin locks response: %v", err)
+	}
+}
+
+// adminDisconnectsHandler will respond with the clients that were recently disconnected and why, newest first.
+func (s *WebSocketServer) adminDisconnectsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	records := s.hub.RecentDisconnects()
+	response := network.AdminDisconnectsResponse{Disconnects: make([]network.DisconnectResponse, 0, len(records))}
+	for _, record := range records {
+		response.Disconnects = append(response.Disconnects, network.DisconnectResponse{
+			ClientId:  record.ClientId,
+			Reason:    string(record.Reason),
+			Detail:    record.Detail,
+			Timestamp: record.Timestamp,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error when writing admin disconnects response: %v", err)
+	}
+}
+
+// adminClientSubscriptionsHandler will respond with the topics the connected client with the id
+// in the clientId query parameter is subscribed to, sorted by name.
+func (s *WebSocketServer) adminClientSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientId := r.URL.Query().Get("clientId")
+	if clientId == "" {
+		http.Error(w, "clientId query parameter is required", http.StatusBadRequest)
+		return
+	}
+	client := s.hub.GetClient(clientId)
+	if client == nil {
+		http.Error(w, "client not connected: "+clientId, http.StatusNotFound)
+		return
+	}
+
+	subscriptions := s.topicManager.Subscriptions(client)
+	response := network.AdminClientSubscriptionsResponse{ClientId: clientId, Subscriptions: make([]network.ClientSubscriptionResponse, 0, len(subscriptions))}
+	for topicName, opts := range subscriptions {
+		response.Subscriptions = append(response.Subscriptions, network.ClientSubscriptionResponse{
+			Topic:     topicName,
+			Conflate:  opts.Conflate,
+			NoEcho:    opts.NoEcho,
+			AckWindow: opts.AckWindow,
+		})
+	}
+	sort.Slice(response.Subscriptions, func(i, j int) bool {
+		return response.Subscriptions[i].Topic < response.Subscriptions[j].Topic
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error when writing admin client subscriptions response: %v", err)
+	}
+}
+
+// adminClientsHandler will respond with every connected client and the compression and codec its
+// connection negotiated, sorted by id. With a clientId query parameter, it responds with just that
+// client.
+func (s *WebSocketServer) adminClientsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var response any
+	if clientId := r.URL.Query().Get("clientId"); clientId != "" {
+		client := s.hub.GetClient(clientId)
+		if client == nil {
+			http.Error(w, "client not connected: "+clientId, http.StatusNotFound)
+			return
+		}
+		response = adminClient(client)
+	} else {
+		clients := s.hub.Clients()
+		views := make([]network.AdminClientResponse, 0, len(clients))
+		for _, client := range clients {
+			views = append(views, adminClient(client))
+		}
+		sort.Slice(views, func(i, j int) bool { return views[i].ClientId < views[j].ClientId })
+		response = views
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error when writing admin clients response: %v", err)
+	}
+}
+
+// adminClient will return the admin view of a connected client.
+func adminClient(client *network.Client) network.AdminClientResponse {
+	return network.AdminClientResponse{ClientId: client.Id, Compression: client.Compression, Codec: client.Codec}
+}
+
+// adminReadOnlyHandler will respond with whether the server is in read only mode, and turn it on or
+// off for a PUT with a body like {"readOnly": true}.
+func (s *WebSocketServer) adminReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var request network.ReadOnlyResponse
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "body must be like {\"readOnly\": true}", http.StatusBadRequest)
+			return
+		}
+		s.SetReadOnly(request.ReadOnly)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(network.ReadOnlyResponse{ReadOnly: s.ReadOnly()}); err != nil {
+		log.Errorf("Error when writing admin read only response: %v", err)
+	}
+}
@@ -0,0 +1,511 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
+)
+
+// newAdminTestServer will create a server backed by a real topic manager with two topics,
+// one of which has a subscriber and has been published to.
+func newAdminTestServer(t *testing.T, adminAPIKey string) *WebSocketServer {
+	cfg := &config.Config{AdminAPIKey: adminAPIKey}
+	tm := topic.NewTopicManager(storage.NewNullStorage(), cfg)
+	s := NewWebSocketServer(network.NewClientHub(), tm, cfg)
+	t.Cleanup(func() { s.Close() })
+
+	if _, err := tm.RegisterTopic("sensors", map[string]any{"temp": 0.0}, topic.TopicOptions{}); err != nil {
+		t.Fatalf("unexpected error registering topic: %v", err)
+	}
+	if _, err := tm.RegisterTopic("alerts", map[string]any{"level": ""}, topic.TopicOptions{ValidationMode: topic.ValidationWarn}); err != nil {
+		t.Fatalf("unexpected error registering topic: %v", err)
+	}
+	// the subscriber doesn't get its own publishes, so it never has to be written to.
+	client := network.NewClient(nil, "subscriber")
+	if err := tm.Subscribe("sensors", client, topic.SubscriptionOptions{NoEcho: true}); err != nil {
+		t.Fatalf("unexpected error subscribing: %v", err)
+	}
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "sensors"}
+	if err := tm.Publish(context.Background(), msg, client, map[string]any{"temp": 21.5}, nil); err != nil {
+		t.Fatalf("unexpected error publishing: %v", err)
+	}
+	return s
+}
+
+func adminRequest(s *WebSocketServer, method string, apiKey string) *httptest.ResponseRecorder {
+	return adminRequestTo(s, method, "/admin/topics", apiKey)
+}
+
+func adminRequestTo(s *WebSocketServer, method string, path string, apiKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if apiKey != "" {
+		req.Header.Set("Authorization", apiKey)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminTopics_ListsTopics(t *testing.T) {
+	s := newAdminTestServer(t, "admin-secret")
+
+	rec := adminRequest(s, http.MethodGet, "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var response network.AdminTopicsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if len(response.Topics) != 2 {
+		t.Fatalf("expected 2 topics, got %d", len(response.Topics))
+	}
+
+	alerts, sensors := response.Topics[0], response.Topics[1]
+	if alerts.Name != "alerts" || sensors.Name != "sensors" {
+		t.Fatalf("expected topics sorted by name, got %s, %s", alerts.Name, sensors.Name)
+	}
+	if alerts.SchemaVersion != 0 || alerts.ValidationMode != "warn" || alerts.SubscriberCount != 0 {
+		t.Errorf("unexpected stats for alerts: %+v", alerts)
+	}
+	if alerts.LastPublished != nil {
+		t.Errorf("expected alerts to have never been published, got %v", alerts.LastPublished)
+	}
+	if sensors.SchemaVersion != 0 || sensors.SubscriberCount != 1 {
+		t.Errorf("unexpected stats for sensors: %+v", sensors)
+	}
+	if sensors.LastPublished == nil {
+		t.Error("expected sensors to have a last published time")
+	}
+}
+
+func TestAdminTopics_WrongKeyUnauthorized(t *testing.T) {
+	s := newAdminTestServer(t, "admin-secret")
+
+	for _, apiKey := range []string{"", "wrong"} {
+		if rec := adminRequest(s, http.MethodGet, apiKey); rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected status unauthorized for key %q, got %d", apiKey, rec.Code)
+		}
+	}
+}
+
+func TestAdminTopics_DisabledWithoutKey(t *testing.T) {
+	s := newAdminTestServer(t, "")
+
+	if rec := adminRequest(s, http.MethodGet, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status not found, got %d", rec.Code)
+	}
+}
+
+func TestAdminTopics_OnlyGet(t *testing.T) {
+	s := newAdminTestServer(t, "admin-secret")
+
+	if rec := adminRequest(s, http.MethodPost, "admin-secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status method not allowed, got %d", rec.Code)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	s := newAdminTestServer(t, "admin-secret")
+	s.hub.AddClient(network.NewClient(nil, "connected"))
+
+	rec := adminRequestTo(s, http.MethodGet, "/admin/stats", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var stats network.ServerStatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	want := network.ServerStatsResponse{Clients: 1, Topics: 2, Subscriptions: 1}
+	if stats != want {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+
+	if rec := adminRequestTo(s, http.MethodGet, "/admin/stats", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status unauthorized, got %d", rec.Code)
+	}
+}
+
+func TestAdminDisconnects(t *testing.T) {
+	s := newAdminTestServer(t, "admin-secret")
+	first, second := network.NewClient(nil, "first"), network.NewClient(nil, "second")
+	s.hub.AddClient(first)
+	s.hub.AddClient(second)
+	s.removeClient(first, network.DisconnectClosed, "close code 1000")
+	s.removeClient(second, network.DisconnectFailureThreshold, "4 failed messages")
+
+	rec := adminRequestTo(s, http.MethodGet, "/admin/disconnects", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var response network.AdminDisconnectsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if len(response.Disconnects) != 2 {
+		t.Fatalf("expected 2 disconnects, got %d", len(response.Disconnects))
+	}
+	newest, oldest := response.Disconnects[0], response.Disconnects[1]
+	if newest.ClientId != "second" || newest.Reason != "failureThreshold" || newest.Detail != "4 failed messages" {
+		t.Errorf("unexpected newest disconnect: %+v", newest)
+	}
+	if oldest.ClientId != "first" || oldest.Reason != "closed" || oldest.Timestamp.IsZero() {
+		t.Errorf("unexpected oldest disconnect: %+v", oldest)
+	}
+
+	if rec := adminRequestTo(s, http.MethodGet, "/admin/disconnects", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status unauthorized, got %d", rec.Code)
+	}
+}
+
+func TestAdminClientSubscriptions(t *testing.T) {
+	s := newAdminTestServer(t, "admin-secret")
+	client := network.NewClient(nil, "support-case")
+	s.hub.AddClient(client)
+	if err := s.topicManager.Subscribe("sensors", client, topic.SubscriptionOptions{Conflate: true}); err != nil {
+		t.Fatalf("unexpected error subscribing: %v", err)
+	}
+	if err := s.topicManager.Subscribe("alerts", client, topic.SubscriptionOptions{}); err != nil {
+		t.Fatalf("unexpected error subscribing: %v", err)
+	}
+
+	rec := adminRequestTo(s, http.MethodGet, "/admin/subscriptions?clientId=support-case", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var response network.AdminClientSubscriptionsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	want := []network.ClientSubscriptionResponse{{Topic: "alerts"}, {Topic: "sensors", Conflate: true}}
+	if response.ClientId != "support-case" || !slices.Equal(response.Subscriptions, want) {
+		t.Errorf("expected %+v for support-case, got %+v", want, response)
+	}
+
+	// topics it unsubscribes from are taken off
+	if err := s.topicManager.Unsubscribe("alerts", client); err != nil {
+		t.Fatalf("unexpected error unsubscribing: %v", err)
+	}
+	rec = adminRequestTo(s, http.MethodGet, "/admin/subscriptions?clientId=support-case", "admin-secret")
+	response = network.AdminClientSubscriptionsResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if len(response.Subscriptions) != 1 || response.Subscriptions[0].Topic != "sensors" {
+		t.Errorf("expected only sensors after unsubscribing, got %+v", response.Subscriptions)
+	}
+}
+
+func TestAdminClientSubscriptions_Errors(t *testing.T) {
+	s := newAdminTestServer(t, "admin-secret")
+	s.hub.AddClient(network.NewClient(nil, "idle"))
+
+	tests := map[string]struct {
+		path   string
+		apiKey string
+		want   int
+	}{
+		"no subscriptions":  {path: "/admin/subscriptions?clientId=idle", apiKey: "admin-secret", want: http.StatusOK},
+		"missing client id": {path: "/admin/subscriptions", apiKey: "admin-secret", want: http.StatusBadRequest},
+		"unknown client":    {path: "/admin/subscriptions?clientId=nobody", apiKey: "admin-secret", want: http.StatusNotFound},
+		"wrong key":         {path: "/admin/subscriptions?clientId=idle", apiKey: "client-secret", want: http.StatusUnauthorized},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := adminRequestTo(s, http.MethodGet, tt.path, tt.apiKey)
+			if rec.Code != tt.want {
+				t.Errorf("expected status %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	rec := adminRequestTo(s, http.MethodGet, "/admin/subscriptions?clientId=idle", "admin-secret")
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"clientId":"idle","subscriptions":[]}` {
+		t.Errorf("expected an empty list of subscriptions, got %s", body)
+	}
+}
+
+func TestAdminClients_ReportsNegotiated(t *testing.T) {
+	cfg := &config.Config{AdminAPIKey: "admin-secret", Compression: true}
+	s := NewWebSocketServer(network.NewClientHub(), topic.NewTopicManager(storage.NewNullStorage(), cfg), cfg)
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	dialer := websocket.Dialer{EnableCompression: true, Subprotocols: []string{network.PROTOCOL_V0}}
+	compressed, resp, err := dialer.Dial(url, http.Header{"ClientId": []string{"compressed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.Close()
+	if got := resp.Header.Get(COMPRESSION_HEADER); got != network.COMPRESSION_DEFLATE {
+		t.Errorf("expected the handshake to report %s compression, got %q", network.COMPRESSION_DEFLATE, got)
+	}
+	if got := resp.Header.Get(CODEC_HEADER); got != network.PROTOCOL_V0 {
+		t.Errorf("expected the handshake to report the %s codec, got %q", network.PROTOCOL_V0, got)
+	}
+
+	plain, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"ClientId": []string{"plain"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if resp.Header.Get(COMPRESSION_HEADER) != network.COMPRESSION_NONE || resp.Header.Get(CODEC_HEADER) != network.PROTOCOL_V1 {
+		t.Errorf("expected the handshake to report no compression and %s, got %v", network.PROTOCOL_V1, resp.Header)
+	}
+	waitForClient(t, s, "compressed")
+	waitForClient(t, s, "plain")
+
+	rec := adminRequestTo(s, http.MethodGet, "/admin/clients", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var clients []network.AdminClientResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &clients); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	want := []network.AdminClientResponse{
+		{ClientId: "compressed", Compression: network.COMPRESSION_DEFLATE, Codec: network.PROTOCOL_V0},
+		{ClientId: "plain", Compression: network.COMPRESSION_NONE, Codec: network.PROTOCOL_V1},
+	}
+	if !slices.Equal(clients, want) {
+		t.Errorf("expected %+v, got %+v", want, clients)
+	}
+
+	rec = adminRequestTo(s, http.MethodGet, "/admin/clients?clientId=compressed", "admin-secret")
+	var client network.AdminClientResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &client); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if client != want[0] {
+		t.Errorf("expected %+v, got %+v", want[0], client)
+	}
+
+	if rec := adminRequestTo(s, http.MethodGet, "/admin/clients?clientId=nobody", "admin-secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for a client that isn't connected, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+func TestCapabilities_HTTPRequiresAPIKey(t *testing.T) {
+	cfg := &config.Config{APIKey: "client-secret"}
+	s := NewWebSocketServer(network.NewClientHub(), topic.NewTopicManager(storage.NewNullStorage(), cfg), cfg)
+	t.Cleanup(func() { s.Close() })
+
+	if rec := adminRequestTo(s, http.MethodGet, "/capabilities", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status unauthorized with the wrong key, got %d", rec.Code)
+	}
+	if rec := adminRequestTo(s, http.MethodPost, "/capabilities", "client-secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status method not allowed, got %d", rec.Code)
+	}
+
+	rec := adminRequestTo(s, http.MethodGet, "/capabilities", "client-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var response network.CapabilitiesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if !slices.Contains(response.Actions, "capabilities") || !slices.Contains(response.Actions, "publish") {
+		t.Errorf("expected the registered actions, got %v", response.Actions)
+	}
+	if response.Features.History || response.Features.AuthMode != "apiKey" {
+		t.Errorf("expected no history and api key auth, got %+v", response.Features)
+	}
+}
+
+func TestAdminLocks_AndMetricsIncludeLockStats(t *testing.T) {
+	s := newAdminTestServer(t, "admin-secret")
+
+	rec := adminRequestTo(s, http.MethodGet, "/admin/locks", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var response network.LocksResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	components := make(map[string]bool)
+	for _, lock := range response.Locks {
+		components[lock.Component] = true
+	}
+	if !components["TopicManager"] || !components["Topic: sensors"] {
+		t.Errorf("expected the topic manager's and topics' locks, got %+v", response.Locks)
+	}
+
+	rec = adminRequestTo(s, http.MethodGet, "/metrics", "")
+	var metrics network.MetricsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &metrics); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if len(metrics.Locks) < len(response.Locks) {
+		t.Errorf("expected the lock stats in the metrics, got %+v", metrics.Locks)
+	}
+}
+
+// readiness will request /readyz and decode the response.
+func readiness(t *testing.T, s *WebSocketServer) (int, network.ReadinessResponse) {
+	t.Helper()
+	rec := adminRequestTo(s, http.MethodGet, "/readyz", "")
+	var response network.ReadinessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	return rec.Code, response
+}
+
+func TestReadyz_DegradedWhileWriterStalled(t *testing.T) {
+	cfg := &config.Config{APIKey: "client-secret", StorageDegradedQueueDepth: 100, StorageDegradedLatency: time.Second}
+	db := storagetest.NewRecordingStorage()
+	s := NewWebSocketServer(network.NewClientHub(), topic.NewTopicManager(db, cfg), cfg)
+	t.Cleanup(func() { s.Close() })
+
+	// readiness doesn't need the api key
+	if code, response := readiness(t, s); code != http.StatusOK || response.Status != "ready" {
+		t.Fatalf("expected ready, got %d %+v", code, response)
+	}
+
+	// the writer is stuck on a write, so its latency keeps growing
+	db.SetQueueStats(storage.QueueStats{Depth: 3, Capacity: 5000, WriteLatency: 5 * time.Second})
+	code, response := readiness(t, s)
+	if code != http.StatusServiceUnavailable || response.Status != "degraded" || len(response.Reasons) != 1 {
+		t.Fatalf("expected degraded for the latency, got %d %+v", code, response)
+	}
+
+	// and writes back up behind it
+	db.SetQueueStats(storage.QueueStats{Depth: 150, Capacity: 5000, WriteLatency: 5 * time.Second})
+	if _, response := readiness(t, s); len(response.Reasons) != 2 {
+		t.Errorf("expected degraded for the depth and latency, got %+v", response)
+	}
+
+	rec := adminRequestTo(s, http.MethodGet, "/metrics", "client-secret")
+	var metrics network.MetricsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &metrics); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	want := network.StorageQueueResponse{Depth: 150, Capacity: 5000, WriteLatencyMs: 5000, Degraded: true}
+	if metrics.StorageQueue != want {
+		t.Errorf("expected %+v in the metrics, got %+v", want, metrics.StorageQueue)
+	}
+
+	// once the writer catches up it's ready again
+	db.SetQueueStats(storage.QueueStats{Capacity: 5000, WriteLatency: time.Millisecond})
+	if code, response := readiness(t, s); code != http.StatusOK || response.Status != "ready" {
+		t.Errorf("expected ready again, got %d %+v", code, response)
+	}
+}
+
+func TestReadyz_ZeroThresholdsNeverDegrade(t *testing.T) {
+	cfg := &config.Config{}
+	db := storagetest.NewRecordingStorage()
+	s := NewWebSocketServer(network.NewClientHub(), topic.NewTopicManager(db, cfg), cfg)
+	t.Cleanup(func() { s.Close() })
+
+	db.SetQueueStats(storage.QueueStats{Depth: 4999, Capacity: 5000, WriteLatency: time.Minute})
+	if code, response := readiness(t, s); code != http.StatusOK || response.Status != "ready" {
+		t.Errorf("expected ready with no thresholds, got %d %+v", code, response)
+	}
+}
+
+func TestMetrics_HTTPIncludesStorageStats(t *testing.T) {
+	cfg := &config.Config{APIKey: "client-secret", AdminAPIKey: "admin-secret"}
+	db := storage.NewSqliteStorage(storage.SqliteOptions{})
+	if err := db.Open(filepath.Join(t.TempDir(), "metrics.db"), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := <-db.AsyncPut(context.Background(), "sensors", map[string]any{"temp": 21.5}, time.Now().UTC(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewWebSocketServer(network.NewClientHub(), topic.NewTopicManager(db, cfg), cfg)
+	t.Cleanup(func() { s.Close() })
+	s.Metrics().RecordAction("publish", time.Millisecond)
+
+	if rec := adminRequestTo(s, http.MethodGet, "/metrics", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status unauthorized with the wrong key, got %d", rec.Code)
+	}
+
+	rec := adminRequestTo(s, http.MethodGet, "/metrics", "client-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var response network.MetricsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if response.TotalMessages != 1 {
+		t.Errorf("expected 1 message in the action metrics, got %d", response.TotalMessages)
+	}
+	if response.Storage == nil || response.Storage.Keys != 1 || response.Storage.SizeBytes <= 0 {
+		t.Errorf("expected storage stats with 1 key and a size, got %+v", response.Storage)
+	}
+
+	// the admin endpoint has the same storage stats
+	rec = adminRequestTo(s, http.MethodGet, "/admin/storage", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stats network.StorageStatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("unexpected error decoding response: %v", err)
+	}
+	if stats != *response.Storage {
+		t.Errorf("expected %+v, got %+v", *response.Storage, stats)
+	}
+}
+
+func TestAdminReadOnly_GetAndToggle(t *testing.T) {
+	s := newAdminTestServer(t, "admin-secret")
+
+	readOnlyRequest := func(method string, body string) (*httptest.ResponseRecorder, network.ReadOnlyResponse) {
+		req := httptest.NewRequest(method, "/admin/readonly", strings.NewReader(body))
+		req.Header.Set("Authorization", "admin-secret")
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		var response network.ReadOnlyResponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("expected a read only response, got %q: %v", rec.Body.String(), err)
+			}
+		}
+		return rec, response
+	}
+
+	if rec, response := readOnlyRequest(http.MethodGet, ""); rec.Code != http.StatusOK || response.ReadOnly {
+		t.Errorf("expected read only to start off, got %d %+v", rec.Code, response)
+	}
+	if rec, response := readOnlyRequest(http.MethodPut, `{"readOnly": true}`); rec.Code != http.StatusOK || !response.ReadOnly || !s.ReadOnly() {
+		t.Errorf("expected read only to be turned on, got %d %+v", rec.Code, response)
+	}
+	if rec, _ := readOnlyRequest(http.MethodPut, `not json`); rec.Code != http.StatusBadRequest || !s.ReadOnly() {
+		t.Errorf("expected a bad body to be rejected without changing the mode, got %d", rec.Code)
+	}
+	if rec, response := readOnlyRequest(http.MethodPut, `{"readOnly": false}`); rec.Code != http.StatusOK || response.ReadOnly || s.ReadOnly() {
+		t.Errorf("expected read only to be turned off, got %d %+v", rec.Code, response)
+	}
+	if rec, _ := readOnlyRequest(http.MethodPost, `{"readOnly": true}`); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected method not allowed, got %d", rec.Code)
+	}
+	if rec := adminRequestTo(s, http.MethodGet, "/admin/readonly", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got %d", rec.Code)
+	}
+}
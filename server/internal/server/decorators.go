@@ -2,14 +2,45 @@ package server
 
 import (
 	"fmt"
+	"runtime/debug"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/atyalexyoung/data-loom/server/internal/logging"
 	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
 )
 
+// tracer records a span for each handled message with the global tracer provider.
+var tracer = otel.Tracer("github.com/atyalexyoung/data-loom/server/internal/server")
+
+// recoverDecorator will recover from a panic in a handler so it doesn't take down the client's
+// read loop. The panic is logged with the stack and the client gets a 500 back.
+func (s *WebSocketServer) recoverDecorator(next HandlerFunc) HandlerFunc {
+	log.Trace("Returning recover decorator.")
+	return func(c *network.Client, msg network.WebSocketMessage) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.WithFields(msg.GetLogFields()).
+					WithField("client", c.Id).
+					WithField("panic", r).
+					WithField("stack", string(debug.Stack())).
+					Error("Recovered from panic in handler")
+
+				s.AckResponseError(c, msg, fmt.Errorf("internal server error"))
+			}
+		}()
+
+		next(c, msg)
+	}
+}
+
 // injectSenderIdDecorator will insert the client ID that the server has for a client into the message.
 func (s *WebSocketServer) injectSenderIdDecorator(next HandlerFunc) HandlerFunc {
 	return func(c *network.Client, msg network.WebSocketMessage) {
@@ -40,6 +71,11 @@ func (s *WebSocketServer) requireTopicDecorator(next HandlerFunc) HandlerFunc {
 func (s *WebSocketServer) requireDataDecorator(next HandlerFunc) HandlerFunc {
 	log.Trace("Returning require message data decorator.")
 	return func(c *network.Client, msg network.WebSocketMessage) {
+		if msg.Binary != nil { // sent as a binary frame, the raw payload is the data
+			msg.ParsedData = msg.Binary
+			next(c, msg)
+			return
+		}
 		if msg.Data == nil { // check if null
 			s.AckResponseBadRequest(c, msg, fmt.Errorf("message data was null"))
 			return
@@ -48,11 +84,23 @@ func (s *WebSocketServer) requireDataDecorator(next HandlerFunc) HandlerFunc {
 			s.AckResponseBadRequest(c, msg, fmt.Errorf("message data was empty"))
 			return
 		}
-		payload, err := parseJSON[map[string]any](msg.Data)
+		payload, err := parseJSON[any](msg.Data)
 		if err != nil {
 			s.AckResponseBadRequest(c, msg, err)
 			return
 		}
+		switch payload.(type) { // top level has to be an object or array
+		case map[string]any, []any:
+		default:
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("message data must be a json object or array"))
+			return
+		}
+		if s.config != nil && s.config.MaxNestingDepth > 0 {
+			if depth := topic.NestingDepth(payload); depth > s.config.MaxNestingDepth {
+				s.AckResponseBadRequest(c, msg, fmt.Errorf("message data is nested %d levels deep, the max is %d", depth, s.config.MaxNestingDepth))
+				return
+			}
+		}
 		msg.ParsedData = payload
 
 		log.WithFields(msg.GetLogFields()).
@@ -72,9 +120,40 @@ func (s *WebSocketServer) metricsDecorator(next HandlerFunc) HandlerFunc {
 			WithField("time", start).
 			Debug("Started Metrics Decorator")
 
+		if msg.Result == nil {
+			msg.Result = &network.RequestResult{}
+		}
+
+		// the span is the parent of the topic manager and storage spans for the request, which is a
+		// no-op unless traces are exported
+		ctx, span := tracer.Start(msg.Context(), msg.Action, trace.WithAttributes(
+			attribute.String("action", msg.Action),
+			attribute.String("topic", msg.Topic),
+			attribute.String("client", c.Id),
+		))
+		msg = msg.WithContext(ctx)
+
 		next(c, msg)
 
 		duration := time.Since(start)
+		span.SetAttributes(attribute.Int("code", msg.Result.Code()))
+		if msg.Result.Code() >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("handler responded with %d", msg.Result.Code()))
+		}
+		span.End()
+		if s.metrics != nil {
+			s.metrics.RecordAction(msg.Action, duration)
+		}
+
+		s.accessLog.Log(logging.AccessLogEntry{
+			Time:      start,
+			ClientId:  c.Id,
+			Action:    msg.Action,
+			Topic:     msg.Topic,
+			MessageId: msg.MessageId,
+			Code:      msg.Result.Code(),
+			Duration:  duration,
+		})
 
 		log.WithFields(msg.GetLogFields()).
 			WithField("client", c.Id).
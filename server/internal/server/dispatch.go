@@ -0,0 +1,78 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// routedMessage is a message read from a client that is waiting for a worker to route it.
+type routedMessage struct {
+	client *network.Client
+	msg    network.WebSocketMessage
+}
+
+// handlerPool is a fixed number of workers shared by every connection that route messages, so a
+// slow handler doesn't stop its connection's read loop from reading the next message. The queue
+// holds as many messages as there are workers, and once it's full the read loops wait for room,
+// so a flood of slow requests still pushes back on the clients sending them.
+type handlerPool struct {
+	queue chan routedMessage
+	done  chan struct{}
+	stop  sync.Once
+	wg    sync.WaitGroup
+}
+
+// newHandlerPool will start the workers that call route for each message, or return nil if there
+// are no workers so messages are routed on the read loop.
+func newHandlerPool(workers int, route func(*network.Client, network.WebSocketMessage)) *handlerPool {
+	if workers <= 0 {
+		return nil
+	}
+	p := &handlerPool{queue: make(chan routedMessage, workers), done: make(chan struct{})}
+	p.wg.Add(workers)
+	for range workers {
+		go func() {
+			defer p.wg.Done()
+			for {
+				select {
+				case routed := <-p.queue:
+					route(routed.client, routed.msg)
+				case <-p.done:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// submit will queue the message for a worker, waiting for room if the queue is full. Returns false
+// if the pool was closed, so the message wasn't queued.
+func (p *handlerPool) submit(client *network.Client, msg network.WebSocketMessage) bool {
+	select {
+	case <-p.done: // checked first, since a select with room in the queue could pick either
+		return false
+	default:
+	}
+	select {
+	case p.queue <- routedMessage{client: client, msg: msg}:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// close will stop the workers after the messages they're routing, and drop any still queued.
+func (p *handlerPool) close() {
+	p.stop.Do(func() { close(p.done) })
+	p.wg.Wait()
+}
+
+// dispatch will route a message read from a client, on a worker if the server has a handler pool,
+// or on the read loop otherwise so the client isn't read from until the handler is done.
+func (s *WebSocketServer) dispatch(client *network.Client, msg network.WebSocketMessage) {
+	if s.pool == nil || !s.pool.submit(client, msg) {
+		s.RouteMessage(client, msg)
+	}
+}
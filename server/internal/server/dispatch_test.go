@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
+)
+
+// newDispatchTestServer will start a server with a "slow" action that waits for release to be
+// closed and a "fast" action that responds right away.
+func newDispatchTestServer(t *testing.T, workers int, release <-chan struct{}) *websocket.Conn {
+	cfg := &config.Config{HandlerWorkers: workers}
+	s := NewWebSocketServer(network.NewClientHub(), topic.NewTopicManager(storage.NewNullStorage(), cfg), cfg)
+	t.Cleanup(func() { s.Close() })
+
+	err := s.RegisterHandler("slow", func(c *network.Client, msg network.WebSocketMessage) {
+		<-release
+		s.AckResponseSuccess(c, msg)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RegisterHandler("fast", func(c *network.Client, msg network.WebSocketMessage) {
+		s.AckResponseSuccess(c, msg)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendSlowThenFast will send a slow request followed by a fast one.
+func sendSlowThenFast(t *testing.T, conn *websocket.Conn) {
+	for _, action := range []string{"slow", "fast"} {
+		if err := conn.WriteJSON(network.WebSocketMessage{MessageId: action, Action: action, RequireAck: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// receiveResponses will read responses from the connection and send their ids to the channel
+// until it closes.
+func receiveResponses(conn *websocket.Conn) <-chan string {
+	ids := make(chan string, 10)
+	go func() {
+		defer close(ids)
+		for {
+			var resp network.Response
+			if err := conn.ReadJSON(&resp); err != nil {
+				return
+			}
+			ids <- resp.MessageId
+		}
+	}()
+	return ids
+}
+
+// expectResponse will wait for the next response and check its id.
+func expectResponse(t *testing.T, ids <-chan string, id string) {
+	t.Helper()
+	select {
+	case got := <-ids:
+		if got != id {
+			t.Fatalf("expected a response to %s, got %s", id, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a response to %s", id)
+	}
+}
+
+func TestDispatch_SynchronousBlocksReads(t *testing.T) {
+	release := make(chan struct{})
+	conn := newDispatchTestServer(t, 0, release)
+	ids := receiveResponses(conn)
+	sendSlowThenFast(t, conn)
+
+	// the fast request isn't read until the slow one is done
+	select {
+	case id := <-ids:
+		t.Fatalf("expected no response while the slow handler runs, got %s", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	expectResponse(t, ids, "slow")
+	expectResponse(t, ids, "fast")
+}
+
+func TestDispatch_PooledKeepsReading(t *testing.T) {
+	release := make(chan struct{})
+	conn := newDispatchTestServer(t, 2, release)
+	ids := receiveResponses(conn)
+	sendSlowThenFast(t, conn)
+
+	// the fast request is handled by another worker while the slow one runs, so it's answered first
+	expectResponse(t, ids, "fast")
+	close(release)
+	expectResponse(t, ids, "slow")
+}
+
+func TestHandlerPool_QueueIsBounded(t *testing.T) {
+	release := make(chan struct{})
+	routed := make(chan string, 3)
+	pool := newHandlerPool(1, func(c *network.Client, msg network.WebSocketMessage) {
+		<-release
+		routed <- msg.MessageId
+	})
+	client := network.NewClient(nil, "client")
+
+	// one message is being routed and one is queued, so the third waits for room
+	pool.submit(client, network.WebSocketMessage{MessageId: "1"})
+	pool.submit(client, network.WebSocketMessage{MessageId: "2"})
+	submitted := make(chan bool)
+	go func() { submitted <- pool.submit(client, network.WebSocketMessage{MessageId: "3"}) }()
+	select {
+	case <-submitted:
+		t.Fatal("expected submit to wait while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if !<-submitted {
+		t.Fatal("expected the message to be queued once there was room")
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if got := <-routed; got != id {
+			t.Errorf("expected %s to be routed, got %s", id, got)
+		}
+	}
+
+	pool.close()
+	if pool.submit(client, network.WebSocketMessage{MessageId: "4"}) {
+		t.Error("expected submit to fail after the pool was closed")
+	}
+}
+
+func TestHandlerPool_NoWorkers(t *testing.T) {
+	if newHandlerPool(0, func(*network.Client, network.WebSocketMessage) {}) != nil {
+		t.Error("expected no pool when there are no workers")
+	}
+}
+
+func TestDispatch_DisconnectCancelsRequest(t *testing.T) {
+	cfg := &config.Config{HandlerWorkers: 1}
+	s := NewWebSocketServer(network.NewClientHub(), topic.NewTopicManager(storage.NewNullStorage(), cfg), cfg)
+	t.Cleanup(func() { s.Close() })
+
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	err := s.RegisterHandler("wait", func(c *network.Client, msg network.WebSocketMessage) {
+		close(started)
+		select {
+		case <-msg.Context().Done():
+			cancelled <- msg.Context().Err()
+		case <-time.After(2 * time.Second):
+			cancelled <- nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(network.WebSocketMessage{MessageId: "wait", Action: "wait"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// the client goes away while its request is still being handled
+	conn.Close()
+	if err := <-cancelled; err == nil {
+		t.Error("expected the request's context to be cancelled when the client disconnected")
+	}
+}
+
+func TestRouteMessage_DropsRequestFromDisconnectedClient(t *testing.T) {
+	s, c := SetupStuff(&mockTopicManager{})
+	s.handlers = map[string]HandlerFunc{}
+	handled := false
+	s.registerHandler("noop", func(c *network.Client, msg network.WebSocketMessage) { handled = true })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "noop", Action: "noop"}.WithContext(ctx))
+
+	if handled || len(s.sent) != 0 {
+		t.Error("expected a request queued for a disconnected client to be dropped")
+	}
+}
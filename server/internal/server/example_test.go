@@ -0,0 +1,63 @@
+package server_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/server"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
+)
+
+func ExampleWebSocketServer_RegisterHandler() {
+	cfg := &config.Config{}
+	s := server.NewWebSocketServer(network.NewClientHub(), topic.NewTopicManager(storage.NewNullStorage(), cfg), cfg)
+	defer s.Close()
+
+	// a custom action that responds with the topic it was sent in upper case
+	err := s.RegisterHandlerWithOptions("shout", func(c *network.Client, msg network.WebSocketMessage) {
+		s.AckResponseSuccessWithData(c, msg, strings.ToUpper(msg.Topic))
+	}, server.HandlerOptions{RequireTopic: true})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	for _, msg := range []network.WebSocketMessage{
+		{MessageId: "1", Action: "shout", Topic: "hello"},
+		{MessageId: "2", Action: "shout"},
+	} {
+		var response network.Response
+		if err := conn.WriteJSON(msg); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if err := conn.ReadJSON(&response); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if response.Code == http.StatusOK {
+			fmt.Println(response.Code, response.Data)
+		} else {
+			fmt.Println(response.Code, response.Message)
+		}
+	}
+	// Output:
+	// 200 HELLO
+	// 400 no topic provided
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// HandlerOptions change how a custom handler is registered with RegisterHandlerWithOptions.
+type HandlerOptions struct {
+	// RequireTopic rejects messages without a topic before they get to the handler.
+	RequireTopic bool
+
+	// RequireData rejects messages without data before they get to the handler, and parses the
+	// data into the message's ParsedData.
+	RequireData bool
+
+	// Writes rejects messages while the server is read only, for actions that change topics or
+	// stored values.
+	Writes bool
+
+	// NoStandardDecorators leaves out the decorators every built in action has, which record
+	// metrics and the access log. Handlers always recover from panics.
+	NoStandardDecorators bool
+
+	// Decorators are run after the standard ones, in order, so the last one calls the handler.
+	Decorators []func(HandlerFunc) HandlerFunc
+}
+
+// ServerOption changes how NewWebSocketServer sets up the server.
+type ServerOption func(s *WebSocketServer)
+
+// WithHandler will register a custom action when the server is created, after the built in
+// actions. The handler is made from the server, so it can respond with the server's ack methods.
+// The server won't start if the action can't be registered.
+func WithHandler(action string, newHandler func(s *WebSocketServer) HandlerFunc, opts HandlerOptions) ServerOption {
+	return func(s *WebSocketServer) {
+		if err := s.RegisterHandlerWithOptions(action, newHandler(s), opts); err != nil {
+			log.Fatalf("Error when registering custom handler: %v", err)
+		}
+	}
+}
+
+// WithIdGenerator will make the server use the generator for the ids of clients that connect
+// without one, and of the messages it sends on its own.
+func WithIdGenerator(ids network.IdGenerator) ServerOption {
+	return func(s *WebSocketServer) {
+		s.ids = ids
+	}
+}
+
+// RegisterHandler will add a handler for a custom action, so code outside of the server, such as
+// a plugin, can add actions without changing NewWebSocketServer. The handler gets the standard
+// decorators of the built in actions, then the decorators given, in order. Must be called before
+// the server starts handling connections. Returns error if the action is blank or already has a handler.
+func (s *WebSocketServer) RegisterHandler(action string, handler HandlerFunc, decorators ...func(HandlerFunc) HandlerFunc) error {
+	return s.RegisterHandlerWithOptions(action, handler, HandlerOptions{Decorators: decorators})
+}
+
+// RegisterHandlerWithOptions will add a handler for a custom action like RegisterHandler, with
+// options for which decorators wrap it.
+func (s *WebSocketServer) RegisterHandlerWithOptions(action string, handler HandlerFunc, opts HandlerOptions) error {
+	if strings.TrimSpace(action) == "" {
+		return fmt.Errorf("can't register a handler without an action")
+	}
+	if handler == nil {
+		return fmt.Errorf("can't register a nil handler for action: %s", action)
+	}
+	if _, ok := s.handlers[action]; ok {
+		return fmt.Errorf("action already has a handler: %s", action)
+	}
+
+	var decorators []func(HandlerFunc) HandlerFunc
+	if !opts.NoStandardDecorators {
+		decorators = append(decorators, s.metricsDecorator)
+	}
+	if opts.RequireTopic {
+		decorators = append(decorators, s.requireTopicDecorator)
+	}
+	if opts.RequireData {
+		decorators = append(decorators, s.requireDataDecorator)
+	}
+	decorators = append(decorators, opts.Decorators...)
+
+	s.registerHandler(action, handler, decorators...)
+	if opts.Writes {
+		s.writes[action] = true
+	}
+	return nil
+}
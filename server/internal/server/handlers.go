@@ -3,16 +3,22 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	logger "github.com/atyalexyoung/data-loom/server/internal/logging"
 	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
 )
 
 // parseJSON takes a type to parse JSON into, and the data of the json and
@@ -23,31 +29,158 @@ func parseJSON[T any](data json.RawMessage) (T, error) {
 	return v, err
 }
 
+// newSuccessResponse will create the response for a successful request, which is compact if the
+// client asked for compact responses when connecting or in the options of the message.
+func newSuccessResponse(c *network.Client, msg network.WebSocketMessage, data any, warnings []string) any {
+	if c.CompactResponses || (msg.Options != nil && msg.Options.Compact) {
+		return network.CompactResponse{MessageId: msg.MessageId, Data: data, Warnings: warnings}
+	}
+	response := network.NewResponse(msg, http.StatusOK, "", data)
+	response.Warnings = warnings
+	return response
+}
+
+// errorCodes are the machine readable codes sent with error responses for errors that clients may
+// want to handle specifically, without parsing the message.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{topic.ErrTopicHasNoSchema, "TOPIC_HAS_NO_SCHEMA"},
+	{topic.ErrPayloadTooLarge, "PAYLOAD_TOO_LARGE"},
+	{ErrReadOnly, "SERVICE_READ_ONLY"},
+	{topic.ErrPreconditionFailed, "PRECONDITION_FAILED"},
+	{topic.ErrTooFrequent, "TOO_FREQUENT"},
+	{topic.ErrTopicLimit, "TOPIC_LIMIT_REACHED"},
+}
+
+// newErrorResponse will create the response for a failed request, with the error as the message
+// and the error's code if it has one.
+func newErrorResponse(msg network.WebSocketMessage, code int, err error) network.Response {
+	response := network.NewResponse(msg, code, err.Error(), nil)
+	for _, errorCode := range errorCodes {
+		if errors.Is(err, errorCode.err) {
+			response.ErrorCode = errorCode.code
+			break
+		}
+	}
+	return response
+}
+
 // AckResponseSuccess with handle logging and responding to client if action was successful
 func (s *WebSocketServer) AckResponseSuccess(c *network.Client, msg network.WebSocketMessage) {
+	msg.Result.SetCode(http.StatusOK)
 	logger.HandlerSuccess(c.Id, msg.Action, msg.Topic, msg.MessageId)
 	if msg.RequireAck {
-		s.sender.SendToClient(c, network.NewResponse(msg, http.StatusOK, "", nil))
+		s.sender.SendToClient(c, newSuccessResponse(c, msg, nil, nil))
+		logger.HandlerAck(c.Id, msg.Action, msg.Topic, msg.MessageId)
+	}
+}
+
+// AckResponseSuccessWithWarnings will handle logging and responding to client if action was successful
+// but had non-fatal issues. The warnings are included in the ack.
+func (s *WebSocketServer) AckResponseSuccessWithWarnings(c *network.Client, msg network.WebSocketMessage, warnings []string) {
+	if len(warnings) == 0 {
+		s.AckResponseSuccess(c, msg)
+		return
+	}
+
+	msg.Result.SetCode(http.StatusOK)
+	logger.HandlerWarnings(c.Id, msg.Action, msg.Topic, msg.MessageId, warnings)
+	if msg.RequireAck {
+		s.sender.SendToClient(c, newSuccessResponse(c, msg, nil, warnings))
 		logger.HandlerAck(c.Id, msg.Action, msg.Topic, msg.MessageId)
 	}
 }
 
 // AckResponseData will handle logging and response with data to client.
 func (s *WebSocketServer) AckResponseSuccessWithData(c *network.Client, msg network.WebSocketMessage, data any) {
+	msg.Result.SetCode(http.StatusOK)
+	logger.HandlerSuccess(c.Id, msg.Action, msg.Topic, msg.MessageId)
+	s.sender.SendToClient(c, newSuccessResponse(c, msg, data, nil))
+	logger.HandlerAck(c.Id, msg.Action, msg.Topic, msg.MessageId)
+}
+
+// AckResponseSuccessWithChunks will handle logging and responding to the client with data, split
+// into chunk responses if the client asked for a chunked response and the data is bigger than the
+// configured chunk size.
+func (s *WebSocketServer) AckResponseSuccessWithChunks(c *network.Client, msg network.WebSocketMessage, data any) {
+	if msg.Options == nil || !msg.Options.Chunked {
+		s.AckResponseSuccessWithData(c, msg, data)
+		return
+	}
+
+	size := DEFAULT_CHUNK_SIZE
+	if s.config != nil && s.config.ChunkSize > 0 {
+		size = s.config.ChunkSize
+	}
+	chunks, err := network.SplitChunks(msg, data, size)
+	if err != nil {
+		s.AckResponseError(c, msg, fmt.Errorf("couldn't split response into chunks: %w", err))
+		return
+	}
+
+	msg.Result.SetCode(http.StatusOK)
 	logger.HandlerSuccess(c.Id, msg.Action, msg.Topic, msg.MessageId)
-	s.sender.SendToClient(c, network.NewResponse(msg, http.StatusOK, "", data))
+	for _, chunk := range chunks {
+		s.sender.SendToClient(c, chunk)
+	}
 	logger.HandlerAck(c.Id, msg.Action, msg.Topic, msg.MessageId)
 }
 
 // AckResponseError will handle logging and creating response to the client if an error has occured
 func (s *WebSocketServer) AckResponseError(c *network.Client, msg network.WebSocketMessage, err error) {
+	msg.Result.SetCode(http.StatusInternalServerError)
 	logger.HandlerError(c.Id, msg.Action, msg.Topic, msg.MessageId, err)
-	s.sender.SendToClient(c, network.NewResponse(msg, http.StatusInternalServerError, err.Error(), nil))
+	s.sender.SendToClient(c, newErrorResponse(msg, http.StatusInternalServerError, err))
 }
 
 func (s *WebSocketServer) AckResponseBadRequest(c *network.Client, msg network.WebSocketMessage, err error) {
+	msg.Result.SetCode(http.StatusBadRequest)
 	logger.HandlerError(c.Id, msg.Action, msg.Topic, msg.MessageId, err)
-	s.sender.SendToClient(c, network.NewResponse(msg, http.StatusBadRequest, err.Error(), nil))
+	s.sender.SendToClient(c, newErrorResponse(msg, http.StatusBadRequest, err))
+}
+
+// AckResponseForbidden will handle logging and responding to the client if a request isn't allowed,
+// such as for an action that is disabled.
+func (s *WebSocketServer) AckResponseForbidden(c *network.Client, msg network.WebSocketMessage, err error) {
+	msg.Result.SetCode(http.StatusForbidden)
+	logger.HandlerError(c.Id, msg.Action, msg.Topic, msg.MessageId, err)
+	s.sender.SendToClient(c, newErrorResponse(msg, http.StatusForbidden, err))
+}
+
+// AckResponseServiceUnavailable will handle logging and responding to the client if a request
+// can't be handled right now, such as a write while the server is read only.
+func (s *WebSocketServer) AckResponseServiceUnavailable(c *network.Client, msg network.WebSocketMessage, err error) {
+	msg.Result.SetCode(http.StatusServiceUnavailable)
+	logger.HandlerError(c.Id, msg.Action, msg.Topic, msg.MessageId, err)
+	s.sender.SendToClient(c, newErrorResponse(msg, http.StatusServiceUnavailable, err))
+}
+
+// AckResponseTooManyRequests will handle logging and responding to the client if a request was
+// rejected for going over a limit.
+func (s *WebSocketServer) AckResponseTooManyRequests(c *network.Client, msg network.WebSocketMessage, err error) {
+	msg.Result.SetCode(http.StatusTooManyRequests)
+	logger.HandlerError(c.Id, msg.Action, msg.Topic, msg.MessageId, err)
+	s.sender.SendToClient(c, newErrorResponse(msg, http.StatusTooManyRequests, err))
+}
+
+// AckResponsePayloadTooLarge will handle logging and responding to the client if a published
+// value is bigger than the topic allows.
+func (s *WebSocketServer) AckResponsePayloadTooLarge(c *network.Client, msg network.WebSocketMessage, err error) {
+	msg.Result.SetCode(http.StatusRequestEntityTooLarge)
+	logger.HandlerError(c.Id, msg.Action, msg.Topic, msg.MessageId, err)
+	s.sender.SendToClient(c, newErrorResponse(msg, http.StatusRequestEntityTooLarge, err))
+}
+
+// AckResponsePreconditionFailed will handle logging and responding to the client if a conditional
+// request's precondition didn't match, with the current state as the data so it can retry.
+func (s *WebSocketServer) AckResponsePreconditionFailed(c *network.Client, msg network.WebSocketMessage, err error, current any) {
+	msg.Result.SetCode(http.StatusPreconditionFailed)
+	logger.HandlerError(c.Id, msg.Action, msg.Topic, msg.MessageId, err)
+	response := newErrorResponse(msg, http.StatusPreconditionFailed, err)
+	response.Data = current
+	s.sender.SendToClient(c, response)
 }
 
 func (s *WebSocketServer) AckResponseDatabaseError(c *network.Client, msg network.WebSocketMessage, err error) {
@@ -57,30 +190,121 @@ func (s *WebSocketServer) AckResponseDatabaseError(c *network.Client, msg networ
 
 // Will register a handler with the action string as the lookup for the handler,
 // the handler function, and any number of decorators to wrap the handler. Note: The decorators
-// are ran right to left in order. In other words, the left-most decorator is the "inner-most"
-// and they are wrapped around from there.
+// are ran left to right in order. In other words, the left-most decorator is the "outer-most"
+// and the right-most decorator is the one that calls the handler. Every handler is wrapped in
+// the recoverDecorator outside of all of them so a panic doesn't kill the client's connection.
 func (s *WebSocketServer) registerHandler(action string, handler HandlerFunc, decorators ...func(HandlerFunc) HandlerFunc) {
 	// gets the name using reflection to log that the handler was registered
 	name := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()).Name()
 
 	final := handler
-	for _, dec := range decorators {
-		final = dec(final)
+	for i := len(decorators) - 1; i >= 0; i-- { // wrap from the inside out
+		final = decorators[i](final)
 	}
+	final = s.recoverDecorator(final)
 	s.handlers[action] = final
 	log.WithFields(log.Fields{"action": action, "function": name}).Trace("registered handler")
 }
 
+// subscriptionOptions will get the options of a subscription from the message. Returns error if
+// the options can't be used together.
+func subscriptionOptions(msg network.WebSocketMessage) (topic.SubscriptionOptions, error) {
+	var opts topic.SubscriptionOptions
+	if msg.Options != nil {
+		opts.Conflate = msg.Options.Conflate
+		if msg.Options.EchoToSender != nil {
+			opts.NoEcho = !*msg.Options.EchoToSender
+		}
+		opts.AckWindow = msg.Options.AckWindow
+	}
+	if opts.AckWindow < 0 || opts.AckWindow > MAX_ACK_WINDOW {
+		return opts, fmt.Errorf("invalid ackWindow: %d. Must be from 0 to %d", opts.AckWindow, MAX_ACK_WINDOW)
+	}
+	if opts.AckWindow > 0 && opts.Conflate {
+		return opts, fmt.Errorf("a subscription with an ackWindow can't conflate, since every value is sequenced")
+	}
+	return opts, nil
+}
+
 // subscribeHandler handles subscription request, error handling from trying to subscribe
 // and response to the client.
 func (s *WebSocketServer) subscribeHandler(c *network.Client, msg network.WebSocketMessage) {
-	if err := s.topicManager.Subscribe(msg.Topic, c); err != nil {
-		s.AckResponseError(c, msg, err)
+	opts, err := subscriptionOptions(msg)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if !s.ensureTopic(c, msg, nil) {
+		return
+	}
+	if msg.Options != nil && msg.Options.ResumeFrom != nil {
+		s.resumeSubscription(c, msg, opts, *msg.Options.ResumeFrom)
+		return
+	}
+
+	if err := s.topicManager.Subscribe(msg.Topic, c, opts); err != nil {
+		if errors.Is(err, topic.ErrSubscriptionLimit) {
+			s.AckResponseTooManyRequests(c, msg, err)
+		} else {
+			s.AckResponseError(c, msg, err)
+		}
 	} else {
 		s.AckResponseSuccess(c, msg)
 	}
 }
 
+// resumeSubscription will subscribe the client and replay the values published to the topic after
+// the sequence number. The response says how many values are replayed and if some were missed,
+// and is sent before them.
+func (s *WebSocketServer) resumeSubscription(c *network.Client, msg network.WebSocketMessage, opts topic.SubscriptionOptions, seq uint64) {
+	err := s.topicManager.SubscribeFrom(msg.Topic, c, opts, seq, func(result topic.ReplayResult) {
+		s.AckResponseSuccessWithData(c, msg, network.ResumeResponse{
+			Replayed:  result.Replayed,
+			Gap:       result.Gap,
+			OldestSeq: result.OldestSeq,
+			LatestSeq: result.LatestSeq,
+		})
+	})
+	if errors.Is(err, topic.ErrSubscriptionLimit) {
+		s.AckResponseTooManyRequests(c, msg, err)
+	} else if errors.Is(err, topic.ErrNoReplayHistory) {
+		s.AckResponseBadRequest(c, msg, err)
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+	}
+}
+
+// subscribeAndGetHandler handles a request to subscribe to a topic and get its current value in
+// one step, so no value published in between is missed or sent twice. The value is sent as the
+// response before any value published after it, and in the envelope of a get with the meta
+// option if the client asked for it.
+func (s *WebSocketServer) subscribeAndGetHandler(c *network.Client, msg network.WebSocketMessage) {
+	opts, err := subscriptionOptions(msg)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if !s.ensureTopic(c, msg, nil) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
+	defer cancel()
+
+	err = s.topicManager.SubscribeAndGet(ctx, msg.Topic, c, opts, func(current topic.ValueMeta) {
+		if msg.Options != nil && msg.Options.Meta {
+			s.AckResponseSuccessWithChunks(c, msg, newValueWithMeta(c, msg.Topic, current))
+		} else {
+			s.AckResponseSuccessWithChunks(c, msg, current.Value)
+		}
+	})
+	if errors.Is(err, topic.ErrSubscriptionLimit) {
+		s.AckResponseTooManyRequests(c, msg, err)
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+	}
+}
+
 // unsubscribeHandler handles request to unsubscribe, error handling from topic manager doing work,
 // and sending response to the requesting client.
 func (s *WebSocketServer) unsubscribeHandler(c *network.Client, msg network.WebSocketMessage) {
@@ -91,6 +315,49 @@ func (s *WebSocketServer) unsubscribeHandler(c *network.Client, msg network.WebS
 	}
 }
 
+// pauseHandler handles a request to stop being sent values for a topic without unsubscribing,
+// and responds to the client.
+func (s *WebSocketServer) pauseHandler(c *network.Client, msg network.WebSocketMessage) {
+	keepLatest := msg.Options != nil && msg.Options.KeepLatest
+	if err := s.topicManager.Pause(msg.Topic, c, keepLatest); errors.Is(err, topic.ErrNotSubscribed) || errors.Is(err, topic.ErrAckWindowed) {
+		s.AckResponseBadRequest(c, msg, err)
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+	} else {
+		s.AckResponseSuccess(c, msg)
+	}
+}
+
+// resumeHandler handles a request to be sent values for a paused subscription again, and
+// responds to the client.
+func (s *WebSocketServer) resumeHandler(c *network.Client, msg network.WebSocketMessage) {
+	if err := s.topicManager.Resume(msg.Topic, c); errors.Is(err, topic.ErrNotSubscribed) {
+		s.AckResponseBadRequest(c, msg, err)
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+	} else {
+		s.AckResponseSuccess(c, msg)
+	}
+}
+
+// ackHandler handles a subscriber acking the values it was sent up to a sequence number, which
+// makes room in its ack window for more, and responds to the client.
+func (s *WebSocketServer) ackHandler(c *network.Client, msg network.WebSocketMessage) {
+	request, err := parseJSON[network.AckRequest](msg.Data)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data is not an ack: %v", err))
+		return
+	}
+
+	if err := s.topicManager.Ack(msg.Topic, c, request.Seq); errors.Is(err, topic.ErrNotSubscribed) || errors.Is(err, topic.ErrInvalidAck) {
+		s.AckResponseBadRequest(c, msg, err)
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+	} else {
+		s.AckResponseSuccess(c, msg)
+	}
+}
+
 // publishHandler handles getting the request to publish from a client, error handling
 // from trying to publish, and response to the sending client.
 func (s *WebSocketServer) publishHandler(c *network.Client, msg network.WebSocketMessage) {
@@ -99,184 +366,1141 @@ func (s *WebSocketServer) publishHandler(c *network.Client, msg network.WebSocke
 		s.AckResponseBadRequest(c, msg, fmt.Errorf("data payload could not be parsed"))
 		return
 	}
+	if err := checkTtl(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if err := checkPriority(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if err := checkHeaders(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+
+	if !s.ensureTopic(c, msg, msg.ParsedData) {
+		return
+	}
 
-	// get the current schema for this topic
-	isMatch, err := s.topicManager.IsSchemaMatch(msg.Topic, msg.ParsedData)
-	if err != nil || !isMatch { // if we get an error, just blame it on client for now.
+	// fill in defaults first so the filled value is what gets validated
+	value, err := s.topicManager.ApplyDefaults(msg.Topic, msg.ParsedData)
+	if err != nil {
 		s.AckResponseBadRequest(c, msg, err)
+		return
 	}
-	log.WithFields(log.Fields{"topic": msg.Topic, "method": "publishHandler"}).Trace("schemas matched")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+	// validate the payload against the current schema for this topic
+	warnings, err := s.topicManager.ValidatePayload(msg.Topic, value)
+	if err != nil { // if we get an error, just blame it on client for now.
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	log.WithFields(log.Fields{"topic": msg.Topic, "method": "publishHandler", "warnings": warnings}).Trace("schema validated")
 
+	if msg.Options != nil && msg.Options.DeliveryReport && msg.Result == nil { // the counts are recorded on the result
+		msg.Result = &network.RequestResult{}
+	}
+	// the write is cancelled once its result is in, not when the handler returns, so a publish
+	// that's acked still gets persisted
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
 	errCh := make(chan error, 1)
-	go func() {
-		select {
-		case err := <-errCh:
-			if err != nil {
-				s.AckResponseDatabaseError(c, msg, err)
-			}
-		case <-ctx.Done():
-			log.WithFields(log.Fields{
-				"topic":  msg.Topic,
-				"client": c.Id,
-			}).Warnf("DB write timeout for topic: %s, client: %s", msg.Topic, c.Id)
-			s.AckResponseDatabaseError(c, msg, fmt.Errorf("timeout when persisting"))
-		}
-	}()
 
-	if err := s.topicManager.Publish(ctx, msg, c, msg.ParsedData, errCh); err != nil {
-		s.AckResponseError(c, msg, err)
+	err = s.topicManager.Publish(ctx, msg, c, value, errCh)
+	if err == nil || errors.Is(err, topic.ErrPublishCoalesced) {
+		if err != nil {
+			warnings = append(warnings, coalescedWarning)
+		}
+		s.ackPublished(c, msg, warnings)
+		go s.awaitPersisted(ctx, cancel, c, msg, errCh)
+		return
+	}
+	cancel()
+	if errors.Is(err, topic.ErrPayloadTooLarge) {
+		s.AckResponsePayloadTooLarge(c, msg, err)
+	} else if errors.Is(err, topic.ErrTooFrequent) {
+		s.AckResponseTooManyRequests(c, msg, err)
 	} else {
-		s.AckResponseSuccess(c, msg)
+		s.AckResponseError(c, msg, err)
 	}
 }
 
-// unsubscribAllHandler handles the request from client to unsubscribe from all topics,
-// and sending respone to the requesting client.
-func (s *WebSocketServer) unsubscribeAllHandler(c *network.Client, msg network.WebSocketMessage) {
-	s.topicManager.UnsubscribeAll(c)
-	s.AckResponseSuccess(c, msg)
+// coalescedWarning is the warning a publish is acked with when the value was held back by the
+// topic's min publish interval, to be published once the interval is up.
+const coalescedWarning = "published sooner than the topic's minPublishInterval, the value will be published when the interval is up unless a newer value replaces it"
+
+// ackPublished will ack a value that was sent to subscribers. If the client asked for a delivery
+// report, the ack is always sent with how many subscribers the value was delivered to as the data.
+func (s *WebSocketServer) ackPublished(c *network.Client, msg network.WebSocketMessage, warnings []string) {
+	if msg.Options == nil || !msg.Options.DeliveryReport {
+		s.AckResponseSuccessWithWarnings(c, msg, warnings)
+		return
+	}
+
+	msg.Result.SetCode(http.StatusOK)
+	logger.HandlerSuccess(c.Id, msg.Action, msg.Topic, msg.MessageId)
+	s.sender.SendToClient(c, newSuccessResponse(c, msg, msg.Result.Delivery(), warnings))
+	logger.HandlerAck(c.Id, msg.Action, msg.Topic, msg.MessageId)
 }
 
-// getHandler handles a request to get a topic value, errors from topic manager, and
-// sending response to requesting client.
-func (s *WebSocketServer) getHandler(c *network.Client, msg network.WebSocketMessage) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+// awaitPersisted will wait for the result of persisting a value that was already acked, and
+// respond with a database error if it failed or didn't finish before ctx is done. A closed errCh
+// means there's nothing to report. cancel is called once the result is in.
+func (s *WebSocketServer) awaitPersisted(ctx context.Context, cancel context.CancelFunc, c *network.Client, msg network.WebSocketMessage, errCh <-chan error) {
 	defer cancel()
-
-	if data, err := s.topicManager.Get(ctx, msg.Topic); err != nil {
-		s.AckResponseError(c, msg, err)
-	} else {
-		s.AckResponseSuccessWithData(c, msg, data)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			s.AckResponseDatabaseError(c, msg, err)
+		}
+	case <-ctx.Done():
+		log.WithFields(log.Fields{
+			"topic":      msg.Topic,
+			"client":     c.Id,
+			"message_id": msg.MessageId,
+			"action":     msg.Action,
+		}).Warnf("DB write timeout for topic: %s, client: %s", msg.Topic, c.Id)
+		s.AckResponseDatabaseError(c, msg, fmt.Errorf("timeout when persisting"))
 	}
 }
 
-// registerTopicHandler handles a request to register a topic, error from topic manager from
-// operation, and sending response to the requesting client.
-func (s *WebSocketServer) registerTopicHandler(c *network.Client, msg network.WebSocketMessage) {
-	if msg.ParsedData == nil {
-		s.AckResponseBadRequest(c, msg, fmt.Errorf("data payload could not be parsed"))
+// publishIfHandler handles a request to publish a value to a topic only if the topic's current
+// value is the expected one. If it isn't, nothing is published and the client gets the current
+// value with its metadata back, so it can retry from it.
+func (s *WebSocketServer) publishIfHandler(c *network.Client, msg network.WebSocketMessage) {
+	request, err := parseJSON[network.PublishIfRequest](msg.Data)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data is not a conditional publish: %v", err))
+		return
+	}
+	switch request.Value.(type) { // the same as the data of a publish
+	case map[string]any, []any:
+	default:
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("value must be a json object or array"))
+		return
+	}
+
+	var condition topic.Precondition
+	if request.Expected != nil {
+		condition.CheckValue = true
+		if condition.Value, err = parseJSON[any](request.Expected); err != nil {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("invalid expected value: %v", err))
+			return
+		}
+	}
+	if request.ExpectedTimestamp != "" {
+		if condition.Timestamp, err = time.Parse(time.RFC3339Nano, request.ExpectedTimestamp); err != nil {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("invalid expectedTimestamp: %s. Must be an RFC 3339 time", request.ExpectedTimestamp))
+			return
+		}
+	}
+	if !condition.CheckValue && condition.Timestamp.IsZero() {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("publishIf needs an expected value or expectedTimestamp"))
+		return
+	}
+	if err := checkTtl(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if err := checkPriority(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if err := checkHeaders(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if !s.topicManager.HasTopic(msg.Topic) {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("topic %s isn't registered. Register it with registerTopic first", msg.Topic))
 		return
 	}
 
-	topic, err := s.topicManager.RegisterTopic(msg.Topic, msg.ParsedData)
+	value, err := s.topicManager.ApplyDefaults(msg.Topic, request.Value)
 	if err != nil {
-		s.AckResponseError(c, msg, err)
-	} else if msg.RequireAck { // explicit check for requireAck since response with data doesn't
-		s.AckResponseSuccessWithData(c, msg, topic)
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	warnings, err := s.topicManager.ValidatePayload(msg.Topic, value)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
 	}
-}
 
-// unregisterTopicHandler handles request from client to unregister a topic, error from topic
-// manager doing work, and responding to the requesting client.
-func (s *WebSocketServer) unregisterTopicHandler(c *network.Client, msg network.WebSocketMessage) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
+	if msg.Options != nil && msg.Options.DeliveryReport && msg.Result == nil { // the counts are recorded on the result
+		msg.Result = &network.RequestResult{}
+	}
+	// the write is cancelled once its result is in, not when the handler returns, so a publish
+	// that's acked still gets persisted
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
+	errCh := make(chan error, 1)
 
-	if err := s.topicManager.UnregisterTopic(ctx, msg.Topic); err != nil {
-		s.AckResponseError(c, msg, err)
+	current, err := s.topicManager.PublishIf(ctx, msg, c, value, condition, errCh)
+	if err == nil {
+		s.ackPublished(c, msg, warnings)
+		go s.awaitPersisted(ctx, cancel, c, msg, errCh)
+		return
+	}
+	cancel()
+	if errors.Is(err, topic.ErrPreconditionFailed) {
+		s.AckResponsePreconditionFailed(c, msg, err, newValueWithMeta(c, msg.Topic, current))
+	} else if errors.Is(err, topic.ErrPayloadTooLarge) {
+		s.AckResponsePayloadTooLarge(c, msg, err)
+	} else if errors.Is(err, topic.ErrTooFrequent) {
+		s.AckResponseTooManyRequests(c, msg, err)
 	} else {
-		s.AckResponseSuccess(c, msg)
+		s.AckResponseError(c, msg, err)
 	}
 }
 
-// listToipicsHandler handles request from client to get a list of users, error from topic manager
-// and translating slice of topics into a list of Topic Responses from topic manager,
-// and sending response to the client.
-func (s *WebSocketServer) listTopicsHandler(c *network.Client, msg network.WebSocketMessage) {
-	topics, err := s.topicManager.ListTopics()
+// publishTransactionHandler handles a request to publish values to several topics at once. Every
+// value is checked against its topic before anything is published, and then they're persisted
+// in a single transaction so either every topic gets its value or none do.
+func (s *WebSocketServer) publishTransactionHandler(c *network.Client, msg network.WebSocketMessage) {
+	request, err := parseJSON[network.PublishTransactionRequest](msg.Data)
 	if err != nil {
-		s.AckResponseError(c, msg, err)
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data is not a transaction: %v", err))
+		return
+	}
+	if len(request.Values) == 0 {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("transaction has no values"))
+		return
+	}
+	if err := checkTtl(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if err := checkPriority(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if err := checkHeaders(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
 		return
 	}
 
-	// get responses from topics
-	var response []network.TopicResponse
-	for _, topic := range topics {
-		// get latest schema from topic
-		var schemaResponse network.TopicSchemaResponse
-		if schema, err := topic.GetLatestSchema(); err != nil {
-			log.Errorf("Error when getting schema for topic: %s when getting list of topics.", topic.NameWithLock())
-		} else if schema != nil {
-			schemaResponse = network.TopicSchemaResponse{
-				Version: schema.Version,
-				Schema:  schema.Schema,
-			}
+	values := make([]topic.TopicValue, 0, len(request.Values))
+	seen := make(map[string]bool, len(request.Values))
+	var warnings []string
+	for _, entry := range request.Values {
+		if strings.TrimSpace(entry.Topic) == "" {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("transaction value has no topic"))
+			return
+		}
+		if seen[entry.Topic] {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("topic %s is in the transaction more than once", entry.Topic))
+			return
+		}
+		seen[entry.Topic] = true
+		if entry.Data == nil {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("no data for topic %s", entry.Topic))
+			return
 		}
 
-		response = append(response, network.TopicResponse{
-			Name:   topic.NameWithLock(),
-			Schema: schemaResponse,
-		})
+		topicName := c.ScopeTopic(entry.Topic)
+		value, err := s.topicManager.ApplyDefaults(topicName, entry.Data)
+		if err != nil {
+			s.AckResponseBadRequest(c, msg, err)
+			return
+		}
+		topicWarnings, err := s.topicManager.ValidatePayload(topicName, value)
+		if err != nil {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("invalid data for topic %s: %w", entry.Topic, err))
+			return
+		}
+		for _, warning := range topicWarnings {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", entry.Topic, warning))
+		}
+		values = append(values, topic.TopicValue{Topic: topicName, Value: value})
 	}
 
-	s.AckResponseSuccessWithData(c, msg, response)
-}
-
-// updateSchemaHandler handles request from client to update the schema for a topic,
-// verifying parsed data, and errors from
-// topic manager perfroming actions, and sending response to client.
-func (s *WebSocketServer) updateSchemaHandler(c *network.Client, msg network.WebSocketMessage) {
-	if msg.ParsedData == nil {
-		s.AckResponseBadRequest(c, msg, fmt.Errorf("data payload could not be parsed"))
-		return
+	if msg.Options != nil && msg.Options.DeliveryReport && msg.Result == nil { // the counts are recorded on the result
+		msg.Result = &network.RequestResult{}
 	}
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
+	defer cancel()
 
-	err := s.topicManager.UpdateSchema(msg.Topic, msg.ParsedData)
-	if err != nil {
+	if err := s.topicManager.PublishTransaction(ctx, msg, c, values); errors.Is(err, topic.ErrPayloadTooLarge) {
+		s.AckResponsePayloadTooLarge(c, msg, err)
+	} else if errors.Is(err, topic.ErrTooFrequent) {
+		s.AckResponseTooManyRequests(c, msg, err)
+	} else if err != nil {
 		s.AckResponseError(c, msg, err)
-		return
+	} else {
+		s.ackPublished(c, msg, warnings)
 	}
+}
 
+// unsubscribAllHandler handles the request from client to unsubscribe from all topics,
+// and sending respone to the requesting client.
+func (s *WebSocketServer) unsubscribeAllHandler(c *network.Client, msg network.WebSocketMessage) {
+	s.topicManager.UnsubscribeAll(c)
 	s.AckResponseSuccess(c, msg)
 }
 
-// sendWithoutSaveHandler handles request from client to publish a message without persisting it to
-// database, handles verifying parsed data, error from topic manager, and sending response to client.
-func (s *WebSocketServer) sendWithoutSaveHandler(c *network.Client, msg network.WebSocketMessage) {
-	if msg.ParsedData == nil {
-		s.AckResponseBadRequest(c, msg, fmt.Errorf("data payload could not be parsed"))
-		return
+// unsubscribeAllPatternHandler will unsubscribe the client from the topics it's subscribed to that
+// match the pattern in the topic field, and respond with the names of the topics it left.
+func (s *WebSocketServer) unsubscribeAllPatternHandler(c *network.Client, msg network.WebSocketMessage) {
+	removed, err := s.topicManager.UnsubscribePattern(c, msg.Topic)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	for i, name := range removed {
+		removed[i] = c.UnscopeTopic(name)
+	}
+	s.AckResponseSuccessWithData(c, msg, removed)
+}
+
+// getHandler handles a request to get a topic value, errors from topic manager, and
+// sending response to requesting client.
+func (s *WebSocketServer) getHandler(c *network.Client, msg network.WebSocketMessage) {
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
+	defer cancel()
+
+	if msg.Options != nil && msg.Options.At != "" {
+		at, err := time.Parse(time.RFC3339Nano, msg.Options.At)
+		if err != nil {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("invalid at: %s. Must be an RFC 3339 time", msg.Options.At))
+			return
+		}
+
+		if msg.Options.Meta {
+			s.getWithMeta(ctx, c, msg, at)
+			return
+		}
+		data, err := s.topicManager.GetAt(ctx, msg.Topic, at)
+		if errors.Is(err, storage.ErrHistoryNotSupported) {
+			s.AckResponseBadRequest(c, msg, err)
+		} else if err != nil {
+			s.AckResponseError(c, msg, err)
+		} else {
+			s.AckResponseSuccessWithChunks(c, msg, data)
+		}
+		return
+	}
+
+	if msg.Options != nil && msg.Options.Meta {
+		s.getWithMeta(ctx, c, msg, time.Time{})
+		return
+	}
+	if data, err := s.topicManager.Get(ctx, msg.Topic); err != nil {
+		s.AckResponseError(c, msg, err)
+	} else {
+		s.AckResponseSuccessWithChunks(c, msg, data)
 	}
+}
 
-	// get the current schema for this topic
-	isMatch, err := s.topicManager.IsSchemaMatch(msg.Topic, msg.ParsedData)
-	if err != nil || !isMatch { // if we get an error, just blame it on client for now.
+// getWithMeta will respond with the value of the topic in an envelope with when and how it was
+// stored, the latest value if at is zero.
+func (s *WebSocketServer) getWithMeta(ctx context.Context, c *network.Client, msg network.WebSocketMessage, at time.Time) {
+	meta, err := s.topicManager.GetWithMeta(ctx, msg.Topic, at)
+	if errors.Is(err, storage.ErrHistoryNotSupported) {
 		s.AckResponseBadRequest(c, msg, err)
+		return
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+		return
+	}
+
+	s.AckResponseSuccessWithChunks(c, msg, newValueWithMeta(c, msg.Topic, meta))
+}
+
+// newValueWithMeta will create the envelope of a topic's value with when and how it was stored.
+func newValueWithMeta(c *network.Client, topicName string, meta topic.ValueMeta) network.ValueWithMeta {
+	response := network.ValueWithMeta{Topic: c.UnscopeTopic(topicName), Value: meta.Value, SchemaVersion: meta.SchemaVersion, Latest: meta.Latest, Headers: meta.Headers}
+	if !meta.Timestamp.IsZero() {
+		response.Timestamp = &meta.Timestamp
 	}
+	return response
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+// getRecentHandler will respond with up to the last count values stored for the topic, newest first.
+func (s *WebSocketServer) getRecentHandler(c *network.Client, msg network.WebSocketMessage) {
+	count := DEFAULT_RECENT_COUNT
+	if msg.Options != nil && msg.Options.Count != nil {
+		count = *msg.Options.Count
+	}
+	if count < 1 || count > MAX_RECENT_COUNT {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("invalid count: %d. Must be from 1 to %d", count, MAX_RECENT_COUNT))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
 	defer cancel()
 
-	// Making error channel for database to async give errors about persistence
-	// back to handler to communicate that with the client.
-	errCh := make(chan error, 1)
-	go func() {
-		select {
-		case err := <-errCh:
-			if err != nil {
-				s.AckResponseDatabaseError(c, msg, err)
+	values, err := s.topicManager.GetRecent(ctx, msg.Topic, count)
+	if errors.Is(err, storage.ErrHistoryNotSupported) {
+		s.AckResponseBadRequest(c, msg, err)
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+	} else {
+		s.AckResponseSuccessWithChunks(c, msg, values)
+	}
+}
+
+// getPatternHandler will respond with the current values of all the topics that match the
+// pattern in the topic field, keyed by topic name.
+func (s *WebSocketServer) getPatternHandler(c *network.Client, msg network.WebSocketMessage) {
+	names, err := s.topicManager.MatchTopics(msg.Topic)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+
+	if s.config != nil && s.config.MaxPatternResults > 0 && len(names) > s.config.MaxPatternResults {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("pattern matched %d topics, the max is %d. Use a narrower pattern", len(names), s.config.MaxPatternResults))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
+	defer cancel()
+
+	values, err := s.topicManager.GetMany(ctx, names)
+	if err != nil {
+		s.AckResponseError(c, msg, err)
+		return
+	}
+	if c.TopicPrefix != "" {
+		unscoped := make(map[string]any, len(values))
+		for name, value := range values {
+			unscoped[c.UnscopeTopic(name)] = value
+		}
+		values = unscoped
+	}
+	s.AckResponseSuccessWithData(c, msg, values)
+}
+
+// exportSchemasHandler will respond with the definitions and schema history of every topic the
+// client can use.
+func (s *WebSocketServer) exportSchemasHandler(c *network.Client, msg network.WebSocketMessage) {
+	definitions := s.topicManager.ExportSchemas()
+
+	registry := network.SchemaRegistry{Topics: make([]network.TopicDefinitionResponse, 0, len(definitions))}
+	for _, definition := range definitions {
+		if !c.InScope(definition.Name) {
+			continue
+		}
+		exported := network.TopicDefinitionResponse{
+			Name:           c.UnscopeTopic(definition.Name),
+			ValidationMode: string(definition.ValidationMode),
+			Schemas:        make([]network.TopicSchemaResponse, 0, len(definition.Schemas)),
+		}
+		for _, schema := range definition.Schemas {
+			exported.Schemas = append(exported.Schemas, network.TopicSchemaResponse{
+				Version: schema.Version,
+				Schema:  schema.Schema,
+				Hash:    schema.Hash,
+			})
+		}
+		registry.Topics = append(registry.Topics, exported)
+	}
+
+	s.AckResponseSuccessWithData(c, msg, registry)
+}
+
+// importSchemasHandler will import topic definitions that were exported from another server.
+func (s *WebSocketServer) importSchemasHandler(c *network.Client, msg network.WebSocketMessage) {
+	registry, err := parseJSON[network.SchemaRegistry](msg.Data)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data is not a schema registry: %v", err))
+		return
+	}
+
+	definitions := make([]topic.TopicDefinition, 0, len(registry.Topics))
+	for _, imported := range registry.Topics {
+		definition := topic.TopicDefinition{
+			Name:           c.ScopeTopic(imported.Name),
+			ValidationMode: topic.ValidationMode(imported.ValidationMode),
+			Schemas:        make([]*topic.TopicSchema, 0, len(imported.Schemas)),
+		}
+		for _, schema := range imported.Schemas {
+			definition.Schemas = append(definition.Schemas, &topic.TopicSchema{
+				Version: schema.Version,
+				Schema:  schema.Schema,
+				Hash:    schema.Hash,
+			})
+		}
+		definitions = append(definitions, definition)
+	}
+
+	result, err := s.topicManager.ImportSchemas(definitions)
+	if errors.Is(err, topic.ErrTopicNotAllowed) {
+		s.AckResponseForbidden(c, msg, err)
+		return
+	} else if errors.Is(err, topic.ErrTopicLimit) {
+		s.AckResponseTooManyRequests(c, msg, err)
+		return
+	} else if err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+
+	s.AckResponseSuccessWithData(c, msg, network.ImportSchemasResponse{
+		TopicsCreated: result.TopicsCreated,
+		VersionsAdded: result.VersionsAdded,
+	})
+}
+
+// topicOptionsFromMessage will convert the options supplied by the client on a message into
+// the options for a topic. Returns error if any of the options are invalid.
+func topicOptionsFromMessage(msg network.WebSocketMessage) (topic.TopicOptions, error) {
+	var opts topic.TopicOptions
+	if msg.Options == nil {
+		opts.ValidationMode = topic.ValidationStrict
+		return opts, nil
+	}
+
+	mode, err := topic.ParseValidationMode(msg.Options.ValidationMode)
+	if err != nil {
+		return opts, err
+	}
+	opts.ValidationMode = mode
+
+	if msg.Options.PersistInterval != "" {
+		interval, err := time.ParseDuration(msg.Options.PersistInterval)
+		if err != nil || interval < 0 {
+			return opts, fmt.Errorf("invalid persistInterval: %s", msg.Options.PersistInterval)
+		}
+		opts.PersistInterval = interval
+	}
+
+	if msg.Options.Webhook != "" {
+		webhook, err := url.Parse(msg.Options.Webhook)
+		if err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+			return opts, fmt.Errorf("invalid webhook: %s. Must be an http or https url", msg.Options.Webhook)
+		}
+		opts.WebhookURL = webhook.String()
+	}
+
+	if msg.Options.OverflowPolicy != "" { // blank leaves it up to each subscriber's policy
+		policy, err := network.ParseOverflowPolicy(msg.Options.OverflowPolicy)
+		if err != nil {
+			return opts, err
+		}
+		opts.OverflowPolicy = policy
+	}
+
+	opts.FillDefaults = msg.Options.FillDefaults
+	opts.Compressed = msg.Options.Compressed
+
+	format, err := topic.ParsePayloadFormat(msg.Options.Format)
+	if err != nil {
+		return opts, err
+	}
+	if msg.Options.Binary {
+		if msg.Options.Format == "" {
+			format = topic.FormatRaw
+		} else if !format.IsBinary() {
+			return opts, fmt.Errorf("binary topics can't have the %s format", format)
+		}
+	}
+	opts.Format = format
+	opts.Binary = format.IsBinary()
+
+	if msg.Options.MaxPayloadSize < 0 {
+		return opts, fmt.Errorf("invalid maxPayloadSize: %d. Must be 0 or greater", msg.Options.MaxPayloadSize)
+	}
+	opts.MaxPayloadSize = msg.Options.MaxPayloadSize
+
+	if len(msg.Options.Aggregate) > 0 {
+		if opts.Binary || opts.Compressed {
+			return opts, fmt.Errorf("aggregate topics can't be binary or compressed")
+		}
+		seen := make(map[string]bool, len(msg.Options.Aggregate))
+		for _, field := range msg.Options.Aggregate {
+			if strings.TrimSpace(field) == "" || seen[field] {
+				return opts, fmt.Errorf("invalid aggregate field: %q. Fields must be named and only listed once", field)
 			}
-		case <-ctx.Done():
-			log.WithFields(log.Fields{
-				"topic":      msg.Topic,
-				"client":     c.Id,
-				"message_id": msg.MessageId,
-				"Action":     msg.Action,
-			}).Warnf("DB write timeout for topic: %s, client: %s", msg.Topic, c.Id)
-			s.AckResponseDatabaseError(c, msg, fmt.Errorf("timeout when persisting"))
-		}
-	}()
-
-	if err := s.topicManager.Publish(ctx, msg, c, msg.ParsedData, errCh); err != nil {
+			seen[field] = true
+		}
+		opts.Aggregate = msg.Options.Aggregate
+	}
+
+	if msg.Options.TickInterval != "" {
+		interval, err := time.ParseDuration(msg.Options.TickInterval)
+		if err != nil || interval < topic.MIN_TICK_INTERVAL {
+			return opts, fmt.Errorf("invalid tickInterval: %s. Must be at least %s", msg.Options.TickInterval, topic.MIN_TICK_INTERVAL)
+		}
+		opts.TickInterval = interval
+	}
+
+	if msg.Options.MinPublishInterval != "" {
+		interval, err := time.ParseDuration(msg.Options.MinPublishInterval)
+		if err != nil || interval < 0 {
+			return opts, fmt.Errorf("invalid minPublishInterval: %s", msg.Options.MinPublishInterval)
+		}
+		opts.MinPublishInterval = interval
+	}
+	policy, err := topic.ParseCooldownPolicy(msg.Options.CooldownPolicy)
+	if err != nil {
+		return opts, err
+	}
+	opts.CooldownPolicy = policy
+
+	if msg.Options.RedeliveryAttempts < 0 || msg.Options.RedeliveryAttempts > topic.MAX_REDELIVERY_ATTEMPTS {
+		return opts, fmt.Errorf("invalid redeliveryAttempts: %d. Must be from 0 to %d", msg.Options.RedeliveryAttempts, topic.MAX_REDELIVERY_ATTEMPTS)
+	}
+	opts.RedeliveryAttempts = msg.Options.RedeliveryAttempts
+	if msg.Options.RedeliveryDelay != "" {
+		delay, err := time.ParseDuration(msg.Options.RedeliveryDelay)
+		if err != nil || delay <= 0 {
+			return opts, fmt.Errorf("invalid redeliveryDelay: %s", msg.Options.RedeliveryDelay)
+		}
+		opts.RedeliveryDelay = delay
+	}
+	if msg.Options.ReplayHistory < 0 || msg.Options.ReplayHistory > topic.MAX_REPLAY_HISTORY {
+		return opts, fmt.Errorf("invalid replayHistory: %d. Must be from 0 to %d", msg.Options.ReplayHistory, topic.MAX_REPLAY_HISTORY)
+	}
+	opts.ReplayHistory = msg.Options.ReplayHistory
+	return opts, nil
+}
+
+// registerTopicHandler handles a request to register a topic, error from topic manager from
+// operation, and sending response to the requesting client.
+func (s *WebSocketServer) registerTopicHandler(c *network.Client, msg network.WebSocketMessage) {
+	if msg.ParsedData == nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data payload could not be parsed"))
+		return
+	}
+
+	opts, err := topicOptionsFromMessage(msg)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+
+	registered, err := s.topicManager.RegisterTopic(msg.Topic, msg.ParsedData, opts)
+	if errors.Is(err, topic.ErrTopicNotAllowed) || errors.Is(err, topic.ErrWebhookNotAllowed) {
+		s.AckResponseForbidden(c, msg, err)
+	} else if errors.Is(err, topic.ErrTopicLimit) {
+		s.AckResponseTooManyRequests(c, msg, err)
+	} else if errors.Is(err, topic.ErrNestingTooDeep) {
+		s.AckResponseBadRequest(c, msg, err)
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+	} else if msg.RequireAck { // explicit check for requireAck since response with data doesn't
+		response := newTopicResponse(registered)
+		if response != nil {
+			response.Name = c.UnscopeTopic(response.Name)
+		}
+		s.AckResponseSuccessWithData(c, msg, response)
+	}
+}
+
+// unregisterTopicHandler handles request from client to unregister a topic, error from topic
+// manager doing work, and responding to the requesting client. With the dryRun option it responds
+// with what would be deleted instead.
+func (s *WebSocketServer) unregisterTopicHandler(c *network.Client, msg network.WebSocketMessage) {
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
+	defer cancel()
+
+	if msg.Options != nil && msg.Options.DryRun {
+		if preview, err := s.topicManager.PreviewUnregisterTopic(ctx, msg.Topic); err != nil {
+			s.AckResponseError(c, msg, err)
+		} else {
+			s.AckResponseSuccessWithData(c, msg, network.DryRunResponse{Topics: []network.DryRunTopic{{
+				Name:        c.UnscopeTopic(preview.Topic),
+				HasData:     preview.HasData,
+				Subscribers: preview.Subscribers,
+			}}})
+		}
+		return
+	}
+
+	if err := s.topicManager.UnregisterTopic(ctx, msg.Topic); err != nil {
 		s.AckResponseError(c, msg, err)
 	} else {
 		s.AckResponseSuccess(c, msg)
 	}
 }
 
+// renameTopicHandler handles request from client to rename a topic to the "newName" in the
+// data, error from topic manager doing work, and responding to the requesting client.
+func (s *WebSocketServer) renameTopicHandler(c *network.Client, msg network.WebSocketMessage) {
+	data, _ := msg.ParsedData.(map[string]any)
+	newName, ok := data["newName"].(string)
+	if !ok || len(strings.TrimSpace(newName)) == 0 {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("no newName provided to rename topic to"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
+	defer cancel()
+
+	if err := s.topicManager.RenameTopic(ctx, msg.Topic, c.ScopeTopic(newName)); errors.Is(err, topic.ErrTopicNotAllowed) {
+		s.AckResponseForbidden(c, msg, err)
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+	} else {
+		s.AckResponseSuccess(c, msg)
+	}
+}
+
+// listToipicsHandler handles request from client to get a list of users, error from topic manager
+// and translating slice of topics into a list of Topic Responses from topic manager,
+// and sending response to the client.
+func (s *WebSocketServer) listTopicsHandler(c *network.Client, msg network.WebSocketMessage) {
+	topics, err := s.topicManager.ListTopics()
+	if err != nil {
+		s.AckResponseError(c, msg, err)
+		return
+	}
+
+	// get responses from the topics the client can use
+	var response []network.TopicResponse
+	for _, topic := range topics {
+		if !c.InScope(topic.NameWithLock()) {
+			continue
+		}
+		topicResponse := newTopicResponse(topic)
+		topicResponse.Name = c.UnscopeTopic(topicResponse.Name)
+		response = append(response, *topicResponse)
+	}
+
+	s.AckResponseSuccessWithData(c, msg, response)
+}
+
+// ensureTopic will make sure the topic of a publish, send, or subscribe exists. Publishing with
+// autoRegister registers a missing topic with the value as its schema, or no schema if the value
+// is binary. Otherwise a missing topic is rejected if the server requires topics to be registered,
+// or registered with no schema if it doesn't. Either way a json topic is registered with its
+// configured default schema instead if it has one, and the value is validated against it like any
+// other publish. The value is nil for a subscribe. Responds to the client and returns false if the
+// topic can't be used.
+func (s *WebSocketServer) ensureTopic(c *network.Client, msg network.WebSocketMessage, value any) bool {
+	_, isBinary := value.([]byte)
+	defaultSchema, hasDefault := s.topicManager.DefaultSchema(msg.Topic)
+	hasDefault = hasDefault && !isBinary
+
+	autoRegister := value != nil && msg.Options != nil && msg.Options.AutoRegister
+	requireRegistered := s.config == nil || s.config.RequireRegisteredTopic
+
+	var err error
+	switch {
+	case s.readOnly.Load() && (autoRegister || !requireRegistered) && !s.topicManager.HasTopic(msg.Topic):
+		s.AckResponseServiceUnavailable(c, msg, fmt.Errorf("%w, so topic %s can't be registered", ErrReadOnly, msg.Topic))
+		return false
+	case autoRegister && hasDefault:
+		_, err = s.topicManager.RegisterTopicIfMissing(msg.Topic, defaultSchema, topic.TopicOptions{})
+	case autoRegister && isBinary: // raw payloads aren't a schema
+		_, err = s.topicManager.RegisterTopicIfMissing(msg.Topic, nil, topic.TopicOptions{Binary: true})
+	case autoRegister:
+		// registered from the value, so the value is validated against itself
+		_, err = s.topicManager.RegisterTopicIfMissing(msg.Topic, value, topic.TopicOptions{})
+	case s.topicManager.HasTopic(msg.Topic):
+		return true
+	case requireRegistered:
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("topic %s isn't registered. Register it with registerTopic first", msg.Topic))
+		return false
+	case hasDefault:
+		_, err = s.topicManager.RegisterTopicIfMissing(msg.Topic, defaultSchema, topic.TopicOptions{})
+	default:
+		_, err = s.topicManager.RegisterTopicIfMissing(msg.Topic, nil, topic.TopicOptions{ValidationMode: topic.ValidationOff, Binary: isBinary})
+	}
+
+	if errors.Is(err, topic.ErrTopicNotAllowed) {
+		s.AckResponseForbidden(c, msg, err)
+		return false
+	} else if errors.Is(err, topic.ErrTopicLimit) {
+		s.AckResponseTooManyRequests(c, msg, err)
+		return false
+	} else if errors.Is(err, topic.ErrNestingTooDeep) {
+		s.AckResponseBadRequest(c, msg, err)
+		return false
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+		return false
+	}
+	return true
+}
+
+// checkTtl will return error if the message has a ttl that is negative. A ttl of zero is the
+// same as not having one.
+func checkTtl(msg network.WebSocketMessage) error {
+	if msg.Options != nil && msg.Options.TtlMs < 0 {
+		return fmt.Errorf("invalid ttlMs: %d. Must be a positive number of milliseconds", msg.Options.TtlMs)
+	}
+	return nil
+}
+
+// checkPriority will return error if the message has a priority that isn't known.
+func checkPriority(msg network.WebSocketMessage) error {
+	if msg.Options == nil {
+		return nil
+	}
+	_, err := network.ParsePriority(msg.Options.Priority)
+	return err
+}
+
+// checkHeaders will return error if the message has more headers than MAX_HEADERS, a header with a
+// blank name, or headers that add up to more than MAX_HEADER_BYTES.
+func checkHeaders(msg network.WebSocketMessage) error {
+	if len(msg.Headers) > MAX_HEADERS {
+		return fmt.Errorf("too many headers: %d. Can have at most %d", len(msg.Headers), MAX_HEADERS)
+	}
+	size := 0
+	for name, value := range msg.Headers {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("header names can't be blank")
+		}
+		size += len(name) + len(value)
+	}
+	if size > MAX_HEADER_BYTES {
+		return fmt.Errorf("headers are %d bytes. Can be at most %d", size, MAX_HEADER_BYTES)
+	}
+	return nil
+}
+
+// serverStatsHandler will respond with how many clients, topics, and subscriptions are on the server.
+func (s *WebSocketServer) serverStatsHandler(c *network.Client, msg network.WebSocketMessage) {
+	s.AckResponseSuccessWithData(c, msg, s.serverStats())
+}
+
+// serverStats will get the counts of clients, topics, and subscriptions from the hub and topic manager.
+func (s *WebSocketServer) serverStats() network.ServerStatsResponse {
+	stats := s.topicManager.Stats()
+	return network.ServerStatsResponse{
+		Clients:              s.hub.ClientCount(),
+		Topics:               stats.TopicCount,
+		Subscriptions:        stats.SubscriptionCount,
+		DroppedFailedClients: stats.DroppedFailedClients,
+	}
+}
+
+// topicExistsHandler will respond with if a topic is registered and its latest schema version if
+// it is, without registering it or listing every topic.
+func (s *WebSocketServer) topicExistsHandler(c *network.Client, msg network.WebSocketMessage) {
+	var response network.TopicExistsResponse
+	if version, ok := s.topicManager.TopicSchemaVersion(msg.Topic); ok {
+		response.Exists = true
+		response.SchemaVersion = &version
+	}
+	s.AckResponseSuccessWithData(c, msg, response)
+}
+
+// storageStatsHandler will respond with the approximate size on disk and number of keys in storage.
+func (s *WebSocketServer) storageStatsHandler(c *network.Client, msg network.WebSocketMessage) {
+	stats, err := s.storageStats(msg.Context())
+	if err != nil {
+		s.AckResponseError(c, msg, fmt.Errorf("couldn't get storage stats: %w", err))
+		return
+	}
+	s.AckResponseSuccessWithData(c, msg, stats)
+}
+
+// storageStats will get the size and key count of the storage from the topic manager.
+func (s *WebSocketServer) storageStats(ctx context.Context) (network.StorageStatsResponse, error) {
+	stats, err := s.topicManager.StorageStats(ctx)
+	if err != nil {
+		return network.StorageStatsResponse{}, err
+	}
+	return network.StorageStatsResponse{SizeBytes: stats.SizeBytes, Keys: stats.Keys}, nil
+}
+
+// lockStatsHandler will respond with how often the topic manager's and topics' locks were taken
+// and how long they waited, for finding contended topics. Only the topics under the client's
+// topic prefix are included.
+func (s *WebSocketServer) lockStatsHandler(c *network.Client, msg network.WebSocketMessage) {
+	s.AckResponseSuccessWithData(c, msg, s.lockStats(c.TopicPrefix))
+}
+
+// lockStats will get the lock stats from the topic manager, leaving out topics that aren't under
+// the prefix and naming the rest without it.
+func (s *WebSocketServer) lockStats(topicPrefix string) network.LocksResponse {
+	stats := s.topicManager.LockStats()
+	response := network.LocksResponse{Locks: make([]network.LockStatsResponse, 0, len(stats))}
+	for _, stat := range stats {
+		component := stat.Component
+		if topicName, ok := strings.CutPrefix(component, "Topic: "); ok {
+			unscoped, ok := strings.CutPrefix(topicName, topicPrefix)
+			if !ok {
+				continue
+			}
+			component = "Topic: " + unscoped
+		}
+		response.Locks = append(response.Locks, network.LockStatsResponse{
+			Component:    component,
+			Method:       stat.Method,
+			Mode:         stat.Mode,
+			Acquisitions: stat.Acquisitions,
+			TotalWait:    stat.TotalWait,
+			MaxWait:      stat.MaxWait,
+		})
+	}
+	return response
+}
+
+// capabilitiesHandler will respond with the actions, codecs, and features the server supports.
+func (s *WebSocketServer) capabilitiesHandler(c *network.Client, msg network.WebSocketMessage) {
+	s.AckResponseSuccessWithData(c, msg, s.capabilities())
+}
+
+// capabilities will describe what the server supports from its handlers, config, and storage.
+func (s *WebSocketServer) capabilities() network.CapabilitiesResponse {
+	response := network.CapabilitiesResponse{
+		Actions:     make([]string, 0, len(s.handlers)),
+		Codecs:      []string{"json", "binary", "gzip", "msgpack"},
+		Compression: s.upgrader.EnableCompression,
+		Features:    network.CapabilityFeatures{AuthMode: "none", RequireRegisteredTopic: true},
+	}
+	for action := range s.handlers {
+		response.Actions = append(response.Actions, action)
+		if s.disabled[action] {
+			response.DisabledActions = append(response.DisabledActions, action)
+		}
+	}
+	sort.Strings(response.Actions)
+	sort.Strings(response.DisabledActions)
+
+	if s.config != nil {
+		if s.config.APIKey != "" || len(s.config.APIKeyPrefixes) > 0 {
+			response.Features.AuthMode = "apiKey"
+		}
+		response.Features.Admin = s.config.AdminAPIKey != ""
+		response.Features.RequireRegisteredTopic = s.config.RequireRegisteredTopic
+	}
+	response.Features.History = s.topicManager != nil && s.topicManager.StorageKeepsHistory()
+	response.Features.ReadOnly = s.readOnly.Load()
+	return response
+}
+
+// newTopicResponse will translate a topic into the response a client would want to know about it,
+// including the latest schema. Returns nil if there is no topic.
+func newTopicResponse(t *topic.Topic) *network.TopicResponse {
+	if t == nil {
+		return nil
+	}
+
+	// get latest schema from topic
+	var schemaResponse network.TopicSchemaResponse
+	if schema, err := t.GetLatestSchema(); err != nil {
+		log.Errorf("Error when getting schema for topic: %s when building topic response.", t.NameWithLock())
+	} else if schema != nil {
+		schemaResponse = network.TopicSchemaResponse{
+			Version: schema.Version,
+			Schema:  schema.Schema,
+			Hash:    schema.Hash,
+		}
+	}
+
+	hasValue, lastUpdated := t.LastUpdated()
+
+	return &network.TopicResponse{
+		Name:           t.NameWithLock(),
+		Schema:         schemaResponse,
+		ValidationMode: string(t.ValidationMode()),
+		HasValue:       hasValue,
+		LastUpdated:    lastUpdated,
+		Binary:         t.IsBinary(),
+		Format:         string(t.Format()),
+		Compressed:     t.IsCompressed(),
+		MaxPayloadSize: t.MaxPayloadSize(),
+		Aggregate:      t.AggregateFields(),
+	}
+}
+
+// updateSchemaHandler handles request from client to update the schema for a topic,
+// verifying parsed data, and errors from
+// topic manager perfroming actions, and sending response to client.
+func (s *WebSocketServer) updateSchemaHandler(c *network.Client, msg network.WebSocketMessage) {
+	if msg.ParsedData == nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data payload could not be parsed"))
+		return
+	}
+
+	err := s.topicManager.UpdateSchema(msg.Topic, msg.ParsedData)
+	if errors.Is(err, topic.ErrNestingTooDeep) {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+		return
+	}
+
+	s.AckResponseSuccess(c, msg)
+}
+
+// updateSchemaManyHandler handles a request to update the schemas of several topics at once. Each
+// topic is updated on its own, so a topic that can't be updated doesn't stop the others, and the
+// result for each one is sent back to the client.
+func (s *WebSocketServer) updateSchemaManyHandler(c *network.Client, msg network.WebSocketMessage) {
+	request, err := parseJSON[network.UpdateSchemaManyRequest](msg.Data)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data is not a list of schemas: %v", err))
+		return
+	}
+	if len(request.Schemas) == 0 {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("no schemas to update"))
+		return
+	}
+
+	seen := make(map[string]bool, len(request.Schemas))
+	for _, entry := range request.Schemas {
+		if strings.TrimSpace(entry.Topic) == "" {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("schema update has no topic"))
+			return
+		}
+		if seen[entry.Topic] {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("topic %s is in the update more than once", entry.Topic))
+			return
+		}
+		seen[entry.Topic] = true
+		if entry.Schema == nil {
+			s.AckResponseBadRequest(c, msg, fmt.Errorf("no schema for topic %s", entry.Topic))
+			return
+		}
+	}
+
+	response := network.UpdateSchemaManyResponse{Results: make([]network.SchemaUpdateResult, 0, len(request.Schemas))}
+	for _, entry := range request.Schemas {
+		result := network.SchemaUpdateResult{Topic: entry.Topic}
+		topicName := c.ScopeTopic(entry.Topic)
+		if err := s.topicManager.UpdateSchema(topicName, entry.Schema); err != nil {
+			log.WithFields(log.Fields{"client_id": c.Id, "topic": topicName}).Warnf("Couldn't update schema in bulk update: %v", err)
+			result.Error = err.Error()
+			response.Failed++
+		} else {
+			result.Updated = true
+			result.SchemaVersion, _ = s.topicManager.TopicSchemaVersion(topicName)
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	s.AckResponseSuccessWithData(c, msg, response)
+}
+
+// validateSchemaHandler handles a request to check a candidate schema for a topic, and a sample
+// payload against it, without updating the topic's schema.
+func (s *WebSocketServer) validateSchemaHandler(c *network.Client, msg network.WebSocketMessage) {
+	request, err := parseJSON[network.ValidateSchemaRequest](msg.Data)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data is not a schema to validate: %v", err))
+		return
+	}
+	if request.Schema == nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("no schema provided to validate"))
+		return
+	}
+
+	check, err := s.topicManager.ValidateSchema(msg.Topic, request.Schema, request.Sample)
+	if errors.Is(err, topic.ErrNestingTooDeep) {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+		return
+	}
+
+	s.AckResponseSuccessWithData(c, msg, network.ValidateSchemaResponse{
+		Compatible:   check.Compatible,
+		Differences:  check.Differences,
+		SampleValid:  check.SampleValid,
+		SampleErrors: check.SampleErrors,
+	})
+}
+
+// migrateSchemaHandler handles a request to give a topic a new schema and transform its stored
+// value to match it in one step. Nothing is changed if the value can't be migrated.
+func (s *WebSocketServer) migrateSchemaHandler(c *network.Client, msg network.WebSocketMessage) {
+	request, err := parseJSON[network.MigrateSchemaRequest](msg.Data)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data is not a schema migration: %v", err))
+		return
+	}
+	if request.Schema == nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("no schema provided to migrate to"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
+	defer cancel()
+
+	migration := topic.SchemaMigration{
+		Rename: request.Transform.Rename,
+		Drop:   request.Transform.Drop,
+		Set:    request.Transform.Set,
+	}
+	result, err := s.topicManager.MigrateSchema(ctx, msg.Topic, request.Schema, migration)
+	if errors.Is(err, topic.ErrMigrationFailed) || errors.Is(err, topic.ErrNestingTooDeep) {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	} else if err != nil {
+		s.AckResponseError(c, msg, err)
+		return
+	}
+
+	s.AckResponseSuccessWithData(c, msg, network.MigrateSchemaResponse{
+		SchemaVersion: result.SchemaVersion,
+		Migrated:      result.Migrated,
+		Value:         result.Value,
+	})
+}
+
+// sendWithoutSaveHandler handles request from client to publish a message without persisting it to
+// database, handles verifying parsed data, error from topic manager, and sending response to client.
+func (s *WebSocketServer) sendWithoutSaveHandler(c *network.Client, msg network.WebSocketMessage) {
+	if msg.ParsedData == nil {
+		s.AckResponseBadRequest(c, msg, fmt.Errorf("data payload could not be parsed"))
+		return
+	}
+	if err := checkTtl(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if err := checkPriority(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if err := checkHeaders(msg); err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+	if !s.ensureTopic(c, msg, msg.ParsedData) {
+		return
+	}
+
+	// fill in defaults first so the filled value is what gets validated
+	value, err := s.topicManager.ApplyDefaults(msg.Topic, msg.ParsedData)
+	if err != nil {
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+
+	// validate the payload against the current schema for this topic
+	warnings, err := s.topicManager.ValidatePayload(msg.Topic, value)
+	if err != nil { // if we get an error, just blame it on client for now.
+		s.AckResponseBadRequest(c, msg, err)
+		return
+	}
+
+	if msg.Options != nil && msg.Options.DeliveryReport && msg.Result == nil { // the counts are recorded on the result
+		msg.Result = &network.RequestResult{}
+	}
+	ctx, cancel := context.WithTimeout(msg.Context(), 2*time.Second)
+
+	// Making error channel for database to async give errors about persistence
+	// back to handler to communicate that with the client.
+	errCh := make(chan error, 1)
+
+	err = s.topicManager.Publish(ctx, msg, c, value, errCh)
+	if err == nil || errors.Is(err, topic.ErrPublishCoalesced) {
+		if err != nil {
+			warnings = append(warnings, coalescedWarning)
+		}
+		s.ackPublished(c, msg, warnings)
+		go s.awaitPersisted(ctx, cancel, c, msg, errCh)
+		return
+	}
+	cancel()
+	if errors.Is(err, topic.ErrPayloadTooLarge) {
+		s.AckResponsePayloadTooLarge(c, msg, err)
+	} else if errors.Is(err, topic.ErrTooFrequent) {
+		s.AckResponseTooManyRequests(c, msg, err)
+	} else {
+		s.AckResponseError(c, msg, err)
+	}
+}
+
 /*
 	/* FUTURE HANDLERS
 	"publishMany": s.TopicManager.SetManyTopics(),
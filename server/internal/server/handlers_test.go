@@ -1,35 +1,111 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/logging"
 	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/network/networktest"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
 	"github.com/atyalexyoung/data-loom/server/internal/topic"
 )
 
 // ----------------------------------------------------------------------- mock topic manager
 
 type mockTopicManager struct {
-	IsMethodCalled bool
-	ErrorResult    error
-	ClientsResult  []*network.Client
-	ClientResult   *network.Client
-	BytesResult    []byte
-	TopicResult    *topic.Topic
-	TopicsResult   []*topic.Topic
-	BoolResult     bool
-	MapResult      map[string]any
+	IsMethodCalled      bool
+	ErrorResult         error
+	ClientsResult       []*network.Client
+	ClientResult        *network.Client
+	BytesResult         []byte
+	TopicResult         *topic.Topic
+	TopicsResult        []*topic.Topic
+	BoolResult          bool
+	MapResult           any
+	WarningsResult      []string
+	ValidationResult    error
+	SubscribeOptions    topic.SubscriptionOptions
+	TopicOptions        topic.TopicOptions
+	DefaultsResult      any
+	PublishedValue      any
+	NamesResult         []string
+	ValuesResult        map[string]any
+	DefinitionsResult   []topic.TopicDefinition
+	AtResult            time.Time
+	StatsResult         topic.ManagerStats
+	RecentResult        []any
+	CountResult         int
+	TransactionValues   []topic.TopicValue
+	SchemaCheckResult   topic.SchemaCheck
+	AutoRegistered      bool
+	AutoRegisterSchema  any
+	TopicMissing        bool
+	DeliveryResult      network.DeliveryStats
+	StorageResult       storage.Stats
+	QueueResult         storage.QueueStats
+	HistoryResult       bool
+	LockResult          []logging.LockStats
+	PreviewResult       topic.UnregisterPreview
+	AckedSeq            uint64
+	SubsResult          map[string]topic.SubscriptionOptions
+	MetaResult          topic.ValueMeta
+	Precondition        topic.Precondition
+	Migration           topic.SchemaMigration
+	MigrationResult     topic.MigrationResult
+	ReplayResult        topic.ReplayResult
+	DefaultSchemaResult any
 }
 
-func (tm *mockTopicManager) Subscribe(topicName string, client *network.Client) error {
+func (tm *mockTopicManager) Subscribe(topicName string, client *network.Client, opts topic.SubscriptionOptions) error {
 	tm.IsMethodCalled = true
+	tm.SubscribeOptions = opts
 	return tm.ErrorResult
 }
 
+func (tm *mockTopicManager) Pause(topicName string, client *network.Client, keepLatest bool) error {
+	tm.IsMethodCalled = true
+	tm.BoolResult = keepLatest
+	return tm.ErrorResult
+}
+
+func (tm *mockTopicManager) Resume(topicName string, client *network.Client) error {
+	tm.IsMethodCalled = true
+	return tm.ErrorResult
+}
+
+func (tm *mockTopicManager) Ack(topicName string, client *network.Client, seq uint64) error {
+	tm.IsMethodCalled = true
+	tm.AckedSeq = seq
+	return tm.ErrorResult
+}
+
+func (tm *mockTopicManager) SubscribeFrom(topicName string, client *network.Client, opts topic.SubscriptionOptions, seq uint64, ack func(topic.ReplayResult)) error {
+	tm.IsMethodCalled = true
+	tm.SubscribeOptions = opts
+	tm.AckedSeq = seq
+	if tm.ErrorResult != nil {
+		return tm.ErrorResult
+	}
+	ack(tm.ReplayResult)
+	return nil
+}
+
+func (tm *mockTopicManager) Subscriptions(client *network.Client) map[string]topic.SubscriptionOptions {
+	return tm.SubsResult
+}
+
 func (tm *mockTopicManager) Unsubscribe(topicName string, client *network.Client) error {
 	tm.IsMethodCalled = true
 	return tm.ErrorResult
@@ -45,49 +121,209 @@ func (tm *mockTopicManager) UnsubscribeAll(client *network.Client) {
 	tm.IsMethodCalled = true
 }
 
-func (tm *mockTopicManager) Publish(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value map[string]any, errCh chan error) error {
+func (tm *mockTopicManager) UnsubscribePattern(client *network.Client, pattern string) ([]string, error) {
+	tm.IsMethodCalled = true
+	return tm.NamesResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) Publish(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, errCh chan error) error {
+	tm.IsMethodCalled = true
+	tm.PublishedValue = value
+	msg.Result.AddDelivery(tm.DeliveryResult)
+	if errCh != nil { // nothing is persisted, so there are no errors to report
+		close(errCh)
+	}
+	return tm.ErrorResult
+}
+
+func (tm *mockTopicManager) PublishIf(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, condition topic.Precondition, errCh chan error) (topic.ValueMeta, error) {
+	tm.IsMethodCalled = true
+	tm.PublishedValue = value
+	tm.Precondition = condition
+	if errCh != nil {
+		close(errCh)
+	}
+	return tm.MetaResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) SendWithoutSave(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, errCh chan error) error {
 	tm.IsMethodCalled = true
+	if errCh != nil {
+		close(errCh)
+	}
 	return tm.ErrorResult
 }
 
-func (tm *mockTopicManager) SendWithoutSave(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value map[string]any, errCh chan error) error {
+func (tm *mockTopicManager) PublishTransaction(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, values []topic.TopicValue) error {
 	tm.IsMethodCalled = true
+	tm.TransactionValues = values
+	msg.Result.AddDelivery(tm.DeliveryResult)
+	msg.Result.AddDelivery(tm.DeliveryResult) // as if every value was delivered to its own topic
 	return tm.ErrorResult
 }
 
-func (tm *mockTopicManager) Get(ctx context.Context, topicName string) (map[string]any, error) {
+func (tm *mockTopicManager) Get(ctx context.Context, topicName string) (any, error) {
+	tm.IsMethodCalled = true
+	return tm.MapResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) GetWithMeta(ctx context.Context, topicName string, at time.Time) (topic.ValueMeta, error) {
+	tm.IsMethodCalled = true
+	tm.AtResult = at
+	return tm.MetaResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) GetAt(ctx context.Context, topicName string, at time.Time) (any, error) {
 	tm.IsMethodCalled = true
+	tm.AtResult = at
 	return tm.MapResult, tm.ErrorResult
 }
 
-func (tm *mockTopicManager) RegisterTopic(topicName string, schema map[string]any) (*topic.Topic, error) {
+func (tm *mockTopicManager) GetRecent(ctx context.Context, topicName string, n int) ([]any, error) {
+	tm.IsMethodCalled = true
+	tm.CountResult = n
+	return tm.RecentResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) GetMany(ctx context.Context, topicNames []string) (map[string]any, error) {
+	tm.IsMethodCalled = true
+	return tm.ValuesResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) MatchTopics(pattern string) ([]string, error) {
+	tm.IsMethodCalled = true
+	return tm.NamesResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) ExportSchemas() []topic.TopicDefinition {
+	tm.IsMethodCalled = true
+	return tm.DefinitionsResult
+}
+
+func (tm *mockTopicManager) ImportSchemas(definitions []topic.TopicDefinition) (topic.ImportResult, error) {
+	tm.IsMethodCalled = true
+	tm.DefinitionsResult = definitions
+	return topic.ImportResult{TopicsCreated: len(definitions)}, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) RegisterTopic(topicName string, schema any, opts topic.TopicOptions) (*topic.Topic, error) {
 	tm.IsMethodCalled = true
+	tm.TopicOptions = opts
 	return tm.TopicResult, tm.ErrorResult
 }
 
+func (tm *mockTopicManager) RegisterTopicIfMissing(topicName string, schema any, opts topic.TopicOptions) (bool, error) {
+	tm.AutoRegistered = true
+	tm.AutoRegisterSchema = schema
+	tm.TopicOptions = opts
+	return tm.BoolResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) HasTopic(topicName string) bool {
+	return !tm.TopicMissing
+}
+
+func (tm *mockTopicManager) SubscribeAndGet(ctx context.Context, topicName string, client *network.Client, opts topic.SubscriptionOptions, snapshot func(topic.ValueMeta)) error {
+	tm.IsMethodCalled = true
+	tm.SubscribeOptions = opts
+	if tm.ErrorResult != nil {
+		return tm.ErrorResult
+	}
+	snapshot(tm.MetaResult)
+	return nil
+}
+
+func (tm *mockTopicManager) DefaultSchema(topicName string) (any, bool) {
+	return tm.DefaultSchemaResult, tm.DefaultSchemaResult != nil
+}
+
+func (tm *mockTopicManager) TopicSchemaVersion(topicName string) (int, bool) {
+	tm.IsMethodCalled = true
+	return tm.CountResult, !tm.TopicMissing
+}
+
 func (tm *mockTopicManager) UnregisterTopic(ctx context.Context, topicName string) error {
 	tm.IsMethodCalled = true
 	return tm.ErrorResult
 }
 
+func (tm *mockTopicManager) RenameTopic(ctx context.Context, topicName string, newName string) error {
+	tm.IsMethodCalled = true
+	return tm.ErrorResult
+}
+
 func (tm *mockTopicManager) ListTopics() ([]*topic.Topic, error) {
 	tm.IsMethodCalled = true
 	return tm.TopicsResult, tm.ErrorResult
 }
 
-func (tm *mockTopicManager) UpdateSchema(topicName string, schema map[string]any) error {
+func (tm *mockTopicManager) UpdateSchema(topicName string, schema any) error {
 	tm.IsMethodCalled = true
 	return tm.ErrorResult
 }
 
+func (tm *mockTopicManager) MigrateSchema(ctx context.Context, topicName string, schema any, migration topic.SchemaMigration) (topic.MigrationResult, error) {
+	tm.IsMethodCalled = true
+	tm.Migration = migration
+	return tm.MigrationResult, tm.ErrorResult
+}
+
 func (tm *mockTopicManager) NextFailedClient() (*network.Client, bool) {
 	return tm.ClientResult, tm.BoolResult
 }
 
-func (tm *mockTopicManager) IsSchemaMatch(topicName string, schema map[string]any) (bool, error) {
+func (tm *mockTopicManager) IsSchemaMatch(topicName string, schema any) (bool, error) {
 	return tm.BoolResult, tm.ErrorResult
 }
 
+func (tm *mockTopicManager) ValidateSchema(topicName string, schema any, sample any) (topic.SchemaCheck, error) {
+	tm.IsMethodCalled = true
+	return tm.SchemaCheckResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) ValidatePayload(topicName string, payload any) ([]string, error) {
+	return tm.WarningsResult, tm.ValidationResult
+}
+
+func (tm *mockTopicManager) ApplyDefaults(topicName string, payload any) (any, error) {
+	if tm.DefaultsResult != nil {
+		return tm.DefaultsResult, nil
+	}
+	return payload, nil
+}
+
+func (tm *mockTopicManager) Stats() topic.ManagerStats {
+	tm.IsMethodCalled = true
+	return tm.StatsResult
+}
+
+func (tm *mockTopicManager) StartIdleExpiry(ctx context.Context) {}
+
+func (tm *mockTopicManager) Close() {}
+
+func (tm *mockTopicManager) PreviewUnregisterTopic(ctx context.Context, topicName string) (topic.UnregisterPreview, error) {
+	tm.IsMethodCalled = true
+	return tm.PreviewResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) StorageStats(ctx context.Context) (storage.Stats, error) {
+	tm.IsMethodCalled = true
+	return tm.StorageResult, tm.ErrorResult
+}
+
+func (tm *mockTopicManager) StorageQueueStats() storage.QueueStats {
+	return tm.QueueResult
+}
+
+func (tm *mockTopicManager) StorageKeepsHistory() bool {
+	return tm.HistoryResult
+}
+
+func (tm *mockTopicManager) LockStats() []logging.LockStats {
+	tm.IsMethodCalled = true
+	return tm.LockResult
+}
+
 //------------------------------------------------------------------------------ test server
 
 type testServer struct {
@@ -188,6 +424,127 @@ func TestSubscribeHandlerFailFromTopicManager(t *testing.T) {
 	}
 }
 
+func TestSubscribeHandlerEchoToSenderOption(t *testing.T) {
+	echoOff := false
+	tests := []struct {
+		name    string
+		options *network.MessageOptions
+		noEcho  bool
+	}{
+		{name: "no options", options: nil, noEcho: false},
+		{name: "echo not set", options: &network.MessageOptions{Conflate: true}, noEcho: false},
+		{name: "echo off", options: &network.MessageOptions{EchoToSender: &echoOff}, noEcho: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &mockTopicManager{}
+			s, c := SetupStuff(m)
+
+			msg := subscribeWithAck
+			msg.Options = tt.options
+			s.subscribeHandler(c, msg)
+
+			if m.SubscribeOptions.NoEcho != tt.noEcho {
+				t.Errorf("expected NoEcho to be %v, got %v", tt.noEcho, m.SubscribeOptions.NoEcho)
+			}
+		})
+	}
+}
+
+func TestSubscribeHandlerFailFromSubscriptionLimit(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("%w: client is subscribed to 2 topics, the max is 2", topic.ErrSubscriptionLimit),
+	}
+	s, c := SetupStuff(m)
+
+	s.subscribeHandler(c, subscribeWithoutAck)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message sent to client.")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusTooManyRequests {
+		t.Error("expected status too many requests.")
+	}
+}
+
+//------------------------------------------------------------- subscribeAndGet handler tests
+
+var subscribeAndGetMsg = network.WebSocketMessage{
+	MessageId: "subscribeAndGet",
+	Action:    "subscribeAndGet",
+	Topic:     "testTopic",
+}
+
+func TestSubscribeAndGetHandlerSuccess(t *testing.T) {
+	m := &mockTopicManager{MetaResult: topic.ValueMeta{Value: map[string]any{"message": "hi"}, Latest: true}}
+	s, c := SetupStuff(m)
+
+	msg := subscribeAndGetMsg
+	msg.Options = &network.MessageOptions{Conflate: true}
+	s.subscribeAndGetHandler(c, msg)
+
+	if !m.SubscribeOptions.Conflate {
+		t.Error("expected the subscription options to be passed to the topic manager")
+	}
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	if data, ok := resp.Data.(map[string]any); !ok || data["message"] != "hi" {
+		t.Errorf("expected the current value as the data, got %+v", resp.Data)
+	}
+}
+
+func TestSubscribeAndGetHandlerWithMeta(t *testing.T) {
+	version := 2
+	m := &mockTopicManager{MetaResult: topic.ValueMeta{Value: "hi", SchemaVersion: &version, Latest: true}}
+	s, c := SetupStuff(m)
+
+	msg := subscribeAndGetMsg
+	msg.Options = &network.MessageOptions{Meta: true}
+	s.subscribeAndGetHandler(c, msg)
+
+	resp := s.sent[0].(network.Response)
+	if data, ok := resp.Data.(network.ValueWithMeta); !ok || data.Value != "hi" || data.SchemaVersion == nil || *data.SchemaVersion != 2 || data.Topic != "testTopic" {
+		t.Errorf("expected the value in the meta envelope, got %+v", resp.Data)
+	}
+}
+
+func TestSubscribeAndGetHandlerFailFromSubscriptionLimit(t *testing.T) {
+	m := &mockTopicManager{ErrorResult: fmt.Errorf("%w: client is subscribed to 2 topics, the max is 2", topic.ErrSubscriptionLimit)}
+	s, c := SetupStuff(m)
+
+	s.subscribeAndGetHandler(c, subscribeAndGetMsg)
+
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status too many requests, got %+v", s.sent[0])
+	}
+}
+
+func TestSubscribeAndGetHandlerFailFromBadOptions(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+
+	msg := subscribeAndGetMsg
+	msg.Options = &network.MessageOptions{Conflate: true, AckWindow: 5}
+	s.subscribeAndGetHandler(c, msg)
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to not be called but was.")
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Errorf("expected status bad request, got %+v", s.sent[0])
+	}
+}
+
 //------------------------------------------------------------------ unsubscribe handler tests
 
 var unsubscribeWithAck = network.WebSocketMessage{
@@ -264,347 +621,284 @@ func TestUnsubscribeHandlerFailFromTopicManager(t *testing.T) {
 	}
 }
 
-//------------------------------------------------------------------- publish handler tests
-
-var publishSuccessWithAck = network.WebSocketMessage{
-	MessageId:  "publishWithAck",
-	Action:     "publish",
-	Topic:      "testTopic",
-	Data:       json.RawMessage(`{"message":"hello world"}`),
-	ParsedData: map[string]any{"message": "hello world"},
+var unsubscribeAllPatternMsg = network.WebSocketMessage{
+	MessageId:  "unsubscribeAllPattern",
+	Action:     "unsubscribeAllPattern",
+	Topic:      "sensors/*",
 	RequireAck: true,
 }
 
-var publishSuccessWithoutAck = network.WebSocketMessage{
-	MessageId:  "publishWithoutAck",
-	Action:     "publish",
-	Topic:      "testTopic",
-	Data:       json.RawMessage(`{"message":"hello world"}`),
-	ParsedData: map[string]any{"message": "hello world"},
-	RequireAck: false,
-}
-
-var publishFailFromTopicManager = network.WebSocketMessage{
-	MessageId:  "publishWithoutAck",
-	Action:     "publish",
-	Topic:      "testTopic",
-	Data:       json.RawMessage(`{"message":"hello world"}`),
-	ParsedData: map[string]any{"message": "hello world"},
-	RequireAck: false,
-}
-
-var publishFailFromNoDataSupplied = network.WebSocketMessage{
-	MessageId: "publishWithoutAck",
-	Action:    "publish",
-	Topic:     "testTopic",
-	Data:      json.RawMessage(`{"message":"hello world"}`),
-	//ParsedData: none
-	RequireAck: false,
-}
-
-func TestPublishSuccessWithAck(t *testing.T) {
+func TestUnsubscribeAllPatternHandlerSuccess(t *testing.T) {
 	m := &mockTopicManager{
-		ErrorResult: nil,
-	}
-	s := testServer{
-		WebSocketServer: &WebSocketServer{
-			topicManager: m,
-		},
+		NamesResult: []string{"sensors/humidity", "sensors/temp"},
 	}
-	s.WebSocketServer.sender = &s
+	s, c := SetupStuff(m)
 
-	client := &network.Client{}
-	s.publishHandler(client, publishSuccessWithAck)
+	s.unsubscribeAllPatternHandler(c, unsubscribeAllPatternMsg)
 
-	if !m.IsMethodCalled {
-		t.Error("expected topic manager method to be called but wasn't.")
-	}
 	if len(s.sent) != 1 {
 		t.Fatal("expected 1 message")
 	}
 	resp, ok := s.sent[0].(network.Response)
 	if !ok || resp.Code != http.StatusOK {
-		t.Error("expected status 200")
+		t.Fatal("expected status ok")
+	}
+	removed, ok := resp.Data.([]string)
+	if !ok || len(removed) != 2 || removed[1] != "sensors/temp" {
+		t.Errorf("expected the removed topics, got: %v", resp.Data)
 	}
 }
 
-func TestPublishSuccessWithoutAck(t *testing.T) {
+func TestUnsubscribeAllPatternHandlerFailFromBadPattern(t *testing.T) {
 	m := &mockTopicManager{
-		ErrorResult: nil,
-	}
-	s := testServer{
-		WebSocketServer: &WebSocketServer{
-			topicManager: m,
-		},
+		ErrorResult: fmt.Errorf("invalid topic pattern"),
 	}
-	s.WebSocketServer.sender = &s
+	s, c := SetupStuff(m)
 
-	client := &network.Client{}
-	s.publishHandler(client, publishSuccessWithoutAck)
+	s.unsubscribeAllPatternHandler(c, unsubscribeAllPatternMsg)
 
-	if !m.IsMethodCalled {
-		t.Error("expected topic manager method to be called but wasn't.")
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
 	}
-	if len(s.sent) != 0 {
-		t.Fatal("expected no message")
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
 	}
 }
 
-func TestPublishFailFromTopicManager(t *testing.T) {
-	m := &mockTopicManager{
-		ErrorResult: fmt.Errorf("error from topic manager"),
-	}
-	s := testServer{
-		WebSocketServer: &WebSocketServer{
-			topicManager: m,
-		},
-	}
-	s.WebSocketServer.sender = &s
+//------------------------------------------------------------------ pause and resume handler tests
 
-	client := &network.Client{}
-	s.publishHandler(client, publishFailFromTopicManager)
+func TestPauseHandlerPassesKeepLatest(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
 
-	if !m.IsMethodCalled {
-		t.Error("expected topic manager method to be called but wasn't.")
+	msg := network.WebSocketMessage{MessageId: "pause", Action: "pause", Topic: "testTopic", RequireAck: true, Options: &network.MessageOptions{KeepLatest: true}}
+	s.pauseHandler(client, msg)
+
+	if !m.IsMethodCalled || !m.BoolResult {
+		t.Error("expected pause to be called with keepLatest")
 	}
 	if len(s.sent) != 1 {
 		t.Fatal("expected 1 message")
 	}
-	resp, ok := s.sent[0].(network.Response)
-	if !ok || resp.Code != http.StatusInternalServerError {
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
 		t.Error("expected status 200")
 	}
 }
 
-func TestPublishFailFromNoParsedData(t *testing.T) {
-	m := &mockTopicManager{
-		ErrorResult: fmt.Errorf("error from topic manager"),
-	}
-	s := testServer{
-		WebSocketServer: &WebSocketServer{
-			topicManager: m,
-		},
+func TestPauseAndResumeNotSubscribedIsBadRequest(t *testing.T) {
+	handlers := map[string]func(s *testServer, c *network.Client, msg network.WebSocketMessage){
+		"pause":  func(s *testServer, c *network.Client, msg network.WebSocketMessage) { s.pauseHandler(c, msg) },
+		"resume": func(s *testServer, c *network.Client, msg network.WebSocketMessage) { s.resumeHandler(c, msg) },
 	}
-	s.WebSocketServer.sender = &s
+	for action, handle := range handlers {
+		t.Run(action, func(t *testing.T) {
+			m := &mockTopicManager{ErrorResult: fmt.Errorf("%w. topic: testTopic", topic.ErrNotSubscribed)}
+			s, client := SetupStuff(m)
+			handle(s, client, network.WebSocketMessage{MessageId: action, Action: action, Topic: "testTopic"})
 
-	client := &network.Client{}
-	s.publishHandler(client, publishFailFromNoDataSupplied)
-
-	if m.IsMethodCalled {
-		t.Error("expected topic manager method to be called but wasn't.")
+			if len(s.sent) != 1 {
+				t.Fatal("expected 1 message")
+			}
+			if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %+v", s.sent[0])
+			}
+		})
 	}
+}
+
+func TestResumeHandlerError(t *testing.T) {
+	m := &mockTopicManager{ErrorResult: fmt.Errorf("topic doesn't exist")}
+	s, client := SetupStuff(m)
+	s.resumeHandler(client, network.WebSocketMessage{MessageId: "resume", Action: "resume", Topic: "missing"})
+
 	if len(s.sent) != 1 {
 		t.Fatal("expected 1 message")
 	}
-	resp, ok := s.sent[0].(network.Response)
-	if !ok || resp.Code != http.StatusBadRequest {
-		t.Error("expected status 200")
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusInternalServerError {
+		t.Error("expected status internal server error")
 	}
 }
 
-//----------------------------------------------------------------------- get handler tests
-
-//------------------------------------------------------------------- register handler tests
-
-var registerTopicSuccesssMsg = network.WebSocketMessage{
-	MessageId:  "registerTopicWithAck",
-	Action:     "registerTopic",
-	Topic:      "testTopic",
-	Data:       json.RawMessage(`{"info":"example"}`),
-	ParsedData: map[string]any{"message": "hello world"},
-	RequireAck: true,
-}
-
-var registerTopicFailNoParsedData = network.WebSocketMessage{
-	MessageId: "registerTopicBadJSON",
-	Action:    "registerTopic",
-	Topic:     "testTopic",
-	Data:      json.RawMessage(`{"invalid":}`),
-	// ParsedData: none
-	RequireAck: true,
-}
+//------------------------------------------------------------------------ ack window tests
 
-func TestRegisterTopicHandlerSuccess(t *testing.T) {
-	m := &mockTopicManager{
-		ErrorResult: nil,
-	}
-	s := testServer{
-		WebSocketServer: &WebSocketServer{
-			topicManager: m,
-		},
-	}
-	s.WebSocketServer.sender = &s
+func TestSubscribeHandlerPassesAckWindow(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
 
-	client := &network.Client{}
-	s.registerTopicHandler(client, registerTopicSuccesssMsg)
+	msg := network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "testTopic", RequireAck: true, Options: &network.MessageOptions{AckWindow: 5}}
+	s.subscribeHandler(client, msg)
 
-	if !m.IsMethodCalled {
-		t.Error("expected topic manager method to be called but wasn't.")
+	if !m.IsMethodCalled || m.SubscribeOptions.AckWindow != 5 {
+		t.Errorf("expected subscribe to be called with an ack window of 5, got %+v", m.SubscribeOptions)
 	}
 	if len(s.sent) != 1 {
 		t.Fatal("expected 1 message")
 	}
-	resp, ok := s.sent[0].(network.Response)
-	if !ok || resp.Code != http.StatusOK {
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
 		t.Error("expected status 200")
 	}
 }
 
-func TestRegisterHandlerFailFromTopicManager(t *testing.T) {
-	m := &mockTopicManager{
-		ErrorResult: fmt.Errorf("error from topic manager"),
-	}
-	s := testServer{
-		WebSocketServer: &WebSocketServer{
-			topicManager: m,
-		},
-	}
-	s.WebSocketServer.sender = &s
-	client := &network.Client{}
+func TestSubscribeHandlerResumeFrom(t *testing.T) {
+	m := &mockTopicManager{ReplayResult: topic.ReplayResult{Replayed: 2, Gap: true, OldestSeq: 4, LatestSeq: 5}}
+	s, client := SetupStuff(m)
 
-	s.registerTopicHandler(client, registerTopicSuccesssMsg)
+	resumeFrom := uint64(1)
+	msg := network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "testTopic", RequireAck: true, Options: &network.MessageOptions{ResumeFrom: &resumeFrom}}
+	s.subscribeHandler(client, msg)
 
-	if !m.IsMethodCalled {
-		t.Error("expected topic manager method to be called but wasn't.")
+	if !m.IsMethodCalled || m.AckedSeq != 1 {
+		t.Errorf("expected subscribe to resume from seq 1, got %d", m.AckedSeq)
 	}
 	if len(s.sent) != 1 {
 		t.Fatal("expected 1 message")
 	}
 	resp, ok := s.sent[0].(network.Response)
-	if !ok || resp.Code != http.StatusInternalServerError {
-		t.Error("expected status internal server error.")
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %+v", s.sent[0])
 	}
-}
-
-func TestRegisterHandlerFailFromNoData(t *testing.T) {
-	m := &mockTopicManager{
-		ErrorResult: fmt.Errorf("error from topic manager"),
+	want := network.ResumeResponse{Replayed: 2, Gap: true, OldestSeq: 4, LatestSeq: 5}
+	if resp.Data != want {
+		t.Errorf("expected %+v, got %+v", want, resp.Data)
 	}
+}
 
+func TestSubscribeHandlerResumeFromWithoutHistory(t *testing.T) {
+	m := &mockTopicManager{ErrorResult: fmt.Errorf("%w: testTopic", topic.ErrNoReplayHistory)}
 	s, client := SetupStuff(m)
 
-	s.registerTopicHandler(client, registerTopicFailNoParsedData)
+	resumeFrom := uint64(1)
+	s.subscribeHandler(client, network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "testTopic", Options: &network.MessageOptions{ResumeFrom: &resumeFrom}})
 
-	if m.IsMethodCalled {
-		t.Error("expected topic manager method to not be called but was.")
-	}
 	if len(s.sent) != 1 {
 		t.Fatal("expected 1 message")
 	}
-	resp, ok := s.sent[0].(network.Response)
-	if !ok || resp.Code != http.StatusBadRequest {
-		t.Error("expected status internal server error.")
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %+v", s.sent[0])
 	}
 }
 
-//------------------------------------------------------------------ unregister handler tests
-
-var unregisterWithAck = network.WebSocketMessage{
-	MessageId:  "unsubscribeWithAck",
-	Action:     "unsubscribe",
-	Topic:      "testTopic",
-	Data:       json.RawMessage(`{}`),
-	RequireAck: true,
-}
+func TestSubscribeHandlerInvalidAckWindow(t *testing.T) {
+	cases := map[string]network.MessageOptions{
+		"negative":  {AckWindow: -1},
+		"too big":   {AckWindow: MAX_ACK_WINDOW + 1},
+		"conflated": {AckWindow: 5, Conflate: true},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &mockTopicManager{}
+			s, client := SetupStuff(m)
+			s.subscribeHandler(client, network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "testTopic", Options: &opts})
 
-var unregisterWithoutAck = network.WebSocketMessage{
-	MessageId:  "unsubscribeWithoutAck",
-	Action:     "unsubscribe",
-	Topic:      "testTopic",
-	Data:       json.RawMessage(`{}`),
-	RequireAck: false,
+			if m.IsMethodCalled {
+				t.Error("expected subscribe not to be called")
+			}
+			if len(s.sent) != 1 {
+				t.Fatal("expected 1 message")
+			}
+			if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %+v", s.sent[0])
+			}
+		})
+	}
 }
 
-func TestUnregisterHandlerSuccessWithAck(t *testing.T) {
-	m := &mockTopicManager{
-		ErrorResult: nil,
-	}
-	s, c := SetupStuff(m)
+func TestAckHandlerPassesSeq(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
 
-	s.unregisterTopicHandler(c, unregisterWithAck)
+	msg := network.WebSocketMessage{MessageId: "ack", Action: "ack", Topic: "testTopic", RequireAck: true, Data: json.RawMessage(`{"seq":7}`)}
+	s.ackHandler(client, msg)
 
-	if !m.IsMethodCalled { // if method wasn't called, bad
-		t.Error("expected topic manager method to not be called but was.")
+	if !m.IsMethodCalled || m.AckedSeq != 7 {
+		t.Errorf("expected ack to be called with seq 7, got %d", m.AckedSeq)
 	}
-	fmt.Println(len(s.sent))
-	if len(s.sent) != 1 { // if nothing was sent, bad. We have ack
+	if len(s.sent) != 1 {
 		t.Fatal("expected 1 message")
 	}
-	resp, ok := s.sent[0].(network.Response)
-	if !ok || resp.Code != http.StatusOK { // if response wasn't ok, bad
-		t.Error("expected status internal server error.")
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Error("expected status 200")
 	}
 }
 
-func TestUnregisterHandlerSuccessWithoutAck(t *testing.T) {
-	m := &mockTopicManager{
-		ErrorResult: nil,
+func TestAckHandlerBadRequests(t *testing.T) {
+	cases := map[string]struct {
+		data json.RawMessage
+		err  error
+	}{
+		"not an ack":     {data: json.RawMessage(`"seven"`)},
+		"invalid ack":    {data: json.RawMessage(`{"seq":7}`), err: fmt.Errorf("%w: seq 7 hasn't been sent", topic.ErrInvalidAck)},
+		"not subscribed": {data: json.RawMessage(`{"seq":7}`), err: fmt.Errorf("%w. topic: testTopic", topic.ErrNotSubscribed)},
 	}
-	s, c := SetupStuff(m)
-
-	s.unsubscribeHandler(c, unregisterWithoutAck)
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			m := &mockTopicManager{ErrorResult: tc.err}
+			s, client := SetupStuff(m)
+			s.ackHandler(client, network.WebSocketMessage{MessageId: "ack", Action: "ack", Topic: "testTopic", Data: tc.data})
 
-	if !m.IsMethodCalled { // if method wasn't called, bad
-		t.Error("expected topic manager method to not be called but was.")
-	}
-	if len(s.sent) != 0 { // if nothing was sent, good. We have ack disabled
-		t.Fatal("expected no message with success and no ack")
-		// do nothing since this is expected
+			if len(s.sent) != 1 {
+				t.Fatal("expected 1 message")
+			}
+			if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %+v", s.sent[0])
+			}
+		})
 	}
 }
 
-func TestUnregisterHandlerFailFromTopicManager(t *testing.T) {
-	m := &mockTopicManager{
-		ErrorResult: fmt.Errorf("error from topic manager"),
-	}
-	s, c := SetupStuff(m)
-
-	s.unregisterTopicHandler(c, unregisterWithoutAck)
+func TestPauseWindowedSubscriptionIsBadRequest(t *testing.T) {
+	m := &mockTopicManager{ErrorResult: fmt.Errorf("%w. topic: testTopic", topic.ErrAckWindowed)}
+	s, client := SetupStuff(m)
+	s.pauseHandler(client, network.WebSocketMessage{MessageId: "pause", Action: "pause", Topic: "testTopic"})
 
-	if !m.IsMethodCalled { // if method wasn't called, bad
-		t.Error("expected topic manager method to not be called but was.")
-	}
-	if len(s.sent) != 1 { // if nothing was sent, bad. We have ack
-		t.Fatal("expected 1 message sent to client.")
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
 	}
-	resp, ok := s.sent[0].(network.Response)
-	if !ok || resp.Code != http.StatusInternalServerError {
-		t.Error("expected status internal server error.")
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %+v", s.sent[0])
 	}
 }
 
-//----------------------------------------------------------------- list topics handler tests
-
-//-------------------------------------------------------------- update schema  handler tests
+//------------------------------------------------------------------- publish handler tests
 
-var updateSchemaSuccessWithAck = network.WebSocketMessage{
-	MessageId:  "sendWithoutSaveSuccessWithAck",
-	Action:     "sendWithoutSave",
+var publishSuccessWithAck = network.WebSocketMessage{
+	MessageId:  "publishWithAck",
+	Action:     "publish",
 	Topic:      "testTopic",
 	Data:       json.RawMessage(`{"message":"hello world"}`),
 	ParsedData: map[string]any{"message": "hello world"},
 	RequireAck: true,
 }
 
-var updateSchemaSuccessWithoutAck = network.WebSocketMessage{
-	MessageId:  "sendWithoutSaveSuccessWithoutAck",
-	Action:     "sendWithoutSave",
+var publishSuccessWithoutAck = network.WebSocketMessage{
+	MessageId:  "publishWithoutAck",
+	Action:     "publish",
 	Topic:      "testTopic",
 	Data:       json.RawMessage(`{"message":"hello world"}`),
 	ParsedData: map[string]any{"message": "hello world"},
 	RequireAck: false,
 }
 
-var updateSchemaFailFromNoDataSupplied = network.WebSocketMessage{
-	MessageId: "sendWithoutSaveFailFromNoDataSupplied",
-	Action:    "sendWithoutSave",
+var publishFailFromTopicManager = network.WebSocketMessage{
+	MessageId:  "publishWithoutAck",
+	Action:     "publish",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{"message":"hello world"}`),
+	ParsedData: map[string]any{"message": "hello world"},
+	RequireAck: false,
+}
+
+var publishFailFromNoDataSupplied = network.WebSocketMessage{
+	MessageId: "publishWithoutAck",
+	Action:    "publish",
 	Topic:     "testTopic",
 	Data:      json.RawMessage(`{"message":"hello world"}`),
 	//ParsedData: none
 	RequireAck: false,
 }
 
-func TestUpdateSchemaSuccessWithAck(t *testing.T) {
+func TestPublishSuccessWithAck(t *testing.T) {
 	m := &mockTopicManager{
 		ErrorResult: nil,
 	}
@@ -616,7 +910,7 @@ func TestUpdateSchemaSuccessWithAck(t *testing.T) {
 	s.WebSocketServer.sender = &s
 
 	client := &network.Client{}
-	s.updateSchemaHandler(client, updateSchemaSuccessWithAck)
+	s.publishHandler(client, publishSuccessWithAck)
 
 	if !m.IsMethodCalled {
 		t.Error("expected topic manager method to be called but wasn't.")
@@ -630,7 +924,7 @@ func TestUpdateSchemaSuccessWithAck(t *testing.T) {
 	}
 }
 
-func TestUpdateSchemaSuccessWithoutAck(t *testing.T) {
+func TestPublishSuccessWithoutAck(t *testing.T) {
 	m := &mockTopicManager{
 		ErrorResult: nil,
 	}
@@ -642,7 +936,8 @@ func TestUpdateSchemaSuccessWithoutAck(t *testing.T) {
 	s.WebSocketServer.sender = &s
 
 	client := &network.Client{}
-	s.updateSchemaHandler(client, updateSchemaSuccessWithoutAck)
+	s.publishHandler(client, publishSuccessWithoutAck)
+
 	if !m.IsMethodCalled {
 		t.Error("expected topic manager method to be called but wasn't.")
 	}
@@ -651,7 +946,7 @@ func TestUpdateSchemaSuccessWithoutAck(t *testing.T) {
 	}
 }
 
-func TestUpdateSchemaFailFromTopicManager(t *testing.T) {
+func TestPublishFailFromTopicManager(t *testing.T) {
 	m := &mockTopicManager{
 		ErrorResult: fmt.Errorf("error from topic manager"),
 	}
@@ -663,7 +958,7 @@ func TestUpdateSchemaFailFromTopicManager(t *testing.T) {
 	s.WebSocketServer.sender = &s
 
 	client := &network.Client{}
-	s.updateSchemaHandler(client, updateSchemaSuccessWithAck)
+	s.publishHandler(client, publishFailFromTopicManager)
 
 	if !m.IsMethodCalled {
 		t.Error("expected topic manager method to be called but wasn't.")
@@ -677,7 +972,7 @@ func TestUpdateSchemaFailFromTopicManager(t *testing.T) {
 	}
 }
 
-func TestUpdateSchemaFailFromNoParsedData(t *testing.T) {
+func TestPublishFailFromNoParsedData(t *testing.T) {
 	m := &mockTopicManager{
 		ErrorResult: fmt.Errorf("error from topic manager"),
 	}
@@ -689,7 +984,7 @@ func TestUpdateSchemaFailFromNoParsedData(t *testing.T) {
 	s.WebSocketServer.sender = &s
 
 	client := &network.Client{}
-	s.updateSchemaHandler(client, updateSchemaFailFromNoDataSupplied)
+	s.publishHandler(client, publishFailFromNoDataSupplied)
 
 	if m.IsMethodCalled {
 		t.Error("expected topic manager method to be called but wasn't.")
@@ -703,48 +998,13 @@ func TestUpdateSchemaFailFromNoParsedData(t *testing.T) {
 	}
 }
 
-//----------------------------------------------------------- send without save handler tests
-
-var sendWithoutSaveSuccessWithAck = network.WebSocketMessage{
-	MessageId:  "sendWithoutSaveSuccessWithAck",
-	Action:     "sendWithoutSave",
-	Topic:      "testTopic",
-	Data:       json.RawMessage(`{"message":"hello world"}`),
-	ParsedData: map[string]any{"message": "hello world"},
-	RequireAck: true,
-}
-
-var sendWithoutSaveSuccessWithoutAck = network.WebSocketMessage{
-	MessageId:  "sendWithoutSaveSuccessWithoutAck",
-	Action:     "sendWithoutSave",
-	Topic:      "testTopic",
-	Data:       json.RawMessage(`{"message":"hello world"}`),
-	ParsedData: map[string]any{"message": "hello world"},
-	RequireAck: false,
-}
-
-var sendWithoutSaveFailFromNoDataSupplied = network.WebSocketMessage{
-	MessageId: "sendWithoutSaveFailFromNoDataSupplied",
-	Action:    "sendWithoutSave",
-	Topic:     "testTopic",
-	Data:      json.RawMessage(`{"message":"hello world"}`),
-	//ParsedData: none
-	RequireAck: false,
-}
-
-func TestSendWithoutSaveSuccessWithAck(t *testing.T) {
+func TestPublishWarningsIncludedInAck(t *testing.T) {
 	m := &mockTopicManager{
-		ErrorResult: nil,
-	}
-	s := testServer{
-		WebSocketServer: &WebSocketServer{
-			topicManager: m,
-		},
+		WarningsResult: []string{"missing field: message"},
 	}
-	s.WebSocketServer.sender = &s
+	s, client := SetupStuff(m)
 
-	client := &network.Client{}
-	s.sendWithoutSaveHandler(client, sendWithoutSaveSuccessWithAck)
+	s.publishHandler(client, publishSuccessWithAck)
 
 	if !m.IsMethodCalled {
 		t.Error("expected topic manager method to be called but wasn't.")
@@ -756,33 +1016,298 @@ func TestSendWithoutSaveSuccessWithAck(t *testing.T) {
 	if !ok || resp.Code != http.StatusOK {
 		t.Error("expected status 200")
 	}
+	if len(resp.Warnings) != 1 || resp.Warnings[0] != "missing field: message" {
+		t.Errorf("expected warnings in ack, got: %v", resp.Warnings)
+	}
 }
 
-func TestSendWithoutSaveSuccessWithoutAck(t *testing.T) {
+func TestPublishFailFromValidation(t *testing.T) {
 	m := &mockTopicManager{
-		ErrorResult: nil,
-	}
-	s := testServer{
-		WebSocketServer: &WebSocketServer{
-			topicManager: m,
-		},
+		ValidationResult: fmt.Errorf("schema doesn't match topics current schema"),
 	}
-	s.WebSocketServer.sender = &s
+	s, client := SetupStuff(m)
 
-	client := &network.Client{}
-	s.sendWithoutSaveHandler(client, sendWithoutSaveSuccessWithoutAck)
+	s.publishHandler(client, publishSuccessWithAck)
 
-	if !m.IsMethodCalled {
-		t.Error("expected topic manager method to be called but wasn't.")
+	if m.IsMethodCalled {
+		t.Error("expected topic manager publish to not be called but was.")
 	}
-	if len(s.sent) != 0 {
-		t.Fatal("expected no message")
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
 	}
 }
 
-func TestSendWithoutSaveFailFromTopicManager(t *testing.T) {
+func TestPublishFailFromTopicWithNoSchema(t *testing.T) {
 	m := &mockTopicManager{
-		ErrorResult: fmt.Errorf("error from topic manager"),
+		ValidationResult: fmt.Errorf("could not get schema for topic with name: testTopic: %w", topic.ErrTopicHasNoSchema),
+	}
+	s, client := SetupStuff(m)
+
+	s.publishHandler(client, publishSuccessWithAck)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Fatal("expected status bad request")
+	}
+	if resp.ErrorCode != "TOPIC_HAS_NO_SCHEMA" || resp.Message == "" {
+		t.Errorf("expected the no schema error code and a message, got %+v", resp)
+	}
+
+	// other errors don't get a code
+	m.ValidationResult = fmt.Errorf("schema doesn't match topics current schema")
+	s.publishHandler(client, publishSuccessWithAck)
+	if resp := s.sent[1].(network.Response); resp.ErrorCode != "" {
+		t.Errorf("expected no error code, got %s", resp.ErrorCode)
+	}
+}
+
+func TestPublishFailFromPayloadTooLarge(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("publish failed: %w: payload for topic testTopic is 26 bytes, the max is 10", topic.ErrPayloadTooLarge),
+	}
+	s, client := SetupStuff(m)
+
+	s.publishHandler(client, publishSuccessWithAck)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusRequestEntityTooLarge || resp.ErrorCode != "PAYLOAD_TOO_LARGE" {
+		t.Errorf("expected status request entity too large, got %+v", s.sent[0])
+	}
+}
+
+func TestPublishMaxPayloadSizeFromRegister(t *testing.T) {
+	s, c, _ := setupRealTopicManager()
+
+	register := registerTopicSuccesssMsg
+	register.ParsedData = map[string]any{"message": ""}
+	register.Options = &network.MessageOptions{MaxPayloadSize: 30}
+	s.registerTopicHandler(c, register)
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected register to succeed, got %+v", s.sent[0])
+	}
+	if data := s.sent[0].(network.Response).Data.(*network.TopicResponse); data.MaxPayloadSize != 30 {
+		t.Errorf("expected the max payload size in the topic response, got %d", data.MaxPayloadSize)
+	}
+
+	s.publishHandler(c, publishSuccessWithAck) // 25 bytes
+	if resp, ok := s.sent[1].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Errorf("expected a payload under the limit to be published, got %+v", s.sent[1])
+	}
+
+	tooLarge := publishSuccessWithAck
+	tooLarge.ParsedData = map[string]any{"message": "hello to the whole world"}
+	s.publishHandler(c, tooLarge)
+	if resp, ok := s.sent[2].(network.Response); !ok || resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a payload over the limit to fail, got %+v", s.sent[2])
+	}
+}
+
+func TestPublishTooFrequentFromMinPublishInterval(t *testing.T) {
+	s, c, _ := setupRealTopicManager()
+
+	register := registerTopicSuccesssMsg
+	register.ParsedData = map[string]any{"message": ""}
+	register.Options = &network.MessageOptions{MinPublishInterval: "1m"}
+	s.registerTopicHandler(c, register)
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected register to succeed, got %+v", s.sent[0])
+	}
+
+	s.publishHandler(c, publishSuccessWithAck)
+	if resp, ok := s.sent[1].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected the first publish to succeed, got %+v", s.sent[1])
+	}
+
+	s.publishHandler(c, publishSuccessWithAck)
+	resp, ok := s.sent[2].(network.Response)
+	if !ok || resp.Code != http.StatusTooManyRequests || resp.ErrorCode != "TOO_FREQUENT" {
+		t.Errorf("expected a publish within the interval to be too frequent, got %+v", s.sent[2])
+	}
+
+	time.Sleep(2500 * time.Millisecond) // longer than a publish waits to be persisted
+	if len(s.sent) != 3 {
+		t.Errorf("expected one response per request, got %d: %+v", len(s.sent), s.sent)
+	}
+}
+
+func TestPublishPersistsAfterHandlerReturns(t *testing.T) {
+	db := storage.NewSqliteStorage(storage.SqliteOptions{})
+	if err := db.Open(filepath.Join(t.TempDir(), "publish.db"), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	tm := topic.NewTopicManager(db, &config.Config{})
+	s := testServer{WebSocketServer: &WebSocketServer{topicManager: tm}}
+	s.WebSocketServer.sender = &s
+	c := network.NewClient(nil, "publisher")
+
+	register := registerTopicSuccesssMsg
+	register.ParsedData = map[string]any{"message": ""}
+	s.registerTopicHandler(c, register)
+	for i := range 10 {
+		publish := publishSuccessWithAck
+		publish.ParsedData = map[string]any{"message": fmt.Sprintf("hello %d", i)}
+		s.publishHandler(c, publish)
+	}
+
+	// the writes are done in order, so once this one is done the publishes are too
+	if err := <-db.AsyncPut(context.Background(), "flush", map[string]any{}, time.Now().UTC(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.Get(context.Background(), "testTopic")
+	if err != nil {
+		t.Fatalf("expected the last publish to be persisted, got %v", err)
+	}
+	if !reflect.DeepEqual(value, map[string]any{"message": "hello 9"}) {
+		t.Errorf("expected the last published value, got %v", value)
+	}
+
+	time.Sleep(2500 * time.Millisecond) // longer than a publish waits to be persisted
+	if len(s.sent) != 11 {
+		t.Errorf("expected one response per request, got %d: %+v", len(s.sent), s.sent)
+	}
+}
+
+func TestPublishCoalescedFromMinPublishInterval(t *testing.T) {
+	s, c, _ := setupRealTopicManager()
+
+	register := registerTopicSuccesssMsg
+	register.ParsedData = map[string]any{"message": ""}
+	register.Options = &network.MessageOptions{MinPublishInterval: "1m", CooldownPolicy: "coalesce"}
+	s.registerTopicHandler(c, register)
+	s.publishHandler(c, publishSuccessWithAck)
+	s.publishHandler(c, publishSuccessWithAck)
+
+	resp, ok := s.sent[2].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected a coalesced publish to be acked, got %+v", s.sent[2])
+	}
+	if len(resp.Warnings) != 1 || resp.Warnings[0] != coalescedWarning {
+		t.Errorf("expected the coalesced warning, got %v", resp.Warnings)
+	}
+}
+
+func TestRegisterHandlerFailFromUnknownCooldownPolicy(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
+
+	msg := registerTopicSuccesssMsg
+	msg.Options = &network.MessageOptions{MinPublishInterval: "100ms", CooldownPolicy: "drop"}
+	s.registerTopicHandler(client, msg)
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to not be called but was.")
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+func TestRegisterHandlerPassesRedeliveryPolicy(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
+
+	msg := registerTopicSuccesssMsg
+	msg.Options = &network.MessageOptions{RedeliveryAttempts: 3, RedeliveryDelay: "250ms"}
+	s.registerTopicHandler(client, msg)
+
+	if m.TopicOptions.RedeliveryAttempts != 3 || m.TopicOptions.RedeliveryDelay != 250*time.Millisecond {
+		t.Errorf("expected 3 redelivery attempts 250ms apart, got %+v", m.TopicOptions)
+	}
+}
+
+func TestRegisterHandlerFailFromInvalidRedelivery(t *testing.T) {
+	for _, opts := range []network.MessageOptions{
+		{RedeliveryAttempts: -1},
+		{RedeliveryAttempts: topic.MAX_REDELIVERY_ATTEMPTS + 1},
+		{RedeliveryAttempts: 2, RedeliveryDelay: "soon"},
+		{RedeliveryAttempts: 2, RedeliveryDelay: "0s"},
+	} {
+		m := &mockTopicManager{}
+		s, client := SetupStuff(m)
+
+		msg := registerTopicSuccesssMsg
+		msg.Options = &opts
+		s.registerTopicHandler(client, msg)
+
+		if m.IsMethodCalled {
+			t.Errorf("%+v: expected topic manager method to not be called but was.", opts)
+		}
+		if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+			t.Errorf("%+v: expected status bad request", opts)
+		}
+	}
+}
+
+func TestRegisterHandlerReplayHistory(t *testing.T) {
+	for history, wantCode := range map[int]int{100: http.StatusOK, -1: http.StatusBadRequest, topic.MAX_REPLAY_HISTORY + 1: http.StatusBadRequest} {
+		m := &mockTopicManager{}
+		s, client := SetupStuff(m)
+
+		msg := registerTopicSuccesssMsg
+		msg.Options = &network.MessageOptions{ReplayHistory: history}
+		s.registerTopicHandler(client, msg)
+
+		if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != wantCode {
+			t.Errorf("replayHistory %d: expected status %d, got %+v", history, wantCode, s.sent[0])
+		}
+		if wantCode == http.StatusOK && m.TopicOptions.ReplayHistory != history {
+			t.Errorf("expected a replay history of %d, got %+v", history, m.TopicOptions)
+		}
+	}
+}
+
+func TestRegisterHandlerFailFromNegativeMaxPayloadSize(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
+
+	msg := registerTopicSuccesssMsg
+	msg.Options = &network.MessageOptions{MaxPayloadSize: -1}
+	s.registerTopicHandler(client, msg)
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to not be called but was.")
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+//----------------------------------------------------------------------- get handler tests
+
+//------------------------------------------------------------------- register handler tests
+
+var registerTopicSuccesssMsg = network.WebSocketMessage{
+	MessageId:  "registerTopicWithAck",
+	Action:     "registerTopic",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{"info":"example"}`),
+	ParsedData: map[string]any{"message": "hello world"},
+	RequireAck: true,
+}
+
+var registerTopicFailNoParsedData = network.WebSocketMessage{
+	MessageId: "registerTopicBadJSON",
+	Action:    "registerTopic",
+	Topic:     "testTopic",
+	Data:      json.RawMessage(`{"invalid":}`),
+	// ParsedData: none
+	RequireAck: true,
+}
+
+func TestRegisterTopicHandlerSuccess(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: nil,
 	}
 	s := testServer{
 		WebSocketServer: &WebSocketServer{
@@ -792,7 +1317,7 @@ func TestSendWithoutSaveFailFromTopicManager(t *testing.T) {
 	s.WebSocketServer.sender = &s
 
 	client := &network.Client{}
-	s.sendWithoutSaveHandler(client, sendWithoutSaveSuccessWithAck)
+	s.registerTopicHandler(client, registerTopicSuccesssMsg)
 
 	if !m.IsMethodCalled {
 		t.Error("expected topic manager method to be called but wasn't.")
@@ -801,12 +1326,203 @@ func TestSendWithoutSaveFailFromTopicManager(t *testing.T) {
 		t.Fatal("expected 1 message")
 	}
 	resp, ok := s.sent[0].(network.Response)
-	if !ok || resp.Code != http.StatusInternalServerError {
+	if !ok || resp.Code != http.StatusOK {
 		t.Error("expected status 200")
 	}
 }
 
-func TestSendWithoutSaveFailFromNoParsedData(t *testing.T) {
+func TestRegisterHandlerFailFromInvalidValidationMode(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
+
+	msg := registerTopicSuccesssMsg
+	msg.Options = &network.MessageOptions{ValidationMode: "sometimes"}
+	s.registerTopicHandler(client, msg)
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to not be called but was.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+func TestRegisterHandlerFailFromNestingTooDeep(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("%w: schema is nested 40 levels deep, the max is 32", topic.ErrNestingTooDeep),
+	}
+	s, c := SetupStuff(m)
+
+	s.registerTopicHandler(c, registerTopicSuccesssMsg)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+func TestRegisterHandlerFailFromInvalidWebhook(t *testing.T) {
+	for _, webhook := range []string{"not a url", "ftp://example.com/hook", "http://"} {
+		m := &mockTopicManager{}
+		s, client := SetupStuff(m)
+
+		msg := registerTopicSuccesssMsg
+		msg.Options = &network.MessageOptions{Webhook: webhook}
+		s.registerTopicHandler(client, msg)
+
+		if m.IsMethodCalled {
+			t.Errorf("expected topic manager method to not be called for webhook %q", webhook)
+		}
+		if len(s.sent) != 1 {
+			t.Fatal("expected 1 message")
+		}
+		resp, ok := s.sent[0].(network.Response)
+		if !ok || resp.Code != http.StatusBadRequest {
+			t.Errorf("expected status bad request for webhook %q", webhook)
+		}
+	}
+}
+
+func TestRegisterHandlerFailFromWebhookNotAllowed(t *testing.T) {
+	s, c, tm := setupRealTopicManager()
+
+	msg := registerTopicSuccesssMsg
+	msg.Options = &network.MessageOptions{Webhook: "http://169.254.169.254/latest/meta-data"}
+	s.registerTopicHandler(c, msg)
+
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusForbidden {
+		t.Errorf("expected status forbidden for a webhook host that isn't allowed, got %+v", s.sent[0])
+	}
+	if tm.HasTopic(msg.Topic) {
+		t.Error("expected the topic to not be registered")
+	}
+}
+
+func TestRegisterHandlerOverflowPolicy(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
+
+	msg := registerTopicSuccesssMsg
+	msg.Options = &network.MessageOptions{OverflowPolicy: "dropOldest"}
+	s.registerTopicHandler(client, msg)
+
+	if m.TopicOptions.OverflowPolicy != network.OverflowDropOldest {
+		t.Errorf("expected overflow policy to be passed to topic manager, got %q", m.TopicOptions.OverflowPolicy)
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Error("expected status ok")
+	}
+}
+
+func TestRegisterHandlerAggregate(t *testing.T) {
+	s, c, _ := setupRealTopicManager()
+
+	register := registerTopicSuccesssMsg
+	register.ParsedData = map[string]any{"latency": 0.0}
+	register.Options = &network.MessageOptions{Aggregate: []string{"latency"}}
+	s.registerTopicHandler(c, register)
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected register to succeed, got %+v", s.sent[0])
+	}
+	if fields := resp.Data.(*network.TopicResponse).Aggregate; !reflect.DeepEqual(fields, []string{"latency"}) {
+		t.Errorf("expected the aggregate fields in the topic response, got %v", fields)
+	}
+
+	for _, latency := range []float64{4, 2} {
+		publish := publishSuccessWithAck
+		publish.ParsedData = map[string]any{"latency": latency}
+		s.publishHandler(c, publish)
+	}
+	notNumber := publishSuccessWithAck
+	notNumber.ParsedData = map[string]any{"latency": "slow"}
+	s.publishHandler(c, notNumber)
+	if resp, ok := s.sent[3].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Errorf("expected a non-numeric aggregate field to be a bad request, got %+v", s.sent[3])
+	}
+
+	s.getHandler(c, network.WebSocketMessage{MessageId: "get", Action: "get", Topic: "testTopic"})
+	encoded, err := json.Marshal(s.sent[4].(network.Response).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != `{"latency":{"count":2,"sum":6,"min":2,"max":4,"last":2}}` {
+		t.Errorf("expected get to return the aggregates, got %s", encoded)
+	}
+}
+
+func TestRegisterHandlerFailFromInvalidAggregate(t *testing.T) {
+	for _, opts := range []network.MessageOptions{
+		{Aggregate: []string{"latency", "latency"}},
+		{Aggregate: []string{" "}},
+		{Aggregate: []string{"latency"}, Binary: true},
+		{Aggregate: []string{"latency"}, Compressed: true},
+	} {
+		m := &mockTopicManager{}
+		s, client := SetupStuff(m)
+
+		msg := registerTopicSuccesssMsg
+		msg.Options = &opts
+		s.registerTopicHandler(client, msg)
+
+		if m.IsMethodCalled {
+			t.Errorf("expected topic manager method to not be called for %+v", opts)
+		}
+		if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+			t.Errorf("expected status bad request for %+v", opts)
+		}
+	}
+}
+
+func TestRegisterHandlerFailFromInvalidOverflowPolicy(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
+
+	msg := registerTopicSuccesssMsg
+	msg.Options = &network.MessageOptions{OverflowPolicy: "dropAll"}
+	s.registerTopicHandler(client, msg)
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to not be called")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+func TestRegisterHandlerFailFromInvalidTickInterval(t *testing.T) {
+	for _, interval := range []string{"soon", "-1s", "1ms"} {
+		m := &mockTopicManager{}
+		s, client := SetupStuff(m)
+
+		msg := registerTopicSuccesssMsg
+		msg.Options = &network.MessageOptions{TickInterval: interval}
+		s.registerTopicHandler(client, msg)
+
+		if m.IsMethodCalled {
+			t.Errorf("expected topic manager method to not be called for tick interval %q", interval)
+		}
+		resp, ok := s.sent[0].(network.Response)
+		if !ok || resp.Code != http.StatusBadRequest {
+			t.Errorf("expected status bad request for tick interval %q", interval)
+		}
+	}
+}
+
+func TestRegisterHandlerFailFromTopicManager(t *testing.T) {
 	m := &mockTopicManager{
 		ErrorResult: fmt.Errorf("error from topic manager"),
 	}
@@ -816,18 +1532,2752 @@ func TestSendWithoutSaveFailFromNoParsedData(t *testing.T) {
 		},
 	}
 	s.WebSocketServer.sender = &s
-
 	client := &network.Client{}
-	s.sendWithoutSaveHandler(client, sendWithoutSaveFailFromNoDataSupplied)
 
-	if m.IsMethodCalled {
+	s.registerTopicHandler(client, registerTopicSuccesssMsg)
+
+	if !m.IsMethodCalled {
 		t.Error("expected topic manager method to be called but wasn't.")
 	}
 	if len(s.sent) != 1 {
 		t.Fatal("expected 1 message")
 	}
 	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusInternalServerError {
+		t.Error("expected status internal server error.")
+	}
+}
+
+func TestRegisterHandlerFailFromNoData(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("error from topic manager"),
+	}
+
+	s, client := SetupStuff(m)
+
+	s.registerTopicHandler(client, registerTopicFailNoParsedData)
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to not be called but was.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
 	if !ok || resp.Code != http.StatusBadRequest {
-		t.Error("expected status 200")
+		t.Error("expected status internal server error.")
+	}
+}
+
+func TestRegisterHandlerAllowedTopicPatterns(t *testing.T) {
+	s, client, _ := setupRealTopicManager()
+	tm := topic.NewTopicManager(storage.NewNullStorage(), &config.Config{AllowedTopicPatterns: []string{"app1/*"}})
+	s.topicManager = tm
+
+	tests := map[string]int{
+		"app1/orders":    http.StatusOK,
+		"app2/orders":    http.StatusForbidden,
+		"app1/orders/eu": http.StatusForbidden,
+	}
+	for name, code := range tests {
+		s.sent = nil
+		msg := registerTopicSuccesssMsg
+		msg.Topic = name
+		s.registerTopicHandler(client, msg)
+
+		if len(s.sent) != 1 {
+			t.Fatalf("%s: expected 1 message, got %d", name, len(s.sent))
+		}
+		if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != code {
+			t.Errorf("%s: expected status %d, got %+v", name, code, s.sent[0])
+		}
+		if registered := tm.HasTopic(name); registered != (code == http.StatusOK) {
+			t.Errorf("%s: expected registered to be %v", name, code == http.StatusOK)
+		}
+	}
+}
+
+//------------------------------------------------------------------ unregister handler tests
+
+var unregisterWithAck = network.WebSocketMessage{
+	MessageId:  "unsubscribeWithAck",
+	Action:     "unsubscribe",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{}`),
+	RequireAck: true,
+}
+
+var unregisterWithoutAck = network.WebSocketMessage{
+	MessageId:  "unsubscribeWithoutAck",
+	Action:     "unsubscribe",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{}`),
+	RequireAck: false,
+}
+
+func TestUnregisterHandlerSuccessWithAck(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: nil,
+	}
+	s, c := SetupStuff(m)
+
+	s.unregisterTopicHandler(c, unregisterWithAck)
+
+	if !m.IsMethodCalled { // if method wasn't called, bad
+		t.Error("expected topic manager method to not be called but was.")
+	}
+	fmt.Println(len(s.sent))
+	if len(s.sent) != 1 { // if nothing was sent, bad. We have ack
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK { // if response wasn't ok, bad
+		t.Error("expected status internal server error.")
+	}
+}
+
+func TestUnregisterHandlerSuccessWithoutAck(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: nil,
+	}
+	s, c := SetupStuff(m)
+
+	s.unsubscribeHandler(c, unregisterWithoutAck)
+
+	if !m.IsMethodCalled { // if method wasn't called, bad
+		t.Error("expected topic manager method to not be called but was.")
+	}
+	if len(s.sent) != 0 { // if nothing was sent, good. We have ack disabled
+		t.Fatal("expected no message with success and no ack")
+		// do nothing since this is expected
+	}
+}
+
+func TestUnregisterHandlerFailFromTopicManager(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("error from topic manager"),
+	}
+	s, c := SetupStuff(m)
+
+	s.unregisterTopicHandler(c, unregisterWithoutAck)
+
+	if !m.IsMethodCalled { // if method wasn't called, bad
+		t.Error("expected topic manager method to not be called but was.")
+	}
+	if len(s.sent) != 1 { // if nothing was sent, bad. We have ack
+		t.Fatal("expected 1 message sent to client.")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusInternalServerError {
+		t.Error("expected status internal server error.")
+	}
+}
+
+func TestUnregisterHandlerDryRun(t *testing.T) {
+	m := &mockTopicManager{
+		PreviewResult: topic.UnregisterPreview{Topic: "testTopic", HasData: true, Subscribers: 2},
+	}
+	s, c := SetupStuff(m)
+
+	msg := unregisterWithoutAck
+	msg.Options = &network.MessageOptions{DryRun: true}
+	s.unregisterTopicHandler(c, msg)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected the dry run to be responded to without requireAck")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	expected := network.DryRunResponse{Topics: []network.DryRunTopic{{Name: "testTopic", HasData: true, Subscribers: 2}}}
+	if !reflect.DeepEqual(resp.Data, expected) {
+		t.Errorf("expected the affected topic, got %+v", resp.Data)
+	}
+}
+
+func TestUnregisterHandlerDryRunMakesNoChanges(t *testing.T) {
+	s, c, tm := setupRealTopicManager()
+	if _, err := tm.RegisterTopic("testTopic", map[string]any{"a": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := unregisterWithAck
+	msg.Options = &network.MessageOptions{DryRun: true}
+	s.unregisterTopicHandler(c, msg)
+
+	if !tm.HasTopic("testTopic") {
+		t.Error("expected the topic to still be registered after a dry run")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	if topics := resp.Data.(network.DryRunResponse).Topics; len(topics) != 1 || topics[0].Name != "testTopic" || topics[0].HasData {
+		t.Errorf("expected the topic to be reported without data, got %+v", topics)
+	}
+}
+
+func TestUnregisterHandlerDryRunFailFromMissingTopic(t *testing.T) {
+	s, c, _ := setupRealTopicManager()
+
+	msg := unregisterWithAck
+	msg.Options = &network.MessageOptions{DryRun: true}
+	s.unregisterTopicHandler(c, msg)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusInternalServerError {
+		t.Errorf("expected status internal server error, got %+v", s.sent[0])
+	}
+}
+
+//------------------------------------------------------------------ rename topic handler tests
+
+var renameTopicWithAck = network.WebSocketMessage{
+	MessageId:  "renameTopicWithAck",
+	Action:     "renameTopic",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{"newName":"renamedTopic"}`),
+	ParsedData: map[string]any{"newName": "renamedTopic"},
+	RequireAck: true,
+}
+
+var renameTopicWithoutNewName = network.WebSocketMessage{
+	MessageId:  "renameTopicWithoutNewName",
+	Action:     "renameTopic",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{"name":"renamedTopic"}`),
+	ParsedData: map[string]any{"name": "renamedTopic"},
+	RequireAck: true,
+}
+
+func TestRenameTopicHandlerSuccessWithAck(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+
+	s.renameTopicHandler(c, renameTopicWithAck)
+
+	if !m.IsMethodCalled {
+		t.Error("expected topic manager method to be called but wasn't.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Error("expected status 200")
+	}
+}
+
+func TestRenameTopicHandlerFailFromTopicManager(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("topic already exists"),
+	}
+	s, c := SetupStuff(m)
+
+	s.renameTopicHandler(c, renameTopicWithAck)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusInternalServerError {
+		t.Error("expected status internal server error.")
+	}
+}
+
+func TestRenameTopicHandlerFailFromNoNewName(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+
+	s.renameTopicHandler(c, renameTopicWithoutNewName)
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to not be called but was.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+//----------------------------------------------------------------- list topics handler tests
+
+//-------------------------------------------------------------- update schema  handler tests
+
+var updateSchemaSuccessWithAck = network.WebSocketMessage{
+	MessageId:  "sendWithoutSaveSuccessWithAck",
+	Action:     "sendWithoutSave",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{"message":"hello world"}`),
+	ParsedData: map[string]any{"message": "hello world"},
+	RequireAck: true,
+}
+
+var updateSchemaSuccessWithoutAck = network.WebSocketMessage{
+	MessageId:  "sendWithoutSaveSuccessWithoutAck",
+	Action:     "sendWithoutSave",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{"message":"hello world"}`),
+	ParsedData: map[string]any{"message": "hello world"},
+	RequireAck: false,
+}
+
+var updateSchemaFailFromNoDataSupplied = network.WebSocketMessage{
+	MessageId: "sendWithoutSaveFailFromNoDataSupplied",
+	Action:    "sendWithoutSave",
+	Topic:     "testTopic",
+	Data:      json.RawMessage(`{"message":"hello world"}`),
+	//ParsedData: none
+	RequireAck: false,
+}
+
+func TestUpdateSchemaSuccessWithAck(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: nil,
+	}
+	s := testServer{
+		WebSocketServer: &WebSocketServer{
+			topicManager: m,
+		},
+	}
+	s.WebSocketServer.sender = &s
+
+	client := &network.Client{}
+	s.updateSchemaHandler(client, updateSchemaSuccessWithAck)
+
+	if !m.IsMethodCalled {
+		t.Error("expected topic manager method to be called but wasn't.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Error("expected status 200")
+	}
+}
+
+func TestUpdateSchemaSuccessWithoutAck(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: nil,
+	}
+	s := testServer{
+		WebSocketServer: &WebSocketServer{
+			topicManager: m,
+		},
+	}
+	s.WebSocketServer.sender = &s
+
+	client := &network.Client{}
+	s.updateSchemaHandler(client, updateSchemaSuccessWithoutAck)
+	if !m.IsMethodCalled {
+		t.Error("expected topic manager method to be called but wasn't.")
+	}
+	if len(s.sent) != 0 {
+		t.Fatal("expected no message")
+	}
+}
+
+func TestUpdateSchemaFailFromTopicManager(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("error from topic manager"),
+	}
+	s := testServer{
+		WebSocketServer: &WebSocketServer{
+			topicManager: m,
+		},
+	}
+	s.WebSocketServer.sender = &s
+
+	client := &network.Client{}
+	s.updateSchemaHandler(client, updateSchemaSuccessWithAck)
+
+	if !m.IsMethodCalled {
+		t.Error("expected topic manager method to be called but wasn't.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusInternalServerError {
+		t.Error("expected status 200")
+	}
+}
+
+func TestUpdateSchemaFailFromNoParsedData(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("error from topic manager"),
+	}
+	s := testServer{
+		WebSocketServer: &WebSocketServer{
+			topicManager: m,
+		},
+	}
+	s.WebSocketServer.sender = &s
+
+	client := &network.Client{}
+	s.updateSchemaHandler(client, updateSchemaFailFromNoDataSupplied)
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to be called but wasn't.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status 200")
+	}
+}
+
+//----------------------------------------------------------- send without save handler tests
+
+var sendWithoutSaveSuccessWithAck = network.WebSocketMessage{
+	MessageId:  "sendWithoutSaveSuccessWithAck",
+	Action:     "sendWithoutSave",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{"message":"hello world"}`),
+	ParsedData: map[string]any{"message": "hello world"},
+	RequireAck: true,
+}
+
+var sendWithoutSaveSuccessWithoutAck = network.WebSocketMessage{
+	MessageId:  "sendWithoutSaveSuccessWithoutAck",
+	Action:     "sendWithoutSave",
+	Topic:      "testTopic",
+	Data:       json.RawMessage(`{"message":"hello world"}`),
+	ParsedData: map[string]any{"message": "hello world"},
+	RequireAck: false,
+}
+
+var sendWithoutSaveFailFromNoDataSupplied = network.WebSocketMessage{
+	MessageId: "sendWithoutSaveFailFromNoDataSupplied",
+	Action:    "sendWithoutSave",
+	Topic:     "testTopic",
+	Data:      json.RawMessage(`{"message":"hello world"}`),
+	//ParsedData: none
+	RequireAck: false,
+}
+
+func TestSendWithoutSaveSuccessWithAck(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: nil,
+	}
+	s := testServer{
+		WebSocketServer: &WebSocketServer{
+			topicManager: m,
+		},
+	}
+	s.WebSocketServer.sender = &s
+
+	client := &network.Client{}
+	s.sendWithoutSaveHandler(client, sendWithoutSaveSuccessWithAck)
+
+	if !m.IsMethodCalled {
+		t.Error("expected topic manager method to be called but wasn't.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Error("expected status 200")
+	}
+}
+
+func TestSendWithoutSaveSuccessWithoutAck(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: nil,
+	}
+	s := testServer{
+		WebSocketServer: &WebSocketServer{
+			topicManager: m,
+		},
+	}
+	s.WebSocketServer.sender = &s
+
+	client := &network.Client{}
+	s.sendWithoutSaveHandler(client, sendWithoutSaveSuccessWithoutAck)
+
+	if !m.IsMethodCalled {
+		t.Error("expected topic manager method to be called but wasn't.")
+	}
+	if len(s.sent) != 0 {
+		t.Fatal("expected no message")
+	}
+}
+
+func TestSendWithoutSaveFailFromTopicManager(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("error from topic manager"),
+	}
+	s := testServer{
+		WebSocketServer: &WebSocketServer{
+			topicManager: m,
+		},
+	}
+	s.WebSocketServer.sender = &s
+
+	client := &network.Client{}
+	s.sendWithoutSaveHandler(client, sendWithoutSaveSuccessWithAck)
+
+	if !m.IsMethodCalled {
+		t.Error("expected topic manager method to be called but wasn't.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusInternalServerError {
+		t.Error("expected status 200")
+	}
+}
+
+func TestSendWithoutSaveFailFromNoParsedData(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("error from topic manager"),
+	}
+	s := testServer{
+		WebSocketServer: &WebSocketServer{
+			topicManager: m,
+		},
+	}
+	s.WebSocketServer.sender = &s
+
+	client := &network.Client{}
+	s.sendWithoutSaveHandler(client, sendWithoutSaveFailFromNoDataSupplied)
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to be called but wasn't.")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status 200")
+	}
+}
+
+//------------------------------------------------------------------------ access log tests
+
+func TestAccessLogWrittenForHandledRequest(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("topic doesn't exist"),
+	}
+	s, c := SetupStuff(m)
+	c.Id = "access-client"
+
+	var buf bytes.Buffer
+	s.accessLog = logging.NewAccessLogger(&buf)
+	s.handlers = make(map[string]HandlerFunc)
+	s.registerHandler("subscribe", s.subscribeHandler, s.metricsDecorator)
+
+	s.handlers["subscribe"](c, subscribeWithAck)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 access log line, got %d: %s", len(lines), buf.String())
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("access log line wasn't json: %v", err)
+	}
+	if entry["client_id"] != "access-client" {
+		t.Errorf("expected client_id access-client, got %v", entry["client_id"])
+	}
+	if entry["action"] != "subscribe" || entry["topic"] != "testTopic" || entry["msg_id"] != "subscribeWithAck" {
+		t.Errorf("unexpected request fields in access log: %v", entry)
+	}
+	if entry["code"] != float64(http.StatusInternalServerError) {
+		t.Errorf("expected code 500, got %v", entry["code"])
+	}
+	if _, ok := entry["duration_ms"]; !ok {
+		t.Error("expected duration_ms in access log")
+	}
+}
+
+//---------------------------------------------------------------- require data decorator tests
+
+func TestRequireDataDecoratorAcceptsArray(t *testing.T) {
+	s, c := SetupStuff(&mockTopicManager{})
+
+	var parsed any
+	handler := s.requireDataDecorator(func(c *network.Client, msg network.WebSocketMessage) {
+		parsed = msg.ParsedData
+	})
+	handler(c, network.WebSocketMessage{
+		MessageId: "arrayPayload",
+		Action:    "publish",
+		Topic:     "testTopic",
+		Data:      json.RawMessage(`[{"name":"first"},{"name":"second"}]`),
+	})
+
+	if len(s.sent) != 0 {
+		t.Fatalf("expected no error response, got: %v", s.sent)
+	}
+	items, ok := parsed.([]any)
+	if !ok || len(items) != 2 {
+		t.Errorf("expected parsed array of 2 items, got: %v", parsed)
+	}
+}
+
+func TestRequireDataDecoratorRejectsTooDeep(t *testing.T) {
+	s, c := SetupStuff(&mockTopicManager{})
+	s.config = &config.Config{MaxNestingDepth: 10}
+
+	called := false
+	handler := s.requireDataDecorator(func(c *network.Client, msg network.WebSocketMessage) {
+		called = true
+	})
+
+	deep := strings.Repeat(`{"child":`, 11) + `"leaf"` + strings.Repeat(`}`, 11)
+	handler(c, network.WebSocketMessage{
+		MessageId: "deepPayload",
+		Action:    "publish",
+		Topic:     "testTopic",
+		Data:      json.RawMessage(deep),
+	})
+
+	if called {
+		t.Error("expected handler to not be called for payload nested past the limit")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+
+	// right at the limit is fine
+	atLimit := strings.Repeat(`{"child":`, 10) + `"leaf"` + strings.Repeat(`}`, 10)
+	handler(c, network.WebSocketMessage{
+		MessageId: "limitPayload",
+		Action:    "publish",
+		Topic:     "testTopic",
+		Data:      json.RawMessage(atLimit),
+	})
+	if !called {
+		t.Error("expected handler to be called for payload at the limit")
+	}
+}
+
+func TestRequireDataDecoratorRejectsScalar(t *testing.T) {
+	s, c := SetupStuff(&mockTopicManager{})
+
+	called := false
+	handler := s.requireDataDecorator(func(c *network.Client, msg network.WebSocketMessage) {
+		called = true
+	})
+	handler(c, network.WebSocketMessage{
+		MessageId: "scalarPayload",
+		Action:    "publish",
+		Topic:     "testTopic",
+		Data:      json.RawMessage(`42`),
+	})
+
+	if called {
+		t.Error("expected handler to not be called for scalar payload")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+//--------------------------------------------------------------------- recover decorator tests
+
+func TestRecoverDecoratorReturnsErrorOnPanic(t *testing.T) {
+	s, c := SetupStuff(&mockTopicManager{})
+	s.handlers = make(map[string]HandlerFunc)
+
+	calls := 0
+	s.registerHandler("panics", func(c *network.Client, msg network.WebSocketMessage) {
+		calls++
+		var data map[string]any
+		data["boom"] = true // nil map write
+	}, s.metricsDecorator)
+
+	msg := network.WebSocketMessage{
+		MessageId: "panicking",
+		Action:    "panics",
+		Topic:     "testTopic",
+	}
+
+	// the connection should survive so the same client can keep sending
+	s.RouteMessage(c, msg)
+	s.RouteMessage(c, msg)
+
+	if calls != 2 {
+		t.Fatalf("expected handler to be called twice, got %d", calls)
+	}
+	if len(s.sent) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(s.sent))
+	}
+	for _, sent := range s.sent {
+		resp, ok := sent.(network.Response)
+		if !ok || resp.Code != http.StatusInternalServerError {
+			t.Errorf("expected status internal server error, got: %v", sent)
+		}
+		if resp.MessageId != "panicking" {
+			t.Errorf("expected response for message panicking, got %s", resp.MessageId)
+		}
+	}
+}
+
+//---------------------------------------------------------------------- list topics handler tests
+
+func TestListTopicsIncludesLastUpdated(t *testing.T) {
+	tm := topic.NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	if _, err := tm.RegisterTopic("fresh", map[string]any{"a": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.RegisterTopic("empty", map[string]any{"a": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	msg := network.WebSocketMessage{MessageId: "publish", Action: "publish", Topic: "fresh"}
+	if err := tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s, c := SetupStuff(&mockTopicManager{})
+	s.topicManager = tm
+	s.listTopicsHandler(c, network.WebSocketMessage{MessageId: "list", Action: "listTopics"})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatal("expected status ok")
+	}
+	topics, ok := resp.Data.([]network.TopicResponse)
+	if !ok || len(topics) != 2 {
+		t.Fatalf("expected 2 topics, got: %v", resp.Data)
+	}
+	for _, topicResponse := range topics {
+		switch topicResponse.Name {
+		case "fresh":
+			if !topicResponse.HasValue || topicResponse.LastUpdated == nil {
+				t.Errorf("expected fresh topic to have a value and last updated time, got: %+v", topicResponse)
+			}
+		case "empty":
+			if topicResponse.HasValue || topicResponse.LastUpdated != nil {
+				t.Errorf("expected empty topic to have no value, got: %+v", topicResponse)
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------- get pattern handler tests
+
+var getPatternMsg = network.WebSocketMessage{
+	MessageId:  "getPattern",
+	Action:     "getPattern",
+	Topic:      "sensors/*",
+	RequireAck: true,
+}
+
+func TestGetPatternHandlerSuccess(t *testing.T) {
+	m := &mockTopicManager{
+		NamesResult:  []string{"sensors/humidity", "sensors/temp"},
+		ValuesResult: map[string]any{"sensors/humidity": 40.0, "sensors/temp": 21.5},
+	}
+	s, c := SetupStuff(m)
+	s.config = &config.Config{MaxPatternResults: 2}
+
+	s.getPatternHandler(c, getPatternMsg)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatal("expected status ok")
+	}
+	values, ok := resp.Data.(map[string]any)
+	if !ok || len(values) != 2 || values["sensors/temp"] != 21.5 {
+		t.Errorf("expected values keyed by topic, got: %v", resp.Data)
+	}
+}
+
+func TestGetPatternHandlerFailFromTooManyResults(t *testing.T) {
+	m := &mockTopicManager{
+		NamesResult: []string{"sensors/a", "sensors/b", "sensors/c"},
+	}
+	s, c := SetupStuff(m)
+	s.config = &config.Config{MaxPatternResults: 2}
+
+	s.getPatternHandler(c, getPatternMsg)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+	if m.ValuesResult != nil {
+		t.Error("expected values to not be read")
+	}
+}
+
+func TestGetPatternHandlerFailFromBadPattern(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("invalid topic pattern"),
+	}
+	s, c := SetupStuff(m)
+
+	s.getPatternHandler(c, getPatternMsg)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+//------------------------------------------------------------ export and import schemas tests
+
+func TestExportImportSchemasHandlersRoundTrip(t *testing.T) {
+	source := topic.NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	if _, err := source.RegisterTopic("orders", map[string]any{"id": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.UpdateSchema("orders", map[string]any{"id": "", "total": 0.0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.RegisterTopic("metrics", map[string]any{"name": ""}, topic.TopicOptions{ValidationMode: topic.ValidationWarn}); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter, c := SetupStuff(&mockTopicManager{})
+	exporter.topicManager = source
+	exporter.exportSchemasHandler(c, network.WebSocketMessage{MessageId: "export", Action: "exportSchemas"})
+	if len(exporter.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	exportResp, ok := exporter.sent[0].(network.Response)
+	if !ok || exportResp.Code != http.StatusOK {
+		t.Fatal("expected status ok")
+	}
+	document, err := json.Marshal(exportResp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := topic.NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	importer, c := SetupStuff(&mockTopicManager{})
+	importer.topicManager = target
+	importer.importSchemasHandler(c, network.WebSocketMessage{MessageId: "import", Action: "importSchemas", Data: document})
+	if len(importer.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	importResp, ok := importer.sent[0].(network.Response)
+	if !ok || importResp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got: %v", importer.sent[0])
+	}
+	result, ok := importResp.Data.(network.ImportSchemasResponse)
+	if !ok || result.TopicsCreated != 2 || result.VersionsAdded != 3 {
+		t.Errorf("unexpected import result: %v", importResp.Data)
+	}
+
+	exported, imported := source.ExportSchemas(), target.ExportSchemas()
+	if len(exported) != len(imported) {
+		t.Fatalf("expected %d topics to be imported, got %d", len(exported), len(imported))
+	}
+	for i := range exported {
+		if exported[i].Name != imported[i].Name || exported[i].ValidationMode != imported[i].ValidationMode {
+			t.Errorf("expected topic %s to be imported as is, got %s", exported[i].Name, imported[i].Name)
+		}
+		if len(exported[i].Schemas) != len(imported[i].Schemas) {
+			t.Fatalf("expected %d versions for %s, got %d", len(exported[i].Schemas), exported[i].Name, len(imported[i].Schemas))
+		}
+		for v := range exported[i].Schemas {
+			if exported[i].Schemas[v].Hash != imported[i].Schemas[v].Hash {
+				t.Errorf("expected version %d of %s to have the same hash", v, exported[i].Name)
+			}
+		}
+	}
+}
+
+func TestImportSchemasHandlerFailFromTopicManager(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("cannot import topic bad with no schemas"),
+	}
+	s, c := SetupStuff(m)
+
+	s.importSchemasHandler(c, network.WebSocketMessage{
+		MessageId: "import",
+		Action:    "importSchemas",
+		Data:      json.RawMessage(`{"topics":[{"name":"bad","schemas":[]}]}`),
+	})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+	if len(m.DefinitionsResult) != 1 || m.DefinitionsResult[0].Name != "bad" {
+		t.Errorf("expected definitions to be passed to topic manager, got: %v", m.DefinitionsResult)
+	}
+}
+
+//--------------------------------------------------------------------- decorator order tests
+
+// recordingDecorator will create a decorator that records when it runs before and after the
+// handler it wraps.
+func recordingDecorator(name string, calls *[]string) func(HandlerFunc) HandlerFunc {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *network.Client, msg network.WebSocketMessage) {
+			*calls = append(*calls, name+" before")
+			next(c, msg)
+			*calls = append(*calls, name+" after")
+		}
+	}
+}
+
+func TestRegisterHandlerRunsDecoratorsInListedOrder(t *testing.T) {
+	s, c := SetupStuff(&mockTopicManager{})
+	s.handlers = make(map[string]HandlerFunc)
+
+	var calls []string
+	s.registerHandler("ordered", func(c *network.Client, msg network.WebSocketMessage) {
+		calls = append(calls, "handler")
+	}, recordingDecorator("first", &calls), recordingDecorator("second", &calls), recordingDecorator("third", &calls))
+
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "ordered", Action: "ordered"})
+
+	expected := []string{
+		"first before", "second before", "third before",
+		"handler",
+		"third after", "second after", "first after",
+	}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected decorators to run in order %v, got %v", expected, calls)
+	}
+}
+
+// newRegisteredTestServer will create a server with the real handler registrations that
+// records what is sent to clients.
+func newRegisteredTestServer(m *mockTopicManager, cfg *config.Config) (*testServer, *network.Client) {
+	s := &testServer{WebSocketServer: NewWebSocketServer(nil, m, cfg)}
+	s.WebSocketServer.sender = s
+	return s, &network.Client{Id: "registered-client"}
+}
+
+func TestRegisteredHandlersCheckTopicBeforeData(t *testing.T) {
+	for _, action := range []string{"publish", "registerTopic", "renameTopic", "updateSchema", "sendWithoutSave"} {
+		t.Run(action, func(t *testing.T) {
+			m := &mockTopicManager{}
+			s, c := newRegisteredTestServer(m, &config.Config{})
+
+			s.RouteMessage(c, network.WebSocketMessage{MessageId: action, Action: action, RequireAck: true})
+
+			if m.IsMethodCalled {
+				t.Error("expected topic manager method to not be called")
+			}
+			if len(s.sent) != 1 {
+				t.Fatalf("expected 1 message, got %d", len(s.sent))
+			}
+			resp, ok := s.sent[0].(network.Response)
+			if !ok || resp.Code != http.StatusBadRequest {
+				t.Fatal("expected status bad request")
+			}
+			if resp.Message != "no topic provided" {
+				t.Errorf("expected the topic to be checked first, got: %s", resp.Message)
+			}
+		})
+	}
+}
+
+func TestRegisteredHandlersRecordRejectedRequests(t *testing.T) {
+	s, c := newRegisteredTestServer(&mockTopicManager{}, &config.Config{})
+	var buf bytes.Buffer
+	s.accessLog = logging.NewAccessLogger(&buf)
+
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "rejected", Action: "publish", Topic: "testTopic"})
+
+	var entry map[string]any
+	if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry); err != nil {
+		t.Fatalf("expected one access log entry, got %q: %v", buf.String(), err)
+	}
+	if entry["code"] != float64(http.StatusBadRequest) {
+		t.Errorf("expected rejected request to be logged with code 400, got %v", entry["code"])
+	}
+	if summary := s.Metrics().Summary(time.Now()); len(summary.Actions) != 1 || summary.Actions[0].Action != "publish" {
+		t.Errorf("expected rejected publish to be counted in metrics, got %+v", summary)
+	}
+}
+
+//------------------------------------------------------------------------ custom handler tests
+
+func TestRegisterHandlerGetsStandardDecorators(t *testing.T) {
+	s, c := newRegisteredTestServer(&mockTopicManager{}, &config.Config{})
+	var calls []string
+	err := s.RegisterHandler("custom", func(c *network.Client, msg network.WebSocketMessage) {
+		calls = append(calls, "handler")
+		s.AckResponseSuccess(c, msg)
+	}, func(next HandlerFunc) HandlerFunc {
+		return func(c *network.Client, msg network.WebSocketMessage) {
+			calls = append(calls, "decorator")
+			next(c, msg)
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error registering handler: %v", err)
+	}
+
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "custom", Action: "custom", RequireAck: true})
+
+	if strings.Join(calls, ",") != "decorator,handler" {
+		t.Errorf("expected the decorator to run before the handler, got %v", calls)
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Errorf("expected status ok, got %+v", s.sent[0])
+	}
+	if summary := s.Metrics().Summary(time.Now()); len(summary.Actions) != 1 || summary.Actions[0].Action != "custom" {
+		t.Errorf("expected the custom action to be counted in metrics, got %+v", summary)
+	}
+}
+
+func TestRegisterHandlerWithoutStandardDecorators(t *testing.T) {
+	s, c := newRegisteredTestServer(&mockTopicManager{}, &config.Config{})
+	err := s.RegisterHandlerWithOptions("quiet", func(c *network.Client, msg network.WebSocketMessage) {
+		panic("handlers still recover")
+	}, HandlerOptions{NoStandardDecorators: true})
+	if err != nil {
+		t.Fatalf("unexpected error registering handler: %v", err)
+	}
+
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "quiet", Action: "quiet"})
+
+	if summary := s.Metrics().Summary(time.Now()); len(summary.Actions) != 0 {
+		t.Errorf("expected no metrics without the standard decorators, got %+v", summary)
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusInternalServerError {
+		t.Errorf("expected the panic to be recovered with status internal server error, got %+v", s.sent[0])
+	}
+}
+
+func TestRegisterHandlerRejectsTakenActions(t *testing.T) {
+	s, _ := newRegisteredTestServer(&mockTopicManager{}, &config.Config{})
+	handler := func(c *network.Client, msg network.WebSocketMessage) {}
+
+	if err := s.RegisterHandler("publish", handler); err == nil {
+		t.Error("expected a built in action to be rejected")
+	}
+	if err := s.RegisterHandler(" ", handler); err == nil {
+		t.Error("expected a blank action to be rejected")
+	}
+	if err := s.RegisterHandler("custom", nil); err == nil {
+		t.Error("expected a nil handler to be rejected")
+	}
+}
+
+func TestWithHandlerRegistersCustomAction(t *testing.T) {
+	cfg := &config.Config{DisabledActions: []string{"disabledCustom"}}
+	newHandler := func(s *WebSocketServer) HandlerFunc {
+		return func(c *network.Client, msg network.WebSocketMessage) {
+			s.AckResponseSuccessWithData(c, msg, "custom data")
+		}
+	}
+	server := NewWebSocketServer(nil, &mockTopicManager{}, cfg,
+		WithHandler("custom", newHandler, HandlerOptions{RequireData: true}),
+		WithHandler("disabledCustom", newHandler, HandlerOptions{}),
+	)
+	s := &testServer{WebSocketServer: server}
+	s.WebSocketServer.sender = s
+	c := &network.Client{Id: "custom-client"}
+
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "no-data", Action: "custom"})
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "data", Action: "custom", Data: json.RawMessage(`{"a": 1}`)})
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "disabled", Action: "disabledCustom"})
+
+	wantCodes := []int{http.StatusBadRequest, http.StatusOK, http.StatusForbidden}
+	if len(s.sent) != len(wantCodes) {
+		t.Fatalf("expected %d messages, got %d", len(wantCodes), len(s.sent))
+	}
+	for i, want := range wantCodes {
+		if resp, ok := s.sent[i].(network.Response); !ok || resp.Code != want {
+			t.Errorf("expected status %d, got %+v", want, s.sent[i])
+		}
+	}
+}
+
+//------------------------------------------------------------------------ get at time tests
+
+func TestGetHandlerAtTime(t *testing.T) {
+	m := &mockTopicManager{
+		MapResult: map[string]any{"value": "old"},
+	}
+	s, c := SetupStuff(m)
+
+	s.getHandler(c, network.WebSocketMessage{
+		MessageId: "getAt",
+		Action:    "get",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{At: "2025-01-01T12:00:30Z"},
+	})
+
+	if !m.AtResult.Equal(time.Date(2025, 1, 1, 12, 0, 30, 0, time.UTC)) {
+		t.Errorf("expected at time to be passed to topic manager, got %s", m.AtResult)
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Error("expected status ok")
+	}
+}
+
+func TestGetHandlerAtTimeFailFromInvalidTime(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+
+	s.getHandler(c, network.WebSocketMessage{
+		MessageId: "getAt",
+		Action:    "get",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{At: "yesterday"},
+	})
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to not be called")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+func TestGetHandlerAtTimeFailFromNoHistory(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("couldn't get value for topic: %w", storage.ErrHistoryNotSupported),
+	}
+	s, c := SetupStuff(m)
+
+	s.getHandler(c, network.WebSocketMessage{
+		MessageId: "getAt",
+		Action:    "get",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{At: "2025-01-01T12:00:30Z"},
+	})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+//------------------------------------------------------------------------- publishIf handler tests
+
+func publishIfMsg(data string) network.WebSocketMessage {
+	return network.WebSocketMessage{MessageId: "publishIf", Action: "publishIf", Topic: "lock", Data: json.RawMessage(data), RequireAck: true}
+}
+
+// publishIfResponse will return the response to a publishIf, skipping the response about
+// persisting that the mock never acks.
+func publishIfResponse(t *testing.T, s *testServer) network.Response {
+	t.Helper()
+	for _, sent := range s.sent {
+		if resp, ok := sent.(network.Response); ok && resp.Action == "publishIf" {
+			return resp
+		}
+	}
+	t.Fatalf("expected a publishIf response, got %v", s.sent)
+	return network.Response{}
+}
+
+func TestPublishIfHandlerSuccess(t *testing.T) {
+	m := &mockTopicManager{DefaultsResult: map[string]any{"owner": "b"}}
+	s, c := SetupStuff(m)
+
+	s.publishIfHandler(c, publishIfMsg(`{"expected": {"owner": "a"}, "value": {"owner": "b"}}`))
+
+	if resp := publishIfResponse(t, s); resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", resp.Code, resp.Message)
+	}
+	if !m.Precondition.CheckValue || !reflect.DeepEqual(m.Precondition.Value, map[string]any{"owner": "a"}) {
+		t.Errorf("expected the expected value to be checked, got %+v", m.Precondition)
+	}
+}
+
+func TestPublishIfHandlerExpectedNull(t *testing.T) {
+	m := &mockTopicManager{DefaultsResult: map[string]any{"owner": "a"}}
+	s, c := SetupStuff(m)
+
+	s.publishIfHandler(c, publishIfMsg(`{"expected": null, "value": {"owner": "a"}}`))
+
+	if resp := publishIfResponse(t, s); resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %d: %s", resp.Code, resp.Message)
+	}
+	if !m.Precondition.CheckValue || m.Precondition.Value != nil {
+		t.Errorf("expected a null value to be checked, got %+v", m.Precondition)
+	}
+}
+
+func TestPublishIfHandlerFailFromPrecondition(t *testing.T) {
+	stored := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &mockTopicManager{
+		DefaultsResult: map[string]any{"owner": "b"},
+		ErrorResult:    fmt.Errorf("%w: doesn't match", topic.ErrPreconditionFailed),
+		MetaResult:     topic.ValueMeta{Value: map[string]any{"owner": "c"}, Timestamp: stored, Latest: true},
+	}
+	s, c := SetupStuff(m)
+
+	s.publishIfHandler(c, publishIfMsg(`{"expected": {"owner": "a"}, "value": {"owner": "b"}}`))
+
+	resp := publishIfResponse(t, s)
+	if resp.Code != http.StatusPreconditionFailed || resp.ErrorCode != "PRECONDITION_FAILED" {
+		t.Fatalf("expected precondition failed, got %d %s", resp.Code, resp.ErrorCode)
+	}
+	current, ok := resp.Data.(network.ValueWithMeta)
+	if !ok || !reflect.DeepEqual(current.Value, map[string]any{"owner": "c"}) || current.Timestamp == nil || !current.Timestamp.Equal(stored) {
+		t.Errorf("expected the current value, got %+v", resp.Data)
+	}
+}
+
+func TestPublishIfHandlerFailFromBadRequest(t *testing.T) {
+	for name, data := range map[string]string{
+		"no precondition": `{"value": {"owner": "b"}}`,
+		"no value":        `{"expected": {"owner": "a"}}`,
+		"bad timestamp":   `{"expectedTimestamp": "yesterday", "value": {"owner": "b"}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := &mockTopicManager{}
+			s, c := SetupStuff(m)
+
+			s.publishIfHandler(c, publishIfMsg(data))
+
+			if resp := publishIfResponse(t, s); resp.Code != http.StatusBadRequest {
+				t.Errorf("expected status bad request, got %d", resp.Code)
+			}
+			if m.IsMethodCalled {
+				t.Error("expected nothing to be published")
+			}
+		})
+	}
+}
+
+//------------------------------------------------------------------------ get with meta tests
+
+func TestGetHandlerWithMeta(t *testing.T) {
+	stored := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	schemaVersion := 2
+	m := &mockTopicManager{
+		MetaResult: topic.ValueMeta{Value: map[string]any{"value": "new"}, Timestamp: stored, SchemaVersion: &schemaVersion, Latest: true},
+	}
+	s, c := SetupStuff(m)
+
+	s.getHandler(c, network.WebSocketMessage{
+		MessageId: "getMeta",
+		Action:    "get",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{Meta: true},
+	})
+
+	if !m.AtResult.IsZero() {
+		t.Errorf("expected the latest value to be asked for, got %s", m.AtResult)
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatal("expected status ok")
+	}
+	encoded, err := json.Marshal(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"topic":"testTopic","value":{"value":"new"},"timestamp":"2025-01-01T12:00:00Z","schemaVersion":2,"latest":true}`
+	if string(encoded) != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestGetHandlerWithMetaUnknown(t *testing.T) {
+	m := &mockTopicManager{
+		MetaResult: topic.ValueMeta{Value: "old"},
+	}
+	s, c := SetupStuff(m)
+
+	s.getHandler(c, network.WebSocketMessage{
+		MessageId: "getMeta",
+		Action:    "get",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{At: "2025-01-01T12:00:30Z", Meta: true},
+	})
+
+	if !m.AtResult.Equal(time.Date(2025, 1, 1, 12, 0, 30, 0, time.UTC)) {
+		t.Errorf("expected at time to be passed to topic manager, got %s", m.AtResult)
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatal("expected status ok")
+	}
+	encoded, err := json.Marshal(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// metadata that isn't known is left out
+	expected := `{"topic":"testTopic","value":"old","latest":false}`
+	if string(encoded) != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestGetHandlerWithMetaFailFromNoHistory(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("couldn't get value for topic: %w", storage.ErrHistoryNotSupported),
+	}
+	s, c := SetupStuff(m)
+
+	s.getHandler(c, network.WebSocketMessage{
+		MessageId: "getMeta",
+		Action:    "get",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{At: "2025-01-01T12:00:30Z", Meta: true},
+	})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+//------------------------------------------------------------------------ get recent handler tests
+
+func TestGetRecentHandler(t *testing.T) {
+	count := 3
+	m := &mockTopicManager{
+		RecentResult: []any{"newest", "middle", "oldest"},
+	}
+	s, c := SetupStuff(m)
+
+	s.getRecentHandler(c, network.WebSocketMessage{
+		MessageId: "getRecent",
+		Action:    "getRecent",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{Count: &count},
+	})
+
+	if m.CountResult != 3 {
+		t.Errorf("expected count to be passed to topic manager, got %d", m.CountResult)
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatal("expected status ok")
+	}
+	if values, ok := resp.Data.([]any); !ok || len(values) != 3 || values[0] != "newest" {
+		t.Errorf("expected the recent values in order, got %v", resp.Data)
+	}
+}
+
+func TestGetRecentHandlerDefaultCount(t *testing.T) {
+	m := &mockTopicManager{RecentResult: []any{}}
+	s, c := SetupStuff(m)
+
+	s.getRecentHandler(c, network.WebSocketMessage{MessageId: "getRecent", Action: "getRecent", Topic: "testTopic"})
+
+	if m.CountResult != DEFAULT_RECENT_COUNT {
+		t.Errorf("expected default count %d, got %d", DEFAULT_RECENT_COUNT, m.CountResult)
+	}
+}
+
+func TestGetRecentHandlerFailFromInvalidCount(t *testing.T) {
+	for _, count := range []int{0, -1, MAX_RECENT_COUNT + 1} {
+		m := &mockTopicManager{}
+		s, c := SetupStuff(m)
+
+		s.getRecentHandler(c, network.WebSocketMessage{
+			MessageId: "getRecent",
+			Action:    "getRecent",
+			Topic:     "testTopic",
+			Options:   &network.MessageOptions{Count: &count},
+		})
+
+		if m.IsMethodCalled {
+			t.Errorf("count %d: expected topic manager method to not be called", count)
+		}
+		if len(s.sent) != 1 {
+			t.Fatalf("count %d: expected 1 message", count)
+		}
+		resp, ok := s.sent[0].(network.Response)
+		if !ok || resp.Code != http.StatusBadRequest {
+			t.Errorf("count %d: expected status bad request", count)
+		}
+	}
+}
+
+func TestGetRecentHandlerFailFromNoHistory(t *testing.T) {
+	m := &mockTopicManager{
+		ErrorResult: fmt.Errorf("couldn't get recent values for topic: %w", storage.ErrHistoryNotSupported),
+	}
+	s, c := SetupStuff(m)
+
+	s.getRecentHandler(c, network.WebSocketMessage{MessageId: "getRecent", Action: "getRecent", Topic: "testTopic"})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusBadRequest {
+		t.Error("expected status bad request")
+	}
+}
+
+//------------------------------------------------------------------------ chunked response tests
+
+// sentChunks will return the responses sent to the test server, failing if any of them isn't a chunk.
+func sentChunks(t *testing.T, s *testServer) []network.Response {
+	t.Helper()
+	var chunks []network.Response
+	for _, sent := range s.sent {
+		resp, ok := sent.(network.Response)
+		if !ok || resp.Code != http.StatusOK || resp.Chunk == nil {
+			t.Fatalf("expected a successful chunk, got %+v", sent)
+		}
+		chunks = append(chunks, resp)
+	}
+	return chunks
+}
+
+func TestGetHandlerChunked(t *testing.T) {
+	value := map[string]any{"text": strings.Repeat("é and some ascii ", 200)}
+	m := &mockTopicManager{MapResult: value}
+	s, c := SetupStuff(m)
+	s.config = &config.Config{ChunkSize: 256}
+
+	s.getHandler(c, network.WebSocketMessage{
+		MessageId: "get",
+		Action:    "get",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{Chunked: true},
+	})
+
+	chunks := sentChunks(t, s)
+	if len(chunks) < 2 {
+		t.Fatalf("expected the value to be split into chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if chunk.Chunk.Index != i || chunk.Chunk.Final != (i == len(chunks)-1) {
+			t.Errorf("expected chunk %d in order with only the last final, got %+v", i, chunk.Chunk)
+		}
+		if piece := chunk.Data.(string); len(piece) > 256 {
+			t.Errorf("expected chunk %d to be at most the chunk size, got %d bytes", i, len(piece))
+		}
+	}
+
+	joined, err := networktest.ReassembleChunks(chunks)
+	if err != nil {
+		t.Fatalf("unexpected error reassembling chunks: %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(joined, &got); err != nil {
+		t.Fatalf("expected reassembled chunks to be json: %v", err)
+	}
+	if !reflect.DeepEqual(got, value) {
+		t.Error("expected reassembled chunks to be the topic value")
+	}
+}
+
+func TestGetHandlerChunkedSmallValue(t *testing.T) {
+	m := &mockTopicManager{MapResult: "small"}
+	s, c := SetupStuff(m)
+
+	s.getHandler(c, network.WebSocketMessage{
+		MessageId: "get",
+		Action:    "get",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{Chunked: true},
+	})
+
+	chunks := sentChunks(t, s)
+	if len(chunks) != 1 || !chunks[0].Chunk.Final || chunks[0].Data != `"small"` {
+		t.Errorf("expected one final chunk, got %+v", chunks)
+	}
+}
+
+func TestGetRecentHandlerChunked(t *testing.T) {
+	values := []any{strings.Repeat("a", 100), strings.Repeat("b", 100), strings.Repeat("c", 100)}
+	m := &mockTopicManager{RecentResult: values}
+	s, c := SetupStuff(m)
+	s.config = &config.Config{ChunkSize: 64}
+
+	s.getRecentHandler(c, network.WebSocketMessage{
+		MessageId: "getRecent",
+		Action:    "getRecent",
+		Topic:     "testTopic",
+		Options:   &network.MessageOptions{Chunked: true},
+	})
+
+	chunks := sentChunks(t, s)
+	if len(chunks) < 5 {
+		t.Fatalf("expected the values to be split into chunks, got %d", len(chunks))
+	}
+	joined, err := networktest.ReassembleChunks(chunks)
+	if err != nil {
+		t.Fatalf("unexpected error reassembling chunks: %v", err)
+	}
+	var got []any
+	if err := json.Unmarshal(joined, &got); err != nil || !reflect.DeepEqual(got, values) {
+		t.Errorf("expected reassembled chunks to be the recent values, got %v, %v", got, err)
+	}
+}
+
+func TestGetHandlerNotChunkedByDefault(t *testing.T) {
+	m := &mockTopicManager{MapResult: strings.Repeat("a", 1000)}
+	s, c := SetupStuff(m)
+	s.config = &config.Config{ChunkSize: 64}
+
+	s.getHandler(c, network.WebSocketMessage{MessageId: "get", Action: "get", Topic: "testTopic"})
+
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Chunk != nil || resp.Data != m.MapResult {
+		t.Errorf("expected the whole value in one response, got %+v", s.sent[0])
+	}
+}
+
+//------------------------------------------------------------------------ disabled action tests
+
+func TestDisabledActionRejected(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := newRegisteredTestServer(m, &config.Config{DisabledActions: []string{"unregisterTopic", "updateSchema"}})
+
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "disabled", Action: "unregisterTopic", Topic: "testTopic", RequireAck: true})
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager method to not be called for disabled action")
+	}
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusForbidden {
+		t.Error("expected status forbidden")
+	}
+
+	// actions that aren't disabled still work
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "enabled", Action: "subscribe", Topic: "testTopic", RequireAck: true})
+
+	if !m.IsMethodCalled {
+		t.Error("expected topic manager method to be called for enabled action")
+	}
+	if len(s.sent) != 2 {
+		t.Fatal("expected 2 messages")
+	}
+	resp, ok = s.sent[1].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Error("expected status ok")
+	}
+}
+
+//------------------------------------------------------------------------ compact response tests
+
+func TestGetHandlerCompactVsFullResponse(t *testing.T) {
+	get := network.WebSocketMessage{MessageId: "get", Action: "get", Topic: "testTopic"}
+
+	m := &mockTopicManager{MapResult: map[string]any{"value": "hello"}}
+	s, c := SetupStuff(m)
+	s.getHandler(c, get)
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	full, err := json.Marshal(s.sent[0])
+	if err != nil {
+		t.Fatalf("unexpected error marshaling response: %v", err)
+	}
+	if string(full) != `{"id":"get","action":"get","code":200,"data":{"value":"hello"},"type":"response"}` {
+		t.Errorf("unexpected full response: %s", full)
+	}
+
+	m = &mockTopicManager{MapResult: map[string]any{"value": "hello"}}
+	s, c = SetupStuff(m)
+	get.Options = &network.MessageOptions{Compact: true}
+	s.getHandler(c, get)
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	compact, err := json.Marshal(s.sent[0])
+	if err != nil {
+		t.Fatalf("unexpected error marshaling response: %v", err)
+	}
+	if string(compact) != `{"id":"get","data":{"value":"hello"}}` {
+		t.Errorf("unexpected compact response: %s", compact)
+	}
+}
+
+func TestPublishHandlerCompactForClient(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+	c.CompactResponses = true
+
+	s.publishHandler(c, publishSuccessWithAck)
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	compact, err := json.Marshal(s.sent[0])
+	if err != nil {
+		t.Fatalf("unexpected error marshaling response: %v", err)
+	}
+	if string(compact) != `{"id":"publishWithAck"}` {
+		t.Errorf("unexpected compact response: %s", compact)
+	}
+}
+
+func TestCompactResponseErrorsKeepFullEnvelope(t *testing.T) {
+	m := &mockTopicManager{ErrorResult: fmt.Errorf("topic manager failed")}
+	s, c := SetupStuff(m)
+	c.CompactResponses = true
+
+	s.getHandler(c, network.WebSocketMessage{MessageId: "get", Action: "get", Topic: "testTopic"})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusInternalServerError || resp.Type != "response" {
+		t.Errorf("expected full error response, got %+v", s.sent[0])
+	}
+}
+
+//------------------------------------------------------------------------ default value tests
+
+func TestPublishHandlerPublishesValueWithDefaults(t *testing.T) {
+	filled := map[string]any{"message": "hello world", "priority": "normal"}
+	m := &mockTopicManager{DefaultsResult: filled}
+	s, c := SetupStuff(m)
+
+	s.publishHandler(c, publishSuccessWithAck)
+
+	published, ok := m.PublishedValue.(map[string]any)
+	if !ok || published["priority"] != "normal" {
+		t.Errorf("expected the value with defaults to be published, got %v", m.PublishedValue)
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Error("expected status ok")
+	}
+}
+
+func TestRegisterHandlerFillDefaults(t *testing.T) {
+	m := &mockTopicManager{}
+	s, client := SetupStuff(m)
+
+	msg := registerTopicSuccesssMsg
+	msg.Options = &network.MessageOptions{FillDefaults: true}
+	s.registerTopicHandler(client, msg)
+
+	if !m.TopicOptions.FillDefaults {
+		t.Error("expected fill defaults to be passed to topic manager")
+	}
+}
+
+//------------------------------------------------------------------- server stats handler tests
+
+func TestServerStatsCountsClientsTopicsAndSubscriptions(t *testing.T) {
+	tm := topic.NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := tm.RegisterTopic(name, map[string]any{"x": ""}, topic.TopicOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hub := network.NewClientHub()
+	first, second := network.NewClient(nil, "first"), network.NewClient(nil, "second")
+	hub.AddClient(first)
+	hub.AddClient(second)
+	for _, name := range []string{"a", "b"} {
+		if err := tm.Subscribe(name, first, topic.SubscriptionOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tm.Subscribe("a", second, topic.SubscriptionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, c := SetupStuff(&mockTopicManager{})
+	s.topicManager = tm
+	s.hub = hub
+	s.serverStatsHandler(c, network.WebSocketMessage{MessageId: "stats", Action: "serverStats"})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatal("expected status ok")
+	}
+	stats, ok := resp.Data.(network.ServerStatsResponse)
+	if !ok {
+		t.Fatalf("expected server stats, got %T", resp.Data)
+	}
+	want := network.ServerStatsResponse{Clients: 2, Topics: 3, Subscriptions: 3}
+	if stats != want {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+
+	// counts follow clients leaving and topics going away
+	hub.RemoveClient(second, network.DisconnectClosed, "")
+	tm.UnsubscribeAll(second)
+	if err := tm.UnregisterTopic(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	want = network.ServerStatsResponse{Clients: 1, Topics: 2, Subscriptions: 1}
+	if stats := s.serverStats(); stats != want {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+}
+
+//------------------------------------------------------------------- topic exists handler tests
+
+func TestTopicExistsForRegisteredTopic(t *testing.T) {
+	s, c, tm := setupRealTopicManager()
+	if _, err := tm.RegisterTopic("testTopic", map[string]any{"message": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.UpdateSchema("testTopic", map[string]any{"message": "", "sender": ""}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.topicExistsHandler(c, network.WebSocketMessage{MessageId: "exists", Action: "topicExists", Topic: "testTopic"})
+
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	data, ok := resp.Data.(network.TopicExistsResponse)
+	if !ok || !data.Exists || data.SchemaVersion == nil || *data.SchemaVersion != 1 {
+		t.Errorf("expected the topic to exist at schema version 1, got %+v", resp.Data)
+	}
+}
+
+func TestTopicExistsForMissingTopic(t *testing.T) {
+	s, c, tm := setupRealTopicManager()
+
+	s.topicExistsHandler(c, network.WebSocketMessage{MessageId: "exists", Action: "topicExists", Topic: "missing"})
+
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	if data, ok := resp.Data.(network.TopicExistsResponse); !ok || data.Exists || data.SchemaVersion != nil {
+		t.Errorf("expected the topic to not exist, got %+v", resp.Data)
+	}
+	if tm.HasTopic("missing") {
+		t.Error("expected checking a topic to not register it")
+	}
+}
+
+//------------------------------------------------------------------- storage stats handler tests
+
+func TestStorageStatsCountsKeys(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	for _, key := range []string{"a", "b"} {
+		if err := <-db.AsyncPut(context.Background(), key, 1, time.Now().UTC(), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, c := SetupStuff(&mockTopicManager{})
+	s.topicManager = topic.NewTopicManager(db, &config.Config{})
+	s.storageStatsHandler(c, network.WebSocketMessage{MessageId: "storage", Action: "storageStats"})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatal("expected status ok")
+	}
+	want := network.StorageStatsResponse{Keys: 2}
+	if stats, ok := resp.Data.(network.StorageStatsResponse); !ok || stats != want {
+		t.Errorf("expected %+v, got %+v", want, resp.Data)
+	}
+}
+
+func TestLockStatsOnlyIncludesTopicsInScope(t *testing.T) {
+	m := &mockTopicManager{LockResult: []logging.LockStats{
+		{Component: "TopicManager", Method: "Publish", Mode: "RLock", Acquisitions: 10, TotalWait: time.Millisecond, MaxWait: time.Microsecond},
+		{Component: "Topic: app1/sensors", Method: "Publish", Mode: "Lock", Acquisitions: 4},
+		{Component: "Topic: app2/secret", Method: "Publish", Mode: "Lock", Acquisitions: 2},
+	}}
+	s, c := SetupStuff(m)
+	c.TopicPrefix = "app1/"
+	s.lockStatsHandler(c, network.WebSocketMessage{MessageId: "locks", Action: "lockStats"})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	want := network.LocksResponse{Locks: []network.LockStatsResponse{
+		{Component: "TopicManager", Method: "Publish", Mode: "RLock", Acquisitions: 10, TotalWait: time.Millisecond, MaxWait: time.Microsecond},
+		{Component: "Topic: sensors", Method: "Publish", Mode: "Lock", Acquisitions: 4},
+	}}
+	if !reflect.DeepEqual(resp.Data, want) {
+		t.Errorf("expected %+v, got %+v", want, resp.Data)
+	}
+}
+
+func TestStorageStatsError(t *testing.T) {
+	m := &mockTopicManager{ErrorResult: fmt.Errorf("storage is closed")}
+	s, c := SetupStuff(m)
+	s.storageStatsHandler(c, network.WebSocketMessage{MessageId: "storage", Action: "storageStats"})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusInternalServerError {
+		t.Error("expected status internal server error")
+	}
+}
+
+//------------------------------------------------------------------- capabilities handler tests
+
+func TestCapabilitiesListsRegisteredActions(t *testing.T) {
+	cfg := &config.Config{APIKey: "secret", StorageType: "sqlite", DisabledActions: []string{"getPattern"}, RequireRegisteredTopic: true}
+	server := NewWebSocketServer(network.NewClientHub(), &mockTopicManager{HistoryResult: true}, cfg)
+	t.Cleanup(func() { server.Close() })
+	s := testServer{WebSocketServer: server}
+	s.WebSocketServer.sender = &s
+
+	s.capabilitiesHandler(&network.Client{}, network.WebSocketMessage{MessageId: "caps", Action: "capabilities"})
+
+	if len(s.sent) != 1 {
+		t.Fatal("expected 1 message")
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatal("expected status ok")
+	}
+	caps, ok := resp.Data.(network.CapabilitiesResponse)
+	if !ok {
+		t.Fatalf("expected capabilities, got %T", resp.Data)
+	}
+
+	if len(caps.Actions) != len(server.handlers) {
+		t.Errorf("expected %d actions, got %v", len(server.handlers), caps.Actions)
+	}
+	for action := range server.handlers {
+		if !slices.Contains(caps.Actions, action) {
+			t.Errorf("expected registered action %s in capabilities", action)
+		}
+	}
+	if !slices.IsSorted(caps.Actions) {
+		t.Errorf("expected actions to be sorted, got %v", caps.Actions)
+	}
+	if !reflect.DeepEqual(caps.DisabledActions, []string{"getPattern"}) {
+		t.Errorf("expected getPattern to be disabled, got %v", caps.DisabledActions)
+	}
+	want := network.CapabilityFeatures{History: true, AuthMode: "apiKey", RequireRegisteredTopic: true}
+	if caps.Features != want {
+		t.Errorf("expected features %+v, got %+v", want, caps.Features)
+	}
+}
+
+func TestCapabilitiesHistoryFromStorage(t *testing.T) {
+	cfg := &config.Config{StorageType: "badger", StoragePath: t.TempDir()}
+	db, err := storage.NewStorage(cfg, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	server := NewWebSocketServer(network.NewClientHub(), topic.NewTopicManager(db, cfg), cfg)
+	t.Cleanup(func() { server.Close() })
+
+	if server.capabilities().Features.History {
+		t.Error("expected no history from a storage that only keeps the latest value")
+	}
+}
+
+//------------------------------------------------------------------- ttl tests
+
+func TestPublishAndSendWithoutSaveRejectNegativeTtl(t *testing.T) {
+	msg := network.WebSocketMessage{
+		MessageId:  "negativeTtl",
+		Topic:      "testTopic",
+		ParsedData: map[string]any{"message": "hello world"},
+		Options:    &network.MessageOptions{TtlMs: -1},
+	}
+	for action, handler := range map[string]func(*testServer) HandlerFunc{
+		"publish":         func(s *testServer) HandlerFunc { return s.publishHandler },
+		"sendWithoutSave": func(s *testServer) HandlerFunc { return s.sendWithoutSaveHandler },
+	} {
+		m := &mockTopicManager{}
+		s, c := SetupStuff(m)
+		msg.Action = action
+		handler(s)(c, msg)
+
+		if m.IsMethodCalled {
+			t.Errorf("%s: expected topic manager not to be called", action)
+		}
+		if len(s.sent) != 1 {
+			t.Fatalf("%s: expected 1 message", action)
+		}
+		resp, ok := s.sent[0].(network.Response)
+		if !ok || resp.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status bad request", action)
+		}
+	}
+}
+
+func TestPublishPassesTtlToTopicManager(t *testing.T) {
+	tm := topic.NewTopicManager(storagetest.NewRecordingStorage(), &config.Config{})
+	if _, err := tm.RegisterTopic("commands", map[string]any{"message": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, c := SetupStuff(&mockTopicManager{})
+	s.topicManager = tm
+	msg := network.WebSocketMessage{
+		MessageId:  "expiring",
+		Action:     "publish",
+		Topic:      "commands",
+		ParsedData: map[string]any{"message": "open"},
+		Options:    &network.MessageOptions{TtlMs: 1},
+	}
+	s.publishHandler(c, msg)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		value, err := tm.Get(context.Background(), "commands")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the value to expire, got %v", value)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+//------------------------------------------------------------------- priority tests
+
+func TestPublishAndSendWithoutSaveRejectUnknownPriority(t *testing.T) {
+	msg := network.WebSocketMessage{
+		MessageId:  "unknownPriority",
+		Topic:      "testTopic",
+		ParsedData: map[string]any{"message": "hello world"},
+		Options:    &network.MessageOptions{Priority: "urgent"},
+	}
+	for action, handler := range map[string]func(*testServer) HandlerFunc{
+		"publish":         func(s *testServer) HandlerFunc { return s.publishHandler },
+		"sendWithoutSave": func(s *testServer) HandlerFunc { return s.sendWithoutSaveHandler },
+	} {
+		m := &mockTopicManager{}
+		s, c := SetupStuff(m)
+		msg.Action = action
+		handler(s)(c, msg)
+
+		if m.IsMethodCalled {
+			t.Errorf("%s: expected topic manager not to be called", action)
+		}
+		if len(s.sent) != 1 {
+			t.Fatalf("%s: expected 1 message", action)
+		}
+		resp, ok := s.sent[0].(network.Response)
+		if !ok || resp.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status bad request", action)
+		}
+	}
+}
+
+func TestPublishAndSendWithoutSaveRejectInvalidHeaders(t *testing.T) {
+	tooMany := make(map[string]string, MAX_HEADERS+1)
+	for i := 0; i <= MAX_HEADERS; i++ {
+		tooMany[fmt.Sprintf("header-%d", i)] = "value"
+	}
+	for name, headers := range map[string]map[string]string{
+		"too many":   tooMany,
+		"blank name": {" ": "value"},
+		"too big":    {"trace": strings.Repeat("x", MAX_HEADER_BYTES)},
+	} {
+		for action, handler := range map[string]func(*testServer) HandlerFunc{
+			"publish":         func(s *testServer) HandlerFunc { return s.publishHandler },
+			"sendWithoutSave": func(s *testServer) HandlerFunc { return s.sendWithoutSaveHandler },
+		} {
+			m := &mockTopicManager{}
+			s, c := SetupStuff(m)
+			msg := network.WebSocketMessage{MessageId: "headers", Action: action, Topic: "testTopic", ParsedData: map[string]any{"message": "hello world"}, Headers: headers}
+			handler(s)(c, msg)
+
+			if m.IsMethodCalled {
+				t.Errorf("%s %s: expected topic manager not to be called", name, action)
+			}
+			if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+				t.Errorf("%s %s: expected status bad request, got %+v", name, action, s.sent[0])
+			}
+		}
+	}
+}
+
+func TestPublishAcceptsHighPriority(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+	msg := network.WebSocketMessage{
+		MessageId:  "highPriority",
+		Action:     "publish",
+		Topic:      "testTopic",
+		ParsedData: map[string]any{"message": "stop"},
+		RequireAck: true,
+		Options:    &network.MessageOptions{Priority: "high"},
+	}
+	s.publishHandler(c, msg)
+
+	if !m.IsMethodCalled {
+		t.Error("expected the message to be published")
+	}
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Errorf("expected status ok, got %+v", s.sent[0])
+	}
+}
+
+//------------------------------------------------------------------- delivery report tests
+
+func TestPublishDeliveryReport(t *testing.T) {
+	delivery := network.DeliveryStats{Targeted: 3, Delivered: 2, Failed: 1}
+	for _, report := range []bool{true, false} {
+		m := &mockTopicManager{DeliveryResult: delivery}
+		s, c := SetupStuff(m)
+		s.publishHandler(c, network.WebSocketMessage{
+			MessageId:  "report",
+			Action:     "publish",
+			Topic:      "alerts",
+			ParsedData: map[string]any{"level": "critical"},
+			RequireAck: true,
+			Options:    &network.MessageOptions{DeliveryReport: report},
+		})
+
+		if len(s.sent) != 1 {
+			t.Fatalf("expected 1 message, got %d", len(s.sent))
+		}
+		resp, ok := s.sent[0].(network.Response)
+		if !ok || resp.Code != http.StatusOK {
+			t.Fatalf("expected status ok, got %+v", s.sent[0])
+		}
+		if report && resp.Data != delivery {
+			t.Errorf("expected the delivery counts %+v, got %+v", delivery, resp.Data)
+		} else if !report && resp.Data != nil {
+			t.Errorf("expected no data without a delivery report, got %+v", resp.Data)
+		}
+	}
+}
+
+func TestPublishTransactionDeliveryReportAddsTopics(t *testing.T) {
+	m := &mockTopicManager{DeliveryResult: network.DeliveryStats{Targeted: 2, Delivered: 1, Failed: 1}}
+	s, c := SetupStuff(m)
+	msg := transactionMessage(`{"values": [{"topic": "debits", "data": {"total": 5}}, {"topic": "credits", "data": {"total": 5}}]}`)
+	msg.Options = &network.MessageOptions{DeliveryReport: true}
+	s.publishTransactionHandler(c, msg)
+
+	want := network.DeliveryStats{Targeted: 4, Delivered: 2, Failed: 2}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Data != want {
+		t.Errorf("expected the delivery counts of both topics %+v, got %+v", want, s.sent[0])
+	}
+}
+
+//------------------------------------------------------------------- auto register tests
+
+func autoRegisterMessage(autoRegister bool) network.WebSocketMessage {
+	return network.WebSocketMessage{
+		MessageId:  "autoRegister",
+		Action:     "publish",
+		Topic:      "sensors/new",
+		ParsedData: map[string]any{"temp": 21.5},
+		RequireAck: true,
+		Options:    &network.MessageOptions{AutoRegister: autoRegister},
+	}
+}
+
+func TestRegisterAndAutoRegisterPastMaxTopics(t *testing.T) {
+	s, c, _ := setupRealTopicManager()
+	s.topicManager = topic.NewTopicManager(storage.NewNullStorage(), &config.Config{MaxTopics: 1})
+
+	s.registerTopicHandler(c, registerTopicSuccesssMsg)
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected the first topic to be registered, got %+v", s.sent[0])
+	}
+
+	s.publishHandler(c, autoRegisterMessage(true))
+	resp, ok := s.sent[1].(network.Response)
+	if !ok || resp.Code != http.StatusTooManyRequests || resp.ErrorCode != "TOPIC_LIMIT_REACHED" {
+		t.Errorf("expected auto registering past the limit to fail, got %+v", s.sent[1])
+	}
+
+	past := registerTopicSuccesssMsg
+	past.Topic = "anotherTopic"
+	s.registerTopicHandler(c, past)
+	resp, ok = s.sent[2].(network.Response)
+	if !ok || resp.Code != http.StatusTooManyRequests || resp.ErrorCode != "TOPIC_LIMIT_REACHED" {
+		t.Errorf("expected registering past the limit to fail, got %+v", s.sent[2])
+	}
+}
+
+func TestPublishAutoRegisterRegistersBeforePublishing(t *testing.T) {
+	m := &mockTopicManager{BoolResult: true}
+	s, c := SetupStuff(m)
+	s.publishHandler(c, autoRegisterMessage(true))
+
+	if !m.AutoRegistered {
+		t.Error("expected the topic to be registered if missing")
+	}
+	if !m.IsMethodCalled {
+		t.Error("expected the value to be published")
+	}
+}
+
+func TestPublishWithoutAutoRegisterDoesNotRegister(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+	s.publishHandler(c, autoRegisterMessage(false))
+
+	if m.AutoRegistered {
+		t.Error("expected the topic not to be registered without autoRegister")
+	}
+}
+
+func TestPublishAutoRegisterBinaryWithoutSchema(t *testing.T) {
+	m := &mockTopicManager{TopicMissing: true}
+	s, c := SetupStuff(m)
+	msg := autoRegisterMessage(true)
+	msg.ParsedData = []byte{0x89, 'P', 'N', 'G'}
+	s.publishHandler(c, msg)
+
+	if !m.AutoRegistered || !m.TopicOptions.Binary {
+		t.Fatalf("expected a binary topic to be registered, got %+v", m.TopicOptions)
+	}
+	if m.AutoRegisterSchema != nil {
+		t.Errorf("expected a binary topic to be registered without a schema, got %v", m.AutoRegisterSchema)
+	}
+}
+
+func TestPublishAutoRegisterNestingTooDeep(t *testing.T) {
+	m := &mockTopicManager{ErrorResult: fmt.Errorf("schema: %w", topic.ErrNestingTooDeep)}
+	s, c := SetupStuff(m)
+	s.publishHandler(c, autoRegisterMessage(true))
+
+	if m.IsMethodCalled {
+		t.Error("expected nothing to be published")
+	}
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Errorf("expected status bad request, got %+v", s.sent[0])
+	}
+}
+
+// setupRealTopicManager will create a test server backed by a real topic manager with no storage.
+func setupRealTopicManager() (*testServer, *network.Client, topic.TopicManager) {
+	tm := topic.NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	s := testServer{WebSocketServer: &WebSocketServer{topicManager: tm}}
+	s.WebSocketServer.sender = &s
+	return &s, network.NewClient(nil, "publisher"), tm
+}
+
+func TestPublishAutoRegisterThenPublish(t *testing.T) {
+	s, c, tm := setupRealTopicManager()
+	s.publishHandler(c, autoRegisterMessage(true))
+
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	if match, err := tm.IsSchemaMatch("sensors/new", map[string]any{"temp": 21.5}); err != nil || !match {
+		t.Errorf("expected topic to be registered with the value as its schema, got %v, %v", match, err)
+	}
+	value, err := tm.Get(context.Background(), "sensors/new")
+	if err != nil {
+		t.Fatalf("unexpected error getting value: %v", err)
+	}
+	if !reflect.DeepEqual(value, map[string]any{"temp": 21.5}) {
+		t.Errorf("expected published value, got %v", value)
+	}
+
+	// a later publish with autoRegister uses the topic that is already there
+	msg := autoRegisterMessage(true)
+	msg.ParsedData = map[string]any{"temp": 22.0}
+	s.publishHandler(c, msg)
+	if resp, ok := s.sent[1].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[1])
+	}
+	if match, _ := tm.IsSchemaMatch("sensors/new", map[string]any{"temp": 21.5}); !match {
+		t.Error("expected the schema to be left as it was registered")
+	}
+}
+
+func TestPublishMissingTopicFailsWithoutAutoRegister(t *testing.T) {
+	s, c, tm := setupRealTopicManager()
+	s.publishHandler(c, autoRegisterMessage(false))
+
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code == http.StatusOK {
+		t.Errorf("expected an error response, got %+v", s.sent[0])
+	}
+	if topics, _ := tm.ListTopics(); len(topics) != 0 {
+		t.Errorf("expected no topics to be registered, got %d", len(topics))
+	}
+}
+
+func TestPublishAutoRegisterUsesDefaultSchema(t *testing.T) {
+	s, c, _ := setupRealTopicManager()
+	tm := topic.NewTopicManager(storage.NewNullStorage(), &config.Config{}, topic.WithDefaultSchemas(topic.DefaultSchemas{
+		Default:    map[string]any{"id": ""},
+		Namespaces: map[string]any{"sensors/": map[string]any{"temp": 0.0, "unit": ""}},
+	}))
+	s.topicManager = tm
+
+	msg := autoRegisterMessage(true)
+	msg.ParsedData = map[string]any{"temp": 21.5, "unit": "C"}
+	s.publishHandler(c, msg)
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	if match, err := tm.IsSchemaMatch("sensors/new", map[string]any{"temp": 0.0, "unit": ""}); err != nil || !match {
+		t.Errorf("expected topic to be registered with the namespace's default schema, got %v, %v", match, err)
+	}
+
+	// the default schema is enforced, where one inferred from the first value would have taken this
+	msg.ParsedData = map[string]any{"temp": 22.0}
+	s.publishHandler(c, msg)
+	if resp, ok := s.sent[1].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Errorf("expected a value missing a field of the default schema to be rejected, got %+v", s.sent[1])
+	}
+}
+
+func TestPublishAutoRegisterRejectsFirstValueNotMatchingDefaultSchema(t *testing.T) {
+	s, c, _ := setupRealTopicManager()
+	tm := topic.NewTopicManager(storage.NewNullStorage(), &config.Config{}, topic.WithDefaultSchemas(topic.DefaultSchemas{
+		Default: map[string]any{"temp": 0.0, "unit": ""},
+	}))
+	s.topicManager = tm
+
+	s.publishHandler(c, autoRegisterMessage(true))
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Errorf("expected the first value to be validated against the default schema, got %+v", s.sent[0])
+	}
+	if match, _ := tm.IsSchemaMatch("sensors/new", map[string]any{"temp": 0.0, "unit": ""}); !match {
+		t.Error("expected topic to be registered with the default schema")
+	}
+}
+
+//------------------------------------------------------------------- require registered topic tests
+
+// setupLazyTopics will create a test server backed by a real topic manager, with requireRegisteredTopic set.
+func setupLazyTopics(requireRegisteredTopic bool) (*testServer, *network.Client, topic.TopicManager) {
+	s, c, tm := setupRealTopicManager()
+	s.config = &config.Config{RequireRegisteredTopic: requireRegisteredTopic}
+	return s, c, tm
+}
+
+func TestRequireRegisteredTopic_RejectsMissingTopic(t *testing.T) {
+	handlers := map[string]func(s *testServer, c *network.Client){
+		"publish": func(s *testServer, c *network.Client) {
+			s.publishHandler(c, autoRegisterMessage(false))
+		},
+		"sendWithoutSave": func(s *testServer, c *network.Client) {
+			msg := autoRegisterMessage(false)
+			msg.Action = "sendWithoutSave"
+			s.sendWithoutSaveHandler(c, msg)
+		},
+		"subscribe": func(s *testServer, c *network.Client) {
+			s.subscribeHandler(c, network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "sensors/new", RequireAck: true})
+		},
+	}
+	for name, handle := range handlers {
+		s, c, tm := setupLazyTopics(true)
+		handle(s, c)
+
+		if len(s.sent) != 1 {
+			t.Fatalf("%s: expected 1 message, got %d", name, len(s.sent))
+		}
+		if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest || !strings.Contains(resp.Message, "isn't registered") {
+			t.Errorf("%s: expected status bad request for an unregistered topic, got %+v", name, s.sent[0])
+		}
+		if tm.HasTopic("sensors/new") {
+			t.Errorf("%s: expected the topic not to be created", name)
+		}
+	}
+}
+
+func TestRequireRegisteredTopic_OffCreatesTopicOnPublish(t *testing.T) {
+	s, c, tm := setupLazyTopics(false)
+	s.publishHandler(c, autoRegisterMessage(false))
+
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	topics, _ := tm.ListTopics()
+	if len(topics) != 1 || topics[0].ValidationMode() != topic.ValidationOff {
+		t.Fatalf("expected one topic created with validation off, got %v", topics)
+	}
+	if schema, err := topics[0].GetLatestSchema(); err != nil || schema.Schema != nil {
+		t.Errorf("expected topic to be created with no schema, got %+v, %v", schema, err)
+	}
+	value, err := tm.Get(context.Background(), "sensors/new")
+	if err != nil {
+		t.Fatalf("unexpected error getting value: %v", err)
+	}
+	if !reflect.DeepEqual(value, map[string]any{"temp": 21.5}) {
+		t.Errorf("expected published value, got %v", value)
+	}
+
+	// with no schema, any value can be published to the topic
+	msg := autoRegisterMessage(false)
+	msg.ParsedData = map[string]any{"humidity": "high"}
+	s.publishHandler(c, msg)
+	if resp, ok := s.sent[1].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Errorf("expected status ok, got %+v", s.sent[1])
+	}
+}
+
+func TestRequireRegisteredTopic_OffCreatesTopicOnSubscribe(t *testing.T) {
+	s, c, tm := setupLazyTopics(false)
+	s.subscribeHandler(c, network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "sensors/new", RequireAck: true})
+
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	if !tm.HasTopic("sensors/new") {
+		t.Error("expected the topic to be created")
+	}
+}
+
+//------------------------------------------------------------------- transaction tests
+
+func transactionMessage(data string) network.WebSocketMessage {
+	return network.WebSocketMessage{
+		MessageId:  "transfer",
+		Action:     "publishTransaction",
+		Data:       json.RawMessage(data),
+		RequireAck: true,
+	}
+}
+
+func TestPublishTransaction_PublishesEveryValue(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+	s.publishTransactionHandler(c, transactionMessage(`{"values": [
+		{"topic": "debits", "data": {"total": 5}},
+		{"topic": "credits", "data": {"total": 5}}
+	]}`))
+
+	want := []topic.TopicValue{
+		{Topic: "debits", Value: map[string]any{"total": 5.0}},
+		{Topic: "credits", Value: map[string]any{"total": 5.0}},
+	}
+	if !reflect.DeepEqual(m.TransactionValues, want) {
+		t.Errorf("expected values %+v, got %+v", want, m.TransactionValues)
+	}
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Errorf("expected status ok, got %+v", s.sent[0])
+	}
+}
+
+func TestPublishTransaction_InvalidRequestPublishesNothing(t *testing.T) {
+	tests := map[string]string{
+		"not a transaction": `[1, 2]`,
+		"no values":         `{"values": []}`,
+		"no topic":          `{"values": [{"data": {"total": 5}}]}`,
+		"duplicate topic":   `{"values": [{"topic": "debits", "data": {"total": 5}}, {"topic": "debits", "data": {"total": 6}}]}`,
+		"no data":           `{"values": [{"topic": "debits"}]}`,
+	}
+	for name, data := range tests {
+		m := &mockTopicManager{}
+		s, c := SetupStuff(m)
+		s.publishTransactionHandler(c, transactionMessage(data))
+
+		if m.IsMethodCalled {
+			t.Errorf("%s: expected topic manager not to be called", name)
+		}
+		if len(s.sent) != 1 {
+			t.Fatalf("%s: expected 1 message, got %d", name, len(s.sent))
+		}
+		if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status bad request, got %+v", name, s.sent[0])
+		}
+	}
+}
+
+func TestPublishTransaction_InvalidValuePublishesNothing(t *testing.T) {
+	m := &mockTopicManager{ValidationResult: fmt.Errorf("missing field total")}
+	s, c := SetupStuff(m)
+	s.publishTransactionHandler(c, transactionMessage(`{"values": [{"topic": "debits", "data": {"amount": 5}}]}`))
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager not to be called")
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest || !strings.Contains(resp.Message, "debits") {
+		t.Errorf("expected status bad request naming the topic, got %+v", s.sent[0])
+	}
+}
+
+func TestPublishTransaction_FailedTransaction(t *testing.T) {
+	m := &mockTopicManager{ErrorResult: fmt.Errorf("transaction failed, nothing was published")}
+	s, c := SetupStuff(m)
+	s.publishTransactionHandler(c, transactionMessage(`{"values": [{"topic": "debits", "data": {"total": 5}}]}`))
+
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusInternalServerError {
+		t.Errorf("expected status internal server error, got %+v", s.sent[0])
+	}
+}
+
+//------------------------------------------------------------------- update schema many tests
+
+func updateSchemaManyMessage(data string) network.WebSocketMessage {
+	return network.WebSocketMessage{
+		MessageId:  "bulkSchemas",
+		Action:     "updateSchemaMany",
+		Data:       json.RawMessage(data),
+		RequireAck: true,
+	}
+}
+
+func TestUpdateSchemaMany_ReportsPartialFailure(t *testing.T) {
+	s, c, tm := setupRealTopicManager()
+	for _, name := range []string{"orders", "invoices"} {
+		if _, err := tm.RegisterTopic(name, map[string]any{"total": 0.0}, topic.TopicOptions{}); err != nil {
+			t.Fatalf("couldn't register %s: %v", name, err)
+		}
+	}
+	initial, _ := tm.TopicSchemaVersion("orders")
+
+	s.updateSchemaManyHandler(c, updateSchemaManyMessage(`{"schemas": [
+		{"topic": "orders", "schema": {"total": 0, "currency": ""}},
+		{"topic": "missing", "schema": {"total": 0}},
+		{"topic": "invoices", "schema": {"total": 0, "paid": false}}
+	]}`))
+
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	result, ok := resp.Data.(network.UpdateSchemaManyResponse)
+	if !ok || result.Failed != 1 || len(result.Results) != 3 {
+		t.Fatalf("expected one of three topics to fail, got %+v", resp.Data)
+	}
+	for i, name := range []string{"orders", "missing", "invoices"} {
+		got := result.Results[i]
+		if got.Topic != name {
+			t.Errorf("expected result %d to be for %s, got %s", i, name, got.Topic)
+		}
+		if wantUpdated := name != "missing"; got.Updated != wantUpdated || (got.Error == "") != wantUpdated {
+			t.Errorf("expected %s updated to be %v, got %+v", name, wantUpdated, got)
+		}
+	}
+	if version, _ := tm.TopicSchemaVersion("orders"); result.Results[0].SchemaVersion != version || version != initial+1 {
+		t.Errorf("expected orders to be at schema version %d, got %d in the result and %d on the topic", initial+1, result.Results[0].SchemaVersion, version)
+	}
+	if version, _ := tm.TopicSchemaVersion("invoices"); version != initial+1 {
+		t.Errorf("expected invoices to be updated even though a topic before it failed, got version %d", version)
+	}
+}
+
+func TestUpdateSchemaMany_InvalidRequestUpdatesNothing(t *testing.T) {
+	tests := map[string]string{
+		"not a list":      `[1, 2]`,
+		"no schemas":      `{"schemas": []}`,
+		"no topic":        `{"schemas": [{"schema": {"total": 0}}]}`,
+		"duplicate topic": `{"schemas": [{"topic": "orders", "schema": {"total": 0}}, {"topic": "orders", "schema": {"paid": false}}]}`,
+		"no schema":       `{"schemas": [{"topic": "orders", "schema": {"total": 0}}, {"topic": "invoices"}]}`,
+	}
+	for name, data := range tests {
+		m := &mockTopicManager{}
+		s, c := SetupStuff(m)
+		s.updateSchemaManyHandler(c, updateSchemaManyMessage(data))
+
+		if m.IsMethodCalled {
+			t.Errorf("%s: expected topic manager not to be called", name)
+		}
+		if len(s.sent) != 1 {
+			t.Fatalf("%s: expected 1 message, got %d", name, len(s.sent))
+		}
+		if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status bad request, got %+v", name, s.sent[0])
+		}
+	}
+}
+
+//------------------------------------------------------------------- validate schema tests
+
+func validateSchemaMessage(data string) network.WebSocketMessage {
+	return network.WebSocketMessage{
+		MessageId: "candidate",
+		Action:    "validateSchema",
+		Topic:     "orders",
+		Data:      json.RawMessage(data),
+	}
+}
+
+func TestValidateSchema_RespondsWithCheck(t *testing.T) {
+	valid := false
+	m := &mockTopicManager{SchemaCheckResult: topic.SchemaCheck{
+		Compatible:   false,
+		Differences:  []string{"missing field: total"},
+		SampleValid:  &valid,
+		SampleErrors: []string{"missing field: total"},
+	}}
+	s, c := SetupStuff(m)
+	s.validateSchemaHandler(c, validateSchemaMessage(`{"schema": {"id": "", "total": 0}, "sample": {"id": "1"}}`))
+
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	check, ok := resp.Data.(network.ValidateSchemaResponse)
+	if !ok {
+		t.Fatalf("expected a validate schema response, got %T", resp.Data)
+	}
+	if check.Compatible || len(check.Differences) != 1 || check.SampleValid == nil || *check.SampleValid {
+		t.Errorf("unexpected check: %+v", check)
+	}
+}
+
+func TestValidateSchema_NoSchemaBadRequest(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+	s.validateSchemaHandler(c, validateSchemaMessage(`{"sample": {"id": "1"}}`))
+
+	if m.IsMethodCalled {
+		t.Error("expected topic manager not to be called")
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Errorf("expected status bad request, got %+v", s.sent[0])
+	}
+}
+
+func TestValidateSchema_Errors(t *testing.T) {
+	tests := map[error]int{
+		fmt.Errorf("schema is too deep: %w", topic.ErrNestingTooDeep): http.StatusBadRequest,
+		fmt.Errorf("could not get topic by name: orders"):             http.StatusInternalServerError,
+	}
+	for err, code := range tests {
+		m := &mockTopicManager{ErrorResult: err}
+		s, c := SetupStuff(m)
+		s.validateSchemaHandler(c, validateSchemaMessage(`{"schema": {"id": ""}}`))
+
+		if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != code {
+			t.Errorf("%v: expected status %d, got %+v", err, code, s.sent[0])
+		}
+	}
+}
+
+func migrateSchemaMessage(data string) network.WebSocketMessage {
+	return network.WebSocketMessage{
+		MessageId: "migration",
+		Action:    "migrateSchema",
+		Topic:     "orders",
+		Data:      json.RawMessage(data),
+	}
+}
+
+func TestMigrateSchema_RespondsWithResult(t *testing.T) {
+	m := &mockTopicManager{MigrationResult: topic.MigrationResult{SchemaVersion: 2, Migrated: true, Value: map[string]any{"total": 5.0}}}
+	s, c := SetupStuff(m)
+	s.migrateSchemaHandler(c, migrateSchemaMessage(`{"schema": {"total": 0}, "transform": {"rename": {"amount": "total"}, "drop": ["legacy"], "set": {"currency": "USD"}}}`))
+
+	if m.Migration.Rename["amount"] != "total" || len(m.Migration.Drop) != 1 || m.Migration.Set["currency"] != "USD" {
+		t.Errorf("unexpected migration passed to topic manager: %+v", m.Migration)
+	}
+	if len(s.sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(s.sent))
+	}
+	resp, ok := s.sent[0].(network.Response)
+	if !ok || resp.Code != http.StatusOK {
+		t.Fatalf("expected status ok, got %+v", s.sent[0])
+	}
+	result, ok := resp.Data.(network.MigrateSchemaResponse)
+	if !ok || result.SchemaVersion != 2 || !result.Migrated {
+		t.Errorf("unexpected migration response: %+v", resp.Data)
+	}
+}
+
+func TestMigrateSchema_Errors(t *testing.T) {
+	tests := map[error]int{
+		fmt.Errorf("%w: can't rename amount", topic.ErrMigrationFailed):    http.StatusBadRequest,
+		fmt.Errorf("schema is too deep: %w", topic.ErrNestingTooDeep):      http.StatusBadRequest,
+		fmt.Errorf("couldn't store migrated value for topic orders: full"): http.StatusInternalServerError,
+	}
+	for err, code := range tests {
+		m := &mockTopicManager{ErrorResult: err}
+		s, c := SetupStuff(m)
+		s.migrateSchemaHandler(c, migrateSchemaMessage(`{"schema": {"total": 0}}`))
+
+		if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != code {
+			t.Errorf("%v: expected status %d, got %+v", err, code, s.sent[0])
+		}
+	}
+
+	m := &mockTopicManager{}
+	s, c := SetupStuff(m)
+	s.migrateSchemaHandler(c, migrateSchemaMessage(`{"transform": {}}`))
+	if m.IsMethodCalled {
+		t.Error("expected topic manager not to be called without a schema")
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusBadRequest {
+		t.Errorf("expected status bad request, got %+v", s.sent[0])
+	}
+}
+
+//-------------------------------------------------------------------------- read only tests
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	for _, action := range writeActions {
+		t.Run(action, func(t *testing.T) {
+			m := &mockTopicManager{}
+			s, c := newRegisteredTestServer(m, &config.Config{ReadOnly: true})
+
+			s.RouteMessage(c, network.WebSocketMessage{MessageId: action, Action: action, Topic: "testTopic", Data: json.RawMessage(`{"a": 1}`), RequireAck: true})
+
+			if m.IsMethodCalled {
+				t.Error("expected topic manager method to not be called")
+			}
+			if len(s.sent) != 1 {
+				t.Fatalf("expected 1 message, got %d", len(s.sent))
+			}
+			resp, ok := s.sent[0].(network.Response)
+			if !ok || resp.Code != http.StatusServiceUnavailable || resp.ErrorCode != "SERVICE_READ_ONLY" {
+				t.Errorf("expected status 503 with SERVICE_READ_ONLY, got %+v", s.sent[0])
+			}
+		})
+	}
+}
+
+func TestReadOnlyAllowsReads(t *testing.T) {
+	for _, action := range []string{"subscribe", "unsubscribe", "get", "listTopics", "sendWithoutSave"} {
+		t.Run(action, func(t *testing.T) {
+			m := &mockTopicManager{}
+			s, c := newRegisteredTestServer(m, &config.Config{ReadOnly: true})
+
+			s.RouteMessage(c, network.WebSocketMessage{MessageId: action, Action: action, Topic: "testTopic", Data: json.RawMessage(`{"a": 1}`), RequireAck: true})
+
+			if !m.IsMethodCalled {
+				t.Error("expected topic manager method to be called")
+			}
+			for _, sent := range s.sent {
+				if resp, ok := sent.(network.Response); ok && resp.Code == http.StatusServiceUnavailable {
+					t.Errorf("expected %s to be allowed while read only, got %+v", action, resp)
+				}
+			}
+		})
+	}
+}
+
+func TestReadOnlyToggledAtRuntime(t *testing.T) {
+	m := &mockTopicManager{}
+	s, c := newRegisteredTestServer(m, &config.Config{})
+	publish := network.WebSocketMessage{MessageId: "pub", Action: "publish", Topic: "testTopic", Data: json.RawMessage(`{"a": 1}`), RequireAck: true}
+
+	s.SetReadOnly(true)
+	if !s.ReadOnly() || !s.capabilities().Features.ReadOnly {
+		t.Fatal("expected the server to be read only")
+	}
+	s.RouteMessage(c, publish)
+	if m.IsMethodCalled {
+		t.Error("expected publish to be rejected while read only")
+	}
+
+	s.SetReadOnly(false)
+	s.RouteMessage(c, publish)
+	if !m.IsMethodCalled {
+		t.Error("expected publish to go through after read only is turned off")
+	}
+	if resp, ok := s.sent[len(s.sent)-1].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Errorf("expected status ok, got %+v", s.sent[len(s.sent)-1])
+	}
+}
+
+func TestReadOnlyDoesntRegisterMissingTopics(t *testing.T) {
+	m := &mockTopicManager{TopicMissing: true}
+	s, c := newRegisteredTestServer(m, &config.Config{ReadOnly: true, RequireRegisteredTopic: false})
+
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "missing", RequireAck: true})
+
+	if m.IsMethodCalled {
+		t.Error("expected the topic to not be registered or subscribed to")
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusServiceUnavailable || resp.ErrorCode != "SERVICE_READ_ONLY" {
+		t.Errorf("expected status 503 with SERVICE_READ_ONLY, got %+v", s.sent[0])
+	}
+}
+
+func TestReadOnlyRejectsCustomWrites(t *testing.T) {
+	s, c := newRegisteredTestServer(&mockTopicManager{}, &config.Config{ReadOnly: true})
+	for action, writes := range map[string]bool{"customWrite": true, "customRead": false} {
+		err := s.RegisterHandlerWithOptions(action, func(c *network.Client, msg network.WebSocketMessage) {
+			s.AckResponseSuccess(c, msg)
+		}, HandlerOptions{Writes: writes})
+		if err != nil {
+			t.Fatalf("unexpected error registering handler: %v", err)
+		}
+	}
+
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "write", Action: "customWrite", RequireAck: true})
+	s.RouteMessage(c, network.WebSocketMessage{MessageId: "read", Action: "customRead", RequireAck: true})
+
+	if len(s.sent) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(s.sent))
+	}
+	if resp, ok := s.sent[0].(network.Response); !ok || resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the custom write to be rejected, got %+v", s.sent[0])
+	}
+	if resp, ok := s.sent[1].(network.Response); !ok || resp.Code != http.StatusOK {
+		t.Errorf("expected the custom read to be handled, got %+v", s.sent[1])
 	}
 }
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/metrics"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
+)
+
+func TestOtel_HandledRequestIsExported(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	otel.SetTracerProvider(tracerProvider)
+	t.Cleanup(func() { tracerProvider.Shutdown(context.Background()) })
+
+	cfg := &config.Config{GetReadThrough: true} // so the get reaches storage
+	tm := topic.NewTopicManager(storage.NewTracedStorage(storagetest.NewRecordingStorage()), cfg)
+	if _, err := tm.RegisterTopic("sensors", map[string]any{"temp": 0.0}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{WebSocketServer: NewWebSocketServer(nil, tm, cfg)}
+	s.WebSocketServer.sender = s
+	t.Cleanup(func() { s.Close() })
+
+	reader := sdkmetric.NewManualReader()
+	if _, err := metrics.NewOtelExporter(s.Metrics(), sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))); err != nil {
+		t.Fatal(err)
+	}
+
+	s.RouteMessage(&network.Client{Id: "client"}, network.WebSocketMessage{MessageId: "get", Action: "get", Topic: "sensors", RequireAck: true})
+
+	// the storage span is a child of the topic manager span, which is a child of the handler span
+	ended := spans.Ended()
+	names := make(map[string]sdktrace.ReadOnlySpan, len(ended))
+	for _, span := range ended {
+		names[span.Name()] = span
+	}
+	parents := map[string]string{"Storage.Get": "TopicManager.Get", "TopicManager.Get": "get"}
+	for child, parent := range parents {
+		c, ok := names[child]
+		if !ok {
+			t.Fatalf("expected a %s span, got %v", child, ended)
+		}
+		p, ok := names[parent]
+		if !ok {
+			t.Fatalf("expected a %s span, got %v", parent, ended)
+		}
+		if c.Parent().SpanID() != p.SpanContext().SpanID() {
+			t.Errorf("expected the %s span to be a child of the %s span", child, parent)
+		}
+	}
+	if names["get"].SpanContext().TraceID() != names["Storage.Get"].SpanContext().TraceID() {
+		t.Error("expected the spans to be in the same trace")
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != "dataloom.messages" {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				if action, _ := point.Attributes.Value(attribute.Key("action")); action.AsString() == "get" {
+					count = point.Value
+				}
+			}
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected 1 get message to be exported, got %d", count)
+	}
+}
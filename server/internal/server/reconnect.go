@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// RECONNECT_TOKEN_HEADER is the header a client is given its reconnect token in when it connects,
+// and sends it back in to resume or take over its client id.
+const RECONNECT_TOKEN_HEADER = "Reconnect-Token"
+
+// reconnectToken is the token a client id was last issued, and when it stops being accepted.
+type reconnectToken struct {
+	token   string
+	expires time.Time // zero while the client is connected
+}
+
+// tokenStore keeps the reconnect token issued to each client id, so only whoever has the token can
+// resume or take over the id. It only lives in memory.
+type tokenStore struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	tokens map[string]reconnectToken
+}
+
+// newTokenStore will create a store that accepts tokens for the ttl after their client
+// disconnects, or nil if the ttl is 0 so tokens aren't issued.
+func newTokenStore(ttl time.Duration) *tokenStore {
+	if ttl <= 0 {
+		return nil
+	}
+	return &tokenStore{ttl: ttl, tokens: make(map[string]reconnectToken)}
+}
+
+// tokenClaim is the token claim issued to a connection, and the token it replaced so it can be put
+// back if the connection never opens.
+type tokenClaim struct {
+	token       string
+	resumed     bool // the id was used with its token
+	previous    reconnectToken
+	hadPrevious bool
+}
+
+// claim will check the presented token lets a connection use the client id, and issue it a new
+// one that replaces the old token. An id with no token, or one that expired, can be used by anyone.
+// Returns false if the token is wrong.
+func (st *tokenStore) claim(clientId string, presented string, now time.Time) (tokenClaim, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var claimed tokenClaim
+	claimed.previous, claimed.hadPrevious = st.tokens[clientId]
+	if claimed.hadPrevious && (claimed.previous.expires.IsZero() || now.Before(claimed.previous.expires)) {
+		if subtle.ConstantTimeCompare([]byte(claimed.previous.token), []byte(presented)) != 1 {
+			return tokenClaim{}, false
+		}
+		claimed.resumed = true
+	}
+
+	claimed.token = newReconnectToken()
+	st.tokens[clientId] = reconnectToken{token: claimed.token}
+	return claimed, true
+}
+
+// unclaim will put back the token a claim replaced, for a connection that failed to open, so the
+// client that has it can still use it. Nothing changes if the id was claimed again since.
+func (st *tokenStore) unclaim(clientId string, claimed tokenClaim) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if current, ok := st.tokens[clientId]; !ok || current.token != claimed.token {
+		return
+	}
+	if claimed.hadPrevious {
+		st.tokens[clientId] = claimed.previous
+	} else {
+		delete(st.tokens, clientId)
+	}
+}
+
+// release will start the ttl of a token once its client disconnects. Nothing changes if the id
+// was issued another token since, such as when it was taken over. Tokens that expired are dropped.
+func (st *tokenStore) release(clientId string, token string, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id, current := range st.tokens {
+		if !current.expires.IsZero() && !now.Before(current.expires) {
+			delete(st.tokens, id)
+		}
+	}
+	if current, ok := st.tokens[clientId]; ok && current.token == token {
+		st.tokens[clientId] = reconnectToken{token: token, expires: now.Add(st.ttl)}
+	}
+}
+
+// newReconnectToken will return a random token that can't be guessed.
+func newReconnectToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
+)
+
+// newReconnectTestServer will start a server that issues reconnect tokens and restores
+// subscriptions, with a news topic registered.
+func newReconnectTestServer(t *testing.T) (*WebSocketServer, topic.TopicManager, string) {
+	cfg := &config.Config{ReconnectTokenTTL: time.Minute, SubscriptionRestoreWindow: time.Minute}
+	tm := topic.NewTopicManager(storage.NewNullStorage(), cfg)
+	s := NewWebSocketServer(network.NewClientHub(), tm, cfg)
+	t.Cleanup(func() { s.Close() })
+	if _, err := tm.RegisterTopic("news", map[string]any{"a": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return s, tm, "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// dialWithToken will connect to the server with the client id and reconnect token, and return
+// the connection with the token it was issued. Fails the test if the dial doesn't get the status.
+func dialWithToken(t *testing.T, url string, clientId string, token string, wantStatus int) (*websocket.Conn, string) {
+	t.Helper()
+	header := http.Header{"ClientId": []string{clientId}}
+	if token != "" {
+		header.Set(RECONNECT_TOKEN_HEADER, token)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if resp == nil {
+		t.Fatalf("expected a response, got %v", err)
+	}
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("expected status %d, got %d", wantStatus, resp.StatusCode)
+	}
+	if err != nil {
+		return nil, ""
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, resp.Header.Get(RECONNECT_TOKEN_HEADER)
+}
+
+func TestReconnectToken_RequiredToResume(t *testing.T) {
+	s, tm, url := newReconnectTestServer(t)
+
+	conn, token := dialWithToken(t, url, "stable-client", "", http.StatusSwitchingProtocols)
+	if token == "" {
+		t.Fatal("expected a reconnect token in the handshake")
+	}
+	subscribeOver(t, conn, "news", nil)
+	disconnect(t, s, conn)
+
+	// knowing the id isn't enough to resume it
+	dialWithToken(t, url, "stable-client", "", http.StatusForbidden)
+	dialWithToken(t, url, "stable-client", "guessed", http.StatusForbidden)
+	if tm.Stats().SubscriptionCount != 0 {
+		t.Fatal("expected nothing to be restored without the token")
+	}
+
+	conn, rotated := dialWithToken(t, url, "stable-client", token, http.StatusSwitchingProtocols)
+	if rotated == "" || rotated == token {
+		t.Errorf("expected a new token on each connect, got %q", rotated)
+	}
+	var restoredMsg network.WebSocketMessage
+	if err := conn.ReadJSON(&restoredMsg); err != nil {
+		t.Fatal(err)
+	}
+	if restoredMsg.Action != "subscriptionsRestored" || string(restoredMsg.Data) != `{"topics":["news"]}` {
+		t.Errorf("expected news to be restored with the token, got %s %s", restoredMsg.Action, restoredMsg.Data)
+	}
+
+	// the old token was replaced, so it can't be used again
+	disconnect(t, s, conn)
+	dialWithToken(t, url, "stable-client", token, http.StatusForbidden)
+	dialWithToken(t, url, "stable-client", rotated, http.StatusSwitchingProtocols)
+}
+
+func TestReconnectToken_TakesOverConnectedClient(t *testing.T) {
+	s, _, url := newReconnectTestServer(t)
+
+	first, token := dialWithToken(t, url, "stable-client", "", http.StatusSwitchingProtocols)
+	waitForClient(t, s, "stable-client")
+	dialWithToken(t, url, "stable-client", "", http.StatusForbidden)
+
+	dialWithToken(t, url, "stable-client", token, http.StatusSwitchingProtocols)
+	if record := waitForDisconnect(t, s); record.Reason != network.DisconnectTakenOver {
+		t.Errorf("expected the first connection to be taken over, got %+v", record)
+	}
+	if err := first.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := first.ReadMessage(); !websocket.IsCloseError(err, network.CLOSE_TAKEN_OVER) {
+		t.Errorf("expected the first connection to be closed as taken over, got %v", err)
+	}
+	waitForClient(t, s, "stable-client")
+}
+
+func TestReconnectToken_FailedUpgradeKeepsToken(t *testing.T) {
+	s, _, url := newReconnectTestServer(t)
+
+	first, token := dialWithToken(t, url, "stable-client", "", http.StatusSwitchingProtocols)
+	waitForClient(t, s, "stable-client")
+
+	// a plain request with the token can't be upgraded, so it shouldn't use the token up
+	request, err := http.NewRequest(http.MethodGet, "http"+strings.TrimPrefix(url, "ws"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("ClientId", "stable-client")
+	request.Header.Set(RECONNECT_TOKEN_HEADER, token)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the upgrade to fail with status bad request, got %d", resp.StatusCode)
+	}
+
+	if disconnects := s.hub.RecentDisconnects(); len(disconnects) != 0 {
+		t.Errorf("expected the connected client to not be taken over, got %+v", disconnects)
+	}
+	if err := first.WriteJSON(network.WebSocketMessage{MessageId: "1", Action: "listTopics", RequireAck: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := first.ReadMessage(); err != nil {
+		t.Errorf("expected the first connection to still be open, got %v", err)
+	}
+
+	dialWithToken(t, url, "stable-client", token, http.StatusSwitchingProtocols)
+	if record := waitForDisconnect(t, s); record.Reason != network.DisconnectTakenOver {
+		t.Errorf("expected the first connection to be taken over with its token, got %+v", record)
+	}
+}
+
+func TestReconnectToken_OffByDefault(t *testing.T) {
+	s, _, url := newDisconnectTestServer(t)
+
+	_, token := dialWithToken(t, url, "stable-client", "", http.StatusSwitchingProtocols)
+	if token != "" {
+		t.Errorf("expected no reconnect token, got %q", token)
+	}
+	waitForClient(t, s, "stable-client")
+	dialWithToken(t, url, "stable-client", "", http.StatusConflict)
+}
+
+func TestTokenStore_TTL(t *testing.T) {
+	if newTokenStore(0) != nil {
+		t.Error("expected no store when the ttl is 0")
+	}
+
+	store := newTokenStore(time.Minute)
+	now := time.Now()
+	claimed, ok := store.claim("client", "", now)
+	if !ok || claimed.resumed || claimed.token == "" {
+		t.Fatalf("expected a new id to be claimed without a token, got %+v %v", claimed, ok)
+	}
+
+	// a connected client's token doesn't expire
+	if _, ok := store.claim("client", "", now.Add(time.Hour)); ok {
+		t.Error("expected the id to need its token while connected")
+	}
+
+	store.release("client", claimed.token, now)
+	if _, ok := store.claim("client", "", now.Add(59*time.Second)); ok {
+		t.Error("expected the id to need its token within the ttl")
+	}
+	if claimed, ok := store.claim("client", "", now.Add(time.Minute)); !ok || claimed.resumed {
+		t.Error("expected anyone to be able to use the id once the token expired")
+	}
+}
+
+func TestTokenStore_Unclaim(t *testing.T) {
+	store := newTokenStore(time.Minute)
+	now := time.Now()
+	first, _ := store.claim("client", "", now)
+
+	claimed, ok := store.claim("client", first.token, now)
+	if !ok || !claimed.resumed {
+		t.Fatalf("expected the id to be resumed with its token, got %+v %v", claimed, ok)
+	}
+	store.unclaim("client", claimed)
+	if _, ok := store.claim("client", claimed.token, now); ok {
+		t.Error("expected the unclaimed token to not be accepted")
+	}
+	if _, ok := store.claim("client", first.token, now); !ok {
+		t.Error("expected the token the claim replaced to be accepted again")
+	}
+
+	fresh, _ := store.claim("new-client", "", now)
+	store.unclaim("new-client", fresh)
+	if claimed, ok := store.claim("new-client", "", now); !ok || claimed.resumed {
+		t.Error("expected an id that had no token to have none again")
+	}
+}
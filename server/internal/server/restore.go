@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
+)
+
+// parkedSubscriptions are the subscriptions a client had when it disconnected, by topic name.
+type parkedSubscriptions struct {
+	subscriptions map[string]topic.SubscriptionOptions
+	expires       time.Time
+}
+
+// subscriptionStore keeps the subscriptions of disconnected clients by client id for a while, so
+// they can be restored if the client reconnects with the same id. It only lives in memory.
+type subscriptionStore struct {
+	mu     sync.Mutex
+	window time.Duration
+	parked map[string]parkedSubscriptions
+}
+
+// newSubscriptionStore will create a store that keeps subscriptions for the window, or nil if the
+// window is 0 so subscriptions aren't kept.
+func newSubscriptionStore(window time.Duration) *subscriptionStore {
+	if window <= 0 {
+		return nil
+	}
+	return &subscriptionStore{window: window, parked: make(map[string]parkedSubscriptions)}
+}
+
+// park will keep the subscriptions of a client that disconnected until the window is up, replacing
+// any it already had kept. Subscriptions that expired are dropped.
+func (st *subscriptionStore) park(clientId string, subscriptions map[string]topic.SubscriptionOptions, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id, parked := range st.parked {
+		if !now.Before(parked.expires) {
+			delete(st.parked, id)
+		}
+	}
+	st.parked[clientId] = parkedSubscriptions{subscriptions: subscriptions, expires: now.Add(st.window)}
+}
+
+// take will remove and return the subscriptions kept for the client, or nil if there are none or
+// the window is up.
+func (st *subscriptionStore) take(clientId string, now time.Time) map[string]topic.SubscriptionOptions {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	parked, ok := st.parked[clientId]
+	delete(st.parked, clientId)
+	if !ok || !now.Before(parked.expires) {
+		return nil
+	}
+	return parked.subscriptions
+}
+
+// parkSubscriptions will keep the subscriptions of a client that is disconnecting, so they can be
+// restored if it reconnects with the same id. Must be called before the client is unsubscribed.
+func (s *WebSocketServer) parkSubscriptions(client *network.Client) {
+	if s.restorable == nil {
+		return
+	}
+	if subscriptions := s.topicManager.Subscriptions(client); len(subscriptions) > 0 {
+		s.restorable.park(client.Id, subscriptions, time.Now())
+	}
+}
+
+// restoreSubscriptions will subscribe a client that reconnected to the topics it was subscribed to
+// when it disconnected, with the same options, and tell it which topics were restored. Topics that
+// were unregistered since, or aren't under the client's topic prefix, are skipped.
+func (s *WebSocketServer) restoreSubscriptions(client *network.Client) {
+	if s.restorable == nil {
+		return
+	}
+	subscriptions := s.restorable.take(client.Id, time.Now())
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	restored := make([]string, 0, len(subscriptions))
+	for topicName, opts := range subscriptions {
+		if !client.InScope(topicName) { // the id reconnected with a key for another prefix
+			continue
+		}
+		if err := s.topicManager.Subscribe(topicName, client, opts); err != nil {
+			log.WithFields(log.Fields{"client_id": client.Id, "topic": topicName}).Warnf("couldn't restore subscription: %v", err)
+			continue
+		}
+		restored = append(restored, client.UnscopeTopic(topicName))
+	}
+	sort.Strings(restored)
+	log.WithField("client_id", client.Id).Infof("restored %d of %d subscriptions on reconnect", len(restored), len(subscriptions))
+
+	data, err := json.Marshal(network.SubscriptionsRestored{Topics: restored})
+	if err != nil {
+		log.WithField("client_id", client.Id).Errorf("couldn't encode restored subscriptions: %v", err)
+		return
+	}
+	s.sender.SendToClient(client, network.WebSocketMessage{MessageId: s.ids.MessageId(), Action: "subscriptionsRestored", Data: data})
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
+)
+
+// newRestoreTestServer will start a server that keeps subscriptions for the window, with the topics registered.
+func newRestoreTestServer(t *testing.T, window time.Duration, topics ...string) (*WebSocketServer, topic.TopicManager, string) {
+	cfg := &config.Config{SubscriptionRestoreWindow: window}
+	tm := topic.NewTopicManager(storage.NewNullStorage(), cfg)
+	s := NewWebSocketServer(network.NewClientHub(), tm, cfg)
+	t.Cleanup(func() { s.Close() })
+	for _, name := range topics {
+		if _, err := tm.RegisterTopic(name, map[string]any{"a": ""}, topic.TopicOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return s, tm, "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// dialAs will connect to the server with the client id.
+func dialAs(t *testing.T, url string, clientId string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"ClientId": []string{clientId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// subscribeOver will subscribe the connection to the topic and wait for the ack.
+func subscribeOver(t *testing.T, conn *websocket.Conn, topicName string, opts *network.MessageOptions) {
+	msg := network.WebSocketMessage{MessageId: "sub-" + topicName, Action: "subscribe", Topic: topicName, RequireAck: true, Options: opts}
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	var ack network.Response
+	if err := conn.ReadJSON(&ack); err != nil || ack.Code != http.StatusOK {
+		t.Fatalf("expected subscribe to succeed, got %+v, %v", ack, err)
+	}
+}
+
+// disconnect will close the connection and wait for the server to remove the client.
+func disconnect(t *testing.T, s *WebSocketServer, conn *websocket.Conn) {
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+	if err := conn.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
+		t.Fatal(err)
+	}
+	waitForDisconnect(t, s)
+}
+
+func TestRestoreSubscriptions_OnReconnect(t *testing.T) {
+	s, tm, url := newRestoreTestServer(t, time.Minute, "news", "weather", "sports")
+
+	conn := dialAs(t, url, "stable-client")
+	subscribeOver(t, conn, "news", nil)
+	subscribeOver(t, conn, "weather", &network.MessageOptions{EchoToSender: new(bool)})
+	disconnect(t, s, conn)
+	if tm.Stats().SubscriptionCount != 0 {
+		t.Fatal("expected the client to be unsubscribed when it disconnected")
+	}
+
+	conn = dialAs(t, url, "stable-client")
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var restoredMsg network.WebSocketMessage
+	if err := conn.ReadJSON(&restoredMsg); err != nil {
+		t.Fatal(err)
+	}
+	var restored network.SubscriptionsRestored
+	if err := json.Unmarshal(restoredMsg.Data, &restored); err != nil {
+		t.Fatal(err)
+	}
+	if restoredMsg.Action != "subscriptionsRestored" || !reflect.DeepEqual(restored.Topics, []string{"news", "weather"}) {
+		t.Fatalf("expected news and weather to be restored, got %s %+v", restoredMsg.Action, restored)
+	}
+
+	// the client gets values without subscribing again, and the subscription keeps its options
+	client := s.hub.GetClient("stable-client")
+	if client == nil {
+		t.Fatal("expected the client to be connected")
+	}
+	subscriptions := tm.Subscriptions(client)
+	if len(subscriptions) != 2 || !subscriptions["weather"].NoEcho || subscriptions["news"].NoEcho {
+		t.Errorf("expected subscriptions to be restored with their options, got %+v", subscriptions)
+	}
+	msg := network.WebSocketMessage{MessageId: "after-reconnect", Action: "publish", Topic: "news"}
+	if err := tm.SendWithoutSave(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var received network.WebSocketMessage
+	if err := conn.ReadJSON(&received); err != nil {
+		t.Fatal(err)
+	}
+	if received.MessageId != "after-reconnect" {
+		t.Errorf("expected the published value, got %+v", received)
+	}
+}
+
+func TestRestoreSubscriptions_SkipsUnregisteredTopicsAndOnlyOnce(t *testing.T) {
+	s, tm, url := newRestoreTestServer(t, time.Minute, "news", "weather")
+
+	conn := dialAs(t, url, "stable-client")
+	subscribeOver(t, conn, "news", nil)
+	subscribeOver(t, conn, "weather", nil)
+	disconnect(t, s, conn)
+	if err := tm.UnregisterTopic(context.Background(), "weather"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn = dialAs(t, url, "stable-client")
+	var restoredMsg network.WebSocketMessage
+	if err := conn.ReadJSON(&restoredMsg); err != nil {
+		t.Fatal(err)
+	}
+	if string(restoredMsg.Data) != `{"topics":["news"]}` {
+		t.Errorf("expected only news to be restored, got %s", restoredMsg.Data)
+	}
+
+	// reconnecting again without subscribing to anything has nothing to restore
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+	if err := tm.Unsubscribe("news", s.hub.GetClient("stable-client")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
+		t.Fatal(err)
+	}
+	waitForClientGone(t, s, "stable-client")
+	dialAs(t, url, "stable-client")
+	waitForClient(t, s, "stable-client")
+	if tm.Stats().SubscriptionCount != 0 {
+		t.Errorf("expected nothing to be restored, got %d subscriptions", tm.Stats().SubscriptionCount)
+	}
+}
+
+func TestRestoreSubscriptions_OffByDefault(t *testing.T) {
+	s, tm, url := newRestoreTestServer(t, 0, "news")
+
+	conn := dialAs(t, url, "stable-client")
+	subscribeOver(t, conn, "news", nil)
+	disconnect(t, s, conn)
+
+	dialAs(t, url, "stable-client")
+	waitForClient(t, s, "stable-client")
+	if tm.Stats().SubscriptionCount != 0 {
+		t.Errorf("expected nothing to be restored, got %d subscriptions", tm.Stats().SubscriptionCount)
+	}
+}
+
+func TestSubscriptionStore_Window(t *testing.T) {
+	if newSubscriptionStore(0) != nil {
+		t.Error("expected no store when the window is 0")
+	}
+
+	store := newSubscriptionStore(time.Minute)
+	now := time.Now()
+	subscriptions := map[string]topic.SubscriptionOptions{"news": {Conflate: true}}
+
+	store.park("in-time", subscriptions, now)
+	if got := store.take("in-time", now.Add(59*time.Second)); !reflect.DeepEqual(got, subscriptions) {
+		t.Errorf("expected the subscriptions within the window, got %+v", got)
+	}
+	if got := store.take("in-time", now.Add(59*time.Second)); got != nil {
+		t.Errorf("expected subscriptions to only be taken once, got %+v", got)
+	}
+
+	store.park("too-late", subscriptions, now)
+	if got := store.take("too-late", now.Add(time.Minute)); got != nil {
+		t.Errorf("expected nothing after the window, got %+v", got)
+	}
+
+	// expired subscriptions are dropped when others are parked
+	store.park("expired", subscriptions, now)
+	store.park("other", subscriptions, now.Add(2*time.Minute))
+	if _, ok := store.parked["expired"]; ok {
+		t.Error("expected expired subscriptions to be dropped")
+	}
+}
+
+// waitForClient will wait for the hub to have a client with the id.
+func waitForClient(t *testing.T, s *WebSocketServer, clientId string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if s.hub.GetClient(clientId) != nil {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected client %s to connect", clientId)
+}
+
+// waitForClientGone will wait for the hub to not have a client with the id.
+func waitForClientGone(t *testing.T, s *WebSocketServer, clientId string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if s.hub.GetClient(clientId) == nil {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected client %s to disconnect", clientId)
+}
@@ -5,24 +5,54 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/logging"
+	"github.com/atyalexyoung/data-loom/server/internal/metrics"
 	"github.com/atyalexyoung/data-loom/server/internal/network"
 	"github.com/atyalexyoung/data-loom/server/internal/topic"
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 const (
 	FAILED_MESSAGE_THRESHOLD = 3
+	DEFAULT_RECENT_COUNT     = 10    // values returned by getRecent when no count is given
+	MAX_RECENT_COUNT         = 1000  // most values getRecent can return
+	DEFAULT_CHUNK_SIZE       = 65536 // bytes in each chunk of a chunked response when the config doesn't set one
+	MAX_ACK_WINDOW           = 1000  // most values a subscription can be sent without acking them
+	MAX_HEADERS              = 32    // most headers a published message can have
+	MAX_HEADER_BYTES         = 4096  // most bytes the names and values of a message's headers can add up to
 )
 
+// headers of the handshake response that tell the client what its connection negotiated
+const (
+	COMPRESSION_HEADER = "Compression" // "permessage-deflate" or "none"
+	CODEC_HEADER       = "Codec"       // the subprotocol responses are sent in
+)
+
+// errReadStream wraps errors reading a frame from the connection, as opposed to errors parsing a
+// frame that was read. The connection can't be read from anymore after one of these.
+var errReadStream = errors.New("websocket read failed")
+
+// binaryActions are the actions that can be sent as a binary frame with a raw payload.
+var binaryActions = map[string]bool{"publish": true, "sendWithoutSave": true}
+
+// writeActions are the built in actions that change topics or stored values, which are rejected
+// while the server is read only. sendWithoutSave isn't one, since nothing is stored.
+var writeActions = []string{"publish", "publishIf", "publishTransaction", "registerTopic", "unregisterTopic", "renameTopic", "updateSchema", "updateSchemaMany", "migrateSchema", "importSchemas"}
+
+// ErrReadOnly is returned for requests that would change topics or stored values while the
+// server is read only.
+var ErrReadOnly = errors.New("server is read only")
+
 type MessageSender interface {
 	SendToClient(c *network.Client, message any)
 }
@@ -40,12 +70,27 @@ type WebSocketServer struct {
 	upgrader      websocket.Upgrader
 	handlers      map[string]HandlerFunc
 	config        *config.Config
-	failedClients map[*network.Client]int
+	failedClients map[*network.Client]*clientFailures
+	disabled      map[string]bool // actions that are turned off by config
+	writes        map[string]bool // actions that are rejected while the server is read only
+	readOnly      atomic.Bool
+	restorable    *subscriptionStore  // subscriptions of disconnected clients, nil if they aren't restored
+	tokens        *tokenStore         // reconnect tokens of client ids, nil if they aren't issued
+	ids           network.IdGenerator // makes the ids of clients that connect without one and messages the server sends on its own
+	pool          *handlerPool        // workers that route messages, nil if they're routed on each read loop
+	metrics       *metrics.Metrics
+	accessLog     *logging.AccessLogger
 	mu            sync.RWMutex
 }
 
-// NewWebSocketServer will create and set up a WebSocketServer struct that is ready to use.
-func NewWebSocketServer(hub *network.ClientHub, topicManager topic.TopicManager, config *config.Config) *WebSocketServer {
+// NewWebSocketServer will create and set up a WebSocketServer struct that is ready to use. Options,
+// such as WithHandler for custom actions, are applied after the built in handlers are registered.
+func NewWebSocketServer(hub *network.ClientHub, topicManager topic.TopicManager, config *config.Config, opts ...ServerOption) *WebSocketServer {
+	accessLog, err := logging.OpenAccessLog(config.AccessLogPath)
+	if err != nil {
+		log.Fatalf("Error when opening access log: %v", err)
+	}
+
 	s := &WebSocketServer{
 		hub:          hub,
 		topicManager: topicManager,
@@ -53,27 +98,69 @@ func NewWebSocketServer(hub *network.ClientHub, topicManager topic.TopicManager,
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
+			HandshakeTimeout:  config.HandshakeTimeout,
+			Subprotocols:      network.Protocols,
+			ReadBufferSize:    config.ReadBufferSize,
+			WriteBufferSize:   config.WriteBufferSize,
+			EnableCompression: config.Compression,
 		},
-		handlers: make(map[string]HandlerFunc),
-		config:   config,
+		handlers:      make(map[string]HandlerFunc),
+		writes:        make(map[string]bool, len(writeActions)),
+		restorable:    newSubscriptionStore(config.SubscriptionRestoreWindow),
+		tokens:        newTokenStore(config.ReconnectTokenTTL),
+		ids:           network.UUIDGenerator{},
+		config:        config,
+		failedClients: make(map[*network.Client]*clientFailures),
+		metrics:       metrics.NewMetrics(),
+		accessLog:     accessLog,
 	}
 	s.sender = s
+	for _, action := range writeActions {
+		s.writes[action] = true
+	}
+	s.readOnly.Store(config.ReadOnly)
+	if config.WriteBufferPool {
+		// connections only hold a write buffer while writing, which saves memory when most are idle
+		s.upgrader.WriteBufferPool = &sync.Pool{}
+	}
 
 	// these handlers are set up with decorators for "middleware-like" functionality by
 	// wrapping the the inner-most handler with decorators for pre/post hooks for things
 	// like metrics, logging, validation or auth with early returns to block handler etc.
+	// Decorators run in the order they are listed. Metrics comes first so rejected requests
+	// are still recorded, then the topic is checked before the data is parsed.
 
 	log.Debug("Setting up handlers...")
 	s.registerHandler("subscribe", s.subscribeHandler, s.metricsDecorator, s.requireTopicDecorator)
-	s.registerHandler("publish", s.publishHandler, s.metricsDecorator, s.injectSenderIdDecorator, s.requireDataDecorator, s.requireTopicDecorator)
+	s.registerHandler("subscribeAndGet", s.subscribeAndGetHandler, s.metricsDecorator, s.requireTopicDecorator)
+	s.registerHandler("publish", s.publishHandler, s.metricsDecorator, s.requireTopicDecorator, s.requireDataDecorator, s.injectSenderIdDecorator)
+	s.registerHandler("publishIf", s.publishIfHandler, s.metricsDecorator, s.requireTopicDecorator, s.requireDataDecorator, s.injectSenderIdDecorator)
+	s.registerHandler("publishTransaction", s.publishTransactionHandler, s.metricsDecorator, s.requireDataDecorator, s.injectSenderIdDecorator)
 	s.registerHandler("unsubscribe", s.unsubscribeHandler, s.metricsDecorator, s.requireTopicDecorator)
 	s.registerHandler("unsubscribeAll", s.unsubscribeAllHandler, s.metricsDecorator, s.requireTopicDecorator)
+	s.registerHandler("unsubscribeAllPattern", s.unsubscribeAllPatternHandler, s.metricsDecorator, s.requireTopicDecorator)
+	s.registerHandler("pause", s.pauseHandler, s.metricsDecorator, s.requireTopicDecorator)
+	s.registerHandler("resume", s.resumeHandler, s.metricsDecorator, s.requireTopicDecorator)
+	s.registerHandler("ack", s.ackHandler, s.metricsDecorator, s.requireTopicDecorator, s.requireDataDecorator)
 	s.registerHandler("get", s.getHandler, s.metricsDecorator, s.requireTopicDecorator)
-	s.registerHandler("registerTopic", s.registerTopicHandler, s.metricsDecorator, s.requireDataDecorator, s.requireTopicDecorator)
+	s.registerHandler("getPattern", s.getPatternHandler, s.metricsDecorator, s.requireTopicDecorator)
+	s.registerHandler("getRecent", s.getRecentHandler, s.metricsDecorator, s.requireTopicDecorator)
+	s.registerHandler("topicExists", s.topicExistsHandler, s.metricsDecorator, s.requireTopicDecorator)
+	s.registerHandler("registerTopic", s.registerTopicHandler, s.metricsDecorator, s.requireTopicDecorator, s.requireDataDecorator)
 	s.registerHandler("unregisterTopic", s.unregisterTopicHandler, s.metricsDecorator, s.requireTopicDecorator)
+	s.registerHandler("renameTopic", s.renameTopicHandler, s.metricsDecorator, s.requireTopicDecorator, s.requireDataDecorator)
 	s.registerHandler("listTopics", s.listTopicsHandler, s.metricsDecorator) // no required topics
 	s.registerHandler("updateSchema", s.updateSchemaHandler, s.metricsDecorator, s.requireTopicDecorator, s.requireDataDecorator)
-	s.registerHandler("sendWithoutSave", s.sendWithoutSaveHandler, s.metricsDecorator, s.injectSenderIdDecorator, s.requireTopicDecorator, s.requireDataDecorator)
+	s.registerHandler("updateSchemaMany", s.updateSchemaManyHandler, s.metricsDecorator, s.requireDataDecorator)
+	s.registerHandler("validateSchema", s.validateSchemaHandler, s.metricsDecorator, s.requireTopicDecorator, s.requireDataDecorator)
+	s.registerHandler("migrateSchema", s.migrateSchemaHandler, s.metricsDecorator, s.requireTopicDecorator, s.requireDataDecorator)
+	s.registerHandler("sendWithoutSave", s.sendWithoutSaveHandler, s.metricsDecorator, s.requireTopicDecorator, s.requireDataDecorator, s.injectSenderIdDecorator)
+	s.registerHandler("importSchemas", s.importSchemasHandler, s.metricsDecorator, s.requireDataDecorator)
+	s.registerHandler("exportSchemas", s.exportSchemasHandler, s.metricsDecorator) // no required topics
+	s.registerHandler("serverStats", s.serverStatsHandler, s.metricsDecorator)     // no required topics
+	s.registerHandler("capabilities", s.capabilitiesHandler, s.metricsDecorator)   // no required topics
+	s.registerHandler("storageStats", s.storageStatsHandler, s.metricsDecorator)   // no required topics
+	s.registerHandler("lockStats", s.lockStatsHandler, s.metricsDecorator)         // no required topics
 
 	/*
 		FUTURE HANDLERS
@@ -83,20 +170,194 @@ func NewWebSocketServer(hub *network.ClientHub, topicManager topic.TopicManager,
 		s.registerHandler("listWithPattern", s.unregisterTopicHandler, s.requireTopic)
 	*/
 
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.disabled = make(map[string]bool, len(config.DisabledActions))
+	for _, action := range config.DisabledActions {
+		if _, ok := s.handlers[action]; !ok {
+			log.Warnf("DISABLED_ACTIONS has unknown action: %s", action)
+		}
+		s.disabled[action] = true
+	}
+
+	s.pool = newHandlerPool(config.HandlerWorkers, s.RouteMessage)
+
 	log.Trace("Returning new web socket server.")
 	return s
 }
 
+// Metrics returns the metrics that are collected for the actions handled by the server.
+func (s *WebSocketServer) Metrics() *metrics.Metrics {
+	return s.metrics
+}
+
+// Close will disconnect every client, telling them the server is going away, and release anything
+// held by the server, such as the access log file, handler workers, and the topic manager's
+// background work.
+func (s *WebSocketServer) Close() error {
+	if s.hub != nil {
+		for _, client := range s.hub.Clients() {
+			if s.removeClient(client, network.DisconnectShutdown, "") {
+				client.Disconnect(network.DisconnectShutdown, "server shutting down")
+			}
+		}
+	}
+	if s.pool != nil {
+		s.pool.close()
+	}
+	if s.topicManager != nil {
+		s.topicManager.Close()
+	}
+	return s.accessLog.Close()
+}
+
 // Handler returns ta handler for the websocket connection to main
 func (s *WebSocketServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", s.handleWebSocket)
+	mux.HandleFunc("/capabilities", s.capabilitiesHTTPHandler)
+	mux.HandleFunc("/metrics", s.metricsHTTPHandler)
+	mux.HandleFunc("/readyz", s.readyzHTTPHandler)
+	mux.HandleFunc("/admin/topics", s.requireAdmin(s.adminTopicsHandler))
+	mux.HandleFunc("/admin/stats", s.requireAdmin(s.adminStatsHandler))
+	mux.HandleFunc("/admin/storage", s.requireAdmin(s.adminStorageHandler))
+	mux.HandleFunc("/admin/locks", s.requireAdmin(s.adminLocksHandler))
+	mux.HandleFunc("/admin/disconnects", s.requireAdmin(s.adminDisconnectsHandler))
+	mux.HandleFunc("/admin/subscriptions", s.requireAdmin(s.adminClientSubscriptionsHandler))
+	mux.HandleFunc("/admin/clients", s.requireAdmin(s.adminClientsHandler))
+	mux.HandleFunc("/admin/readonly", s.requireAdmin(s.adminReadOnlyHandler))
 	return mux
 }
 
+// isAuthorized will check the request has an api key in the Authorization header, if the server
+// is configured with any. Otherwise the API key is not required.
+func (s *WebSocketServer) isAuthorized(r *http.Request) bool {
+	_, ok := s.authorize(r)
+	return ok
+}
+
+// authorize will check the request has an api key in the Authorization header, if the server is
+// configured with any, and return the topic prefix the key is confined to. The server's own api
+// key, or no key if there are none, has no prefix so it can use every topic.
+func (s *WebSocketServer) authorize(r *http.Request) (string, bool) {
+	if s.config == nil || (s.config.APIKey == "" && len(s.config.APIKeyPrefixes) == 0) {
+		return "", true
+	}
+	apiKey := strings.TrimSpace(r.Header.Get("Authorization"))
+	if s.config.APIKey != "" && apiKey == s.config.APIKey {
+		return "", true
+	}
+	prefix, ok := s.config.APIKeyPrefixes[apiKey]
+	return prefix, ok && apiKey != ""
+}
+
+// capabilitiesHTTPHandler will respond with the same description of the server as the
+// capabilities action, so clients can check what the server supports before connecting.
+func (s *WebSocketServer) capabilitiesHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.isAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.capabilities()); err != nil {
+		log.Errorf("Error when writing capabilities response: %v", err)
+	}
+}
+
+// metricsHTTPHandler will respond with the action metrics since the server started and the size
+// of its storage, for monitoring. The action metrics are still served if storage can't be read.
+func (s *WebSocketServer) metricsHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.isAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	response := network.MetricsResponse{
+		Summary:              s.metrics.Summary(time.Now()),
+		DroppedFailedClients: s.topicManager.Stats().DroppedFailedClients,
+	}
+	if stats, err := s.storageStats(r.Context()); err != nil {
+		log.Errorf("Error when getting storage stats for metrics: %v", err)
+	} else {
+		response.Storage = &stats
+	}
+	response.StorageQueue, _ = s.storageHealth()
+	response.Locks = s.lockStats("").Locks
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error when writing metrics response: %v", err)
+	}
+}
+
+// readyzHTTPHandler will respond with whether the server is ready to take traffic. It responds
+// 503 while storage is degraded, so a load balancer can send traffic elsewhere until the writes
+// catch up. It doesn't need an api key so probes can reach it.
+func (s *WebSocketServer) readyzHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := network.ReadinessResponse{Status: "ready"}
+	status := http.StatusOK
+	if _, reasons := s.storageHealth(); len(reasons) > 0 {
+		response = network.ReadinessResponse{Status: "degraded", Reasons: reasons}
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error when writing readiness response: %v", err)
+	}
+}
+
+// storageHealth will return the storage's write queue stats and the reasons it's degraded, which
+// is when more writes are queued or they're taking longer than the configured thresholds.
+func (s *WebSocketServer) storageHealth() (network.StorageQueueResponse, []string) {
+	stats := s.topicManager.StorageQueueStats()
+	response := network.StorageQueueResponse{
+		Depth:          stats.Depth,
+		Capacity:       stats.Capacity,
+		WriteLatencyMs: stats.WriteLatency.Milliseconds(),
+	}
+	if s.config == nil {
+		return response, nil
+	}
+
+	var reasons []string
+	if limit := s.config.StorageDegradedQueueDepth; limit > 0 && stats.Depth >= limit {
+		reasons = append(reasons, fmt.Sprintf("storage write queue has %d writes, degraded at %d", stats.Depth, limit))
+	}
+	if limit := s.config.StorageDegradedLatency; limit > 0 && stats.WriteLatency >= limit {
+		reasons = append(reasons, fmt.Sprintf("storage writes are taking %s, degraded at %s", stats.WriteLatency.Round(time.Millisecond), limit))
+	}
+	response.Degraded = len(reasons) > 0
+	return response, reasons
+}
+
 // SendToClient wraps the SendJSON with error handling for websocket errors
 func (s *WebSocketServer) SendToClient(c *network.Client, message any) {
-	if err := c.SendJSON(message); err != nil {
+	if response, ok := message.(network.Response); ok && c.LegacyResponses {
+		message = network.NewLegacyResponse(response)
+	}
+	// a message its overflow policy dropped isn't the client failing
+	if err := c.SendJSON(message); err != nil && !errors.Is(err, network.ErrMessageDropped) {
 		if !s.handleWebSocketError(err, c) {
 			s.MarkClientFailed(c)
 		} else { // we good ig, just watch it
@@ -110,53 +371,168 @@ func (s *WebSocketServer) SendToClient(c *network.Client, message any) {
 // and each client will get their own handleWebSocket handler.
 func (s *WebSocketServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
-	if s.config.APIKey != "" {
-		apiKey := strings.TrimSpace(r.Header.Get("Authorization"))
-		if apiKey != s.config.APIKey {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-	} // else the API key not required.
+	topicPrefix, ok := s.authorize(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	clientID := r.Header.Get("ClientId")
 	if clientID == "" {
-		clientID = uuid.NewString() // fallback to generated ID
+		clientID = s.ids.ClientId() // fallback to generated ID
+	}
+
+	// with reconnect tokens, an id that was issued one can only be used again with its token, which
+	// also lets the connection take the id over from a client that is still connected.
+	// The token is put back if the upgrade fails, and a connected client is only taken over once it
+	// succeeds, so a failed connection doesn't lock the client that has the token out.
+	var claimed tokenClaim
+	if s.tokens != nil {
+		var ok bool
+		claimed, ok = s.tokens.claim(clientID, r.Header.Get(RECONNECT_TOKEN_HEADER), time.Now())
+		if !ok {
+			http.Error(w, "invalid reconnect token", http.StatusForbidden)
+			return
+		}
+	}
+	unclaim := func() {
+		if s.tokens != nil {
+			s.tokens.unclaim(clientID, claimed)
+		}
 	}
 
 	// check if the client Id is already used or not.
-	if currentClient := s.hub.GetClient(clientID); currentClient != nil {
+	if s.hub.GetClient(clientID) != nil && !claimed.resumed {
+		unclaim()
 		http.Error(w, "client ID already exists", http.StatusConflict)
 		return
 	}
 
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	// bound the time the handshake can take so a client that never finishes upgrading
+	// doesn't tie up this goroutine forever.
+	if s.config.HandshakeTimeout > 0 {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(s.config.HandshakeTimeout)); err != nil {
+			log.WithField("client_id", clientID).Warnf("could not set handshake read deadline: %v", err)
+		}
+	}
+
+	// the client is told what the connection negotiated, since a client library may not expose it
+	compression := network.NegotiatedCompression(r, s.upgrader.EnableCompression)
+	codec := network.NegotiatedProtocol(r)
+	responseHeader := http.Header{COMPRESSION_HEADER: []string{compression}, CODEC_HEADER: []string{codec}}
+	if claimed.token != "" {
+		responseHeader.Set(RECONNECT_TOKEN_HEADER, claimed.token)
+	}
+	conn, err := s.upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
+		unclaim()
 		log.WithFields(log.Fields{
 			"request": r,
 		}).Errorf("Upgrade error: %v", err)
 		return
 	}
 	defer conn.Close()
-	client := &network.Client{Conn: conn, Id: uuid.NewString()}
+	if s.tokens != nil {
+		defer func() { s.tokens.release(clientID, claimed.token, time.Now()) }()
+	}
+	if currentClient := s.hub.GetClient(clientID); currentClient != nil && claimed.resumed {
+		if s.removeClient(currentClient, network.DisconnectTakenOver, "") {
+			currentClient.Disconnect(network.DisconnectTakenOver, "client id taken over by a new connection")
+		}
+	}
+
+	// handshake is done, clear the deadline so the read loop can block as long as it needs.
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		log.WithField("client_id", clientID).Warnf("could not clear handshake read deadline: %v", err)
+	}
+	client := network.NewClient(conn, clientID)
+	client.CompactResponses = strings.EqualFold(strings.TrimSpace(r.Header.Get("Compact-Responses")), "true")
+	client.LegacyResponses = conn.Subprotocol() == network.PROTOCOL_V0
+	client.SetOverflowPolicy(network.OverflowPolicy(s.config.OverflowPolicy))
+	client.TopicPrefix = topicPrefix
+	client.Compression = compression
+	client.Codec = codec
+	client.Start()
+	defer client.Close()
+
+	// requests are handled with a context that is cancelled once the connection is closed, so work
+	// that is still running for a client that is gone is abandoned
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
 
 	// send back the uuid of client
 
 	s.hub.AddClient(client)
-	defer s.hub.RemoveClient(client)
+	if s.tokens == nil || claimed.resumed { // with reconnect tokens, only the token restores an id's subscriptions
+		s.restoreSubscriptions(client)
+	}
 
 	for {
-		var msg network.WebSocketMessage
-		if err := conn.ReadJSON(&msg); err != nil { // blocks until can read message
+		msg, err := readMessage(conn)
+		if err != nil { // blocks until can read message
 			if !s.handleWebSocketError(err, client) { // returns bool if client is ok
 				// if we aren't ok, disconnect from this loser
+				reason, detail := disconnectReason(err, client)
+				if s.removeClient(client, reason, detail) && reason == network.DisconnectReadError {
+					// the server is the one giving up on the connection, so tell the client why
+					client.Disconnect(reason, detail)
+				}
 				break
 			}
 		} else { // we all good
-			s.RouteMessage(client, msg)
+			s.dispatch(client, msg.WithContext(ctx))
 		}
 	}
 }
 
+// readMessage will read the next message from the connection. Text frames are a json message,
+// and binary frames are a json message followed by a raw payload. Errors reading the frame are
+// wrapped with errReadStream, so they can be told apart from a message that is just malformed.
+func readMessage(conn *websocket.Conn) (network.WebSocketMessage, error) {
+	var msg network.WebSocketMessage
+	frameType, frame, err := conn.ReadMessage()
+	if err != nil {
+		return msg, fmt.Errorf("%w: %w", errReadStream, err)
+	}
+	if frameType == websocket.BinaryMessage {
+		return network.ParseBinaryFrame(frame)
+	}
+	err = json.Unmarshal(frame, &msg)
+	return msg, err
+}
+
+// removeClient is where every disconnected client is removed from the hub and its topics.
+// The reason is logged and recorded in the hub's recent disconnects. Nothing is recorded if
+// the client was already removed, such as when the read loop ends for a client that the
+// cleanup crew removed. Returns true if the client was removed.
+func (s *WebSocketServer) removeClient(client *network.Client, reason network.DisconnectReason, detail string) bool {
+	s.parkSubscriptions(client)
+	s.topicManager.UnsubscribeAll(client)
+
+	s.mu.Lock()
+	delete(s.failedClients, client)
+	s.mu.Unlock()
+
+	if !s.hub.RemoveClient(client, reason, detail) {
+		return false
+	}
+	log.WithFields(log.Fields{"client_id": client.Id, "reason": reason, "detail": detail}).Info("client disconnected")
+	return true
+}
+
+// disconnectReason will work out why a client is being disconnected from the error that ended its read loop.
+func disconnectReason(err error, client *network.Client) (network.DisconnectReason, string) {
+	if client.Overflowed() { // the server closed the connection, so the error is from that
+		return network.DisconnectSendQueueOverflow, ""
+	}
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		return network.DisconnectClosed, fmt.Sprintf("close code %d", ce.Code)
+	}
+	return network.DisconnectReadError, err.Error()
+}
+
 // ListenForClientFailuresFromTopicManager will get clients that have
 // failed from the topic manager to be marked as failed by the server
 func (s *WebSocketServer) ListenForClientFailuresFromTopicManager() {
@@ -170,11 +546,38 @@ func (s *WebSocketServer) ListenForClientFailuresFromTopicManager() {
 	}
 }
 
+// clientFailures is how many sends to a client have failed since its failures started, and when
+// the first and last of them were.
+type clientFailures struct {
+	count int
+	first time.Time
+	last  time.Time
+}
+
 // MarkClientFailed will increment the client's failures.
 func (s *WebSocketServer) MarkClientFailed(c *network.Client) {
+	s.markClientFailedAt(c, time.Now())
+}
+
+// markClientFailedAt will count a failure of the client at the time. If the client went longer
+// than the grace period without failing, it recovered, so its failures start over from this one.
+func (s *WebSocketServer) markClientFailedAt(c *network.Client, now time.Time) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.failedClients[c]++
+	failures, ok := s.failedClients[c]
+	if !ok || s.recovered(failures, now) {
+		failures = &clientFailures{first: now}
+		s.failedClients[c] = failures
+	}
+	failures.count++
+	failures.last = now
+}
+
+// recovered will return true if the client has gone the grace period without failing. Clients
+// never recover without a grace period.
+func (s *WebSocketServer) recovered(failures *clientFailures, now time.Time) bool {
+	grace := s.config.FailedClientsGrace
+	return grace > 0 && now.Sub(failures.last) >= grace
 }
 
 // StartClientCleanupCrew will start a goroutine that will periodically cleanup clients failing to communicate.
@@ -188,35 +591,59 @@ func (s *WebSocketServer) StartClientCleanupCrew(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				s.cleanupFailedClients()
+				s.cleanupFailedClients(time.Now())
 			}
 		}
 	}()
 }
 
-// cleanupFailedClients will remove the clients that are failing to communicate.
-func (s *WebSocketServer) cleanupFailedClients() {
+// cleanupFailedClients will remove the clients that are failing to communicate and close their
+// connections. A client is only removed once it's past the failure threshold and its failures
+// have gone on for the grace period, and the failures of clients that recovered are forgotten.
+func (s *WebSocketServer) cleanupFailedClients(now time.Time) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	removals := make([]*network.Client, 0)
-
-	for client, numFails := range s.failedClients {
-		if numFails > FAILED_MESSAGE_THRESHOLD {
-			s.topicManager.UnsubscribeAll(client)
-			s.hub.RemoveClient(client)
-			removals = append(removals, client)
+	removals := make(map[*network.Client]int)
+	for client, failures := range s.failedClients {
+		if s.recovered(failures, now) {
+			log.WithField("client_id", client.Id).Debugf("Client recovered after %d failed messages", failures.count)
+			delete(s.failedClients, client)
+			continue
+		}
+		if failures.count > FAILED_MESSAGE_THRESHOLD && now.Sub(failures.first) >= s.config.FailedClientsGrace {
+			removals[client] = failures.count
 		}
 	}
+	s.mu.Unlock()
 
-	for _, client := range removals {
-		delete(s.failedClients, client)
+	for client, numFails := range removals {
+		if s.removeClient(client, network.DisconnectFailureThreshold, fmt.Sprintf("%d failed messages", numFails)) {
+			client.Disconnect(network.DisconnectFailureThreshold, "too many failed messages")
+		}
 	}
 }
 
 // RouteMessage will take the action from a WebSocketMessage and determine which handler should take care of the logic.
 func (s *WebSocketServer) RouteMessage(client *network.Client, msg network.WebSocketMessage) {
 	log.Debugf("Routing incoming message from client: %s for action: %s", client.Id, msg.Action)
+	if err := msg.Context().Err(); err != nil { // the client disconnected while it was queued
+		log.WithFields(log.Fields{"client_id": client.Id, "action": msg.Action, "message_id": msg.MessageId}).Debug("dropping request from disconnected client")
+		return
+	}
+	if s.disabled[msg.Action] {
+		s.AckResponseForbidden(client, msg, fmt.Errorf("action is disabled on this server: %s", msg.Action))
+		return
+	}
+	if s.writes[msg.Action] && s.readOnly.Load() {
+		s.AckResponseServiceUnavailable(client, msg, fmt.Errorf("%w, try again later: %s", ErrReadOnly, msg.Action))
+		return
+	}
+	if msg.Binary != nil && !binaryActions[msg.Action] {
+		s.AckResponseBadRequest(client, msg, fmt.Errorf("action can't be sent as a binary frame: %s", msg.Action))
+		return
+	}
+	if msg.Topic != "" { // handlers only see the full name, so the client is kept to its prefix
+		msg.Topic = client.ScopeTopic(msg.Topic)
+	}
 	if handler, ok := s.handlers[msg.Action]; ok {
 		handler(client, msg)
 	} else {
@@ -225,6 +652,24 @@ func (s *WebSocketServer) RouteMessage(client *network.Client, msg network.WebSo
 	}
 }
 
+// SetReadOnly will turn read only mode on or off. While it's on, actions that change topics or
+// stored values are rejected, and reads and subscriptions keep working.
+func (s *WebSocketServer) SetReadOnly(readOnly bool) {
+	if s.readOnly.Swap(readOnly) == readOnly {
+		return
+	}
+	if readOnly {
+		log.Info("Read only mode turned on. Writes are rejected until it's turned off")
+	} else {
+		log.Info("Read only mode turned off")
+	}
+}
+
+// ReadOnly will return true if the server is rejecting actions that change topics or stored values.
+func (s *WebSocketServer) ReadOnly() bool {
+	return s.readOnly.Load()
+}
+
 // handleWebSocketError handles what to log or do with an error from the websocket.
 // Returns boolean if the websocket is ok or not. If false, the client should be disconnected
 func (s *WebSocketServer) handleWebSocketError(err error, client *network.Client) bool {
@@ -244,9 +689,23 @@ func (s *WebSocketServer) handleWebSocketError(err error, client *network.Client
 		}
 
 		// if the connection is closed, get this guy outta here
-		s.topicManager.UnsubscribeAll(client)
 		return false
 	}
+	if errors.Is(err, net.ErrClosed) || client.Overflowed() { // the server closed the connection
+		return false
+	}
+	// the stream is broken, such as by a truncated frame or one over the read limit, and every
+	// read after this fails the same way, so reading again would just spin.
+	if errors.Is(err, errReadStream) {
+		ctx.Error("WebSocket stream error: ", err)
+		return false
+	}
+
+	if errors.Is(err, network.ErrInvalidBinaryFrame) {
+		ctx.Error("Invalid binary frame: ", err)
+		s.sender.SendToClient(client, network.NewResponse(network.WebSocketMessage{MessageId: "UNKNOWN", Action: "UNKNOWN"}, http.StatusBadRequest, err.Error(), nil))
+		return true
+	}
 
 	var syntaxErr *json.SyntaxError
 	if errors.As(err, &syntaxErr) {
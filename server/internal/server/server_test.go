@@ -0,0 +1,939 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/topic"
+)
+
+// newDisconnectTestServer will start a server that clients can connect to over a real websocket.
+func newDisconnectTestServer(t *testing.T) (*WebSocketServer, topic.TopicManager, string) {
+	cfg := &config.Config{}
+	tm := topic.NewTopicManager(storage.NewNullStorage(), cfg)
+	s := NewWebSocketServer(network.NewClientHub(), tm, cfg)
+	t.Cleanup(func() { s.Close() })
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return s, tm, "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// waitForDisconnect will wait for the hub to record a disconnect and return it.
+func waitForDisconnect(t *testing.T, s *WebSocketServer) network.DisconnectRecord {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if disconnects := s.hub.RecentDisconnects(); len(disconnects) > 0 {
+			return disconnects[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("expected a disconnect to be recorded")
+	return network.DisconnectRecord{}
+}
+
+// readCloseCode will read from the connection until the server closes it and return the close code
+// it was closed with.
+func readCloseCode(t *testing.T, conn *websocket.Conn) int {
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) {
+			t.Fatalf("expected the server to close the connection, got %v", err)
+		}
+		return ce.Code
+	}
+}
+
+func TestDisconnectReason_ClientClosed(t *testing.T) {
+	s, _, url := newDisconnectTestServer(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+	if err := conn.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
+		t.Fatal(err)
+	}
+
+	disconnect := waitForDisconnect(t, s)
+	if disconnect.Reason != network.DisconnectClosed || disconnect.Detail != "close code 1000" {
+		t.Errorf("expected closed with close code 1000, got %+v", disconnect)
+	}
+	if s.hub.ClientCount() != 0 {
+		t.Errorf("expected the client to be removed from the hub, got %d clients", s.hub.ClientCount())
+	}
+}
+
+func TestDisconnectReason_SendQueueOverflow(t *testing.T) {
+	s, tm, url := newDisconnectTestServer(t)
+	if _, err := tm.RegisterTopic("flood", map[string]any{"blob": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	subscribe := network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "flood", RequireAck: true}
+	if err := conn.WriteJSON(subscribe); err != nil {
+		t.Fatal(err)
+	}
+	var ack network.Response
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client stops reading, so its send queue fills up once the connection is backed up
+	publisher := network.NewClient(nil, "publisher")
+	value := map[string]any{"blob": strings.Repeat("x", 256<<10)}
+	for i := 0; i < 2000 && len(s.hub.RecentDisconnects()) == 0; i++ {
+		msg := network.WebSocketMessage{MessageId: fmt.Sprint(i), Action: "sendWithoutSave", Topic: "flood"}
+		if err := tm.SendWithoutSave(context.Background(), msg, publisher, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	disconnect := waitForDisconnect(t, s)
+	if disconnect.Reason != network.DisconnectSendQueueOverflow {
+		t.Errorf("expected send queue overflow, got %+v", disconnect)
+	}
+}
+
+func TestDisconnectReason_FailureThreshold(t *testing.T) {
+	s, tm, _ := newDisconnectTestServer(t)
+	if _, err := tm.RegisterTopic("failing", map[string]any{"a": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	client := network.NewClient(nil, "failing-client")
+	s.hub.AddClient(client)
+	if err := tm.Subscribe("failing", client, topic.SubscriptionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i <= FAILED_MESSAGE_THRESHOLD; i++ {
+		s.MarkClientFailed(client)
+	}
+	s.cleanupFailedClients(time.Now())
+
+	disconnects := s.hub.RecentDisconnects()
+	if len(disconnects) != 1 {
+		t.Fatalf("expected 1 disconnect, got %d", len(disconnects))
+	}
+	want := fmt.Sprintf("%d failed messages", FAILED_MESSAGE_THRESHOLD+1)
+	if disconnects[0].ClientId != "failing-client" || disconnects[0].Reason != network.DisconnectFailureThreshold || disconnects[0].Detail != want {
+		t.Errorf("expected failure threshold with %q, got %+v", want, disconnects[0])
+	}
+	if tm.Stats().SubscriptionCount != 0 {
+		t.Error("expected the client to be unsubscribed from its topics")
+	}
+
+	// the read loop ending afterwards doesn't record it again
+	if s.removeClient(client, network.DisconnectReadError, "use of closed network connection") {
+		t.Error("expected the client to already be removed")
+	}
+	if len(s.hub.RecentDisconnects()) != 1 {
+		t.Error("expected the disconnect to only be recorded once")
+	}
+}
+
+func TestCloseCode_FailureThreshold(t *testing.T) {
+	s, _, url := newDisconnectTestServer(t)
+	conn := dialAs(t, url, "failing-client")
+	waitForClient(t, s, "failing-client")
+
+	client := s.hub.GetClient("failing-client")
+	for i := 0; i <= FAILED_MESSAGE_THRESHOLD; i++ {
+		s.MarkClientFailed(client)
+	}
+	s.cleanupFailedClients(time.Now())
+
+	if code := readCloseCode(t, conn); code != network.CLOSE_FAILURE_THRESHOLD {
+		t.Errorf("expected close code %d, got %d", network.CLOSE_FAILURE_THRESHOLD, code)
+	}
+}
+
+func TestCloseCode_SendQueueOverflow(t *testing.T) {
+	s, tm, url := newDisconnectTestServer(t)
+	if _, err := tm.RegisterTopic("flood", map[string]any{"a": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialAs(t, url, "slow-client")
+	waitForClient(t, s, "slow-client")
+	subscribeOver(t, conn, "flood", &network.MessageOptions{AckWindow: 1})
+
+	// the client keeps reading but never acks, so values back up behind its ack window until the
+	// backlog overflows
+	publisher := network.NewClient(nil, "publisher")
+	for i := 0; i <= topic.MAX_ACK_BACKLOG+1; i++ {
+		msg := network.WebSocketMessage{MessageId: fmt.Sprint(i), Action: "sendWithoutSave", Topic: "flood"}
+		if err := tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"a": "value"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code := readCloseCode(t, conn); code != network.CLOSE_SEND_QUEUE_OVERFLOW {
+		t.Errorf("expected close code %d, got %d", network.CLOSE_SEND_QUEUE_OVERFLOW, code)
+	}
+}
+
+func TestCloseCode_Shutdown(t *testing.T) {
+	s, _, url := newDisconnectTestServer(t)
+	conn := dialAs(t, url, "connected-client")
+	waitForClient(t, s, "connected-client")
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if code := readCloseCode(t, conn); code != websocket.CloseGoingAway {
+		t.Errorf("expected close code %d, got %d", websocket.CloseGoingAway, code)
+	}
+	if disconnect := waitForDisconnect(t, s); disconnect.Reason != network.DisconnectShutdown {
+		t.Errorf("expected the client to be disconnected for the shutdown, got %+v", disconnect)
+	}
+}
+
+func TestFailedClientsGrace_TransientFailuresNotEvicted(t *testing.T) {
+	s, _, _ := newDisconnectTestServer(t)
+	s.config.FailedClientsGrace = time.Minute
+	client := network.NewClient(nil, "mobile-client")
+	s.hub.AddClient(client)
+
+	// a burst of failures past the threshold, then the radio comes back
+	start := time.Now()
+	for i := 0; i <= FAILED_MESSAGE_THRESHOLD; i++ {
+		s.markClientFailedAt(client, start.Add(time.Duration(i)*time.Second))
+	}
+	s.cleanupFailedClients(start.Add(30 * time.Second))
+	if len(s.hub.RecentDisconnects()) != 0 {
+		t.Fatal("expected the client to be kept within the grace period")
+	}
+
+	s.cleanupFailedClients(start.Add(2 * time.Minute))
+	if len(s.hub.RecentDisconnects()) != 0 {
+		t.Fatal("expected a recovered client to be kept")
+	}
+	s.mu.RLock()
+	_, tracked := s.failedClients[client]
+	s.mu.RUnlock()
+	if tracked {
+		t.Error("expected the failures of a recovered client to be forgotten")
+	}
+
+	// failing again after recovering starts over instead of adding to the old failures
+	s.markClientFailedAt(client, start.Add(3*time.Minute))
+	s.mu.RLock()
+	failures := *s.failedClients[client]
+	s.mu.RUnlock()
+	if failures.count != 1 || !failures.first.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("expected failures to start over, got %+v", failures)
+	}
+}
+
+func TestFailedClientsGrace_SustainedFailuresEvicted(t *testing.T) {
+	s, _, _ := newDisconnectTestServer(t)
+	s.config.FailedClientsGrace = time.Minute
+	client := network.NewClient(nil, "gone-client")
+	s.hub.AddClient(client)
+
+	// failing every 20 seconds never goes the grace period without a failure
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		s.markClientFailedAt(client, start.Add(time.Duration(i)*20*time.Second))
+		s.cleanupFailedClients(start.Add(time.Duration(i)*20*time.Second + time.Second))
+		if disconnects := s.hub.RecentDisconnects(); i < 3 && len(disconnects) != 0 {
+			t.Fatalf("expected the client to be kept before the grace period, got %+v after %d failures", disconnects, i+1)
+		}
+	}
+
+	disconnects := s.hub.RecentDisconnects()
+	if len(disconnects) != 1 {
+		t.Fatalf("expected 1 disconnect once failures went on past the grace period, got %d", len(disconnects))
+	}
+	if disconnects[0].ClientId != "gone-client" || disconnects[0].Reason != network.DisconnectFailureThreshold {
+		t.Errorf("expected failure threshold disconnect, got %+v", disconnects[0])
+	}
+}
+
+func TestDisconnectReason_FromReadError(t *testing.T) {
+	client := network.NewClient(nil, "client")
+
+	reason, detail := disconnectReason(&websocket.CloseError{Code: websocket.CloseGoingAway}, client)
+	if reason != network.DisconnectClosed || detail != "close code 1001" {
+		t.Errorf("expected closed with close code 1001, got %s %q", reason, detail)
+	}
+
+	reason, detail = disconnectReason(fmt.Errorf("connection reset by peer"), client)
+	if reason != network.DisconnectReadError || detail != "connection reset by peer" {
+		t.Errorf("expected read error, got %s %q", reason, detail)
+	}
+}
+
+func TestReadLoop_ExitsOnBrokenStream(t *testing.T) {
+	s, _, url := newDisconnectTestServer(t)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a frame with a reserved opcode breaks the stream, so every read after it fails the same way
+	frame := append([]byte{0x83, 0x80 | 2, 0, 0, 0, 0}, []byte("{}")...)
+	if _, err := conn.UnderlyingConn().Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	disconnect := waitForDisconnect(t, s)
+	if disconnect.Reason != network.DisconnectReadError || !strings.Contains(disconnect.Detail, "opcode") {
+		t.Errorf("expected a read error for the bad frame, got %+v", disconnect)
+	}
+	if code := readCloseCode(t, conn); code != websocket.CloseProtocolError {
+		t.Errorf("expected close code %d, got %d", websocket.CloseProtocolError, code)
+	}
+	if s.hub.ClientCount() != 0 {
+		t.Errorf("expected the client to be removed, got %d clients", s.hub.ClientCount())
+	}
+}
+
+func TestHandleWebSocketError_StreamErrorsDisconnect(t *testing.T) {
+	s, c := SetupStuff(&mockTopicManager{})
+
+	for _, err := range []error{
+		fmt.Errorf("%w: %w", errReadStream, io.ErrUnexpectedEOF),
+		fmt.Errorf("%w: %w", errReadStream, websocket.ErrReadLimit),
+	} {
+		if s.handleWebSocketError(err, c) {
+			t.Errorf("expected %v to disconnect the client", err)
+		}
+	}
+	if !s.handleWebSocketError(&json.SyntaxError{}, c) {
+		t.Error("expected a malformed message to keep the client connected")
+	}
+}
+
+func TestPublish_DeliveryReportCountsFailedSubscribers(t *testing.T) {
+	_, tm, url := newDisconnectTestServer(t)
+	if _, err := tm.RegisterTopic("alerts", map[string]any{"level": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	if err := subscriber.WriteJSON(network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "alerts", RequireAck: true}); err != nil {
+		t.Fatal(err)
+	}
+	var ack network.Response
+	if err := subscriber.ReadJSON(&ack); err != nil || ack.Code != http.StatusOK {
+		t.Fatalf("expected subscribe ack, got %+v, %v", ack, err)
+	}
+	// a subscriber whose connection is gone, but that hasn't been cleaned up yet
+	gone := network.NewClient(nil, "gone")
+	gone.Close()
+	if err := tm.Subscribe("alerts", gone, topic.SubscriptionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	msg := network.WebSocketMessage{
+		MessageId: "alert",
+		Action:    "publish",
+		Topic:     "alerts",
+		Data:      json.RawMessage(`{"level": "critical"}`),
+		Options:   &network.MessageOptions{DeliveryReport: true},
+	}
+	if err := publisher.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Code int                   `json:"code"`
+		Data network.DeliveryStats `json:"data"`
+	}
+	if err := publisher.ReadJSON(&report); err != nil || report.Code != http.StatusOK {
+		t.Fatalf("expected publish ack, got %+v, %v", report, err)
+	}
+	want := network.DeliveryStats{Targeted: 2, Delivered: 1, Failed: 1}
+	if report.Data != want {
+		t.Errorf("expected delivery counts %+v, got %+v", want, report.Data)
+	}
+
+	var delivered network.WebSocketMessage
+	subscriber.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := subscriber.ReadJSON(&delivered); err != nil || delivered.MessageId != "alert" {
+		t.Errorf("expected the healthy subscriber to get the alert, got %+v, %v", delivered, err)
+	}
+}
+
+func TestBinaryPublish_RoundTrip(t *testing.T) {
+	_, tm, url := newDisconnectTestServer(t)
+	if _, err := tm.RegisterTopic("thumbnails", map[string]any{}, topic.TopicOptions{Binary: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	if err := subscriber.WriteJSON(network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "thumbnails", RequireAck: true}); err != nil {
+		t.Fatal(err)
+	}
+	var ack network.Response
+	if err := subscriber.ReadJSON(&ack); err != nil || ack.Code != http.StatusOK {
+		t.Fatalf("expected subscribe ack, got %+v, %v", ack, err)
+	}
+
+	publisher, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	payload := []byte{0x89, 'P', 'N', 'G', 0x00, '{', 0xff}
+	frame, err := network.EncodeBinaryFrame(&network.WebSocketMessage{MessageId: "thumb", Action: "publish", Topic: "thumbnails", RequireAck: true}, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.ReadJSON(&ack); err != nil || ack.Code != http.StatusOK {
+		t.Fatalf("expected publish ack, got %+v, %v", ack, err)
+	}
+
+	subscriber.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frameType, received, err := subscriber.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameType != websocket.BinaryMessage {
+		t.Fatalf("expected a binary frame, got frame type %d", frameType)
+	}
+	delivered, err := network.ParseBinaryFrame(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered.Topic != "thumbnails" || !bytes.Equal(delivered.Binary, payload) {
+		t.Errorf("expected the payload on thumbnails, got %q on %s", delivered.Binary, delivered.Topic)
+	}
+
+	value, err := tm.Get(context.Background(), "thumbnails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, ok := value.([]byte); !ok || !bytes.Equal(stored, payload) {
+		t.Errorf("expected the payload to be the topic's value, got %v", value)
+	}
+}
+
+// formatFrame is a frame read from a connection, split into the message and any raw payload.
+type formatFrame struct {
+	msg      network.WebSocketMessage
+	code     int // set for responses
+	isBinary bool
+}
+
+// readFormatFrames will read frames from the connection until it has n, parsing binary frames
+// into their header and payload. Persist errors are skipped like sendAndRead does.
+func readFormatFrames(t *testing.T, conn *websocket.Conn, n int) []formatFrame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frames := make([]formatFrame, 0, n)
+	for len(frames) < n {
+		frameType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frameType == websocket.BinaryMessage {
+			msg, err := network.ParseBinaryFrame(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, formatFrame{msg: msg, isBinary: true})
+			continue
+		}
+		var frame formatFrame
+		var response network.Response
+		if err := json.Unmarshal(data, &response); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &frame.msg); err != nil {
+			t.Fatal(err)
+		}
+		if frame.msg.Action == "persist" {
+			continue
+		}
+		frame.code = response.Code
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func TestTopicFormats_MixedOnOneConnection(t *testing.T) {
+	_, tm, url := newDisconnectTestServer(t)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for name, format := range map[string]string{"readings": "json", "images": "raw", "events": "msgpack"} {
+		for _, msg := range []network.WebSocketMessage{
+			{MessageId: "register-" + name, Action: "registerTopic", Topic: name, Data: json.RawMessage(`{"a": 0}`), RequireAck: true, Options: &network.MessageOptions{Format: format}},
+			{MessageId: "subscribe-" + name, Action: "subscribe", Topic: name, RequireAck: true},
+		} {
+			if response := sendAndRead(t, conn, msg); response.Code != http.StatusOK {
+				t.Fatalf("expected %s to succeed, got %+v", msg.Action, response)
+			}
+		}
+	}
+
+	image := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	event := []byte{0x81, 0xa1, 'a', 0x01} // {"a": 1}
+	if err := conn.WriteJSON(network.WebSocketMessage{MessageId: "pub-readings", Action: "publish", Topic: "readings", Data: json.RawMessage(`{"a": 1}`), RequireAck: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, publish := range []struct {
+		topic   string
+		payload []byte
+	}{{"images", image}, {"events", event}} {
+		frame, err := network.EncodeBinaryFrame(&network.WebSocketMessage{MessageId: "pub-" + publish.topic, Action: "publish", Topic: publish.topic, RequireAck: true}, publish.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each publish is acked and delivered back to the connection in its topic's format
+	delivered := make(map[string]formatFrame)
+	for _, frame := range readFormatFrames(t, conn, 6) {
+		if frame.code != 0 {
+			if frame.code != http.StatusOK {
+				t.Errorf("expected publishes to succeed, got %+v", frame)
+			}
+			continue
+		}
+		delivered[frame.msg.Topic] = frame
+	}
+	if readings := delivered["readings"]; readings.isBinary || readings.msg.Format != "" || string(readings.msg.Data) != `{"a":1}` {
+		t.Errorf("expected readings as json, got %+v", readings)
+	}
+	if images := delivered["images"]; !images.isBinary || images.msg.Format != "raw" || !bytes.Equal(images.msg.Binary, image) {
+		t.Errorf("expected images as raw bytes, got %+v", images)
+	}
+	if events := delivered["events"]; !events.isBinary || events.msg.Format != "msgpack" || !bytes.Equal(events.msg.Binary, event) {
+		t.Errorf("expected events as msgpack, got %+v", events)
+	}
+	if value, err := tm.Get(context.Background(), "events"); err != nil || !bytes.Equal(value.([]byte), event) {
+		t.Errorf("expected the msgpack payload to be stored as is, got %v, %v", value, err)
+	}
+
+	// a msgpack topic only takes well formed msgpack, and isn't validated against the schema
+	frame, err := network.EncodeBinaryFrame(&network.WebSocketMessage{MessageId: "bad-events", Action: "publish", Topic: "events", RequireAck: true}, []byte{0xc1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	if response := readFormatFrames(t, conn, 1)[0]; response.code != http.StatusBadRequest {
+		t.Errorf("expected malformed msgpack to be rejected, got %+v", response)
+	}
+	if response := sendAndRead(t, conn, network.WebSocketMessage{MessageId: "json-events", Action: "publish", Topic: "events", Data: json.RawMessage(`{"a": 1}`), RequireAck: true}); response.Code != http.StatusBadRequest {
+		t.Errorf("expected json to be rejected for a msgpack topic, got %+v", response)
+	}
+}
+
+func TestHeaders_RoundTripToSubscribers(t *testing.T) {
+	_, _, url := newDisconnectTestServer(t)
+	publisher := dialAs(t, url, "publisher")
+	subscriber := dialAs(t, url, "subscriber")
+
+	// the schema doesn't have the header names, and strict validation only looks at data
+	register := network.WebSocketMessage{MessageId: "register", Action: "registerTopic", Topic: "orders", Data: json.RawMessage(`{"total": 0}`), RequireAck: true}
+	if ack := sendAndRead(t, publisher, register); ack.Code != http.StatusOK {
+		t.Fatalf("expected register to succeed, got %+v", ack)
+	}
+	if ack := sendAndRead(t, subscriber, network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "orders", RequireAck: true}); ack.Code != http.StatusOK {
+		t.Fatalf("expected subscribe to succeed, got %+v", ack)
+	}
+
+	headers := map[string]string{"content-type": "application/json", "trace-id": "4bf92f3577b34da6", "tenant": "acme"}
+	publish := network.WebSocketMessage{MessageId: "pub", Action: "publish", Topic: "orders", Data: json.RawMessage(`{"total": 5}`), Headers: headers, RequireAck: true}
+	if ack := sendAndRead(t, publisher, publish); ack.Code != http.StatusOK {
+		t.Fatalf("expected publish with headers to succeed, got %+v", ack)
+	}
+
+	if err := subscriber.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var delivered network.WebSocketMessage
+	if err := subscriber.ReadJSON(&delivered); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(delivered.Headers, headers) {
+		t.Errorf("expected subscriber to get headers %v, got %v", headers, delivered.Headers)
+	}
+	if string(delivered.Data) != `{"total":5}` {
+		t.Errorf("expected headers to be left out of data, got %s", delivered.Data)
+	}
+
+	get := network.WebSocketMessage{MessageId: "get", Action: "get", Topic: "orders", RequireAck: true, Options: &network.MessageOptions{Meta: true}}
+	response := sendAndRead(t, publisher, get)
+	var envelope network.ValueWithMeta
+	if err := json.Unmarshal(response.Data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(envelope.Headers, headers) {
+		t.Errorf("expected get with meta to have headers %v, got %+v", headers, envelope)
+	}
+}
+
+func TestBinaryFrame_RejectedForOtherActions(t *testing.T) {
+	_, _, url := newDisconnectTestServer(t)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, frame := range [][]byte{
+		[]byte(`{"id":"1","action":"registerTopic","topic":"blobs"}raw`),
+		[]byte(`not a header`),
+	} {
+		if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			t.Fatal(err)
+		}
+		var response network.Response
+		if err := conn.ReadJSON(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("expected status bad request for %q, got %+v", frame, response)
+		}
+	}
+}
+
+func TestBufferSizes_AppliedAndLargeMessagesWork(t *testing.T) {
+	cfg := &config.Config{ReadBufferSize: 1024, WriteBufferSize: 2048, WriteBufferPool: true}
+	tm := topic.NewTopicManager(storage.NewNullStorage(), cfg)
+	s := NewWebSocketServer(network.NewClientHub(), tm, cfg)
+	t.Cleanup(func() { s.Close() })
+	if s.upgrader.ReadBufferSize != 1024 || s.upgrader.WriteBufferSize != 2048 || s.upgrader.WriteBufferPool == nil {
+		t.Fatalf("expected the buffer config to be set on the upgrader, got read %d, write %d, pool %v",
+			s.upgrader.ReadBufferSize, s.upgrader.WriteBufferSize, s.upgrader.WriteBufferPool)
+	}
+	if _, err := tm.RegisterTopic("large", map[string]any{"blob": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "large", RequireAck: true}); err != nil {
+		t.Fatal(err)
+	}
+	var ack network.Response
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatal(err)
+	}
+
+	// a value many times bigger than the buffers is read and written across many of them
+	blob := strings.Repeat("x", 1<<20)
+	data, _ := json.Marshal(map[string]any{"blob": blob})
+	if err := conn.WriteJSON(network.WebSocketMessage{MessageId: "pub", Action: "publish", Topic: "large", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	var echoed network.WebSocketMessage
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&echoed); err != nil {
+		t.Fatal(err)
+	}
+	var value map[string]string
+	if err := json.Unmarshal(echoed.Data, &value); err != nil {
+		t.Fatal(err)
+	}
+	if echoed.MessageId != "pub" || value["blob"] != blob {
+		t.Errorf("expected the large value to be delivered whole, got message %s with %d bytes", echoed.MessageId, len(value["blob"]))
+	}
+}
+
+// prefixFrame is either a response or a message from a topic, read from a connection.
+type prefixFrame struct {
+	Id     string          `json:"id"`
+	Action string          `json:"action"`
+	Topic  string          `json:"topic"`
+	Code   int             `json:"code"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// dialWithKey will connect to the server with the api key.
+func dialWithKey(t *testing.T, url string, apiKey string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": []string{apiKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendAndRead will send the message and return the next frame read from the connection. Responses
+// about persisting earlier publishes can come at any point, so they're skipped.
+func sendAndRead(t *testing.T, conn *websocket.Conn, msg network.WebSocketMessage) prefixFrame {
+	t.Helper()
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var frame prefixFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Action != "persist" {
+			return frame
+		}
+	}
+}
+
+func TestTopicPrefix_KeysAreIsolated(t *testing.T) {
+	cfg := &config.Config{APIKey: "server-key", APIKeyPrefixes: map[string]string{"key-a": "tenant-a/", "key-b": "tenant-b/"}}
+	tm := topic.NewTopicManager(storage.NewNullStorage(), cfg)
+	s := NewWebSocketServer(network.NewClientHub(), tm, cfg)
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	if _, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": []string{"wrong-key"}}); err == nil {
+		t.Fatal("expected a connection with an unknown key to be rejected")
+	}
+
+	// both tenants use the same topic name, and each only gets its own values back
+	tenants := map[string]*websocket.Conn{"a": dialWithKey(t, url, "key-a"), "b": dialWithKey(t, url, "key-b")}
+	for _, name := range []string{"a", "b"} {
+		conn := tenants[name]
+		if ack := sendAndRead(t, conn, network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "sensors", RequireAck: true}); ack.Code != http.StatusOK {
+			t.Fatalf("expected tenant %s to subscribe, got %+v", name, ack)
+		}
+		data := json.RawMessage(fmt.Sprintf(`{"from":%q}`, name))
+		echoed := sendAndRead(t, conn, network.WebSocketMessage{MessageId: "pub-" + name, Action: "publish", Topic: "sensors", Data: data})
+		if echoed.Id != "pub-"+name || echoed.Topic != "sensors" || string(echoed.Data) != string(data) {
+			t.Errorf("expected tenant %s to get its own value on its topic name, got %+v", name, echoed)
+		}
+	}
+	for _, name := range []string{"tenant-a/sensors", "tenant-b/sensors"} {
+		if !tm.HasTopic(name) {
+			t.Errorf("expected %s to be registered", name)
+		}
+	}
+	if tm.HasTopic("sensors") {
+		t.Error("expected topic names to be prefixed")
+	}
+
+	// tenant a's next frame is the response, not tenant b's value
+	listed := sendAndRead(t, tenants["a"], network.WebSocketMessage{MessageId: "list", Action: "listTopics"})
+	var topics []network.TopicResponse
+	if err := json.Unmarshal(listed.Data, &topics); err != nil {
+		t.Fatal(err)
+	}
+	if listed.Id != "list" || len(topics) != 1 || topics[0].Name != "sensors" {
+		t.Errorf("expected tenant a to only see its own topic, got %+v %s", listed, listed.Data)
+	}
+	got := sendAndRead(t, tenants["b"], network.WebSocketMessage{MessageId: "get", Action: "get", Topic: "sensors"})
+	if string(got.Data) != `{"from":"b"}` {
+		t.Errorf("expected tenant b to get its own value, got %s", got.Data)
+	}
+	pattern := sendAndRead(t, tenants["b"], network.WebSocketMessage{MessageId: "pattern", Action: "getPattern", Topic: "*"})
+	if string(pattern.Data) != `{"sensors":{"from":"b"}}` {
+		t.Errorf("expected tenant b's pattern to only match its own topics, got %s", pattern.Data)
+	}
+
+	// the server's own key isn't confined, so it sees both tenants' topics by their full names
+	server := dialWithKey(t, url, "server-key")
+	got = sendAndRead(t, server, network.WebSocketMessage{MessageId: "get", Action: "get", Topic: "tenant-a/sensors"})
+	if string(got.Data) != `{"from":"a"}` {
+		t.Errorf("expected the server key to get tenant a's value, got %s", got.Data)
+	}
+}
+
+func TestTopicPrefix_TransactionAndRename(t *testing.T) {
+	cfg := &config.Config{APIKeyPrefixes: map[string]string{"key-a": "tenant-a/"}}
+	tm := topic.NewTopicManager(storage.NewNullStorage(), cfg)
+	s := NewWebSocketServer(network.NewClientHub(), tm, cfg)
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	for _, name := range []string{"tenant-a/first", "tenant-a/second"} {
+		if _, err := tm.RegisterTopic(name, map[string]any{"v": 0}, topic.TopicOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Fatal("expected a connection without a key to be rejected when every key has a prefix")
+	}
+	conn := dialWithKey(t, url, "key-a")
+
+	transaction := json.RawMessage(`{"values":[{"topic":"first","data":{"v":1}},{"topic":"second","data":{"v":2}}]}`)
+	if ack := sendAndRead(t, conn, network.WebSocketMessage{MessageId: "tx", Action: "publishTransaction", Data: transaction, RequireAck: true}); ack.Code != http.StatusOK {
+		t.Fatalf("expected the transaction to be published, got %+v %s", ack, ack.Data)
+	}
+	if ack := sendAndRead(t, conn, network.WebSocketMessage{MessageId: "sub", Action: "subscribe", Topic: "second", RequireAck: true}); ack.Code != http.StatusOK {
+		t.Fatalf("expected to subscribe, got %+v", ack)
+	}
+
+	// the rename is told to subscribers with the names they know the topic by
+	renamed := sendAndRead(t, conn, network.WebSocketMessage{MessageId: "rename", Action: "renameTopic", Topic: "second", Data: json.RawMessage(`{"newName":"renamed"}`), RequireAck: true})
+	if renamed.Action != "renameTopic" || renamed.Topic != "renamed" || string(renamed.Data) != `{"newName":"renamed","oldName":"second"}` {
+		t.Errorf("expected the rename notification without the prefix, got %+v %s", renamed, renamed.Data)
+	}
+	if !tm.HasTopic("tenant-a/renamed") {
+		t.Error("expected the new name to be prefixed")
+	}
+	value, err := tm.Get(context.Background(), "tenant-a/first")
+	if err != nil || value == nil {
+		t.Errorf("expected the transaction to publish to the prefixed topic, got %v, %v", value, err)
+	}
+}
+
+// readResponseFields will send a request that fails and return the fields of the response.
+func readResponseFields(t *testing.T, url string, protocols []string) (map[string]any, string) {
+	dialer := websocket.Dialer{Subprotocols: protocols}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(network.WebSocketMessage{MessageId: "req-1", Action: "unknownAction"}); err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := conn.ReadJSON(&fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields, conn.Subprotocol()
+}
+
+func TestProtocol_LegacyResponseShape(t *testing.T) {
+	_, _, url := newDisconnectTestServer(t)
+	fields, protocol := readResponseFields(t, url, []string{network.PROTOCOL_V0})
+
+	if protocol != network.PROTOCOL_V0 {
+		t.Fatalf("expected the legacy protocol to be negotiated, got %q", protocol)
+	}
+	if fields["messageId"] != "req-1" || fields["type"] != "unknownAction" || fields["code"] != float64(http.StatusBadRequest) {
+		t.Errorf("expected the legacy response fields, got %v", fields)
+	}
+	for _, renamed := range []string{"id", "action"} {
+		if _, ok := fields[renamed]; ok {
+			t.Errorf("expected no %q field in a legacy response, got %v", renamed, fields)
+		}
+	}
+}
+
+func TestProtocol_CurrentResponseShape(t *testing.T) {
+	_, _, url := newDisconnectTestServer(t)
+
+	// the current shape is used for v1, and for clients that don't ask for a protocol
+	for _, protocols := range [][]string{{network.PROTOCOL_V1}, {network.PROTOCOL_V1, network.PROTOCOL_V0}, nil} {
+		fields, _ := readResponseFields(t, url, protocols)
+		if fields["id"] != "req-1" || fields["action"] != "unknownAction" || fields["type"] != "response" {
+			t.Errorf("expected the current response fields for %v, got %v", protocols, fields)
+		}
+		if _, ok := fields["messageId"]; ok {
+			t.Errorf("expected no messageId field for %v, got %v", protocols, fields)
+		}
+	}
+}
+
+// sequentialIds makes ids in an org's own format from a counter, so tests know what they'll be.
+type sequentialIds struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (g *sequentialIds) id(format string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.next++
+	return fmt.Sprintf(format, g.next)
+}
+
+func (g *sequentialIds) ClientId() string  { return g.id("svc-eu-%04d") }
+func (g *sequentialIds) MessageId() string { return g.id("msg-%04d") }
+
+func TestIdGenerator_UsedForClientAndMessageIds(t *testing.T) {
+	cfg := &config.Config{SubscriptionRestoreWindow: time.Minute}
+	ids := &sequentialIds{}
+	tm := topic.NewTopicManager(storage.NewNullStorage(), cfg, topic.WithIdGenerator(ids))
+	if _, err := tm.RegisterTopic("news", map[string]any{"a": ""}, topic.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewWebSocketServer(network.NewClientHub(), tm, cfg, WithIdGenerator(ids))
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	// a client that connects without an id is given one in the org's format
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForClient(t, s, "svc-eu-0001")
+	subscribeOver(t, conn, "news", nil)
+	disconnect(t, s, conn)
+
+	// and the messages the server sends on its own are too
+	conn = dialAs(t, url, "svc-eu-0001")
+	var restored network.WebSocketMessage
+	if err := conn.ReadJSON(&restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Action != "subscriptionsRestored" || restored.MessageId != "msg-0002" {
+		t.Errorf("expected the restored message to have a generated id, got %+v", restored)
+	}
+}
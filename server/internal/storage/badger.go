@@ -3,27 +3,36 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"time"
-
-	log "github.com/sirupsen/logrus"
-
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 )
 
 type BadgerStorage struct {
-	database   *badger.DB
-	writeQueue chan dbWriteRequest
-	mu         sync.Mutex
+	mu         sync.RWMutex // held to use the database, and held exclusively to close it
 	closed     bool
+	database   *badger.DB
+	writeQueue *writeQueue
+	retry      RetryOptions
+	write      func(key string, value any, expiresAt time.Time) error
+	writeBatch func(entries []BatchEntry) error
 }
 
 func NewBadgerStorage() *BadgerStorage {
-	return &BadgerStorage{
-		writeQueue: make(chan dbWriteRequest, 5000),
+	s := &BadgerStorage{
+		writeQueue: newWriteQueue(5000),
 	}
+	s.write = s.put
+	s.writeBatch = s.putBatch
+	return s
+}
+
+// isRetryableBadgerError will return true for transaction conflicts, which can succeed if tried again.
+func isRetryableBadgerError(err error) bool {
+	return errors.Is(err, badger.ErrConflict)
 }
 
 // OpenDatabase will handle logic for opening and setting up databse
@@ -32,70 +41,83 @@ func (s *BadgerStorage) Open(path string, ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
 	s.database = db
+	s.mu.Unlock()
 	s.startWriter(ctx) // now we open, start.
 	return nil
 }
 
 func (store *BadgerStorage) startWriter(ctx context.Context) {
-	go func() {
-		for {
-			select {
-			case writeReq, ok := <-store.writeQueue:
-				if !ok {
-					return // queue closed
-				}
-
-				// doing this
-				select { // select context closed or proceed with write
-				// if context closed, write error and continue with loop
-				case <-writeReq.writeCtx.Done():
-					if writeReq.errCh != nil {
-						writeReq.errCh <- writeReq.writeCtx.Err()
-					}
-					continue
-				default: // no cancellation, continue with operation
-				}
-
-				err := store.put(writeReq.key, writeReq.value)
-				if writeReq.errCh != nil { // does this chan exist?
-					writeReq.errCh <- err // give err to whoever sent this
-					log.Info("closing the write errCh")
-					close(writeReq.errCh)
-				}
-
-			case <-ctx.Done(): // if we get cancelled, stop the worker.
-				return
+	go store.writeQueue.run(ctx, func(req dbWriteRequest) error {
+		return writeWithRetry(req.writeCtx, store.retry, isRetryableBadgerError, req.key, func() error {
+			if req.batch != nil {
+				return store.writeBatch(req.batch)
 			}
-		}
-	}()
+			if req.renameTo != "" {
+				return store.rename(req.key, req.renameTo)
+			}
+			return store.write(req.key, req.value, req.expiresAt)
+		})
+	})
 }
 
-// Close will handle closing and cleaning up database instance
+// Close will handle closing and cleaning up database instance. Reads and writes already using the
+// database are finished first, and any made after get ErrStorageClosed.
 func (store *BadgerStorage) Close() error {
+	store.writeQueue.close()
+
 	store.mu.Lock()
-	if !store.closed {
-		close(store.writeQueue)
-		store.closed = true
+	defer store.mu.Unlock()
+	if store.closed {
+		return nil
 	}
-	store.mu.Unlock()
-
+	store.closed = true
 	if store.database != nil {
 		return store.database.Close()
 	}
 	return nil
 }
 
+// withDatabase will call fn with the database, holding the lock so it can't be closed while fn
+// is using it. Returns ErrStorageClosed if the storage is closed or was never opened.
+func (store *BadgerStorage) withDatabase(fn func(db *badger.DB) error) error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if store.closed || store.database == nil {
+		return ErrStorageClosed
+	}
+	return fn(store.database)
+}
+
+// view will run fn in a read only transaction, or return ErrStorageClosed if the storage is closed.
+func (store *BadgerStorage) view(fn func(txn *badger.Txn) error) error {
+	return store.withDatabase(func(db *badger.DB) error {
+		return db.View(fn)
+	})
+}
+
+// update will run fn in a read write transaction, or return ErrStorageClosed if the storage is closed.
+func (store *BadgerStorage) update(fn func(txn *badger.Txn) error) error {
+	return store.withDatabase(func(db *badger.DB) error {
+		return db.Update(fn)
+	})
+}
+
 // Put will set a key to a value that is passed in.
-func (store *BadgerStorage) put(key string, value map[string]any) error {
+func (store *BadgerStorage) put(key string, value any, expiresAt time.Time) error {
 
 	byteData, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
-	err = store.database.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(key), byteData)
+	entry := badger.NewEntry([]byte(key), byteData)
+	if !expiresAt.IsZero() {
+		entry.ExpiresAt = badgerExpiresAt(expiresAt)
+	}
+	err = store.update(func(txn *badger.Txn) error {
+		return txn.SetEntry(entry)
 	})
 	if err != nil {
 		return err
@@ -104,36 +126,53 @@ func (store *BadgerStorage) put(key string, value map[string]any) error {
 	return nil
 }
 
-func (store *BadgerStorage) AsyncPut(ctx context.Context, key string, value map[string]any, timestamp time.Time) chan error {
-	returnChannel := make(chan error, 1)
+// putBatch will set every key in the batch to its value in one transaction. If any of them
+// fail, the transaction is discarded and nothing is stored.
+func (store *BadgerStorage) putBatch(entries []BatchEntry) error {
+	return store.update(func(txn *badger.Txn) error {
+		for _, batchEntry := range entries {
+			byteData, err := json.Marshal(batchEntry.Value)
+			if err != nil {
+				return fmt.Errorf("couldn't encode value for %s: %w", batchEntry.Key, err)
+			}
 
-	store.mu.Lock()
-	if store.closed {
-		store.mu.Unlock()
-		returnChannel <- fmt.Errorf("storage is closed")
-		close(returnChannel)
-		return returnChannel
-	}
-	store.mu.Unlock()
-
-	select {
-	case store.writeQueue <- dbWriteRequest{key: key, value: value, errCh: returnChannel, writeCtx: ctx}:
-		// queued successfully
-	case <-ctx.Done():
-		returnChannel <- ctx.Err()
-		close(returnChannel)
-	default:
-		returnChannel <- fmt.Errorf("write queue is full")
-		close(returnChannel)
+			entry := badger.NewEntry([]byte(batchEntry.Key), byteData)
+			if !batchEntry.ExpiresAt.IsZero() {
+				entry.ExpiresAt = badgerExpiresAt(batchEntry.ExpiresAt)
+			}
+			if err := txn.SetEntry(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// badgerExpiresAt will convert an expiry time to the unix seconds badger expires entries at,
+// rounding up so a value is never expired early.
+func badgerExpiresAt(expiresAt time.Time) uint64 {
+	seconds := expiresAt.Unix()
+	if expiresAt.Nanosecond() > 0 {
+		seconds++
 	}
-	return returnChannel
+	return uint64(seconds)
+}
+
+func (store *BadgerStorage) AsyncPut(ctx context.Context, key string, value any, timestamp time.Time, expiresAt time.Time) chan error {
+	return store.writeQueue.enqueue(dbWriteRequest{key: key, value: value, writeCtx: ctx, expiresAt: expiresAt})
+}
+
+// AsyncPutBatch will queue a write of every entry in a single transaction and return a channel
+// that responds with the error from the write, if any.
+func (store *BadgerStorage) AsyncPutBatch(ctx context.Context, entries []BatchEntry) chan error {
+	return store.writeQueue.enqueue(dbWriteRequest{batch: entries, writeCtx: ctx})
 }
 
 // Get will retrieve the value of the supplied key
-func (store *BadgerStorage) Get(ctx context.Context, key string) (map[string]any, error) {
-	var result map[string]any
+func (store *BadgerStorage) Get(ctx context.Context, key string) (any, error) {
+	var result any
 
-	err := store.database.View(func(txn *badger.Txn) error {
+	err := store.view(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
 		if err != nil {
 			return err
@@ -158,9 +197,22 @@ func (store *BadgerStorage) Get(ctx context.Context, key string) (map[string]any
 	return result, nil
 }
 
+// GetAt isn't supported by badger storage since only the latest value for a key is kept.
+func (store *BadgerStorage) GetAt(ctx context.Context, key string, at time.Time) (any, error) {
+	return nil, ErrHistoryNotSupported
+}
+
+// GetRecent isn't supported by badger storage since only the latest value for a key is kept.
+func (store *BadgerStorage) GetRecent(ctx context.Context, key string, n int) ([]any, error) {
+	return nil, ErrHistoryNotSupported
+}
+
 // Delete will delete a key, value pair from the database.
 func (store *BadgerStorage) Delete(ctx context.Context, key string) error {
-	err := store.database.Update(func(txn *badger.Txn) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := store.update(func(txn *badger.Txn) error {
 		return txn.Delete([]byte(key))
 	})
 	if err != nil {
@@ -168,3 +220,83 @@ func (store *BadgerStorage) Delete(ctx context.Context, key string) error {
 	}
 	return nil
 }
+
+// Rename will move the value stored under a key to a new key in a single transaction.
+// If there is no value for the old key, nothing is done. It's queued with the writes, so it's done
+// after the ones already queued.
+func (store *BadgerStorage) Rename(ctx context.Context, oldKey string, newKey string) error {
+	return <-store.writeQueue.enqueue(dbWriteRequest{key: oldKey, renameTo: newKey, writeCtx: ctx})
+}
+
+// rename is the write the writer does for a queued Rename.
+func (store *BadgerStorage) rename(oldKey string, newKey string) error {
+	return store.update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(oldKey))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			return err
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		entry := badger.NewEntry([]byte(newKey), val)
+		entry.ExpiresAt = item.ExpiresAt() // a value that expires keeps its expiry
+		if err := txn.SetEntry(entry); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(oldKey))
+	})
+}
+
+// Stats will return the size of the LSM tree and value log, and the number of keys that aren't
+// deleted or expired. Badger only works out its size on disk about once a minute, so until it
+// has, the size is estimated from the size of the keys and values instead.
+func (store *BadgerStorage) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	var estimatedSize int64
+	err := store.withDatabase(func(db *badger.DB) error {
+		err := db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false // only the keys are counted
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				stats.Keys++
+				estimatedSize += it.Item().EstimatedSize()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		lsm, vlog := db.Size()
+		stats.SizeBytes = lsm + vlog
+		return nil
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	if stats.SizeBytes == 0 {
+		stats.SizeBytes = estimatedSize
+	}
+	return stats, nil
+}
+
+// QueueStats will return how many writes are queued and how long they're taking to be written.
+func (store *BadgerStorage) QueueStats() QueueStats {
+	return store.writeQueue.stats(time.Now())
+}
+
+// KeepsHistory will always return false, only the latest value of each key is kept.
+func (store *BadgerStorage) KeepsHistory() bool {
+	return false
+}
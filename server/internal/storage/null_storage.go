@@ -23,11 +23,12 @@ func (n *NullStorage) Close() error {
 	return nil
 }
 
-func (n *NullStorage) AsyncPut(ctx context.Context, key string, value map[string]any, timestamp time.Time) chan error {
+func (n *NullStorage) AsyncPut(ctx context.Context, key string, value any, timestamp time.Time, expiresAt time.Time) chan error {
 	log.WithFields(log.Fields{
-		"key":       key,
-		"value":     value,
-		"timestamp": timestamp,
+		"key":        key,
+		"value":      value,
+		"timestamp":  timestamp,
+		"expires_at": expiresAt,
 	}).Debug("[NullStorage] AsyncPut called")
 	ch := make(chan error, 1)
 	ch <- nil
@@ -35,12 +36,50 @@ func (n *NullStorage) AsyncPut(ctx context.Context, key string, value map[string
 	return ch
 }
 
-func (n *NullStorage) Get(ctx context.Context, key string) (map[string]any, error) {
+func (n *NullStorage) AsyncPutBatch(ctx context.Context, entries []BatchEntry) chan error {
+	log.Debugf("[NullStorage] AsyncPutBatch called with %d entries", len(entries))
+	ch := make(chan error, 1)
+	ch <- nil
+	close(ch)
+	return ch
+}
+
+func (n *NullStorage) Get(ctx context.Context, key string) (any, error) {
 	log.Debugf("[NullStorage] Get called for key: %s", key)
 	return nil, nil
 }
 
+func (n *NullStorage) GetAt(ctx context.Context, key string, at time.Time) (any, error) {
+	log.Debugf("[NullStorage] GetAt called for key: %s at: %s", key, at)
+	return nil, nil
+}
+
+func (n *NullStorage) GetRecent(ctx context.Context, key string, count int) ([]any, error) {
+	log.Debugf("[NullStorage] GetRecent called for key: %s count: %d", key, count)
+	return []any{}, nil
+}
+
 func (n *NullStorage) Delete(ctx context.Context, key string) error {
 	log.Debugf("[NullStorage] Delete called for key: %s", key)
 	return nil
 }
+
+func (n *NullStorage) Rename(ctx context.Context, oldKey string, newKey string) error {
+	log.Debugf("[NullStorage] Rename called for key: %s to key: %s", oldKey, newKey)
+	return nil
+}
+
+func (n *NullStorage) Stats(ctx context.Context) (Stats, error) {
+	log.Debug("[NullStorage] Stats called")
+	return Stats{}, nil
+}
+
+// QueueStats will always return empty stats, nothing is ever queued.
+func (n *NullStorage) QueueStats() QueueStats {
+	return QueueStats{}
+}
+
+// KeepsHistory will always return false, nothing is kept.
+func (n *NullStorage) KeepsHistory() bool {
+	return false
+}
@@ -4,31 +4,89 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"sync"
+	"net/url"
+	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	_ "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 // SqliteStorage is the SQLite implementation of the storage.Storage interface.
 type SqliteStorage struct {
 	db         *sql.DB
-	writeQueue chan dbWriteRequest
-	mu         sync.Mutex
-	closed     bool
+	writeQueue *writeQueue
+	options    SqliteOptions
+	retry      RetryOptions
+	write      func(ctx context.Context, key string, value any, timestamp time.Time, expiresAt time.Time) error
+	writeBatch func(ctx context.Context, entries []BatchEntry) error
 }
 
-func NewSqliteStorage() *SqliteStorage {
-	return &SqliteStorage{
-		writeQueue: make(chan dbWriteRequest, 5000),
+// SqliteOptions are the pragmas that are applied to every connection to the database.
+// Blank values leave SQLite's default in place.
+type SqliteOptions struct {
+	JournalMode string        // DELETE, TRUNCATE, PERSIST, MEMORY, WAL, or OFF
+	Synchronous string        // OFF, NORMAL, FULL, or EXTRA
+	BusyTimeout time.Duration // how long to wait on a locked database before failing
+}
+
+func NewSqliteStorage(options SqliteOptions) *SqliteStorage {
+	s := &SqliteStorage{
+		writeQueue: newWriteQueue(5000),
+		options:    options,
+	}
+	s.write = s.put
+	s.writeBatch = s.putBatch
+	return s
+}
+
+// isRetryableSqliteError will return true for errors from the database being busy or locked by
+// another connection, which can succeed if tried again.
+func isRetryableSqliteError(err error) bool {
+	var coded interface{ Code() int }
+	if !errors.As(err, &coded) {
+		return false
+	}
+	switch coded.Code() & 0xff { // extended result codes keep the primary code in the low byte
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	default:
+		return false
+	}
+}
+
+// dataSourceName will add the pragmas from the options onto the path so the driver applies
+// them to every connection it opens, not just the first one.
+func (s *SqliteStorage) dataSourceName(path string) string {
+	query := url.Values{}
+	if s.options.BusyTimeout > 0 {
+		query.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", s.options.BusyTimeout.Milliseconds()))
+	}
+	if s.options.JournalMode != "" {
+		query.Add("_pragma", fmt.Sprintf("journal_mode(%s)", s.options.JournalMode))
+	}
+	if s.options.Synchronous != "" {
+		query.Add("_pragma", fmt.Sprintf("synchronous(%s)", s.options.Synchronous))
+	}
+	if len(query) == 0 {
+		return path
+	}
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
 	}
+	return path + separator + query.Encode()
 }
 
-// Open will open the database, and create the table if it doesn't exist
+// Open will open the database, apply the pragmas, and create the tables if they don't exist.
+// The messages table has the latest value for each topic and when it expires in unix
+// nanoseconds, if it does. The message_history table has every value that was stored with
+// its timestamp in unix nanoseconds.
 func (s *SqliteStorage) Open(path string, ctx context.Context) error {
-	db, err := sql.Open("sqlite", path)
+	db, err := sql.Open("sqlite", s.dataSourceName(path))
 	if err != nil {
 		return err
 	}
@@ -36,8 +94,15 @@ func (s *SqliteStorage) Open(path string, ctx context.Context) error {
 		CREATE TABLE IF NOT EXISTS messages (
 			topicName TEXT PRIMARY KEY,
 			timestamp INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			expiresAt INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS message_history (
+			topicName TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
 			data BLOB NOT NULL
 		);
+		CREATE INDEX IF NOT EXISTS message_history_topic_time ON message_history (topicName, timestamp);
 	`
 
 	_, err = db.Exec(sqlStmt)
@@ -45,56 +110,60 @@ func (s *SqliteStorage) Open(path string, ctx context.Context) error {
 		db.Close()
 		return err
 	}
+	if err := addColumnIfMissing(db, "messages", "expiresAt", "INTEGER"); err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
 
 	s.startWriter(ctx) // now we open, start.
 
 	return nil
 }
 
+// addColumnIfMissing will add a column to a table that was created before the column existed.
+func addColumnIfMissing(db *sql.DB, table string, column string, columnType string) error {
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, columnType))
+	return err
+}
+
 // startWriter will start the goroutine that will handle writing to the store.
 func (store *SqliteStorage) startWriter(ctx context.Context) {
-	go func() {
-		for {
-			select {
-			case writeReq, ok := <-store.writeQueue:
-				if !ok {
-					return // queue closed
-				}
-
-				// doing this
-				select { // select context closed or proceed with write
-				// if context closed, write error and continue with loop
-				case <-writeReq.writeCtx.Done():
-					if writeReq.errCh != nil {
-						writeReq.errCh <- writeReq.writeCtx.Err()
-					}
-					continue
-				default: // no cancellation, continue with operation
-				}
-
-				err := store.put(writeReq.writeCtx, writeReq.key, writeReq.value, writeReq.timestamp)
-				if writeReq.errCh != nil { // does this chan exist?
-					writeReq.errCh <- err // give err to whoever sent this
-					log.Info("closing the write errCh")
-					close(writeReq.errCh)
-				}
-
-			case <-ctx.Done(): // if we get cancelled, stop the worker.
-				return
+	go store.writeQueue.run(ctx, func(req dbWriteRequest) error {
+		return writeWithRetry(req.writeCtx, store.retry, isRetryableSqliteError, req.key, func() error {
+			if req.batch != nil {
+				return store.writeBatch(req.writeCtx, req.batch)
 			}
-		}
-	}()
+			if req.renameTo != "" {
+				return store.rename(req.writeCtx, req.key, req.renameTo)
+			}
+			return store.write(req.writeCtx, req.key, req.value, req.timestamp, req.expiresAt)
+		})
+	})
 }
 
 // Close will handle closing and cleaning up database instance
 func (s *SqliteStorage) Close() error {
-
-	s.mu.Lock()
-	if !s.closed {
-		close(s.writeQueue)
-		s.closed = true
-	}
-	s.mu.Unlock()
+	s.writeQueue.close()
 
 	if s.db != nil {
 		return s.db.Close()
@@ -103,71 +172,98 @@ func (s *SqliteStorage) Close() error {
 }
 
 // Put will set a key to a value that is passed in.
-func (s *SqliteStorage) put(ctx context.Context, key string, value map[string]any, timestamp time.Time) error {
+func (s *SqliteStorage) put(ctx context.Context, key string, value any, timestamp time.Time, expiresAt time.Time) error {
 
 	data, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return putTx(ctx, tx, key, data, timestamp, expiresAt)
+	})
+}
+
+// putBatch will set every key in the batch to its value in one transaction. If any of them
+// fail, the transaction is rolled back and nothing is stored.
+func (s *SqliteStorage) putBatch(ctx context.Context, entries []BatchEntry) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		for _, entry := range entries {
+			data, err := json.Marshal(entry.Value)
+			if err != nil {
+				return fmt.Errorf("couldn't encode value for %s: %w", entry.Key, err)
+			}
+			if err := putTx(ctx, tx, entry.Key, data, entry.Timestamp, entry.ExpiresAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// putTx will write an encoded value for a key, and add it to the key's history, in the transaction.
+func putTx(ctx context.Context, tx *sql.Tx, key string, data []byte, timestamp time.Time, expiresAt time.Time) error {
 	// TODO: maybe handle error from SQL on collision instead of direct replace.
 	const insertStatement = `
-		INSERT OR REPLACE INTO messages (topicName, timestamp, data)
+		INSERT OR REPLACE INTO messages (topicName, timestamp, data, expiresAt)
+		VALUES (?, ?, ?, ?)
+	`
+	const historyStatement = `
+		INSERT INTO message_history (topicName, timestamp, data)
 		VALUES (?, ?, ?)
 	`
-	_, err = s.db.ExecContext(ctx, insertStatement, key, timestamp, data)
+	var expires sql.NullInt64
+	if !expiresAt.IsZero() {
+		expires = sql.NullInt64{Int64: expiresAt.UnixNano(), Valid: true}
+	}
+	if _, err := tx.ExecContext(ctx, insertStatement, key, timestamp, data, expires); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, historyStatement, key, timestamp.UnixNano(), data)
 	return err
 }
 
 // AsyncPut will handle queueing a write and handling the error channel that can respond with an error from the async put operation.
-func (s *SqliteStorage) AsyncPut(ctx context.Context, key string, value map[string]any, timestamp time.Time) chan error {
-	ch := make(chan error, 1)
-
-	s.mu.Lock()
-	if s.closed {
-		s.mu.Unlock()
-		ch <- fmt.Errorf("storage is closed")
-		close(ch)
-		return ch
-	}
-	s.mu.Unlock()
-
-	select {
-	case s.writeQueue <- dbWriteRequest{
+func (s *SqliteStorage) AsyncPut(ctx context.Context, key string, value any, timestamp time.Time, expiresAt time.Time) chan error {
+	return s.writeQueue.enqueue(dbWriteRequest{
 		key:       key,
 		value:     value,
-		errCh:     ch,
 		writeCtx:  ctx,
 		timestamp: timestamp,
-	}:
-		// queued successfully
-	default:
-		ch <- fmt.Errorf("write queue is full")
-		close(ch)
-	}
-	return ch
+		expiresAt: expiresAt,
+	})
+}
+
+// AsyncPutBatch will queue a write of every entry in a single transaction and return a channel
+// that responds with the error from the write, if any.
+func (s *SqliteStorage) AsyncPutBatch(ctx context.Context, entries []BatchEntry) chan error {
+	return s.writeQueue.enqueue(dbWriteRequest{batch: entries, writeCtx: ctx})
 }
 
-// Get will retrieve the value of the supplied key
-func (store *SqliteStorage) Get(ctx context.Context, key string) (map[string]any, error) {
+// Get will retrieve the value of the supplied key, or nil if the value has expired.
+func (store *SqliteStorage) Get(ctx context.Context, key string) (any, error) {
 
 	const query = `
-	SELECT data FROM messages
+	SELECT data, expiresAt FROM messages
 		WHERE topicName = ?
 		ORDER BY timestamp DESC
 		LIMIT 1
 	`
 
 	var rawData []byte
-	err := store.db.QueryRowContext(ctx, query, key).Scan(&rawData)
+	var expiresAt sql.NullInt64
+	err := store.db.QueryRowContext(ctx, query, key).Scan(&rawData, &expiresAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
+	if expiresAt.Valid && time.Now().UnixNano() >= expiresAt.Int64 {
+		return nil, nil
+	}
 
-	var result map[string]any
+	var result any
 	if err := json.Unmarshal(rawData, &result); err != nil {
 
 	}
@@ -175,9 +271,126 @@ func (store *SqliteStorage) Get(ctx context.Context, key string) (map[string]any
 	return result, nil
 }
 
-// Delete will delete a key, value pair from the database.
+// GetAt will retrieve the most recent value of the supplied key that was stored at or before the time.
+func (store *SqliteStorage) GetAt(ctx context.Context, key string, at time.Time) (any, error) {
+
+	const query = `
+	SELECT data FROM message_history
+		WHERE topicName = ? AND timestamp <= ?
+		ORDER BY timestamp DESC
+		LIMIT 1
+	`
+
+	var rawData []byte
+	err := store.db.QueryRowContext(ctx, query, key, at.UnixNano()).Scan(&rawData)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var result any
+	if err := json.Unmarshal(rawData, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetRecent will retrieve up to the last n values stored for the supplied key, newest first.
+func (store *SqliteStorage) GetRecent(ctx context.Context, key string, n int) ([]any, error) {
+
+	const query = `
+	SELECT data FROM message_history
+		WHERE topicName = ?
+		ORDER BY timestamp DESC
+		LIMIT ?
+	`
+
+	rows, err := store.db.QueryContext(ctx, query, key, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make([]any, 0, n)
+	for rows.Next() {
+		var rawData []byte
+		if err := rows.Scan(&rawData); err != nil {
+			return nil, err
+		}
+		var value any
+		if err := json.Unmarshal(rawData, &value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// Delete will delete a key, value pair and its history from the database.
 func (store *SqliteStorage) Delete(ctx context.Context, key string) error {
-	const stmt = `DELETE FROM messages WHERE topicName = ?`
-	_, err := store.db.ExecContext(ctx, stmt, key)
-	return err
+	return store.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE topicName = ?`, key); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM message_history WHERE topicName = ?`, key)
+		return err
+	})
+}
+
+// Rename will move the rows stored under a key, and its history, to a new key. It's queued with
+// the writes, so it's done after the ones already queued.
+func (store *SqliteStorage) Rename(ctx context.Context, oldKey string, newKey string) error {
+	return <-store.writeQueue.enqueue(dbWriteRequest{key: oldKey, renameTo: newKey, writeCtx: ctx})
+}
+
+// rename is the write the writer does for a queued Rename.
+func (store *SqliteStorage) rename(ctx context.Context, oldKey string, newKey string) error {
+	return store.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `UPDATE messages SET topicName = ? WHERE topicName = ?`, newKey, oldKey); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE message_history SET topicName = ? WHERE topicName = ?`, newKey, oldKey)
+		return err
+	})
+}
+
+// Stats will return the size of the database file from its page count and page size, and the
+// number of keys with a latest value. History rows aren't counted as keys but are in the size.
+func (store *SqliteStorage) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	const sizeQuery = `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
+	if err := store.db.QueryRowContext(ctx, sizeQuery).Scan(&stats.SizeBytes); err != nil {
+		return Stats{}, err
+	}
+	if err := store.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM messages`).Scan(&stats.Keys); err != nil {
+		return Stats{}, err
+	}
+	return stats, nil
+}
+
+// QueueStats will return how many writes are queued and how long they're taking to be written.
+func (store *SqliteStorage) QueueStats() QueueStats {
+	return store.writeQueue.stats(time.Now())
+}
+
+// KeepsHistory will always return true, every value stored is kept.
+func (store *SqliteStorage) KeepsHistory() bool {
+	return true
+}
+
+// inTx will run the function in a transaction, committing if it returns no error.
+func (store *SqliteStorage) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
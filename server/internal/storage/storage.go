@@ -2,20 +2,84 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/atyalexyoung/data-loom/server/internal/config"
 )
 
 type dbWriteRequest struct {
 	key       string
-	value     map[string]any
+	value     any
 	errCh     chan error
 	writeCtx  context.Context
 	timestamp time.Time
+	expiresAt time.Time    // zero if the value doesn't expire
+	batch     []BatchEntry // set for a batch of values that are written in one transaction instead of the key and value
+	renameTo  string       // set for moving the value stored under the key to this key instead of writing a value
+	queuedAt  time.Time    // when the request was put on the write queue
+}
+
+// BatchEntry is a single value that is written as part of a batch with AsyncPutBatch.
+type BatchEntry struct {
+	Key       string
+	Value     any
+	Timestamp time.Time
+	ExpiresAt time.Time // zero if the value doesn't expire
+}
+
+// RetryOptions are how many times a write that failed with a transient error, such as a busy
+// database, is retried and how long to wait before the first retry. The wait doubles after
+// every retry. The zero value doesn't retry.
+type RetryOptions struct {
+	Retries int
+	Backoff time.Duration
+}
+
+// writeWithRetry will call write, retrying it while it fails with an error that is retryable
+// and there are retries left. Returns the last error, or the context error if the context is
+// done while waiting to retry.
+func writeWithRetry(ctx context.Context, retry RetryOptions, retryable func(error) bool, key string, write func() error) error {
+	backoff := retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil || attempt > retry.Retries || !retryable(err) {
+			return err
+		}
+
+		log.WithFields(log.Fields{"key": key, "attempt": attempt, "backoff": backoff}).Warnf("transient error when writing to storage, retrying: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Stats is the approximate size of a storage, used for capacity monitoring.
+type Stats struct {
+	SizeBytes int64 // approximate size on disk
+	Keys      int64 // number of keys that have a stored value
+}
+
+// QueueStats is how backed up a storage's writes are, used for health checks.
+type QueueStats struct {
+	Depth        int           // number of writes waiting in the queue
+	Capacity     int           // number of writes the queue holds before rejecting them
+	WriteLatency time.Duration // how long the last write took from being queued to being written, or the write in progress if it's taking longer
 }
 
+// ErrHistoryNotSupported is returned when asking for a past value from a storage that only keeps the latest value.
+var ErrHistoryNotSupported = errors.New("storage does not keep value history")
+
+// ErrStorageClosed is returned by reads and writes made after the storage is closed.
+var ErrStorageClosed = errors.New("storage is closed")
+
 // Storage is an interface for any storage that will be used.
 type Storage interface {
 
@@ -25,27 +89,62 @@ type Storage interface {
 	// Close will handle closing and cleaning up database instance
 	Close() error
 
-	// AsyncPut will set a key to a value that is passed in.
-	AsyncPut(ctx context.Context, key string, value map[string]any, timestamp time.Time) chan error
+	// AsyncPut will set a key to a value that is passed in. If expiresAt isn't zero, Get
+	// doesn't return the value once it's past that time.
+	AsyncPut(ctx context.Context, key string, value any, timestamp time.Time, expiresAt time.Time) chan error
+
+	// AsyncPutBatch will set every key in the batch to its value in a single transaction, so
+	// either all of them are stored or none are. It is queued with the other writes, so it
+	// is applied in order with them.
+	AsyncPutBatch(ctx context.Context, entries []BatchEntry) chan error
 
-	// Get will retrieve the value of the supplied key
-	Get(ctx context.Context, key string) (map[string]any, error)
+	// Get will retrieve the value of the supplied key, or nil if the value has expired.
+	Get(ctx context.Context, key string) (any, error)
+
+	// GetAt will retrieve the most recent value of the supplied key that was stored at or before
+	// the time. Returns ErrHistoryNotSupported if the storage only keeps the latest value.
+	GetAt(ctx context.Context, key string, at time.Time) (any, error)
+
+	// GetRecent will retrieve up to the last n values stored for the supplied key, newest first.
+	// Returns ErrHistoryNotSupported if the storage only keeps the latest value.
+	GetRecent(ctx context.Context, key string, n int) ([]any, error)
 
 	// Delete will delete a key, value pair from the database.
 	Delete(ctx context.Context, key string) error
+
+	// Rename will move the value stored under a key to a new key. It is queued with the writes, so
+	// values queued for the old key before it are moved too.
+	Rename(ctx context.Context, oldKey string, newKey string) error
+
+	// Stats will return the approximate size on disk and number of keys in the storage.
+	Stats(ctx context.Context) (Stats, error)
+
+	// QueueStats will return how many writes are queued and how long they're taking to be written.
+	QueueStats() QueueStats
+
+	// KeepsHistory will return if past values are kept for GetAt and GetRecent, instead of them
+	// returning ErrHistoryNotSupported.
+	KeepsHistory() bool
 }
 
-// NewStorage takes the configuration and returns the storage type that is specified.
+// NewStorage takes the configuration and returns the storage type that is specified. The type
+// is matched without case or surrounding spaces, the same as config.Load reads it.
 func NewStorage(cfg *config.Config, ctx context.Context) (Storage, error) {
-	switch cfg.StorageType {
+	switch strings.ToLower(strings.TrimSpace(cfg.StorageType)) {
 	case "badger":
 		s := NewBadgerStorage()
+		s.retry = RetryOptions{Retries: cfg.StorageWriteRetries, Backoff: cfg.StorageRetryBackoff}
 		if err := s.Open(cfg.StoragePath, ctx); err != nil {
 			return nil, err
 		}
 		return s, nil
 	case "sqlite":
-		s := NewSqliteStorage()
+		s := NewSqliteStorage(SqliteOptions{
+			JournalMode: cfg.SqliteJournalMode,
+			Synchronous: cfg.SqliteSynchronous,
+			BusyTimeout: cfg.SqliteBusyTimeout,
+		})
+		s.retry = RetryOptions{Retries: cfg.StorageWriteRetries, Backoff: cfg.StorageRetryBackoff}
 		if err := s.Open(cfg.StoragePath, ctx); err != nil {
 			return nil, err
 		}
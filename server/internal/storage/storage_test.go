@@ -0,0 +1,568 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// openTestStorages will open every persistent storage type in a temp dir for a test.
+func openTestStorages(t *testing.T) map[string]Storage {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	badgerStore := NewBadgerStorage()
+	require.NoError(t, badgerStore.Open(t.TempDir(), ctx))
+	t.Cleanup(func() { badgerStore.Close() })
+
+	sqliteStore := NewSqliteStorage(SqliteOptions{})
+	require.NoError(t, sqliteStore.Open(filepath.Join(t.TempDir(), "test.db"), ctx))
+	t.Cleanup(func() { sqliteStore.Close() })
+
+	return map[string]Storage{
+		"badger": badgerStore,
+		"sqlite": sqliteStore,
+	}
+}
+
+func TestRename_MovesValue(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			value := map[string]any{"message": "hello"}
+			require.NoError(t, <-store.AsyncPut(ctx, "old-name", value, time.Now().UTC(), time.Time{}))
+
+			require.NoError(t, store.Rename(ctx, "old-name", "new-name"))
+
+			moved, err := store.Get(ctx, "new-name")
+			require.NoError(t, err)
+			assert.Equal(t, value, moved)
+
+			old, err := store.Get(ctx, "old-name")
+			require.NoError(t, err)
+			assert.Nil(t, old)
+		})
+	}
+}
+
+func TestRename_MissingKeyIsNoop(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			require.NoError(t, store.Rename(ctx, "missing", "still-missing"))
+
+			value, err := store.Get(ctx, "still-missing")
+			require.NoError(t, err)
+			assert.Nil(t, value)
+		})
+	}
+}
+
+func TestRename_AfterQueuedWrite(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			written := store.AsyncPut(ctx, "old-name", "queued", time.Now().UTC(), time.Time{})
+
+			require.NoError(t, store.Rename(ctx, "old-name", "new-name"))
+			require.NoError(t, <-written)
+
+			moved, err := store.Get(ctx, "new-name")
+			require.NoError(t, err)
+			assert.Equal(t, "queued", moved)
+
+			old, err := store.Get(ctx, "old-name")
+			require.NoError(t, err)
+			assert.Nil(t, old)
+		})
+	}
+}
+
+func TestPutAndGet_ArrayValue(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			value := []any{map[string]any{"name": "first"}, "second"}
+			require.NoError(t, <-store.AsyncPut(ctx, "list", value, time.Now().UTC(), time.Time{}))
+
+			stored, err := store.Get(ctx, "list")
+			require.NoError(t, err)
+			assert.Equal(t, value, stored)
+		})
+	}
+}
+
+func TestSqliteGetRecent_NewestFirstAndLimited(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewSqliteStorage(SqliteOptions{})
+	require.NoError(t, store.Open(filepath.Join(t.TempDir(), "test.db"), ctx))
+	defer store.Close()
+
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, <-store.AsyncPut(ctx, "sparkline", float64(i), start.Add(time.Duration(i)*time.Second), time.Time{}))
+	}
+	require.NoError(t, <-store.AsyncPut(ctx, "other", float64(100), start, time.Time{}))
+
+	recent, err := store.GetRecent(ctx, "sparkline", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []any{float64(5), float64(4), float64(3)}, recent)
+
+	// asking for more than there are gets all of them
+	recent, err = store.GetRecent(ctx, "sparkline", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []any{float64(5), float64(4), float64(3), float64(2), float64(1)}, recent)
+
+	recent, err = store.GetRecent(ctx, "missing", 3)
+	require.NoError(t, err)
+	assert.Empty(t, recent)
+}
+
+func TestBadgerGetRecent_NotSupported(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewBadgerStorage()
+	require.NoError(t, store.Open(t.TempDir(), ctx))
+	defer store.Close()
+
+	_, err := store.GetRecent(ctx, "sparkline", 3)
+	assert.ErrorIs(t, err, ErrHistoryNotSupported)
+}
+
+func TestGet_ExpiredValueNotReturned(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now().UTC()
+			fresh := map[string]any{"command": "open"}
+			require.NoError(t, <-store.AsyncPut(ctx, "expired", map[string]any{"command": "close"}, now, now.Add(-time.Second)))
+			require.NoError(t, <-store.AsyncPut(ctx, "fresh", fresh, now, now.Add(time.Hour)))
+
+			value, err := store.Get(ctx, "expired")
+			require.NoError(t, err)
+			assert.Nil(t, value)
+
+			value, err = store.Get(ctx, "fresh")
+			require.NoError(t, err)
+			assert.Equal(t, fresh, value)
+
+			// a renamed value keeps its expiry
+			require.NoError(t, store.Rename(ctx, "expired", "renamed"))
+			value, err = store.Get(ctx, "renamed")
+			require.NoError(t, err)
+			assert.Nil(t, value)
+		})
+	}
+}
+
+func TestSqliteOpen_AddsExpiresAtToOldDatabase(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "old.db")
+
+	// the messages table from before values could expire
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE messages (topicName TEXT PRIMARY KEY, timestamp INTEGER NOT NULL, data BLOB NOT NULL);
+		INSERT INTO messages (topicName, timestamp, data) VALUES ('old', 0, '{"a":"1"}');
+	`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	store := NewSqliteStorage(SqliteOptions{})
+	require.NoError(t, store.Open(path, ctx))
+	defer store.Close()
+
+	value, err := store.Get(ctx, "old")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": "1"}, value)
+
+	now := time.Now().UTC()
+	require.NoError(t, <-store.AsyncPut(ctx, "old", map[string]any{"a": "2"}, now, now.Add(-time.Second)))
+	value, err = store.Get(ctx, "old")
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestSqlitePragmas_AppliedAndRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewSqliteStorage(SqliteOptions{
+		JournalMode: "WAL",
+		Synchronous: "NORMAL",
+		BusyTimeout: 1234 * time.Millisecond,
+	})
+	require.NoError(t, store.Open(filepath.Join(t.TempDir(), "pragmas.db"), ctx))
+	defer store.Close()
+
+	var journalMode string
+	require.NoError(t, store.db.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+
+	var synchronous int
+	require.NoError(t, store.db.QueryRowContext(ctx, "PRAGMA synchronous").Scan(&synchronous))
+	assert.Equal(t, 1, synchronous) // 1 is NORMAL
+
+	var busyTimeout int
+	require.NoError(t, store.db.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&busyTimeout))
+	assert.Equal(t, 1234, busyTimeout)
+
+	value := map[string]any{"message": "hello"}
+	require.NoError(t, <-store.AsyncPut(ctx, "pragma-topic", value, time.Now().UTC(), time.Time{}))
+	stored, err := store.Get(ctx, "pragma-topic")
+	require.NoError(t, err)
+	assert.Equal(t, value, stored)
+}
+
+func TestNewStorage_UnknownTypeErrors(t *testing.T) {
+	for _, storageType := range []string{"sqlte", "postgres", "bad ger"} {
+		store, err := NewStorage(&config.Config{StorageType: storageType, StoragePath: t.TempDir()}, context.Background())
+		assert.Error(t, err, storageType)
+		assert.ErrorContains(t, err, "unknown storage type")
+		assert.Nil(t, store, storageType)
+	}
+}
+
+func TestNewStorage_TypeIgnoresCase(t *testing.T) {
+	store, err := NewStorage(&config.Config{StorageType: " SQLite", StoragePath: filepath.Join(t.TempDir(), "test.db")}, context.Background())
+	require.NoError(t, err)
+	defer store.Close()
+	assert.IsType(t, &SqliteStorage{}, store)
+}
+
+func TestNewStorage_NoneIsNullStorage(t *testing.T) {
+	for _, storageType := range []string{"none", "", " None ", "NONE"} {
+		store, err := NewStorage(&config.Config{StorageType: storageType}, context.Background())
+		require.NoError(t, err)
+		assert.IsType(t, &NullStorage{}, store)
+	}
+}
+
+func TestSqliteGetAt_ReturnsValueAtTime(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStorages(t)["sqlite"]
+	assert.True(t, store.KeepsHistory())
+
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, value := range []string{"first", "second", "third"} {
+		at := base.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, <-store.AsyncPut(ctx, "history", map[string]any{"value": value}, at, time.Time{}))
+	}
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		expected any
+	}{
+		{name: "before first", at: base.Add(-time.Second), expected: nil},
+		{name: "exactly first", at: base, expected: map[string]any{"value": "first"}},
+		{name: "between first and second", at: base.Add(30 * time.Second), expected: map[string]any{"value": "first"}},
+		{name: "between second and third", at: base.Add(90 * time.Second), expected: map[string]any{"value": "second"}},
+		{name: "after last", at: base.Add(time.Hour), expected: map[string]any{"value": "third"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := store.GetAt(ctx, "history", tt.at)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+
+	// the latest value is still the last one stored
+	latest, err := store.Get(ctx, "history")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"value": "third"}, latest)
+}
+
+func TestSqliteGetAt_HistoryFollowsRenameAndDelete(t *testing.T) {
+	ctx := context.Background()
+	store := openTestStorages(t)["sqlite"]
+
+	at := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, <-store.AsyncPut(ctx, "old-name", map[string]any{"value": "kept"}, at, time.Time{}))
+
+	require.NoError(t, store.Rename(ctx, "old-name", "new-name"))
+	value, err := store.GetAt(ctx, "new-name", at)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"value": "kept"}, value)
+	value, err = store.GetAt(ctx, "old-name", at)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+
+	require.NoError(t, store.Delete(ctx, "new-name"))
+	value, err = store.GetAt(ctx, "new-name", at)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestBadgerGetAt_NotSupported(t *testing.T) {
+	store := openTestStorages(t)["badger"]
+	assert.False(t, store.KeepsHistory())
+	_, err := store.GetAt(context.Background(), "history", time.Now())
+	assert.ErrorIs(t, err, ErrHistoryNotSupported)
+}
+
+// sqliteCodeError is an error with a sqlite result code, like the errors from the sqlite driver.
+type sqliteCodeError int
+
+func (e sqliteCodeError) Error() string { return fmt.Sprintf("sqlite error code %d", int(e)) }
+func (e sqliteCodeError) Code() int     { return int(e) }
+
+// flakyWrites will return the errors in order for the first writes, then call write.
+type flakyWrites struct {
+	mu       sync.Mutex
+	errs     []error
+	attempts int
+}
+
+func (f *flakyWrites) next() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts++
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+func (f *flakyWrites) Attempts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.attempts
+}
+
+// openFlakySqlite will open a sqlite storage whose writes fail with the errors before they work.
+func openFlakySqlite(t *testing.T, retry RetryOptions, errs ...error) (*SqliteStorage, *flakyWrites) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	flaky := &flakyWrites{errs: errs}
+	store := NewSqliteStorage(SqliteOptions{})
+	store.retry = retry
+	store.write = func(ctx context.Context, key string, value any, timestamp time.Time, expiresAt time.Time) error {
+		if err := flaky.next(); err != nil {
+			return err
+		}
+		return store.put(ctx, key, value, timestamp, expiresAt)
+	}
+	require.NoError(t, store.Open(filepath.Join(t.TempDir(), "test.db"), ctx))
+	t.Cleanup(func() { store.Close() })
+	return store, flaky
+}
+
+func TestSqliteWrite_RetriesTransientErrors(t *testing.T) {
+	busy := sqliteCodeError(sqlite3.SQLITE_BUSY)
+	locked := sqliteCodeError(sqlite3.SQLITE_LOCKED_SHAREDCACHE) // extended code
+	store, flaky := openFlakySqlite(t, RetryOptions{Retries: 3, Backoff: time.Millisecond}, busy, locked)
+
+	ctx := context.Background()
+	value := map[string]any{"message": "persisted"}
+	require.NoError(t, <-store.AsyncPut(ctx, "retried", value, time.Now().UTC(), time.Time{}))
+	assert.Equal(t, 3, flaky.Attempts())
+
+	stored, err := store.Get(ctx, "retried")
+	require.NoError(t, err)
+	assert.Equal(t, value, stored)
+}
+
+func TestSqliteWrite_GivesUpAfterRetries(t *testing.T) {
+	busy := sqliteCodeError(sqlite3.SQLITE_BUSY)
+	store, flaky := openFlakySqlite(t, RetryOptions{Retries: 2, Backoff: time.Millisecond}, busy, busy, busy, busy)
+
+	err := <-store.AsyncPut(context.Background(), "busy", map[string]any{"a": "1"}, time.Now().UTC(), time.Time{})
+	assert.ErrorIs(t, err, busy)
+	assert.Equal(t, 3, flaky.Attempts())
+}
+
+func TestSqliteWrite_PermanentErrorsNotRetried(t *testing.T) {
+	readOnly := sqliteCodeError(sqlite3.SQLITE_READONLY)
+	store, flaky := openFlakySqlite(t, RetryOptions{Retries: 3, Backoff: time.Millisecond}, readOnly)
+
+	err := <-store.AsyncPut(context.Background(), "read-only", map[string]any{"a": "1"}, time.Now().UTC(), time.Time{})
+	assert.ErrorIs(t, err, readOnly)
+	assert.Equal(t, 1, flaky.Attempts())
+}
+
+func TestBadgerWrite_RetriesConflicts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	flaky := &flakyWrites{errs: []error{badger.ErrConflict, badger.ErrConflict}}
+	store := NewBadgerStorage()
+	store.retry = RetryOptions{Retries: 3, Backoff: time.Millisecond}
+	store.write = func(key string, value any, expiresAt time.Time) error {
+		if err := flaky.next(); err != nil {
+			return err
+		}
+		return store.put(key, value, expiresAt)
+	}
+	require.NoError(t, store.Open(t.TempDir(), ctx))
+	defer store.Close()
+
+	value := map[string]any{"message": "persisted"}
+	require.NoError(t, <-store.AsyncPut(ctx, "retried", value, time.Now().UTC(), time.Time{}))
+	assert.Equal(t, 3, flaky.Attempts())
+
+	stored, err := store.Get(ctx, "retried")
+	require.NoError(t, err)
+	assert.Equal(t, value, stored)
+}
+
+func TestPutBatch_StoresEveryValue(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now().UTC()
+			require.NoError(t, <-store.AsyncPutBatch(ctx, []BatchEntry{
+				{Key: "debits", Value: map[string]any{"total": 5.0}, Timestamp: now},
+				{Key: "credits", Value: map[string]any{"total": 5.0}, Timestamp: now},
+			}))
+
+			for _, key := range []string{"debits", "credits"} {
+				value, err := store.Get(ctx, key)
+				require.NoError(t, err)
+				assert.Equal(t, map[string]any{"total": 5.0}, value, key)
+			}
+		})
+	}
+}
+
+func TestPutBatch_FailureStoresNothing(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now().UTC()
+			require.NoError(t, <-store.AsyncPut(ctx, "debits", map[string]any{"total": 1.0}, now, time.Time{}))
+
+			// the second value can't be encoded, so the first one is rolled back
+			err := <-store.AsyncPutBatch(ctx, []BatchEntry{
+				{Key: "debits", Value: map[string]any{"total": 5.0}, Timestamp: now.Add(time.Millisecond)},
+				{Key: "credits", Value: make(chan int), Timestamp: now.Add(time.Millisecond)},
+			})
+			require.Error(t, err)
+
+			debits, err := store.Get(ctx, "debits")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]any{"total": 1.0}, debits)
+
+			credits, err := store.Get(ctx, "credits")
+			require.NoError(t, err)
+			assert.Nil(t, credits)
+		})
+	}
+}
+
+func TestSqlitePutBatch_AddsHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := NewSqliteStorage(SqliteOptions{})
+	require.NoError(t, store.Open(filepath.Join(t.TempDir(), "test.db"), ctx))
+	defer store.Close()
+
+	now := time.Now().UTC()
+	require.NoError(t, <-store.AsyncPut(ctx, "debits", "first", now, time.Time{}))
+	require.NoError(t, <-store.AsyncPutBatch(ctx, []BatchEntry{{Key: "debits", Value: "second", Timestamp: now.Add(time.Millisecond)}}))
+
+	recent, err := store.GetRecent(ctx, "debits", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []any{"second", "first"}, recent)
+}
+
+func TestStats_NonZeroAfterWrites(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for i := range 3 {
+				require.NoError(t, <-store.AsyncPut(ctx, fmt.Sprintf("key-%d", i), map[string]any{"i": i}, time.Now().UTC(), time.Time{}))
+			}
+			// a second write to a key is still one key
+			require.NoError(t, <-store.AsyncPut(ctx, "key-0", map[string]any{"i": 10}, time.Now().UTC(), time.Time{}))
+
+			stats, err := store.Stats(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, int64(3), stats.Keys)
+			assert.Positive(t, stats.SizeBytes)
+		})
+	}
+}
+
+func TestStats_DeletedKeysNotCounted(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			require.NoError(t, <-store.AsyncPut(ctx, "kept", 1, time.Now().UTC(), time.Time{}))
+			require.NoError(t, <-store.AsyncPut(ctx, "deleted", 2, time.Now().UTC(), time.Time{}))
+			require.NoError(t, store.Delete(ctx, "deleted"))
+
+			stats, err := store.Stats(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), stats.Keys)
+		})
+	}
+}
+
+func TestBadgerClosed_OperationsReturnStorageClosed(t *testing.T) {
+	ctx := context.Background()
+	store := NewBadgerStorage()
+	require.NoError(t, store.Open(t.TempDir(), ctx))
+	require.NoError(t, <-store.AsyncPut(ctx, "key", "value", time.Now().UTC(), time.Time{}))
+	require.NoError(t, store.Close())
+
+	_, err := store.Get(ctx, "key")
+	assert.ErrorIs(t, err, ErrStorageClosed)
+	assert.ErrorIs(t, store.Delete(ctx, "key"), ErrStorageClosed)
+	assert.ErrorIs(t, store.Rename(ctx, "key", "other"), ErrStorageClosed)
+	_, err = store.Stats(ctx)
+	assert.ErrorIs(t, err, ErrStorageClosed)
+	assert.ErrorIs(t, <-store.AsyncPut(ctx, "key", "late", time.Now().UTC(), time.Time{}), ErrStorageClosed)
+	assert.ErrorIs(t, <-store.AsyncPutBatch(ctx, []BatchEntry{{Key: "key", Value: "late"}}), ErrStorageClosed)
+	assert.NoError(t, store.Close()) // closing twice is fine
+}
+
+func TestBadgerClosed_NeverOpened(t *testing.T) {
+	store := NewBadgerStorage()
+	_, err := store.Get(context.Background(), "key")
+	assert.ErrorIs(t, err, ErrStorageClosed)
+	assert.ErrorIs(t, store.Delete(context.Background(), "key"), ErrStorageClosed)
+}
+
+func TestBadgerClosed_WhileReading(t *testing.T) {
+	ctx := context.Background()
+	store := NewBadgerStorage()
+	require.NoError(t, store.Open(t.TempDir(), ctx))
+	require.NoError(t, <-store.AsyncPut(ctx, "key", "value", time.Now().UTC(), time.Time{}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := store.Get(ctx, "key"); err != nil {
+					assert.ErrorIs(t, err, ErrStorageClosed)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, store.Close())
+	wg.Wait()
+}
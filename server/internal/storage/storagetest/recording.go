@@ -0,0 +1,218 @@
+package storagetest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+)
+
+// StorageCall is a single call that was made to a RecordingStorage and the arguments it was called with.
+type StorageCall struct {
+	Method    string               // "AsyncPut", "AsyncPutBatch", "Get", "GetAt", "GetRecent", "Delete", "Rename", or "Stats"
+	Key       string               // for Rename, the old key
+	NewKey    string               // Rename only
+	Value     any                  // AsyncPut only
+	Timestamp time.Time            // the timestamp for AsyncPut, or the time for GetAt
+	ExpiresAt time.Time            // AsyncPut only, zero if the value doesn't expire
+	Count     int                  // GetRecent only
+	Batch     []storage.BatchEntry // AsyncPutBatch only
+}
+
+// RecordingStorage is an in memory storage for tests that records every call made to it, so tests
+// can check what was persisted. It only keeps the latest value for each key. Errors can be set for
+// a method with Fail to test how storage failures are handled.
+type RecordingStorage struct {
+	mu       sync.Mutex
+	calls    []StorageCall
+	values   map[string]any
+	expires  map[string]time.Time
+	failures map[string]error
+	queue    storage.QueueStats
+}
+
+// NewRecordingStorage will create an empty RecordingStorage that is ready to use.
+func NewRecordingStorage() *RecordingStorage {
+	return &RecordingStorage{
+		values:   make(map[string]any),
+		expires:  make(map[string]time.Time),
+		failures: make(map[string]error),
+	}
+}
+
+// Fail will make every later call to the method return the error, or stop failing if err is nil.
+func (r *RecordingStorage) Fail(method string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		delete(r.failures, method)
+		return
+	}
+	r.failures[method] = err
+}
+
+// SetQueueStats will make QueueStats return the stats, to test how a backed up write queue is handled.
+func (r *RecordingStorage) SetQueueStats(stats storage.QueueStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queue = stats
+}
+
+// Calls will return every call that was made, in the order they were made.
+func (r *RecordingStorage) Calls() []StorageCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]StorageCall(nil), r.calls...)
+}
+
+// CallsTo will return the calls that were made to the method, in the order they were made.
+func (r *RecordingStorage) CallsTo(method string) []StorageCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var calls []StorageCall
+	for _, call := range r.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// record will add the call and return the error it should fail with, if any. Must hold the lock.
+func (r *RecordingStorage) record(call StorageCall) error {
+	r.calls = append(r.calls, call)
+	return r.failures[call.Method]
+}
+
+func (r *RecordingStorage) Open(path string, ctx context.Context) error {
+	return nil
+}
+
+func (r *RecordingStorage) Close() error {
+	return nil
+}
+
+func (r *RecordingStorage) AsyncPut(ctx context.Context, key string, value any, timestamp time.Time, expiresAt time.Time) chan error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.record(StorageCall{Method: "AsyncPut", Key: key, Value: value, Timestamp: timestamp, ExpiresAt: expiresAt})
+	if err == nil {
+		r.values[key] = value
+		r.expires[key] = expiresAt
+	}
+	ch := make(chan error, 1)
+	ch <- err
+	close(ch)
+	return ch
+}
+
+// AsyncPutBatch will record the call and store every entry, or none of them if it fails.
+func (r *RecordingStorage) AsyncPutBatch(ctx context.Context, entries []storage.BatchEntry) chan error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.record(StorageCall{Method: "AsyncPutBatch", Batch: entries})
+	if err == nil {
+		for _, entry := range entries {
+			r.values[entry.Key] = entry.Value
+			r.expires[entry.Key] = entry.ExpiresAt
+		}
+	}
+	ch := make(chan error, 1)
+	ch <- err
+	close(ch)
+	return ch
+}
+
+func (r *RecordingStorage) Get(ctx context.Context, key string) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.record(StorageCall{Method: "Get", Key: key}); err != nil {
+		return nil, err
+	}
+	if expiresAt := r.expires[key]; !expiresAt.IsZero() && !time.Now().Before(expiresAt) {
+		return nil, nil
+	}
+	return r.values[key], nil
+}
+
+// GetAt will record the call and return the latest value, since only the latest value is kept.
+func (r *RecordingStorage) GetAt(ctx context.Context, key string, at time.Time) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.record(StorageCall{Method: "GetAt", Key: key, Timestamp: at}); err != nil {
+		return nil, err
+	}
+	return r.values[key], nil
+}
+
+// GetRecent will record the call and return the latest value, if there is one, since only the latest value is kept.
+func (r *RecordingStorage) GetRecent(ctx context.Context, key string, n int) ([]any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.record(StorageCall{Method: "GetRecent", Key: key, Count: n}); err != nil {
+		return nil, err
+	}
+	values := make([]any, 0, 1)
+	if value, ok := r.values[key]; ok && n > 0 {
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (r *RecordingStorage) Delete(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.record(StorageCall{Method: "Delete", Key: key}); err != nil {
+		return err
+	}
+	delete(r.values, key)
+	delete(r.expires, key)
+	return nil
+}
+
+func (r *RecordingStorage) Rename(ctx context.Context, oldKey string, newKey string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.record(StorageCall{Method: "Rename", Key: oldKey, NewKey: newKey}); err != nil {
+		return err
+	}
+	if value, ok := r.values[oldKey]; ok {
+		r.values[newKey] = value
+		r.expires[newKey] = r.expires[oldKey]
+		delete(r.values, oldKey)
+		delete(r.expires, oldKey)
+	}
+	return nil
+}
+
+// Stats will record the call and return the number of keys with a value. Nothing is on disk, so the size is always 0.
+func (r *RecordingStorage) Stats(ctx context.Context) (storage.Stats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.record(StorageCall{Method: "Stats"}); err != nil {
+		return storage.Stats{}, err
+	}
+	return storage.Stats{Keys: int64(len(r.values))}, nil
+}
+
+// QueueStats will return the stats set with SetQueueStats. Writes are never queued, so they're
+// empty unless they've been set. It isn't recorded as a call.
+func (r *RecordingStorage) QueueStats() storage.QueueStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queue
+}
+
+// KeepsHistory will always return false, only the latest value of each key is kept.
+func (r *RecordingStorage) KeepsHistory() bool {
+	return false
+}
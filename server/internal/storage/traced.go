@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracedStorage wraps a storage to record a span for each read and write, as a child of the span
+// in the context. Methods that aren't traced go straight to the wrapped storage.
+type TracedStorage struct {
+	Storage
+	tracer trace.Tracer
+}
+
+// NewTracedStorage will wrap the storage so its calls are traced with the global tracer provider.
+func NewTracedStorage(s Storage) *TracedStorage {
+	return &TracedStorage{Storage: s, tracer: otel.Tracer("github.com/atyalexyoung/data-loom/server/internal/storage")}
+}
+
+// start will start a span for a call on the key.
+func (t *TracedStorage) start(ctx context.Context, name string, key string) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, name, trace.WithAttributes(attribute.String("key", key)))
+}
+
+// end will end the span, recording the error if there was one.
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// AsyncPut will trace queueing the write. The write itself happens after the span ends.
+func (t *TracedStorage) AsyncPut(ctx context.Context, key string, value any, timestamp time.Time, expiresAt time.Time) chan error {
+	ctx, span := t.start(ctx, "Storage.AsyncPut", key)
+	defer span.End()
+	return t.Storage.AsyncPut(ctx, key, value, timestamp, expiresAt)
+}
+
+// AsyncPutBatch will trace queueing the batch. The write itself happens after the span ends.
+func (t *TracedStorage) AsyncPutBatch(ctx context.Context, entries []BatchEntry) chan error {
+	ctx, span := t.tracer.Start(ctx, "Storage.AsyncPutBatch", trace.WithAttributes(attribute.Int("entries", len(entries))))
+	defer span.End()
+	return t.Storage.AsyncPutBatch(ctx, entries)
+}
+
+func (t *TracedStorage) Get(ctx context.Context, key string) (any, error) {
+	ctx, span := t.start(ctx, "Storage.Get", key)
+	value, err := t.Storage.Get(ctx, key)
+	end(span, err)
+	return value, err
+}
+
+func (t *TracedStorage) GetAt(ctx context.Context, key string, at time.Time) (any, error) {
+	ctx, span := t.start(ctx, "Storage.GetAt", key)
+	value, err := t.Storage.GetAt(ctx, key, at)
+	end(span, err)
+	return value, err
+}
+
+func (t *TracedStorage) GetRecent(ctx context.Context, key string, n int) ([]any, error) {
+	ctx, span := t.start(ctx, "Storage.GetRecent", key)
+	values, err := t.Storage.GetRecent(ctx, key, n)
+	end(span, err)
+	return values, err
+}
+
+func (t *TracedStorage) Delete(ctx context.Context, key string) error {
+	ctx, span := t.start(ctx, "Storage.Delete", key)
+	err := t.Storage.Delete(ctx, key)
+	end(span, err)
+	return err
+}
+
+func (t *TracedStorage) Rename(ctx context.Context, oldKey string, newKey string) error {
+	ctx, span := t.start(ctx, "Storage.Rename", oldKey)
+	err := t.Storage.Rename(ctx, oldKey, newKey)
+	end(span, err)
+	return err
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// writeQueue is the queue of writes that a single writer goroutine does in order. Every request
+// that goes through the queue is responded to exactly once, whether it's written, cancelled,
+// rejected, or still queued when the writer stops.
+type writeQueue struct {
+	mu       sync.Mutex
+	requests chan dbWriteRequest
+	closed   bool
+
+	writingSince time.Time     // when the request being written was queued, zero if nothing is being written
+	lastLatency  time.Duration // how long the last written request took from being queued to being written
+}
+
+// newWriteQueue will create an open queue that holds up to size requests.
+func newWriteQueue(size int) *writeQueue {
+	return &writeQueue{requests: make(chan dbWriteRequest, size)}
+}
+
+// respond will give the error to whoever queued the request and close its channel.
+func (r dbWriteRequest) respond(err error) {
+	if r.errCh == nil {
+		return
+	}
+	r.errCh <- err
+	close(r.errCh)
+}
+
+// enqueue will queue the request and return the channel that responds with the error from the
+// write. The request fails right away if the queue is closed or full, or the context is done.
+func (q *writeQueue) enqueue(req dbWriteRequest) chan error {
+	req.errCh = make(chan error, 1)
+	req.queuedAt = time.Now()
+
+	// holding the lock while sending keeps Close from closing the queue under us.
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		req.respond(ErrStorageClosed)
+		return req.errCh
+	}
+	if err := req.writeCtx.Err(); err != nil {
+		req.respond(err)
+		return req.errCh
+	}
+
+	select {
+	case q.requests <- req:
+		// queued successfully
+	default:
+		req.respond(fmt.Errorf("write queue is full"))
+	}
+	return req.errCh
+}
+
+// run will write each queued request with write until the queue is closed or ctx is done.
+// Requests whose own context is done by the time they're reached are not written.
+func (q *writeQueue) run(ctx context.Context, write func(req dbWriteRequest) error) {
+	for {
+		if err := ctx.Err(); err != nil { // a cancelled writer doesn't take any more requests
+			q.stop(err)
+			return
+		}
+
+		select {
+		case req, ok := <-q.requests:
+			if !ok {
+				return // queue closed
+			}
+			if err := req.writeCtx.Err(); err != nil {
+				req.respond(err)
+				continue
+			}
+			q.startWrite(req)
+			err := write(req)
+			q.finishWrite(req, time.Now())
+			req.respond(err)
+
+		case <-ctx.Done(): // if we get cancelled, stop the worker.
+			q.stop(ctx.Err())
+			return
+		}
+	}
+}
+
+// startWrite will record that the writer has started writing the request.
+func (q *writeQueue) startWrite(req dbWriteRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.writingSince = req.queuedAt
+}
+
+// finishWrite will record how long the request took from being queued to being written.
+func (q *writeQueue) finishWrite(req dbWriteRequest, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.writingSince = time.Time{}
+	q.lastLatency = now.Sub(req.queuedAt)
+}
+
+// stats will return how full the queue is and its write latency as of now. A write that's
+// taking longer than the last one took counts as the latency, so a stalled writer shows up
+// before it finishes.
+func (q *writeQueue) stats(now time.Time) QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := QueueStats{Depth: len(q.requests), Capacity: cap(q.requests), WriteLatency: q.lastLatency}
+	if !q.writingSince.IsZero() {
+		stats.WriteLatency = max(stats.WriteLatency, now.Sub(q.writingSince))
+	}
+	return stats
+}
+
+// stop will close the queue to new requests and respond to the ones still in it with err.
+// Called when the writer stops without the queue being closed.
+func (q *writeQueue) stop(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for {
+		select {
+		case req, ok := <-q.requests:
+			if !ok {
+				return
+			}
+			req.respond(err)
+		default:
+			return
+		}
+	}
+}
+
+// close will close the queue to new requests. The writer still writes what's already queued.
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.requests)
+	}
+}
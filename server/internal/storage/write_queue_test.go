@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireRespondedOnce will read the response from a write's channel and check the channel is
+// closed right after it. Returns the error the write responded with.
+func requireRespondedOnce(t *testing.T, ch chan error) error {
+	t.Helper()
+	var err error
+	select {
+	case err = <-ch:
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "write was never responded to")
+	}
+	select {
+	case _, ok := <-ch:
+		require.False(t, ok, "write was responded to more than once")
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "write channel was never closed")
+	}
+	return err
+}
+
+func TestWriteQueue_CancelledAndFullAtOnce(t *testing.T) {
+	q := newWriteQueue(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	go q.run(ctx, func(req dbWriteRequest) error {
+		<-release // hold the writer so the queue fills up
+		return nil
+	})
+
+	writeCtx, cancelWrites := context.WithCancel(context.Background())
+	defer cancelWrites()
+	const writers = 50
+	channels := make([]chan error, writers)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i == writers/2 {
+				cancelWrites()
+			}
+			channels[i] = q.enqueue(dbWriteRequest{key: fmt.Sprintf("key-%d", i), writeCtx: writeCtx})
+		}()
+	}
+	wg.Wait()
+	close(release)
+
+	var full int
+	for _, ch := range channels {
+		err := requireRespondedOnce(t, ch)
+		if err != nil && err.Error() == "write queue is full" {
+			full++
+		} else if err != nil {
+			assert.ErrorIs(t, err, context.Canceled)
+		}
+	}
+	assert.Positive(t, full, "expected some writes to find the queue full")
+}
+
+func TestWriteQueue_StopRespondsToQueuedWrites(t *testing.T) {
+	q := newWriteQueue(10)
+	var channels []chan error
+	for i := range 3 {
+		channels = append(channels, q.enqueue(dbWriteRequest{key: fmt.Sprintf("key-%d", i), writeCtx: context.Background()}))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.run(ctx, func(req dbWriteRequest) error {
+		t.Errorf("write %s should not happen after the writer is cancelled", req.key)
+		return nil
+	})
+
+	for _, ch := range channels {
+		assert.ErrorIs(t, requireRespondedOnce(t, ch), context.Canceled)
+	}
+	err := requireRespondedOnce(t, q.enqueue(dbWriteRequest{key: "late", writeCtx: context.Background()}))
+	assert.EqualError(t, err, "storage is closed")
+
+	q.close() // the queue was already stopped, so this must not close it again
+}
+
+func TestWriteQueue_CloseWhileEnqueueing(t *testing.T) {
+	q := newWriteQueue(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.run(ctx, func(req dbWriteRequest) error { return nil })
+
+	const writers = 50
+	channels := make([]chan error, writers)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i == writers/2 {
+				q.close()
+			}
+			channels[i] = q.enqueue(dbWriteRequest{key: fmt.Sprintf("key-%d", i), writeCtx: context.Background()})
+		}()
+	}
+	wg.Wait()
+	q.close()
+
+	for _, ch := range channels {
+		requireRespondedOnce(t, ch)
+	}
+}
+
+func TestAsyncPut_CancelledWritesWithClose(t *testing.T) {
+	for name, store := range openTestStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			const writers = 100
+			channels := make([]chan error, writers)
+			var wg sync.WaitGroup
+			for i := range writers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ctx, cancel := context.WithCancel(context.Background())
+					if i%2 == 0 {
+						cancel()
+					} else {
+						defer cancel()
+					}
+					channels[i] = store.AsyncPut(ctx, fmt.Sprintf("key-%d", i), i, time.Now().UTC(), time.Time{})
+				}()
+			}
+			wg.Wait()
+			require.NoError(t, store.Close())
+
+			for i, ch := range channels {
+				err := requireRespondedOnce(t, ch)
+				if i%2 == 0 {
+					assert.ErrorIs(t, err, context.Canceled)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteQueue_StatsWithStalledWriter(t *testing.T) {
+	q := newWriteQueue(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Equal(t, QueueStats{Capacity: 4}, q.stats(time.Now()))
+
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	go q.run(ctx, func(req dbWriteRequest) error {
+		writing <- struct{}{}
+		<-release // stall the writer
+		return nil
+	})
+
+	first := q.enqueue(dbWriteRequest{key: "first", writeCtx: context.Background()})
+	<-writing
+	second := q.enqueue(dbWriteRequest{key: "second", writeCtx: context.Background()})
+
+	// the write in progress counts towards the latency before it finishes
+	stats := q.stats(time.Now().Add(time.Minute))
+	assert.Equal(t, 1, stats.Depth)
+	assert.GreaterOrEqual(t, stats.WriteLatency, time.Minute)
+
+	release <- struct{}{}
+	require.NoError(t, requireRespondedOnce(t, first))
+	<-writing
+	release <- struct{}{}
+	require.NoError(t, requireRespondedOnce(t, second))
+
+	// once the writer catches up, the latency is how long the last write took
+	stats = q.stats(time.Now().Add(time.Minute))
+	assert.Equal(t, 0, stats.Depth)
+	assert.Less(t, stats.WriteLatency, time.Minute)
+}
@@ -0,0 +1,161 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// MAX_ACK_BACKLOG is how many values can wait for room in a subscription's ack window before the
+// client is disconnected for not acking, the same as how many messages a client's send queue holds.
+const MAX_ACK_BACKLOG = network.DEFAULT_SEND_QUEUE_SIZE
+
+// ErrInvalidAck is returned when a client acks a subscription that doesn't have an ack window, or
+// a sequence number that wasn't sent yet.
+var ErrInvalidAck = errors.New("invalid ack")
+
+// ErrAckBacklogFull is returned when a value is published to a subscriber whose ack window is
+// full and already has MAX_ACK_BACKLOG values waiting for room in it.
+var ErrAckBacklogFull = errors.New("ack window backlog is full")
+
+// ErrAckWindowed is returned when pausing a subscription that has an ack window, since delivery is
+// already held back whenever the window is full.
+var ErrAckWindowed = errors.New("subscription has an ack window")
+
+// windowedMessage is a value waiting for room in an ack window. It's only given a sequence number
+// when it's sent, so a value that expires while it waits doesn't leave a gap in the sequence.
+type windowedMessage struct {
+	frameType int
+	data      []byte
+	expires   time.Time
+}
+
+// ackWindow is the sliding window of a subscription that acks the values it's sent. Values are
+// sent with a sequence number that counts up from 1, and at most size of them are sent without
+// being acked. Values published while the window is full wait in a backlog until the client acks.
+type ackWindow struct {
+	size    int
+	sent    uint64 // sequence number of the last value sent
+	acked   uint64 // highest sequence number the client acked, which acks every value before it too
+	backlog []windowedMessage
+}
+
+// full returns true if as many values as the window holds were sent and haven't been acked.
+func (w *ackWindow) full() bool {
+	return w.sent-w.acked >= uint64(w.size)
+}
+
+// sequenced will return the json of a message, or the json header of a binary frame, with the
+// sequence number added as its first field.
+func sequenced(data []byte, seq uint64) []byte {
+	result := make([]byte, 0, len(data)+24)
+	result = append(result, `{"seq":`...)
+	result = strconv.AppendUint(result, seq, 10)
+	if len(data) > 1 && data[1] != '}' {
+		result = append(result, ',')
+	}
+	return append(result, data[1:]...)
+}
+
+// sendWindowed will add a value to the backlog of a subscriber with an ack window and send as much
+// of the backlog as fits in the window. Returns ErrAckBacklogFull if the backlog overflowed, or
+// the error from sending to the client. Must hold the lock.
+func (t *Topic) sendWindowed(client *network.Client, window *ackWindow, frameType int, data []byte, expires time.Time) error {
+	if len(window.backlog) >= MAX_ACK_BACKLOG {
+		return fmt.Errorf("%w for client %s on topic %s", ErrAckBacklogFull, client.Id, t.name)
+	}
+	window.backlog = append(window.backlog, windowedMessage{frameType: frameType, data: data, expires: expires})
+	return t.flushWindow(client, window)
+}
+
+// flushWindow will send values from the backlog of a subscriber with an ack window, oldest first,
+// until the window is full. Values that expired while they waited are dropped. They're sent
+// without expiring, without a priority, and never dropped by the send queue, so the client gets
+// every sequence number in order. Must hold the lock.
+func (t *Topic) flushWindow(client *network.Client, window *ackWindow) error {
+	now := time.Now()
+	for !window.full() && len(window.backlog) > 0 {
+		next := window.backlog[0]
+		window.backlog[0] = windowedMessage{}
+		window.backlog = window.backlog[1:]
+		if !next.expires.IsZero() && !now.Before(next.expires) {
+			continue
+		}
+
+		prepared, err := websocket.NewPreparedMessage(next.frameType, sequenced(next.data, window.sent+1))
+		if err != nil {
+			return err
+		}
+		if err := client.SendPrepared(prepared, network.OverflowDisconnect, time.Time{}, network.PriorityNormal); err != nil {
+			return err
+		}
+		window.sent++
+	}
+	return nil
+}
+
+// Ack will ack every value sent to the client with a sequence number up to seq, and send values
+// from the backlog that fit in the window now. Acking a sequence number that was already acked
+// does nothing. Returns true if the client's connection is closed and the backlog couldn't be
+// sent, and error if the client isn't subscribed with an ack window or seq wasn't sent yet.
+func (t *Topic) Ack(client *network.Client, seq uint64) (bool, error) {
+	t.mu.Lock("Ack")
+	defer t.mu.Unlock("Ack")
+	if _, ok := t.subscribers[client]; !ok {
+		return false, fmt.Errorf("%w. topic: %s, client: %s", ErrNotSubscribed, t.name, client.Id)
+	}
+	window, ok := t.windows[client]
+	if !ok {
+		return false, fmt.Errorf("%w: the subscription to %s doesn't have an ack window", ErrInvalidAck, t.name)
+	}
+	if seq > window.sent {
+		return false, fmt.Errorf("%w: seq %d hasn't been sent, the last sent is %d", ErrInvalidAck, seq, window.sent)
+	}
+
+	window.acked = max(window.acked, seq)
+	if err := t.flushWindow(client, window); err != nil {
+		log.WithFields(log.Fields{"topic": t.name, "client": client.Id}).Warnf("couldn't send backlog on ack: %v", err)
+		return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway), nil
+	}
+	return false, nil
+}
+
+// setWindow will give the client's subscription an ack window of the size, or take it away if the
+// size is 0. Resizing a window keeps its sequence numbers and backlog, and taking it away drops the
+// backlog. Windowed subscriptions can't be paused, so giving a paused subscription a window resumes
+// it without the value it held. Must hold the lock.
+func (t *Topic) setWindow(client *network.Client, size int) {
+	window, ok := t.windows[client]
+	if size <= 0 {
+		delete(t.windows, client)
+		return
+	}
+	delete(t.paused, client)
+	if !ok {
+		t.windows[client] = &ackWindow{size: size}
+		return
+	}
+
+	window.size = size
+	if err := t.flushWindow(client, window); err != nil { // a bigger window has room for the backlog
+		log.WithFields(log.Fields{"topic": t.name, "client": client.Id}).Warnf("couldn't send backlog on resize: %v", err)
+	}
+}
+
+// AckWindow will return how many values sent to the client haven't been acked, and how many are
+// waiting for room in the window, or false if the client's subscription doesn't have an ack window.
+func (t *Topic) AckWindow(client *network.Client) (unacked int, backlog int, ok bool) {
+	t.mu.RLock("AckWindow")
+	defer t.mu.RUnlock("AckWindow")
+	window, ok := t.windows[client]
+	if !ok {
+		return 0, 0, false
+	}
+	return int(window.sent - window.acked), len(window.backlog), true
+}
@@ -0,0 +1,184 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expectSequence will wait for a message and check its sequence number.
+func expectSequence(t *testing.T, received <-chan network.WebSocketMessage, seq uint64) network.WebSocketMessage {
+	t.Helper()
+	select {
+	case msg := <-received:
+		assert.Equal(t, seq, msg.Sequence, "message %s", msg.MessageId)
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a message with seq %d", seq)
+		return network.WebSocketMessage{}
+	}
+}
+
+// publishWindowed will send values to the topic with message ids counting up from first.
+func publishWindowed(t *testing.T, tm TopicManager, topicName string, first int, count int) {
+	publisher := network.NewClient(nil, "publisher")
+	for i := first; i < first+count; i++ {
+		msg := network.WebSocketMessage{MessageId: fmt.Sprintf("value-%d", i), Action: "publish", Topic: topicName}
+		require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"a": "1"}, nil))
+	}
+}
+
+func TestAckWindow_FillsThenWaitsForAck(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "windowed")
+
+	client, remote := newTestClient(t, "subscriber")
+	received := receiveMessages(remote)
+	require.NoError(t, tm.Subscribe("windowed", client, SubscriptionOptions{AckWindow: 2}))
+
+	result := &network.RequestResult{}
+	msg := network.WebSocketMessage{MessageId: "value-0", Action: "publish", Topic: "windowed", Result: result}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+	publishWindowed(t, tm, "windowed", 1, 3)
+
+	// values waiting for room in the window still count as delivered
+	assert.Equal(t, network.DeliveryStats{Targeted: 1, Delivered: 1}, result.Delivery())
+
+	assert.Equal(t, "value-0", expectSequence(t, received, 1).MessageId)
+	assert.Equal(t, "value-1", expectSequence(t, received, 2).MessageId)
+	expectNothing(t, received)
+
+	topics, err := tm.ListTopics()
+	require.NoError(t, err)
+	unacked, backlog, ok := topics[0].AckWindow(client)
+	assert.True(t, ok)
+	assert.Equal(t, 2, unacked)
+	assert.Equal(t, 2, backlog)
+}
+
+func TestAckWindow_AckResumesDelivery(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "windowed")
+
+	client, remote := newTestClient(t, "subscriber")
+	received := receiveMessages(remote)
+	require.NoError(t, tm.Subscribe("windowed", client, SubscriptionOptions{AckWindow: 2}))
+	publishWindowed(t, tm, "windowed", 0, 5)
+	expectSequence(t, received, 1)
+	expectSequence(t, received, 2)
+
+	// acking one makes room for one
+	require.NoError(t, tm.Ack("windowed", client, 1))
+	assert.Equal(t, "value-2", expectSequence(t, received, 3).MessageId)
+	expectNothing(t, received)
+
+	// acks are cumulative, so acking the last one sent makes room for the whole window
+	require.NoError(t, tm.Ack("windowed", client, 3))
+	assert.Equal(t, "value-3", expectSequence(t, received, 4).MessageId)
+	assert.Equal(t, "value-4", expectSequence(t, received, 5).MessageId)
+
+	// with room in the window, new values are sent right away
+	require.NoError(t, tm.Ack("windowed", client, 5))
+	publishWindowed(t, tm, "windowed", 5, 1)
+	assert.Equal(t, "value-5", expectSequence(t, received, 6).MessageId)
+}
+
+func TestAckWindow_ExpiredValuesDroppedWithoutGaps(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "windowed")
+
+	client, remote := newTestClient(t, "subscriber")
+	received := receiveMessages(remote)
+	require.NoError(t, tm.Subscribe("windowed", client, SubscriptionOptions{AckWindow: 1}))
+
+	publisher := network.NewClient(nil, "publisher")
+	for i := range 2 {
+		msg := network.WebSocketMessage{MessageId: fmt.Sprintf("expiring-%d", i), Action: "publish", Topic: "windowed", Options: &network.MessageOptions{TtlMs: 50}}
+		require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"a": "1"}, nil))
+	}
+	publishWindowed(t, tm, "windowed", 0, 1)
+	expectSequence(t, received, 1)
+
+	// the value that expired while it waited is skipped, and the next one takes its sequence number
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, tm.Ack("windowed", client, 1))
+	assert.Equal(t, "value-0", expectSequence(t, received, 2).MessageId)
+}
+
+func TestAckWindow_InvalidAcks(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "windowed")
+	client, _ := newTestClient(t, "subscriber")
+
+	assert.ErrorIs(t, tm.Ack("windowed", client, 0), ErrNotSubscribed)
+	assert.Error(t, tm.Ack("missing", client, 0))
+
+	require.NoError(t, tm.Subscribe("windowed", client, SubscriptionOptions{}))
+	assert.ErrorIs(t, tm.Ack("windowed", client, 0), ErrInvalidAck, "subscription doesn't have an ack window")
+
+	require.NoError(t, tm.Subscribe("windowed", client, SubscriptionOptions{AckWindow: 3}))
+	publishWindowed(t, tm, "windowed", 0, 2)
+	assert.ErrorIs(t, tm.Ack("windowed", client, 3), ErrInvalidAck, "seq 3 hasn't been sent")
+	require.NoError(t, tm.Ack("windowed", client, 2))
+	require.NoError(t, tm.Ack("windowed", client, 1), "acking an acked value again does nothing")
+
+	topics, err := tm.ListTopics()
+	require.NoError(t, err)
+	unacked, _, _ := topics[0].AckWindow(client)
+	assert.Equal(t, 0, unacked)
+}
+
+func TestAckWindow_CantPause(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "windowed")
+	client, _ := newTestClient(t, "subscriber")
+
+	require.NoError(t, tm.Subscribe("windowed", client, SubscriptionOptions{}))
+	require.NoError(t, tm.Pause("windowed", client, true))
+
+	// resubscribing with a window resumes the subscription, since it can't be paused anymore
+	require.NoError(t, tm.Subscribe("windowed", client, SubscriptionOptions{AckWindow: 1}))
+	topics, err := tm.ListTopics()
+	require.NoError(t, err)
+	assert.False(t, topics[0].IsPaused(client))
+	assert.ErrorIs(t, tm.Pause("windowed", client, false), ErrAckWindowed)
+
+	// resubscribing without a window takes it away
+	require.NoError(t, tm.Subscribe("windowed", client, SubscriptionOptions{}))
+	_, _, ok := topics[0].AckWindow(client)
+	assert.False(t, ok)
+	require.NoError(t, tm.Pause("windowed", client, false))
+}
+
+func TestAckWindow_BacklogOverflowDisconnects(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "windowed")
+
+	client, remote := newTestClient(t, "subscriber")
+	received := receiveMessages(remote)
+	require.NoError(t, tm.Subscribe("windowed", client, SubscriptionOptions{AckWindow: 1}))
+
+	// the window holds one, the backlog holds MAX_ACK_BACKLOG, and the next one overflows it
+	publishWindowed(t, tm, "windowed", 0, MAX_ACK_BACKLOG+2)
+	expectSequence(t, received, 1)
+
+	select {
+	case msg, ok := <-received:
+		assert.False(t, ok, "expected the connection to close, got %+v", msg)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the client that stopped acking to be disconnected")
+	}
+}
+
+func TestSequenced(t *testing.T) {
+	assert.Equal(t, `{"seq":1}`, string(sequenced([]byte(`{}`), 1)))
+	assert.Equal(t, `{"seq":42,"id":"a"}`, string(sequenced([]byte(`{"id":"a"}`), 42)))
+	assert.Equal(t, `{"seq":3,"id":"a"}raw`, string(sequenced([]byte(`{"id":"a"}raw`), 3)))
+}
@@ -0,0 +1,146 @@
+package topic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AggregateStats are the running aggregates of one numeric field of the values published to an
+// aggregate topic.
+type AggregateStats struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Last  float64 `json:"last"`
+}
+
+// add will fold a value into the aggregates.
+func (a AggregateStats) add(value float64) AggregateStats {
+	if a.Count == 0 || value < a.Min {
+		a.Min = value
+	}
+	if a.Count == 0 || value > a.Max {
+		a.Max = value
+	}
+	a.Count++
+	a.Sum += value
+	a.Last = value
+	return a
+}
+
+// aggregator keeps the running aggregates of the numeric fields of an aggregate topic, which are
+// what is stored and what get returns for the topic instead of the published values.
+type aggregator struct {
+	mu      sync.Mutex
+	fields  []string
+	stats   map[string]AggregateStats
+	loaded  bool // the aggregates stored before the server started have been read
+	version int  // counts changes, so undoing an add doesn't undo a later one
+}
+
+// newAggregator will create an aggregator for the fields, or nil if there are none.
+func newAggregator(fields []string) *aggregator {
+	if len(fields) == 0 {
+		return nil
+	}
+	return &aggregator{fields: fields, stats: make(map[string]AggregateStats, len(fields))}
+}
+
+// check will return error if the payload isn't an object, or any of the aggregated fields it has
+// aren't numbers. Fields that are missing are left out of the aggregates.
+func (a *aggregator) check(payload any) error {
+	object, ok := payload.(map[string]any)
+	if !ok {
+		return fmt.Errorf("aggregate topics only take json objects, got %T", payload)
+	}
+	for _, field := range a.fields {
+		if value, ok := object[field]; ok {
+			if _, isNumber := value.(float64); !isNumber {
+				return fmt.Errorf("aggregated field %s must be a number, got %T", field, value)
+			}
+		}
+	}
+	return nil
+}
+
+// load will read the aggregates that were stored before the server started, the first time it's
+// called, so published values keep adding to them instead of starting over.
+func (a *aggregator) load(read func() (any, error)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.loaded {
+		return nil
+	}
+
+	stored, err := read()
+	if err != nil {
+		return fmt.Errorf("couldn't read stored aggregates: %w", err)
+	}
+	if stored != nil {
+		// round trip through json, since storage gives back maps instead of AggregateStats
+		var stats map[string]AggregateStats
+		raw, err := json.Marshal(stored)
+		if err == nil {
+			err = json.Unmarshal(raw, &stats)
+		}
+		if err != nil {
+			log.WithField("method", "aggregator.load").Warnf("stored value isn't aggregates, starting them over: %v", err)
+		}
+		for _, field := range a.fields {
+			if fieldStats, ok := stats[field]; ok {
+				a.stats[field] = fieldStats
+			}
+		}
+	}
+	a.loaded = true
+	return nil
+}
+
+// add will fold the aggregated fields of a payload into the aggregates, and return a copy of the
+// aggregates after it and a function that undoes it if nothing else was added since.
+func (a *aggregator) add(payload any) (map[string]AggregateStats, func(), error) {
+	if err := a.check(payload); err != nil {
+		return nil, nil, err
+	}
+	object := payload.(map[string]any)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	previous := maps.Clone(a.stats)
+	for _, field := range a.fields {
+		if value, ok := object[field]; ok {
+			a.stats[field] = a.stats[field].add(value.(float64))
+		}
+	}
+	a.version++
+
+	version := a.version
+	undo := func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.version == version {
+			a.stats = previous
+			a.version++
+		}
+	}
+	return maps.Clone(a.stats), undo, nil
+}
+
+// aggregate will add a published value to the topic's aggregates, reading the stored aggregates
+// first if they haven't been yet. Returns the aggregates to store for the topic and a function
+// to undo adding the value.
+func (tm *topicManager) aggregate(ctx context.Context, topic *Topic, value any) (map[string]AggregateStats, func(), error) {
+	err := topic.aggregator.load(func() (any, error) {
+		return tm.db.Get(ctx, topic.NameWithLock())
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return topic.aggregator.add(value)
+}
@@ -0,0 +1,150 @@
+package topic
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registerAggregateTopic will register a topic named "metrics" that aggregates the fields.
+func registerAggregateTopic(t *testing.T, tm TopicManager, fields ...string) {
+	t.Helper()
+	_, err := tm.RegisterTopic("metrics", map[string]any{"latency": 0.0, "errors": 0.0}, TopicOptions{Aggregate: fields})
+	require.NoError(t, err)
+}
+
+// publishMetric will publish the value to the "metrics" topic.
+func publishMetric(t *testing.T, tm TopicManager, value map[string]any) {
+	t.Helper()
+	msg := network.WebSocketMessage{MessageId: "metric", Action: "publish", Topic: "metrics"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), value, nil))
+}
+
+func TestAggregate_PublishedSequence(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerAggregateTopic(t, tm, "latency", "errors")
+	subscriber, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("metrics", subscriber, SubscriptionOptions{}))
+
+	publishMetric(t, tm, map[string]any{"latency": 30.0, "errors": 1.0})
+	publishMetric(t, tm, map[string]any{"latency": 10.0, "errors": 0.0})
+	publishMetric(t, tm, map[string]any{"latency": 20.0}) // fields that are missing aren't counted
+
+	expected := map[string]AggregateStats{
+		"latency": {Count: 3, Sum: 60, Min: 10, Max: 30, Last: 20},
+		"errors":  {Count: 2, Sum: 1, Min: 0, Max: 1, Last: 0},
+	}
+	value, err := tm.Get(context.Background(), "metrics")
+	require.NoError(t, err)
+	assert.Equal(t, expected, value)
+
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 3)
+	assert.Equal(t, expected, puts[2].Value, "the aggregates are stored instead of the value")
+
+	// subscribers still get the values that were published
+	assert.JSONEq(t, `{"latency": 30, "errors": 1}`, string(readMessage(t, remote).Data))
+	assert.JSONEq(t, `{"latency": 10, "errors": 0}`, string(readMessage(t, remote).Data))
+	assert.JSONEq(t, `{"latency": 20}`, string(readMessage(t, remote).Data))
+}
+
+func TestAggregate_SendWithoutSaveDoesNotAggregate(t *testing.T) {
+	tm := NewTopicManager(storagetest.NewRecordingStorage(), &config.Config{})
+	registerAggregateTopic(t, tm, "latency")
+
+	publishMetric(t, tm, map[string]any{"latency": 5.0})
+	msg := network.WebSocketMessage{MessageId: "live", Action: "sendWithoutSave", Topic: "metrics"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"latency": 100.0}, nil))
+
+	value, err := tm.Get(context.Background(), "metrics")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]AggregateStats{"latency": {Count: 1, Sum: 5, Min: 5, Max: 5, Last: 5}}, value)
+}
+
+func TestAggregate_ContinuesFromStoredAggregates(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerAggregateTopic(t, tm, "latency")
+	publishMetric(t, tm, map[string]any{"latency": 5.0})
+	publishMetric(t, tm, map[string]any{"latency": 15.0})
+
+	// a server that starts with the same storage keeps adding to the stored aggregates
+	restarted := NewTopicManager(db, &config.Config{})
+	registerAggregateTopic(t, restarted, "latency")
+	publishMetric(t, restarted, map[string]any{"latency": 1.0})
+
+	value, err := restarted.Get(context.Background(), "metrics")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]AggregateStats{"latency": {Count: 3, Sum: 21, Min: 1, Max: 15, Last: 1}}, value)
+}
+
+func TestAggregate_NonNumericFieldRejected(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("metrics", map[string]any{}, TopicOptions{ValidationMode: ValidationOff, Aggregate: []string{"latency"}})
+	require.NoError(t, err)
+
+	_, err = tm.ValidatePayload("metrics", map[string]any{"latency": "fast"})
+	assert.ErrorContains(t, err, "latency", "checked even with validation off")
+	_, err = tm.ValidatePayload("metrics", 12.0)
+	assert.Error(t, err)
+	_, err = tm.ValidatePayload("metrics", map[string]any{"other": "field"})
+	assert.NoError(t, err)
+}
+
+func TestAggregate_FailedWriteUndone(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerAggregateTopic(t, tm, "latency")
+	publishMetric(t, tm, map[string]any{"latency": 5.0})
+
+	db.Fail("AsyncPut", errors.New("disk full"))
+	errCh := make(chan error, 1)
+	msg := network.WebSocketMessage{MessageId: "metric", Action: "publish", Topic: "metrics"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"latency": 100.0}, errCh))
+	require.Error(t, <-errCh)
+	db.Fail("AsyncPut", nil)
+
+	value, err := tm.Get(context.Background(), "metrics")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]AggregateStats{"latency": {Count: 1, Sum: 5, Min: 5, Max: 5, Last: 5}}, value,
+		"expected the value that wasn't stored to be taken out of the aggregates")
+
+	publishMetric(t, tm, map[string]any{"latency": 7.0})
+	value, err = tm.Get(context.Background(), "metrics")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]AggregateStats{"latency": {Count: 2, Sum: 12, Min: 5, Max: 7, Last: 7}}, value)
+}
+
+func TestAggregate_FailedTransactionUndone(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerAggregateTopic(t, tm, "latency")
+	registerTopics(t, tm, "other")
+	publishMetric(t, tm, map[string]any{"latency": 5.0})
+
+	db.Fail("AsyncPutBatch", errors.New("disk full"))
+	msg := network.WebSocketMessage{MessageId: "transfer", Action: "publishTransaction"}
+	err := tm.PublishTransaction(context.Background(), msg, network.NewClient(nil, "publisher"), []TopicValue{
+		{Topic: "metrics", Value: map[string]any{"latency": 100.0}},
+		{Topic: "other", Value: map[string]any{"a": "b"}},
+	})
+	require.Error(t, err)
+
+	db.Fail("AsyncPutBatch", nil)
+	require.NoError(t, tm.PublishTransaction(context.Background(), msg, network.NewClient(nil, "publisher"), []TopicValue{
+		{Topic: "metrics", Value: map[string]any{"latency": 7.0}},
+	}))
+	value, err := tm.Get(context.Background(), "metrics")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]AggregateStats{"latency": {Count: 2, Sum: 12, Min: 5, Max: 7, Last: 7}}, value)
+	batches := db.CallsTo("AsyncPutBatch")
+	assert.Equal(t, value, batches[len(batches)-1].Batch[0].Value)
+}
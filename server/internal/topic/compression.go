@@ -0,0 +1,84 @@
+package topic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ENCODING_GZIP is the encoding set on messages sent to subscribers of a compressed topic.
+const ENCODING_GZIP = "gzip"
+
+// compressPayload will gzip an encoded payload.
+func compressPayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressPayload will gunzip a payload that was compressed with compressPayload.
+func decompressPayload(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// compressValue will compress the payload of a value for a compressed topic, which is the raw
+// bytes for a binary topic and the json of the value, raw, otherwise. Returns nil if the topic
+// isn't compressed.
+func (t *Topic) compressValue(value any, raw []byte) ([]byte, error) {
+	if !t.compressed {
+		return nil, nil
+	}
+	if payload, ok := value.([]byte); ok {
+		raw = payload
+	}
+	return compressPayload(raw)
+}
+
+// decompressValue will turn a value read from storage for a compressed topic back into the value
+// that was published. Values of topics that aren't compressed, and nil, are returned as they are.
+func (t *Topic) decompressValue(stored any) (any, error) {
+	if !t.compressed || stored == nil {
+		return stored, nil
+	}
+
+	var compressed []byte
+	switch v := stored.(type) {
+	case []byte:
+		compressed = v
+	case string: // storage that keeps values as json has the compressed bytes as base64
+		decoded, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("stored value for compressed topic %s isn't compressed: %w", t.name, err)
+		}
+		compressed = decoded
+	default:
+		return nil, fmt.Errorf("stored value for compressed topic %s isn't compressed", t.name)
+	}
+
+	payload, err := decompressPayload(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decompress stored value for topic %s: %w", t.name, err)
+	}
+	if t.binary {
+		return payload, nil
+	}
+	var value any
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, fmt.Errorf("couldn't decode decompressed value for topic %s: %w", t.name, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,110 @@
+package topic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// ErrPreconditionFailed is returned by a conditional publish when the topic's current value isn't
+// the one that was expected.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Precondition is what a topic's current value has to be for a conditional publish to go through.
+type Precondition struct {
+	CheckValue bool      // if the current value has to equal Value
+	Value      any       // the expected current value, nil for a topic that has no value
+	Timestamp  time.Time // when the current value has to have been stored, zero doesn't check it
+}
+
+// lockWrites will take the write locks of the topics in the order they were created, so two
+// callers locking overlapping topics can't deadlock, even if one is renamed in between, and
+// return the func to release them.
+func lockWrites(topics ...*Topic) func() {
+	sorted := make([]*Topic, 0, len(topics))
+	seen := make(map[*Topic]bool, len(topics))
+	for _, topic := range topics {
+		if !seen[topic] {
+			seen[topic] = true
+			sorted = append(sorted, topic)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].seq < sorted[j].seq })
+
+	for _, topic := range sorted {
+		topic.writeMu.Lock()
+	}
+	return func() {
+		for _, topic := range sorted {
+			topic.writeMu.Unlock()
+		}
+	}
+}
+
+// valuesEqual will compare two values by their json, so values decoded from a request and values
+// read from storage are equal when they have the same content.
+func valuesEqual(a, b any) bool {
+	aRaw, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bRaw, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aRaw, bRaw)
+}
+
+// currentMeta will return the topic's current value with its metadata. The cached value is used
+// even when gets read through to storage, since it's updated when a value is published and storage
+// is written to after.
+func (tm *topicManager) currentMeta(ctx context.Context, topic *Topic) (ValueMeta, error) {
+	if meta, ok := topic.cachedMeta(time.Now()); ok {
+		return meta, nil
+	}
+	return tm.GetWithMeta(ctx, topic.NameWithLock(), time.Time{})
+}
+
+// PublishIf will publish a value to a topic like Publish, but only if the topic's current value
+// matches the precondition. The current value is read, compared, and written while holding the
+// topic's write lock, so no other publish to the topic can happen in between. Returns
+// ErrPreconditionFailed with the current value if it doesn't match. A value published sooner than
+// the topic's min publish interval is always rejected, since the precondition could be stale by
+// the time a held back value was published.
+func (tm *topicManager) PublishIf(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, condition Precondition, errChan chan error) (current ValueMeta, err error) {
+	ctx, span := startSpan(ctx, "TopicManager.PublishIf", msg.Topic)
+	defer func() {
+		closeOnError(errChan, err)
+		endSpan(span, err)
+	}()
+
+	tm.mu.RLock("PublishIf")
+	topic, ok := tm.topics[msg.Topic]
+	tm.mu.RUnlock("PublishIf")
+
+	if !ok {
+		return ValueMeta{}, fmt.Errorf("publish failed. Topic doesn't exist. Topic: %s", msg.Topic)
+	}
+
+	unlock := lockWrites(topic)
+	defer unlock()
+
+	current, err = tm.currentMeta(ctx, topic)
+	if err != nil {
+		return ValueMeta{}, fmt.Errorf("publish failed. Couldn't read current value of topic %s: %w", msg.Topic, err)
+	}
+	if condition.CheckValue && !valuesEqual(current.Value, condition.Value) {
+		return current, fmt.Errorf("%w: current value of topic %s doesn't match the expected value", ErrPreconditionFailed, msg.Topic)
+	}
+	if !condition.Timestamp.IsZero() && !current.Timestamp.Equal(condition.Timestamp) {
+		return current, fmt.Errorf("%w: current value of topic %s wasn't stored at the expected timestamp", ErrPreconditionFailed, msg.Topic)
+	}
+
+	return current, tm.sendTopic(ctx, msg, sender, value, true, false, errChan)
+}
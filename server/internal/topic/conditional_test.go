@@ -0,0 +1,118 @@
+package topic
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+)
+
+func publishIfMsg(topicName string) network.WebSocketMessage {
+	return network.WebSocketMessage{MessageId: "publishIf", Action: "publishIf", Topic: topicName}
+}
+
+func TestPublishIf_MatchingValue(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "lock")
+	client := network.NewClient(nil, "client")
+
+	// a topic with no value matches an expected null
+	_, err := tm.PublishIf(context.Background(), publishIfMsg("lock"), client, map[string]any{"a": "owner-1"}, Precondition{CheckValue: true}, nil)
+	require.NoError(t, err)
+
+	_, err = tm.PublishIf(context.Background(), publishIfMsg("lock"), client, map[string]any{"a": "owner-2"}, Precondition{CheckValue: true, Value: map[string]any{"a": "owner-1"}}, nil)
+	require.NoError(t, err)
+
+	value, err := tm.Get(context.Background(), "lock")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": "owner-2"}, value)
+}
+
+func TestPublishIf_MismatchReturnsCurrent(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "lock")
+	client := network.NewClient(nil, "client")
+	require.NoError(t, tm.Publish(context.Background(), publishIfMsg("lock"), client, map[string]any{"a": "owner-1"}, nil))
+
+	current, err := tm.PublishIf(context.Background(), publishIfMsg("lock"), client, map[string]any{"a": "owner-3"}, Precondition{CheckValue: true, Value: map[string]any{"a": "owner-2"}}, nil)
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+	assert.Equal(t, map[string]any{"a": "owner-1"}, current.Value)
+	assert.False(t, current.Timestamp.IsZero())
+
+	// nothing was published
+	value, err := tm.Get(context.Background(), "lock")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": "owner-1"}, value)
+
+	_, err = tm.PublishIf(context.Background(), publishIfMsg("lock"), client, map[string]any{"a": "owner-3"}, Precondition{CheckValue: true}, nil)
+	assert.ErrorIs(t, err, ErrPreconditionFailed, "expected a null value to not match a topic with a value")
+}
+
+func TestPublishIf_Timestamp(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "lock")
+	client := network.NewClient(nil, "client")
+	require.NoError(t, tm.Publish(context.Background(), publishIfMsg("lock"), client, map[string]any{"a": "owner-1"}, nil))
+
+	meta, err := tm.GetWithMeta(context.Background(), "lock", time.Time{})
+	require.NoError(t, err)
+
+	_, err = tm.PublishIf(context.Background(), publishIfMsg("lock"), client, map[string]any{"a": "owner-2"}, Precondition{Timestamp: meta.Timestamp}, nil)
+	require.NoError(t, err)
+
+	// the value changed, so the old timestamp doesn't match anymore
+	current, err := tm.PublishIf(context.Background(), publishIfMsg("lock"), client, map[string]any{"a": "owner-3"}, Precondition{Timestamp: meta.Timestamp}, nil)
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+	assert.Equal(t, map[string]any{"a": "owner-2"}, current.Value)
+}
+
+func TestPublishIf_MissingTopic(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.PublishIf(context.Background(), publishIfMsg("missing"), network.NewClient(nil, "client"), map[string]any{"a": "b"}, Precondition{CheckValue: true}, nil)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrPreconditionFailed)
+}
+
+func TestPublishIf_ConcurrentIncrements(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "counter")
+	client := network.NewClient(nil, "client")
+	require.NoError(t, tm.Publish(context.Background(), publishIfMsg("counter"), client, map[string]any{"a": 0.0}, nil))
+
+	// every increment reads the count and only writes if nobody else wrote first, so none are lost
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				value, err := tm.Get(context.Background(), "counter")
+				if !assert.NoError(t, err) {
+					return
+				}
+				count := value.(map[string]any)["a"].(float64)
+				_, err = tm.PublishIf(context.Background(), publishIfMsg("counter"), client, map[string]any{"a": count + 1}, Precondition{CheckValue: true, Value: value}, nil)
+				if err == nil {
+					done++
+				} else if !assert.ErrorIs(t, err, ErrPreconditionFailed) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := tm.Get(context.Background(), "counter")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": float64(workers * increments)}, value)
+}
@@ -0,0 +1,139 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CooldownPolicy is what happens to a value published to a topic sooner than its min publish
+// interval after the last one.
+type CooldownPolicy string
+
+const (
+	// CooldownReject rejects the value with ErrTooFrequent.
+	CooldownReject CooldownPolicy = "reject"
+	// CooldownCoalesce holds the value back and publishes it once the interval is up, replacing
+	// any value already held back so only the latest is published.
+	CooldownCoalesce CooldownPolicy = "coalesce"
+)
+
+// ErrTooFrequent is returned when a value is published to a topic sooner than its min publish
+// interval after the last one, and the topic rejects those values.
+var ErrTooFrequent = errors.New("published too frequently")
+
+// ErrPublishCoalesced is returned when a value published to a topic sooner than its min publish
+// interval is held back to be published once the interval is up. Nothing failed, it just hasn't
+// been published yet.
+var ErrPublishCoalesced = errors.New("publish coalesced")
+
+// ParseCooldownPolicy converts a string into a CooldownPolicy. A blank string defaults to
+// rejecting. Returns error if the policy is unknown.
+func ParseCooldownPolicy(policy string) (CooldownPolicy, error) {
+	switch CooldownPolicy(policy) {
+	case "":
+		return CooldownReject, nil
+	case CooldownReject, CooldownCoalesce:
+		return CooldownPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown cooldown policy: %s", policy)
+	}
+}
+
+// publishCooldown keeps a topic from being published to more than once per interval.
+type publishCooldown struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	policy      CooldownPolicy
+	lastPublish time.Time // when the last value was let through, zero if none has been
+	pending     func()    // publishes the latest value held back, nil if there isn't one
+	timer       *time.Timer
+	stopped     bool
+}
+
+// newPublishCooldown will create a cooldown that lets a value through at most once per interval.
+func newPublishCooldown(interval time.Duration, policy CooldownPolicy) *publishCooldown {
+	if policy == "" {
+		policy = CooldownReject
+	}
+	return &publishCooldown{interval: interval, policy: policy}
+}
+
+// Allow will return nil if a value can be published now, and record it as the last publish. If
+// it's too soon, it returns ErrTooFrequent, or for the coalesce policy holds back publish to be
+// called once the interval is up and returns ErrPublishCoalesced. A nil publish can't be held back,
+// so it's rejected either way.
+func (c *publishCooldown) Allow(now time.Time, publish func()) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.tooSoon(now) {
+		c.lastPublish = now
+		return nil
+	}
+	if c.policy != CooldownCoalesce || publish == nil || c.stopped {
+		return fmt.Errorf("%w: can publish once every %s", ErrTooFrequent, c.interval)
+	}
+
+	c.pending = publish
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.lastPublish.Add(c.interval).Sub(now), c.flush)
+	}
+	return ErrPublishCoalesced
+}
+
+// Reserve will record a value as the last publish like Allow, for a value that can't be held
+// back. Returns ErrTooFrequent if it's too soon, whatever the policy. Otherwise returns a func
+// that undoes it, for when the value ends up not being published.
+func (c *publishCooldown) Reserve(now time.Time) (func(), error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tooSoon(now) {
+		return nil, fmt.Errorf("%w: can publish once every %s", ErrTooFrequent, c.interval)
+	}
+	previous := c.lastPublish
+	c.lastPublish = now
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.lastPublish.Equal(now) { // unless something was published since
+			c.lastPublish = previous
+		}
+	}, nil
+}
+
+// tooSoon will return true if a value can't be published now. A value that's held back is
+// published first, so nothing gets through ahead of it. The lock must be held.
+func (c *publishCooldown) tooSoon(now time.Time) bool {
+	return c.pending != nil || (!c.lastPublish.IsZero() && now.Sub(c.lastPublish) < c.interval)
+}
+
+// flush will publish the value that's held back, if there is one.
+func (c *publishCooldown) flush() {
+	c.mu.Lock()
+	c.timer = nil
+	publish := c.pending
+	c.pending = nil
+	if publish == nil || c.stopped {
+		c.mu.Unlock()
+		return
+	}
+	c.lastPublish = time.Now()
+	c.mu.Unlock()
+
+	publish()
+}
+
+// Stop will drop the value that's held back without publishing it. Used when the topic is unregistered.
+func (c *publishCooldown) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	c.pending = nil
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
@@ -0,0 +1,150 @@
+package topic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+)
+
+func cooldownMsg(topicName string) network.WebSocketMessage {
+	return network.WebSocketMessage{MessageId: "cooldown", Action: "publish", Topic: topicName}
+}
+
+func TestParseCooldownPolicy(t *testing.T) {
+	policy, err := ParseCooldownPolicy("")
+	require.NoError(t, err)
+	assert.Equal(t, CooldownReject, policy)
+
+	policy, err = ParseCooldownPolicy("coalesce")
+	require.NoError(t, err)
+	assert.Equal(t, CooldownCoalesce, policy)
+
+	_, err = ParseCooldownPolicy("drop")
+	assert.Error(t, err)
+}
+
+func TestCooldown_RejectsTooFrequent(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("limited", map[string]any{"a": ""}, TopicOptions{MinPublishInterval: 50 * time.Millisecond})
+	require.NoError(t, err)
+	sender := network.NewClient(nil, "publisher")
+
+	require.NoError(t, tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "1"}, nil))
+	err = tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "2"}, nil)
+	assert.ErrorIs(t, err, ErrTooFrequent)
+	err = tm.SendWithoutSave(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "2"}, nil)
+	assert.ErrorIs(t, err, ErrTooFrequent)
+	assert.Equal(t, []any{map[string]any{"a": "1"}}, putValues(db))
+
+	// once the interval is up it can be published to again
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "3"}, nil))
+	assert.Equal(t, []any{map[string]any{"a": "1"}, map[string]any{"a": "3"}}, putValues(db))
+}
+
+func TestCooldown_CoalescesToLatest(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("limited", map[string]any{"a": ""}, TopicOptions{MinPublishInterval: 50 * time.Millisecond, CooldownPolicy: CooldownCoalesce})
+	require.NoError(t, err)
+	subscriber, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("limited", subscriber, SubscriptionOptions{}))
+	sender := network.NewClient(nil, "publisher")
+
+	start := time.Now()
+	require.NoError(t, tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "1"}, nil))
+	for _, value := range []string{"2", "3", "4"} {
+		err := tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": value}, nil)
+		assert.ErrorIs(t, err, ErrPublishCoalesced)
+	}
+
+	assert.JSONEq(t, `{"a":"1"}`, string(readMessage(t, remote).Data))
+	// only the latest value held back is published, once the interval is up
+	held := readMessage(t, remote)
+	assert.JSONEq(t, `{"a":"4"}`, string(held.Data))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	assert.Eventually(t, func() bool { return len(putValues(db)) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []any{map[string]any{"a": "1"}, map[string]any{"a": "4"}}, putValues(db))
+
+	// the held back value started a new interval
+	err = tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "5"}, nil)
+	assert.ErrorIs(t, err, ErrPublishCoalesced)
+}
+
+func TestCooldown_PublishIfIsNotCoalesced(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("limited", map[string]any{"a": ""}, TopicOptions{MinPublishInterval: time.Minute, CooldownPolicy: CooldownCoalesce})
+	require.NoError(t, err)
+	sender := network.NewClient(nil, "publisher")
+
+	require.NoError(t, tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "1"}, nil))
+	_, err = tm.PublishIf(context.Background(), publishIfMsg("limited"), sender, map[string]any{"a": "2"}, Precondition{}, nil)
+	assert.ErrorIs(t, err, ErrTooFrequent)
+}
+
+func TestCooldown_TransactionsAreChecked(t *testing.T) {
+	for _, policy := range []CooldownPolicy{CooldownReject, CooldownCoalesce} {
+		t.Run(string(policy), func(t *testing.T) {
+			db := storagetest.NewRecordingStorage()
+			tm := NewTopicManager(db, &config.Config{})
+			_, err := tm.RegisterTopic("limited", map[string]any{"a": ""}, TopicOptions{MinPublishInterval: time.Minute, CooldownPolicy: policy})
+			require.NoError(t, err)
+			registerTopics(t, tm, "other")
+			sender := network.NewClient(nil, "publisher")
+			msg := network.WebSocketMessage{MessageId: "tx", Action: "publishTransaction"}
+
+			require.NoError(t, tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "1"}, nil))
+			err = tm.PublishTransaction(context.Background(), msg, sender, []TopicValue{
+				{Topic: "other", Value: map[string]any{"a": "2"}},
+				{Topic: "limited", Value: map[string]any{"a": "2"}},
+			})
+			assert.ErrorIs(t, err, ErrTooFrequent)
+			assert.Empty(t, db.CallsTo("AsyncPutBatch"), "nothing in the transaction is published")
+		})
+	}
+}
+
+func TestCooldown_FailedTransactionDoesNotStartInterval(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("limited", map[string]any{"a": ""}, TopicOptions{MinPublishInterval: time.Minute})
+	require.NoError(t, err)
+	sender := network.NewClient(nil, "publisher")
+	msg := network.WebSocketMessage{MessageId: "tx", Action: "publishTransaction"}
+
+	db.Fail("AsyncPutBatch", errors.New("disk full"))
+	err = tm.PublishTransaction(context.Background(), msg, sender, []TopicValue{{Topic: "limited", Value: map[string]any{"a": "1"}}})
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrTooFrequent)
+
+	db.Fail("AsyncPutBatch", nil)
+	require.NoError(t, tm.PublishTransaction(context.Background(), msg, sender, []TopicValue{{Topic: "limited", Value: map[string]any{"a": "2"}}}))
+	err = tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "3"}, nil)
+	assert.ErrorIs(t, err, ErrTooFrequent, "the committed transaction starts the interval")
+}
+
+func TestCooldown_UnregisterDropsHeldValue(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("limited", map[string]any{"a": ""}, TopicOptions{MinPublishInterval: 30 * time.Millisecond, CooldownPolicy: CooldownCoalesce})
+	require.NoError(t, err)
+	sender := network.NewClient(nil, "publisher")
+
+	require.NoError(t, tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "1"}, nil))
+	assert.ErrorIs(t, tm.Publish(context.Background(), cooldownMsg("limited"), sender, map[string]any{"a": "2"}, nil), ErrPublishCoalesced)
+	require.NoError(t, tm.UnregisterTopic(context.Background(), "limited"))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, []any{map[string]any{"a": "1"}}, putValues(db))
+}
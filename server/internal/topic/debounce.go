@@ -0,0 +1,99 @@
+package topic
+
+import (
+	"sync"
+	"time"
+)
+
+// persistDebouncer coalesces values for a topic so that only the latest value is
+// persisted once per interval, instead of persisting every update.
+type persistDebouncer struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	pending     any
+	pendingTime time.Time
+	pendingTTL  time.Time // when the pending value expires, zero if it doesn't
+	hasPending  bool
+	timer       *time.Timer
+	stopped     bool
+	flush       func(value any, timestamp time.Time, expiresAt time.Time)
+}
+
+// newPersistDebouncer will create a debouncer that calls flush with the latest value at most once per interval.
+func newPersistDebouncer(interval time.Duration, flush func(value any, timestamp time.Time, expiresAt time.Time)) *persistDebouncer {
+	return &persistDebouncer{
+		interval: interval,
+		flush:    flush,
+	}
+}
+
+// Add will set the latest value to be persisted, replacing any value that hasn't been
+// flushed yet, and start the flush timer if it isn't already running.
+func (d *persistDebouncer) Add(value any, timestamp time.Time, expiresAt time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+
+	d.pending = value
+	d.pendingTime = timestamp
+	d.pendingTTL = expiresAt
+	d.hasPending = true
+
+	if d.timer == nil {
+		d.timer = time.AfterFunc(d.interval, d.Flush)
+	}
+}
+
+// Flush will persist the pending value now, if there is one.
+func (d *persistDebouncer) Flush() {
+	d.mu.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if !d.hasPending || d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	value, timestamp, expiresAt := d.pending, d.pendingTime, d.pendingTTL
+	d.pending = nil
+	d.hasPending = false
+	d.mu.Unlock()
+
+	d.flush(value, timestamp, expiresAt)
+}
+
+// HasPending will return true if there is a value that hasn't been flushed yet.
+func (d *persistDebouncer) HasPending() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.hasPending
+}
+
+// Discard will drop the value that hasn't been flushed, if there is one, without persisting it.
+// Used when a newer value was persisted without going through the debouncer.
+func (d *persistDebouncer) Discard() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending = nil
+	d.hasPending = false
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
+
+// Stop will stop the debouncer and drop any value that hasn't been flushed.
+func (d *persistDebouncer) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	d.pending = nil
+	d.hasPending = false
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
@@ -0,0 +1,71 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putValues will return the values that were put to the storage, in the order they were put.
+func putValues(db *storagetest.RecordingStorage) []any {
+	var values []any
+	for _, call := range db.CallsTo("AsyncPut") {
+		values = append(values, call.Value)
+	}
+	return values
+}
+
+func publishBurst(t *testing.T, tm TopicManager, topicName string, count int) {
+	sender := network.NewClient(nil, "publisher")
+	for i := 0; i < count; i++ {
+		msg := network.WebSocketMessage{MessageId: fmt.Sprint(i), Action: "publish", Topic: topicName}
+		require.NoError(t, tm.Publish(context.Background(), msg, sender, map[string]any{"count": i}, nil))
+	}
+}
+
+func TestDebouncedPersistence_FewerWritesThanPublishes(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("debounced", map[string]any{"count": 0}, TopicOptions{PersistInterval: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	publishBurst(t, tm, "debounced", 100)
+
+	// the latest value always gets flushed eventually
+	assert.Eventually(t, func() bool {
+		puts := putValues(db)
+		return len(puts) > 0 && assert.ObjectsAreEqual(map[string]any{"count": 99}, puts[len(puts)-1])
+	}, time.Second, 10*time.Millisecond)
+	assert.Less(t, len(putValues(db)), 100)
+}
+
+func TestWithoutDebounce_EveryPublishIsWritten(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("not-debounced", map[string]any{"count": 0}, TopicOptions{})
+	require.NoError(t, err)
+
+	publishBurst(t, tm, "not-debounced", 100)
+
+	assert.Len(t, putValues(db), 100)
+}
+
+func TestDebouncedPersistence_UnregisterDropsPending(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("debounced", map[string]any{"count": 0}, TopicOptions{PersistInterval: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	publishBurst(t, tm, "debounced", 10)
+	require.NoError(t, tm.UnregisterTopic(context.Background(), "debounced"))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, putValues(db))
+}
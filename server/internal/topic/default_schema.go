@@ -0,0 +1,69 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultSchemas are the schemas topics are registered with when they're registered on their own,
+// by publishing with autoRegister or publishing or subscribing to a missing topic, instead of
+// inferring one from the first value.
+type DefaultSchemas struct {
+	Default    any            `json:"default,omitempty"`    // schema for topics that aren't in any of the namespaces
+	Namespaces map[string]any `json:"namespaces,omitempty"` // schema for the topics with names starting with each prefix
+}
+
+// LoadDefaultSchemas will read and parse the default schemas file at the path. Returns error if
+// the file can't be read, has fields that aren't part of a default schemas file, or has a blank
+// namespace.
+func LoadDefaultSchemas(path string) (DefaultSchemas, error) {
+	var schemas DefaultSchemas
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return schemas, fmt.Errorf("couldn't read default schemas file: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&schemas); err != nil {
+		return schemas, fmt.Errorf("couldn't parse default schemas file %s: %w", path, err)
+	}
+	for namespace, schema := range schemas.Namespaces {
+		if strings.TrimSpace(namespace) == "" {
+			return schemas, fmt.Errorf("default schemas file %s has a blank namespace. Use default for every topic", path)
+		}
+		if schema == nil {
+			return schemas, fmt.Errorf("default schemas file %s has no schema for namespace %s", path, namespace)
+		}
+	}
+	return schemas, nil
+}
+
+// WithDefaultSchemas will make the topic manager register topics that are registered on their
+// own with the schemas instead of one inferred from the first value.
+func WithDefaultSchemas(schemas DefaultSchemas) ManagerOption {
+	return func(tm *topicManager) {
+		tm.defaultSchemas = schemas
+	}
+}
+
+// DefaultSchema will return the schema a topic registered on its own gets, from the longest
+// namespace the name starts with, or the default if it isn't in any. Returns false if there's no
+// schema for it, so it should be inferred from the first value like before.
+func (tm *topicManager) DefaultSchema(topicName string) (any, bool) {
+	longest := -1
+	var schema any
+	for namespace, namespaceSchema := range tm.defaultSchemas.Namespaces {
+		if strings.HasPrefix(topicName, namespace) && len(namespace) > longest {
+			longest = len(namespace)
+			schema = namespaceSchema
+		}
+	}
+	if longest < 0 {
+		schema = tm.defaultSchemas.Default
+	}
+	return schema, schema != nil
+}
@@ -0,0 +1,69 @@
+package topic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeDefaultSchemas will write the contents to a default schemas file and return its path.
+func writeDefaultSchemas(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "default-schemas.json")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestDefaultSchema_LongestNamespaceWins(t *testing.T) {
+	schemas, err := LoadDefaultSchemas(writeDefaultSchemas(t, `{
+		"default": {"id": ""},
+		"namespaces": {
+			"sensors/": {"temp": 0},
+			"sensors/kitchen/": {"temp": 0, "humidity": 0}
+		}
+	}`))
+	require.NoError(t, err)
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{}, WithDefaultSchemas(schemas))
+
+	tests := map[string]any{
+		"sensors/garage":         map[string]any{"temp": 0.0},
+		"sensors/kitchen/fridge": map[string]any{"temp": 0.0, "humidity": 0.0},
+		"orders":                 map[string]any{"id": ""},
+	}
+	for topicName, want := range tests {
+		schema, ok := tm.DefaultSchema(topicName)
+		assert.True(t, ok, topicName)
+		assert.Equal(t, want, schema, topicName)
+	}
+}
+
+func TestDefaultSchema_NoneConfigured(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{}, WithDefaultSchemas(DefaultSchemas{
+		Namespaces: map[string]any{"sensors/": map[string]any{"temp": 0.0}},
+	}))
+	_, ok := tm.DefaultSchema("orders")
+	assert.False(t, ok)
+
+	_, ok = NewTopicManager(storage.NewNullStorage(), &config.Config{}).DefaultSchema("sensors/garage")
+	assert.False(t, ok)
+}
+
+func TestLoadDefaultSchemas_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":       `{"schemas": {}}`,
+		"blank namespace":     `{"namespaces": {" ": {"temp": 0}}}`,
+		"namespace no schema": `{"namespaces": {"sensors/": null}}`,
+		"not json":            `{"default": `,
+	}
+	for name, contents := range tests {
+		_, err := LoadDefaultSchemas(writeDefaultSchemas(t, contents))
+		assert.Error(t, err, name)
+	}
+
+	_, err := LoadDefaultSchemas(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package topic
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MIN_IDLE_SWEEP_INTERVAL is the most often topics are checked for being idle, however short the
+// idle expiry is.
+const MIN_IDLE_SWEEP_INTERVAL = 10 * time.Millisecond
+
+// isIdle will return true if the topic has no subscribers and hasn't been registered, published to,
+// or subscribed or unsubscribed from within the window before now.
+func (t *Topic) isIdle(now time.Time, window time.Duration) bool {
+	t.mu.RLock("isIdle")
+	defer t.mu.RUnlock("isIdle")
+	return len(t.subscribers) == 0 && now.Sub(t.lastActive) >= window
+}
+
+// StartIdleExpiry will start unregistering topics that have been idle for the configured topic
+// idle expiry, until ctx is done. Topics are checked every half of the expiry, so a topic can be
+// idle for up to one and a half times the expiry before it's unregistered. Does nothing if the
+// expiry is 0.
+func (tm *topicManager) StartIdleExpiry(ctx context.Context) {
+	window := tm.config.TopicIdleExpiry
+	if window <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(max(window/2, MIN_IDLE_SWEEP_INTERVAL))
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				tm.expireIdleTopics(ctx, now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// expireIdleTopics will unregister every topic that is idle as of now, deleting their stored values
+// only if the config says to purge them. Returns the names of the topics that were unregistered.
+func (tm *topicManager) expireIdleTopics(ctx context.Context, now time.Time) []string {
+	window := tm.config.TopicIdleExpiry
+
+	// checked and removed under the lock so a topic can't become active in between
+	tm.mu.Lock("expireIdleTopics")
+	expired := make(map[string]*Topic)
+	for name, topic := range tm.topics {
+		if topic.isIdle(now, window) {
+			expired[name] = topic
+			delete(tm.topics, name)
+			if tm.config.TopicIdleExpiryPurge {
+				tm.orphans.Track(name)
+			}
+		}
+	}
+	tm.mu.Unlock("expireIdleTopics")
+
+	names := make([]string, 0, len(expired))
+	for name, topic := range expired {
+		logger := log.WithFields(log.Fields{"method": "expireIdleTopics", "topic": name})
+		deleteCtx, cancel := context.WithTimeout(ctx, DEFAULT_ORPHAN_DELETE_TIMEOUT)
+		if err := tm.closeTopic(deleteCtx, name, topic, tm.config.TopicIdleExpiryPurge); err != nil {
+			logger.Warnf("unregistered idle topic but its stored value wasn't deleted: %v", err)
+		} else {
+			logger.Infof("unregistered topic that was idle for %s", window)
+		}
+		cancel()
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,81 @@
+package topic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleExpiry_IdleTopicUnregisteredActiveSurvives(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{TopicIdleExpiry: 100 * time.Millisecond})
+	registerTopics(t, tm, "idle", "subscribed", "published")
+	client, _ := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("subscribed", client, SubscriptionOptions{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tm.StartIdleExpiry(ctx)
+
+	// keep publishing to one topic for a few windows
+	publisher := network.NewClient(nil, "publisher")
+	msg := network.WebSocketMessage{MessageId: "keep-alive", Action: "publish", Topic: "published"}
+	deadline := time.Now().Add(400 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"a": "1"}, nil))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	assert.False(t, tm.HasTopic("idle"), "idle topic should have been unregistered")
+	assert.True(t, tm.HasTopic("subscribed"), "topic with a subscriber should survive")
+	assert.True(t, tm.HasTopic("published"), "topic being published to should survive")
+
+	// once the subscriber leaves, the topic is idle too
+	require.NoError(t, tm.Unsubscribe("subscribed", client))
+	assert.Eventually(t, func() bool { return !tm.HasTopic("subscribed") }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestIdleExpiry_DisabledByDefault(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "idle")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tm.StartIdleExpiry(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, tm.HasTopic("idle"))
+}
+
+func TestIdleExpiry_PurgeDeletesStoredValue(t *testing.T) {
+	tests := map[string]bool{"keeps stored value": false, "purges stored value": true}
+	for name, purge := range tests {
+		t.Run(name, func(t *testing.T) {
+			db := storagetest.NewRecordingStorage()
+			cfg := &config.Config{TopicIdleExpiry: time.Minute, TopicIdleExpiryPurge: purge}
+			manager := NewTopicManager(db, cfg).(*topicManager)
+			registerTopics(t, manager, "idle", "recent")
+			require.NoError(t, <-db.AsyncPut(context.Background(), "idle", map[string]any{"a": "1"}, time.Now().UTC(), time.Time{}))
+
+			// only the topic that was active before the window is expired
+			manager.topics["idle"].lastActive = time.Now().Add(-2 * time.Minute)
+			expired := manager.expireIdleTopics(context.Background(), time.Now())
+			assert.Equal(t, []string{"idle"}, expired)
+			assert.True(t, manager.HasTopic("recent"))
+
+			stored, err := db.Get(context.Background(), "idle")
+			require.NoError(t, err)
+			if purge {
+				assert.Nil(t, stored)
+			} else {
+				assert.Equal(t, map[string]any{"a": "1"}, stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package topic
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// PayloadFormat is how the values published to a topic are encoded.
+type PayloadFormat string
+
+const (
+	// FormatJSON values are json, validated against the topic's schema.
+	FormatJSON PayloadFormat = "json"
+	// FormatRaw values are raw bytes sent as binary frames, which the server doesn't look at.
+	FormatRaw PayloadFormat = "raw"
+	// FormatMsgpack values are a single MessagePack value sent as binary frames. The server only
+	// checks they're well formed, the schema isn't used to validate them.
+	FormatMsgpack PayloadFormat = "msgpack"
+)
+
+// ParsePayloadFormat converts a string into a PayloadFormat. A blank string defaults to json.
+// Returns error if the format is unknown.
+func ParsePayloadFormat(format string) (PayloadFormat, error) {
+	switch PayloadFormat(format) {
+	case "":
+		return FormatJSON, nil
+	case FormatJSON, FormatRaw, FormatMsgpack:
+		return PayloadFormat(format), nil
+	default:
+		return "", fmt.Errorf("unknown payload format: %s", format)
+	}
+}
+
+// IsBinary will return true if values in the format are bytes sent as binary frames rather than json.
+func (f PayloadFormat) IsBinary() bool {
+	return f == FormatRaw || f == FormatMsgpack
+}
+
+// checkMsgpack will return error unless the payload is exactly one well formed MessagePack value.
+// Values are counted off as they're read instead of recursing, so deeply nested payloads can't
+// overflow the stack.
+func checkMsgpack(payload []byte) error {
+	rest := payload
+	pending := 1 // values left to read, arrays and maps add their elements
+	for pending > 0 {
+		if len(rest) < pending { // every value is at least a byte
+			return fmt.Errorf("msgpack payload is truncated")
+		}
+		b := rest[0]
+		rest = rest[1:]
+		pending--
+
+		var skip, elements int
+		switch {
+		case b <= 0x7f || b >= 0xe0: // positive and negative fixint
+		case b <= 0x8f: // fixmap
+			elements = 2 * int(b&0x0f)
+		case b <= 0x9f: // fixarray
+			elements = int(b & 0x0f)
+		case b <= 0xbf: // fixstr
+			skip = int(b & 0x1f)
+		default:
+			var err error
+			if skip, elements, rest, err = msgpackLengths(b, rest); err != nil {
+				return err
+			}
+		}
+
+		if skip > len(rest) {
+			return fmt.Errorf("msgpack payload is truncated")
+		}
+		rest = rest[skip:]
+		pending += elements
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("msgpack payload has %d bytes after its value", len(rest))
+	}
+	return nil
+}
+
+// msgpackLengths will read the length that follows a MessagePack type byte from 0xc0 up, and
+// return how many bytes of data follow it and how many values it contains.
+func msgpackLengths(b byte, rest []byte) (int, int, []byte, error) {
+	// readLength will read a big endian length of the size from the start of rest
+	readLength := func(size int) (int, error) {
+		if len(rest) < size {
+			return 0, fmt.Errorf("msgpack payload is truncated")
+		}
+		var n uint64
+		switch size {
+		case 1:
+			n = uint64(rest[0])
+		case 2:
+			n = uint64(binary.BigEndian.Uint16(rest))
+		case 4:
+			n = uint64(binary.BigEndian.Uint32(rest))
+		}
+		rest = rest[size:]
+		return int(n), nil
+	}
+
+	var skip, elements int
+	var err error
+	switch b {
+	case 0xc0, 0xc2, 0xc3: // nil, false, true
+	case 0xcc, 0xd0: // uint8, int8
+		skip = 1
+	case 0xcd, 0xd1: // uint16, int16
+		skip = 2
+	case 0xca, 0xce, 0xd2: // float32, uint32, int32
+		skip = 4
+	case 0xcb, 0xcf, 0xd3: // float64, uint64, int64
+		skip = 8
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16 with their type
+		skip = 1 + 1<<(b-0xd4)
+	case 0xc4, 0xd9: // bin8, str8
+		skip, err = readLength(1)
+	case 0xc5, 0xda: // bin16, str16
+		skip, err = readLength(2)
+	case 0xc6, 0xdb: // bin32, str32
+		skip, err = readLength(4)
+	case 0xc7: // ext8 with its type
+		skip, err = readLength(1)
+		skip++
+	case 0xc8: // ext16
+		skip, err = readLength(2)
+		skip++
+	case 0xc9: // ext32
+		skip, err = readLength(4)
+		skip++
+	case 0xdc: // array16
+		elements, err = readLength(2)
+	case 0xdd: // array32
+		elements, err = readLength(4)
+	case 0xde: // map16
+		elements, err = readLength(2)
+		elements *= 2
+	case 0xdf: // map32
+		elements, err = readLength(4)
+		elements *= 2
+	default: // 0xc1 is never used
+		return 0, 0, rest, fmt.Errorf("msgpack payload has an invalid type byte 0x%x", b)
+	}
+	return skip, elements, rest, err
+}
@@ -0,0 +1,54 @@
+package topic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePayloadFormat(t *testing.T) {
+	for input, want := range map[string]PayloadFormat{"": FormatJSON, "json": FormatJSON, "raw": FormatRaw, "msgpack": FormatMsgpack} {
+		format, err := ParsePayloadFormat(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, format)
+	}
+
+	_, err := ParsePayloadFormat("protobuf")
+	assert.Error(t, err)
+	assert.False(t, FormatJSON.IsBinary())
+	assert.True(t, FormatRaw.IsBinary())
+	assert.True(t, FormatMsgpack.IsBinary())
+}
+
+func TestCheckMsgpack_Valid(t *testing.T) {
+	valid := map[string][]byte{
+		"fixint":       {0x05},
+		"nil":          {0xc0},
+		"fixmap":       {0x81, 0xa1, 'a', 0x01},
+		"str8":         {0xd9, 0x03, 'a', 'b', 'c'},
+		"array16":      {0xdc, 0x00, 0x02, 0xc3, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0},
+		"nested":       {0x91, 0x91, 0x91, 0x80},
+		"fixext4":      {0xd6, 0x01, 0, 0, 0, 0},
+		"bin16":        {0xc5, 0x00, 0x01, 0xff},
+		"negative int": {0xff},
+	}
+	for name, payload := range valid {
+		assert.NoError(t, checkMsgpack(payload), name)
+	}
+}
+
+func TestCheckMsgpack_Invalid(t *testing.T) {
+	invalid := map[string][]byte{
+		"empty":          {},
+		"truncated str":  {0xa3, 'a'},
+		"truncated map":  {0x81, 0xa1, 'a'},
+		"trailing bytes": {0x01, 0x02},
+		"never used":     {0xc1},
+		"huge array":     {0xdd, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"short length":   {0xda, 0x01},
+	}
+	for name, payload := range invalid {
+		assert.Error(t, checkMsgpack(payload), name)
+	}
+}
@@ -0,0 +1,103 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ValueMeta is a value of a topic with what is known about when and how it was stored. Storage
+// only keeps values, so the metadata is what the topic recorded when the value was stored, and
+// isn't known for values stored before the server started.
+type ValueMeta struct {
+	Value         any
+	Timestamp     time.Time         // when the value was stored, zero if it isn't known
+	SchemaVersion *int              // the topic's latest schema version when the value was stored, nil if it isn't known
+	Latest        bool              // no newer value has been stored for the topic
+	Headers       map[string]string // the headers the value was published with, nil if it had none or they aren't known
+}
+
+// storedMeta will return the metadata of the last value stored for the topic, without the value.
+// Must hold the lock.
+func (t *Topic) storedMeta() ValueMeta {
+	meta := ValueMeta{Timestamp: t.lastUpdated, Latest: true}
+	if !t.lastUpdated.IsZero() {
+		schemaVersion := t.updatedSchema
+		meta.SchemaVersion = &schemaVersion
+		meta.Headers = t.updatedHeaders
+	}
+	return meta
+}
+
+// snapshotMeta will return the metadata of the last value stored for the topic, without the value.
+func (t *Topic) snapshotMeta() ValueMeta {
+	t.mu.RLock("snapshotMeta")
+	defer t.mu.RUnlock("snapshotMeta")
+	return t.storedMeta()
+}
+
+// cachedMeta will return the cached value for the topic with its metadata, taken under the same
+// lock so they match, and false if there is no cached value.
+func (t *Topic) cachedMeta(now time.Time) (ValueMeta, bool) {
+	t.mu.RLock("cachedMeta")
+	defer t.mu.RUnlock("cachedMeta")
+	if !t.hasCache {
+		return ValueMeta{}, false
+	}
+	meta := t.storedMeta()
+	if t.cacheExpires.IsZero() || now.Before(t.cacheExpires) {
+		meta.Value = t.cachedValue
+	}
+	return meta, true
+}
+
+// GetWithMeta will retrieve the value of the topic with its metadata, the latest value if at is
+// zero, or the value it had at the time. The metadata of a value from before the last one stored
+// since the server started isn't known, so only the value is returned and it isn't the latest.
+func (tm *topicManager) GetWithMeta(ctx context.Context, topicName string, at time.Time) (ValueMeta, error) {
+	tm.mu.RLock("GetWithMeta")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("GetWithMeta")
+
+	if !ok {
+		return ValueMeta{}, fmt.Errorf("couldn't get value for topic. topic doesn't exist. topic: %s", topicName)
+	}
+
+	if !at.IsZero() {
+		value, err := tm.GetAt(ctx, topicName, at)
+		if err != nil {
+			return ValueMeta{}, err
+		}
+		meta := topic.snapshotMeta()
+		if meta.Timestamp.IsZero() || at.Before(meta.Timestamp) { // a newer value was stored since, or it isn't known
+			meta = ValueMeta{}
+		}
+		meta.Value = value
+		return meta, nil
+	}
+
+	if !tm.config.GetReadThrough {
+		if meta, ok := topic.cachedMeta(time.Now()); ok {
+			log.WithFields(log.Fields{"method": "GetWithMeta", "topic": topicName}).Trace("returning cached topic value.")
+			return meta, nil
+		}
+	}
+
+	// a value stored while reading it could be either one, so the metadata is only kept if there wasn't
+	before := topic.snapshotMeta()
+	value, err := tm.db.Get(ctx, topicName)
+	if err != nil {
+		return ValueMeta{}, fmt.Errorf("couldn't get value for topic with error: %v", err)
+	}
+	if value, err = topic.decompressValue(value); err != nil {
+		return ValueMeta{}, err
+	}
+	meta := topic.snapshotMeta()
+	if !meta.Timestamp.Equal(before.Timestamp) || (topic.debouncer != nil && topic.debouncer.HasPending()) {
+		meta = ValueMeta{} // storage doesn't have the latest value yet
+	}
+	meta.Value = value
+	return meta, nil
+}
@@ -0,0 +1,132 @@
+package topic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publishValue will publish the value to the topic and return when it was sent.
+func publishValue(t *testing.T, tm TopicManager, topicName string, value any) time.Time {
+	before := time.Now().UTC()
+	msg := network.WebSocketMessage{MessageId: "meta", Action: "publish", Topic: topicName}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), value, nil))
+	return before
+}
+
+func TestGetWithMeta_PublishedValue(t *testing.T) {
+	for _, readThrough := range []bool{false, true} {
+		tm := NewTopicManager(storagetest.NewRecordingStorage(), &config.Config{GetReadThrough: readThrough})
+		registerTopics(t, tm, "sensor")
+
+		sent := publishValue(t, tm, "sensor", map[string]any{"a": "1"})
+		meta, err := tm.GetWithMeta(context.Background(), "sensor", time.Time{})
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]any{"a": "1"}, meta.Value, "read through: %v", readThrough)
+		assert.True(t, meta.Latest)
+		require.NotNil(t, meta.SchemaVersion)
+		assert.Equal(t, 0, *meta.SchemaVersion)
+		assert.False(t, meta.Timestamp.Before(sent))
+		assert.WithinDuration(t, sent, meta.Timestamp, time.Second)
+	}
+}
+
+func TestGetWithMeta_HeadersOfLatestValue(t *testing.T) {
+	tm := NewTopicManager(storagetest.NewRecordingStorage(), &config.Config{})
+	registerTopics(t, tm, "sensor")
+	sender := network.NewClient(nil, "publisher")
+
+	headers := map[string]string{"trace-id": "abc"}
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "sensor", Headers: headers}
+	require.NoError(t, tm.Publish(context.Background(), msg, sender, map[string]any{"a": "1"}, nil))
+	meta, err := tm.GetWithMeta(context.Background(), "sensor", time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, headers, meta.Headers)
+
+	// a value published without headers doesn't keep the last one's
+	publishValue(t, tm, "sensor", map[string]any{"a": "2"})
+	meta, err = tm.GetWithMeta(context.Background(), "sensor", time.Time{})
+	require.NoError(t, err)
+	assert.Nil(t, meta.Headers)
+}
+
+func TestGetWithMeta_SchemaVersionAtTimeOfStorage(t *testing.T) {
+	tm := NewTopicManager(storagetest.NewRecordingStorage(), &config.Config{})
+	registerTopics(t, tm, "sensor")
+	publishValue(t, tm, "sensor", map[string]any{"a": "1"})
+
+	// updating the schema doesn't change the version the stored value was published under
+	require.NoError(t, tm.UpdateSchema("sensor", map[string]any{"a": "", "b": ""}))
+	meta, err := tm.GetWithMeta(context.Background(), "sensor", time.Time{})
+	require.NoError(t, err)
+	require.NotNil(t, meta.SchemaVersion)
+	assert.Equal(t, 0, *meta.SchemaVersion)
+
+	publishValue(t, tm, "sensor", map[string]any{"a": "2", "b": "3"})
+	meta, err = tm.GetWithMeta(context.Background(), "sensor", time.Time{})
+	require.NoError(t, err)
+	require.NotNil(t, meta.SchemaVersion)
+	assert.Equal(t, 1, *meta.SchemaVersion)
+}
+
+func TestGetWithMeta_ValueStoredBeforeStart(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	require.NoError(t, <-db.AsyncPut(context.Background(), "sensor", map[string]any{"a": "old"}, time.Now().UTC(), time.Time{}))
+
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "sensor")
+	meta, err := tm.GetWithMeta(context.Background(), "sensor", time.Time{})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]any{"a": "old"}, meta.Value)
+	assert.True(t, meta.Latest, "nothing newer has been stored")
+	assert.True(t, meta.Timestamp.IsZero())
+	assert.Nil(t, meta.SchemaVersion)
+}
+
+func TestGetWithMeta_At(t *testing.T) {
+	tm := NewTopicManager(storagetest.NewRecordingStorage(), &config.Config{})
+	registerTopics(t, tm, "sensor")
+	sent := publishValue(t, tm, "sensor", map[string]any{"a": "1"})
+
+	// after the last value was stored, the value at the time is the latest one
+	meta, err := tm.GetWithMeta(context.Background(), "sensor", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, meta.Latest)
+	assert.False(t, meta.Timestamp.IsZero())
+	assert.NotNil(t, meta.SchemaVersion)
+
+	// before it, the value is an older one that nothing is known about
+	meta, err = tm.GetWithMeta(context.Background(), "sensor", sent.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, meta.Latest)
+	assert.True(t, meta.Timestamp.IsZero())
+	assert.Nil(t, meta.SchemaVersion)
+}
+
+func TestGetWithMeta_PendingDebouncedValueIsNotLatest(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{GetReadThrough: true})
+	_, err := tm.RegisterTopic("sensor", map[string]any{"a": ""}, TopicOptions{PersistInterval: time.Minute})
+	require.NoError(t, err)
+
+	publishValue(t, tm, "sensor", map[string]any{"a": "1"})
+	meta, err := tm.GetWithMeta(context.Background(), "sensor", time.Time{})
+	require.NoError(t, err)
+	assert.Nil(t, meta.Value, "the value hasn't been flushed to storage")
+	assert.False(t, meta.Latest)
+	assert.True(t, meta.Timestamp.IsZero())
+}
+
+func TestGetWithMeta_MissingTopic(t *testing.T) {
+	tm := NewTopicManager(storagetest.NewRecordingStorage(), &config.Config{})
+	_, err := tm.GetWithMeta(context.Background(), "missing", time.Time{})
+	assert.Error(t, err)
+}
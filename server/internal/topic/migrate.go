@@ -0,0 +1,213 @@
+package topic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrMigrationFailed is returned when a topic's stored value can't be migrated to a new schema,
+// in which case neither the schema nor the stored value is changed.
+var ErrMigrationFailed = errors.New("schema migration failed")
+
+// SchemaMigration is how a topic's stored value is transformed to match a new schema. Fields are
+// renamed first, then dropped, then set. Nested fields are named by their path with dots, such as
+// "location.lat".
+type SchemaMigration struct {
+	Rename map[string]string // old field to new field, the old field has to be in the value
+	Drop   []string          // fields to remove, fields the value doesn't have are skipped
+	Set    map[string]any    // fields to set to a value, replacing what they had
+}
+
+// MigrationResult is the schema version a topic was migrated to and the value it has now.
+type MigrationResult struct {
+	SchemaVersion int
+	Migrated      bool // false if the topic had no stored value to migrate
+	Value         any
+}
+
+// MigrateSchema will give a topic a new schema and transform its stored value to match it in one
+// step. The value is read, transformed, and written back while holding the topic's write lock, so
+// no publish to the topic can happen in between. The schema is only updated once the value is
+// written, so if the transform fails, the value doesn't match the new schema for a strict topic,
+// or it can't be written, nothing is changed. Binary and aggregate topics can't be migrated.
+func (tm *topicManager) MigrateSchema(ctx context.Context, topicName string, schema any, migration SchemaMigration) (result MigrationResult, err error) {
+	ctx, span := startSpan(ctx, "TopicManager.MigrateSchema", topicName)
+	defer func() { endSpan(span, err) }()
+
+	if err := tm.checkNestingDepth(schema, "schema"); err != nil {
+		return result, err
+	}
+
+	tm.mu.RLock("MigrateSchema")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("MigrateSchema")
+	if !ok {
+		return result, fmt.Errorf("cannot migrate schema for topic %s. Topic doesn't exist", topicName)
+	}
+	if topic.binary || topic.aggregator != nil {
+		return result, fmt.Errorf("%w: topic %s doesn't store json values that can be migrated", ErrMigrationFailed, topicName)
+	}
+
+	unlock := lockWrites(topic)
+	defer unlock()
+
+	current, err := tm.currentMeta(ctx, topic)
+	if err != nil {
+		return result, fmt.Errorf("couldn't read current value of topic %s: %w", topicName, err)
+	}
+
+	if current.Value != nil {
+		value, err := migrateValue(copyJSONValue(current.Value), migration)
+		if err != nil {
+			return result, fmt.Errorf("%w for topic %s: %v", ErrMigrationFailed, topicName, err)
+		}
+
+		topic.mu.RLock("MigrateSchema")
+		fillDefaults, mode, expiresAt := topic.fillDefaults, topic.validationMode, topic.cacheExpires
+		topic.mu.RUnlock("MigrateSchema")
+		if fillDefaults {
+			value = withDefaults(schema, value)
+		}
+		if mismatches := schemaMismatches(schema, value, ""); len(mismatches) > 0 && mode == ValidationStrict {
+			return result, fmt.Errorf("%w for topic %s: migrated value doesn't match the new schema: %s", ErrMigrationFailed, topicName, strings.Join(mismatches, "; "))
+		}
+
+		if err := tm.writeMigratedValue(ctx, topic, value, expiresAt); err != nil {
+			return result, err
+		}
+		result.Migrated, result.Value = true, value
+	}
+
+	topic.UpdateSchema(schema)
+	result.SchemaVersion = topic.LatestSchemaVersion()
+	if result.Migrated { // marked after the schema is updated so the value is stored under the new version
+		topic.markUpdated(time.Now().UTC(), current.Headers)
+	}
+	return result, nil
+}
+
+// writeMigratedValue will store the migrated value of a topic and wait for it to be written, then
+// cache it. A value waiting to be persisted by the topic's debouncer is dropped, since it has the
+// old shape. Must hold the topic's write lock.
+func (tm *topicManager) writeMigratedValue(ctx context.Context, topic *Topic, value any, expiresAt time.Time) error {
+	stored := value
+	if topic.compressed {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("couldn't encode migrated value for topic %s: %w", topic.name, err)
+		}
+		if stored, err = topic.compressValue(value, raw); err != nil {
+			return fmt.Errorf("couldn't compress migrated value for topic %s: %w", topic.name, err)
+		}
+	}
+
+	if err := <-tm.db.AsyncPut(ctx, topic.name, stored, time.Now().UTC(), expiresAt); err != nil {
+		return fmt.Errorf("couldn't store migrated value for topic %s: %w", topic.name, err)
+	}
+	if topic.debouncer != nil {
+		topic.debouncer.Discard()
+	}
+	topic.cacheValue(value, expiresAt)
+	return nil
+}
+
+// migrateValue will apply a migration to a value, which has to be an object. The value is changed
+// in place, so it should be a copy.
+func migrateValue(value any, migration SchemaMigration) (any, error) {
+	object, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("stored value is a %T, not an object", value)
+	}
+
+	// every renamed field is taken out before any are put back, so fields can be swapped
+	sources := make([]string, 0, len(migration.Rename))
+	for from := range migration.Rename {
+		sources = append(sources, from)
+	}
+	sort.Strings(sources)
+	renamed := make(map[string]any, len(sources))
+	for _, from := range sources {
+		fieldValue, ok := removeField(object, from)
+		if !ok {
+			return nil, fmt.Errorf("can't rename %s, the value doesn't have it", from)
+		}
+		renamed[from] = fieldValue
+	}
+	for _, from := range sources {
+		to := migration.Rename[from]
+		if _, exists := lookupField(object, to); exists {
+			return nil, fmt.Errorf("can't rename %s to %s, the value already has %s", from, to, to)
+		}
+		if err := setField(object, to, renamed[from]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range migration.Drop {
+		removeField(object, path)
+	}
+	for path, fieldValue := range migration.Set {
+		if err := setField(object, path, copyJSONValue(fieldValue)); err != nil {
+			return nil, err
+		}
+	}
+	return object, nil
+}
+
+// lookupField will return the value of the field at the dotted path, and false if there isn't one.
+func lookupField(object map[string]any, path string) (any, bool) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := object[key].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		object = child
+	}
+	value, ok := object[keys[len(keys)-1]]
+	return value, ok
+}
+
+// removeField will remove the field at the dotted path and return its value, and false if there
+// wasn't one.
+func removeField(object map[string]any, path string) (any, bool) {
+	parentPath, key := "", path
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		parentPath, key = path[:i], path[i+1:]
+	}
+	parent := object
+	if parentPath != "" {
+		found, ok := lookupField(object, parentPath)
+		if parent, ok = found.(map[string]any); !ok {
+			return nil, false
+		}
+	}
+	value, ok := parent[key]
+	delete(parent, key)
+	return value, ok
+}
+
+// setField will set the field at the dotted path, adding objects for the fields along it that
+// aren't there. Returns error if a field along the path isn't an object.
+func setField(object map[string]any, path string, value any) error {
+	keys := strings.Split(path, ".")
+	for i, key := range keys[:len(keys)-1] {
+		child, exists := object[key]
+		if !exists {
+			child = make(map[string]any)
+			object[key] = child
+		}
+		childObject, ok := child.(map[string]any)
+		if !ok {
+			return fmt.Errorf("can't set %s, %s isn't an object", path, strings.Join(keys[:i+1], "."))
+		}
+		object = childObject
+	}
+	object[keys[len(keys)-1]] = value
+	return nil
+}
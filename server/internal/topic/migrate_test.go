@@ -0,0 +1,141 @@
+package topic
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateSchema_RenamesStoredField(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := storage.NewBadgerStorage()
+	require.NoError(t, db.Open(t.TempDir(), ctx))
+	defer db.Close()
+
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("sensor", map[string]any{"temp": 0.0, "unit": ""}, TopicOptions{})
+	require.NoError(t, err)
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "sensor"}
+	errCh := make(chan error, 1)
+	require.NoError(t, tm.Publish(ctx, msg, network.NewClient(nil, "publisher"), map[string]any{"temp": 21.5, "unit": "C"}, errCh))
+	require.NoError(t, <-errCh)
+
+	newSchema := map[string]any{"temperature": 0.0, "unit": ""}
+	result, err := tm.MigrateSchema(ctx, "sensor", newSchema, SchemaMigration{Rename: map[string]string{"temp": "temperature"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.SchemaVersion)
+	assert.True(t, result.Migrated)
+	assert.Equal(t, map[string]any{"temperature": 21.5, "unit": "C"}, result.Value)
+
+	topic, err := tm.ListTopics()
+	require.NoError(t, err)
+	schema, err := topic[0].GetLatestSchema()
+	require.NoError(t, err)
+	assert.Equal(t, newSchema, schema.Schema)
+
+	value, err := tm.Get(ctx, "sensor")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"temperature": 21.5, "unit": "C"}, value)
+	stored, err := db.Get(ctx, "sensor")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"temperature": 21.5, "unit": "C"}, stored)
+
+	// values published after are validated against the new schema
+	_, err = tm.ValidatePayload("sensor", map[string]any{"temp": 1.0, "unit": "C"})
+	assert.Error(t, err)
+}
+
+func TestMigrateSchema_FailureChangesNothing(t *testing.T) {
+	tests := map[string]struct {
+		migration SchemaMigration
+		schema    any
+		failPut   bool
+	}{
+		"missing field":       {migration: SchemaMigration{Rename: map[string]string{"missing": "b"}}, schema: map[string]any{"b": ""}},
+		"target exists":       {migration: SchemaMigration{Rename: map[string]string{"a": "b"}}, schema: map[string]any{"b": ""}},
+		"doesn't match":       {migration: SchemaMigration{Drop: []string{"a"}}, schema: map[string]any{"c": ""}},
+		"storage write fails": {migration: SchemaMigration{Rename: map[string]string{"a": "c"}}, schema: map[string]any{"b": "", "c": ""}, failPut: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			db := storagetest.NewRecordingStorage()
+			tm := NewTopicManager(db, &config.Config{})
+			_, err := tm.RegisterTopic("topic", map[string]any{"a": "", "b": ""}, TopicOptions{})
+			require.NoError(t, err)
+			msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "topic"}
+			require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "x", "b": "y"}, nil))
+			if tt.failPut {
+				db.Fail("AsyncPut", errors.New("disk full"))
+			}
+			puts := len(db.CallsTo("AsyncPut"))
+
+			_, err = tm.MigrateSchema(context.Background(), "topic", tt.schema, tt.migration)
+			require.Error(t, err)
+			if !tt.failPut {
+				assert.ErrorIs(t, err, ErrMigrationFailed)
+				assert.Len(t, db.CallsTo("AsyncPut"), puts)
+			}
+
+			version, _ := tm.TopicSchemaVersion("topic")
+			assert.Equal(t, 0, version)
+			value, err := tm.Get(context.Background(), "topic")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]any{"a": "x", "b": "y"}, value)
+		})
+	}
+}
+
+func TestMigrateSchema_NoStoredValueOnlyUpdatesSchema(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "empty")
+
+	result, err := tm.MigrateSchema(context.Background(), "empty", map[string]any{"b": ""}, SchemaMigration{Rename: map[string]string{"a": "b"}})
+	require.NoError(t, err)
+	assert.Equal(t, MigrationResult{SchemaVersion: 1}, result)
+	assert.Empty(t, db.CallsTo("AsyncPut"))
+}
+
+func TestMigrateSchema_BinaryTopicRejected(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("images", map[string]any{}, TopicOptions{Format: FormatRaw})
+	require.NoError(t, err)
+
+	_, err = tm.MigrateSchema(context.Background(), "images", map[string]any{}, SchemaMigration{})
+	assert.ErrorIs(t, err, ErrMigrationFailed)
+}
+
+func TestMigrateValue(t *testing.T) {
+	value := map[string]any{
+		"a":        1.0,
+		"b":        2.0,
+		"location": map[string]any{"latitude": 10.0, "longitude": 20.0},
+		"legacy":   true,
+	}
+	migrated, err := migrateValue(value, SchemaMigration{
+		Rename: map[string]string{"a": "b", "b": "a", "location.latitude": "position.lat"},
+		Drop:   []string{"legacy", "notThere"},
+		Set:    map[string]any{"location.source": "gps", "version": 2.0},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"a":        2.0,
+		"b":        1.0,
+		"location": map[string]any{"longitude": 20.0, "source": "gps"},
+		"position": map[string]any{"lat": 10.0},
+		"version":  2.0,
+	}, migrated)
+
+	_, err = migrateValue([]any{1.0}, SchemaMigration{})
+	assert.Error(t, err)
+	_, err = migrateValue(map[string]any{"a": 1.0}, SchemaMigration{Set: map[string]any{"a.b": 1.0}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,218 @@
+package topic
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_ORPHAN_DELETE_TIMEOUT = 5 * time.Second        // how long each retried delete can take
+	DEFAULT_ORPHAN_BACKOFF        = 500 * time.Millisecond // wait before the first retry, doubled after each failure
+	DEFAULT_ORPHAN_MAX_BACKOFF    = 30 * time.Second
+)
+
+// ErrOrphanedStorage is returned when a topic was unregistered but its stored value couldn't be
+// deleted. The delete is retried in the background until it succeeds.
+var ErrOrphanedStorage = errors.New("topic unregistered but its stored value wasn't deleted")
+
+// deleteWithContext will delete the key from storage, giving up when ctx is done even if the
+// storage doesn't, so a wedged storage can't block the caller. A delete that is given up on
+// can still finish later.
+func deleteWithContext(ctx context.Context, del func(ctx context.Context, key string) error, key string) error {
+	result := make(chan error, 1)
+	go func() { result <- del(ctx, key) }()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// orphanedDeletes deletes the stored values of unregistered topics, retrying the ones whose delete
+// failed, so storage doesn't keep a value for a topic that memory doesn't have anymore. A key is
+// tracked from when its topic is removed until it's deleted, it's claimed by a topic registered
+// with the name again, which then owns the stored value, or Close is called.
+type orphanedDeletes struct {
+	mu         sync.Mutex
+	pending    map[string]*orphan
+	done       chan struct{}
+	closeOnce  sync.Once
+	timeout    time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+	delete     func(ctx context.Context, key string) error
+}
+
+// orphan is a key waiting to be deleted. deleted is closed once the delete last tried for it has
+// returned, so a topic claiming the key can wait for it before writing.
+type orphan struct {
+	deleted  chan struct{}
+	retrying bool
+}
+
+// newOrphanedDeletes will create an empty set of orphaned keys that are deleted with del.
+func newOrphanedDeletes(del func(ctx context.Context, key string) error) *orphanedDeletes {
+	return &orphanedDeletes{
+		pending:    make(map[string]*orphan),
+		done:       make(chan struct{}),
+		timeout:    DEFAULT_ORPHAN_DELETE_TIMEOUT,
+		backoff:    DEFAULT_ORPHAN_BACKOFF,
+		maxBackoff: DEFAULT_ORPHAN_MAX_BACKOFF,
+		delete:     del,
+	}
+}
+
+// Track will flag the key's stored value to be deleted. It has to be called under the topic
+// manager's lock while no topic is registered with the key, so a topic registered with the key
+// afterwards always claims it.
+func (o *orphanedDeletes) Track(key string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.pending[key]; ok {
+		return
+	}
+	deleted := make(chan struct{})
+	close(deleted) // nothing is being deleted yet
+	o.pending[key] = &orphan{deleted: deleted}
+}
+
+// Delete will try deleting the tracked key's stored value now, giving up when ctx is done, and
+// keep retrying in the background if it fails. Does nothing if the key was claimed.
+func (o *orphanedDeletes) Delete(ctx context.Context, key string) error {
+	entry, deleted, ok := o.begin(key, nil)
+	if !ok {
+		return nil
+	}
+	if err := o.attempt(ctx, key, deleted); err != nil {
+		o.Retry(key)
+		return err
+	}
+	o.finish(key, entry)
+	return nil
+}
+
+// Retry will keep retrying in the background to delete the tracked key's stored value, unless
+// it's already being retried.
+func (o *orphanedDeletes) Retry(key string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entry, ok := o.pending[key]
+	if !ok || entry.retrying {
+		return
+	}
+	entry.retrying = true
+	go o.retry(key, entry)
+}
+
+// Claim will stop deleting the key's stored value because a topic is being registered with it.
+// The returned channel is closed once a delete that was already started for the key returns.
+// Returns false if the key wasn't waiting to be deleted.
+func (o *orphanedDeletes) Claim(key string) (<-chan struct{}, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entry, ok := o.pending[key]
+	if !ok {
+		deleted := make(chan struct{})
+		close(deleted)
+		return deleted, false
+	}
+	delete(o.pending, key)
+	if entry.retrying {
+		log.WithFields(log.Fields{"method": "orphanedDeletes.Claim", "key": key}).Warn("topic was registered again before its old stored value was deleted, keeping the value")
+	}
+	return entry.deleted, true
+}
+
+// Pending will return the keys that are still waiting to be deleted.
+func (o *orphanedDeletes) Pending() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	keys := make([]string, 0, len(o.pending))
+	for key := range o.pending {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Close will stop retrying every orphaned delete. Keys still pending are left in storage.
+func (o *orphanedDeletes) Close() {
+	o.closeOnce.Do(func() { close(o.done) })
+}
+
+// begin will start a delete of the key, if it's still tracked by entry, or by anything when entry
+// is nil. It's started under the lock so a topic claiming the key either stops it from starting
+// or waits for it to return.
+func (o *orphanedDeletes) begin(key string, entry *orphan) (*orphan, chan struct{}, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	current, ok := o.pending[key]
+	if !ok || (entry != nil && current != entry) {
+		return nil, nil, false
+	}
+	current.deleted = make(chan struct{})
+	return current, current.deleted, true
+}
+
+// attempt will delete the key, closing deleted once the delete returns even if it's given up on.
+func (o *orphanedDeletes) attempt(ctx context.Context, key string, deleted chan struct{}) error {
+	return deleteWithContext(ctx, func(ctx context.Context, key string) error {
+		defer close(deleted)
+		return o.delete(ctx, key)
+	}, key)
+}
+
+// finish will stop tracking the key, if it's still tracked by entry.
+func (o *orphanedDeletes) finish(key string, entry *orphan) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.pending[key] == entry {
+		delete(o.pending, key)
+	}
+}
+
+func (o *orphanedDeletes) retry(key string, entry *orphan) {
+	logger := log.WithFields(log.Fields{"method": "orphanedDeletes.retry", "key": key})
+	defer o.finish(key, entry)
+
+	backoff := o.backoff
+	for attempt := 1; ; attempt++ {
+		// a delete that was given up on has to return before the next one is tried
+		o.mu.Lock()
+		previous := entry.deleted
+		o.mu.Unlock()
+		select {
+		case <-o.done:
+			return
+		case <-previous:
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-o.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		_, deleted, ok := o.begin(key, entry)
+		if !ok { // claimed by a topic registered with the name again
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+		err := o.attempt(ctx, key, deleted)
+		cancel()
+		if err == nil {
+			logger.WithField("attempt", attempt).Info("deleted orphaned stored value")
+			return
+		}
+
+		logger.WithField("attempt", attempt).Warnf("retrying delete of orphaned stored value: %v", err)
+		backoff = min(backoff*2, o.maxBackoff)
+	}
+}
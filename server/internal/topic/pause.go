@@ -0,0 +1,95 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// ErrNotSubscribed is returned when pausing or resuming a subscription the client doesn't have.
+var ErrNotSubscribed = errors.New("client is not subscribed to topic")
+
+// pausedSubscription is a subscriber that isn't being sent values for the topic until it resumes.
+// If it keeps the latest value, the last value published while it was paused is held to be sent
+// when it resumes.
+type pausedSubscription struct {
+	keepLatest bool
+	latest     *websocket.PreparedMessage // nil if nothing was published while paused
+	expires    time.Time
+	priority   network.Priority
+}
+
+// hold will keep the message as the latest value published while paused, replacing any older one.
+func (p *pausedSubscription) hold(message *websocket.PreparedMessage, expires time.Time, priority network.Priority) {
+	if !p.keepLatest {
+		return
+	}
+	p.latest = message
+	p.expires = expires
+	p.priority = priority
+}
+
+// Pause will stop the client being sent values published to the topic without unsubscribing it.
+// If keepLatest is true, the latest value published while paused is sent when it resumes. Pausing
+// a paused subscription changes keepLatest but keeps the value already held.
+func (t *Topic) Pause(client *network.Client, keepLatest bool) error {
+	t.mu.Lock("Pause")
+	defer t.mu.Unlock("Pause")
+	if _, ok := t.subscribers[client]; !ok {
+		return fmt.Errorf("%w. topic: %s, client: %s", ErrNotSubscribed, t.name, client.Id)
+	}
+	if _, ok := t.windows[client]; ok {
+		return fmt.Errorf("%w, stop acking to hold values back. topic: %s", ErrAckWindowed, t.name)
+	}
+
+	if paused, ok := t.paused[client]; ok {
+		paused.keepLatest = keepLatest
+		if !keepLatest {
+			paused.latest = nil
+		}
+		return nil
+	}
+	t.paused[client] = &pausedSubscription{keepLatest: keepLatest}
+	return nil
+}
+
+// Resume will start sending values published to the topic to the client again, first sending the
+// latest value published while it was paused if it was kept. Resuming a subscription that isn't
+// paused does nothing. Returns true if the client's connection is closed and the held value
+// couldn't be sent.
+func (t *Topic) Resume(client *network.Client) (bool, error) {
+	t.mu.Lock("Resume")
+	defer t.mu.Unlock("Resume")
+	opts, ok := t.subscribers[client]
+	if !ok {
+		return false, fmt.Errorf("%w. topic: %s, client: %s", ErrNotSubscribed, t.name, client.Id)
+	}
+
+	paused, ok := t.paused[client]
+	if !ok {
+		return false, nil
+	}
+	delete(t.paused, client)
+	if paused.latest == nil {
+		return false, nil
+	}
+
+	if err := t.sendPrepared(client, opts, paused.latest, paused.expires, paused.priority); err != nil {
+		log.WithFields(log.Fields{"topic": t.name, "client": client.Id}).Warnf("couldn't send latest value on resume: %v", err)
+		return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway), nil
+	}
+	return false, nil
+}
+
+// IsPaused will return true if the client's subscription to the topic is paused.
+func (t *Topic) IsPaused(client *network.Client) bool {
+	t.mu.RLock("IsPaused")
+	defer t.mu.RUnlock("IsPaused")
+	_, ok := t.paused[client]
+	return ok
+}
@@ -0,0 +1,45 @@
+package topic
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// Events sent to the other subscribers of a topic when a client subscribes to or unsubscribes from it.
+const (
+	PRESENCE_JOINED = "joined"
+	PRESENCE_LEFT   = "left"
+)
+
+// PresenceEvent is the data of a presence message, which says which client joined or left a topic.
+type PresenceEvent struct {
+	Event    string `json:"event"`
+	ClientId string `json:"clientId"`
+}
+
+// notifyPresence will send a presence message for the client to the other subscribers of the topic,
+// if presence events are turned on.
+func (tm *topicManager) notifyPresence(topic *Topic, client *network.Client, event string) {
+	if !tm.config.PresenceEvents {
+		return
+	}
+
+	raw, err := json.Marshal(PresenceEvent{Event: event, ClientId: client.Id})
+	if err != nil {
+		log.WithFields(log.Fields{"method": "notifyPresence", "client": client.Id}).Errorf("could not marshal presence event: %v", err)
+		return
+	}
+	failedClients := topic.NotifyExcept(&network.WebSocketMessage{
+		MessageId: tm.ids.MessageId(),
+		Action:    "presence",
+		Topic:     topic.NameWithLock(),
+		Data:      raw,
+	}, client)
+	for _, failed := range failedClients {
+		log.WithFields(log.Fields{"client": failed}).Warn("Client failed to be sent presence event. Marking as failed client.")
+		tm.markClientFailed(failed)
+	}
+}
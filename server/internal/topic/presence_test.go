@@ -0,0 +1,105 @@
+package topic
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expectPresence will wait for a presence message and check its event and client.
+func expectPresence(t *testing.T, received <-chan network.WebSocketMessage, event string, clientId string) {
+	t.Helper()
+	select {
+	case msg := <-received:
+		assert.Equal(t, "presence", msg.Action)
+		assert.Equal(t, "room", msg.Topic)
+		var presence PresenceEvent
+		require.NoError(t, json.Unmarshal(msg.Data, &presence))
+		assert.Equal(t, PresenceEvent{Event: event, ClientId: clientId}, presence)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a %s presence event for %s", event, clientId)
+	}
+}
+
+// expectNothing will check that no message arrives for a short while.
+func expectNothing(t *testing.T, received <-chan network.WebSocketMessage) {
+	t.Helper()
+	select {
+	case msg := <-received:
+		t.Fatalf("expected no message, got %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPresence_ExistingSubscribersNotifiedOfJoinAndLeave(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{PresenceEvents: true})
+	registerTopics(t, tm, "room")
+
+	first, firstRemote := newTestClient(t, "first")
+	firstReceived := receiveMessages(firstRemote)
+	require.NoError(t, tm.Subscribe("room", first, SubscriptionOptions{}))
+	expectNothing(t, firstReceived)
+
+	second, secondRemote := newTestClient(t, "second")
+	secondReceived := receiveMessages(secondRemote)
+	require.NoError(t, tm.Subscribe("room", second, SubscriptionOptions{}))
+	expectPresence(t, firstReceived, PRESENCE_JOINED, "second")
+	expectNothing(t, secondReceived)
+
+	// subscribing again isn't joining again
+	require.NoError(t, tm.Subscribe("room", second, SubscriptionOptions{Conflate: true}))
+	expectNothing(t, firstReceived)
+
+	require.NoError(t, tm.Unsubscribe("room", second))
+	expectPresence(t, firstReceived, PRESENCE_LEFT, "second")
+
+	require.NoError(t, tm.Subscribe("room", second, SubscriptionOptions{}))
+	expectPresence(t, firstReceived, PRESENCE_JOINED, "second")
+	tm.UnsubscribeAll(first)
+	expectPresence(t, secondReceived, PRESENCE_LEFT, "first")
+}
+
+func TestPresence_OffByDefault(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "room")
+
+	first, firstRemote := newTestClient(t, "first")
+	firstReceived := receiveMessages(firstRemote)
+	require.NoError(t, tm.Subscribe("room", first, SubscriptionOptions{}))
+
+	second, _ := newTestClient(t, "second")
+	require.NoError(t, tm.Subscribe("room", second, SubscriptionOptions{}))
+	require.NoError(t, tm.Unsubscribe("room", second))
+	expectNothing(t, firstReceived)
+}
+
+// fixedIds gives every message the same id, so tests can check the generator was used.
+type fixedIds struct{}
+
+func (fixedIds) ClientId() string  { return "svc-eu-client" }
+func (fixedIds) MessageId() string { return "msg-fixed" }
+
+func TestPresence_UsesIdGenerator(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{PresenceEvents: true}, WithIdGenerator(fixedIds{}))
+	registerTopics(t, tm, "room")
+
+	first, firstRemote := newTestClient(t, "first")
+	firstReceived := receiveMessages(firstRemote)
+	require.NoError(t, tm.Subscribe("room", first, SubscriptionOptions{}))
+	second, _ := newTestClient(t, "second")
+	require.NoError(t, tm.Subscribe("room", second, SubscriptionOptions{}))
+
+	select {
+	case msg := <-firstReceived:
+		assert.Equal(t, "presence", msg.Action)
+		assert.Equal(t, "msg-fixed", msg.MessageId)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a presence event")
+	}
+}
@@ -0,0 +1,203 @@
+package topic
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// MAX_REDELIVERY_ATTEMPTS is the most times a topic can redeliver a value to a subscriber.
+	MAX_REDELIVERY_ATTEMPTS = 10
+	// DEFAULT_REDELIVERY_DELAY is how long a topic waits before redelivering when it doesn't set a delay.
+	DEFAULT_REDELIVERY_DELAY = 100 * time.Millisecond
+	// DEFAULT_REDELIVERY_QUEUE_SIZE is the most messages a topic holds to redeliver at once.
+	DEFAULT_REDELIVERY_QUEUE_SIZE = 256
+)
+
+// sendFunc sends a prepared message to a subscriber of a topic.
+type sendFunc func(client *network.Client, opts SubscriptionOptions, prepared *websocket.PreparedMessage, expires time.Time, priority network.Priority) error
+
+// redeliveryPolicy is how many more times a topic tries to send a value to a subscriber it
+// couldn't be sent to, and how long it waits before each try.
+type redeliveryPolicy struct {
+	attempts int
+	delay    time.Duration
+}
+
+// newRedeliveryPolicy will create a policy for the attempts, using the default delay if it isn't set.
+func newRedeliveryPolicy(attempts int, delay time.Duration) redeliveryPolicy {
+	if attempts <= 0 {
+		return redeliveryPolicy{}
+	}
+	if delay <= 0 {
+		delay = DEFAULT_REDELIVERY_DELAY
+	}
+	return redeliveryPolicy{attempts: min(attempts, MAX_REDELIVERY_ATTEMPTS), delay: delay}
+}
+
+// redelivery is a message that couldn't be sent to a subscriber, waiting to be sent again.
+type redelivery struct {
+	client   *network.Client
+	prepared *websocket.PreparedMessage
+	expires  time.Time
+	priority network.Priority
+	attempt  int       // how many times it has been redelivered
+	due      time.Time // when it's sent again
+}
+
+// redeliveryQueue holds the messages a topic couldn't send to its subscribers until they're sent
+// again. A single goroutine, started by the first message queued, redelivers them in the order
+// they failed through the topic's send limiter, until the queue is stopped. If the queue is full
+// the message isn't queued.
+type redeliveryQueue struct {
+	topic   *Topic
+	policy  redeliveryPolicy
+	size    int
+	mu      sync.Mutex
+	pending []*redelivery // ordered by when they're due, since every message waits the same delay
+	started bool
+	wake    chan struct{}
+	ctx     context.Context // done once the queue is stopped, so a redelivery waiting to send gives up
+	cancel  context.CancelFunc
+}
+
+// newRedeliveryQueue will create a queue that redelivers the topic's messages with the policy,
+// or nil if the policy doesn't redeliver.
+func newRedeliveryQueue(topic *Topic, policy redeliveryPolicy) *redeliveryQueue {
+	if policy.attempts <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &redeliveryQueue{
+		topic:  topic,
+		policy: policy,
+		size:   DEFAULT_REDELIVERY_QUEUE_SIZE,
+		wake:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Add will queue a message the subscriber couldn't be sent to be sent again after the delay.
+// Returns false if it couldn't be queued because the queue is full or stopped.
+func (q *redeliveryQueue) Add(client *network.Client, prepared *websocket.PreparedMessage, expires time.Time, priority network.Priority) bool {
+	return q.push(&redelivery{client: client, prepared: prepared, expires: expires, priority: priority})
+}
+
+// Stop will stop redelivering. Anything still queued is dropped.
+func (q *redeliveryQueue) Stop() {
+	q.cancel()
+	q.mu.Lock()
+	q.pending = nil
+	q.mu.Unlock()
+}
+
+// push will queue the message to be sent once the delay is up.
+func (q *redeliveryQueue) push(r *redelivery) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ctx.Err() != nil || len(q.pending) >= q.size {
+		return false
+	}
+	r.due = time.Now().Add(q.policy.delay)
+	q.pending = append(q.pending, r)
+	if !q.started {
+		q.started = true
+		go q.run()
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (q *redeliveryQueue) run() {
+	for {
+		q.mu.Lock()
+		var next *redelivery
+		if len(q.pending) > 0 {
+			next = q.pending[0]
+		}
+		q.mu.Unlock()
+
+		if next == nil {
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-q.wake:
+			}
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(next.due))
+		select {
+		case <-q.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		q.mu.Lock()
+		if len(q.pending) == 0 || q.pending[0] != next { // dropped when the queue was stopped
+			q.mu.Unlock()
+			continue
+		}
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+		q.redeliver(next)
+	}
+}
+
+// redeliver will send the message to the subscriber again, queueing it for another attempt if
+// that fails. The subscriber is marked failed once every attempt fails, or it can't be queued
+// again. Stops without marking it if the client unsubscribed or the message expired in the
+// meantime. The message can be delivered after values published later.
+func (q *redeliveryQueue) redeliver(r *redelivery) {
+	t := q.topic
+	logger := log.WithFields(log.Fields{"topic": t.NameWithLock(), "client_id": r.client.Id})
+	if !r.expires.IsZero() && !time.Now().Before(r.expires) {
+		logger.Debug("Value expired before it could be redelivered")
+		return
+	}
+
+	r.attempt++
+	t.mu.RLock("redeliver")
+	opts, subscribed := t.subscribers[r.client]
+	var err error
+	if subscribed {
+		// the same order publishing takes them in, the topic's lock then a send slot
+		if err = t.sends.acquire(q.ctx); err != nil {
+			t.mu.RUnlock("redeliver")
+			return
+		}
+		err = t.send(r.client, opts, r.prepared, r.expires, r.priority)
+		if errors.Is(err, network.ErrMessageConflated) { // queued in place of a value that wasn't written
+			err = nil
+		}
+		t.sends.release()
+	}
+	t.mu.RUnlock("redeliver")
+	if !subscribed {
+		return
+	}
+	if err == nil {
+		logger.Debugf("Redelivered to subscriber on attempt %d", r.attempt)
+		return
+	}
+	if r.attempt < q.policy.attempts && q.push(r) {
+		return
+	}
+
+	logger.Warnf("Couldn't redeliver to subscriber after %d attempts: %v", r.attempt, err)
+	if q.ctx.Err() == nil && t.onSendFailed != nil {
+		t.onSendFailed(r.client)
+	}
+}
@@ -0,0 +1,124 @@
+package topic
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failSends will make the first n sends of the topic fail, and return how many sends were tried.
+func failSends(topic *Topic, n int32) *atomic.Int32 {
+	var tries atomic.Int32
+	send := topic.send
+	topic.send = func(client *network.Client, opts SubscriptionOptions, prepared *websocket.PreparedMessage, expires time.Time, priority network.Priority) error {
+		if tries.Add(1) <= n {
+			return errors.New("connection hiccup")
+		}
+		return send(client, opts, prepared, expires, priority)
+	}
+	return &tries
+}
+
+func TestRedelivery_FirstSendFailsThenSucceeds(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("orders", map[string]any{"a": ""}, TopicOptions{RedeliveryAttempts: 3, RedeliveryDelay: 10 * time.Millisecond})
+	require.NoError(t, err)
+	tries := failSends(topic, 1)
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("orders", client, SubscriptionOptions{}))
+	msg := network.WebSocketMessage{MessageId: "important", Action: "publish", Topic: "orders"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "value"}, nil))
+
+	delivered := readMessage(t, remote)
+	assert.Equal(t, "important", delivered.MessageId)
+	assert.JSONEq(t, `{"a":"value"}`, string(delivered.Data))
+	assert.Equal(t, int32(2), tries.Load())
+	assert.Zero(t, drainFailedClients(tm.(*topicManager)), "redelivered subscriber shouldn't be marked failed")
+}
+
+func TestRedelivery_MarksFailedAfterAttempts(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("orders", map[string]any{"a": ""}, TopicOptions{RedeliveryAttempts: 2, RedeliveryDelay: 5 * time.Millisecond})
+	require.NoError(t, err)
+	tries := failSends(topic, 100)
+
+	client, _ := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("orders", client, SubscriptionOptions{}))
+	msg := network.WebSocketMessage{MessageId: "lost", Action: "publish", Topic: "orders"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "value"}, nil))
+
+	require.Eventually(t, func() bool { return tries.Load() == 3 }, time.Second, 5*time.Millisecond)
+	failedClient, _ := tm.NextFailedClient()
+	assert.Equal(t, client, failedClient)
+}
+
+func TestRedelivery_StopsWhenUnsubscribed(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("orders", map[string]any{"a": ""}, TopicOptions{RedeliveryAttempts: 5, RedeliveryDelay: 20 * time.Millisecond})
+	require.NoError(t, err)
+	tries := failSends(topic, 100)
+
+	client, _ := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("orders", client, SubscriptionOptions{}))
+	msg := network.WebSocketMessage{MessageId: "gone", Action: "publish", Topic: "orders"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "value"}, nil))
+	require.NoError(t, tm.Unsubscribe("orders", client))
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, int32(1), tries.Load())
+	assert.Zero(t, drainFailedClients(tm.(*topicManager)))
+}
+
+func TestNewRedeliveryPolicy(t *testing.T) {
+	assert.Equal(t, redeliveryPolicy{}, newRedeliveryPolicy(0, time.Second))
+	assert.Equal(t, redeliveryPolicy{attempts: 2, delay: DEFAULT_REDELIVERY_DELAY}, newRedeliveryPolicy(2, 0))
+	assert.Equal(t, redeliveryPolicy{attempts: MAX_REDELIVERY_ATTEMPTS, delay: time.Second}, newRedeliveryPolicy(50, time.Second))
+}
+
+func TestRedelivery_MarksFailedWhenQueueIsFull(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("orders", map[string]any{"a": ""}, TopicOptions{RedeliveryAttempts: 3, RedeliveryDelay: time.Second})
+	require.NoError(t, err)
+	topic.redeliveries.size = 1
+	failSends(topic, 100)
+
+	client, _ := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("orders", client, SubscriptionOptions{}))
+	publisher := network.NewClient(nil, "publisher")
+	msg := network.WebSocketMessage{MessageId: "first", Action: "publish", Topic: "orders"}
+	require.NoError(t, tm.Publish(context.Background(), msg, publisher, map[string]any{"a": "first"}, nil))
+	assert.Zero(t, drainFailedClients(tm.(*topicManager)), "first value should be queued to redeliver")
+
+	msg.MessageId = "second"
+	require.NoError(t, tm.Publish(context.Background(), msg, publisher, map[string]any{"a": "second"}, nil))
+	failedClient, ok := tm.NextFailedClient()
+	require.True(t, ok)
+	assert.Equal(t, client, failedClient)
+}
+
+func TestRedelivery_StopsWhenTopicUnregistered(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("orders", map[string]any{"a": ""}, TopicOptions{RedeliveryAttempts: 5, RedeliveryDelay: 20 * time.Millisecond})
+	require.NoError(t, err)
+	tries := failSends(topic, 100)
+
+	client, _ := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("orders", client, SubscriptionOptions{}))
+	msg := network.WebSocketMessage{MessageId: "gone", Action: "publish", Topic: "orders"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "value"}, nil))
+	require.NoError(t, tm.UnregisterTopic(context.Background(), "orders"))
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, int32(1), tries.Load())
+	assert.Zero(t, drainFailedClients(tm.(*topicManager)))
+}
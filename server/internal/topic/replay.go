@@ -0,0 +1,141 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// MAX_REPLAY_HISTORY is the most values a topic can keep to replay to subscribers that resume.
+const MAX_REPLAY_HISTORY = 10000
+
+// ErrNoReplayHistory is returned when a client resumes a subscription to a topic that doesn't keep
+// values to replay.
+var ErrNoReplayHistory = errors.New("topic doesn't keep a replay history")
+
+// ReplayResult is what was replayed to a client that resumed a subscription from a sequence number.
+type ReplayResult struct {
+	Replayed  int    // values sent to the client from the history
+	Gap       bool   // values after the sequence number aged out of the history, or the server restarted
+	OldestSeq uint64 // sequence number of the oldest value still in the history, 0 if it's empty
+	LatestSeq uint64 // sequence number of the last value published to the topic
+}
+
+// replayEntry is a value published to a topic, kept to replay to subscribers that resume.
+type replayEntry struct {
+	msg       *network.WebSocketMessage
+	frameType int
+	expires   time.Time
+}
+
+// replayLog is the last values published to a topic, numbered from 1 in the order they were sent
+// to subscribers. Values are only kept in memory, so the numbers start over when the server restarts.
+type replayLog struct {
+	entries []replayEntry // ring of the last values, the oldest at start once it's full
+	start   int
+	latest  uint64 // sequence number of the last value recorded
+}
+
+// newReplayLog will create a log keeping the last size values, or nil if size is 0.
+func newReplayLog(size int) *replayLog {
+	if size <= 0 {
+		return nil
+	}
+	return &replayLog{entries: make([]replayEntry, 0, min(size, MAX_REPLAY_HISTORY))}
+}
+
+// record will give a message the next sequence number and keep it, dropping the oldest value if
+// the log is full.
+func (r *replayLog) record(msg *network.WebSocketMessage, frameType int, expires time.Time) {
+	r.latest++
+	msg.TopicSequence = r.latest
+	entry := replayEntry{msg: msg, frameType: frameType, expires: expires}
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, entry)
+		return
+	}
+	r.entries[r.start] = entry
+	r.start = (r.start + 1) % len(r.entries)
+}
+
+// since will return the values with a sequence number after seq, oldest first, and if some of them
+// aren't kept anymore.
+func (r *replayLog) since(seq uint64) (entries []replayEntry, result ReplayResult) {
+	result.LatestSeq = r.latest
+	if len(r.entries) > 0 {
+		result.OldestSeq = r.latest - uint64(len(r.entries)) + 1
+	}
+	// a sequence number the topic hasn't reached is from before the server restarted
+	result.Gap = seq > r.latest || (result.OldestSeq > 0 && seq+1 < result.OldestSeq)
+	for i := range r.entries {
+		entry := r.entries[(r.start+i)%len(r.entries)]
+		if entry.msg.TopicSequence > seq || seq > r.latest {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, result
+}
+
+// subscribeAndReplay will subscribe the client to the topic and send it the values published after
+// the sequence number while holding the lock, so no value is published in between. ack is called
+// before they're sent, so a response queued to the client from it comes first. Values that expired
+// aren't replayed. Returns if the client wasn't subscribed already.
+func (t *Topic) subscribeAndReplay(client *network.Client, opts SubscriptionOptions, seq uint64, ack func(ReplayResult)) bool {
+	t.mu.Lock("subscribeAndReplay")
+	defer t.mu.Unlock("subscribeAndReplay")
+	_, alreadySubscribed := t.subscribers[client]
+	t.subscribers[client] = opts
+	t.setWindow(client, opts.AckWindow)
+	t.lastActive = time.Now()
+
+	entries, result := t.replay.since(seq)
+	now := time.Now()
+	live := entries[:0]
+	for _, entry := range entries {
+		if entry.expires.IsZero() || now.Before(entry.expires) {
+			live = append(live, entry)
+		}
+	}
+	result.Replayed = len(live)
+	ack(result)
+
+	for _, entry := range live {
+		encoded, err := encodeMessage(client.Unscoped(entry.msg), entry.frameType)
+		if err != nil {
+			log.WithError(err).WithField("topic", t.name).Error("Couldn't encode message to replay")
+			continue
+		}
+		if window, ok := t.windows[client]; ok {
+			err = t.sendWindowed(client, window, entry.frameType, encoded.data, entry.expires)
+		} else {
+			err = t.send(client, opts, encoded.prepared, entry.expires, entry.msg.Priority)
+			if errors.Is(err, network.ErrMessageConflated) { // only the latest replayed value is kept
+				err = nil
+			}
+		}
+		if err != nil { // the client is gone or fell behind, it can resume again from what it got
+			log.WithFields(log.Fields{"topic": t.name, "client_id": client.Id}).Warnf("Couldn't replay values to subscriber: %v", err)
+			break
+		}
+	}
+	return !alreadySubscribed
+}
+
+// SubscribeFrom will subscribe the client to a topic and replay the values published to it after
+// the sequence number, so a client that reconnects gets what it missed before values published
+// after. ack is called with what will be replayed before any value is sent. If values after the
+// sequence number aren't in the topic's history anymore, the ones that are get replayed and the
+// result has a gap. Returns error if the topic doesn't exist, doesn't keep a replay history, or
+// the client can't subscribe.
+func (tm *topicManager) SubscribeFrom(topicName string, client *network.Client, opts SubscriptionOptions, seq uint64, ack func(ReplayResult)) error {
+	return tm.subscribe(topicName, client, func(topic *Topic) (bool, error) {
+		if topic.replay == nil {
+			return false, fmt.Errorf("%w: %s", ErrNoReplayHistory, topicName)
+		}
+		return topic.subscribeAndReplay(client, opts, seq, ack), nil
+	})
+}
@@ -0,0 +1,104 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publishNumbered will send the numbers from first to last to the topic, in order.
+func publishNumbered(t *testing.T, tm TopicManager, topicName string, first int, last int) {
+	publisher := network.NewClient(nil, "publisher")
+	for i := first; i <= last; i++ {
+		msg := network.WebSocketMessage{MessageId: fmt.Sprint(i), Action: "sendWithoutSave", Topic: topicName}
+		require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"n": float64(i)}, nil))
+	}
+}
+
+func TestSubscribeFrom_ReplaysInWindowThenGoesLive(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("stream", map[string]any{"n": 0.0}, TopicOptions{ReplayHistory: 5})
+	require.NoError(t, err)
+	publishNumbered(t, tm, "stream", 1, 3)
+
+	client, remote := newTestClient(t, "reconnected")
+	var result ReplayResult
+	require.NoError(t, tm.SubscribeFrom("stream", client, SubscriptionOptions{}, 1, func(r ReplayResult) { result = r }))
+	assert.Equal(t, ReplayResult{Replayed: 2, OldestSeq: 1, LatestSeq: 3}, result)
+	assert.Equal(t, 1, len(tm.Subscriptions(client)))
+
+	publishNumbered(t, tm, "stream", 4, 4)
+	for _, want := range []uint64{2, 3, 4} {
+		msg := readMessage(t, remote)
+		assert.Equal(t, want, msg.TopicSequence)
+		assert.JSONEq(t, fmt.Sprintf(`{"n":%d}`, want), string(msg.Data))
+	}
+}
+
+func TestSubscribeFrom_AgedOutReportsGap(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("stream", map[string]any{"n": 0.0}, TopicOptions{ReplayHistory: 2})
+	require.NoError(t, err)
+	publishNumbered(t, tm, "stream", 1, 5)
+
+	client, remote := newTestClient(t, "reconnected")
+	var result ReplayResult
+	require.NoError(t, tm.SubscribeFrom("stream", client, SubscriptionOptions{}, 1, func(r ReplayResult) { result = r }))
+	assert.Equal(t, ReplayResult{Replayed: 2, Gap: true, OldestSeq: 4, LatestSeq: 5}, result)
+
+	// what's still kept is replayed, so the client only has to fill in 2 and 3
+	assert.Equal(t, uint64(4), readMessage(t, remote).TopicSequence)
+	assert.Equal(t, uint64(5), readMessage(t, remote).TopicSequence)
+}
+
+func TestReplayLog_Since(t *testing.T) {
+	log := newReplayLog(3)
+	for i := 0; i < 5; i++ {
+		log.record(&network.WebSocketMessage{}, 0, time.Time{})
+	}
+	sequences := func(entries []replayEntry) []uint64 {
+		var seqs []uint64
+		for _, entry := range entries {
+			seqs = append(seqs, entry.msg.TopicSequence)
+		}
+		return seqs
+	}
+
+	tests := map[string]struct {
+		seq     uint64
+		want    []uint64
+		wantGap bool
+	}{
+		"caught up":              {seq: 5},
+		"in window":              {seq: 3, want: []uint64{4, 5}},
+		"just before the oldest": {seq: 2, want: []uint64{3, 4, 5}},
+		"aged out":               {seq: 1, want: []uint64{3, 4, 5}, wantGap: true},
+		"from before a restart":  {seq: 40, want: []uint64{3, 4, 5}, wantGap: true},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			entries, result := log.since(tt.seq)
+			assert.Equal(t, tt.want, sequences(entries))
+			assert.Equal(t, tt.wantGap, result.Gap)
+			assert.Equal(t, uint64(3), result.OldestSeq)
+			assert.Equal(t, uint64(5), result.LatestSeq)
+		})
+	}
+}
+
+func TestSubscribeFrom_TopicWithoutHistory(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "plain")
+	client := network.NewClient(nil, "reconnected")
+
+	err := tm.SubscribeFrom("plain", client, SubscriptionOptions{}, 1, func(ReplayResult) { t.Error("expected no ack") })
+	assert.ErrorIs(t, err, ErrNoReplayHistory)
+	assert.Zero(t, len(tm.Subscriptions(client)))
+}
@@ -0,0 +1,153 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// SeedFile is a set of topics to register when the server starts.
+type SeedFile struct {
+	Topics []SeedTopic `json:"topics"`
+}
+
+// SeedTopic is a topic to register from a seed file, with the same options a client can
+// register a topic with.
+type SeedTopic struct {
+	Name               string `json:"name"`
+	Schema             any    `json:"schema"`
+	ValidationMode     string `json:"validationMode,omitempty"`     // "strict" (default), "warn", or "off"
+	PersistInterval    string `json:"persistInterval,omitempty"`    // Go duration, e.g. "500ms"
+	OverflowPolicy     string `json:"overflowPolicy,omitempty"`     // "dropOldest", "dropNewest", or "disconnect"
+	FillDefaults       bool   `json:"fillDefaults,omitempty"`       // fill fields missing from published values from the schema
+	TickInterval       string `json:"tickInterval,omitempty"`       // Go duration, at least MIN_TICK_INTERVAL
+	MinPublishInterval string `json:"minPublishInterval,omitempty"` // Go duration, e.g. "100ms"
+	CooldownPolicy     string `json:"cooldownPolicy,omitempty"`     // "reject" (default) or "coalesce"
+}
+
+// SeedResult is how many topics were registered by seeding and how many already existed.
+type SeedResult struct {
+	TopicsCreated int
+	TopicsSkipped int
+}
+
+// LoadSeedFile will read and parse the seed file at the path. Returns error if the file can't
+// be read or has fields that aren't part of a seed file.
+func LoadSeedFile(path string) (SeedFile, error) {
+	var seed SeedFile
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return seed, fmt.Errorf("couldn't read seed file: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&seed); err != nil {
+		return seed, fmt.Errorf("couldn't parse seed file %s: %w", path, err)
+	}
+	return seed, nil
+}
+
+// SeedFromFile will load the seed file at the path and register its topics with the topic manager.
+func SeedFromFile(tm TopicManager, path string) (SeedResult, error) {
+	seed, err := LoadSeedFile(path)
+	if err != nil {
+		return SeedResult{}, err
+	}
+	return Seed(tm, seed)
+}
+
+// Seed will register the topics in the seed with the topic manager. Seeding is idempotent, so
+// topics that already exist with the same schema are skipped. All of the topics are checked
+// before anything is registered. Returns error if any are invalid, or a topic already exists
+// with a different schema.
+func Seed(tm TopicManager, seed SeedFile) (SeedResult, error) {
+	var result SeedResult
+
+	options := make([]TopicOptions, 0, len(seed.Topics))
+	seen := make(map[string]bool, len(seed.Topics))
+	for _, seedTopic := range seed.Topics {
+		if strings.TrimSpace(seedTopic.Name) == "" {
+			return result, fmt.Errorf("cannot seed topic with no name")
+		}
+		if seen[seedTopic.Name] {
+			return result, fmt.Errorf("cannot seed topic %s more than once", seedTopic.Name)
+		}
+		seen[seedTopic.Name] = true
+		if seedTopic.Schema == nil {
+			return result, fmt.Errorf("cannot seed topic %s with no schema", seedTopic.Name)
+		}
+
+		mode, err := ParseValidationMode(seedTopic.ValidationMode)
+		if err != nil {
+			return result, fmt.Errorf("cannot seed topic %s: %w", seedTopic.Name, err)
+		}
+		opts := TopicOptions{ValidationMode: mode, FillDefaults: seedTopic.FillDefaults}
+		if seedTopic.PersistInterval != "" {
+			interval, err := time.ParseDuration(seedTopic.PersistInterval)
+			if err != nil || interval < 0 {
+				return result, fmt.Errorf("cannot seed topic %s: invalid persistInterval: %s", seedTopic.Name, seedTopic.PersistInterval)
+			}
+			opts.PersistInterval = interval
+		}
+		if seedTopic.TickInterval != "" {
+			interval, err := time.ParseDuration(seedTopic.TickInterval)
+			if err != nil || interval < MIN_TICK_INTERVAL {
+				return result, fmt.Errorf("cannot seed topic %s: invalid tickInterval: %s. Must be at least %s", seedTopic.Name, seedTopic.TickInterval, MIN_TICK_INTERVAL)
+			}
+			opts.TickInterval = interval
+		}
+		if seedTopic.MinPublishInterval != "" {
+			interval, err := time.ParseDuration(seedTopic.MinPublishInterval)
+			if err != nil || interval < 0 {
+				return result, fmt.Errorf("cannot seed topic %s: invalid minPublishInterval: %s", seedTopic.Name, seedTopic.MinPublishInterval)
+			}
+			opts.MinPublishInterval = interval
+		}
+		if opts.CooldownPolicy, err = ParseCooldownPolicy(seedTopic.CooldownPolicy); err != nil {
+			return result, fmt.Errorf("cannot seed topic %s: %w", seedTopic.Name, err)
+		}
+		if seedTopic.OverflowPolicy != "" {
+			policy, err := network.ParseOverflowPolicy(seedTopic.OverflowPolicy)
+			if err != nil {
+				return result, fmt.Errorf("cannot seed topic %s: %w", seedTopic.Name, err)
+			}
+			opts.OverflowPolicy = policy
+		}
+		options = append(options, opts)
+	}
+
+	topics, err := tm.ListTopics()
+	if err != nil {
+		return result, fmt.Errorf("couldn't list existing topics to seed: %w", err)
+	}
+	existing := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		existing[topic.NameWithLock()] = true
+	}
+
+	for i, seedTopic := range seed.Topics {
+		if existing[seedTopic.Name] {
+			if match, _ := tm.IsSchemaMatch(seedTopic.Name, seedTopic.Schema); !match {
+				return result, fmt.Errorf("cannot seed topic %s, topic already exists with different schema", seedTopic.Name)
+			}
+			result.TopicsSkipped++
+			continue
+		}
+
+		if _, err := tm.RegisterTopic(seedTopic.Name, seedTopic.Schema, options[i]); err != nil {
+			return result, fmt.Errorf("couldn't seed topic %s: %w", seedTopic.Name, err)
+		}
+		result.TopicsCreated++
+	}
+
+	log.WithFields(log.Fields{"method": "Seed", "topics_created": result.TopicsCreated, "topics_skipped": result.TopicsSkipped}).Info("seeded topics")
+	return result, nil
+}
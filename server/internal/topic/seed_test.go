@@ -0,0 +1,104 @@
+package topic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSeedFile will write the contents to a seed file in a temp directory and return its path.
+func writeSeedFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "seed.json")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+const testSeed = `{
+	"topics": [
+		{"name": "sensors", "schema": {"temp": 0, "unit": ""}},
+		{"name": "alerts", "schema": {"level": ""}, "validationMode": "warn", "persistInterval": "500ms", "overflowPolicy": "dropOldest"}
+	]
+}`
+
+func TestSeedFromFile_RegistersTopics(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+
+	result, err := SeedFromFile(tm, writeSeedFile(t, testSeed))
+	require.NoError(t, err)
+	assert.Equal(t, SeedResult{TopicsCreated: 2}, result)
+
+	topics := make(map[string]*Topic)
+	listed, err := tm.ListTopics()
+	require.NoError(t, err)
+	for _, topic := range listed {
+		topics[topic.NameWithLock()] = topic
+	}
+	require.Len(t, topics, 2)
+
+	match, err := tm.IsSchemaMatch("sensors", map[string]any{"temp": 0.0, "unit": ""})
+	require.NoError(t, err)
+	assert.True(t, match)
+	assert.Equal(t, ValidationStrict, topics["sensors"].ValidationMode())
+
+	assert.Equal(t, ValidationWarn, topics["alerts"].ValidationMode())
+	assert.Equal(t, network.OverflowDropOldest, topics["alerts"].overflowPolicy)
+	require.NotNil(t, topics["alerts"].debouncer)
+	t.Cleanup(topics["alerts"].debouncer.Stop)
+	assert.Equal(t, 500*time.Millisecond, topics["alerts"].debouncer.interval)
+}
+
+func TestSeedFromFile_Idempotent(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	path := writeSeedFile(t, testSeed)
+
+	_, err := SeedFromFile(tm, path)
+	require.NoError(t, err)
+	result, err := SeedFromFile(tm, path)
+	require.NoError(t, err)
+	assert.Equal(t, SeedResult{TopicsSkipped: 2}, result)
+
+	for _, definition := range tm.ExportSchemas() {
+		assert.Len(t, definition.Schemas, 1, "seeding again shouldn't add schema versions to %s", definition.Name)
+	}
+}
+
+func TestSeedFromFile_ExistingTopicWithDifferentSchema(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("sensors", map[string]any{"humidity": 0}, TopicOptions{})
+	require.NoError(t, err)
+
+	_, err = SeedFromFile(tm, writeSeedFile(t, testSeed))
+	assert.Error(t, err)
+}
+
+func TestSeedFromFile_InvalidSeedRegistersNothing(t *testing.T) {
+	for name, contents := range map[string]string{
+		"unknown field":   `{"topics": [{"name": "sensors", "schema": {}, "scheme": {}}]}`,
+		"no schema":       `{"topics": [{"name": "sensors"}]}`,
+		"duplicate":       `{"topics": [{"name": "sensors", "schema": {}}, {"name": "sensors", "schema": {}}]}`,
+		"bad mode":        `{"topics": [{"name": "sensors", "schema": {}}, {"name": "alerts", "schema": {}, "validationMode": "loose"}]}`,
+		"bad policy":      `{"topics": [{"name": "sensors", "schema": {}}, {"name": "alerts", "schema": {}, "overflowPolicy": "dropAll"}]}`,
+		"bad interval":    `{"topics": [{"name": "sensors", "schema": {}}, {"name": "alerts", "schema": {}, "persistInterval": "soon"}]}`,
+		"not a seed file": `[]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+			_, err := SeedFromFile(tm, writeSeedFile(t, contents))
+			assert.Error(t, err)
+			assert.Empty(t, tm.ExportSchemas())
+		})
+	}
+}
+
+func TestSeedFromFile_MissingFile(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := SeedFromFile(tm, filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
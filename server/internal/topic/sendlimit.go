@@ -0,0 +1,52 @@
+package topic
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// sendLimiter bounds how many sends to subscribers can run at once across all the topics that
+// share it, so many topics publishing at the same time can't swamp the server. A nil limiter
+// doesn't limit anything.
+type sendLimiter struct {
+	slots  chan struct{}
+	active atomic.Int64
+	peak   atomic.Int64 // most sends that were running at once
+}
+
+// newSendLimiter will create a limiter that lets up to limit sends run at once, or nil if the
+// limit is 0 so sends aren't limited.
+func newSendLimiter(limit int) *sendLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &sendLimiter{slots: make(chan struct{}, limit)}
+}
+
+// acquire will wait until a send can run. Returns the context's error if it's done first.
+func (l *sendLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	active := l.active.Add(1)
+	for {
+		peak := l.peak.Load()
+		if active <= peak || l.peak.CompareAndSwap(peak, active) {
+			return nil
+		}
+	}
+}
+
+// release will let another send run. Must be called once for every acquire that succeeded.
+func (l *sendLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.active.Add(-1)
+	<-l.slots
+}
@@ -0,0 +1,101 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendLimiter_NeverExceedsLimitAcrossTopics(t *testing.T) {
+	const limit, topicCount, publishes = 3, 8, 20
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxConcurrentSends: limit})
+	clients := newFanOutClients(t, fanOutSubscribers)
+	for i := 0; i < topicCount; i++ {
+		name := fmt.Sprintf("topic-%d", i)
+		registerTopics(t, tm, name)
+		for _, client := range clients[i*len(clients)/topicCount : (i+1)*len(clients)/topicCount] {
+			require.NoError(t, tm.Subscribe(name, client, SubscriptionOptions{}))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < topicCount; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			sender := network.NewClient(nil, "publisher-"+name)
+			for n := 0; n < publishes; n++ {
+				msg := network.WebSocketMessage{MessageId: fmt.Sprintf("%s-%d", name, n), Action: "sendWithoutSave", Topic: name}
+				assert.NoError(t, tm.SendWithoutSave(context.Background(), msg, sender, map[string]any{"a": "value"}, nil))
+			}
+		}(fmt.Sprintf("topic-%d", i))
+	}
+	wg.Wait()
+
+	sends := tm.(*topicManager).sends
+	assert.LessOrEqual(t, sends.peak.Load(), int64(limit))
+	assert.Positive(t, sends.peak.Load())
+	assert.Zero(t, sends.active.Load())
+}
+
+func TestSendLimiter_CancelledWhileWaiting(t *testing.T) {
+	sends := newSendLimiter(1)
+	require.NoError(t, sends.acquire(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, sends.acquire(ctx), context.Canceled)
+
+	sends.release()
+	assert.NoError(t, sends.acquire(context.Background()))
+}
+
+func TestSendLimiter_ZeroIsUnlimited(t *testing.T) {
+	sends := newSendLimiter(0)
+	assert.Nil(t, sends)
+	assert.NoError(t, sends.acquire(context.Background()))
+	sends.release()
+}
+
+func BenchmarkFanOut_ManyTopicsLimited(b *testing.B) {
+	for _, limit := range []int{0, 4} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxConcurrentSends: limit})
+			clients := newFanOutClients(b, fanOutSubscribers)
+			names := make([]string, 0, 10)
+			for i := 0; i < 10; i++ {
+				name := fmt.Sprintf("topic-%d", i)
+				if _, err := tm.RegisterTopic(name, map[string]any{"a": ""}, TopicOptions{}); err != nil {
+					b.Fatal(err)
+				}
+				for _, client := range clients[i*len(clients)/10 : (i+1)*len(clients)/10] {
+					if err := tm.Subscribe(name, client, SubscriptionOptions{}); err != nil {
+						b.Fatal(err)
+					}
+				}
+				names = append(names, name)
+			}
+			sender := network.NewClient(nil, "publisher")
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				n := 0
+				for pb.Next() {
+					name := names[n%len(names)]
+					n++
+					msg := network.WebSocketMessage{MessageId: "bench", Action: "sendWithoutSave", Topic: name}
+					if err := tm.SendWithoutSave(context.Background(), msg, sender, map[string]any{"a": "value"}, nil); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+)
+
+// SubscribeAndGet will subscribe the client to a topic and get the topic's current value with its
+// metadata in one step, so no value published in between is missed or sent twice. The value is
+// read and the client subscribed while holding the topic's write lock, so every publish to the
+// topic is either in the value or sent to the client after. snapshot is called with the value
+// before the lock is released, so a response queued to the client from it is sent ahead of any
+// value published after. Returns error if the topic doesn't exist, the value can't be read, or the
+// client can't subscribe, and the client isn't subscribed.
+func (tm *topicManager) SubscribeAndGet(ctx context.Context, topicName string, client *network.Client, opts SubscriptionOptions, snapshot func(ValueMeta)) (err error) {
+	ctx, span := startSpan(ctx, "TopicManager.SubscribeAndGet", topicName)
+	defer func() { endSpan(span, err) }()
+
+	tm.mu.RLock("SubscribeAndGet")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("SubscribeAndGet")
+
+	if !ok {
+		return fmt.Errorf("topic doesn't exist for %s", topicName)
+	}
+
+	unlock := lockWrites(topic)
+	defer unlock()
+
+	current, err := tm.currentMeta(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("couldn't read current value of topic %s: %w", topicName, err)
+	}
+	if err := tm.Subscribe(topicName, client, opts); err != nil {
+		return err
+	}
+	snapshot(current)
+	return nil
+}
@@ -0,0 +1,91 @@
+package topic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+)
+
+func TestSubscribeAndGet_ExactlyOnceAcrossConcurrentPublishes(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("counter", map[string]any{"count": 0}, TopicOptions{})
+	require.NoError(t, err)
+	publisher := network.NewClient(nil, "publisher")
+
+	const total = 200
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range total {
+			if i == total/4 {
+				close(started)
+			}
+			msg := network.WebSocketMessage{MessageId: fmt.Sprint(i), Action: "publish", Topic: "counter"}
+			assert.NoError(t, tm.Publish(context.Background(), msg, publisher, map[string]any{"count": float64(i)}, nil))
+		}
+	}()
+
+	// subscribe while values are being published
+	<-started
+	subscriber, remote := newTestClient(t, "subscriber")
+	var snapshot ValueMeta
+	require.NoError(t, tm.SubscribeAndGet(context.Background(), "counter", subscriber, SubscriptionOptions{}, func(current ValueMeta) {
+		snapshot = current
+	}))
+	wg.Wait()
+
+	require.NotNil(t, snapshot.Value)
+	count := int(snapshot.Value.(map[string]any)["count"].(float64))
+
+	// every value after the snapshot is sent once and in order, and none from before it
+	for want := count + 1; want < total; want++ {
+		var value map[string]float64
+		require.NoError(t, json.Unmarshal(readMessage(t, remote).Data, &value))
+		require.Equal(t, float64(want), value["count"])
+	}
+}
+
+func TestSubscribeAndGet_NoValue(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "empty")
+	client := network.NewClient(nil, "client")
+
+	called := false
+	require.NoError(t, tm.SubscribeAndGet(context.Background(), "empty", client, SubscriptionOptions{}, func(current ValueMeta) {
+		called = true
+		assert.Nil(t, current.Value)
+	}))
+	assert.True(t, called)
+	assert.Contains(t, tm.Subscriptions(client), "empty")
+}
+
+func TestSubscribeAndGet_MissingTopic(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	err := tm.SubscribeAndGet(context.Background(), "missing", network.NewClient(nil, "client"), SubscriptionOptions{}, func(ValueMeta) {
+		t.Error("expected no snapshot for a topic that doesn't exist")
+	})
+	assert.Error(t, err)
+}
+
+func TestSubscribeAndGet_SubscriptionLimit(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxSubscriptionsPerClient: 1})
+	registerTopics(t, tm, "one", "two")
+	client := network.NewClient(nil, "client")
+	require.NoError(t, tm.Subscribe("one", client, SubscriptionOptions{}))
+
+	err := tm.SubscribeAndGet(context.Background(), "two", client, SubscriptionOptions{}, func(ValueMeta) {
+		t.Error("expected no snapshot when the client can't subscribe")
+	})
+	assert.ErrorIs(t, err, ErrSubscriptionLimit)
+}
@@ -0,0 +1,59 @@
+package topic
+
+import (
+	"sync"
+	"time"
+)
+
+// topicTicker calls tick once per interval while nothing is published to a topic. Every
+// publish pushes the next tick back a full interval, so ticks only happen on an idle topic.
+type topicTicker struct {
+	mu       sync.Mutex
+	interval time.Duration
+	timer    *time.Timer
+	stopped  bool
+	tick     func()
+}
+
+// newTopicTicker will create a ticker that calls tick after every interval without a publish.
+func newTopicTicker(interval time.Duration, tick func()) *topicTicker {
+	t := &topicTicker{
+		interval: interval,
+		tick:     tick,
+	}
+	t.mu.Lock() // the timer can fire before it is assigned
+	t.timer = time.AfterFunc(interval, t.fire)
+	t.mu.Unlock()
+	return t
+}
+
+// Reset will push the next tick back a full interval. Called whenever a value is sent to the topic.
+func (t *topicTicker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	t.timer.Reset(t.interval)
+}
+
+// fire will schedule the next tick and then call tick.
+func (t *topicTicker) fire() {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.timer.Reset(t.interval)
+	t.mu.Unlock()
+
+	t.tick()
+}
+
+// Stop will stop the ticker. No ticks happen after Stop returns, other than one that already started.
+func (t *topicTicker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	t.timer.Stop()
+}
@@ -0,0 +1,95 @@
+package topic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveMessages will read messages from the remote end of a client's connection in the
+// background until the connection is closed.
+func receiveMessages(remote *websocket.Conn) <-chan network.WebSocketMessage {
+	received := make(chan network.WebSocketMessage, 100)
+	go func() {
+		defer close(received)
+		for {
+			var msg network.WebSocketMessage
+			if err := remote.ReadJSON(&msg); err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	return received
+}
+
+// newTickingTopic will register a topic that ticks at the interval and subscribe a client to it.
+func newTickingTopic(t *testing.T, tm TopicManager, interval time.Duration) <-chan network.WebSocketMessage {
+	_, err := tm.RegisterTopic("heartbeat", map[string]any{"a": ""}, TopicOptions{TickInterval: interval})
+	require.NoError(t, err)
+	t.Cleanup(func() { tm.UnregisterTopic(context.Background(), "heartbeat") })
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("heartbeat", client, SubscriptionOptions{}))
+	return receiveMessages(remote)
+}
+
+func TestTick_IdleTopicGetsTicks(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	received := newTickingTopic(t, tm, MIN_TICK_INTERVAL)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			assert.Equal(t, "tick", msg.Action)
+			assert.Equal(t, "heartbeat", msg.Topic)
+			assert.NotNil(t, msg.Timestamp)
+			assert.Empty(t, msg.Data)
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected a tick on an idle topic")
+		}
+	}
+}
+
+func TestTick_SuppressedWhileDataFlows(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	interval := 200 * time.Millisecond
+	received := newTickingTopic(t, tm, interval)
+
+	sender := network.NewClient(nil, "publisher")
+	for i := 0; i < 12; i++ { // a publish every quarter of the interval
+		msg := network.WebSocketMessage{MessageId: "data", Action: "publish", Topic: "heartbeat"}
+		require.NoError(t, tm.Publish(context.Background(), msg, sender, map[string]any{"a": "1"}, nil))
+		time.Sleep(interval / 4)
+	}
+	for len(received) > 0 {
+		assert.Equal(t, "publish", (<-received).Action, "expected no ticks while data is flowing")
+	}
+
+	// once the data stops, the ticks start again
+	select {
+	case msg := <-received:
+		assert.Equal(t, "tick", msg.Action)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a tick once the topic went idle")
+	}
+}
+
+func TestTick_StopsWhenUnregistered(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	received := newTickingTopic(t, tm, MIN_TICK_INTERVAL)
+	require.NoError(t, tm.UnregisterTopic(context.Background(), "heartbeat"))
+
+	select {
+	case msg := <-received:
+		t.Fatalf("expected no ticks after the topic was unregistered, got %s", msg.Action)
+	case <-time.After(3 * MIN_TICK_INTERVAL):
+	}
+}
@@ -1,7 +1,16 @@
 package topic
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/atyalexyoung/data-loom/server/internal/logging"
 	"github.com/atyalexyoung/data-loom/server/internal/network"
@@ -16,39 +25,254 @@ import (
 // what the actual data looks like. The name is how the topic is referenced, and
 // the subscribers are the ones that care about this topic.
 type Topic struct {
-	name         string
-	mu           logging.DebugRWMutex
-	subscribers  map[*network.Client]bool
-	schemas      map[int]*TopicSchema
-	latestSchema int
+	name           string
+	seq            uint64 // unique to the topic and never changes, unlike its name, so write locks are taken in its order
+	mu             logging.DebugRWMutex
+	writeMu        sync.Mutex // held while publishing a stored value, so a conditional publish's compare and write aren't interleaved with another
+	subscribers    map[*network.Client]SubscriptionOptions
+	paused         map[*network.Client]*pausedSubscription // subscribers that aren't sent values until they resume
+	windows        map[*network.Client]*ackWindow          // subscribers that ack the values they're sent
+	schemas        map[int]*TopicSchema
+	latestSchema   int
+	maxSchemas     int // how many schema versions are kept, 0 keeps every version
+	validationMode ValidationMode
+	overflowPolicy network.OverflowPolicy
+	fillDefaults   bool
+	binary         bool                  // takes raw binary payloads instead of json, never changes
+	format         PayloadFormat         // how published payloads are encoded, never changes
+	compressed     bool                  // payloads are gzipped at rest and to subscribers, never changes
+	maxPayloadSize int                   // most bytes a published payload can be, 0 uses the server's limit, never changes
+	aggregator     *aggregator           // running aggregates that are stored instead of published values, nil for other topics
+	debouncer      *persistDebouncer     // nil unless persistence is debounced for the topic
+	webhook        *webhookSink          // nil unless publishes are mirrored to a webhook
+	ticker         *topicTicker          // nil unless subscribers get ticks while the topic is idle
+	cooldown       *publishCooldown      // nil unless the topic has a min publish interval
+	sends          *sendLimiter          // shared by every topic of the manager, nil if sends aren't limited
+	redelivery     redeliveryPolicy      // how sends that fail are retried, zero doesn't retry them
+	redeliveries   *redeliveryQueue      // sends waiting to be retried, nil if they aren't retried
+	send           sendFunc              // sends a prepared message to a subscriber, replaced in tests
+	onSendFailed   func(*network.Client) // called when redelivering to a subscriber failed, nil does nothing
+	replay         *replayLog            // nil unless values are kept to replay to subscribers that resume
+	hasValue       bool                  // if a value has been stored for the topic
+	lastUpdated    time.Time             // when the stored value was last updated, zero if unknown
+	updatedSchema  int                   // the latest schema version when the stored value was last updated
+	updatedHeaders map[string]string     // the headers the stored value was published with
+	lastPublished  time.Time             // when a value was last sent to subscribers, zero if never
+	lastActive     time.Time             // when the topic was registered, published to, or subscribed or unsubscribed from
+	cachedValue    any                   // the last value published to be stored, so get doesn't need storage
+	cacheExpires   time.Time             // when the cached value expires, zero if it doesn't
+	hasCache       bool                  // if there is a cached value, since nil can be a value
+}
+
+// topicSeq is the seq of the last topic created.
+var topicSeq atomic.Uint64
+
+// TopicStats is a snapshot of the state of a topic for observability.
+type TopicStats struct {
+	Name            string
+	SchemaVersion   int
+	ValidationMode  ValidationMode
+	SubscriberCount int
+	HasValue        bool
+	LastUpdated     *time.Time // nil if unknown
+	LastPublished   *time.Time // nil if nothing has been published since the server started
+}
+
+const (
+	// MIN_TICK_INTERVAL is the shortest interval a topic can send ticks to its subscribers at.
+	MIN_TICK_INTERVAL = 100 * time.Millisecond
+)
+
+// ValidationMode defines how strictly published payloads are checked against
+// the schema of a topic.
+type ValidationMode string
+
+const (
+	// ValidationStrict rejects any payload that doesn't match the schema.
+	ValidationStrict ValidationMode = "strict"
+	// ValidationWarn accepts mismatched payloads but reports the mismatches as warnings.
+	ValidationWarn ValidationMode = "warn"
+	// ValidationOff skips schema validation entirely.
+	ValidationOff ValidationMode = "off"
+)
+
+// ParseValidationMode converts a string into a ValidationMode. A blank string
+// defaults to strict validation. Returns error if the mode is unknown.
+func ParseValidationMode(mode string) (ValidationMode, error) {
+	switch ValidationMode(mode) {
+	case "":
+		return ValidationStrict, nil
+	case ValidationStrict, ValidationWarn, ValidationOff:
+		return ValidationMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown validation mode: %s", mode)
+	}
+}
+
+// SubscriptionOptions are the settings for a single client's subscription to a topic.
+type SubscriptionOptions struct {
+	// Conflate will replace an undelivered value for the topic with the newest one
+	// instead of queueing behind it, so a slow subscriber only gets the latest value.
+	Conflate bool
+	// NoEcho will skip delivering messages that the subscriber published itself.
+	NoEcho bool
+	// AckWindow will send values with a sequence number and only send this many without the
+	// subscriber acking them, holding the rest until it acks, when greater than zero.
+	AckWindow int
+}
+
+// TopicOptions are the settings for a topic that are set when it is registered.
+type TopicOptions struct {
+	ValidationMode ValidationMode
+
+	// PersistInterval will coalesce updates to the topic and only persist the latest value
+	// once per interval when greater than zero. Delivery to subscribers is still immediate.
+	PersistInterval time.Duration
+
+	// WebhookURL will have every value published to the topic posted to the url when set.
+	WebhookURL string
+
+	// OverflowPolicy is what happens to a value for the topic when a subscriber's outbound
+	// queue is full. Blank uses the subscriber's policy, which is set from the server config.
+	OverflowPolicy network.OverflowPolicy
+
+	// FillDefaults will fill fields that are missing from published values with the value
+	// the field has in the latest schema, before the value is validated, persisted, and delivered.
+	FillDefaults bool
+
+	// TickInterval will send subscribers a "tick" message with the topic name and time once per
+	// interval when nothing was sent to the topic during it, when greater than zero.
+	TickInterval time.Duration
+
+	// Binary topics take raw binary payloads instead of json. The schema isn't used to validate
+	// them, and they're sent to subscribers as binary frames. It's the same as the raw Format.
+	Binary bool
+
+	// Format is how values published to the topic are encoded. Blank is raw for binary topics and
+	// json for the rest.
+	Format PayloadFormat
+
+	// Compressed topics gzip published values when they're stored and sent to subscribers, for
+	// topics with large values where the bandwidth is worth the cpu.
+	Compressed bool
+
+	// MaxPayloadSize is the most bytes a value published to the topic can be, as json or raw
+	// binary. 0 uses the server's max payload size.
+	MaxPayloadSize int
+
+	// Aggregate is the numeric fields of published values to keep running aggregates of. When set,
+	// the aggregates are what is stored and what get returns, and subscribers still get the
+	// published values.
+	Aggregate []string
+
+	// MinPublishInterval is the least time between values published to the topic when greater
+	// than zero. CooldownPolicy is what happens to values published sooner than that.
+	MinPublishInterval time.Duration
+	CooldownPolicy     CooldownPolicy
+
+	// RedeliveryAttempts is how many more times a value is sent to a subscriber it couldn't be
+	// sent to, RedeliveryDelay apart, before the subscriber is marked failed. 0 doesn't redeliver.
+	RedeliveryAttempts int
+	RedeliveryDelay    time.Duration
+
+	// ReplayHistory is how many of the last values sent to subscribers are kept in memory, with
+	// sequence numbers, to replay to subscribers that resume from one. 0 doesn't keep any.
+	ReplayHistory int
 }
 
 // TopicSchema defines the data that is held to define a schema for a topic
 // version number is the current version for the schema and the Schema is
-// the json structure of the schema.
+// the json structure of the schema. The Hash is a SHA-256 of the canonical
+// json of the schema so identical schemas can be detected cheaply.
 type TopicSchema struct {
 	Version int
-	Schema  map[string]any
+	Schema  any
+	Hash    string
+}
+
+// newTopicSchema will create a schema of the given version and compute its hash.
+func newTopicSchema(version int, schema any) *TopicSchema {
+	return &TopicSchema{
+		Version: version,
+		Schema:  schema,
+		Hash:    SchemaHash(schema),
+	}
+}
+
+// SchemaHash returns the hex encoded SHA-256 of the canonical json of a schema.
+// encoding/json sorts map keys, so the same schema always gives the same hash.
+func SchemaHash(schema any) string {
+	raw, err := json.Marshal(schema)
+	if err != nil { // shouldn't happen for schemas parsed from json, but don't match anything if it does.
+		log.WithField("method", "SchemaHash").Errorf("could not marshal schema to hash: %v", err)
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
 }
 
 // NewTopic will intialize and return a ready to use Topic struct.
-func NewTopic(name string, schema map[string]any) *Topic {
+func NewTopic(name string, schema any, opts TopicOptions) *Topic {
+	if opts.ValidationMode == "" {
+		opts.ValidationMode = ValidationStrict
+	}
+	format := opts.Format
+	if format == "" {
+		format = FormatJSON
+		if opts.Binary {
+			format = FormatRaw
+		}
+	}
+
 	topic := &Topic{
-		name:        name,
-		schemas:     make(map[int]*TopicSchema),
-		subscribers: make(map[*network.Client]bool),
-		mu:          *logging.NewDebugRWMutex("Topic: " + name),
+		name:           name,
+		seq:            topicSeq.Add(1),
+		schemas:        make(map[int]*TopicSchema),
+		subscribers:    make(map[*network.Client]SubscriptionOptions),
+		paused:         make(map[*network.Client]*pausedSubscription),
+		windows:        make(map[*network.Client]*ackWindow),
+		mu:             *logging.NewDebugRWMutex("Topic: " + name),
+		validationMode: opts.ValidationMode,
+		overflowPolicy: opts.OverflowPolicy,
+		fillDefaults:   opts.FillDefaults,
+		binary:         format.IsBinary(),
+		format:         format,
+		compressed:     opts.Compressed,
+		maxPayloadSize: opts.MaxPayloadSize,
+		aggregator:     newAggregator(opts.Aggregate),
+		redelivery:     newRedeliveryPolicy(opts.RedeliveryAttempts, opts.RedeliveryDelay),
+		replay:         newReplayLog(opts.ReplayHistory),
+		lastActive:     time.Now(),
 		// LatestSchema default to 0
 	}
 
-	topic.schemas[0] = &TopicSchema{ // create new schema and add it to map
-		Version: 0,
-		Schema:  schema,
-	}
+	topic.send = topic.sendPrepared
+	topic.redeliveries = newRedeliveryQueue(topic, topic.redelivery)
+	topic.schemas[0] = newTopicSchema(0, schema) // create new schema and add it to map
 
 	return topic
 }
 
+// stop will stop everything running in the background for the topic, so nothing is persisted,
+// mirrored, or sent for it anymore.
+func (t *Topic) stop() {
+	if t.debouncer != nil { // don't write back a value for a topic that is gone
+		t.debouncer.Stop()
+	}
+	if t.webhook != nil {
+		t.webhook.Stop()
+	}
+	if t.ticker != nil {
+		t.ticker.Stop()
+	}
+	if t.cooldown != nil { // don't publish a held back value to a topic that is gone
+		t.cooldown.Stop()
+	}
+	if t.redeliveries != nil {
+		t.redeliveries.Stop()
+	}
+}
+
 // LatestSchemaVersion will return the integer of the latest topic version.
 func (t *Topic) LatestSchemaVersion() int {
 	t.mu.RLock("LatestSchemaVersion")
@@ -56,6 +280,152 @@ func (t *Topic) LatestSchemaVersion() int {
 	return t.latestSchema
 }
 
+// ValidationMode will return how published payloads are validated for the topic.
+func (t *Topic) ValidationMode() ValidationMode {
+	t.mu.RLock("ValidationMode")
+	defer t.mu.RUnlock("ValidationMode")
+	return t.validationMode
+}
+
+// IsBinary will return true if the topic takes raw binary payloads instead of json.
+func (t *Topic) IsBinary() bool {
+	return t.binary
+}
+
+// Format will return how values published to the topic are encoded.
+func (t *Topic) Format() PayloadFormat {
+	return t.format
+}
+
+// IsCompressed will return true if published values are gzipped when stored and sent to subscribers.
+func (t *Topic) IsCompressed() bool {
+	return t.compressed
+}
+
+// MaxPayloadSize will return the most bytes a value published to the topic can be, or 0 if the
+// topic uses the server's limit.
+func (t *Topic) MaxPayloadSize() int {
+	return t.maxPayloadSize
+}
+
+// AggregateFields will return the numeric fields the topic keeps running aggregates of, or nil if
+// it isn't an aggregate topic.
+func (t *Topic) AggregateFields() []string {
+	if t.aggregator == nil {
+		return nil
+	}
+	return t.aggregator.fields
+}
+
+// checkPayloadKind will return error if the payload is binary and the topic takes json, or the
+// other way around, or it isn't well formed msgpack for a msgpack topic.
+func (t *Topic) checkPayloadKind(payload any) error {
+	raw, isBinary := payload.([]byte)
+	if isBinary && !t.binary {
+		return fmt.Errorf("topic %s takes json payloads, not binary", t.name)
+	}
+	if !isBinary && t.binary {
+		return fmt.Errorf("topic %s only takes binary payloads", t.name)
+	}
+	if t.format == FormatMsgpack {
+		if err := checkMsgpack(raw); err != nil {
+			return fmt.Errorf("topic %s only takes msgpack payloads: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+// LastUpdated will return if the topic has a stored value, and when it was last updated. The
+// time is nil if the topic has no value or the value was stored before the server started.
+func (t *Topic) LastUpdated() (bool, *time.Time) {
+	t.mu.RLock("LastUpdated")
+	defer t.mu.RUnlock("LastUpdated")
+	if t.lastUpdated.IsZero() {
+		return t.hasValue, nil
+	}
+	lastUpdated := t.lastUpdated
+	return t.hasValue, &lastUpdated
+}
+
+// Stats will return a snapshot of the state of the topic, taken under a single read lock.
+func (t *Topic) Stats() TopicStats {
+	t.mu.RLock("Stats")
+	defer t.mu.RUnlock("Stats")
+
+	stats := TopicStats{
+		Name:            t.name,
+		SchemaVersion:   t.latestSchema,
+		ValidationMode:  t.validationMode,
+		SubscriberCount: len(t.subscribers),
+		HasValue:        t.hasValue,
+	}
+	if !t.lastUpdated.IsZero() {
+		lastUpdated := t.lastUpdated
+		stats.LastUpdated = &lastUpdated
+	}
+	if !t.lastPublished.IsZero() {
+		lastPublished := t.lastPublished
+		stats.LastPublished = &lastPublished
+	}
+	return stats
+}
+
+// markPublished will record that a value was sent to the subscribers of the topic at the timestamp.
+func (t *Topic) markPublished(timestamp time.Time) {
+	t.mu.Lock("markPublished")
+	defer t.mu.Unlock("markPublished")
+	if timestamp.After(t.lastPublished) {
+		t.lastPublished = timestamp
+	}
+	if timestamp.After(t.lastActive) {
+		t.lastActive = timestamp
+	}
+}
+
+// markUpdated will record that a value was stored for the topic at the timestamp.
+func (t *Topic) markUpdated(timestamp time.Time, headers map[string]string) {
+	t.mu.Lock("markUpdated")
+	defer t.mu.Unlock("markUpdated")
+	t.hasValue = true
+	if timestamp.After(t.lastUpdated) {
+		t.lastUpdated = timestamp
+		t.updatedSchema = t.latestSchema
+		t.updatedHeaders = headers
+	}
+}
+
+// cacheValue will set the value that get returns for the topic without reading storage.
+func (t *Topic) cacheValue(value any, expiresAt time.Time) {
+	t.mu.Lock("cacheValue")
+	defer t.mu.Unlock("cacheValue")
+	t.cachedValue = value
+	t.cacheExpires = expiresAt
+	t.hasCache = true
+}
+
+// cached will return the cached value for the topic, and false if there isn't one. An expired
+// value is cached as nil, the same as storage returns for it.
+func (t *Topic) cached(now time.Time) (any, bool) {
+	t.mu.RLock("cached")
+	defer t.mu.RUnlock("cached")
+	if !t.hasCache {
+		return nil, false
+	}
+	if !t.cacheExpires.IsZero() && !now.Before(t.cacheExpires) {
+		return nil, true
+	}
+	return t.cachedValue, true
+}
+
+// invalidateCache will drop the cached value so get reads it from storage.
+func (t *Topic) invalidateCache() {
+	t.mu.Lock("invalidateCache")
+	defer t.mu.Unlock("invalidateCache")
+	t.cachedValue = nil
+	t.cacheExpires = time.Time{}
+	t.hasCache = false
+}
+
 // NameWithLock will return the name of the topic.
 func (t *Topic) NameWithLock() string {
 	t.mu.RLock("Name")
@@ -63,6 +433,52 @@ func (t *Topic) NameWithLock() string {
 	return t.name
 }
 
+// rename will change the name of the topic.
+func (t *Topic) rename(newName string) {
+	t.mu.Lock("rename")
+	defer t.mu.Unlock("rename")
+	t.name = newName
+}
+
+// Notify will send a message to every subscriber of the topic without conflating it,
+// and returns the clients that failed to be sent to.
+func (t *Topic) Notify(msg *network.WebSocketMessage) []*network.Client {
+	return t.NotifyExcept(msg, nil)
+}
+
+// NotifyExcept will send a message to every subscriber of the topic other than the excluded
+// client without conflating it, and returns the clients that failed to be sent to.
+func (t *Topic) NotifyExcept(msg *network.WebSocketMessage, excluded *network.Client) []*network.Client {
+	return t.notifyEach(func(client *network.Client) *network.WebSocketMessage {
+		if client == excluded {
+			return nil
+		}
+		return client.Unscoped(msg)
+	})
+}
+
+// notifyEach will send every subscriber of the topic the message build returns for it without
+// conflating it, or nothing if it returns nil, and returns the clients that failed to be sent to.
+func (t *Topic) notifyEach(build func(client *network.Client) *network.WebSocketMessage) []*network.Client {
+	t.mu.RLock("Notify")
+	defer t.mu.RUnlock("Notify")
+
+	failedClients := make([]*network.Client, 0)
+	for client := range t.subscribers {
+		msg := build(client)
+		if msg == nil {
+			continue
+		}
+		if err := client.SendJSON(msg); err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				failedClients = append(failedClients, client)
+			}
+			log.Println("Error when writing json to client: ", client.Id)
+		}
+	}
+	return failedClients
+}
+
 // Unsubscribe will remove the client to the map of subscribers
 func (t *Topic) Unsubscribe(client *network.Client) error {
 	t.mu.Lock("Unsubscribe")
@@ -72,14 +488,22 @@ func (t *Topic) Unsubscribe(client *network.Client) error {
 		return fmt.Errorf("cannot unsubscribe client from topic. client is not subscribed to topic. topic: %s, client: %s", t.name, client.Id)
 	}
 	delete(t.subscribers, client)
+	delete(t.paused, client)
+	delete(t.windows, client)
+	t.lastActive = time.Now()
 	return nil
 }
 
-// Subscribe will add the client to the map of subscribers
-func (t *Topic) Subscribe(client *network.Client) {
+// Subscribe will add the client to the map of subscribers with the options for the subscription.
+// Returns true if the client wasn't already subscribed.
+func (t *Topic) Subscribe(client *network.Client, opts SubscriptionOptions) bool {
 	t.mu.Lock("Subscribe")
 	defer t.mu.Unlock("Subscribe")
-	t.subscribers[client] = true
+	_, alreadySubscribed := t.subscribers[client]
+	t.subscribers[client] = opts
+	t.setWindow(client, opts.AckWindow)
+	t.lastActive = time.Now()
+	return !alreadySubscribed
 }
 
 // IsClientSubscribed returns a bool if the client is in the map of subscribers.
@@ -90,6 +514,15 @@ func (t *Topic) IsClientSubscribed(client *network.Client) bool {
 	return ok
 }
 
+// Subscription will return the options of the client's subscription to the topic, and false if
+// the client isn't subscribed.
+func (t *Topic) Subscription(client *network.Client) (SubscriptionOptions, bool) {
+	t.mu.RLock("Subscription")
+	defer t.mu.RUnlock("Subscription")
+	opts, ok := t.subscribers[client]
+	return opts, ok
+}
+
 // ListSubscribers will get a list of network.Client type of all subscribers for the given topic
 func (t *Topic) ListSubscribers() []*network.Client {
 	t.mu.RLock("ListSubscribers")
@@ -103,7 +536,7 @@ func (t *Topic) ListSubscribers() []*network.Client {
 }
 
 // Update schema will update the schema of a topic, and return the new latest schema number.
-func (t *Topic) UpdateSchema(schema map[string]any) {
+func (t *Topic) UpdateSchema(schema any) {
 	t.mu.Lock("UpdateSchema")
 	defer func() {
 		log.WithFields(log.Fields{"method": "UpdateSchema", "topic": t.name}).Trace("updated topic schema")
@@ -111,9 +544,21 @@ func (t *Topic) UpdateSchema(schema map[string]any) {
 	}()
 
 	t.latestSchema++
-	t.schemas[t.latestSchema] = &TopicSchema{
-		Version: t.latestSchema,
-		Schema:  schema,
+	t.schemas[t.latestSchema] = newTopicSchema(t.latestSchema, schema)
+	t.evictSchemas()
+}
+
+// evictSchemas will drop the oldest schema versions when the topic has more than it keeps. The
+// latest version is always kept. Must hold the lock.
+func (t *Topic) evictSchemas() {
+	if t.maxSchemas <= 0 {
+		return
+	}
+	oldestKept := t.latestSchema - t.maxSchemas + 1
+	for version := range t.schemas {
+		if version < oldestKept {
+			delete(t.schemas, version)
+		}
 	}
 }
 
@@ -124,7 +569,7 @@ func (t *Topic) GetLatestSchema() (*TopicSchema, error) {
 
 	// If no schemas exist at all
 	if len(t.schemas) == 0 {
-		return nil, fmt.Errorf("no schemas found for topic, update schema")
+		return nil, fmt.Errorf("%w, give it one with updateSchema", ErrTopicHasNoSchema)
 	}
 
 	// Try the cached latest
@@ -149,34 +594,181 @@ func (t *Topic) GetLatestSchema() (*TopicSchema, error) {
 	return nil, fmt.Errorf("schema map is corrupt, no latest schema found")
 }
 
-// GetSchemaByVersion will get the schema for the topic of the given version interger.
+// SchemaHistory will return every schema version of the topic, ordered by version.
+func (t *Topic) SchemaHistory() []*TopicSchema {
+	t.mu.RLock("SchemaHistory")
+	defer t.mu.RUnlock("SchemaHistory")
+
+	history := make([]*TopicSchema, 0, len(t.schemas))
+	for _, schema := range t.schemas {
+		history = append(history, schema)
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Version < history[j].Version })
+	return history
+}
+
+// GetSchemaByVersion will get the schema for the topic of the given version interger. Returns
+// ErrSchemaVersionEvicted if the version existed but was dropped to keep the newer versions.
 func (t *Topic) GetSchemaByVersion(versionNumber int) (*TopicSchema, error) {
 	t.mu.Lock("GetSchemaByVersion")
 	defer t.mu.Unlock("GetSchemaByVersion")
 
-	schema, ok := t.schemas[t.latestSchema]
+	schema, ok := t.schemas[versionNumber]
 	if !ok {
+		if versionNumber >= 0 && versionNumber < t.latestSchema {
+			return nil, fmt.Errorf("cannot get schema version %d. Only the last %d versions are kept: %w", versionNumber, t.maxSchemas, ErrSchemaVersionEvicted)
+		}
 		return nil, fmt.Errorf("cannot get schema version %d. Version doesn't exist", versionNumber)
 	}
 
 	return schema, nil
 }
 
-func (t *Topic) Publish(sender *network.Client, msg *network.WebSocketMessage) []*network.Client {
+// Publish will send a message to all of the subscribers of the topic. The message is encoded
+// once and the same prepared message is written to every subscriber. Stops sending if the
+// context is done. Returns how many subscribers the message was queued for out of the ones it
+// was meant for, how many it replaced a value for that was still waiting to be written, and
+// the clients that couldn't be sent to because their connection is closed.
+// Paused subscribers aren't sent the message or counted, but may hold it until they resume.
+// Subscribers with a full ack window are counted, since the message waits for them to ack.
+func (t *Topic) Publish(ctx context.Context, sender *network.Client, msg *network.WebSocketMessage) (stats network.DeliveryStats, failedClients []*network.Client) {
 	t.mu.Lock("Publish")
 	defer t.mu.Unlock("Publish")
 
-	failedClients := make([]*network.Client, 0)
+	for client, opts := range t.subscribers {
+		if _, paused := t.paused[client]; !paused && (!opts.NoEcho || client != sender) {
+			stats.Targeted++
+		}
+	}
+	// whoever isn't delivered to by the time this returns failed, including the ones that
+	// weren't tried because the publish was cancelled, or whose full queue dropped it.
+	defer func() { stats.Failed = stats.Targeted - stats.Delivered - stats.Conflated }()
+
+	failedClients = make([]*network.Client, 0)
+	if ctx.Err() != nil {
+		return stats, failedClients
+	}
+
+	var expires time.Time
+	if msg.ExpiresAt != nil {
+		expires = *msg.ExpiresAt
+	}
+	frameType := websocket.TextMessage
+	if msg.Binary != nil { // sent as the json header followed by the raw payload
+		frameType = websocket.BinaryMessage
+	}
+	if t.replay != nil { // numbered while holding the lock so the sequence is the order it's sent in
+		t.replay.record(msg, frameType, expires)
+	}
+	// encoded once for each topic prefix of the subscribers, which is almost always just one
+	encodings := make(map[string]*encodedMessage, 1)
+	encodeFor := func(client *network.Client) (*encodedMessage, error) {
+		if encoded, ok := encodings[client.TopicPrefix]; ok {
+			return encoded, nil
+		}
+		encoded, err := encodeMessage(client.Unscoped(msg), frameType)
+		encodings[client.TopicPrefix] = encoded
+		return encoded, err
+	}
 
 	// publish to all subscribers
-	for client := range t.subscribers {
-		if err := client.SendJSON(msg); err != nil {
+	for client, opts := range t.subscribers {
+		if ctx.Err() != nil {
+			log.WithField("topic", t.name).Debug("Publish cancelled before all subscribers were sent to")
+			break
+		}
+		if opts.NoEcho && client == sender {
+			continue
+		}
+		encoded, err := encodeFor(client)
+		if err != nil {
+			log.WithError(err).WithField("topic", t.name).Error("Couldn't encode message to publish")
+			continue
+		}
+		if paused, ok := t.paused[client]; ok {
+			paused.hold(encoded.prepared, expires, msg.Priority)
+			continue
+		}
+		if err := t.sends.acquire(ctx); err != nil {
+			log.WithField("topic", t.name).Debug("Publish cancelled waiting to send to subscribers")
+			break
+		}
+		if window, ok := t.windows[client]; ok {
+			err := t.sendWindowed(client, window, frameType, encoded.data, expires)
+			t.sends.release()
+			if err != nil {
+				if errors.Is(err, ErrAckBacklogFull) {
+					log.WithField("topic", t.name).Warnf("Disconnecting client %s that stopped acking", client.Id)
+					go client.Disconnect(network.DisconnectSendQueueOverflow, "ack window backlog overflowed")
+				} else if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					failedClients = append(failedClients, client)
+				}
+				continue
+			}
+			stats.Delivered++
+			continue
+		}
+		err = t.send(client, opts, encoded.prepared, expires, msg.Priority)
+		t.sends.release()
+		if errors.Is(err, network.ErrMessageConflated) { // queued, but in place of a value that is never written
+			stats.Conflated++
+			continue
+		} else if errors.Is(err, network.ErrMessageDropped) { // the overflow policy dropped it, so it isn't retried
+			log.WithFields(log.Fields{"topic": t.name, "client_id": client.Id}).Debug("Subscriber's send queue is full, dropped value")
+			continue
+		}
+		if err != nil && t.redeliveries != nil {
+			if t.redeliveries.Add(client, encoded.prepared, expires, msg.Priority) {
+				log.WithFields(log.Fields{"topic": t.name, "client_id": client.Id}).Debugf("Couldn't send to subscriber, redelivering: %v", err)
+			} else {
+				log.WithFields(log.Fields{"topic": t.name, "client_id": client.Id}).Warnf("Couldn't send to subscriber and the redelivery queue is full: %v", err)
+				failedClients = append(failedClients, client)
+			}
+			continue
+		} else if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				failedClients = append(failedClients, client)
 			}
 			// TODO: add failure count to client failure
 			log.Println("Error when writing json to client: ", client.Id)
+			continue
 		}
+		stats.Delivered++
 	}
-	return failedClients
+	return stats, failedClients
+}
+
+// encodedMessage is a message encoded to publish, and the prepared message made from it.
+type encodedMessage struct {
+	data     []byte
+	prepared *websocket.PreparedMessage
+}
+
+// encodeMessage will encode a message to publish as a frame of the type. Binary frames are the
+// json header followed by the raw payload.
+func encodeMessage(msg *network.WebSocketMessage, frameType int) (*encodedMessage, error) {
+	var data []byte
+	var err error
+	if frameType == websocket.BinaryMessage {
+		data, err = network.EncodeBinaryFrame(msg, msg.Binary)
+	} else {
+		data, err = json.Marshal(msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := websocket.NewPreparedMessage(frameType, data)
+	if err != nil {
+		return nil, err
+	}
+	return &encodedMessage{data: data, prepared: prepared}, nil
+}
+
+// sendPrepared will queue the message to be written to a subscriber, conflating it with an
+// undelivered value for the topic if the subscription conflates. Must hold the lock.
+func (t *Topic) sendPrepared(client *network.Client, opts SubscriptionOptions, prepared *websocket.PreparedMessage, expires time.Time, priority network.Priority) error {
+	if opts.Conflate {
+		return client.SendConflated(t.name, prepared, t.overflowPolicy, expires, priority)
+	}
+	return client.SendPrepared(prepared, t.overflowPolicy, expires, priority)
 }
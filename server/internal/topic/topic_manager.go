@@ -3,47 +3,237 @@ package topic
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/atyalexyoung/data-loom/server/internal/config"
 	"github.com/atyalexyoung/data-loom/server/internal/logging"
 	"github.com/atyalexyoung/data-loom/server/internal/network"
 	"github.com/atyalexyoung/data-loom/server/internal/storage"
 )
 
 type TopicManager interface {
-	Subscribe(topicName string, client *network.Client) error
+	Subscribe(topicName string, client *network.Client, opts SubscriptionOptions) error
+	SubscribeAndGet(ctx context.Context, topicName string, client *network.Client, opts SubscriptionOptions, snapshot func(ValueMeta)) error
 	Unsubscribe(topicName string, client *network.Client) error
+	Pause(topicName string, client *network.Client, keepLatest bool) error
+	Resume(topicName string, client *network.Client) error
+	Ack(topicName string, client *network.Client, seq uint64) error
 	ListSubscribersForTopic(topicName string) ([]*network.Client, error)
 	UnsubscribeAll(client *network.Client)
-	Publish(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value map[string]any, errChan chan error) error
-	SendWithoutSave(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value map[string]any, errChan chan error) error
-	Get(ctx context.Context, topicName string) (map[string]any, error)
-	RegisterTopic(topicName string, schema map[string]any) (*Topic, error)
+	UnsubscribePattern(client *network.Client, pattern string) ([]string, error)
+	Subscriptions(client *network.Client) map[string]SubscriptionOptions
+	SubscribeFrom(topicName string, client *network.Client, opts SubscriptionOptions, seq uint64, ack func(ReplayResult)) error
+	Publish(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, errChan chan error) error
+	PublishIf(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, condition Precondition, errChan chan error) (ValueMeta, error)
+	SendWithoutSave(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, errChan chan error) error
+	PublishTransaction(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, values []TopicValue) error
+	Get(ctx context.Context, topicName string) (any, error)
+	GetAt(ctx context.Context, topicName string, at time.Time) (any, error)
+	GetWithMeta(ctx context.Context, topicName string, at time.Time) (ValueMeta, error)
+	GetRecent(ctx context.Context, topicName string, n int) ([]any, error)
+	GetMany(ctx context.Context, topicNames []string) (map[string]any, error)
+	MatchTopics(pattern string) ([]string, error)
+	RegisterTopic(topicName string, schema any, opts TopicOptions) (*Topic, error)
+	RegisterTopicIfMissing(topicName string, schema any, opts TopicOptions) (bool, error)
+	DefaultSchema(topicName string) (any, bool)
+	HasTopic(topicName string) bool
+	TopicSchemaVersion(topicName string) (int, bool)
 	UnregisterTopic(ctx context.Context, topicName string) error
+	PreviewUnregisterTopic(ctx context.Context, topicName string) (UnregisterPreview, error)
+	RenameTopic(ctx context.Context, topicName string, newName string) error
 	ListTopics() ([]*Topic, error)
-	UpdateSchema(topicName string, schema map[string]any) error
+	ExportSchemas() []TopicDefinition
+	ImportSchemas(definitions []TopicDefinition) (ImportResult, error)
+	UpdateSchema(topicName string, schema any) error
+	MigrateSchema(ctx context.Context, topicName string, schema any, migration SchemaMigration) (MigrationResult, error)
 	NextFailedClient() (*network.Client, bool)
-	IsSchemaMatch(topicName string, schema map[string]any) (bool, error)
+	IsSchemaMatch(topicName string, schema any) (bool, error)
+	ValidateSchema(topicName string, schema any, sample any) (SchemaCheck, error)
+	ValidatePayload(topicName string, payload any) ([]string, error)
+	ApplyDefaults(topicName string, payload any) (any, error)
+	Stats() ManagerStats
+	StorageStats(ctx context.Context) (storage.Stats, error)
+	StorageQueueStats() storage.QueueStats
+	StorageKeepsHistory() bool
+	LockStats() []logging.LockStats
+	StartIdleExpiry(ctx context.Context)
+	Close()
 }
 
+// TopicDefinition is a topic's name, validation mode, and full schema history. It is used to
+// copy topic definitions from one server to another.
+type TopicDefinition struct {
+	Name           string
+	ValidationMode ValidationMode
+	Schemas        []*TopicSchema // ordered by version
+}
+
+// ImportResult is how many topics and schema versions were added by an import.
+type ImportResult struct {
+	TopicsCreated int
+	VersionsAdded int
+}
+
+// TopicValue is a value to publish to a topic as part of a transaction.
+type TopicValue struct {
+	Topic string
+	Value any
+}
+
+// SchemaCheck is the result of checking a candidate schema for a topic without updating the topic.
+type SchemaCheck struct {
+	// Compatible is true if payloads that match the current schema are still accepted by the
+	// topic with the candidate schema.
+	Compatible bool
+	// Differences are why a payload that matches the current schema wouldn't match the candidate.
+	Differences []string
+	// SampleValid is true if the sample payload matches the candidate schema, nil without a sample.
+	SampleValid *bool
+	// SampleErrors are why the sample payload doesn't match the candidate schema.
+	SampleErrors []string
+}
+
+// UnregisterPreview is what unregistering a topic would affect, without it being unregistered.
+type UnregisterPreview struct {
+	Topic       string
+	HasData     bool // there is a stored value that would be deleted
+	Subscribers int  // how many clients would lose their subscription
+}
+
+// ManagerStats is how many topics there are and how many subscriptions there are across all of them.
+type ManagerStats struct {
+	TopicCount           int
+	SubscriptionCount    int
+	DroppedFailedClients int64 // failed sends that weren't counted against their client because the queue was full
+}
+
+// ErrSubscriptionLimit is returned when a client tries to subscribe to more topics than it is allowed.
+var ErrSubscriptionLimit = errors.New("subscription limit reached")
+
+// ErrSchemaVersionEvicted is returned when getting a schema version that was dropped because a
+// topic only keeps its most recent versions.
+var ErrSchemaVersionEvicted = errors.New("schema version was evicted")
+
+// ErrTopicHasNoSchema is returned when a topic has no schema versions at all, so values published
+// to it can't be validated until it's given one with UpdateSchema.
+var ErrTopicHasNoSchema = errors.New("topic has no schema")
+
+// ErrPayloadTooLarge is returned when a value published to a topic is bigger than the topic's max
+// payload size, or the server's if the topic doesn't have one.
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ErrTopicLimit is returned when a topic is registered while there are already as many topics as
+// the configured max.
+var ErrTopicLimit = errors.New("topic limit reached")
+
+// ErrTopicNotAllowed is returned when a topic is registered with a name that doesn't match any of
+// the configured allowed topic patterns.
+var ErrTopicNotAllowed = errors.New("topic name not allowed")
+
+// ErrWebhookNotAllowed is returned when a topic is registered with a webhook whose host isn't one
+// of the configured webhook allowed hosts.
+var ErrWebhookNotAllowed = errors.New("webhook not allowed")
+
+// ErrNestingTooDeep is returned when a payload or schema is nested deeper than the configured max depth.
+var ErrNestingTooDeep = errors.New("nesting too deep")
+
 // topicManager holds a map of the key for a key-value pair and the client that is subscribed to that key.
 type topicManager struct {
-	mu            *logging.DebugRWMutex
-	topics        map[string]*Topic
-	db            storage.Storage
-	failedClients chan *network.Client
+	mu                 *logging.DebugRWMutex
+	topics             map[string]*Topic
+	db                 storage.Storage
+	config             *config.Config
+	failedClients      chan *network.Client
+	droppedFailures    atomic.Int64
+	subMu              sync.Mutex
+	subscriptionCounts map[*network.Client]int
+	totalSubscriptions int // sum of subscriptionCounts, guarded by subMu
+	orphans            *orphanedDeletes
+	ids                network.IdGenerator
+	sends              *sendLimiter
+	transforms         []topicTransforms // set by WithTransforms, not changed after the manager is created
+	defaultSchemas     DefaultSchemas    // set by WithDefaultSchemas, not changed after the manager is created
+}
+
+// ManagerOption changes how NewTopicManager sets up the topic manager.
+type ManagerOption func(tm *topicManager)
+
+// WithIdGenerator will make the topic manager use the generator for the ids of the messages it
+// sends on its own, such as ticks, presence events, and rename notifications.
+func WithIdGenerator(ids network.IdGenerator) ManagerOption {
+	return func(tm *topicManager) {
+		tm.ids = ids
+	}
+}
+
+// NewTopicManager will create a topic manager that persists to the storage passed in and
+// uses the limits from the configuration. Options are applied last.
+func NewTopicManager(storage storage.Storage, cfg *config.Config, opts ...ManagerOption) TopicManager {
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	tm := &topicManager{
+		topics:             make(map[string]*Topic),
+		db:                 storage,
+		config:             cfg,
+		failedClients:      make(chan *network.Client, failedClientsBuffer(cfg)),
+		mu:                 logging.NewDebugRWMutex("TopicManager"),
+		subscriptionCounts: make(map[*network.Client]int),
+		ids:                network.UUIDGenerator{},
+		sends:              newSendLimiter(cfg.MaxConcurrentSends),
+	}
+	tm.orphans = newOrphanedDeletes(func(ctx context.Context, key string) error {
+		return tm.db.Delete(ctx, key)
+	})
+	for _, opt := range opts {
+		opt(tm)
+	}
+	return tm
+}
+
+// Close will stop the work the topic manager does in the background, such as retrying the
+// deletes of orphaned stored values.
+func (tm *topicManager) Close() {
+	tm.orphans.Close()
+}
+
+// HasTopic will return true if a topic is registered with the name.
+func (tm *topicManager) HasTopic(topicName string) bool {
+	tm.mu.RLock("HasTopic")
+	defer tm.mu.RUnlock("HasTopic")
+	_, ok := tm.topics[topicName]
+	return ok
+}
+
+// TopicSchemaVersion will return the latest schema version of a topic, and false if no topic is
+// registered with the name.
+func (tm *topicManager) TopicSchemaVersion(topicName string) (int, bool) {
+	tm.mu.RLock("TopicSchemaVersion")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("TopicSchemaVersion")
+	if !ok {
+		return 0, false
+	}
+	return topic.LatestSchemaVersion(), true
 }
 
-func NewTopicManager(storage storage.Storage) TopicManager {
-	return &topicManager{
-		topics:        make(map[string]*Topic),
-		db:            storage,
-		failedClients: make(chan *network.Client, 100),
-		mu:            logging.NewDebugRWMutex("TopicManager"),
+// failedClientsBuffer will return the configured size of the failed clients queue, or 100 if
+// it isn't set.
+func failedClientsBuffer(cfg *config.Config) int {
+	if cfg.FailedClientsBuffer > 0 {
+		return cfg.FailedClientsBuffer
 	}
+	return 100
 }
 
 func (tm *topicManager) NextFailedClient() (*network.Client, bool) {
@@ -51,18 +241,40 @@ func (tm *topicManager) NextFailedClient() (*network.Client, bool) {
 	return client, ok
 }
 
-// will increment the amount of failures for a client in the
+// markClientFailed will queue a failed send to the client for the server to count against it. If
+// the queue is full it waits up to the configured wait for room, and then drops the failure and
+// counts the drop, so sending to subscribers is only held up for that long.
 func (tm *topicManager) markClientFailed(c *network.Client) {
 	select {
 	case tm.failedClients <- c:
-		// enqueued success
+		return
 	default:
-		log.Warnf("failedClients channel full, dropping client %s", c.Id)
 	}
+
+	if wait := tm.config.FailedClientsWait; wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case tm.failedClients <- c:
+			return
+		case <-timer.C:
+		}
+	}
+
+	dropped := tm.droppedFailures.Add(1)
+	log.WithFields(log.Fields{"client": c.Id, "dropped": dropped}).Warn("failedClients channel full, dropping client failure")
+}
+
+// Subscribe checks if the topic exists and subscribes the client to it with the options for the subscription.
+func (tm *topicManager) Subscribe(topicName string, client *network.Client, opts SubscriptionOptions) error {
+	return tm.subscribe(topicName, client, func(topic *Topic) (bool, error) {
+		return topic.Subscribe(client, opts), nil
+	})
 }
 
-// Subscribe checks if the topic
-func (tm *topicManager) Subscribe(topicName string, client *network.Client) error {
+// subscribe will check if the topic exists and the client is under its subscription limit, then
+// subscribe it with join, which returns if the client wasn't subscribed already.
+func (tm *topicManager) subscribe(topicName string, client *network.Client, join func(*Topic) (bool, error)) error {
 	tm.mu.RLock("Subscribe")
 	topic, exists := tm.topics[topicName]
 	tm.mu.RUnlock("Subscribe")
@@ -71,10 +283,103 @@ func (tm *topicManager) Subscribe(topicName string, client *network.Client) erro
 		return fmt.Errorf("topic doesn't exist for %s", topicName)
 	}
 
-	topic.Subscribe(client)
+	// hold the count lock while subscribing so concurrent subscribes can't go over the limit
+	tm.subMu.Lock()
+
+	limit := tm.config.MaxSubscriptionsPerClient
+	if limit > 0 && !topic.IsClientSubscribed(client) && tm.subscriptionCounts[client] >= limit {
+		tm.subMu.Unlock()
+		return fmt.Errorf("%w: client %s is subscribed to %d topics, the max is %d", ErrSubscriptionLimit, client.Id, tm.subscriptionCounts[client], limit)
+	}
+
+	joined, err := join(topic)
+	if joined {
+		tm.subscriptionCounts[client]++
+		tm.totalSubscriptions++
+	}
+	tm.subMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if joined {
+		tm.notifyPresence(topic, client, PRESENCE_JOINED)
+	}
 	return nil
 }
 
+// SubscriptionCount returns the number of topics a client is subscribed to.
+func (tm *topicManager) SubscriptionCount(client *network.Client) int {
+	tm.subMu.Lock()
+	defer tm.subMu.Unlock()
+	return tm.subscriptionCounts[client]
+}
+
+// releaseSubscriptions will take subscriptions off of a client's count, removing the client
+// from the counts once it has none.
+func (tm *topicManager) releaseSubscriptions(client *network.Client, count int) {
+	tm.subMu.Lock()
+	defer tm.subMu.Unlock()
+
+	count = min(count, tm.subscriptionCounts[client])
+	tm.subscriptionCounts[client] -= count
+	tm.totalSubscriptions -= count
+	if tm.subscriptionCounts[client] <= 0 {
+		delete(tm.subscriptionCounts, client)
+	}
+}
+
+// Stats will return the number of topics and subscriptions, and how many client failures were
+// dropped. These are kept as counts, so nothing is scanned.
+func (tm *topicManager) Stats() ManagerStats {
+	tm.mu.RLock("Stats")
+	topicCount := len(tm.topics)
+	tm.mu.RUnlock("Stats")
+
+	tm.subMu.Lock()
+	defer tm.subMu.Unlock()
+	return ManagerStats{TopicCount: topicCount, SubscriptionCount: tm.totalSubscriptions, DroppedFailedClients: tm.droppedFailures.Load()}
+}
+
+// StorageStats will return the approximate size on disk and number of keys in the storage.
+func (tm *topicManager) StorageStats(ctx context.Context) (storage.Stats, error) {
+	return tm.db.Stats(ctx)
+}
+
+// StorageQueueStats will return how many writes to the storage are queued and how long they're taking.
+func (tm *topicManager) StorageQueueStats() storage.QueueStats {
+	return tm.db.QueueStats()
+}
+
+// StorageKeepsHistory will return if the storage keeps past values, so they can be read with
+// GetAt and GetRecent.
+func (tm *topicManager) StorageKeepsHistory() bool {
+	return tm.db.KeepsHistory()
+}
+
+// LockStats will return how often the topic manager's lock and each topic's lock were taken by
+// each method and how long they waited, with the manager's first and then the topics' by name.
+func (tm *topicManager) LockStats() []logging.LockStats {
+	tm.mu.RLock("LockStats")
+	names := make([]string, 0, len(tm.topics))
+	topics := make(map[string]*Topic, len(tm.topics))
+	for name, topic := range tm.topics {
+		names = append(names, name)
+		topics[name] = topic
+	}
+	tm.mu.RUnlock("LockStats")
+	sort.Strings(names)
+
+	stats := tm.mu.Stats()
+	for _, name := range names {
+		for _, stat := range topics[name].mu.Stats() {
+			stat.Component = "Topic: " + name // a renamed topic's lock still has its old name
+			stats = append(stats, stat)
+		}
+	}
+	return stats
+}
+
 // Unsubscribe removes a client from the subscription list for a given topic name.
 func (tm *topicManager) Unsubscribe(topicName string, client *network.Client) error {
 	tm.mu.RLock("Unsubscribe")
@@ -84,7 +389,61 @@ func (tm *topicManager) Unsubscribe(topicName string, client *network.Client) er
 	if !ok { // the topic doesn't exist to unsubscribe from, let user know
 		return fmt.Errorf("cannot unsubscribe client from topic. topic doesn't exits. topic: %s, client: %s", topicName, client.Id)
 	}
-	return topic.Unsubscribe(client)
+	if err := topic.Unsubscribe(client); err != nil {
+		return err
+	}
+	tm.releaseSubscriptions(client, 1)
+	tm.notifyPresence(topic, client, PRESENCE_LEFT)
+	return nil
+}
+
+// Pause will stop the client being sent values published to the topic without unsubscribing it.
+// If keepLatest is true, the latest value published while paused is sent when it resumes.
+func (tm *topicManager) Pause(topicName string, client *network.Client, keepLatest bool) error {
+	tm.mu.RLock("Pause")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("Pause")
+
+	if !ok {
+		return fmt.Errorf("cannot pause subscription. topic doesn't exist. topic: %s, client: %s", topicName, client.Id)
+	}
+	return topic.Pause(client, keepLatest)
+}
+
+// Resume will start sending values published to the topic to the client again, after sending it
+// the latest value published while it was paused if that was kept.
+func (tm *topicManager) Resume(topicName string, client *network.Client) error {
+	tm.mu.RLock("Resume")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("Resume")
+
+	if !ok {
+		return fmt.Errorf("cannot resume subscription. topic doesn't exist. topic: %s, client: %s", topicName, client.Id)
+	}
+	failed, err := topic.Resume(client)
+	if failed {
+		log.WithFields(log.Fields{"client": client}).Warn("Client failed to be sent value on resume. Marking as failed client.")
+		tm.markClientFailed(client)
+	}
+	return err
+}
+
+// Ack will ack the values sent to the client's windowed subscription up to the sequence number,
+// and send it values that were waiting for room in the window.
+func (tm *topicManager) Ack(topicName string, client *network.Client, seq uint64) error {
+	tm.mu.RLock("Ack")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("Ack")
+
+	if !ok {
+		return fmt.Errorf("cannot ack. topic doesn't exist. topic: %s, client: %s", topicName, client.Id)
+	}
+	failed, err := topic.Ack(client, seq)
+	if failed {
+		log.WithFields(log.Fields{"client": client}).Warn("Client failed to be sent values on ack. Marking as failed client.")
+		tm.markClientFailed(client)
+	}
+	return err
 }
 
 // ListSubscribersForTopic returns a copy of the list of all clients that are subscribed to a given topic name.
@@ -99,6 +458,24 @@ func (tm *topicManager) ListSubscribersForTopic(topicName string) ([]*network.Cl
 	return topic.ListSubscribers(), nil
 }
 
+// Subscriptions will return the options of every subscription the client has, by topic name.
+func (tm *topicManager) Subscriptions(client *network.Client) map[string]SubscriptionOptions {
+	tm.mu.RLock("Subscriptions")
+	topicsCopy := make([]*Topic, 0, len(tm.topics))
+	for _, topic := range tm.topics {
+		topicsCopy = append(topicsCopy, topic)
+	}
+	tm.mu.RUnlock("Subscriptions")
+
+	subscriptions := make(map[string]SubscriptionOptions)
+	for _, topic := range topicsCopy {
+		if opts, ok := topic.Subscription(client); ok {
+			subscriptions[topic.NameWithLock()] = opts
+		}
+	}
+	return subscriptions
+}
+
 // UnsubscribeAll removes a client from all topics.
 func (tm *topicManager) UnsubscribeAll(client *network.Client) {
 	tm.mu.RLock("UnsubscribeAll")
@@ -108,15 +485,69 @@ func (tm *topicManager) UnsubscribeAll(client *network.Client) {
 	}
 	tm.mu.RUnlock("UnsubscribeAll")
 
+	unsubscribed := 0
 	for _, topic := range topicsCopy {
 		if err := topic.Unsubscribe(client); err == nil { // client wasn't subscribed to topic
-			log.Printf("Unsubscribed client: %s from topic: %s", client.Id, topic.name)
+			log.Printf("Unsubscribed client: %s from topic: %s", client.Id, topic.NameWithLock())
+			unsubscribed++
+			tm.notifyPresence(topic, client, PRESENCE_LEFT)
+		}
+	}
+	tm.releaseSubscriptions(client, unsubscribed)
+}
+
+// UnsubscribePattern removes a client from the topics it's subscribed to that match a glob pattern,
+// such as "sensors/*", and returns their sorted names. The pattern syntax is the same as MatchTopics.
+// Returns error if the pattern is malformed.
+func (tm *topicManager) UnsubscribePattern(client *network.Client, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid topic pattern %q: %w", pattern, err)
+	}
+
+	tm.mu.RLock("UnsubscribePattern")
+	matched := make([]*Topic, 0)
+	for name, topic := range tm.topics {
+		if ok, _ := path.Match(pattern, name); ok {
+			matched = append(matched, topic)
+		}
+	}
+	tm.mu.RUnlock("UnsubscribePattern")
+
+	removed := make([]string, 0)
+	for _, topic := range matched {
+		if err := topic.Unsubscribe(client); err == nil { // err means the client wasn't subscribed to topic
+			removed = append(removed, topic.NameWithLock())
+			tm.notifyPresence(topic, client, PRESENCE_LEFT)
 		}
 	}
+	tm.releaseSubscriptions(client, len(removed))
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// checkPayloadSize will return ErrPayloadTooLarge if the payload is bigger than the topic's max
+// payload size, or the server's if the topic doesn't set one. Binary payloads are measured as
+// their raw bytes and anything else as its json.
+func (tm *topicManager) checkPayloadSize(topic *Topic, value any, raw []byte) error {
+	limit := topic.MaxPayloadSize()
+	if limit == 0 {
+		limit = tm.config.MaxPayloadSize
+	}
+	size := len(raw)
+	if payload, isBinary := value.([]byte); isBinary {
+		size = len(payload)
+	}
+	if limit > 0 && size > limit {
+		return fmt.Errorf("%w: payload for topic %s is %d bytes, the max is %d", ErrPayloadTooLarge, topic.NameWithLock(), size, limit)
+	}
+	return nil
 }
 
 // sendTopic will send the value passed in for a given topic to all the subscribers of that topic.
-func (tm *topicManager) sendTopic(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value map[string]any, persist bool, errCh chan error) error {
+// If the topic has a min publish interval and the value is too soon after the last one, it's
+// rejected, or held back and ErrPublishCoalesced returned if coalesce is true and the topic's
+// cooldown policy coalesces.
+func (tm *topicManager) sendTopic(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, persist bool, coalesce bool, errCh chan error) error {
 	// get topic from tm and unlock
 	tm.mu.RLock("sendTopic")
 	topic, ok := tm.topics[msg.Topic]
@@ -125,61 +556,110 @@ func (tm *topicManager) sendTopic(ctx context.Context, msg network.WebSocketMess
 	if !ok { // couldn't get topic, I guess it doesn't exist
 		return fmt.Errorf("publish failed. Topic doesn't exist. Topic: %s", msg.Topic)
 	}
+	if err := topic.checkPayloadKind(value); err != nil {
+		return fmt.Errorf("publish failed: %w", err)
+	}
 
-	var dbErrChan chan error
-	if persist { // if it's supposed to be persisted, then persist
-		time := time.Now().UTC()
+	priority, err := messagePriority(msg)
+	if err != nil {
+		return fmt.Errorf("publish failed for topic %s: %w", msg.Topic, err)
+	}
 
-		var valueString string
+	// nothing has been sent or stored yet, so if the request is already done there's no point
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("publish cancelled for topic %s: %w", msg.Topic, err)
+	}
 
-		if raw, err := json.Marshal(value); err != nil {
-			valueString = fmt.Sprintf("marshal_error: %v, fallback=%#v", err, value)
-		} else {
-			valueString = string(raw)
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Could not marshal json data.")
+	}
+	if err := tm.checkPayloadSize(topic, value, raw); err != nil {
+		return fmt.Errorf("publish failed: %w", err)
+	}
+	published, err := tm.transformPublished(topic, msg.Topic, value, raw)
+	if err != nil {
+		return fmt.Errorf("publish failed: %w", err)
+	}
+	if topic.cooldown != nil {
+		var hold func()
+		if coalesce {
+			hold = func() { tm.publishHeld(topic, msg, sender, published, priority, persist) }
+		}
+		if err := topic.cooldown.Allow(time.Now(), hold); errors.Is(err, ErrPublishCoalesced) {
+			return err // nothing is persisted until the value is published
+		} else if err != nil {
+			return fmt.Errorf("publish failed for topic %s: %w", msg.Topic, err)
+		}
+	}
+
+	return tm.publishValue(ctx, topic, msg, sender, published, priority, persist, errCh)
+}
+
+// publishValue will persist a value that passed the checks of sendTopic if persist is true, and
+// send it to the subscribers of the topic. The value is passed already encoded.
+func (tm *topicManager) publishValue(ctx context.Context, topic *Topic, msg network.WebSocketMessage, sender *network.Client, value publishedValue, priority network.Priority, persist bool, errCh chan error) error {
+	// compressed once, and the same bytes are persisted and sent to subscribers unless the
+	// transforms made them differ
+	compressed, err := topic.compressValue(value.sent, value.raw)
+	if err != nil {
+		return fmt.Errorf("publish failed. Couldn't compress value for topic %s: %w", msg.Topic, err)
+	}
+	storedCompressed := compressed
+	if persist && topic.compressed && value.diverged {
+		storedRaw, err := json.Marshal(value.stored)
+		if err != nil {
+			return fmt.Errorf("publish failed. Couldn't encode value for topic %s: %w", msg.Topic, err)
+		}
+		if storedCompressed, err = topic.compressValue(value.stored, storedRaw); err != nil {
+			return fmt.Errorf("publish failed. Couldn't compress value for topic %s: %w", msg.Topic, err)
+		}
+	}
+	stored := value.stored
+	if storedCompressed != nil {
+		stored = storedCompressed
+	}
+	cached := value.stored
+	var undoAggregate func()
+	if persist && topic.aggregator != nil { // the aggregates are stored instead of the value
+		aggregates, undo, err := tm.aggregate(ctx, topic, value.stored)
+		if err != nil {
+			return fmt.Errorf("publish failed for topic %s: %w", msg.Topic, err)
 		}
+		stored, cached, undoAggregate = aggregates, aggregates, undo
+	}
+
+	// the same server timestamp is persisted and sent to subscribers
+	timestamp := time.Now().UTC()
+	expiresAt := messageExpiry(msg, timestamp)
+
+	var dbErrChan chan error
+	if persist { // if it's supposed to be persisted, then persist
+
 		log.WithFields(log.Fields{
 			"sender_id":  sender.Id,
-			"value":      valueString,
+			"value":      string(value.raw),
 			"action":     msg.Action,
 			"message_id": msg.MessageId,
 			"topic":      msg.Topic,
-			"time":       time,
+			"time":       timestamp,
+			"expires_at": expiresAt,
 		}).Info("calling async put on database")
 
-		dbErrChan = tm.db.AsyncPut(ctx, msg.Topic, value, time)
-	}
-
-	raw, err := json.Marshal(value)
-	if err != nil {
-		return fmt.Errorf("Could not marshal json data.")
-	}
-	outboundMessage := &network.WebSocketMessage{
-		MessageId: msg.MessageId,
-		Action:    msg.Action,
-		Topic:     msg.Topic,
-		Data:      raw,
+		if topic.debouncer != nil { // persistence is coalesced, the latest value gets flushed later
+			topic.debouncer.Add(stored, timestamp, expiresAt)
+		} else {
+			dbErrChan = tm.db.AsyncPut(ctx, msg.Topic, stored, timestamp, expiresAt)
+		}
+		topic.markUpdated(timestamp, msg.Headers)
+		topic.cacheValue(cached, expiresAt)
 	}
-	failedClients := topic.Publish(sender, outboundMessage)
 
-	for _, client := range failedClients {
-		log.WithFields(log.Fields{"client": client}).Warn("Client failed to be published to. Marking as failed client.")
-		tm.markClientFailed(client)
-	}
+	tm.deliver(ctx, topic, msg, sender, value.sent, value.raw, compressed, timestamp, expiresAt, priority)
 
 	// respond to client with errors if needed
-	if dbErrChan != nil && errCh != nil {
-		go func() {
-			defer close(errCh)
-
-			select {
-			case err := <-dbErrChan:
-				if err != nil {
-					errCh <- fmt.Errorf("database error: %w", err)
-				}
-			case <-time.After(2 * time.Second):
-				errCh <- fmt.Errorf("timeout waiting for database ack")
-			}
-		}()
+	if dbErrChan != nil {
+		go tm.awaitPersisted(topic, dbErrChan, undoAggregate, errCh)
 	} else if errCh != nil {
 		close(errCh) // if no persistence, just close
 	}
@@ -187,129 +667,1011 @@ func (tm *topicManager) sendTopic(ctx context.Context, msg network.WebSocketMess
 	return nil
 }
 
-// Publish will send the JSON of the message to all clients subscribed to the topic
-func (tm *topicManager) Publish(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value map[string]any, errChan chan error) error {
-	return tm.sendTopic(ctx, msg, sender, value, true, errChan)
-}
+// awaitPersisted will wait for the write of a published value and report how it went on errCh if
+// it isn't nil. The value was cached and aggregated before it was written, so if the write fails
+// the cache is dropped for get to read what was stored, and the value is taken back out of the
+// aggregates before the failure is reported. The client is told about a write that is taking too
+// long, but the cleanup waits for its result since it could still succeed.
+func (tm *topicManager) awaitPersisted(topic *Topic, dbErrChan <-chan error, undoAggregate func(), errCh chan error) {
+	report := func(err error) {
+		if errCh != nil {
+			if err != nil {
+				errCh <- err
+			}
+			close(errCh)
+			errCh = nil
+		}
+	}
+	defer report(nil)
 
-// SendWithoutSave will publish a value to a topic, but not persist that data to storage.
-func (tm *topicManager) SendWithoutSave(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value map[string]any, errChan chan error) error {
-	return tm.sendTopic(ctx, msg, sender, value, false, errChan)
+	var err error
+	select {
+	case err = <-dbErrChan:
+	case <-time.After(2 * time.Second):
+		report(fmt.Errorf("timeout waiting for database ack"))
+		err = <-dbErrChan
+	}
+	if err != nil {
+		topic.invalidateCache()
+		if undoAggregate != nil {
+			undoAggregate()
+		}
+		report(fmt.Errorf("database error: %w", err))
+	}
 }
 
-// Get will retrieve the current value for a given topic
-func (tm *topicManager) Get(ctx context.Context, topicName string) (map[string]any, error) {
-	tm.mu.RLock("Get")
-	topic, ok := tm.topics[topicName]
-	tm.mu.RUnlock("Get")
+// publishHeld will publish a value that was held back by the topic's cooldown once the interval
+// is up. The client that published it was already responded to, so errors are only logged.
+func (tm *topicManager) publishHeld(topic *Topic, msg network.WebSocketMessage, sender *network.Client, value publishedValue, priority network.Priority, persist bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 
-	if !ok {
-		return nil, fmt.Errorf("couldn't get value for topic. topic doesn't exist. topic: %s", topicName)
-	}
+	msg.Topic = topic.NameWithLock() // the topic could have been renamed while the value was held back
+	msg.Result = nil                 // the request it came from is done
+	errCh := make(chan error, 1)
 
-	log.WithFields(log.Fields{"method": "Get", "topic": topic.name}).Trace("getting topic from database.")
-	value, err := tm.db.Get(ctx, topic.name)
+	unlock := lockWrites(topic)
+	err := tm.publishValue(ctx, topic, msg, sender, value, priority, persist, errCh)
+	unlock()
+	if err == nil {
+		err = <-errCh
+	}
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get value for topic with error: %v", err)
+		log.WithFields(log.Fields{"method": "publishHeld", "topic": msg.Topic}).Errorf("failed to publish held back value: %v", err)
 	}
-	return value, nil
 }
 
-// RegisterTopic takes a topic name and schema for the topic and will add it to list of topics.
-// This will create a schema of version 0 for the topic. Returns error if the topic already exists
-func (tm *topicManager) RegisterTopic(topicName string, schema map[string]any) (*Topic, error) {
-	tm.mu.RLock("RegisterTopic")
-	currentTopic, ok := tm.topics[topicName]
-	tm.mu.RUnlock("RegisterTopic")
-
-	if ok { // if we get a topic, it already exists
-		curretSchema, err := currentTopic.GetLatestSchema()
+// deliver will mirror a value to the topic's webhook and send it to the subscribers of the topic.
+// The value is passed already encoded as raw, and compressed for compressed topics, so it is only
+// encoded once. Compressed values are sent as a binary frame with the gzip encoding.
+func (tm *topicManager) deliver(ctx context.Context, topic *Topic, msg network.WebSocketMessage, sender *network.Client, value any, raw []byte, compressed []byte, timestamp time.Time, expiresAt time.Time, priority network.Priority) {
+	if topic.webhook != nil { // mirrored on its own goroutine so it doesn't hold up delivery
+		topic.webhook.Send(msg.Topic, value, timestamp)
+	}
 
-		if err == nil { // WE DID GET THE LATEST SCHEMA
-			if schemasMatch(curretSchema.Schema, schema) {
-				log.WithFields(log.Fields{"method": "RegisterTopic", "topic": topicName}).Trace("schema found, returning pre-existing topic")
-				return currentTopic, nil
+	schemaVersion := topic.LatestSchemaVersion()
+	outboundMessage := &network.WebSocketMessage{
+		MessageId:     msg.MessageId,
+		Action:        msg.Action,
+		Topic:         msg.Topic,
+		Data:          raw,
+		Timestamp:     &timestamp,
+		SchemaVersion: &schemaVersion,
+		Priority:      priority,
+		Headers:       msg.Headers,
+	}
+	if !expiresAt.IsZero() {
+		outboundMessage.ExpiresAt = &expiresAt
+	}
+	if compressed != nil {
+		outboundMessage.Data = nil
+		outboundMessage.Binary = compressed
+		outboundMessage.Encoding = ENCODING_GZIP
+	} else if payload, ok := value.([]byte); ok {
+		outboundMessage.Data = nil
+		outboundMessage.Binary = payload
+	}
+	if topic.binary {
+		outboundMessage.Format = string(topic.format)
+	}
+	stats, failedClients := topic.Publish(ctx, sender, outboundMessage)
+	msg.Result.AddDelivery(stats)
+	topic.markPublished(timestamp)
+	if topic.ticker != nil { // the topic isn't idle, so there's no need for a tick
+		topic.ticker.Reset()
+	}
 
-			} else { // schemas don't match, return error
-				return nil, fmt.Errorf("cannot register topic, topic already exists with different schema. Try updating schema")
-			}
-		} // else we couldn't get the latest schema, update the current topics schema.
+	for _, client := range failedClients {
+		log.WithFields(log.Fields{"client": client}).Warn("Client failed to be published to. Marking as failed client.")
+		tm.markClientFailed(client)
+	}
+}
 
-		currentTopic.UpdateSchema(schema)
-		return currentTopic, nil
+// messagePriority will return the priority the client sent the message with, or the default priority.
+func messagePriority(msg network.WebSocketMessage) (network.Priority, error) {
+	if msg.Options == nil {
+		return network.PriorityNormal, nil
+	}
+	return network.ParsePriority(msg.Options.Priority)
+}
 
-	} // else we didn't get a topic so create new one.
-	topic := NewTopic(topicName, schema)
-	tm.topics[topic.name] = topic // add new topic to topic manager
+// messageExpiry will return when a value sent at the timestamp expires from the ttl the client sent
+// the message with, or zero if it doesn't expire.
+func messageExpiry(msg network.WebSocketMessage, timestamp time.Time) time.Time {
+	if msg.Options == nil || msg.Options.TtlMs <= 0 {
+		return time.Time{}
+	}
+	return timestamp.Add(time.Duration(msg.Options.TtlMs) * time.Millisecond)
+}
 
-	log.WithFields(log.Fields{"method": "RegisterTopic", "topic": topicName}).Trace("created and registered new topic")
+// loadHasValue will check storage once when a topic is registered for a value stored before the
+// topic was registered, so listing topics doesn't need to read storage for every topic.
+func (tm *topicManager) loadHasValue(topic *Topic) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 
-	return topic, nil
+	value, err := tm.db.Get(ctx, topic.name)
+	if err != nil || value == nil {
+		return
+	}
+	topic.mu.Lock("loadHasValue")
+	topic.hasValue = true
+	topic.mu.Unlock("loadHasValue")
 }
 
-// schemasMatch will convert two map[string]any tol json and compare them to see if they are the same.
-func schemasMatch(schema, msg map[string]any) bool {
-	if len(schema) != len(msg) {
-		return false
+// sendTick will send a tick with the topic name and the current time to the subscribers of an
+// idle topic, so they know the server is still there even though no data is changing.
+func (tm *topicManager) sendTick(topic *Topic) {
+	if len(topic.ListSubscribers()) == 0 {
+		return
 	}
-	for key, val := range schema {
-		msgVal, ok := msg[key]
-		if !ok {
-			return false
-		}
 
-		// If the schema field is a nested map, validate recursively
-		if nestedSchema, ok := val.(map[string]any); ok {
-			msgNested, ok := msgVal.(map[string]any)
-			if !ok {
-				return false
-			}
-			if !schemasMatch(nestedSchema, msgNested) {
-				return false
-			}
-		}
+	timestamp := time.Now().UTC()
+	failedClients := topic.Notify(&network.WebSocketMessage{
+		MessageId: tm.ids.MessageId(),
+		Action:    "tick",
+		Topic:     topic.NameWithLock(),
+		Timestamp: &timestamp,
+	})
+	for _, client := range failedClients {
+		log.WithFields(log.Fields{"client": client}).Warn("Client failed to be sent tick. Marking as failed client.")
+		tm.markClientFailed(client)
 	}
-	return true
 }
 
-// UnregisterTopic takes name of topic to unregister and removes it from the topics.
-// returns error if topic doesn't exist.
-func (tm *topicManager) UnregisterTopic(ctx context.Context, topicName string) error {
-	tm.mu.Lock("UnregisterTopic")
-	_, ok := tm.topics[topicName]
-	if !ok {
-		return fmt.Errorf("cannot unregister topic. topic doesn't exist with name: %s", topicName)
+// persistDebounced will write the latest coalesced value for a topic to storage. There is no
+// client waiting on this write, so errors are only logged.
+func (tm *topicManager) persistDebounced(topic *Topic, value any, timestamp time.Time, expiresAt time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	topicName := topic.NameWithLock()
+	if err := <-tm.db.AsyncPut(ctx, topicName, value, timestamp, expiresAt); err != nil {
+		topic.invalidateCache() // the cached value is the one that wasn't stored
+		log.WithFields(log.Fields{"method": "persistDebounced", "topic": topicName}).Errorf("failed to persist debounced value: %v", err)
 	}
+}
 
-	delete(tm.topics, topicName) // delete the key-value in the map
-	tm.mu.Unlock("UnregisterTopic")
+// Publish will send the JSON of the message to all clients subscribed to the topic
+func (tm *topicManager) Publish(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, errChan chan error) (err error) {
+	ctx, span := startSpan(ctx, "TopicManager.Publish", msg.Topic)
+	defer func() {
+		closeOnError(errChan, err)
+		endSpan(span, err)
+	}()
 
-	if err := tm.db.Delete(ctx, topicName); err != nil {
-		return fmt.Errorf("Topic deleted but unable to delete from persistent storage with err: %v", err)
+	tm.mu.RLock("Publish")
+	topic, ok := tm.topics[msg.Topic]
+	tm.mu.RUnlock("Publish")
+	if ok {
+		unlock := lockWrites(topic)
+		defer unlock()
 	}
-
-	return nil
+	return tm.sendTopic(ctx, msg, sender, value, true, true, errChan)
 }
 
-// ListTopics will retreive all topics that are currently being used.
-func (tm *topicManager) ListTopics() ([]*Topic, error) {
-	tm.mu.RLock("ListTopics")
-	defer tm.mu.RUnlock("ListTopics")
-
-	topicsCopy := make([]*Topic, 0, len(tm.topics))
-	for _, t := range tm.topics {
-		topicsCopy = append(topicsCopy, t)
+// closeOnError will close the channel a publish reports its persistence errors on if the publish
+// failed, since there's nothing left for it to report.
+func closeOnError(errCh chan error, err error) {
+	if err != nil && errCh != nil {
+		close(errCh)
 	}
+}
 
-	return topicsCopy, nil
+// SendWithoutSave will publish a value to a topic, but not persist that data to storage.
+func (tm *topicManager) SendWithoutSave(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, value any, errChan chan error) (err error) {
+	ctx, span := startSpan(ctx, "TopicManager.SendWithoutSave", msg.Topic)
+	defer func() {
+		closeOnError(errChan, err)
+		endSpan(span, err)
+	}()
+	return tm.sendTopic(ctx, msg, sender, value, false, true, errChan)
 }
 
-func (tm *topicManager) UpdateSchema(topicName string, schema map[string]any) error {
-	tm.mu.RLock("UpdateSchema")
-	topic, ok := tm.topics[topicName]
-	tm.mu.RUnlock("UpdateSchema")
+// PublishTransaction will persist the values for several topics in a single storage transaction
+// and then send each value to the subscribers of its topic. Nothing is delivered unless the
+// transaction commits. Every value gets the same timestamp, and the options of the message
+// apply to all of them. Returns error if any of the topics don't exist or the transaction fails.
+func (tm *topicManager) PublishTransaction(ctx context.Context, msg network.WebSocketMessage, sender *network.Client, values []TopicValue) (err error) {
+	ctx, span := tracer.Start(ctx, "TopicManager.PublishTransaction")
+	defer func() { endSpan(span, err) }()
 
-	if !ok {
+	tm.mu.RLock("PublishTransaction")
+	topics := make([]*Topic, 0, len(values))
+	for _, value := range values {
+		topic, ok := tm.topics[value.Topic]
+		if !ok {
+			tm.mu.RUnlock("PublishTransaction")
+			return fmt.Errorf("transaction failed. Topic doesn't exist. Topic: %s", value.Topic)
+		}
+		if err := topic.checkPayloadKind(value.Value); err != nil {
+			tm.mu.RUnlock("PublishTransaction")
+			return fmt.Errorf("transaction failed: %w", err)
+		}
+		topics = append(topics, topic)
+	}
+	tm.mu.RUnlock("PublishTransaction")
+
+	unlock := lockWrites(topics...)
+	defer unlock()
+
+	priority, err := messagePriority(msg)
+	if err != nil {
+		return fmt.Errorf("transaction failed: %w", err)
+	}
+
+	// transformed and encoded up front so nothing can fail between the commit and delivery
+	published := make([]publishedValue, 0, len(values))
+	compressed := make([][]byte, 0, len(values))       // sent to subscribers
+	storedCompressed := make([][]byte, 0, len(values)) // persisted, unless it's the same as what's sent
+	for i, value := range values {
+		raw, err := json.Marshal(value.Value)
+		if err != nil {
+			return fmt.Errorf("transaction failed. Couldn't encode value for topic %s: %w", value.Topic, err)
+		}
+		if err := tm.checkPayloadSize(topics[i], value.Value, raw); err != nil {
+			return fmt.Errorf("transaction failed: %w", err)
+		}
+		transformed, err := tm.transformPublished(topics[i], value.Topic, value.Value, raw)
+		if err != nil {
+			return fmt.Errorf("transaction failed: %w", err)
+		}
+		published = append(published, transformed)
+		gzipped, err := topics[i].compressValue(transformed.sent, transformed.raw)
+		if err != nil {
+			return fmt.Errorf("transaction failed. Couldn't compress value for topic %s: %w", value.Topic, err)
+		}
+		compressed = append(compressed, gzipped)
+		if topics[i].compressed && transformed.diverged {
+			storedRaw, err := json.Marshal(transformed.stored)
+			if err != nil {
+				return fmt.Errorf("transaction failed. Couldn't encode value for topic %s: %w", value.Topic, err)
+			}
+			if gzipped, err = topics[i].compressValue(transformed.stored, storedRaw); err != nil {
+				return fmt.Errorf("transaction failed. Couldn't compress value for topic %s: %w", value.Topic, err)
+			}
+		}
+		storedCompressed = append(storedCompressed, gzipped)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("transaction cancelled: %w", err)
+	}
+
+	timestamp := time.Now().UTC()
+	expiresAt := messageExpiry(msg, timestamp)
+	entries := make([]storage.BatchEntry, 0, len(values))
+	stored := make([]any, 0, len(values))
+	var undos []func() // of the cooldowns and aggregates, if nothing ends up published
+	undo := func() {
+		for _, undoStep := range undos {
+			undoStep()
+		}
+	}
+	// a transaction can't be held back, so a topic it's too soon for rejects the whole thing
+	reserved := make(map[*Topic]bool, len(topics))
+	for i, topic := range topics {
+		if topic.cooldown == nil || reserved[topic] {
+			continue
+		}
+		undoCooldown, err := topic.cooldown.Reserve(timestamp)
+		if err != nil {
+			undo()
+			return fmt.Errorf("transaction failed for topic %s: %w", values[i].Topic, err)
+		}
+		reserved[topic] = true
+		undos = append(undos, undoCooldown)
+	}
+	for i, value := range values {
+		entry := published[i].stored
+		if storedCompressed[i] != nil {
+			entry = storedCompressed[i]
+		}
+		if topics[i].aggregator != nil { // the aggregates are stored instead of the value
+			aggregates, undoAggregate, err := tm.aggregate(ctx, topics[i], published[i].stored)
+			if err != nil {
+				undo()
+				return fmt.Errorf("transaction failed for topic %s: %w", value.Topic, err)
+			}
+			undos = append(undos, undoAggregate)
+			entry = aggregates
+		}
+		stored = append(stored, entry)
+		entries = append(entries, storage.BatchEntry{Key: value.Topic, Value: entry, Timestamp: timestamp, ExpiresAt: expiresAt})
+	}
+
+	log.WithFields(log.Fields{
+		"sender_id":  sender.Id,
+		"message_id": msg.MessageId,
+		"topics":     len(values),
+		"time":       timestamp,
+	}).Info("calling async put batch on database")
+	// once the batch is queued it can still commit after ctx is done, so its result is always
+	// waited for. The writer refuses a batch whose ctx is done before it's written, and that's the
+	// only way a cancelled transaction doesn't commit.
+	if err := <-tm.db.AsyncPutBatch(ctx, entries); err != nil {
+		undo()
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("transaction cancelled, nothing was published: %w", err)
+		}
+		return fmt.Errorf("transaction failed, nothing was published: %w", err)
+	}
+
+	// it's committed, so it's delivered even if the client went away while it was written
+	ctx = context.WithoutCancel(ctx)
+	for i, topic := range topics {
+		if topic.debouncer != nil { // the pending value is older than the one that was just persisted
+			topic.debouncer.Discard()
+		}
+		topic.markUpdated(timestamp, msg.Headers)
+		if topic.aggregator != nil {
+			topic.cacheValue(stored[i], expiresAt)
+		} else {
+			topic.cacheValue(published[i].stored, expiresAt)
+		}
+
+		topicMsg := msg
+		topicMsg.Topic = values[i].Topic
+		tm.deliver(ctx, topic, topicMsg, sender, published[i].sent, published[i].raw, compressed[i], timestamp, expiresAt, priority)
+	}
+	return nil
+}
+
+// Get will retrieve the current value for a given topic. The last value published to the topic
+// is cached, so it's returned without reading storage unless the config forces reading through.
+// Topics that haven't been published to since they were registered read from storage.
+func (tm *topicManager) Get(ctx context.Context, topicName string) (value any, err error) {
+	ctx, span := startSpan(ctx, "TopicManager.Get", topicName)
+	defer func() { endSpan(span, err) }()
+
+	tm.mu.RLock("Get")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("Get")
+
+	if !ok {
+		return nil, fmt.Errorf("couldn't get value for topic. topic doesn't exist. topic: %s", topicName)
+	}
+
+	if !tm.config.GetReadThrough {
+		if value, ok := topic.cached(time.Now()); ok {
+			log.WithFields(log.Fields{"method": "Get", "topic": topicName}).Trace("returning cached topic value.")
+			return value, nil
+		}
+	}
+
+	log.WithFields(log.Fields{"method": "Get", "topic": topic.name}).Trace("getting topic from database.")
+	value, err = tm.db.Get(ctx, topic.name)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get value for topic with error: %v", err)
+	}
+	return topic.decompressValue(value)
+}
+
+// RegisterTopic takes a topic name, schema, and options for the topic and will add it to list of topics.
+// This will create a schema of version 0 for the topic. Returns error if the topic already exists
+func (tm *topicManager) RegisterTopic(topicName string, schema any, opts TopicOptions) (*Topic, error) {
+	topic, _, err := tm.registerTopic(topicName, schema, opts)
+	return topic, err
+}
+
+// registerTopic will register the topic like RegisterTopic, and return true if this call created
+// it rather than finding it already registered.
+func (tm *topicManager) registerTopic(topicName string, schema any, opts TopicOptions) (*Topic, bool, error) {
+	if err := tm.checkTopicAllowed(topicName); err != nil {
+		return nil, false, err
+	}
+	if err := tm.checkWebhookAllowed(opts.WebhookURL); err != nil {
+		return nil, false, err
+	}
+	if err := tm.checkNestingDepth(schema, "schema"); err != nil {
+		return nil, false, err
+	}
+
+	tm.mu.RLock("RegisterTopic")
+	currentTopic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("RegisterTopic")
+
+	if ok { // if we get a topic, it already exists
+		existing, err := registerExisting(currentTopic, topicName, schema)
+		return existing, false, err
+	} // else we didn't get a topic so create new one.
+	tm.mu.RLock("RegisterTopic")
+	err := tm.checkTopicLimit(topicName)
+	tm.mu.RUnlock("RegisterTopic")
+	if err != nil {
+		return nil, false, err
+	}
+
+	topic := NewTopic(topicName, schema, opts)
+	topic.maxSchemas = tm.config.MaxSchemaVersions
+	topic.sends = tm.sends
+	topic.onSendFailed = tm.markClientFailed
+	tm.loadHasValue(topic)
+	if opts.PersistInterval > 0 {
+		topic.debouncer = newPersistDebouncer(opts.PersistInterval, func(value any, timestamp time.Time, expiresAt time.Time) {
+			tm.persistDebounced(topic, value, timestamp, expiresAt)
+		})
+	}
+	if opts.WebhookURL != "" {
+		topic.webhook = newWebhookSink(opts.WebhookURL)
+	}
+	if opts.TickInterval > 0 {
+		topic.ticker = newTopicTicker(opts.TickInterval, func() {
+			tm.sendTick(topic)
+		})
+	}
+	if opts.MinPublishInterval > 0 {
+		topic.cooldown = newPublishCooldown(opts.MinPublishInterval, opts.CooldownPolicy)
+	}
+	// writes to the new topic wait until an orphaned delete of its name has returned
+	unlock := lockWrites(topic)
+	defer unlock()
+	tm.mu.Lock("RegisterTopic")
+	if existing, ok := tm.topics[topicName]; ok { // someone else registered it since it was checked
+		tm.mu.Unlock("RegisterTopic")
+		topic.stop()
+		existing, err := registerExisting(existing, topicName, schema)
+		return existing, false, err
+	}
+	if err := tm.checkTopicLimit(topicName); err != nil { // other topics could have been registered since it was checked
+		tm.mu.Unlock("RegisterTopic")
+		topic.stop()
+		return nil, false, err
+	}
+	tm.topics[topic.name] = topic // add new topic to topic manager
+	orphanDeleted, _ := tm.orphans.Claim(topicName)
+	tm.mu.Unlock("RegisterTopic")
+	<-orphanDeleted
+
+	log.WithFields(log.Fields{"method": "RegisterTopic", "topic": topicName}).Trace("created and registered new topic")
+
+	return topic, true, nil
+}
+
+// registerExisting will return the topic if it already has the schema being registered. Returns
+// error if it has a different schema. A topic whose schema can't be read gets the schema instead.
+func registerExisting(currentTopic *Topic, topicName string, schema any) (*Topic, error) {
+	curretSchema, err := currentTopic.GetLatestSchema()
+
+	if err == nil { // WE DID GET THE LATEST SCHEMA
+		if curretSchema.Hash != "" && curretSchema.Hash == SchemaHash(schema) {
+			log.WithFields(log.Fields{"method": "RegisterTopic", "topic": topicName}).Trace("schema found, returning pre-existing topic")
+			return currentTopic, nil
+
+		} else { // schemas don't match, return error
+			return nil, fmt.Errorf("cannot register topic, topic already exists with different schema. Try updating schema")
+		}
+	} // else we couldn't get the latest schema, update the current topics schema.
+
+	currentTopic.UpdateSchema(schema)
+	return currentTopic, nil
+}
+
+// NestingDepth will return how deeply objects and arrays are nested in a value. A scalar is 0
+// and an empty object or array is 1. It walks the value without recursion so a deeply
+// nested value can't exhaust the stack.
+func NestingDepth(value any) int {
+	type level struct {
+		value any
+		depth int
+	}
+
+	maxDepth := 0
+	stack := []level{{value: value, depth: 0}}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		switch v := current.value.(type) {
+		case map[string]any:
+			maxDepth = max(maxDepth, current.depth+1)
+			for _, child := range v {
+				stack = append(stack, level{value: child, depth: current.depth + 1})
+			}
+		case []any:
+			maxDepth = max(maxDepth, current.depth+1)
+			for _, child := range v {
+				stack = append(stack, level{value: child, depth: current.depth + 1})
+			}
+		}
+	}
+	return maxDepth
+}
+
+// checkTopicLimit will return ErrTopicLimit if there is a max number of topics configured and
+// registering the topic would go past it. The caller must hold the topic manager's lock.
+func (tm *topicManager) checkTopicLimit(topicName string) error {
+	limit := tm.config.MaxTopics
+	if _, ok := tm.topics[topicName]; ok || limit <= 0 || len(tm.topics) < limit {
+		return nil
+	}
+	return fmt.Errorf("%w: there are %d topics, the max is %d", ErrTopicLimit, len(tm.topics), limit)
+}
+
+// checkTopicAllowed will return ErrTopicNotAllowed if there are allowed topic patterns configured
+// and the name doesn't match any of them. Patterns match like MatchTopics, so "*" doesn't match "/".
+func (tm *topicManager) checkTopicAllowed(topicName string) error {
+	if len(tm.config.AllowedTopicPatterns) == 0 {
+		return nil
+	}
+	for _, pattern := range tm.config.AllowedTopicPatterns {
+		if matched, _ := path.Match(pattern, topicName); matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s doesn't match any of the allowed topic patterns", ErrTopicNotAllowed, topicName)
+}
+
+// checkWebhookAllowed will return ErrWebhookNotAllowed if there's a webhook url and its host isn't
+// one of the configured webhook allowed hosts. A host allowed without a port is allowed on any port.
+func (tm *topicManager) checkWebhookAllowed(webhookURL string) error {
+	if webhookURL == "" {
+		return nil
+	}
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return fmt.Errorf("%w: %s isn't a valid url", ErrWebhookNotAllowed, webhookURL)
+	}
+	host, hostname := strings.ToLower(parsed.Host), strings.ToLower(parsed.Hostname())
+	for _, allowed := range tm.config.WebhookAllowedHosts {
+		if allowed == host || allowed == hostname {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s isn't one of the hosts webhooks can be posted to", ErrWebhookNotAllowed, parsed.Host)
+}
+
+// checkNestingDepth will return ErrNestingTooDeep if the value is nested deeper than the
+// configured max. A max of 0 means there is no limit.
+func (tm *topicManager) checkNestingDepth(value any, kind string) error {
+	limit := tm.config.MaxNestingDepth
+	if limit <= 0 {
+		return nil
+	}
+	if depth := NestingDepth(value); depth > limit {
+		return fmt.Errorf("%w: %s is nested %d levels deep, the max is %d", ErrNestingTooDeep, kind, depth, limit)
+	}
+	return nil
+}
+
+// schemasMatch will compare a schema and a payload to see if they have the same structure.
+// Objects need the same fields, and arrays need every item to match the first item of the
+// schema array. An empty schema array matches any array.
+func schemasMatch(schema, payload any) bool {
+	return len(schemaMismatches(schema, payload, "")) == 0
+}
+
+// schemaMismatches walks the schema and the payload and returns a description of every
+// field that doesn't line up between the two. The path is the location in the payload.
+func schemaMismatches(schema, payload any, path string) []string {
+	mismatches := make([]string, 0)
+
+	switch schemaVal := schema.(type) {
+	case map[string]any:
+		payloadVal, ok := payload.(map[string]any)
+		if !ok {
+			return append(mismatches, fmt.Sprintf("expected object for %s", describePath(path)))
+		}
+		for key, val := range schemaVal {
+			field := joinPath(path, key)
+			fieldVal, ok := payloadVal[key]
+			if !ok {
+				mismatches = append(mismatches, fmt.Sprintf("missing field: %s", field))
+				continue
+			}
+			// scalar values in the schema only say that the field exists, nested objects and
+			// arrays are validated recursively
+			switch val.(type) {
+			case map[string]any, []any:
+				mismatches = append(mismatches, schemaMismatches(val, fieldVal, field)...)
+			}
+		}
+		for key := range payloadVal {
+			if _, ok := schemaVal[key]; !ok {
+				mismatches = append(mismatches, fmt.Sprintf("unexpected field: %s", joinPath(path, key)))
+			}
+		}
+
+	case []any:
+		payloadVal, ok := payload.([]any)
+		if !ok {
+			return append(mismatches, fmt.Sprintf("expected array for %s", describePath(path)))
+		}
+		if len(schemaVal) == 0 { // no item schema, any array goes
+			break
+		}
+		switch schemaVal[0].(type) {
+		case map[string]any, []any:
+			for i, item := range payloadVal {
+				mismatches = append(mismatches, schemaMismatches(schemaVal[0], item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+
+	sort.Strings(mismatches)
+	return mismatches
+}
+
+// joinPath will add a field name onto the path of its parent.
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// describePath will describe a path for an error message, where the blank path is the whole payload.
+func describePath(path string) string {
+	if path == "" {
+		return "payload"
+	}
+	return "field: " + path
+}
+
+// UnregisterTopic takes name of topic to unregister and removes it from the topics.
+// returns error if topic doesn't exist.
+func (tm *topicManager) UnregisterTopic(ctx context.Context, topicName string) error {
+	tm.mu.Lock("UnregisterTopic")
+	topic, ok := tm.topics[topicName]
+	if !ok {
+		tm.mu.Unlock("UnregisterTopic")
+		return fmt.Errorf("cannot unregister topic. topic doesn't exist with name: %s", topicName)
+	}
+
+	delete(tm.topics, topicName) // delete the key-value in the map
+	tm.orphans.Track(topicName)
+	tm.mu.Unlock("UnregisterTopic")
+
+	return tm.closeTopic(ctx, topicName, topic, true)
+}
+
+// PreviewUnregisterTopic will report what unregistering a topic would affect without changing
+// anything, so the impact can be checked first. Returns error if the topic doesn't exist, or its
+// stored value couldn't be read.
+func (tm *topicManager) PreviewUnregisterTopic(ctx context.Context, topicName string) (UnregisterPreview, error) {
+	tm.mu.RLock("PreviewUnregisterTopic")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("PreviewUnregisterTopic")
+	if !ok {
+		return UnregisterPreview{}, fmt.Errorf("cannot unregister topic. topic doesn't exist with name: %s", topicName)
+	}
+
+	value, err := tm.db.Get(ctx, topicName)
+	if err != nil {
+		return UnregisterPreview{}, fmt.Errorf("couldn't check stored value for topic with error: %w", err)
+	}
+
+	return UnregisterPreview{
+		Topic:       topicName,
+		HasData:     value != nil,
+		Subscribers: len(topic.ListSubscribers()),
+	}, nil
+}
+
+// closeTopic will stop everything running for a topic that was removed from the topics, release
+// its subscriptions, and delete its stored value if purge is true. The name has to be tracked by
+// the orphans when the topic is removed for its value to be deleted.
+func (tm *topicManager) closeTopic(ctx context.Context, topicName string, topic *Topic, purge bool) error {
+	topic.stop()
+	topic.invalidateCache()
+
+	// the subscribers of the topic don't have a subscription to it anymore
+	for _, client := range topic.ListSubscribers() {
+		tm.releaseSubscriptions(client, 1)
+	}
+
+	if !purge {
+		return nil
+	}
+	if err := tm.orphans.Delete(ctx, topicName); err != nil {
+		// the stored value keeps being deleted in the background instead of being left behind
+		log.WithFields(log.Fields{"method": "closeTopic", "topic": topicName}).Warnf("couldn't delete stored value, retrying in the background: %v", err)
+		return fmt.Errorf("%w for %s, retrying in the background: %w", ErrOrphanedStorage, topicName, err)
+	}
+
+	return nil
+}
+
+// RenameTopic will move a topic to a new name, keeping its subscribers and schemas, and migrate
+// the persisted value to the new name. Subscribers are notified of the new name once it's moved.
+// The persisted value is moved first, after the writes already queued for the topic, and nothing
+// can be published to the topic until it's done, so a storage failure leaves the topic as it was.
+// Returns error if the topic doesn't exist, a topic already exists with the new name, the new
+// name isn't allowed, or the persisted value couldn't be moved.
+func (tm *topicManager) RenameTopic(ctx context.Context, topicName string, newName string) error {
+	if err := tm.checkTopicAllowed(newName); err != nil {
+		return fmt.Errorf("cannot rename topic: %w", err)
+	}
+
+	tm.mu.RLock("RenameTopic")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("RenameTopic")
+	if !ok {
+		return fmt.Errorf("cannot rename topic. topic doesn't exist with name: %s", topicName)
+	}
+
+	unlock := lockWrites(topic)
+	defer unlock()
+
+	tm.mu.RLock("RenameTopic")
+	current, ok := tm.topics[topicName]
+	_, exists := tm.topics[newName]
+	tm.mu.RUnlock("RenameTopic")
+	if !ok || current != topic {
+		return fmt.Errorf("cannot rename topic. topic doesn't exist with name: %s", topicName)
+	}
+	if exists {
+		return fmt.Errorf("cannot rename topic. topic already exists with name: %s", newName)
+	}
+
+	if topic.debouncer != nil { // written under the old name, so it's moved with the rest
+		topic.debouncer.Flush()
+	}
+	// an orphaned value under the new name is replaced by the moved value, so it isn't deleted
+	orphanDeleted, orphaned := tm.orphans.Claim(newName)
+	<-orphanDeleted
+	if err := tm.db.Rename(ctx, topicName, newName); err != nil {
+		if orphaned {
+			tm.mu.RLock("RenameTopic")
+			if _, exists := tm.topics[newName]; !exists {
+				tm.orphans.Track(newName)
+			}
+			tm.mu.RUnlock("RenameTopic")
+			tm.orphans.Retry(newName)
+		}
+		return fmt.Errorf("cannot rename topic. unable to rename in persistent storage: %w", err)
+	}
+
+	tm.mu.Lock("RenameTopic")
+	if _, exists := tm.topics[newName]; exists { // registered while the value was moved
+		tm.mu.Unlock("RenameTopic")
+		if err := tm.db.Rename(context.WithoutCancel(ctx), newName, topicName); err != nil {
+			log.WithFields(log.Fields{"method": "RenameTopic", "topic": topicName, "new_name": newName}).Errorf("could not move persisted value back: %v", err)
+		}
+		return fmt.Errorf("cannot rename topic. topic already exists with name: %s", newName)
+	}
+	delete(tm.topics, topicName)
+	topic.rename(newName)
+	tm.topics[newName] = topic
+	tm.mu.Unlock("RenameTopic")
+
+	log.WithFields(log.Fields{"method": "RenameTopic", "topic": topicName, "new_name": newName}).Trace("renamed topic")
+
+	// each subscriber is told the names it knows the topic by
+	messageId := tm.ids.MessageId()
+	failedClients := topic.notifyEach(func(client *network.Client) *network.WebSocketMessage {
+		raw, err := json.Marshal(map[string]any{"oldName": client.UnscopeTopic(topicName), "newName": client.UnscopeTopic(newName)})
+		if err != nil {
+			log.WithFields(log.Fields{"method": "RenameTopic", "client": client.Id}).Errorf("could not marshal rename notification: %v", err)
+			return nil
+		}
+		return &network.WebSocketMessage{MessageId: messageId, Action: "renameTopic", Topic: client.UnscopeTopic(newName), Data: raw}
+	})
+	for _, client := range failedClients {
+		log.WithFields(log.Fields{"client": client}).Warn("Client failed to be notified of rename. Marking as failed client.")
+		tm.markClientFailed(client)
+	}
+
+	return nil
+}
+
+// GetAt will get the value a topic had at a point in time. Returns an error wrapping
+// storage.ErrHistoryNotSupported if the storage only keeps the latest value.
+func (tm *topicManager) GetAt(ctx context.Context, topicName string, at time.Time) (value any, err error) {
+	ctx, span := startSpan(ctx, "TopicManager.GetAt", topicName)
+	defer func() { endSpan(span, err) }()
+
+	tm.mu.RLock("GetAt")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("GetAt")
+
+	if !ok {
+		return nil, fmt.Errorf("couldn't get value for topic. topic doesn't exist. topic: %s", topicName)
+	}
+
+	log.WithFields(log.Fields{"method": "GetAt", "topic": topic.name, "at": at}).Trace("getting topic value at time from database.")
+	value, err = tm.db.GetAt(ctx, topic.name, at)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get value for topic at %s with error: %w", at.Format(time.RFC3339Nano), err)
+	}
+	return topic.decompressValue(value)
+}
+
+// GetRecent will retrieve up to the last n values stored for a topic, newest first.
+// Returns error if the topic doesn't exist or the storage doesn't keep history.
+func (tm *topicManager) GetRecent(ctx context.Context, topicName string, n int) (values []any, err error) {
+	ctx, span := startSpan(ctx, "TopicManager.GetRecent", topicName)
+	defer func() { endSpan(span, err) }()
+
+	tm.mu.RLock("GetRecent")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("GetRecent")
+
+	if !ok {
+		return nil, fmt.Errorf("couldn't get recent values for topic. topic doesn't exist. topic: %s", topicName)
+	}
+
+	log.WithFields(log.Fields{"method": "GetRecent", "topic": topic.name, "count": n}).Trace("getting recent topic values from database.")
+	values, err = tm.db.GetRecent(ctx, topic.name, n)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get recent values for topic with error: %w", err)
+	}
+	for i, value := range values {
+		if values[i], err = topic.decompressValue(value); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// GetMany will get the current values for several topics, keyed by topic name. Topics that
+// don't have a value are included with a nil value. Returns error if any topic doesn't
+// exist or a value can't be read.
+func (tm *topicManager) GetMany(ctx context.Context, topicNames []string) (map[string]any, error) {
+	values := make(map[string]any, len(topicNames))
+	for _, topicName := range topicNames {
+		value, err := tm.Get(ctx, topicName)
+		if err != nil {
+			return nil, err
+		}
+		values[topicName] = value
+	}
+	return values, nil
+}
+
+// MatchTopics will return the sorted names of the topics that match a glob pattern, such as
+// "sensors/*". The pattern syntax is the same as path.Match, so "*" doesn't match "/".
+// Returns error if the pattern is malformed.
+func (tm *topicManager) MatchTopics(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid topic pattern %q: %w", pattern, err)
+	}
+
+	tm.mu.RLock("MatchTopics")
+	defer tm.mu.RUnlock("MatchTopics")
+
+	names := make([]string, 0)
+	for name := range tm.topics {
+		if matched, _ := path.Match(pattern, name); matched {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ExportSchemas will return the definitions of all of the topics, ordered by topic name.
+func (tm *topicManager) ExportSchemas() []TopicDefinition {
+	topics, _ := tm.ListTopics()
+
+	definitions := make([]TopicDefinition, 0, len(topics))
+	for _, topic := range topics {
+		definitions = append(definitions, TopicDefinition{
+			Name:           topic.NameWithLock(),
+			ValidationMode: topic.ValidationMode(),
+			Schemas:        topic.SchemaHistory(),
+		})
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	return definitions
+}
+
+// ImportSchemas will add topic definitions exported from another server. Topics that don't
+// exist are registered with the full schema history, and topics that do exist get the
+// versions appended that they don't already have a schema with the same hash for. All of the
+// definitions are checked before anything is imported. Returns error if any are invalid.
+func (tm *topicManager) ImportSchemas(definitions []TopicDefinition) (ImportResult, error) {
+	var result ImportResult
+
+	seen := make(map[string]bool, len(definitions))
+	for _, definition := range definitions {
+		if strings.TrimSpace(definition.Name) == "" {
+			return result, fmt.Errorf("cannot import topic with no name")
+		}
+		if seen[definition.Name] {
+			return result, fmt.Errorf("cannot import topic %s more than once", definition.Name)
+		}
+		seen[definition.Name] = true
+		if len(definition.Schemas) == 0 {
+			return result, fmt.Errorf("cannot import topic %s with no schemas", definition.Name)
+		}
+		if _, err := ParseValidationMode(string(definition.ValidationMode)); err != nil {
+			return result, fmt.Errorf("cannot import topic %s: %w", definition.Name, err)
+		}
+		if err := tm.checkTopicAllowed(definition.Name); err != nil && !tm.HasTopic(definition.Name) {
+			return result, fmt.Errorf("cannot import topic %s: %w", definition.Name, err)
+		}
+		for _, schema := range definition.Schemas {
+			if schema == nil {
+				return result, fmt.Errorf("cannot import topic %s with a null schema version", definition.Name)
+			}
+			if err := tm.checkNestingDepth(schema.Schema, "schema"); err != nil {
+				return result, fmt.Errorf("cannot import topic %s: %w", definition.Name, err)
+			}
+		}
+	}
+
+	// checked up front so an import that would go past the limit doesn't register some of its topics
+	if limit := tm.config.MaxTopics; limit > 0 {
+		tm.mu.RLock("ImportSchemas")
+		total := len(tm.topics)
+		for _, definition := range definitions {
+			if _, ok := tm.topics[definition.Name]; !ok {
+				total++
+			}
+		}
+		tm.mu.RUnlock("ImportSchemas")
+		if total > limit {
+			return result, fmt.Errorf("%w: importing would make %d topics, the max is %d", ErrTopicLimit, total, limit)
+		}
+	}
+
+	for _, definition := range definitions {
+		schemas := append([]*TopicSchema(nil), definition.Schemas...)
+		sort.SliceStable(schemas, func(i, j int) bool { return schemas[i].Version < schemas[j].Version })
+
+		tm.mu.RLock("ImportSchemas")
+		topic, ok := tm.topics[definition.Name]
+		tm.mu.RUnlock("ImportSchemas")
+
+		if !ok { // new topic, bring over the whole history as is
+			mode, _ := ParseValidationMode(string(definition.ValidationMode))
+			registered, err := tm.RegisterTopic(definition.Name, schemas[0].Schema, TopicOptions{ValidationMode: mode})
+			if err != nil {
+				return result, fmt.Errorf("couldn't import topic %s: %w", definition.Name, err)
+			}
+			result.TopicsCreated++
+			result.VersionsAdded++
+			for _, schema := range schemas[1:] {
+				registered.UpdateSchema(schema.Schema)
+				result.VersionsAdded++
+			}
+			continue
+		}
+
+		// existing topic, only append the versions it doesn't have yet
+		existing := make(map[string]bool)
+		for _, schema := range topic.SchemaHistory() {
+			existing[schema.Hash] = true
+		}
+		for _, schema := range schemas {
+			hash := SchemaHash(schema.Schema)
+			if existing[hash] {
+				continue
+			}
+			topic.UpdateSchema(schema.Schema)
+			existing[hash] = true
+			result.VersionsAdded++
+		}
+	}
+
+	log.WithFields(log.Fields{"method": "ImportSchemas", "topics_created": result.TopicsCreated, "versions_added": result.VersionsAdded}).Info("imported topic schemas")
+	return result, nil
+}
+
+// ListTopics will retreive all topics that are currently being used.
+func (tm *topicManager) ListTopics() ([]*Topic, error) {
+	tm.mu.RLock("ListTopics")
+	defer tm.mu.RUnlock("ListTopics")
+
+	topicsCopy := make([]*Topic, 0, len(tm.topics))
+	for _, t := range tm.topics {
+		topicsCopy = append(topicsCopy, t)
+	}
+
+	return topicsCopy, nil
+}
+
+func (tm *topicManager) UpdateSchema(topicName string, schema any) error {
+	if err := tm.checkNestingDepth(schema, "schema"); err != nil {
+		return err
+	}
+
+	tm.mu.RLock("UpdateSchema")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("UpdateSchema")
+
+	if !ok {
 		return fmt.Errorf("cannot update schema for topic %s. Topic doesn't exist", topicName)
 	}
 	topic.UpdateSchema(schema)
@@ -327,24 +1689,217 @@ func (tm *topicManager) getLatestSchemaForTopic(topicName string) (*TopicSchema,
 
 	schema, err := topic.GetLatestSchema()
 	if err != nil {
-		return nil, fmt.Errorf("could not get schema for topic with name: %s", topicName)
+		return nil, fmt.Errorf("could not get schema for topic with name: %s: %w", topicName, err)
 	}
 
 	return schema, nil
 }
 
+// RegisterTopicIfMissing will register the topic with the schema and options if it doesn't exist
+// yet, and leave an existing topic as it is. Returns true if the topic was registered.
+func (tm *topicManager) RegisterTopicIfMissing(topicName string, schema any, opts TopicOptions) (bool, error) {
+	if tm.HasTopic(topicName) {
+		return false, nil
+	}
+
+	_, created, err := tm.registerTopic(topicName, schema, opts)
+	if err != nil {
+		if errors.Is(err, ErrNestingTooDeep) || errors.Is(err, ErrTopicNotAllowed) || errors.Is(err, ErrTopicLimit) {
+			return false, err
+		}
+		// someone else registered it with a different schema since we looked, which is fine.
+		if tm.HasTopic(topicName) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !created { // someone else registered it with the same schema since we looked
+		return false, nil
+	}
+	log.WithFields(log.Fields{"method": "RegisterTopicIfMissing", "topic": topicName}).Info("registered missing topic")
+	return true, nil
+}
+
 // IsSchemaMatch will compare the current schema for a topic and the schema passed in to check
 // if the schema matches the current schema
-func (tm *topicManager) IsSchemaMatch(topicName string, schema map[string]any) (bool, error) {
+func (tm *topicManager) IsSchemaMatch(topicName string, schema any) (bool, error) {
 
 	currentSchema, err := tm.getLatestSchemaForTopic(topicName)
 	if err != nil { // can't get this topic's schema, that's no good.
 		return false, err
 	}
 
-	if !schemasMatch(schema, currentSchema.Schema) { // schemas don't match, get with it yo
+	if !schemasMatch(currentSchema.Schema, schema) { // schemas don't match, get with it yo
 		return false, fmt.Errorf("schema doesn't match topics current schema")
 	}
 
 	return true, nil
 }
+
+// ValidateSchema will check a candidate schema against the current schema of a topic, and check
+// the sample payload against the candidate if there is one, without changing the topic. The
+// current schema is treated as a payload, so the check uses the same rules as publishing: with
+// fill defaults, fields the candidate adds are filled in, and topics that don't validate strictly
+// accept any candidate. Returns error if the topic doesn't exist or either is nested too deep.
+func (tm *topicManager) ValidateSchema(topicName string, schema any, sample any) (SchemaCheck, error) {
+	var check SchemaCheck
+	if err := tm.checkNestingDepth(schema, "schema"); err != nil {
+		return check, err
+	}
+	if sample != nil {
+		if err := tm.checkNestingDepth(sample, "payload"); err != nil {
+			return check, err
+		}
+	}
+
+	tm.mu.RLock("ValidateSchema")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("ValidateSchema")
+	if !ok {
+		return check, fmt.Errorf("could not get topic by name: %s", topicName)
+	}
+	currentSchema, err := topic.GetLatestSchema()
+	if err != nil {
+		return check, fmt.Errorf("could not get schema for topic with name: %s", topicName)
+	}
+
+	topic.mu.RLock("ValidateSchema")
+	fillDefaults := topic.fillDefaults
+	topic.mu.RUnlock("ValidateSchema")
+	asPublished := func(payload any) any {
+		if fillDefaults {
+			return withDefaults(schema, payload)
+		}
+		return payload
+	}
+
+	check.Differences = schemaMismatches(schema, asPublished(currentSchema.Schema), "")
+	check.Compatible = len(check.Differences) == 0 || topic.ValidationMode() != ValidationStrict
+	if sample != nil {
+		check.SampleErrors = schemaMismatches(schema, asPublished(sample), "")
+		valid := len(check.SampleErrors) == 0
+		check.SampleValid = &valid
+	}
+	return check, nil
+}
+
+// ApplyDefaults will fill the fields that are missing from the payload with the values they have
+// in the latest schema of the topic, if the topic was registered to fill defaults. Nested objects
+// are filled too. The payload isn't changed, a filled copy is returned. Topics that don't fill
+// defaults get the payload back as is. Returns error if the topic doesn't exist.
+func (tm *topicManager) ApplyDefaults(topicName string, payload any) (any, error) {
+	tm.mu.RLock("ApplyDefaults")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("ApplyDefaults")
+	if !ok {
+		return nil, fmt.Errorf("could not get topic by name: %s", topicName)
+	}
+
+	topic.mu.RLock("ApplyDefaults")
+	fillDefaults := topic.fillDefaults
+	topic.mu.RUnlock("ApplyDefaults")
+	if !fillDefaults {
+		return payload, nil
+	}
+
+	currentSchema, err := topic.GetLatestSchema()
+	if err != nil { // nothing to fill from
+		return payload, nil
+	}
+	return withDefaults(currentSchema.Schema, payload), nil
+}
+
+// withDefaults will return a copy of the payload with the fields of the schema that are missing
+// from the payload added. Present fields are kept, even when null. Anything that isn't an object
+// in both the schema and the payload is returned as is.
+func withDefaults(schema, payload any) any {
+	schemaVal, ok := schema.(map[string]any)
+	if !ok {
+		return payload
+	}
+	payloadVal, ok := payload.(map[string]any)
+	if !ok {
+		return payload
+	}
+
+	filled := make(map[string]any, len(schemaVal))
+	for key, val := range payloadVal {
+		filled[key] = val
+	}
+	for key, defaultVal := range schemaVal {
+		if val, ok := payloadVal[key]; ok {
+			filled[key] = withDefaults(defaultVal, val)
+		} else {
+			filled[key] = copyJSONValue(defaultVal) // the schema can't be changed through the payload
+		}
+	}
+	return filled
+}
+
+// copyJSONValue will deep copy a value decoded from json.
+func copyJSONValue(value any) any {
+	switch val := value.(type) {
+	case map[string]any:
+		copied := make(map[string]any, len(val))
+		for key, field := range val {
+			copied[key] = copyJSONValue(field)
+		}
+		return copied
+	case []any:
+		copied := make([]any, len(val))
+		for i, item := range val {
+			copied[i] = copyJSONValue(item)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+// ValidatePayload will validate a payload against the latest schema for a topic according to
+// the validation mode of the topic. In strict mode a mismatch returns an error, in warn mode
+// the mismatches are returned as warnings, and in off mode nothing is checked.
+func (tm *topicManager) ValidatePayload(topicName string, payload any) ([]string, error) {
+	tm.mu.RLock("ValidatePayload")
+	topic, ok := tm.topics[topicName]
+	tm.mu.RUnlock("ValidatePayload")
+	if !ok {
+		return nil, fmt.Errorf("could not get topic by name: %s", topicName)
+	}
+	if err := topic.checkPayloadKind(payload); err != nil {
+		return nil, err
+	}
+	if topic.IsBinary() { // there's no schema for raw payloads
+		return nil, nil
+	}
+	if err := tm.checkNestingDepth(payload, "payload"); err != nil {
+		return nil, err
+	}
+	if topic.aggregator != nil { // checked whatever the validation mode, since they can't be aggregated otherwise
+		if err := topic.aggregator.check(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	mode := topic.ValidationMode()
+	if mode == ValidationOff {
+		return nil, nil
+	}
+
+	isMatch, err := tm.IsSchemaMatch(topicName, payload)
+	if isMatch {
+		return nil, nil
+	}
+	if mode != ValidationWarn {
+		return nil, err
+	}
+
+	currentSchema, schemaErr := topic.GetLatestSchema()
+	if schemaErr != nil { // no schema to compare against, just warn with the original error.
+		return []string{err.Error()}, nil
+	}
+	if warnings := schemaMismatches(currentSchema.Schema, payload, ""); len(warnings) > 0 {
+		return warnings, nil
+	}
+	return []string{err.Error()}, nil
+}
@@ -0,0 +1,2128 @@
+package topic
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/logging"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient will create a started client backed by a real websocket connection and
+// return the other end of the connection so the test can read what the client is sent.
+func newTestClient(t *testing.T, id string) (*network.Client, *websocket.Conn) {
+	serverConns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	remote, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { remote.Close() })
+
+	conn := <-serverConns
+	client := network.NewClient(conn, id)
+	client.Start()
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	return client, remote
+}
+
+// readMessage will read the next message sent to a test client.
+func readMessage(t *testing.T, remote *websocket.Conn) network.WebSocketMessage {
+	require.NoError(t, remote.SetReadDeadline(time.Now().Add(2*time.Second)))
+	var msg network.WebSocketMessage
+	require.NoError(t, remote.ReadJSON(&msg))
+	return msg
+}
+
+var validationSchema = map[string]any{
+	"name":  "",
+	"count": 0,
+}
+
+var mismatchedPayload = map[string]any{
+	"name":  "example",
+	"extra": true,
+}
+
+func TestValidatePayload_StrictRejectsMismatch(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("strict-topic", validationSchema, TopicOptions{ValidationMode: ValidationStrict})
+	require.NoError(t, err)
+
+	warnings, err := tm.ValidatePayload("strict-topic", mismatchedPayload)
+
+	assert.Error(t, err)
+	assert.Empty(t, warnings)
+
+	warnings, err = tm.ValidatePayload("strict-topic", map[string]any{"name": "example", "count": 1})
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestValidatePayload_WarnReturnsWarnings(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("warn-topic", validationSchema, TopicOptions{ValidationMode: ValidationWarn})
+	require.NoError(t, err)
+
+	warnings, err := tm.ValidatePayload("warn-topic", mismatchedPayload)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"missing field: count", "unexpected field: extra"}, warnings)
+}
+
+func TestValidatePayload_OffSkipsValidation(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("off-topic", validationSchema, TopicOptions{ValidationMode: ValidationOff})
+	require.NoError(t, err)
+
+	warnings, err := tm.ValidatePayload("off-topic", mismatchedPayload)
+
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestValidatePayload_DefaultsToStrict(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("default-topic", validationSchema, TopicOptions{})
+	require.NoError(t, err)
+
+	assert.Equal(t, ValidationStrict, topic.ValidationMode())
+}
+
+func TestValidatePayload_TopicWithNoSchema(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("no-schema", validationSchema, TopicOptions{})
+	require.NoError(t, err)
+	topic.schemas = make(map[int]*TopicSchema) // shouldn't happen, but a topic can't be published to like this
+
+	_, err = topic.GetLatestSchema()
+	assert.ErrorIs(t, err, ErrTopicHasNoSchema)
+
+	_, err = tm.ValidatePayload("no-schema", map[string]any{"name": "example", "count": 1})
+	assert.ErrorIs(t, err, ErrTopicHasNoSchema)
+	assert.Contains(t, err.Error(), "no-schema")
+
+	// giving the topic a schema fixes it
+	require.NoError(t, tm.UpdateSchema("no-schema", validationSchema))
+	warnings, err := tm.ValidatePayload("no-schema", map[string]any{"name": "example", "count": 1})
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestParseValidationMode(t *testing.T) {
+	mode, err := ParseValidationMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, ValidationStrict, mode)
+
+	mode, err = ParseValidationMode("warn")
+	assert.NoError(t, err)
+	assert.Equal(t, ValidationWarn, mode)
+
+	_, err = ParseValidationMode("sometimes")
+	assert.Error(t, err)
+}
+
+func TestRegisterTopic_IdenticalSchemaIsIdempotent(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	first, err := tm.RegisterTopic("hash-topic", map[string]any{"a": "", "b": map[string]any{"c": 0}}, TopicOptions{})
+	require.NoError(t, err)
+
+	// same schema, different key order in the literal
+	second, err := tm.RegisterTopic("hash-topic", map[string]any{"b": map[string]any{"c": 0}, "a": ""}, TopicOptions{})
+	require.NoError(t, err)
+
+	firstSchema, err := first.GetLatestSchema()
+	require.NoError(t, err)
+	secondSchema, err := second.GetLatestSchema()
+	require.NoError(t, err)
+
+	assert.Same(t, first, second)
+	assert.Equal(t, 0, secondSchema.Version)
+	assert.Equal(t, firstSchema.Hash, secondSchema.Hash)
+	assert.NotEmpty(t, secondSchema.Hash)
+}
+
+func TestRegisterTopic_ChangedSchemaIsDetected(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("hash-topic", map[string]any{"a": ""}, TopicOptions{})
+	require.NoError(t, err)
+
+	// same keys as before but different value type, which key-only comparison would miss
+	_, err = tm.RegisterTopic("hash-topic", map[string]any{"a": 0}, TopicOptions{})
+	assert.Error(t, err)
+
+	assert.NotEqual(t, SchemaHash(map[string]any{"a": ""}), SchemaHash(map[string]any{"a": 0}))
+}
+
+func TestTopicSchemaVersion(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, ok := tm.TopicSchemaVersion("missing")
+	assert.False(t, ok)
+
+	registerTopics(t, tm, "exists")
+	version, ok := tm.TopicSchemaVersion("exists")
+	assert.True(t, ok)
+	assert.Equal(t, 0, version)
+
+	require.NoError(t, tm.UpdateSchema("exists", map[string]any{"a": "", "b": ""}))
+	version, _ = tm.TopicSchemaVersion("exists")
+	assert.Equal(t, 1, version)
+}
+
+func TestRegisterTopicIfMissing_OnlyRegistersOnce(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registered, err := tm.RegisterTopicIfMissing("auto-topic", map[string]any{"a": ""}, TopicOptions{})
+	require.NoError(t, err)
+	assert.True(t, registered)
+
+	// a different schema doesn't fail or replace the existing one
+	registered, err = tm.RegisterTopicIfMissing("auto-topic", map[string]any{"a": 0}, TopicOptions{})
+	require.NoError(t, err)
+	assert.False(t, registered)
+
+	match, err := tm.IsSchemaMatch("auto-topic", map[string]any{"a": ""})
+	require.NoError(t, err)
+	assert.True(t, match)
+}
+
+func TestRegisterTopic_ConcurrentRegistersKeepOneTopic(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	const racers = 50
+	topics := make([]*Topic, racers)
+	created := make([]bool, racers)
+	var wg sync.WaitGroup
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				topic, err := tm.RegisterTopic("raced", map[string]any{"a": ""}, TopicOptions{TickInterval: time.Second})
+				assert.NoError(t, err)
+				topics[i] = topic
+			} else {
+				registered, err := tm.RegisterTopicIfMissing("raced", map[string]any{"a": ""}, TopicOptions{TickInterval: time.Second})
+				assert.NoError(t, err)
+				created[i] = registered
+			}
+		}()
+	}
+	wg.Wait()
+
+	kept := tm.(*topicManager).topics["raced"]
+	for i := 0; i < racers; i += 2 {
+		assert.Same(t, kept, topics[i], "every register should get the topic that was kept")
+	}
+	creators := 0
+	for i := 1; i < racers; i += 2 {
+		if created[i] {
+			creators++
+		}
+	}
+	assert.LessOrEqual(t, creators, 1, "only the register that won the race should say it registered the topic")
+}
+
+func TestRegisterTopic_AllowedTopicPatterns(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{AllowedTopicPatterns: []string{"app1/*", "shared"}})
+	schema := map[string]any{"a": ""}
+
+	for _, name := range []string{"app1/orders", "app1/", "shared"} {
+		_, err := tm.RegisterTopic(name, schema, TopicOptions{})
+		assert.NoError(t, err, name)
+	}
+
+	// * doesn't match across a /, and a pattern without wildcards has to match exactly
+	for _, name := range []string{"app2/orders", "app1/orders/eu", "sharedx", "app1"} {
+		_, err := tm.RegisterTopic(name, schema, TopicOptions{})
+		assert.ErrorIs(t, err, ErrTopicNotAllowed, name)
+		assert.False(t, tm.HasTopic(name), name)
+	}
+
+	_, err := tm.RegisterTopicIfMissing("app2/auto", schema, TopicOptions{})
+	assert.ErrorIs(t, err, ErrTopicNotAllowed)
+	assert.False(t, tm.HasTopic("app2/auto"))
+}
+
+func TestRegisterTopic_MaxTopics(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxTopics: 2})
+	schema := map[string]any{"a": ""}
+	registerTopics(t, tm, "one", "two")
+
+	_, err := tm.RegisterTopic("three", schema, TopicOptions{})
+	assert.ErrorIs(t, err, ErrTopicLimit)
+	assert.False(t, tm.HasTopic("three"))
+	_, err = tm.RegisterTopicIfMissing("three", schema, TopicOptions{})
+	assert.ErrorIs(t, err, ErrTopicLimit)
+
+	// the existing topics keep working
+	_, err = tm.RegisterTopic("one", schema, TopicOptions{})
+	assert.NoError(t, err)
+	msg := network.WebSocketMessage{MessageId: "limit", Action: "publish", Topic: "two"}
+	assert.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "b"}, nil))
+
+	// unregistering a topic makes room
+	require.NoError(t, tm.UnregisterTopic(context.Background(), "one"))
+	_, err = tm.RegisterTopic("three", schema, TopicOptions{})
+	assert.NoError(t, err)
+}
+
+func TestImportSchemas_MaxTopicsImportsNothing(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxTopics: 2})
+	registerTopics(t, tm, "one")
+
+	definitions := []TopicDefinition{
+		{Name: "one", Schemas: []*TopicSchema{{Schema: map[string]any{"a": ""}}}},
+		{Name: "two", Schemas: []*TopicSchema{{Schema: map[string]any{"a": ""}}}},
+		{Name: "three", Schemas: []*TopicSchema{{Schema: map[string]any{"a": ""}}}},
+	}
+	_, err := tm.ImportSchemas(definitions)
+	assert.ErrorIs(t, err, ErrTopicLimit)
+	assert.False(t, tm.HasTopic("two"))
+
+	// topics that already exist don't count against the limit
+	_, err = tm.ImportSchemas(definitions[:2])
+	assert.NoError(t, err)
+}
+
+func TestRegisterTopic_EmptyAllowlistAllowsAnyName(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("anything/at/all", map[string]any{"a": ""}, TopicOptions{})
+	assert.NoError(t, err)
+}
+
+func TestRenameTopic_AllowedTopicPatterns(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{AllowedTopicPatterns: []string{"app1/*"}})
+	_, err := tm.RegisterTopic("app1/old", map[string]any{"a": ""}, TopicOptions{})
+	require.NoError(t, err)
+
+	err = tm.RenameTopic(context.Background(), "app1/old", "app2/new")
+	assert.ErrorIs(t, err, ErrTopicNotAllowed)
+	assert.True(t, tm.HasTopic("app1/old"))
+
+	assert.NoError(t, tm.RenameTopic(context.Background(), "app1/old", "app1/new"))
+}
+
+func TestRenameTopic_SubscribersAndValueFollow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := storage.NewBadgerStorage()
+	require.NoError(t, db.Open(t.TempDir(), ctx))
+	defer db.Close()
+
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("old-topic", map[string]any{"message": ""}, TopicOptions{})
+	require.NoError(t, err)
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("old-topic", client, SubscriptionOptions{}))
+
+	value := map[string]any{"message": "hello"}
+	require.NoError(t, <-db.AsyncPut(ctx, "old-topic", value, time.Now().UTC(), time.Time{}))
+
+	require.NoError(t, tm.RenameTopic(ctx, "old-topic", "new-topic"))
+
+	// subscriber is told about the new name
+	notification := readMessage(t, remote)
+	assert.Equal(t, "renameTopic", notification.Action)
+	assert.Equal(t, "new-topic", notification.Topic)
+	var data map[string]string
+	require.NoError(t, json.Unmarshal(notification.Data, &data))
+	assert.Equal(t, map[string]string{"oldName": "old-topic", "newName": "new-topic"}, data)
+
+	// subscribers moved with the topic
+	subscribers, err := tm.ListSubscribersForTopic("new-topic")
+	require.NoError(t, err)
+	assert.Equal(t, []*network.Client{client}, subscribers)
+	_, err = tm.ListSubscribersForTopic("old-topic")
+	assert.Error(t, err)
+
+	// stored value moved with the topic
+	stored, err := tm.Get(ctx, "new-topic")
+	require.NoError(t, err)
+	assert.Equal(t, value, stored)
+}
+
+func TestRenameTopic_RejectsExistingTarget(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("first", map[string]any{"a": ""}, TopicOptions{})
+	require.NoError(t, err)
+	_, err = tm.RegisterTopic("second", map[string]any{"a": ""}, TopicOptions{})
+	require.NoError(t, err)
+
+	err = tm.RenameTopic(context.Background(), "first", "second")
+	assert.Error(t, err)
+
+	topics, err := tm.ListTopics()
+	require.NoError(t, err)
+	assert.Len(t, topics, 2)
+}
+
+func TestRenameTopic_StorageFailureKeepsTopic(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	db.Fail("Rename", errors.New("disk full"))
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "old-topic")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("old-topic", client, SubscriptionOptions{}))
+	received := receiveMessages(remote)
+
+	err := tm.RenameTopic(context.Background(), "old-topic", "new-topic")
+	assert.Error(t, err)
+
+	assert.True(t, tm.HasTopic("old-topic"))
+	assert.False(t, tm.HasTopic("new-topic"))
+	subscribers, err := tm.ListSubscribersForTopic("old-topic")
+	require.NoError(t, err)
+	assert.Equal(t, []*network.Client{client}, subscribers)
+	expectNothing(t, received)
+}
+
+func TestRenameTopic_MissingTopic(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	assert.Error(t, tm.RenameTopic(context.Background(), "missing", "new-name"))
+}
+
+func TestRenameTopic_AlongsideTransactions(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "a", "m")
+	sender := network.NewClient(nil, "publisher")
+	msg := network.WebSocketMessage{MessageId: "tx", Action: "publishTransaction"}
+
+	// "a" keeps being renamed to sort before and after "m", so transactions locking both would
+	// take their locks in opposite orders if they were taken by name
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for names := [2]string{"a", "z"}; ; names[0], names[1] = names[1], names[0] {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.NoError(t, tm.RenameTopic(context.Background(), names[0], names[1]))
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for _, renamed := range []string{"a", "z"} { // whichever name it has now
+					values := []TopicValue{{Topic: "m", Value: map[string]any{"a": "x"}}, {Topic: renamed, Value: map[string]any{"a": "x"}}}
+					if tm.PublishTransaction(context.Background(), msg, sender, values) == nil {
+						break
+					}
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(stop)
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("transactions and renames deadlocked")
+	}
+}
+
+func TestValidatePayload_ArrayPayload(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("list-topic", []any{map[string]any{"name": ""}}, TopicOptions{})
+	require.NoError(t, err)
+
+	_, err = tm.ValidatePayload("list-topic", []any{
+		map[string]any{"name": "first"},
+		map[string]any{"name": "second"},
+	})
+	assert.NoError(t, err)
+
+	_, err = tm.ValidatePayload("list-topic", []any{}) // empty list is still a list
+	assert.NoError(t, err)
+
+	_, err = tm.ValidatePayload("list-topic", map[string]any{"name": "not a list"})
+	assert.Error(t, err)
+
+	_, err = tm.ValidatePayload("list-topic", []any{map[string]any{"wrong": "field"}})
+	assert.Error(t, err)
+}
+
+func TestValidatePayload_ArrayWarnings(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("list-topic", map[string]any{"items": []any{map[string]any{"id": 0}}}, TopicOptions{ValidationMode: ValidationWarn})
+	require.NoError(t, err)
+
+	warnings, err := tm.ValidatePayload("list-topic", map[string]any{"items": []any{
+		map[string]any{"id": 1},
+		map[string]any{"name": "no id"},
+	}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"missing field: items[1].id", "unexpected field: items[1].name"}, warnings)
+}
+
+func TestPublish_ArrayPayloadDeliveredAndPersisted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := storage.NewBadgerStorage()
+	require.NoError(t, db.Open(t.TempDir(), ctx))
+	defer db.Close()
+
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("list-topic", []any{}, TopicOptions{})
+	require.NoError(t, err)
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("list-topic", client, SubscriptionOptions{}))
+
+	value := []any{"a", "b", float64(3)}
+	errCh := make(chan error, 1)
+	msg := network.WebSocketMessage{MessageId: "array", Action: "publish", Topic: "list-topic"}
+	require.NoError(t, tm.Publish(ctx, msg, client, value, errCh))
+	require.NoError(t, <-errCh)
+
+	delivered := readMessage(t, remote)
+	assert.JSONEq(t, `["a","b",3]`, string(delivered.Data))
+
+	stored, err := tm.Get(ctx, "list-topic")
+	require.NoError(t, err)
+	assert.Equal(t, value, stored)
+}
+
+func TestPublish_RedactedFieldsNotLogged(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.StandardLogger()
+	output, hooks := logger.Out, logger.ReplaceHooks(make(log.LevelHooks))
+	logger.SetOutput(&out)
+	logger.AddHook(logging.NewRedactionHook([]string{"password"}))
+	t.Cleanup(func() {
+		logger.SetOutput(output)
+		logger.ReplaceHooks(hooks)
+	})
+
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("accounts", map[string]any{"user": "", "password": ""}, TopicOptions{})
+	require.NoError(t, err)
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "accounts"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"user": "ana", "password": "hunter2"}, nil))
+
+	assert.Contains(t, out.String(), "calling async put on database")
+	assert.Contains(t, out.String(), "ana")
+	assert.NotContains(t, out.String(), "hunter2")
+}
+
+func TestPublish_BinaryPayloadDeliveredAsBinaryFrame(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("thumbnails", map[string]any{}, TopicOptions{Binary: true})
+	require.NoError(t, err)
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("thumbnails", client, SubscriptionOptions{}))
+
+	payload := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	msg := network.WebSocketMessage{MessageId: "thumb", Action: "publish", Topic: "thumbnails"}
+	require.NoError(t, tm.Publish(context.Background(), msg, client, payload, nil))
+
+	require.NoError(t, remote.SetReadDeadline(time.Now().Add(2*time.Second)))
+	frameType, frame, err := remote.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, frameType)
+	delivered, err := network.ParseBinaryFrame(frame)
+	require.NoError(t, err)
+	assert.Equal(t, "thumb", delivered.MessageId)
+	assert.NotNil(t, delivered.Timestamp)
+	assert.Equal(t, payload, delivered.Binary)
+
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 1)
+	assert.Equal(t, payload, puts[0].Value)
+}
+
+func TestPublish_PayloadMustMatchBinaryTopic(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("thumbnails", map[string]any{}, TopicOptions{Binary: true})
+	require.NoError(t, err)
+	registerTopics(t, tm, "json-topic")
+
+	_, err = tm.ValidatePayload("thumbnails", map[string]any{"a": ""})
+	assert.Error(t, err)
+	_, err = tm.ValidatePayload("json-topic", []byte("raw"))
+	assert.Error(t, err)
+	warnings, err := tm.ValidatePayload("thumbnails", []byte("raw"))
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "json-topic"}
+	assert.Error(t, tm.Publish(context.Background(), msg, nil, []byte("raw"), nil))
+	err = tm.PublishTransaction(context.Background(), msg, nil, []TopicValue{{Topic: "thumbnails", Value: map[string]any{"a": ""}}})
+	assert.Error(t, err)
+}
+
+func TestPublish_CompressedAndUncompressedTopics(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{GetReadThrough: true})
+	_, err := tm.RegisterTopic("reports", map[string]any{"body": ""}, TopicOptions{Compressed: true})
+	require.NoError(t, err)
+	registerTopics(t, tm, "ticks")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("reports", client, SubscriptionOptions{}))
+	require.NoError(t, tm.Subscribe("ticks", client, SubscriptionOptions{}))
+
+	report := map[string]any{"body": strings.Repeat("all quiet. ", 100)}
+	msg := network.WebSocketMessage{MessageId: "report", Action: "publish", Topic: "reports"}
+	require.NoError(t, tm.Publish(context.Background(), msg, client, report, nil))
+	tick := map[string]any{"a": "tick"}
+	msg = network.WebSocketMessage{MessageId: "tick", Action: "publish", Topic: "ticks"}
+	require.NoError(t, tm.Publish(context.Background(), msg, client, tick, nil))
+
+	// the compressed topic is sent as a binary frame with the gzipped json after the header
+	require.NoError(t, remote.SetReadDeadline(time.Now().Add(2*time.Second)))
+	frameType, frame, err := remote.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, frameType)
+	delivered, err := network.ParseBinaryFrame(frame)
+	require.NoError(t, err)
+	assert.Equal(t, ENCODING_GZIP, delivered.Encoding)
+	assert.Less(t, len(delivered.Binary), len(report["body"].(string)))
+	payload, err := decompressPayload(delivered.Binary)
+	require.NoError(t, err)
+	raw, err := json.Marshal(report)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(raw), string(payload))
+
+	// the other topic is sent as json like before
+	delivered = readMessage(t, remote)
+	assert.Equal(t, "ticks", delivered.Topic)
+	assert.Empty(t, delivered.Encoding)
+	assert.JSONEq(t, `{"a": "tick"}`, string(delivered.Data))
+
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 2)
+	assert.IsType(t, []byte{}, puts[0].Value, "expected the compressed value to be stored compressed")
+	assert.Equal(t, tick, puts[1].Value)
+
+	// values are decompressed when they're read back
+	value, err := tm.Get(context.Background(), "reports")
+	require.NoError(t, err)
+	assert.Equal(t, report, value)
+	value, err = tm.Get(context.Background(), "ticks")
+	require.NoError(t, err)
+	assert.Equal(t, tick, value)
+	recent, err := tm.GetRecent(context.Background(), "reports", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []any{report}, recent)
+}
+
+func TestDecompressValue_StoredAsBase64(t *testing.T) {
+	topic := NewTopic("reports", nil, TopicOptions{Compressed: true})
+	compressed, err := topic.compressValue(map[string]any{"body": "hi"}, []byte(`{"body":"hi"}`))
+	require.NoError(t, err)
+
+	// storage that keeps values as json gives the compressed bytes back as base64
+	value, err := topic.decompressValue(base64.StdEncoding.EncodeToString(compressed))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"body": "hi"}, value)
+
+	_, err = topic.decompressValue(map[string]any{"body": "hi"})
+	assert.Error(t, err, "expected a value that was never compressed to fail")
+}
+
+func registerTopics(t *testing.T, tm TopicManager, names ...string) {
+	for _, name := range names {
+		_, err := tm.RegisterTopic(name, map[string]any{"a": ""}, TopicOptions{})
+		require.NoError(t, err)
+	}
+}
+
+func TestSubscribe_LimitBoundary(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxSubscriptionsPerClient: 2})
+	registerTopics(t, tm, "one", "two", "three")
+	client := network.NewClient(nil, "limited")
+
+	require.NoError(t, tm.Subscribe("one", client, SubscriptionOptions{}))
+	require.NoError(t, tm.Subscribe("two", client, SubscriptionOptions{}))
+
+	// at the limit, resubscribing to a topic already subscribed to doesn't use budget
+	assert.NoError(t, tm.Subscribe("two", client, SubscriptionOptions{Conflate: true}))
+
+	err := tm.Subscribe("three", client, SubscriptionOptions{})
+	assert.ErrorIs(t, err, ErrSubscriptionLimit)
+
+	// other clients have their own budget
+	assert.NoError(t, tm.Subscribe("three", network.NewClient(nil, "other"), SubscriptionOptions{}))
+}
+
+func TestStats_CountsTopicsAndSubscriptions(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "one", "two", "three")
+	first, second := network.NewClient(nil, "first"), network.NewClient(nil, "second")
+
+	require.NoError(t, tm.Subscribe("one", first, SubscriptionOptions{}))
+	require.NoError(t, tm.Subscribe("two", first, SubscriptionOptions{}))
+	require.NoError(t, tm.Subscribe("two", first, SubscriptionOptions{})) // resubscribing isn't a new subscription
+	require.NoError(t, tm.Subscribe("one", second, SubscriptionOptions{}))
+	assert.Equal(t, ManagerStats{TopicCount: 3, SubscriptionCount: 3}, tm.Stats())
+
+	require.NoError(t, tm.Unsubscribe("one", first))
+	require.NoError(t, tm.UnregisterTopic(context.Background(), "two"))
+	tm.UnsubscribeAll(first) // already has no subscriptions left
+	assert.Equal(t, ManagerStats{TopicCount: 2, SubscriptionCount: 1}, tm.Stats())
+}
+
+func TestSubscribe_UnsubscribeFreesBudget(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxSubscriptionsPerClient: 1})
+	registerTopics(t, tm, "one", "two", "three")
+	client := network.NewClient(nil, "limited")
+
+	require.NoError(t, tm.Subscribe("one", client, SubscriptionOptions{}))
+	require.ErrorIs(t, tm.Subscribe("two", client, SubscriptionOptions{}), ErrSubscriptionLimit)
+
+	require.NoError(t, tm.Unsubscribe("one", client))
+	require.NoError(t, tm.Subscribe("two", client, SubscriptionOptions{}))
+
+	tm.UnsubscribeAll(client)
+	require.NoError(t, tm.Subscribe("three", client, SubscriptionOptions{}))
+
+	require.NoError(t, tm.UnregisterTopic(context.Background(), "three"))
+	assert.NoError(t, tm.Subscribe("one", client, SubscriptionOptions{}))
+}
+
+func TestUnsubscribePattern_LeavesOtherSubscriptions(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "sensors/temp", "sensors/humidity", "sensors/outside/temp", "sensors/wind", "alerts")
+	client := network.NewClient(nil, "subscriber")
+	for _, name := range []string{"sensors/temp", "sensors/humidity", "sensors/outside/temp", "alerts"} {
+		require.NoError(t, tm.Subscribe(name, client, SubscriptionOptions{}))
+	}
+
+	// sensors/wind matches but isn't subscribed to, so it isn't in the removed names
+	removed, err := tm.UnsubscribePattern(client, "sensors/*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sensors/humidity", "sensors/temp"}, removed)
+
+	subscriptions := tm.Subscriptions(client)
+	assert.Len(t, subscriptions, 2)
+	assert.Contains(t, subscriptions, "sensors/outside/temp")
+	assert.Contains(t, subscriptions, "alerts")
+	assert.Equal(t, ManagerStats{TopicCount: 5, SubscriptionCount: 2}, tm.Stats())
+
+	removed, err = tm.UnsubscribePattern(client, "sensors/*")
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	_, err = tm.UnsubscribePattern(client, "sensors/[")
+	assert.Error(t, err)
+	assert.Equal(t, ManagerStats{TopicCount: 5, SubscriptionCount: 2}, tm.Stats())
+}
+
+// drainFailedClients will read the queued failed clients until none are left.
+func drainFailedClients(tm *topicManager) int {
+	drained := 0
+	for {
+		select {
+		case <-tm.failedClients:
+			drained++
+		default:
+			return drained
+		}
+	}
+}
+
+func TestMarkClientFailed_FloodCountsDrops(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{FailedClientsBuffer: 5}).(*topicManager)
+	client := network.NewClient(nil, "failing")
+
+	// nothing drains the queue, so everything past the buffer is dropped right away
+	for range 20 {
+		tm.markClientFailed(client)
+	}
+
+	assert.Equal(t, 5, drainFailedClients(tm))
+	assert.Equal(t, int64(15), tm.Stats().DroppedFailedClients)
+}
+
+func TestMarkClientFailed_WaitsForListener(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{FailedClientsBuffer: 2, FailedClientsWait: time.Second}).(*topicManager)
+	client := network.NewClient(nil, "failing")
+
+	received := make(chan int)
+	go func() {
+		count := 0
+		for count < 50 {
+			tm.NextFailedClient()
+			count++
+			time.Sleep(time.Millisecond) // slower than the failures come in, so the queue fills
+		}
+		received <- count
+	}()
+
+	for range 50 {
+		tm.markClientFailed(client)
+	}
+
+	assert.Equal(t, 50, <-received)
+	assert.Equal(t, int64(0), tm.Stats().DroppedFailedClients)
+}
+
+func TestMarkClientFailed_DropsAfterWait(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{FailedClientsBuffer: 1, FailedClientsWait: 20 * time.Millisecond}).(*topicManager)
+	client := network.NewClient(nil, "failing")
+
+	tm.markClientFailed(client)
+	start := time.Now()
+	tm.markClientFailed(client)
+
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Equal(t, 1, drainFailedClients(tm))
+	assert.Equal(t, int64(1), tm.Stats().DroppedFailedClients)
+}
+
+func TestSubscribe_ZeroIsUnlimited(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	client := network.NewClient(nil, "unlimited")
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("topic-%d", i)
+		registerTopics(t, tm, name)
+		require.NoError(t, tm.Subscribe(name, client, SubscriptionOptions{}))
+	}
+}
+
+func TestPublish_SubscribersGetServerTimestamp(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "timestamped")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("timestamped", client, SubscriptionOptions{}))
+
+	before := time.Now().UTC()
+	msg := network.WebSocketMessage{MessageId: "persisted", Action: "publish", Topic: "timestamped"}
+	require.NoError(t, tm.Publish(context.Background(), msg, client, map[string]any{"a": "1"}, nil))
+	msg = network.WebSocketMessage{MessageId: "not-persisted", Action: "sendWithoutSave", Topic: "timestamped"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, client, map[string]any{"a": "2"}, nil))
+
+	for _, id := range []string{"persisted", "not-persisted"} {
+		delivered := readMessage(t, remote)
+		assert.Equal(t, id, delivered.MessageId)
+		require.NotNil(t, delivered.Timestamp)
+		assert.False(t, delivered.Timestamp.IsZero())
+		assert.False(t, delivered.Timestamp.Before(before.Truncate(time.Millisecond)))
+	}
+}
+
+func TestPublish_EchoToSubscribedSender(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "echo")
+
+	publisher, publisherRemote := newTestClient(t, "publisher")
+	require.NoError(t, tm.Subscribe("echo", publisher, SubscriptionOptions{}))
+
+	msg := network.WebSocketMessage{MessageId: "own-publish", Action: "publish", Topic: "echo"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"a": "1"}, nil))
+
+	assert.Equal(t, "own-publish", readMessage(t, publisherRemote).MessageId)
+}
+
+func TestPublish_NoEchoSkipsSender(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "no-echo")
+
+	publisher, publisherRemote := newTestClient(t, "publisher")
+	other, otherRemote := newTestClient(t, "other")
+	require.NoError(t, tm.Subscribe("no-echo", publisher, SubscriptionOptions{NoEcho: true}))
+	require.NoError(t, tm.Subscribe("no-echo", other, SubscriptionOptions{}))
+
+	msg := network.WebSocketMessage{MessageId: "own-publish", Action: "publish", Topic: "no-echo"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"a": "1"}, nil))
+	assert.Equal(t, "own-publish", readMessage(t, otherRemote).MessageId)
+
+	// the publisher should still get what other clients publish, and that should be the
+	// first thing it sees since its own publish was skipped
+	msg = network.WebSocketMessage{MessageId: "other-publish", Action: "publish", Topic: "no-echo"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, other, map[string]any{"a": "2"}, nil))
+	assert.Equal(t, "other-publish", readMessage(t, publisherRemote).MessageId)
+}
+
+// valueStorage is a null storage that has a value stored for every key.
+type valueStorage struct {
+	*storage.NullStorage
+}
+
+func (s *valueStorage) Get(ctx context.Context, key string) (any, error) {
+	return map[string]any{"stored": true}, nil
+}
+
+func TestPause_NothingDeliveredUntilResume(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "paused")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("paused", client, SubscriptionOptions{}))
+	require.NoError(t, tm.Pause("paused", client, false))
+
+	publisher := network.NewClient(nil, "publisher")
+	for i := range 3 {
+		msg := network.WebSocketMessage{MessageId: fmt.Sprintf("while-paused-%d", i), Action: "publish", Topic: "paused"}
+		require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"a": "1"}, nil))
+	}
+
+	// still subscribed, so resuming picks up where it left off without subscribing again
+	subscribers, err := tm.ListSubscribersForTopic("paused")
+	require.NoError(t, err)
+	assert.Equal(t, []*network.Client{client}, subscribers)
+
+	require.NoError(t, tm.Resume("paused", client))
+	msg := network.WebSocketMessage{MessageId: "after-resume", Action: "publish", Topic: "paused"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"a": "2"}, nil))
+
+	// the first thing the subscriber sees is what was published after it resumed
+	assert.Equal(t, "after-resume", readMessage(t, remote).MessageId)
+}
+
+func TestPause_KeepLatestDeliveredOnResume(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "paused")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("paused", client, SubscriptionOptions{}))
+	require.NoError(t, tm.Pause("paused", client, true))
+
+	publisher := network.NewClient(nil, "publisher")
+	for i := range 3 {
+		msg := network.WebSocketMessage{MessageId: fmt.Sprintf("while-paused-%d", i), Action: "publish", Topic: "paused"}
+		require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"i": i}, nil))
+	}
+
+	require.NoError(t, tm.Resume("paused", client))
+	msg := network.WebSocketMessage{MessageId: "after-resume", Action: "publish", Topic: "paused"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, publisher, map[string]any{"i": 3}, nil))
+
+	// only the latest value from while it was paused is kept, then delivery carries on
+	assert.Equal(t, "while-paused-2", readMessage(t, remote).MessageId)
+	assert.Equal(t, "after-resume", readMessage(t, remote).MessageId)
+}
+
+func TestPause_NotCountedInDeliveryStats(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "paused")
+
+	paused, _ := newTestClient(t, "paused")
+	active, _ := newTestClient(t, "active")
+	require.NoError(t, tm.Subscribe("paused", paused, SubscriptionOptions{}))
+	require.NoError(t, tm.Subscribe("paused", active, SubscriptionOptions{}))
+	require.NoError(t, tm.Pause("paused", paused, false))
+
+	result := &network.RequestResult{}
+	msg := network.WebSocketMessage{MessageId: "stats", Action: "publish", Topic: "paused", Result: result}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+	assert.Equal(t, network.DeliveryStats{Targeted: 1, Delivered: 1}, result.Delivery())
+}
+
+func TestPause_RequiresSubscription(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "topic")
+	client := network.NewClient(nil, "client")
+
+	assert.ErrorIs(t, tm.Pause("topic", client, false), ErrNotSubscribed)
+	assert.ErrorIs(t, tm.Resume("topic", client), ErrNotSubscribed)
+	assert.Error(t, tm.Pause("missing", client, false))
+
+	// unsubscribing drops the pause, so subscribing again starts unpaused
+	require.NoError(t, tm.Subscribe("topic", client, SubscriptionOptions{}))
+	require.NoError(t, tm.Pause("topic", client, false))
+	require.NoError(t, tm.Unsubscribe("topic", client))
+	require.NoError(t, tm.Subscribe("topic", client, SubscriptionOptions{}))
+	topics, err := tm.ListTopics()
+	require.NoError(t, err)
+	assert.False(t, topics[0].IsPaused(client))
+}
+
+func TestLastUpdated_SetByPersistedPublishOnly(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("updated", map[string]any{"a": ""}, TopicOptions{})
+	require.NoError(t, err)
+
+	hasValue, lastUpdated := topic.LastUpdated()
+	assert.False(t, hasValue)
+	assert.Nil(t, lastUpdated)
+
+	sender := network.NewClient(nil, "publisher")
+	msg := network.WebSocketMessage{MessageId: "not-persisted", Action: "sendWithoutSave", Topic: "updated"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, sender, map[string]any{"a": "1"}, nil))
+	hasValue, lastUpdated = topic.LastUpdated()
+	assert.False(t, hasValue)
+	assert.Nil(t, lastUpdated)
+
+	before := time.Now().UTC()
+	msg = network.WebSocketMessage{MessageId: "persisted", Action: "publish", Topic: "updated"}
+	require.NoError(t, tm.Publish(context.Background(), msg, sender, map[string]any{"a": "2"}, nil))
+	hasValue, lastUpdated = topic.LastUpdated()
+	assert.True(t, hasValue)
+	require.NotNil(t, lastUpdated)
+	assert.False(t, lastUpdated.Before(before))
+}
+
+func TestLastUpdated_ValueStoredBeforeRegister(t *testing.T) {
+	tm := NewTopicManager(&valueStorage{NullStorage: storage.NewNullStorage()}, &config.Config{})
+	topic, err := tm.RegisterTopic("restored", map[string]any{"stored": true}, TopicOptions{})
+	require.NoError(t, err)
+
+	hasValue, lastUpdated := topic.LastUpdated()
+	assert.True(t, hasValue)
+	assert.Nil(t, lastUpdated)
+}
+
+// nestedValue will build an object nested the given number of levels deep.
+func nestedValue(depth int) any {
+	var value any = "leaf"
+	for i := 0; i < depth; i++ {
+		value = map[string]any{"child": value}
+	}
+	return value
+}
+
+func TestNestingDepth(t *testing.T) {
+	assert.Equal(t, 0, NestingDepth("scalar"))
+	assert.Equal(t, 1, NestingDepth(map[string]any{}))
+	assert.Equal(t, 1, NestingDepth([]any{}))
+	assert.Equal(t, 3, NestingDepth([]any{map[string]any{"a": []any{1}}, "b"}))
+	assert.Equal(t, 500, NestingDepth(nestedValue(500)))
+}
+
+func TestNestingDepth_PayloadOverLimitRejected(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxNestingDepth: 5})
+	_, err := tm.RegisterTopic("deep", nestedValue(5), TopicOptions{ValidationMode: ValidationOff})
+	require.NoError(t, err)
+
+	_, err = tm.ValidatePayload("deep", nestedValue(5))
+	assert.NoError(t, err)
+
+	_, err = tm.ValidatePayload("deep", nestedValue(6))
+	assert.ErrorIs(t, err, ErrNestingTooDeep)
+}
+
+func TestNestingDepth_SchemaOverLimitRejected(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxNestingDepth: 5})
+
+	_, err := tm.RegisterTopic("deep", nestedValue(6), TopicOptions{})
+	assert.ErrorIs(t, err, ErrNestingTooDeep)
+
+	_, err = tm.RegisterTopic("shallow", nestedValue(2), TopicOptions{})
+	require.NoError(t, err)
+	assert.ErrorIs(t, tm.UpdateSchema("shallow", nestedValue(6)), ErrNestingTooDeep)
+}
+
+func TestMatchTopics_Glob(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "sensors/temp", "sensors/humidity", "sensors/outside/temp", "alerts")
+
+	names, err := tm.MatchTopics("sensors/*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sensors/humidity", "sensors/temp"}, names)
+
+	names, err = tm.MatchTopics("*/temp")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sensors/temp"}, names)
+
+	names, err = tm.MatchTopics("nothing*")
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	_, err = tm.MatchTopics("sensors/[")
+	assert.Error(t, err)
+}
+
+func TestGetMany_ReturnsValuesByTopic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db, err := storage.NewStorage(&config.Config{StorageType: "badger", StoragePath: t.TempDir()}, ctx)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "sensors/temp", "sensors/humidity", "sensors/empty")
+
+	sender := network.NewClient(nil, "publisher")
+	for name, value := range map[string]any{"sensors/temp": 21.5, "sensors/humidity": 40.0} {
+		errCh := make(chan error, 1)
+		msg := network.WebSocketMessage{MessageId: name, Action: "publish", Topic: name}
+		require.NoError(t, tm.Publish(ctx, msg, sender, map[string]any{"value": value}, errCh))
+		require.NoError(t, <-errCh)
+	}
+
+	names, err := tm.MatchTopics("sensors/*")
+	require.NoError(t, err)
+	values, err := tm.GetMany(ctx, names)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"sensors/temp":     map[string]any{"value": 21.5},
+		"sensors/humidity": map[string]any{"value": 40.0},
+		"sensors/empty":    nil,
+	}, values)
+
+	_, err = tm.GetMany(ctx, []string{"sensors/temp", "missing"})
+	assert.Error(t, err)
+}
+
+// newRegistry will create a topic manager with several topics that have several schema versions.
+func newRegistry(t *testing.T) TopicManager {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+
+	_, err := tm.RegisterTopic("orders", map[string]any{"id": ""}, TopicOptions{})
+	require.NoError(t, err)
+	require.NoError(t, tm.UpdateSchema("orders", map[string]any{"id": "", "total": 0}))
+	require.NoError(t, tm.UpdateSchema("orders", map[string]any{"id": "", "total": 0, "items": []any{map[string]any{"sku": ""}}}))
+
+	_, err = tm.RegisterTopic("metrics", []any{map[string]any{"name": ""}}, TopicOptions{ValidationMode: ValidationWarn})
+	require.NoError(t, err)
+	return tm
+}
+
+func TestExportImportSchemas_RoundTrip(t *testing.T) {
+	source := newRegistry(t)
+	exported := source.ExportSchemas()
+	require.Len(t, exported, 2)
+	assert.Equal(t, "metrics", exported[0].Name)
+	assert.Equal(t, "orders", exported[1].Name)
+	require.Len(t, exported[1].Schemas, 3)
+	for i, schema := range exported[1].Schemas {
+		assert.Equal(t, i, schema.Version)
+	}
+
+	target := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	result, err := target.ImportSchemas(exported)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{TopicsCreated: 2, VersionsAdded: 4}, result)
+	assert.Equal(t, exported, target.ExportSchemas())
+
+	// importing the same registry again doesn't add anything
+	result, err = target.ImportSchemas(exported)
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{}, result)
+}
+
+func TestImportSchemas_AppendsMissingVersions(t *testing.T) {
+	target := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := target.RegisterTopic("orders", map[string]any{"id": ""}, TopicOptions{})
+	require.NoError(t, err)
+	require.NoError(t, target.UpdateSchema("orders", map[string]any{"local": true}))
+
+	result, err := target.ImportSchemas(newRegistry(t).ExportSchemas())
+	require.NoError(t, err)
+	assert.Equal(t, ImportResult{TopicsCreated: 1, VersionsAdded: 3}, result) // metrics, plus 2 new orders versions
+
+	var orders TopicDefinition
+	for _, definition := range target.ExportSchemas() {
+		if definition.Name == "orders" {
+			orders = definition
+		}
+	}
+	require.Len(t, orders.Schemas, 4)
+	assert.Equal(t, map[string]any{"local": true}, orders.Schemas[1].Schema)
+	assert.Equal(t, map[string]any{"id": "", "total": 0}, orders.Schemas[2].Schema)
+	assert.Equal(t, 3, orders.Schemas[3].Version)
+}
+
+func TestImportSchemas_InvalidDefinitionImportsNothing(t *testing.T) {
+	target := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := target.ImportSchemas([]TopicDefinition{
+		{Name: "good", Schemas: []*TopicSchema{{Version: 0, Schema: map[string]any{"a": ""}}}},
+		{Name: "bad"},
+	})
+	assert.Error(t, err)
+	assert.Empty(t, target.ExportSchemas())
+}
+
+func TestImportSchemas_DisallowedNameImportsNothing(t *testing.T) {
+	target := NewTopicManager(storage.NewNullStorage(), &config.Config{AllowedTopicPatterns: []string{"app1/*"}})
+	schemas := []*TopicSchema{{Version: 0, Schema: map[string]any{"a": ""}}}
+	_, err := target.ImportSchemas([]TopicDefinition{
+		{Name: "app1/orders", Schemas: schemas},
+		{Name: "app2/orders", Schemas: schemas},
+	})
+	assert.ErrorIs(t, err, ErrTopicNotAllowed)
+	assert.Empty(t, target.ExportSchemas())
+}
+
+func TestPublish_CancelledContextNoDeliveryOrWrite(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "cancelled")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("cancelled", client, SubscriptionOptions{}))
+	sender := network.NewClient(nil, "publisher")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	msg := network.WebSocketMessage{MessageId: "cancelled", Action: "publish", Topic: "cancelled"}
+	err := tm.Publish(ctx, msg, sender, map[string]any{"a": "1"}, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	msg = network.WebSocketMessage{MessageId: "cancelled-unsaved", Action: "sendWithoutSave", Topic: "cancelled"}
+	assert.ErrorIs(t, tm.SendWithoutSave(ctx, msg, sender, map[string]any{"a": "2"}, nil), context.Canceled)
+
+	assert.Empty(t, putValues(db))
+	hasValue, _ := tm.(*topicManager).topics["cancelled"].LastUpdated()
+	assert.False(t, hasValue)
+
+	// the next message the subscriber gets should be the one after the cancelled publishes
+	msg = network.WebSocketMessage{MessageId: "live", Action: "publish", Topic: "cancelled"}
+	require.NoError(t, tm.Publish(context.Background(), msg, sender, map[string]any{"a": "3"}, nil))
+	assert.Equal(t, "live", readMessage(t, remote).MessageId)
+	assert.Len(t, putValues(db), 1)
+}
+
+func TestPublish_SubscribersGetSchemaVersion(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("versioned", map[string]any{"a": ""}, TopicOptions{})
+	require.NoError(t, err)
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("versioned", client, SubscriptionOptions{}))
+	sender := network.NewClient(nil, "publisher")
+
+	msg := network.WebSocketMessage{MessageId: "v0", Action: "publish", Topic: "versioned"}
+	require.NoError(t, tm.Publish(context.Background(), msg, sender, map[string]any{"a": "1"}, nil))
+	delivered := readMessage(t, remote)
+	require.NotNil(t, delivered.SchemaVersion)
+	assert.Equal(t, 0, *delivered.SchemaVersion)
+
+	require.NoError(t, tm.UpdateSchema("versioned", map[string]any{"a": "", "b": 0}))
+	msg = network.WebSocketMessage{MessageId: "v1", Action: "sendWithoutSave", Topic: "versioned"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, sender, map[string]any{"a": "1", "b": 2}, nil))
+	delivered = readMessage(t, remote)
+	assert.Equal(t, "v1", delivered.MessageId)
+	require.NotNil(t, delivered.SchemaVersion)
+	assert.Equal(t, 1, *delivered.SchemaVersion)
+}
+
+func TestPublish_PersistsValueWithDeliveredTimestamp(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "persisted")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("persisted", client, SubscriptionOptions{}))
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "persisted"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 1)
+	assert.Equal(t, "persisted", puts[0].Key)
+	assert.Equal(t, map[string]any{"a": "1"}, puts[0].Value)
+
+	delivered := readMessage(t, remote)
+	require.NotNil(t, delivered.Timestamp)
+	assert.True(t, puts[0].Timestamp.Equal(*delivered.Timestamp))
+
+	value, err := tm.Get(context.Background(), "persisted")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": "1"}, value)
+}
+
+func TestPublish_TtlPersistedAndDelivered(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "commands")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("commands", client, SubscriptionOptions{}))
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "commands", Options: &network.MessageOptions{TtlMs: 60000}}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 1)
+	assert.Equal(t, puts[0].Timestamp.Add(time.Minute), puts[0].ExpiresAt)
+
+	delivered := readMessage(t, remote)
+	require.NotNil(t, delivered.ExpiresAt)
+	assert.True(t, puts[0].ExpiresAt.Equal(*delivered.ExpiresAt))
+
+	value, err := tm.Get(context.Background(), "commands")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": "1"}, value)
+}
+
+func TestPublish_ExpiredValueNotReturnedByGet(t *testing.T) {
+	tm := NewTopicManager(storagetest.NewRecordingStorage(), &config.Config{})
+	registerTopics(t, tm, "commands")
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "commands", Options: &network.MessageOptions{TtlMs: 1}}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	assert.Eventually(t, func() bool {
+		value, err := tm.Get(context.Background(), "commands")
+		return err == nil && value == nil
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestPublish_WithoutTtlNeverExpires(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "state")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("state", client, SubscriptionOptions{}))
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "state"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 1)
+	assert.True(t, puts[0].ExpiresAt.IsZero())
+	assert.Nil(t, readMessage(t, remote).ExpiresAt)
+}
+
+func TestPublish_DebouncedValueKeepsTtl(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("commands", map[string]any{"a": ""}, TopicOptions{PersistInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "commands", Options: &network.MessageOptions{TtlMs: 60000}}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	assert.Eventually(t, func() bool { return len(db.CallsTo("AsyncPut")) == 1 }, time.Second, 5*time.Millisecond)
+	put := db.CallsTo("AsyncPut")[0]
+	assert.Equal(t, put.Timestamp.Add(time.Minute), put.ExpiresAt)
+}
+
+func TestGetRecent_ReadsFromStorage(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "sparkline")
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "sparkline"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	values, err := tm.GetRecent(context.Background(), "sparkline", 5)
+	require.NoError(t, err)
+	assert.Equal(t, []any{map[string]any{"a": "1"}}, values)
+
+	calls := db.CallsTo("GetRecent")
+	require.Len(t, calls, 1)
+	assert.Equal(t, 5, calls[0].Count)
+
+	_, err = tm.GetRecent(context.Background(), "missing", 5)
+	assert.Error(t, err)
+}
+
+func TestGet_CachedAndReadThroughMatch(t *testing.T) {
+	for _, readThrough := range []bool{false, true} {
+		db := storagetest.NewRecordingStorage()
+		tm := NewTopicManager(db, &config.Config{GetReadThrough: readThrough})
+		registerTopics(t, tm, "cached")
+		getsAtRegister := len(db.CallsTo("Get"))
+
+		for _, value := range []string{"1", "2"} {
+			msg := network.WebSocketMessage{MessageId: value, Action: "publish", Topic: "cached"}
+			require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": value}, nil))
+		}
+
+		value, err := tm.Get(context.Background(), "cached")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]any{"a": "2"}, value, "read through: %v", readThrough)
+
+		storageReads := len(db.CallsTo("Get")) - getsAtRegister
+		if readThrough {
+			assert.Equal(t, 1, storageReads)
+		} else {
+			assert.Zero(t, storageReads, "expected the cached value to be returned without reading storage")
+		}
+	}
+}
+
+func TestGet_ReadThroughSeesStorageChanges(t *testing.T) {
+	ctx := context.Background()
+	db := storagetest.NewRecordingStorage()
+	cached := NewTopicManager(db, &config.Config{})
+	readThrough := NewTopicManager(db, &config.Config{GetReadThrough: true})
+	registerTopics(t, cached, "shared")
+	registerTopics(t, readThrough, "shared")
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "shared"}
+	require.NoError(t, cached.Publish(ctx, msg, network.NewClient(nil, "publisher"), map[string]any{"a": "published"}, nil))
+	// written to storage by something other than the cached topic manager
+	require.NoError(t, <-db.AsyncPut(ctx, "shared", map[string]any{"a": "stored"}, time.Now().UTC(), time.Time{}))
+
+	value, err := cached.Get(ctx, "shared")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": "published"}, value)
+
+	value, err = readThrough.Get(ctx, "shared")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": "stored"}, value)
+}
+
+func TestGet_CacheNotSetBySendWithoutSave(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "unsaved")
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "sendWithoutSave", Topic: "unsaved"}
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	value, err := tm.Get(context.Background(), "unsaved")
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestGet_CacheDroppedWhenWriteFails(t *testing.T) {
+	ctx := context.Background()
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "failing")
+	publisher := network.NewClient(nil, "publisher")
+
+	errCh := make(chan error, 1)
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "failing"}
+	require.NoError(t, tm.Publish(ctx, msg, publisher, map[string]any{"a": "stored"}, errCh))
+	require.NoError(t, <-errCh)
+
+	db.Fail("AsyncPut", errors.New("disk full"))
+	errCh = make(chan error, 1)
+	msg.MessageId = "2"
+	require.NoError(t, tm.Publish(ctx, msg, publisher, map[string]any{"a": "lost"}, errCh))
+	require.Error(t, <-errCh)
+
+	_, ok := tm.(*topicManager).topics["failing"].cached(time.Now())
+	assert.False(t, ok, "expected the value that wasn't stored to not stay cached")
+	value, err := tm.Get(ctx, "failing")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": "stored"}, value)
+}
+
+func TestGet_CacheInvalidatedOnUnregister(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "removed")
+	topic := tm.(*topicManager).topics["removed"]
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "removed"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+	_, ok := topic.cached(time.Now())
+	require.True(t, ok)
+
+	require.NoError(t, tm.UnregisterTopic(context.Background(), "removed"))
+	_, ok = topic.cached(time.Now())
+	assert.False(t, ok)
+
+	// registering it again doesn't bring back the old value
+	registerTopics(t, tm, "removed")
+	value, err := tm.Get(context.Background(), "removed")
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestSendWithoutSave_DoesNotPersist(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "unsaved")
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "sendWithoutSave", Topic: "unsaved"}
+	errCh := make(chan error, 1)
+	require.NoError(t, tm.SendWithoutSave(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, errCh))
+
+	_, open := <-errCh
+	assert.False(t, open, "expected the error channel to be closed without an error")
+	assert.Empty(t, db.CallsTo("AsyncPut"))
+	hasValue, _ := tm.(*topicManager).topics["unsaved"].LastUpdated()
+	assert.False(t, hasValue)
+}
+
+func TestPublish_StorageErrorSentOnErrChan(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "failing")
+	diskFull := errors.New("disk full")
+	db.Fail("AsyncPut", diskFull)
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "failing"}
+	errCh := make(chan error, 1)
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, errCh))
+
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, diskFull)
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the storage error on the error channel")
+	}
+}
+
+func TestRegisterTopic_LoadsStoredValue(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	<-db.AsyncPut(context.Background(), "restored", map[string]any{"a": "1"}, time.Now(), time.Time{})
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "restored", "empty")
+
+	gets := db.CallsTo("Get")
+	require.Len(t, gets, 2)
+	assert.Equal(t, "restored", gets[0].Key)
+
+	hasValue, _ := tm.(*topicManager).topics["restored"].LastUpdated()
+	assert.True(t, hasValue)
+	hasValue, _ = tm.(*topicManager).topics["empty"].LastUpdated()
+	assert.False(t, hasValue)
+}
+
+func TestUnregisterAndRename_UpdateStorage(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "old", "removed")
+
+	require.NoError(t, tm.RenameTopic(context.Background(), "old", "new"))
+	require.NoError(t, tm.UnregisterTopic(context.Background(), "removed"))
+
+	renames := db.CallsTo("Rename")
+	require.Len(t, renames, 1)
+	assert.Equal(t, storagetest.StorageCall{Method: "Rename", Key: "old", NewKey: "new"}, renames[0])
+	assert.Equal(t, []storagetest.StorageCall{{Method: "Delete", Key: "removed"}}, db.CallsTo("Delete"))
+}
+
+func TestUnregisterTopic_StorageErrorStillRemovesTopic(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "removed")
+	db.Fail("Delete", errors.New("locked"))
+
+	assert.ErrorIs(t, tm.UnregisterTopic(context.Background(), "removed"), ErrOrphanedStorage)
+	topics, err := tm.ListTopics()
+	require.NoError(t, err)
+	assert.Empty(t, topics)
+}
+
+func TestPreviewUnregisterTopic_ReportsWithoutChanges(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "stored", "empty")
+	require.NoError(t, <-db.AsyncPut(context.Background(), "stored", map[string]any{"a": "b"}, time.Now(), time.Time{}))
+	client := network.NewClient(nil, "subscriber")
+	require.NoError(t, tm.Subscribe("stored", client, SubscriptionOptions{}))
+
+	preview, err := tm.PreviewUnregisterTopic(context.Background(), "stored")
+	require.NoError(t, err)
+	assert.Equal(t, UnregisterPreview{Topic: "stored", HasData: true, Subscribers: 1}, preview)
+
+	preview, err = tm.PreviewUnregisterTopic(context.Background(), "empty")
+	require.NoError(t, err)
+	assert.Equal(t, UnregisterPreview{Topic: "empty"}, preview)
+
+	_, err = tm.PreviewUnregisterTopic(context.Background(), "missing")
+	assert.Error(t, err)
+
+	assert.True(t, tm.HasTopic("stored"))
+	assert.True(t, tm.HasTopic("empty"))
+	assert.Empty(t, db.CallsTo("Delete"))
+	subscribers, err := tm.ListSubscribersForTopic("stored")
+	require.NoError(t, err)
+	assert.Equal(t, []*network.Client{client}, subscribers)
+}
+
+// wedgedDeleteStorage is a recording storage whose deletes block until it's released.
+type wedgedDeleteStorage struct {
+	*storagetest.RecordingStorage
+	released chan struct{}
+}
+
+func (w *wedgedDeleteStorage) Delete(ctx context.Context, key string) error {
+	<-w.released
+	return w.RecordingStorage.Delete(ctx, key)
+}
+
+// fastOrphanRetries will make the topic manager retry orphaned deletes quickly for a test.
+func fastOrphanRetries(tm TopicManager) *orphanedDeletes {
+	orphans := tm.(*topicManager).orphans
+	orphans.backoff = 10 * time.Millisecond
+	orphans.maxBackoff = 20 * time.Millisecond
+	orphans.timeout = 50 * time.Millisecond
+	return orphans
+}
+
+func TestUnregisterTopic_WedgedDeleteTimesOutAndIsRetried(t *testing.T) {
+	db := &wedgedDeleteStorage{RecordingStorage: storagetest.NewRecordingStorage(), released: make(chan struct{})}
+	tm := NewTopicManager(db, &config.Config{})
+	orphans := fastOrphanRetries(tm)
+	registerTopics(t, tm, "removed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := tm.UnregisterTopic(ctx, "removed")
+	assert.Less(t, time.Since(start), time.Second, "unregister should give up when the context is done")
+	assert.ErrorIs(t, err, ErrOrphanedStorage)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, []string{"removed"}, orphans.Pending())
+
+	close(db.released)
+	assert.Eventually(t, func() bool { return len(orphans.Pending()) == 0 }, time.Second, 5*time.Millisecond)
+	assert.NotEmpty(t, db.CallsTo("Delete"))
+}
+
+func TestUnregisterTopic_FailedDeleteRetriedUntilItSucceeds(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	orphans := fastOrphanRetries(tm)
+	registerTopics(t, tm, "removed")
+	require.NoError(t, <-db.AsyncPut(context.Background(), "removed", "stale", time.Now(), time.Time{}))
+	db.Fail("Delete", errors.New("locked"))
+
+	assert.ErrorIs(t, tm.UnregisterTopic(context.Background(), "removed"), ErrOrphanedStorage)
+	assert.Eventually(t, func() bool { return len(db.CallsTo("Delete")) >= 3 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"removed"}, orphans.Pending())
+
+	db.Fail("Delete", nil)
+	assert.Eventually(t, func() bool { return len(orphans.Pending()) == 0 }, time.Second, 5*time.Millisecond)
+	value, err := db.Get(context.Background(), "removed")
+	require.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestUnregisterTopic_RetryKeepsValueOfReregisteredTopic(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	orphans := fastOrphanRetries(tm)
+	registerTopics(t, tm, "reused")
+	db.Fail("Delete", errors.New("locked"))
+
+	assert.ErrorIs(t, tm.UnregisterTopic(context.Background(), "reused"), ErrOrphanedStorage)
+	registerTopics(t, tm, "reused")
+	require.NoError(t, <-db.AsyncPut(context.Background(), "reused", "fresh", time.Now(), time.Time{}))
+	db.Fail("Delete", nil)
+
+	assert.Eventually(t, func() bool { return len(orphans.Pending()) == 0 }, time.Second, 5*time.Millisecond)
+	value, err := db.Get(context.Background(), "reused")
+	require.NoError(t, err)
+	assert.Equal(t, "fresh", value)
+}
+
+func TestRegisterTopic_WaitsForOrphanedDelete(t *testing.T) {
+	db := &wedgedDeleteStorage{RecordingStorage: storagetest.NewRecordingStorage(), released: make(chan struct{})}
+	tm := NewTopicManager(db, &config.Config{})
+	fastOrphanRetries(tm)
+	registerTopics(t, tm, "reused")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, tm.UnregisterTopic(ctx, "reused"), ErrOrphanedStorage)
+
+	registered := make(chan error, 1)
+	go func() {
+		_, err := tm.RegisterTopic("reused", map[string]any{"a": ""}, TopicOptions{})
+		registered <- err
+	}()
+	select {
+	case <-registered:
+		t.Fatal("registering should wait for the delete that was given up on")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(db.released)
+	select {
+	case err := <-registered:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("registering didn't finish once the delete returned")
+	}
+	require.NoError(t, <-db.AsyncPut(context.Background(), "reused", "fresh", time.Now(), time.Time{}))
+
+	time.Sleep(100 * time.Millisecond) // no retry is left to delete the new value
+	value, err := db.Get(context.Background(), "reused")
+	require.NoError(t, err)
+	assert.Equal(t, "fresh", value)
+	assert.Len(t, db.CallsTo("Delete"), 1)
+}
+
+func TestClose_StopsOrphanedDeleteRetries(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	orphans := fastOrphanRetries(tm)
+	registerTopics(t, tm, "removed")
+	db.Fail("Delete", errors.New("locked"))
+
+	assert.ErrorIs(t, tm.UnregisterTopic(context.Background(), "removed"), ErrOrphanedStorage)
+	assert.Eventually(t, func() bool { return len(db.CallsTo("Delete")) >= 2 }, time.Second, 5*time.Millisecond)
+
+	tm.Close()
+	assert.Eventually(t, func() bool { return len(orphans.Pending()) == 0 }, time.Second, 5*time.Millisecond)
+	attempts := len(db.CallsTo("Delete"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, db.CallsTo("Delete"), attempts)
+}
+
+var defaultsSchema = map[string]any{
+	"name":  "unnamed",
+	"count": 0.0,
+	"meta":  map[string]any{"source": "sensor", "tags": []any{"default"}},
+}
+
+func TestApplyDefaults_FillsMissingFields(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("defaults", defaultsSchema, TopicOptions{FillDefaults: true})
+	require.NoError(t, err)
+
+	payload := map[string]any{"count": 5.0, "meta": map[string]any{}}
+	filled, err := tm.ApplyDefaults("defaults", payload)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"name":  "unnamed",
+		"count": 5.0,
+		"meta":  map[string]any{"source": "sensor", "tags": []any{"default"}},
+	}, filled)
+	assert.Equal(t, map[string]any{"count": 5.0, "meta": map[string]any{}}, payload, "the payload itself shouldn't be changed")
+
+	// filled values are copies, so changing them doesn't change the schema
+	filled.(map[string]any)["meta"].(map[string]any)["tags"].([]any)[0] = "changed"
+	match, err := tm.IsSchemaMatch("defaults", defaultsSchema)
+	require.NoError(t, err)
+	assert.True(t, match)
+	assert.Equal(t, "default", defaultsSchema["meta"].(map[string]any)["tags"].([]any)[0])
+
+	// the filled value now passes strict validation
+	warnings, err := tm.ValidatePayload("defaults", filled)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestApplyDefaults_PreservesPresentFields(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("defaults", defaultsSchema, TopicOptions{FillDefaults: true, ValidationMode: ValidationWarn})
+	require.NoError(t, err)
+
+	payload := map[string]any{
+		"name":  nil,
+		"count": 0.0,
+		"meta":  map[string]any{"source": "gateway", "tags": []any{}},
+		"extra": true,
+	}
+	filled, err := tm.ApplyDefaults("defaults", payload)
+	require.NoError(t, err)
+	assert.Equal(t, payload, filled)
+
+	// values that aren't objects can't be filled
+	filled, err = tm.ApplyDefaults("defaults", []any{1.0})
+	require.NoError(t, err)
+	assert.Equal(t, []any{1.0}, filled)
+}
+
+func TestApplyDefaults_OnlyWhenOptedIn(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("no-defaults", defaultsSchema, TopicOptions{})
+	require.NoError(t, err)
+
+	payload := map[string]any{"count": 5.0}
+	filled, err := tm.ApplyDefaults("no-defaults", payload)
+	require.NoError(t, err)
+	assert.Equal(t, payload, filled)
+
+	_, err = tm.ApplyDefaults("missing", payload)
+	assert.Error(t, err)
+}
+
+func TestApplyDefaults_UsesLatestSchema(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("defaults", map[string]any{"unit": "celsius"}, TopicOptions{FillDefaults: true})
+	require.NoError(t, err)
+	require.NoError(t, tm.UpdateSchema("defaults", map[string]any{"unit": "kelvin"}))
+
+	filled, err := tm.ApplyDefaults("defaults", map[string]any{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"unit": "kelvin"}, filled)
+}
+
+func TestPublishTransaction_CommitPersistsThenDelivers(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "debits", "credits")
+
+	debitsClient, debitsRemote := newTestClient(t, "debits-subscriber")
+	creditsClient, creditsRemote := newTestClient(t, "credits-subscriber")
+	require.NoError(t, tm.Subscribe("debits", debitsClient, SubscriptionOptions{}))
+	require.NoError(t, tm.Subscribe("credits", creditsClient, SubscriptionOptions{}))
+
+	msg := network.WebSocketMessage{MessageId: "transfer", Action: "publishTransaction"}
+	require.NoError(t, tm.PublishTransaction(context.Background(), msg, network.NewClient(nil, "publisher"), []TopicValue{
+		{Topic: "debits", Value: map[string]any{"total": 5.0}},
+		{Topic: "credits", Value: map[string]any{"total": 5.0}},
+	}))
+
+	batches := db.CallsTo("AsyncPutBatch")
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0].Batch, 2)
+	assert.Equal(t, "debits", batches[0].Batch[0].Key)
+	assert.Equal(t, "credits", batches[0].Batch[1].Key)
+	assert.Empty(t, db.CallsTo("AsyncPut"))
+
+	debits, credits := readMessage(t, debitsRemote), readMessage(t, creditsRemote)
+	assert.Equal(t, "transfer", debits.MessageId)
+	assert.Equal(t, "debits", debits.Topic)
+	assert.Equal(t, "credits", credits.Topic)
+	assert.JSONEq(t, `{"total": 5}`, string(credits.Data))
+	require.NotNil(t, debits.Timestamp)
+	require.NotNil(t, credits.Timestamp)
+	assert.True(t, debits.Timestamp.Equal(*credits.Timestamp), "expected every value in the transaction to have the same timestamp")
+
+	values, err := tm.GetMany(context.Background(), []string{"debits", "credits"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"debits": map[string]any{"total": 5.0}, "credits": map[string]any{"total": 5.0}}, values)
+}
+
+func TestPublishTransaction_RollbackDeliversNothing(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "debits", "credits")
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("debits", client, SubscriptionOptions{}))
+	require.NoError(t, tm.Subscribe("credits", client, SubscriptionOptions{}))
+	sender := network.NewClient(nil, "publisher")
+
+	db.Fail("AsyncPutBatch", errors.New("disk full"))
+	msg := network.WebSocketMessage{MessageId: "transfer", Action: "publishTransaction"}
+	err := tm.PublishTransaction(context.Background(), msg, sender, []TopicValue{
+		{Topic: "debits", Value: map[string]any{"total": 5.0}},
+		{Topic: "credits", Value: map[string]any{"total": 5.0}},
+	})
+	assert.ErrorContains(t, err, "disk full")
+
+	for _, name := range []string{"debits", "credits"} {
+		value, err := tm.Get(context.Background(), name)
+		require.NoError(t, err)
+		assert.Nil(t, value, name)
+		hasValue, _ := tm.(*topicManager).topics[name].LastUpdated()
+		assert.False(t, hasValue, name)
+	}
+
+	// the next message the subscriber gets should be the one after the failed transaction
+	db.Fail("AsyncPutBatch", nil)
+	msg = network.WebSocketMessage{MessageId: "live", Action: "publish", Topic: "credits"}
+	require.NoError(t, tm.Publish(context.Background(), msg, sender, map[string]any{"total": 1.0}, nil))
+	assert.Equal(t, "live", readMessage(t, remote).MessageId)
+}
+
+// lateAckStorage is a storage that commits batches right away, but holds back the result until
+// it's released, like a write that finishes after the transaction was cancelled.
+type lateAckStorage struct {
+	*storagetest.RecordingStorage
+	release chan struct{}
+}
+
+func (s *lateAckStorage) AsyncPutBatch(ctx context.Context, entries []storage.BatchEntry) chan error {
+	committed := s.RecordingStorage.AsyncPutBatch(context.Background(), entries)
+	late := make(chan error, 1)
+	go func() {
+		<-s.release
+		late <- <-committed
+	}()
+	return late
+}
+
+func TestPublishTransaction_CancelledAfterQueuedStillDeliversCommit(t *testing.T) {
+	db := &lateAckStorage{RecordingStorage: storagetest.NewRecordingStorage(), release: make(chan struct{})}
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "debits")
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("debits", client, SubscriptionOptions{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		msg := network.WebSocketMessage{MessageId: "transfer", Action: "publishTransaction"}
+		done <- tm.PublishTransaction(ctx, msg, network.NewClient(nil, "publisher"), []TopicValue{
+			{Topic: "debits", Value: map[string]any{"total": 5.0}},
+		})
+	}()
+	require.Eventually(t, func() bool { return len(db.CallsTo("AsyncPutBatch")) == 1 }, time.Second, time.Millisecond)
+	cancel()
+	close(db.release)
+
+	// the batch committed, so the transaction has to finish even though it was cancelled
+	require.NoError(t, <-done)
+	assert.Equal(t, "transfer", readMessage(t, remote).MessageId)
+	value, err := tm.Get(context.Background(), "debits")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"total": 5.0}, value)
+}
+
+func TestPublishTransaction_MissingTopicPublishesNothing(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	registerTopics(t, tm, "debits")
+
+	msg := network.WebSocketMessage{MessageId: "transfer", Action: "publishTransaction"}
+	err := tm.PublishTransaction(context.Background(), msg, network.NewClient(nil, "publisher"), []TopicValue{
+		{Topic: "debits", Value: map[string]any{"total": 5.0}},
+		{Topic: "missing", Value: map[string]any{"total": 5.0}},
+	})
+	assert.ErrorContains(t, err, "missing")
+	assert.Empty(t, db.CallsTo("AsyncPutBatch"))
+}
+
+func TestPublish_MaxPayloadSizePerTopic(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{MaxPayloadSize: 20})
+	_, err := tm.RegisterTopic("large", map[string]any{"a": ""}, TopicOptions{MaxPayloadSize: 100})
+	require.NoError(t, err)
+	_, err = tm.RegisterTopic("tiny", map[string]any{"a": ""}, TopicOptions{MaxPayloadSize: 10})
+	require.NoError(t, err)
+	registerTopics(t, tm, "server-limit")
+	_, err = tm.RegisterTopic("blobs", map[string]any{"a": ""}, TopicOptions{Binary: true, MaxPayloadSize: 4})
+	require.NoError(t, err)
+
+	subscriber, remote := newTestClient(t, "subscriber")
+	for _, name := range []string{"large", "tiny", "server-limit"} {
+		require.NoError(t, tm.Subscribe(name, subscriber, SubscriptionOptions{}))
+	}
+	sender := network.NewClient(nil, "publisher")
+	publish := func(topicName string, value any) error {
+		msg := network.WebSocketMessage{MessageId: topicName, Action: "publish", Topic: topicName}
+		return tm.Publish(context.Background(), msg, sender, value, nil)
+	}
+
+	fifty := map[string]any{"a": strings.Repeat("x", 42)} // 50 bytes of json
+	assert.NoError(t, publish("large", fifty), "under the topic's limit even though it's over the server's")
+	assert.Equal(t, "large", readMessage(t, remote).MessageId)
+
+	assert.ErrorIs(t, publish("tiny", fifty), ErrPayloadTooLarge)
+	assert.ErrorIs(t, publish("server-limit", fifty), ErrPayloadTooLarge, "topics without a limit use the server's")
+	assert.NoError(t, publish("tiny", map[string]any{"a": "b"}))
+	assert.Equal(t, "tiny", readMessage(t, remote).MessageId, "nothing is delivered for payloads over the limit")
+
+	assert.NoError(t, publish("blobs", []byte{1, 2, 3, 4}), "binary payloads are measured as raw bytes")
+	assert.ErrorIs(t, publish("blobs", []byte{1, 2, 3, 4, 5}), ErrPayloadTooLarge)
+
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 3, "nothing is persisted for payloads over the limit")
+	assert.Equal(t, []string{"large", "tiny", "blobs"}, []string{puts[0].Key, puts[1].Key, puts[2].Key})
+
+	msg := network.WebSocketMessage{MessageId: "transfer", Action: "publishTransaction"}
+	err = tm.PublishTransaction(context.Background(), msg, sender, []TopicValue{
+		{Topic: "large", Value: fifty},
+		{Topic: "tiny", Value: fifty},
+	})
+	assert.ErrorIs(t, err, ErrPayloadTooLarge)
+	assert.Empty(t, db.CallsTo("AsyncPutBatch"))
+}
+
+func TestPublishTransaction_DropsPendingDebouncedValue(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{})
+	_, err := tm.RegisterTopic("debounced", map[string]any{"total": 0.0}, TopicOptions{PersistInterval: 20 * time.Millisecond})
+	require.NoError(t, err)
+	sender := network.NewClient(nil, "publisher")
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "debounced"}
+	require.NoError(t, tm.Publish(context.Background(), msg, sender, map[string]any{"total": 1.0}, nil))
+	msg = network.WebSocketMessage{MessageId: "transfer", Action: "publishTransaction"}
+	require.NoError(t, tm.PublishTransaction(context.Background(), msg, sender, []TopicValue{{Topic: "debounced", Value: map[string]any{"total": 2.0}}}))
+
+	// the older pending value would overwrite the transaction's value if it was flushed
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, putValues(db))
+	value, err := db.Get(context.Background(), "debounced")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"total": 2.0}, value)
+}
+
+func TestUpdateSchema_EvictsOldestVersionsPastLimit(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxSchemaVersions: 3})
+	topic, err := tm.RegisterTopic("evolving", map[string]any{"v0": ""}, TopicOptions{})
+	require.NoError(t, err)
+
+	for version := 1; version <= 5; version++ {
+		require.NoError(t, tm.UpdateSchema("evolving", map[string]any{fmt.Sprintf("v%d", version): ""}))
+	}
+
+	history := topic.SchemaHistory()
+	require.Len(t, history, 3)
+	for i, schema := range history {
+		assert.Equal(t, i+3, schema.Version)
+	}
+	assert.Equal(t, 5, topic.LatestSchemaVersion())
+
+	kept, err := topic.GetSchemaByVersion(4)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"v4": ""}, kept.Schema)
+
+	_, err = topic.GetSchemaByVersion(2)
+	assert.ErrorIs(t, err, ErrSchemaVersionEvicted)
+	_, err = topic.GetSchemaByVersion(6)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrSchemaVersionEvicted)
+}
+
+func TestUpdateSchema_LimitOfOneKeepsLatest(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{MaxSchemaVersions: 1})
+	topic, err := tm.RegisterTopic("evolving", map[string]any{"v0": ""}, TopicOptions{})
+	require.NoError(t, err)
+	require.NoError(t, tm.UpdateSchema("evolving", map[string]any{"v1": ""}))
+
+	latest, err := topic.GetLatestSchema()
+	require.NoError(t, err)
+	assert.Equal(t, 1, latest.Version)
+	assert.Len(t, topic.SchemaHistory(), 1)
+}
+
+func TestUpdateSchema_NoLimitKeepsEveryVersion(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("evolving", map[string]any{"v0": ""}, TopicOptions{})
+	require.NoError(t, err)
+	for version := 1; version <= 5; version++ {
+		require.NoError(t, tm.UpdateSchema("evolving", map[string]any{fmt.Sprintf("v%d", version): ""}))
+	}
+
+	assert.Len(t, topic.SchemaHistory(), 6)
+	first, err := topic.GetSchemaByVersion(0)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"v0": ""}, first.Schema)
+}
+
+func TestValidateSchema_CompatibleCandidates(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("strict", map[string]any{"id": "", "total": 0}, TopicOptions{})
+	require.NoError(t, err)
+	_, err = tm.RegisterTopic("filled", map[string]any{"id": "", "total": 0}, TopicOptions{FillDefaults: true})
+	require.NoError(t, err)
+	_, err = tm.RegisterTopic("warned", map[string]any{"id": "", "total": 0}, TopicOptions{ValidationMode: ValidationWarn})
+	require.NoError(t, err)
+
+	// the same fields with different example values is the same schema
+	check, err := tm.ValidateSchema("strict", map[string]any{"id": "a", "total": 5}, nil)
+	require.NoError(t, err)
+	assert.True(t, check.Compatible)
+	assert.Empty(t, check.Differences)
+	assert.Nil(t, check.SampleValid)
+
+	// added fields are filled in for publishers that don't send them yet
+	check, err = tm.ValidateSchema("filled", map[string]any{"id": "", "total": 0, "currency": "USD"}, nil)
+	require.NoError(t, err)
+	assert.True(t, check.Compatible)
+	assert.Empty(t, check.Differences)
+
+	// warn mode never rejects a payload, but still says what changed
+	check, err = tm.ValidateSchema("warned", map[string]any{"id": ""}, nil)
+	require.NoError(t, err)
+	assert.True(t, check.Compatible)
+	assert.Equal(t, []string{"unexpected field: total"}, check.Differences)
+}
+
+func TestValidateSchema_IncompatibleCandidates(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("strict", map[string]any{"id": "", "total": 0}, TopicOptions{})
+	require.NoError(t, err)
+	_, err = tm.RegisterTopic("filled", map[string]any{"id": "", "total": 0}, TopicOptions{FillDefaults: true})
+	require.NoError(t, err)
+
+	check, err := tm.ValidateSchema("strict", map[string]any{"id": "", "total": 0, "currency": ""}, nil)
+	require.NoError(t, err)
+	assert.False(t, check.Compatible)
+	assert.Equal(t, []string{"missing field: currency"}, check.Differences)
+
+	// filling defaults can't help when a field is removed or changes type
+	check, err = tm.ValidateSchema("filled", map[string]any{"id": "", "total": map[string]any{"amount": 0}}, nil)
+	require.NoError(t, err)
+	assert.False(t, check.Compatible)
+	assert.Equal(t, []string{"expected object for field: total"}, check.Differences)
+}
+
+func TestValidateSchema_ChecksSample(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("orders", map[string]any{"id": ""}, TopicOptions{})
+	require.NoError(t, err)
+	candidate := map[string]any{"id": "", "total": 0}
+
+	check, err := tm.ValidateSchema("orders", candidate, map[string]any{"id": "1", "total": 5})
+	require.NoError(t, err)
+	require.NotNil(t, check.SampleValid)
+	assert.True(t, *check.SampleValid)
+	assert.Empty(t, check.SampleErrors)
+
+	check, err = tm.ValidateSchema("orders", candidate, map[string]any{"id": "1"})
+	require.NoError(t, err)
+	require.NotNil(t, check.SampleValid)
+	assert.False(t, *check.SampleValid)
+	assert.Equal(t, []string{"missing field: total"}, check.SampleErrors)
+}
+
+func TestValidateSchema_DoesNotChangeTopic(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	topic, err := tm.RegisterTopic("orders", map[string]any{"id": ""}, TopicOptions{})
+	require.NoError(t, err)
+
+	_, err = tm.ValidateSchema("orders", map[string]any{"id": "", "total": 0}, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, topic.LatestSchemaVersion())
+	_, err = tm.ValidatePayload("orders", map[string]any{"id": "1"})
+	assert.NoError(t, err)
+
+	_, err = tm.ValidateSchema("missing", map[string]any{"id": ""}, nil)
+	assert.Error(t, err)
+}
+
+func TestLockStats_CountsConcurrentPublishes(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	registerTopics(t, tm, "busy", "old")
+	require.NoError(t, tm.RenameTopic(context.Background(), "old", "renamed"))
+	client := network.NewClient(nil, "publisher")
+
+	const workers, publishes = 8, 25
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range publishes {
+				assert.NoError(t, tm.Publish(context.Background(), network.WebSocketMessage{Action: "publish", Topic: "busy"}, client, map[string]any{"a": "1"}, nil))
+			}
+		}()
+	}
+	wg.Wait()
+
+	acquisitions := make(map[string]int64)
+	for _, stat := range tm.LockStats() {
+		acquisitions[stat.Component] += stat.Acquisitions
+		assert.LessOrEqual(t, stat.MaxWait, stat.TotalWait)
+	}
+	assert.GreaterOrEqual(t, acquisitions["TopicManager"], int64(workers*publishes))
+	assert.GreaterOrEqual(t, acquisitions["Topic: busy"], int64(workers*publishes))
+	assert.Contains(t, acquisitions, "Topic: renamed", "expected a renamed topic's lock under its new name")
+	assert.NotContains(t, acquisitions, "Topic: old")
+}
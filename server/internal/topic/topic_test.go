@@ -0,0 +1,193 @@
+package topic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fanOutSubscribers = 200
+
+// newFanOutClients will create clients backed by real websocket connections that aren't
+// started, so every send is written on the calling goroutine. The other ends of the
+// connections are drained in the background.
+func newFanOutClients(tb testing.TB, count int) []*network.Client {
+	serverConns := make(chan *websocket.Conn, count)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Errorf("upgrade failed: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	tb.Cleanup(srv.Close)
+
+	clients := make([]*network.Client, 0, count)
+	for i := 0; i < count; i++ {
+		remote, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		require.NoError(tb, err)
+		tb.Cleanup(func() { remote.Close() })
+		go func() {
+			for {
+				_, r, err := remote.NextReader()
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, r)
+			}
+		}()
+
+		conn := <-serverConns
+		tb.Cleanup(func() { conn.Close() })
+		clients = append(clients, network.NewClient(conn, fmt.Sprintf("subscriber-%d", i)))
+	}
+	return clients
+}
+
+func fanOutMessage() *network.WebSocketMessage {
+	timestamp := time.Now().UTC()
+	return &network.WebSocketMessage{
+		MessageId: "fan-out",
+		Action:    "publish",
+		Topic:     "fan-out",
+		Data:      []byte(`{"name":"example","count":42,"tags":["a","b","c"]}`),
+		SenderId:  "publisher",
+		Timestamp: &timestamp,
+	}
+}
+
+func TestTopicPublish_AllSubscribersGetMessage(t *testing.T) {
+	topic := NewTopic("fan-out", map[string]any{}, TopicOptions{})
+	remotes := make([]*websocket.Conn, 0, 3)
+	for i := 0; i < 3; i++ {
+		client, remote := newTestClient(t, fmt.Sprintf("subscriber-%d", i))
+		topic.Subscribe(client, SubscriptionOptions{Conflate: i == 0})
+		remotes = append(remotes, remote)
+	}
+
+	stats, failed := topic.Publish(context.Background(), nil, fanOutMessage())
+	assert.Empty(t, failed)
+	assert.Equal(t, network.DeliveryStats{Targeted: 3, Delivered: 3}, stats)
+	for _, remote := range remotes {
+		delivered := readMessage(t, remote)
+		assert.Equal(t, "fan-out", delivered.MessageId)
+		assert.JSONEq(t, `{"name":"example","count":42,"tags":["a","b","c"]}`, string(delivered.Data))
+	}
+}
+
+func TestTopicPublish_CancelledContextSendsNothing(t *testing.T) {
+	topic := NewTopic("fan-out", map[string]any{}, TopicOptions{})
+	client, remote := newTestClient(t, "subscriber")
+	topic.Subscribe(client, SubscriptionOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := fanOutMessage()
+	cancelled.MessageId = "cancelled"
+	stats, failed := topic.Publish(ctx, nil, cancelled)
+	assert.Empty(t, failed)
+	assert.Equal(t, network.DeliveryStats{Targeted: 1, Failed: 1}, stats)
+
+	// the next message the subscriber gets should be the one after the cancelled publish
+	_, failed = topic.Publish(context.Background(), nil, fanOutMessage())
+	assert.Empty(t, failed)
+	assert.Equal(t, "fan-out", readMessage(t, remote).MessageId)
+}
+
+func TestTopicPublish_DeliveryStatsCountFailedSubscribers(t *testing.T) {
+	topic := NewTopic("fan-out", map[string]any{}, TopicOptions{})
+	sender, _ := newTestClient(t, "sender")
+	topic.Subscribe(sender, SubscriptionOptions{NoEcho: true}) // not meant to get its own publish
+	healthy := make([]*websocket.Conn, 0, 2)
+	for i := 0; i < 2; i++ {
+		client, remote := newTestClient(t, fmt.Sprintf("healthy-%d", i))
+		topic.Subscribe(client, SubscriptionOptions{})
+		healthy = append(healthy, remote)
+	}
+	closed, _ := newTestClient(t, "closed")
+	topic.Subscribe(closed, SubscriptionOptions{})
+	closed.Close()
+
+	stats, _ := topic.Publish(context.Background(), sender, fanOutMessage())
+
+	assert.Equal(t, network.DeliveryStats{Targeted: 3, Delivered: 2, Failed: 1}, stats)
+	for _, remote := range healthy {
+		assert.Equal(t, "fan-out", readMessage(t, remote).MessageId)
+	}
+}
+
+func TestTopicPublish_DeliveryStatsCountDroppedAndConflated(t *testing.T) {
+	topic := NewTopic("fan-out", map[string]any{}, TopicOptions{OverflowPolicy: network.OverflowDropNewest})
+	full, _ := newTestClient(t, "full")
+	topic.Subscribe(full, SubscriptionOptions{})
+	slow, _ := newTestClient(t, "slow")
+	topic.Subscribe(slow, SubscriptionOptions{Conflate: true})
+	healthy, remote := newTestClient(t, "healthy")
+	topic.Subscribe(healthy, SubscriptionOptions{})
+
+	// what the clients' queues report when the full one drops it and the slow one still has
+	// the last value waiting
+	send := topic.send
+	topic.send = func(client *network.Client, opts SubscriptionOptions, prepared *websocket.PreparedMessage, expires time.Time, priority network.Priority) error {
+		switch client {
+		case full:
+			return network.ErrMessageDropped
+		case slow:
+			return network.ErrMessageConflated
+		}
+		return send(client, opts, prepared, expires, priority)
+	}
+
+	stats, failed := topic.Publish(context.Background(), nil, fanOutMessage())
+	assert.Empty(t, failed)
+	assert.Equal(t, network.DeliveryStats{Targeted: 3, Delivered: 1, Conflated: 1, Failed: 1}, stats)
+	assert.Equal(t, "fan-out", readMessage(t, remote).MessageId)
+}
+
+// BenchmarkFanOut compares encoding the message for every subscriber against publishing
+// through the topic, which encodes it once and writes the same prepared message to all of them.
+func BenchmarkFanOut(b *testing.B) {
+	b.Run("json-per-subscriber", func(b *testing.B) {
+		clients := newFanOutClients(b, fanOutSubscribers)
+		msg := fanOutMessage()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, client := range clients {
+				if err := client.SendJSON(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("prepared-message", func(b *testing.B) {
+		clients := newFanOutClients(b, fanOutSubscribers)
+		topic := NewTopic("fan-out", map[string]any{}, TopicOptions{})
+		for _, client := range clients {
+			topic.Subscribe(client, SubscriptionOptions{})
+		}
+		msg := fanOutMessage()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, failed := topic.Publish(context.Background(), nil, msg); len(failed) != 0 {
+				b.Fatalf("%d clients failed", len(failed))
+			}
+		}
+	})
+}
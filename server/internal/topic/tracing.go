@@ -0,0 +1,29 @@
+package topic
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the topic manager's spans with the global tracer provider, so they're no-ops
+// unless traces are exported.
+var tracer = otel.Tracer("github.com/atyalexyoung/data-loom/server/internal/topic")
+
+// startSpan will start a span for a topic manager call on the topic, as a child of the span in the
+// context.
+func startSpan(ctx context.Context, name string, topicName string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("topic", topicName)))
+}
+
+// endSpan will end the span, recording the error if there was one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
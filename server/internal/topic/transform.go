@@ -0,0 +1,254 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrTransformFailed is returned when a transform can't be applied to a published value, in which
+// case nothing is persisted or sent.
+var ErrTransformFailed = errors.New("transform failed")
+
+// REDACTED is what RedactFields replaces the value of a field with.
+const REDACTED = "[REDACTED]"
+
+// Transform changes a value published to a topic before it's persisted or sent to subscribers.
+// The value is a copy, so it can be changed in place. Values of binary topics aren't transformed.
+type Transform interface {
+	Transform(topicName string, value any) (any, error)
+}
+
+// TransformFunc is a function that can be used as a Transform.
+type TransformFunc func(topicName string, value any) (any, error)
+
+// Transform will call the function.
+func (f TransformFunc) Transform(topicName string, value any) (any, error) {
+	return f(topicName, value)
+}
+
+// Pipeline is transforms that are applied to a value in order, each getting what the one before
+// it returned.
+type Pipeline []Transform
+
+// Apply will run the value through each transform of the pipeline in order, on a copy of it.
+func (p Pipeline) Apply(topicName string, value any) (any, error) {
+	if len(p) == 0 {
+		return value, nil
+	}
+	value = copyJSONValue(value)
+	for i, transform := range p {
+		var err error
+		if value, err = transform.Transform(topicName, value); err != nil {
+			return nil, fmt.Errorf("%w: transform %d for topic %s: %v", ErrTransformFailed, i+1, topicName, err)
+		}
+	}
+	return value, nil
+}
+
+// TransformPipelines are the pipelines for the values published to a topic, one for the value
+// that's persisted and one for the value that's sent to subscribers, so they can differ.
+type TransformPipelines struct {
+	Persist   Pipeline
+	Broadcast Pipeline
+}
+
+// publishedValue is a value published to a topic after it's transformed.
+type publishedValue struct {
+	stored any    // persisted and cached
+	sent   any    // sent to subscribers
+	raw    []byte // sent encoded as json
+
+	diverged bool // stored and sent were transformed separately, so they can differ
+}
+
+// topicTransforms are the pipelines for the topics with names matching the pattern.
+type topicTransforms struct {
+	pattern   string
+	pipelines TransformPipelines
+}
+
+// WithTransforms will make the topic manager run values published to topics with names matching
+// the glob pattern through the pipelines, such as "sensors/*", or "*" for every topic. When more
+// than one pattern matches, the pipelines run in the order they were added. Values are transformed
+// by publish, sendWithoutSave, and publishTransaction, after they're validated, and the persisted
+// value is what get returns. The server won't start if the pattern is malformed.
+func WithTransforms(pattern string, pipelines TransformPipelines) ManagerOption {
+	if _, err := path.Match(pattern, ""); err != nil {
+		log.Fatalf("Error when adding transforms, malformed topic pattern %q: %v", pattern, err)
+	}
+	return func(tm *topicManager) {
+		tm.transforms = append(tm.transforms, topicTransforms{pattern: pattern, pipelines: pipelines})
+	}
+}
+
+// TransformSpec is a built in transform in a transforms file, named by its type.
+type TransformSpec struct {
+	Type   string   `json:"type"`             // "redactFields", "scaleField", or "addTimestamp"
+	Fields []string `json:"fields,omitempty"` // redactFields only
+	Field  string   `json:"field,omitempty"`  // scaleField and addTimestamp
+	Factor *float64 `json:"factor,omitempty"` // scaleField only
+}
+
+// TopicTransforms are the pipelines for the topics with names matching the pattern in a
+// transforms file.
+type TopicTransforms struct {
+	Pattern   string          `json:"pattern"`
+	Persist   []TransformSpec `json:"persist,omitempty"`
+	Broadcast []TransformSpec `json:"broadcast,omitempty"`
+}
+
+// LoadTransforms will read and parse the transforms file at the path, and return an option
+// adding the pipelines of each pattern to the topic manager in the order they're in the file.
+// Returns error if the file can't be read, has fields that aren't part of a transforms file, a
+// malformed pattern, or a transform that isn't built in or is missing what it needs.
+func LoadTransforms(filePath string) ([]ManagerOption, error) {
+	raw, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read transforms file: %w", err)
+	}
+
+	var topics []TopicTransforms
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&topics); err != nil {
+		return nil, fmt.Errorf("couldn't parse transforms file %s: %w", filePath, err)
+	}
+
+	options := make([]ManagerOption, 0, len(topics))
+	for _, topic := range topics {
+		if strings.TrimSpace(topic.Pattern) == "" {
+			return nil, fmt.Errorf("transforms file %s has a blank pattern. Use * for every topic", filePath)
+		}
+		if _, err := path.Match(topic.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("transforms file %s has a malformed pattern %q: %w", filePath, topic.Pattern, err)
+		}
+		var pipelines TransformPipelines
+		if pipelines.Persist, err = buildPipeline(topic.Persist); err != nil {
+			return nil, fmt.Errorf("transforms file %s has a bad persist transform for %s: %w", filePath, topic.Pattern, err)
+		}
+		if pipelines.Broadcast, err = buildPipeline(topic.Broadcast); err != nil {
+			return nil, fmt.Errorf("transforms file %s has a bad broadcast transform for %s: %w", filePath, topic.Pattern, err)
+		}
+		options = append(options, WithTransforms(topic.Pattern, pipelines))
+	}
+	return options, nil
+}
+
+// buildPipeline will make the built in transforms of the specs, in order.
+func buildPipeline(specs []TransformSpec) (Pipeline, error) {
+	pipeline := make(Pipeline, 0, len(specs))
+	for i, spec := range specs {
+		switch spec.Type {
+		case "redactFields":
+			if len(spec.Fields) == 0 {
+				return nil, fmt.Errorf("transform %d: redactFields needs fields", i+1)
+			}
+			pipeline = append(pipeline, RedactFields(spec.Fields...))
+		case "scaleField":
+			if spec.Field == "" || spec.Factor == nil {
+				return nil, fmt.Errorf("transform %d: scaleField needs a field and a factor", i+1)
+			}
+			pipeline = append(pipeline, ScaleField(spec.Field, *spec.Factor))
+		case "addTimestamp":
+			if spec.Field == "" {
+				return nil, fmt.Errorf("transform %d: addTimestamp needs a field", i+1)
+			}
+			pipeline = append(pipeline, AddTimestamp(spec.Field))
+		default:
+			return nil, fmt.Errorf("transform %d: unknown type %q. Must be redactFields, scaleField, or addTimestamp", i+1, spec.Type)
+		}
+	}
+	return pipeline, nil
+}
+
+// transformPublished will run a value published to a topic through the topic's pipelines. The
+// value is passed already encoded as raw, and is only encoded again if it was transformed for
+// subscribers. Both the stored and sent value are the value itself if the topic has no transforms.
+func (tm *topicManager) transformPublished(topic *Topic, topicName string, value any, raw []byte) (publishedValue, error) {
+	published := publishedValue{stored: value, sent: value, raw: raw}
+	if topic.binary {
+		return published, nil
+	}
+
+	var err error
+	sentTransformed := false
+	for _, transforms := range tm.transforms {
+		if matched, _ := path.Match(transforms.pattern, topicName); !matched {
+			continue
+		}
+		if published.stored, err = transforms.pipelines.Persist.Apply(topicName, published.stored); err != nil {
+			return published, err
+		}
+		if published.sent, err = transforms.pipelines.Broadcast.Apply(topicName, published.sent); err != nil {
+			return published, err
+		}
+		published.diverged = published.diverged || len(transforms.pipelines.Persist) > 0 || len(transforms.pipelines.Broadcast) > 0
+		sentTransformed = sentTransformed || len(transforms.pipelines.Broadcast) > 0
+	}
+	if sentTransformed {
+		if published.raw, err = json.Marshal(published.sent); err != nil {
+			return published, fmt.Errorf("%w: couldn't encode transformed value for topic %s: %v", ErrTransformFailed, topicName, err)
+		}
+	}
+	return published, nil
+}
+
+// RedactFields will replace the fields at the dotted paths with REDACTED, such as "user.email".
+// Fields the value doesn't have are skipped, as are values that aren't objects.
+func RedactFields(paths ...string) Transform {
+	return TransformFunc(func(topicName string, value any) (any, error) {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return value, nil
+		}
+		for _, fieldPath := range paths {
+			if _, exists := lookupField(object, fieldPath); exists {
+				if err := setField(object, fieldPath, REDACTED); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return object, nil
+	})
+}
+
+// ScaleField will multiply the number at the dotted path by the factor, such as to normalize a
+// reading to other units. Values that don't have the field are skipped. Returns error if the field
+// isn't a number.
+func ScaleField(fieldPath string, factor float64) Transform {
+	return TransformFunc(func(topicName string, value any) (any, error) {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return value, nil
+		}
+		field, exists := lookupField(object, fieldPath)
+		if !exists {
+			return object, nil
+		}
+		number, ok := field.(float64)
+		if !ok {
+			return nil, fmt.Errorf("can't scale %s, it's a %T, not a number", fieldPath, field)
+		}
+		return object, setField(object, fieldPath, number*factor)
+	})
+}
+
+// AddTimestamp will set the field at the dotted path to the time the value was transformed on the
+// server, in RFC 3339 format. Values that aren't objects are skipped.
+func AddTimestamp(fieldPath string) Transform {
+	return TransformFunc(func(topicName string, value any) (any, error) {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return value, nil
+		}
+		return object, setField(object, fieldPath, time.Now().UTC().Format(time.RFC3339Nano))
+	})
+}
@@ -0,0 +1,220 @@
+package topic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// appendStep will add the step to the "steps" field of the value, so the order transforms ran in
+// can be checked.
+func appendStep(step string) Transform {
+	return TransformFunc(func(topicName string, value any) (any, error) {
+		object := value.(map[string]any)
+		steps, _ := object["steps"].([]any)
+		object["steps"] = append(steps, step)
+		return object, nil
+	})
+}
+
+func TestPipeline_AppliesInOrderOnACopy(t *testing.T) {
+	value := map[string]any{"reading": 2.0}
+	transformed, err := Pipeline{appendStep("redact"), appendStep("normalize"), appendStep("enrich")}.Apply("sensors", value)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"reading": 2.0, "steps": []any{"redact", "normalize", "enrich"}}, transformed)
+	assert.Equal(t, map[string]any{"reading": 2.0}, value, "the published value shouldn't be changed")
+
+	failing := TransformFunc(func(string, any) (any, error) { return nil, errors.New("bad reading") })
+	_, err = Pipeline{appendStep("redact"), failing}.Apply("sensors", value)
+	assert.ErrorIs(t, err, ErrTransformFailed)
+}
+
+func TestTransforms_PersistAndBroadcastDiverge(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{}, WithTransforms("sensors/*", TransformPipelines{
+		Persist:   Pipeline{ScaleField("temp", 0.001)},
+		Broadcast: Pipeline{RedactFields("owner.email"), AddTimestamp("receivedAt")},
+	}))
+	schema := map[string]any{"temp": 0.0, "owner": map[string]any{"email": ""}}
+	_, err := tm.RegisterTopic("sensors/kitchen", schema, TopicOptions{})
+	require.NoError(t, err)
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("sensors/kitchen", client, SubscriptionOptions{}))
+
+	before := time.Now().UTC()
+	published := map[string]any{"temp": 21500.0, "owner": map[string]any{"email": "cook@example.com"}}
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "sensors/kitchen"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), published, nil))
+
+	var sent map[string]any
+	require.NoError(t, json.Unmarshal(readMessage(t, remote).Data, &sent))
+	assert.Equal(t, 21500.0, sent["temp"])
+	assert.Equal(t, map[string]any{"email": REDACTED}, sent["owner"])
+	receivedAt, err := time.Parse(time.RFC3339Nano, sent["receivedAt"].(string))
+	require.NoError(t, err)
+	assert.False(t, receivedAt.Before(before))
+
+	stored := map[string]any{"temp": 21.5, "owner": map[string]any{"email": "cook@example.com"}}
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 1)
+	assert.Equal(t, stored, puts[0].Value)
+	value, err := tm.Get(context.Background(), "sensors/kitchen")
+	require.NoError(t, err)
+	assert.Equal(t, stored, value)
+	assert.Equal(t, map[string]any{"temp": 21500.0, "owner": map[string]any{"email": "cook@example.com"}}, published)
+}
+
+func TestTransforms_MatchingPatternsRunInOrder(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{},
+		WithTransforms("*", TransformPipelines{Persist: Pipeline{appendStep("all")}}),
+		WithTransforms("orders", TransformPipelines{Persist: Pipeline{appendStep("orders")}}),
+	)
+	registerTopics(t, tm, "orders", "other")
+
+	for _, topicName := range []string{"orders", "other"} {
+		msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: topicName}
+		require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "x"}, nil))
+	}
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 2)
+	assert.Equal(t, map[string]any{"a": "x", "steps": []any{"all", "orders"}}, puts[0].Value)
+	assert.Equal(t, map[string]any{"a": "x", "steps": []any{"all"}}, puts[1].Value)
+}
+
+func TestTransforms_AppliedToTransactions(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{}, WithTransforms("sensors/*", TransformPipelines{
+		Persist:   Pipeline{ScaleField("temp", 0.001)},
+		Broadcast: Pipeline{RedactFields("owner")},
+	}))
+	registerTopics(t, tm, "sensors/kitchen", "orders")
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("sensors/kitchen", client, SubscriptionOptions{}))
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publishTransaction"}
+	require.NoError(t, tm.PublishTransaction(context.Background(), msg, network.NewClient(nil, "publisher"), []TopicValue{
+		{Topic: "sensors/kitchen", Value: map[string]any{"temp": 21500.0, "owner": "cook"}},
+		{Topic: "orders", Value: map[string]any{"temp": 1.0}},
+	}))
+
+	var sent map[string]any
+	require.NoError(t, json.Unmarshal(readMessage(t, remote).Data, &sent))
+	assert.Equal(t, map[string]any{"temp": 21500.0, "owner": REDACTED}, sent)
+
+	batches := db.CallsTo("AsyncPutBatch")
+	require.Len(t, batches, 1)
+	assert.Equal(t, map[string]any{"temp": 21.5, "owner": "cook"}, batches[0].Batch[0].Value)
+	assert.Equal(t, map[string]any{"temp": 1.0}, batches[0].Batch[1].Value, "only matching topics are transformed")
+	value, err := tm.Get(context.Background(), "sensors/kitchen")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"temp": 21.5, "owner": "cook"}, value)
+}
+
+func TestTransforms_FailureRejectsPublish(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{}, WithTransforms("*", TransformPipelines{Broadcast: Pipeline{ScaleField("a", 2)}}))
+	registerTopics(t, tm, "orders")
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "orders"}
+	err := tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "not a number"}, nil)
+	assert.ErrorIs(t, err, ErrTransformFailed)
+	assert.Empty(t, db.CallsTo("AsyncPut"))
+}
+
+func TestTransforms_CompressedTopicStoresPersistedValue(t *testing.T) {
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{}, WithTransforms("*", TransformPipelines{Broadcast: Pipeline{RedactFields("secret")}}))
+	_, err := tm.RegisterTopic("vault", map[string]any{"secret": ""}, TopicOptions{Compressed: true})
+	require.NoError(t, err)
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "vault"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"secret": "hunter2"}, nil))
+
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 1)
+	topic, err := tm.ListTopics()
+	require.NoError(t, err)
+	stored, err := topic[0].decompressValue(puts[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"secret": "hunter2"}, stored)
+}
+
+// writeTransforms will write the contents to a transforms file and return its path.
+func writeTransforms(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "transforms.json")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestLoadTransforms_BuildsPipelines(t *testing.T) {
+	options, err := LoadTransforms(writeTransforms(t, `[
+		{
+			"pattern": "sensors/*",
+			"persist": [{"type": "scaleField", "field": "temp", "factor": 0.001}],
+			"broadcast": [{"type": "redactFields", "fields": ["owner.email"]}, {"type": "addTimestamp", "field": "receivedAt"}]
+		},
+		{"pattern": "sensors/kitchen", "persist": [{"type": "redactFields", "fields": ["secret"]}]}
+	]`))
+	require.NoError(t, err)
+	db := storagetest.NewRecordingStorage()
+	tm := NewTopicManager(db, &config.Config{}, options...)
+	_, err = tm.RegisterTopic("sensors/kitchen", map[string]any{"temp": 0.0, "secret": "", "owner": map[string]any{"email": ""}}, TopicOptions{})
+	require.NoError(t, err)
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("sensors/kitchen", client, SubscriptionOptions{}))
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "sensors/kitchen"}
+	published := map[string]any{"temp": 21500.0, "secret": "hunter2", "owner": map[string]any{"email": "cook@example.com"}}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), published, nil))
+
+	var sent map[string]any
+	require.NoError(t, json.Unmarshal(readMessage(t, remote).Data, &sent))
+	assert.Equal(t, map[string]any{"email": REDACTED}, sent["owner"])
+	assert.Contains(t, sent, "receivedAt")
+	puts := db.CallsTo("AsyncPut")
+	require.Len(t, puts, 1)
+	assert.Equal(t, map[string]any{"temp": 21.5, "secret": REDACTED, "owner": map[string]any{"email": "cook@example.com"}}, puts[0].Value)
+}
+
+func TestLoadTransforms_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":        `[{"pattern": "*", "transforms": []}]`,
+		"blank pattern":        `[{"pattern": " ", "persist": [{"type": "addTimestamp", "field": "at"}]}]`,
+		"malformed pattern":    `[{"pattern": "[", "persist": [{"type": "addTimestamp", "field": "at"}]}]`,
+		"unknown transform":    `[{"pattern": "*", "persist": [{"type": "uppercase", "field": "name"}]}]`,
+		"redact without field": `[{"pattern": "*", "broadcast": [{"type": "redactFields"}]}]`,
+		"scale without factor": `[{"pattern": "*", "persist": [{"type": "scaleField", "field": "temp"}]}]`,
+		"not json":             `[{"pattern": `,
+	}
+	for name, contents := range tests {
+		_, err := LoadTransforms(writeTransforms(t, contents))
+		assert.Error(t, err, name)
+	}
+
+	_, err := LoadTransforms(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestScaleField(t *testing.T) {
+	scaled, err := ScaleField("reading.value", 10).Transform("sensors", map[string]any{"reading": map[string]any{"value": 1.5}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"reading": map[string]any{"value": 15.0}}, scaled)
+
+	skipped, err := ScaleField("missing", 10).Transform("sensors", map[string]any{"a": 1.0})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"a": 1.0}, skipped)
+
+	_, err = ScaleField("a", 10).Transform("sensors", map[string]any{"a": "1"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,145 @@
+package topic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_WEBHOOK_TIMEOUT    = 5 * time.Second
+	DEFAULT_WEBHOOK_ATTEMPTS   = 3
+	DEFAULT_WEBHOOK_BACKOFF    = 200 * time.Millisecond
+	DEFAULT_WEBHOOK_QUEUE_SIZE = 256
+)
+
+// webhookPayload is the body that is posted to a topic's webhook for every publish.
+type webhookPayload struct {
+	Topic     string    `json:"topic"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      any       `json:"data"`
+}
+
+// webhookSink posts the values published to a topic to an external endpoint. Values are
+// queued and posted in order by a single goroutine so a slow or failing endpoint never
+// blocks publishing. If the queue is full the value is dropped and logged.
+type webhookSink struct {
+	url      string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	queue    chan webhookPayload
+	ctx      context.Context // done once the sink is stopped, so posts in flight are cancelled
+	cancel   context.CancelFunc
+}
+
+// newWebhookSink will create a webhook sink for a url and start the goroutine that posts to it.
+func newWebhookSink(url string) *webhookSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhookSink{
+		url: url,
+		client: &http.Client{
+			Timeout: DEFAULT_WEBHOOK_TIMEOUT,
+			// a redirect could point anywhere, so only the allowed host is ever posted to
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		attempts: DEFAULT_WEBHOOK_ATTEMPTS,
+		backoff:  DEFAULT_WEBHOOK_BACKOFF,
+		queue:    make(chan webhookPayload, DEFAULT_WEBHOOK_QUEUE_SIZE),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go w.run()
+	return w
+}
+
+// Send will queue a value to be posted to the webhook.
+func (w *webhookSink) Send(topicName string, value any, timestamp time.Time) {
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	select {
+	case w.queue <- webhookPayload{Topic: topicName, Timestamp: timestamp, Data: value}:
+	default:
+		log.WithFields(log.Fields{"topic": topicName, "url": w.url}).Warn("webhook queue is full, dropping value")
+	}
+}
+
+// Stop will stop posting to the webhook. Anything still queued is dropped.
+func (w *webhookSink) Stop() {
+	w.cancel()
+}
+
+func (w *webhookSink) run() {
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case payload := <-w.queue:
+			w.deliver(payload)
+		}
+	}
+}
+
+// deliver will post a payload to the webhook, retrying with backoff on connection errors
+// and 5xx responses. Failures are logged since the publish has already gone out.
+func (w *webhookSink) deliver(payload webhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.WithFields(log.Fields{"topic": payload.Topic, "url": w.url}).Errorf("could not marshal webhook payload: %v", err)
+		return
+	}
+
+	backoff := w.backoff
+	for attempt := 1; attempt <= w.attempts; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			return
+		}
+
+		fields := log.Fields{"topic": payload.Topic, "url": w.url, "attempt": attempt}
+		if !retry || attempt == w.attempts {
+			log.WithFields(fields).Errorf("webhook delivery failed: %v", err)
+			return
+		}
+		log.WithFields(fields).Warnf("webhook delivery failed, retrying: %v", err)
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post will send the body to the webhook once. Returns if the request should be retried
+// along with the error.
+func (w *webhookSink) post(body []byte) (bool, error) {
+	// cancelled by Stop, so a hung endpoint doesn't hold up shutdown
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return false, nil
+}
@@ -0,0 +1,197 @@
+package topic
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atyalexyoung/data-loom/server/internal/config"
+	"github.com/atyalexyoung/data-loom/server/internal/network"
+	"github.com/atyalexyoung/data-loom/server/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookConfig will return a config that allows webhooks to the test servers.
+func webhookConfig() *config.Config {
+	return &config.Config{WebhookAllowedHosts: []string{"127.0.0.1"}}
+}
+
+// newWebhookTopic will register a topic with a webhook pointed at the url.
+func newWebhookTopic(t *testing.T, tm TopicManager, topicName string, url string) *Topic {
+	topic, err := tm.RegisterTopic(topicName, map[string]any{"a": ""}, TopicOptions{WebhookURL: url})
+	require.NoError(t, err)
+	require.NotNil(t, topic.webhook)
+	topic.webhook.backoff = 10 * time.Millisecond
+	t.Cleanup(topic.webhook.Stop)
+	return topic
+}
+
+func TestWebhook_PublishIsPosted(t *testing.T) {
+	received := make(chan webhookPayload, 1)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var payload webhookPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		received <- payload
+	}))
+	defer sink.Close()
+
+	tm := NewTopicManager(storage.NewNullStorage(), webhookConfig())
+	newWebhookTopic(t, tm, "mirrored", sink.URL)
+
+	before := time.Now().UTC()
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "mirrored"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	select {
+	case payload := <-received:
+		assert.Equal(t, "mirrored", payload.Topic)
+		assert.Equal(t, map[string]any{"a": "1"}, payload.Data)
+		assert.False(t, payload.Timestamp.Before(before.Truncate(time.Millisecond)))
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook was never posted to")
+	}
+}
+
+func TestWebhook_RetriesServerErrors(t *testing.T) {
+	var attempts atomic.Int32
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer sink.Close()
+
+	tm := NewTopicManager(storage.NewNullStorage(), webhookConfig())
+	newWebhookTopic(t, tm, "retried", sink.URL)
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "retried"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	assert.Eventually(t, func() bool { return attempts.Load() == 3 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond) // no more attempts after the success
+	assert.Equal(t, int32(3), attempts.Load())
+}
+
+func TestWebhook_ClientErrorsNotRetried(t *testing.T) {
+	var attempts atomic.Int32
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer sink.Close()
+
+	tm := NewTopicManager(storage.NewNullStorage(), webhookConfig())
+	newWebhookTopic(t, tm, "rejected", sink.URL)
+
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "rejected"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	assert.Eventually(t, func() bool { return attempts.Load() == 1 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestWebhook_SlowSinkDoesNotBlockPublish(t *testing.T) {
+	release := make(chan struct{})
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer sink.Close()
+	defer close(release)
+
+	tm := NewTopicManager(storage.NewNullStorage(), webhookConfig())
+	newWebhookTopic(t, tm, "slow", sink.URL)
+
+	client, remote := newTestClient(t, "subscriber")
+	require.NoError(t, tm.Subscribe("slow", client, SubscriptionOptions{}))
+
+	start := time.Now()
+	sender := network.NewClient(nil, "publisher")
+	for i := 0; i < 5; i++ {
+		msg := network.WebSocketMessage{MessageId: "slow", Action: "publish", Topic: "slow"}
+		require.NoError(t, tm.Publish(context.Background(), msg, sender, map[string]any{"a": "1"}, nil))
+	}
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, "slow", readMessage(t, remote).MessageId)
+}
+
+func TestWebhook_HostNotAllowed(t *testing.T) {
+	tm := NewTopicManager(storage.NewNullStorage(), &config.Config{})
+	_, err := tm.RegisterTopic("internal", map[string]any{"a": ""}, TopicOptions{WebhookURL: "http://169.254.169.254/latest"})
+	assert.ErrorIs(t, err, ErrWebhookNotAllowed, "webhooks shouldn't be allowed without allowed hosts")
+
+	tm = NewTopicManager(storage.NewNullStorage(), &config.Config{WebhookAllowedHosts: []string{"hooks.example.com", "sink:8080"}})
+	_, err = tm.RegisterTopic("other", map[string]any{"a": ""}, TopicOptions{WebhookURL: "http://hooks.example.com.evil.test/"})
+	assert.ErrorIs(t, err, ErrWebhookNotAllowed)
+	_, err = tm.RegisterTopic("port", map[string]any{"a": ""}, TopicOptions{WebhookURL: "http://sink:9090/"})
+	assert.ErrorIs(t, err, ErrWebhookNotAllowed, "a host allowed with a port should only be allowed on that port")
+	assert.False(t, tm.HasTopic("other"))
+
+	_, err = tm.RegisterTopic("allowed", map[string]any{"a": ""}, TopicOptions{WebhookURL: "https://HOOKS.example.com:8443/data"})
+	require.NoError(t, err)
+	_, err = tm.RegisterTopic("allowedPort", map[string]any{"a": ""}, TopicOptions{WebhookURL: "http://sink:8080/"})
+	require.NoError(t, err)
+}
+
+func TestWebhook_RedirectsNotFollowed(t *testing.T) {
+	var redirected atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected.Add(1)
+	}))
+	defer target.Close()
+	var attempts atomic.Int32
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer sink.Close()
+
+	tm := NewTopicManager(storage.NewNullStorage(), webhookConfig())
+	newWebhookTopic(t, tm, "redirected", sink.URL)
+	msg := network.WebSocketMessage{MessageId: "1", Action: "publish", Topic: "redirected"}
+	require.NoError(t, tm.Publish(context.Background(), msg, network.NewClient(nil, "publisher"), map[string]any{"a": "1"}, nil))
+
+	require.Eventually(t, func() bool { return attempts.Load() == 1 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), redirected.Load())
+}
+
+func TestWebhook_StopCancelsPost(t *testing.T) {
+	posted := make(chan struct{})
+	release := make(chan struct{})
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(posted)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer sink.Close()
+	defer close(release)
+
+	webhook := newWebhookSink(sink.URL)
+	webhook.Send("hung", map[string]any{"a": "1"}, time.Now())
+	<-posted
+
+	cancelled := make(chan struct{})
+	go func() {
+		_, err := webhook.post([]byte("{}"))
+		assert.ErrorIs(t, err, context.Canceled)
+		close(cancelled)
+	}()
+	webhook.Stop()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("stopping the webhook should cancel posts in flight")
+	}
+}
@@ -25,12 +25,13 @@ func startTestServer(t *testing.T) (*http.Server, context.CancelFunc, string, st
 	}
 
 	clientHub := network.NewClientHub()
-	topicManager := topic.NewTopicManager(db)
+	topicManager := topic.NewTopicManager(db, cfg)
 	wsServer := server.NewWebSocketServer(clientHub, topicManager, cfg)
 
 	srv := &http.Server{
-		Addr:    ":0", // OS assigns free port
-		Handler: wsServer.Handler(),
+		Addr:              ":0", // OS assigns free port
+		Handler:           wsServer.Handler(),
+		ReadHeaderTimeout: cfg.HandshakeTimeout,
 	}
 
 	ln, err := net.Listen("tcp4", "127.0.0.1:0")
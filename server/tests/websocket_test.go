@@ -2,8 +2,12 @@ package tests
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -57,6 +61,59 @@ func TestWebSocketServer(t *testing.T) {
 	t.Logf("Received: %s", resp)
 }
 
+// Test that a client that never finishes the handshake gets dropped
+func TestSlowHandshakeIsAborted(t *testing.T) {
+	t.Setenv("HANDSHAKE_TIMEOUT", "200ms")
+	srv, cancel, url, db := startTestServer(t)
+	defer cancel()
+	defer srv.Close()
+	defer db.Close()
+
+	conn, err := net.Dial("tcp4", strings.TrimSuffix(strings.TrimPrefix(url, "ws://"), "/ws"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// write a partial upgrade request and never finish it
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	start := time.Now()
+	_, err = io.ReadAll(conn)
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("expected server to close the connection before the test deadline")
+	}
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+// Test that a completed handshake isn't affected by the handshake timeout
+func TestHandshakeTimeoutDoesNotAffectUpgradedConnection(t *testing.T) {
+	t.Setenv("HANDSHAKE_TIMEOUT", "200ms")
+	srv, cancel, url, db := startTestServer(t)
+	defer cancel()
+	defer srv.Close()
+	defer db.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial(url, http.Header{})
+	require.NoError(t, err)
+	defer c.Close()
+
+	time.Sleep(500 * time.Millisecond) // wait past the handshake timeout
+
+	msg := WebSocketMessage{
+		Id:         "afterHandshake",
+		Action:     "listTopics",
+		RequireAck: true,
+	}
+	require.NoError(t, c.WriteJSON(msg))
+
+	var resp WebSocketMessage
+	require.NoError(t, c.ReadJSON(&resp))
+	assert.Equal(t, "afterHandshake", resp.Id)
+}
+
 // test subscribe to existing topic
 
 // test message with invalid action